@@ -0,0 +1,462 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PathBlockingStatus   = "/api/blocking/status"
+	PathBlockingEnable   = "/api/blocking/enable"
+	PathBlockingDisable  = "/api/blocking/disable"
+	PathBlockingQuery    = "/api/blocking/query"
+	PathListsRefresh     = "/api/lists/refresh"
+	PathListsBlacklist   = "/api/lists/blacklist"
+	PathListsWhitelist   = "/api/lists/whitelist"
+	PathCacheFlush       = "/api/cache/flush"
+	PathClientNamesFlush = "/api/clientnames/flush"
+	PathHealth           = "/healthz"
+	PathStatus           = "/api/status"
+	PathStats            = "/api/stats"
+	PathQuery            = "/api/query"
+)
+
+// max size of the JSON body of query requests
+const maxQueryRequestSize = 4096
+
+// BlockingStatus represents the current blocking state
+type BlockingStatus struct {
+	// true if blocking is enabled
+	Enabled bool `json:"enabled"`
+	// if blocking is temporary disabled: amount of seconds until blocking will be enabled
+	AutoEnableInSec uint `json:"autoEnableInSec"`
+	// state of block groups with schedule
+	ScheduledGroups []GroupSchedule `json:"scheduledGroups,omitempty"`
+}
+
+// GroupSchedule is the current state of a block group with schedule
+type GroupSchedule struct {
+	Group string `json:"group"`
+	// true if the group is currently used for blocking
+	Active bool `json:"active"`
+	// next activation or deactivation of the group, empty if the state doesn't change
+	NextToggle *time.Time `json:"nextToggle,omitempty"`
+}
+
+// BlockingControl can enable and disable blocking
+type BlockingControl interface {
+	EnableBlocking()
+	// disables blocking, duration 0 means infinite
+	DisableBlocking(duration time.Duration)
+	BlockingStatus() BlockingStatus
+}
+
+// ListMatch is the list entry, which matches a domain
+type ListMatch struct {
+	Group string `json:"group"`
+	// matching list (link) in the group
+	List string `json:"list"`
+	// matching entry of the list, e.g. the domain, a parent domain, a wildcard or a regular expression
+	Entry string `json:"entry"`
+}
+
+// BlockingExplanation describes, if and why a domain would be blocked for a client
+type BlockingExplanation struct {
+	Domain string `json:"domain"`
+	Client string `json:"client"`
+	// groups, which are checked for the client
+	Groups []string `json:"groups"`
+	// false if blocking is disabled or the lists are not loaded yet
+	BlockingEnabled bool `json:"blockingEnabled"`
+	Blocked         bool `json:"blocked"`
+	// reason of the decision, e.g. "BLOCKED (ads)" or "WHITELISTED (ads)"
+	Reason    string     `json:"reason"`
+	Blacklist *ListMatch `json:"blacklist,omitempty"`
+	// a whitelist match overrides the blacklist match
+	Whitelist *ListMatch `json:"whitelist,omitempty"`
+}
+
+// BlockingExplainer checks a domain against the black and white lists without resolving it
+type BlockingExplainer interface {
+	// client is an IP address or a client name
+	ExplainBlocking(domain string, client string) BlockingExplanation
+}
+
+// ListRefresher can reload black and white lists
+type ListRefresher interface {
+	// triggers asynchronous reload of all lists
+	RefreshLists()
+}
+
+// ListEntryControl can add and remove entries of black and white lists at runtime
+type ListEntryControl interface {
+	// adds domain to the group of the list type ("blacklist" or "whitelist"), returns error if the domain is invalid
+	AddListEntry(listType string, group string, domain string) error
+	// removes domain, which was added at runtime. Returns false if the entry doesn't exist
+	RemoveListEntry(listType string, group string, domain string) bool
+	// returns entries per group, which were added at runtime
+	ListEntries(listType string) map[string][]string
+}
+
+// CacheControl can remove entries from the cache
+type CacheControl interface {
+	// removes entries of passed domain and its sub domains, whole cache if domain is empty.
+	// Returns number of removed entries
+	FlushCache(domain string) int
+}
+
+// ClientNamesControl can remove cached client names
+type ClientNamesControl interface {
+	// removes all cached client names, returns number of removed entries
+	FlushClientNames() int
+}
+
+// HealthChecker checks if queries can be resolved
+type HealthChecker interface {
+	// resolves the probe domain, returns error if the resolution fails
+	CheckHealth(ctx context.Context) error
+}
+
+// Status contains the current state of the server
+type Status struct {
+	StartTime time.Time      `json:"startTime"`
+	UptimeSec uint64         `json:"uptimeSec"`
+	Blocking  BlockingStatus `json:"blocking"`
+	// entry counts of black and white lists
+	Lists []ListStatus `json:"lists"`
+	// number of cached responses
+	CacheEntries int              `json:"cacheEntries"`
+	Upstreams    []UpstreamStatus `json:"upstreams"`
+	// resolvers in chain order
+	Resolvers []ResolverStatus `json:"resolvers"`
+}
+
+// ListStatus contains entry counts per group of black or white lists
+type ListStatus struct {
+	// blacklist or whitelist
+	Type        string         `json:"type"`
+	Entries     map[string]int `json:"entries"`
+	LastRefresh time.Time      `json:"lastRefresh"`
+}
+
+// UpstreamStatus contains statistics of recent requests to one upstream
+type UpstreamStatus struct {
+	Name         string  `json:"name"`
+	Requests     uint64  `json:"requests"`
+	Errors       uint64  `json:"errors"`
+	AvgLatencyMs float64 `json:"avgLatencyMs"`
+	// probability of the upstream to be selected for a request (0..1), weighted by latency and error rate
+	Weight float64 `json:"weight"`
+	// true if the upstream is evicted temporarily after consecutive failures
+	Evicted bool `json:"evicted"`
+}
+
+// ResolverStatus contains the name and configuration of one resolver in the chain
+type ResolverStatus struct {
+	Name          string   `json:"name"`
+	Configuration []string `json:"configuration"`
+}
+
+// StatusProvider returns the current state of the server
+type StatusProvider interface {
+	Status() Status
+}
+
+// Stats contains query statistics of the completed hours of the last 24 hours
+type Stats struct {
+	TotalQueries      int          `json:"totalQueries"`
+	BlockedQueries    int          `json:"blockedQueries"`
+	TopQueries        []StatsEntry `json:"topQueries"`
+	TopBlockedQueries []StatsEntry `json:"topBlockedQueries"`
+	TopClients        []StatsEntry `json:"topClients"`
+	Reasons           []StatsEntry `json:"reasons"`
+	QueryTypes        []StatsEntry `json:"queryTypes"`
+	ResponseTypes     []StatsEntry `json:"responseTypes"`
+}
+
+// StatsEntry is a counted value, e.g. a domain or client name
+type StatsEntry struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// StatsProvider returns the query statistics
+type StatsProvider interface {
+	Stats() Stats
+}
+
+// QueryRequest is a DNS query, which is resolved by the query endpoint
+type QueryRequest struct {
+	Name string `json:"name"`
+	// query type, e.g. A or AAAA. Default: A
+	Type string `json:"type"`
+	// optional: IP address or name of the client to simulate. Default: IP address of the caller
+	Client string `json:"client"`
+}
+
+// QueryResult is the answer of the resolver chain for a query
+type QueryResult struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	ClientIP    string   `json:"clientIP"`
+	ClientNames []string `json:"clientNames"`
+	// return code of the answer, e.g. NOERROR or NXDOMAIN
+	ResponseCode string `json:"responseCode"`
+	// reason of the answer, e.g. "RESOLVED (udp:1.1.1.1:53)", "CACHED" or "BLOCKED (ads)"
+	Reason string `json:"reason"`
+	// resolver, which produced the answer: RESOLVED, CACHED, BLOCKED, CONDITIONAL, CUSTOM DNS or FILTERED
+	ResponseType string `json:"responseType"`
+	Blocked      bool   `json:"blocked"`
+	Cached       bool   `json:"cached"`
+	// upstream (with protocol), which answered the query, empty if the answer was not received from an upstream
+	Upstream   string        `json:"upstream,omitempty"`
+	Answers    []QueryAnswer `json:"answers"`
+	DurationMs int64         `json:"durationMs"`
+	// resolution error, the response code is SERVFAIL
+	Error string `json:"error,omitempty"`
+}
+
+// QueryAnswer is a record of the answer
+type QueryAnswer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	// record data, e.g. the IP address of A records
+	Value string `json:"value"`
+}
+
+// QueryResolver resolves queries with the resolver chain like DNS requests
+type QueryResolver interface {
+	// resolves the query as if it was sent by the client of the query or (if not set) by the caller.
+	// Returns error if the query is invalid
+	Query(ctx context.Context, query QueryRequest, callerIP net.IP) (QueryResult, error)
+}
+
+// CacheFlushResult is the response of cache flush endpoint
+type CacheFlushResult struct {
+	RemovedCount int `json:"removedCount"`
+}
+
+func logger() *logrus.Entry {
+	return logrus.WithField("prefix", "api")
+}
+
+// RegisterEndpoint registers blocking control endpoints
+func RegisterEndpoint(router *http.ServeMux, control BlockingControl) {
+	router.HandleFunc(PathBlockingStatus, allowMethod(http.MethodGet, func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, control.BlockingStatus())
+	}))
+
+	router.HandleFunc(PathBlockingEnable, allowMethod(http.MethodPost, func(rw http.ResponseWriter, req *http.Request) {
+		control.EnableBlocking()
+		logger().Info("blocking enabled")
+
+		writeJSON(rw, control.BlockingStatus())
+	}))
+
+	router.HandleFunc(PathBlockingDisable, allowMethod(http.MethodPost, func(rw http.ResponseWriter, req *http.Request) {
+		var duration time.Duration
+
+		if d := req.URL.Query().Get("duration"); d != "" {
+			var err error
+			if duration, err = time.ParseDuration(d); err != nil || duration < 0 {
+				http.Error(rw, fmt.Sprintf("invalid duration '%s'", d), http.StatusBadRequest)
+				return
+			}
+		}
+
+		control.DisableBlocking(duration)
+		logger().WithField("duration", duration).Info("blocking disabled")
+
+		writeJSON(rw, control.BlockingStatus())
+	}))
+}
+
+// RegisterBlockingQueryEndpoint registers endpoint, which explains if a domain would be blocked for a client
+func RegisterBlockingQueryEndpoint(router *http.ServeMux, explainer BlockingExplainer) {
+	router.HandleFunc(PathBlockingQuery, allowMethod(http.MethodGet, func(rw http.ResponseWriter, req *http.Request) {
+		domain := strings.TrimSuffix(strings.TrimSpace(req.URL.Query().Get("domain")), ".")
+		if domain == "" {
+			http.Error(rw, "parameter 'domain' is missing", http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(rw, explainer.ExplainBlocking(domain, strings.TrimSpace(req.URL.Query().Get("client"))))
+	}))
+}
+
+// RegisterListsEndpoint registers endpoint for list refresh
+func RegisterListsEndpoint(router *http.ServeMux, refresher ListRefresher) {
+	router.HandleFunc(PathListsRefresh, allowMethod(http.MethodPost, func(rw http.ResponseWriter, req *http.Request) {
+		logger().Info("list refresh requested")
+		refresher.RefreshLists()
+
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+}
+
+// RegisterListEntriesEndpoint registers endpoints to list (GET), add (POST) and remove (DELETE) black and white list
+// entries at runtime, parameters "group" and "domain"
+func RegisterListEntriesEndpoint(router *http.ServeMux, control ListEntryControl) {
+	for path, listType := range map[string]string{PathListsBlacklist: "blacklist", PathListsWhitelist: "whitelist"} {
+		listType := listType
+
+		router.HandleFunc(path, func(rw http.ResponseWriter, req *http.Request) {
+			group := req.URL.Query().Get("group")
+			domain := req.URL.Query().Get("domain")
+
+			switch req.Method {
+			case http.MethodGet:
+			case http.MethodPost:
+				if err := control.AddListEntry(listType, group, domain); err != nil {
+					http.Error(rw, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				logger().WithFields(logrus.Fields{"group": group, "domain": domain}).Infof("%s entry added", listType)
+			case http.MethodDelete:
+				if !control.RemoveListEntry(listType, group, domain) {
+					http.Error(rw, "entry not found", http.StatusNotFound)
+					return
+				}
+
+				logger().WithFields(logrus.Fields{"group": group, "domain": domain}).Infof("%s entry removed", listType)
+			default:
+				http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			writeJSON(rw, control.ListEntries(listType))
+		})
+	}
+}
+
+// RegisterCacheEndpoint registers endpoint for cache flush
+func RegisterCacheEndpoint(router *http.ServeMux, control CacheControl) {
+	router.HandleFunc(PathCacheFlush, allowMethod(http.MethodPost, func(rw http.ResponseWriter, req *http.Request) {
+		count := control.FlushCache(req.URL.Query().Get("domain"))
+
+		writeJSON(rw, CacheFlushResult{RemovedCount: count})
+	}))
+}
+
+// RegisterClientNamesEndpoint registers endpoint to flush the client names cache
+func RegisterClientNamesEndpoint(router *http.ServeMux, control ClientNamesControl) {
+	router.HandleFunc(PathClientNamesFlush, allowMethod(http.MethodPost, func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, CacheFlushResult{RemovedCount: control.FlushClientNames()})
+	}))
+}
+
+// RegisterStatusEndpoint registers endpoint for the server status
+func RegisterStatusEndpoint(router *http.ServeMux, provider StatusProvider) {
+	router.HandleFunc(PathStatus, allowMethod(http.MethodGet, func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, provider.Status())
+	}))
+}
+
+// RegisterStatsEndpoint registers endpoint for query statistics
+func RegisterStatsEndpoint(router *http.ServeMux, provider StatsProvider) {
+	router.HandleFunc(PathStats, allowMethod(http.MethodGet, func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, provider.Stats())
+	}))
+}
+
+// RegisterQueryEndpoint registers endpoint, which resolves a query with the resolver chain: GET with parameters
+// "name", "type" and "client" or POST with QueryRequest as JSON body
+func RegisterQueryEndpoint(router *http.ServeMux, resolver QueryResolver) {
+	router.HandleFunc(PathQuery, func(rw http.ResponseWriter, req *http.Request) {
+		var query QueryRequest
+
+		switch req.Method {
+		case http.MethodGet:
+			query = QueryRequest{
+				Name:   req.URL.Query().Get("name"),
+				Type:   req.URL.Query().Get("type"),
+				Client: req.URL.Query().Get("client"),
+			}
+		case http.MethodPost:
+			if err := json.NewDecoder(io.LimitReader(req.Body, maxQueryRequestSize)).Decode(&query); err != nil {
+				http.Error(rw, fmt.Sprintf("can't parse query: %v", err), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query.Name = strings.TrimSpace(query.Name)
+		query.Client = strings.TrimSpace(query.Client)
+
+		if query.Name == "" {
+			http.Error(rw, "parameter 'name' is missing", http.StatusBadRequest)
+			return
+		}
+
+		if query.Type = strings.ToUpper(strings.TrimSpace(query.Type)); query.Type == "" {
+			query.Type = "A"
+		}
+
+		result, err := resolver.Query(req.Context(), query, remoteIP(req))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(rw, result)
+	})
+}
+
+// returns the IP address of the caller
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// RegisterHealthEndpoint registers health check endpoint: 200 if a query could be resolved, 503 otherwise
+func RegisterHealthEndpoint(router *http.ServeMux, checker HealthChecker, timeout time.Duration) {
+	router.HandleFunc(PathHealth, allowMethod(http.MethodGet, func(rw http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+
+		if err := checker.CheckHealth(ctx); err != nil {
+			logger().Warn("health check failed: ", err)
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+
+			return
+		}
+
+		_, _ = rw.Write([]byte("OK"))
+	}))
+}
+
+// returns handler, which rejects requests with other methods than passed method
+func allowMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(rw).Encode(value); err != nil {
+		logger().Error("can't write response: ", err)
+	}
+}
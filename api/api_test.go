@@ -0,0 +1,374 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type blockingControlMock struct {
+	mock.Mock
+}
+
+func (m *blockingControlMock) EnableBlocking() {
+	m.Called()
+}
+
+func (m *blockingControlMock) DisableBlocking(duration time.Duration) {
+	m.Called(duration)
+}
+
+func (m *blockingControlMock) BlockingStatus() BlockingStatus {
+	return m.Called().Get(0).(BlockingStatus)
+}
+
+func call(router *http.ServeMux, method, url string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+
+	return rec
+}
+
+func Test_BlockingStatus(t *testing.T) {
+	m := &blockingControlMock{}
+	m.On("BlockingStatus").Return(BlockingStatus{Enabled: false, AutoEnableInSec: 300})
+
+	router := http.NewServeMux()
+	RegisterEndpoint(router, m)
+
+	rec := call(router, http.MethodGet, PathBlockingStatus)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var status BlockingStatus
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	assert.Equal(t, BlockingStatus{Enabled: false, AutoEnableInSec: 300}, status)
+
+	rec = call(router, http.MethodPost, PathBlockingStatus)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func Test_BlockingEnableDisable(t *testing.T) {
+	m := &blockingControlMock{}
+	m.On("BlockingStatus").Return(BlockingStatus{Enabled: true})
+	m.On("EnableBlocking")
+	m.On("DisableBlocking", 5*time.Minute)
+	m.On("DisableBlocking", time.Duration(0))
+
+	router := http.NewServeMux()
+	RegisterEndpoint(router, m)
+
+	assert.Equal(t, http.StatusOK, call(router, http.MethodPost, PathBlockingEnable).Code)
+	assert.Equal(t, http.StatusOK, call(router, http.MethodPost, PathBlockingDisable+"?duration=5m").Code)
+	assert.Equal(t, http.StatusOK, call(router, http.MethodPost, PathBlockingDisable).Code)
+	assert.Equal(t, http.StatusBadRequest, call(router, http.MethodPost, PathBlockingDisable+"?duration=abc").Code)
+	assert.Equal(t, http.StatusBadRequest, call(router, http.MethodPost, PathBlockingDisable+"?duration=-5m").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, call(router, http.MethodGet, PathBlockingEnable).Code)
+
+	m.AssertExpectations(t)
+}
+
+type blockingExplainerMock struct {
+	mock.Mock
+}
+
+func (m *blockingExplainerMock) ExplainBlocking(domain string, client string) BlockingExplanation {
+	return m.Called(domain, client).Get(0).(BlockingExplanation)
+}
+
+func Test_BlockingQuery(t *testing.T) {
+	m := &blockingExplainerMock{}
+	m.On("ExplainBlocking", "example.com", "192.168.1.5").Return(BlockingExplanation{
+		Domain: "example.com", Client: "192.168.1.5", Groups: []string{"ads"}, BlockingEnabled: true, Blocked: true,
+		Reason: "BLOCKED (ads)", Blacklist: &ListMatch{Group: "ads", List: "ads.txt", Entry: "example.com"},
+	})
+
+	router := http.NewServeMux()
+	RegisterBlockingQueryEndpoint(router, m)
+
+	rec := call(router, http.MethodGet, PathBlockingQuery+"?domain=example.com.&client=192.168.1.5")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"domain":"example.com","client":"192.168.1.5","groups":["ads"],"blockingEnabled":true,
+		"blocked":true,"reason":"BLOCKED (ads)","blacklist":{"group":"ads","list":"ads.txt","entry":"example.com"}}`,
+		rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, call(router, http.MethodGet, PathBlockingQuery+"?client=1.2.3.4").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, call(router, http.MethodPost, PathBlockingQuery+"?domain=a.com").Code)
+
+	m.AssertExpectations(t)
+}
+
+type queryResolverMock struct {
+	mock.Mock
+}
+
+func (m *queryResolverMock) Query(_ context.Context, query QueryRequest, callerIP net.IP) (QueryResult, error) {
+	args := m.Called(query, callerIP.String())
+	return args.Get(0).(QueryResult), args.Error(1)
+}
+
+func Test_Query(t *testing.T) {
+	result := QueryResult{Name: "example.com.", Type: "A", ClientIP: "192.168.1.5", ClientNames: []string{"laptop"},
+		ResponseCode: "NOERROR", Reason: "CACHED", ResponseType: "CACHED", Cached: true,
+		Answers: []QueryAnswer{{Name: "example.com.", Type: "A", TTL: 250, Value: "93.184.216.34"}}, DurationMs: 1}
+
+	m := &queryResolverMock{}
+	m.On("Query", QueryRequest{Name: "example.com", Type: "A", Client: "192.168.1.5"}, "192.0.2.1").
+		Return(result, nil)
+	m.On("Query", QueryRequest{Name: "example.com", Type: "AAAA", Client: "laptop"}, "192.0.2.1").
+		Return(result, nil)
+	m.On("Query", QueryRequest{Name: "example.com", Type: "XYZ"}, "192.0.2.1").
+		Return(QueryResult{}, errors.New("unknown query type 'XYZ'"))
+
+	router := http.NewServeMux()
+	RegisterQueryEndpoint(router, m)
+
+	rec := call(router, http.MethodGet, PathQuery+"?name=example.com&client=192.168.1.5")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"name":"example.com.","type":"A","clientIP":"192.168.1.5","clientNames":["laptop"],
+		"responseCode":"NOERROR","reason":"CACHED","responseType":"CACHED","blocked":false,"cached":true,
+		"answers":[{"name":"example.com.","type":"A","ttl":250,"value":"93.184.216.34"}],"durationMs":1}`,
+		rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, PathQuery,
+		strings.NewReader(`{"name":" example.com","type":"aaaa","client":"laptop"}`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = call(router, http.MethodGet, PathQuery+"?name=example.com&type=xyz")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "unknown query type 'XYZ'")
+
+	assert.Equal(t, http.StatusBadRequest, call(router, http.MethodGet, PathQuery+"?type=A").Code)
+	assert.Equal(t, http.StatusBadRequest, call(router, http.MethodPost, PathQuery).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, call(router, http.MethodDelete, PathQuery).Code)
+
+	m.AssertExpectations(t)
+}
+
+type listRefresherMock struct {
+	mock.Mock
+}
+
+func (m *listRefresherMock) RefreshLists() {
+	m.Called()
+}
+
+func Test_ListsRefresh(t *testing.T) {
+	m := &listRefresherMock{}
+	m.On("RefreshLists")
+
+	router := http.NewServeMux()
+	RegisterListsEndpoint(router, m)
+
+	assert.Equal(t, http.StatusAccepted, call(router, http.MethodPost, PathListsRefresh).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, call(router, http.MethodGet, PathListsRefresh).Code)
+
+	m.AssertNumberOfCalls(t, "RefreshLists", 1)
+}
+
+type listEntryControlMock struct {
+	mock.Mock
+}
+
+func (m *listEntryControlMock) AddListEntry(listType string, group string, domain string) error {
+	return m.Called(listType, group, domain).Error(0)
+}
+
+func (m *listEntryControlMock) RemoveListEntry(listType string, group string, domain string) bool {
+	return m.Called(listType, group, domain).Bool(0)
+}
+
+func (m *listEntryControlMock) ListEntries(listType string) map[string][]string {
+	return m.Called(listType).Get(0).(map[string][]string)
+}
+
+func Test_ListEntries(t *testing.T) {
+	m := &listEntryControlMock{}
+	m.On("AddListEntry", "blacklist", "ads", "example.com").Return(nil)
+	m.On("AddListEntry", "blacklist", "ads", "in valid").Return(errors.New("invalid domain 'in valid'"))
+	m.On("RemoveListEntry", "whitelist", "ads", "example.com").Return(true)
+	m.On("RemoveListEntry", "whitelist", "ads", "other.com").Return(false)
+	m.On("ListEntries", "blacklist").Return(map[string][]string{"ads": {"example.com"}})
+	m.On("ListEntries", "whitelist").Return(map[string][]string{})
+
+	router := http.NewServeMux()
+	RegisterListEntriesEndpoint(router, m)
+
+	rec := call(router, http.MethodPost, PathListsBlacklist+"?group=ads&domain=example.com")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"ads":["example.com"]}`, rec.Body.String())
+
+	rec = call(router, http.MethodGet, PathListsBlacklist)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"ads":["example.com"]}`, rec.Body.String())
+
+	rec = call(router, http.MethodPost, PathListsBlacklist+"?group=ads&domain=in%20valid")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid domain")
+
+	rec = call(router, http.MethodDelete, PathListsWhitelist+"?group=ads&domain=example.com")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusNotFound,
+		call(router, http.MethodDelete, PathListsWhitelist+"?group=ads&domain=other.com").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, call(router, http.MethodPut, PathListsWhitelist).Code)
+
+	m.AssertExpectations(t)
+}
+
+type cacheControlMock struct {
+	mock.Mock
+}
+
+func (m *cacheControlMock) FlushCache(domain string) int {
+	return m.Called(domain).Int(0)
+}
+
+func Test_CacheFlush(t *testing.T) {
+	m := &cacheControlMock{}
+	m.On("FlushCache", "").Return(10)
+	m.On("FlushCache", "example.com").Return(2)
+
+	router := http.NewServeMux()
+	RegisterCacheEndpoint(router, m)
+
+	rec := call(router, http.MethodPost, PathCacheFlush)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"removedCount":10}`, rec.Body.String())
+
+	rec = call(router, http.MethodPost, PathCacheFlush+"?domain=example.com")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"removedCount":2}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusMethodNotAllowed, call(router, http.MethodGet, PathCacheFlush).Code)
+
+	m.AssertExpectations(t)
+}
+
+type clientNamesControlMock struct {
+	mock.Mock
+}
+
+func (m *clientNamesControlMock) FlushClientNames() int {
+	return m.Called().Int(0)
+}
+
+func Test_ClientNamesFlush(t *testing.T) {
+	m := &clientNamesControlMock{}
+	m.On("FlushClientNames").Return(3)
+
+	router := http.NewServeMux()
+	RegisterClientNamesEndpoint(router, m)
+
+	rec := call(router, http.MethodPost, PathClientNamesFlush)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"removedCount":3}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusMethodNotAllowed, call(router, http.MethodGet, PathClientNamesFlush).Code)
+
+	m.AssertExpectations(t)
+}
+
+type healthCheckerMock struct {
+	mock.Mock
+}
+
+func (m *healthCheckerMock) CheckHealth(ctx context.Context) error {
+	return m.Called().Error(0)
+}
+
+func Test_Health(t *testing.T) {
+	m := &healthCheckerMock{}
+	m.On("CheckHealth").Return(nil).Once()
+	m.On("CheckHealth").Return(errors.New("upstream timeout")).Once()
+
+	router := http.NewServeMux()
+	RegisterHealthEndpoint(router, m, time.Second)
+
+	rec := call(router, http.MethodGet, PathHealth)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "OK", rec.Body.String())
+
+	rec = call(router, http.MethodGet, PathHealth)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "upstream timeout")
+
+	m.AssertExpectations(t)
+}
+
+type statusProviderMock struct {
+	mock.Mock
+}
+
+func (m *statusProviderMock) Status() Status {
+	return m.Called().Get(0).(Status)
+}
+
+func Test_Status(t *testing.T) {
+	m := &statusProviderMock{}
+	m.On("Status").Return(Status{
+		UptimeSec:    42,
+		CacheEntries: 3,
+		Upstreams:    []UpstreamStatus{{Name: "udp:8.8.8.8:53", Requests: 10, Errors: 1, AvgLatencyMs: 12.5}},
+		Resolvers:    []ResolverStatus{{Name: "caching resolver", Configuration: []string{"maxCacheTimeInSec = 0"}}},
+	})
+
+	router := http.NewServeMux()
+	RegisterStatusEndpoint(router, m)
+
+	rec := call(router, http.MethodGet, PathStatus)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var status map[string]interface{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	assert.Equal(t, float64(42), status["uptimeSec"])
+	assert.Equal(t, float64(3), status["cacheEntries"])
+	assert.Equal(t, "udp:8.8.8.8:53", status["upstreams"].([]interface{})[0].(map[string]interface{})["name"])
+	assert.Equal(t, "caching resolver", status["resolvers"].([]interface{})[0].(map[string]interface{})["name"])
+
+	rec = call(router, http.MethodPost, PathStatus)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+type statsProviderMock struct {
+	mock.Mock
+}
+
+func (m *statsProviderMock) Stats() Stats {
+	return m.Called().Get(0).(Stats)
+}
+
+func Test_Stats(t *testing.T) {
+	m := &statsProviderMock{}
+	m.On("Stats").Return(Stats{
+		TotalQueries:   10,
+		BlockedQueries: 2,
+		TopQueries:     []StatsEntry{{Name: "example.com", Count: 8}, {Name: "blocked.com", Count: 2}},
+	})
+
+	router := http.NewServeMux()
+	RegisterStatsEndpoint(router, m)
+
+	rec := call(router, http.MethodGet, PathStats)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var stats Stats
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&stats))
+	assert.Equal(t, 10, stats.TotalQueries)
+	assert.Equal(t, 2, stats.BlockedQueries)
+	assert.Equal(t, []StatsEntry{{Name: "example.com", Count: 8}, {Name: "blocked.com", Count: 2}}, stats.TopQueries)
+
+	rec = call(router, http.MethodPost, PathStats)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
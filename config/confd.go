@@ -0,0 +1,135 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// ReadConfig returns the content of the configuration file. If path is a directory, all "*.yml" files of the
+// directory are merged in order of their names: lists are appended, maps are merged and scalar values of later
+// files override values of earlier files
+func ReadConfig(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read config file: %v", err)
+	}
+
+	if !info.IsDir() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read config file: %v", err)
+		}
+
+		return data, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.yml"))
+	if err != nil {
+		return nil, fmt.Errorf("can't read config directory: %v", err)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("config directory '%s' doesn't contain any *.yml file", path)
+	}
+
+	sort.Strings(files)
+
+	merged, err := mergeConfigFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(merged)
+}
+
+// parses and merges the files, the structure of each file is checked to report errors with file name
+func mergeConfigFiles(files []string) (interface{}, error) {
+	var merged interface{}
+
+	// file, which defined the scalar value with the path
+	origins := make(map[string]string)
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("can't read config file: %v", err)
+		}
+
+		if err := yaml.UnmarshalStrict(data, &Config{}); err != nil {
+			return nil, fmt.Errorf("wrong file structure in '%s': %v", file, err)
+		}
+
+		var content interface{}
+		if err := yaml.Unmarshal(data, &content); err != nil {
+			return nil, fmt.Errorf("wrong file structure in '%s': %v", file, err)
+		}
+
+		merged = mergeValues("", merged, content, file, origins)
+	}
+
+	return merged, nil
+}
+
+// merges src of the file into dst: maps are merged recursively, lists are appended, scalar values are replaced
+func mergeValues(path string, dst, src interface{}, file string, origins map[string]string) interface{} {
+	if src == nil {
+		return dst
+	}
+
+	if dst == nil {
+		recordOrigins(path, src, file, origins)
+		return src
+	}
+
+	switch s := src.(type) {
+	case map[interface{}]interface{}:
+		if d, ok := dst.(map[interface{}]interface{}); ok {
+			for k, v := range s {
+				d[k] = mergeValues(joinPath(path, k), d[k], v, file, origins)
+			}
+
+			return d
+		}
+	case []interface{}:
+		if d, ok := dst.([]interface{}); ok {
+			return append(d, s...)
+		}
+	}
+
+	if !reflect.DeepEqual(dst, src) {
+		log.WithField("prefix", "config").Warnf("value of '%s' in '%s' overrides value in '%s'",
+			path, file, origins[path])
+	}
+
+	recordOrigins(path, src, file, origins)
+
+	return src
+}
+
+// remembers the file for all scalar values of v
+func recordOrigins(path string, v interface{}, file string, origins map[string]string) {
+	if m, ok := v.(map[interface{}]interface{}); ok {
+		for k, value := range m {
+			recordOrigins(joinPath(path, k), value, file, origins)
+		}
+
+		return
+	}
+
+	origins[path] = file
+}
+
+func joinPath(path string, key interface{}) string {
+	if path == "" {
+		return fmt.Sprint(key)
+	}
+
+	return fmt.Sprintf("%s.%v", path, key)
+}
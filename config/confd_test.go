@@ -0,0 +1,129 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "conf.d")
+	assert.NoError(t, err)
+
+	for name, content := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+
+	return dir
+}
+
+func TestLoadConfig_Directory(t *testing.T) {
+	dir := writeConfigDir(t, map[string]string{
+		"10-base.yml": `upstream:
+  externalResolvers:
+    - udp:8.8.8.8
+  timeout: 1s
+port: 53
+blocking:
+  blackLists:
+    ads:
+      - https://ads.example.com/list.txt
+  clientGroupsBlock:
+    default:
+      - ads
+`,
+		"20-kids.yml": `blocking:
+  blackLists:
+    ads:
+      - https://more-ads.example.com/list.txt
+    kids:
+      - https://kids.example.com/list.txt
+  clientGroupsBlock:
+    kids-laptop:
+      - kids
+`,
+		"30-local.yml": `upstream:
+  externalResolvers:
+    - udp:1.1.1.1
+  timeout: 3s
+customDNS:
+  mapping:
+    printer.lan: 192.168.178.3
+`,
+		// ignored
+		"readme.txt": "no configuration",
+	})
+	defer os.RemoveAll(dir)
+
+	cfg, err := LoadConfig(dir)
+	assert.NoError(t, err)
+
+	// lists are appended
+	assert.Equal(t, []Upstream{
+		{Net: "udp", Host: "8.8.8.8", Port: 53, Timeout: 3 * time.Second, Retries: 2},
+		{Net: "udp", Host: "1.1.1.1", Port: 53, Timeout: 3 * time.Second, Retries: 2},
+	}, cfg.Upstream.ExternalResolvers)
+	assert.Equal(t, []string{"https://ads.example.com/list.txt", "https://more-ads.example.com/list.txt"},
+		cfg.Blocking.BlackLists["ads"])
+
+	// maps are merged
+	assert.Equal(t, map[string][]string{"default": {"ads"}, "kids-laptop": {"kids"}}, cfg.Blocking.ClientGroupsBlock)
+	assert.Len(t, cfg.Blocking.BlackLists, 2)
+	assert.Len(t, cfg.CustomDNS.Mapping, 1)
+
+	// last value wins
+	assert.Equal(t, Duration(3*time.Second), cfg.Upstream.Timeout)
+	assert.Equal(t, ListenConfig{"53"}, cfg.Port)
+	assert.Equal(t, dir, cfg.Path())
+}
+
+func TestLoadConfig_DirectoryErrors(t *testing.T) {
+	empty := writeConfigDir(t, map[string]string{"config.yaml": "port: 53"})
+	defer os.RemoveAll(empty)
+
+	_, err := LoadConfig(empty)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't contain any *.yml file")
+
+	invalid := writeConfigDir(t, map[string]string{
+		"10-base.yml":  "port: 53",
+		"20-wrong.yml": "unknownKey: 1",
+	})
+	defer os.RemoveAll(invalid)
+
+	_, err = LoadConfig(invalid)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "20-wrong.yml")
+
+	_, err = LoadConfig("wrong/path")
+	assert.Error(t, err)
+}
+
+func Test_mergeValues(t *testing.T) {
+	origins := make(map[string]string)
+
+	var merged interface{}
+	merged = mergeValues("", merged, map[interface{}]interface{}{
+		"port": []interface{}{"53"},
+		"a":    map[interface{}]interface{}{"b": 1},
+	}, "1.yml", origins)
+	merged = mergeValues("", merged, map[interface{}]interface{}{
+		"port": "5353",
+		"a":    map[interface{}]interface{}{"b": 2},
+	}, "2.yml", origins)
+
+	// list replaced by scalar value
+	assert.Equal(t, map[interface{}]interface{}{
+		"port": "5353",
+		"a":    map[interface{}]interface{}{"b": 2},
+	}, merged)
+	assert.Equal(t, "2.yml", origins["a.b"])
+}
+
+func TestConfig_Path(t *testing.T) {
+	assert.Equal(t, DefaultPath, (&Config{}).Path())
+}
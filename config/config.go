@@ -2,35 +2,109 @@ package config
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net"
-	"reflect"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	defaultDoHPath           = "/dns-query"
+	defaultRefreshPeriod     = 4 * time.Hour
+	defaultCacheTimeNegative = 30 * time.Minute
+	defaultUpstreamRetries   = 2
+)
+
+// MaxCacheTimeServfail is the max. caching time of SERVFAIL responses, longer caching would hide the recovery of
+// upstreams
+const MaxCacheTimeServfail = 30 * time.Second
+
 // nolint:gochecknoglobals
 var netDefaultPort = map[string]uint16{
 	"udp":     53,
 	"tcp":     53,
 	"tcp-tls": 853,
+	"https":   443,
+}
+
+// DefaultResolverOrder is the default order of the resolver chain, the upstream resolver is always the last one
+// nolint:gochecknoglobals
+var DefaultResolverOrder = []string{
+	"rateLimit",
+	"clientNames",
+	"upstreamGroup",
+	"queryLog",
+	"stats",
+	"queryTypeFilter",
+	"ednsClientSubnet",
+	"ownNames",
+	"conditional",
+	"customDNS",
+	"specialUseNames",
+	"blocking",
+	"caching",
+	"dedup",
+	"dns64",
+	"rebindProtection",
+	"dnssec",
 }
 
 // Upstream is the definition of external DNS server
 type Upstream struct {
-	Net  string
-	Host string
-	Port uint16
+	Net        string
+	Host       string
+	Port       uint16
+	Path       string
+	CommonName string
+	// timeout for dial, write and read, global default is used if not set
+	Timeout time.Duration
+	// number of retries after timeout, always the global value
+	Retries int
+	// local IP address for outgoing queries, global or group value is used
+	OutgoingAddress string
+}
+
+// String returns the normalized form, which can be parsed again
+func (u Upstream) String() string {
+	if u.Net == "https" {
+		return fmt.Sprintf("https://%s%s", net.JoinHostPort(u.Host, strconv.Itoa(int(u.Port))), u.Path)
+	}
+
+	if u.CommonName != "" {
+		return fmt.Sprintf("%s:%s#%s", u.Net, net.JoinHostPort(u.Host, strconv.Itoa(int(u.Port))), u.CommonName)
+	}
+
+	return fmt.Sprintf("%s:%s", u.Net, net.JoinHostPort(u.Host, strconv.Itoa(int(u.Port))))
 }
 
+// UnmarshalYAML creates Upstream from string ("net:host:port") or from map with keys "upstream" and "timeout"
 func (u *Upstream) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
 	if err := unmarshal(&s); err != nil {
-		return err
+		var m struct {
+			Upstream string   `yaml:"upstream"`
+			Timeout  Duration `yaml:"timeout"`
+		}
+
+		if err := unmarshal(&m); err != nil {
+			return err
+		}
+
+		upstream, err := parseUpstream(m.Upstream)
+		if err != nil {
+			return err
+		}
+
+		upstream.Timeout = time.Duration(m.Timeout)
+		*u = upstream
+
+		return nil
 	}
 
 	upstream, err := parseUpstream(s)
@@ -43,75 +117,523 @@ func (u *Upstream) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
-// parseUpstream creates new Upstream from passed string in format net:host:port
+// parseUpstream creates new Upstream from passed string in format [net:]host[:port][#commonName].
+// net is udp if omitted, IPv6 addresses with port must be enclosed in brackets: tcp-tls:[2620:fe::fe]:853
 func parseUpstream(upstream string) (result Upstream, err error) {
-	if strings.Trim(upstream, " ") == "" {
+	upstream = strings.TrimSpace(upstream)
+	if upstream == "" {
 		return Upstream{}, nil
 	}
 
-	parts := strings.Split(upstream, ":")
+	if strings.HasPrefix(upstream, "https://") {
+		return parseHTTPSUpstream(upstream)
+	}
+
+	input := upstream
 
-	if len(parts) < 2 || len(parts) > 3 {
-		err = fmt.Errorf("wrong configuration, couldn't parse input '%s', please enter net:host[:port]", upstream)
-		return
+	var commonName string
+
+	if i := strings.Index(upstream, "#"); i >= 0 {
+		commonName = strings.TrimSpace(upstream[i+1:])
+		upstream = upstream[:i]
 	}
 
-	net := strings.TrimSpace(parts[0])
+	netType := "udp"
 
-	if _, ok := netDefaultPort[net]; !ok {
-		err = fmt.Errorf("wrong configuration, couldn't parse net '%s', please user one of %s",
-			net, reflect.ValueOf(netDefaultPort).MapKeys())
-		return
+	if i := strings.Index(upstream, ":"); i >= 0 {
+		if _, ok := netDefaultPort[strings.TrimSpace(upstream[:i])]; ok {
+			netType = strings.TrimSpace(upstream[:i])
+			upstream = upstream[i+1:]
+		}
 	}
 
-	var port uint16
+	if netType == "https" {
+		return Upstream{}, fmt.Errorf("wrong configuration, please use URL format https://host[:port]/path for "+
+			"DNS-over-HTTPS upstream '%s'", input)
+	}
 
-	host := strings.TrimSpace(parts[1])
+	if commonName != "" && netType != "tcp-tls" {
+		return Upstream{}, fmt.Errorf("wrong configuration, common name '%s' is only supported for tcp-tls", commonName)
+	}
 
-	if len(parts) == 3 {
-		var p int
-		p, err = strconv.Atoi(strings.TrimSpace(parts[2]))
+	host, port, err := parseHostPort(strings.TrimSpace(upstream), netDefaultPort[netType])
+	if err != nil {
+		return Upstream{}, fmt.Errorf("wrong configuration, couldn't parse upstream '%s': %v, "+
+			"please use [net:]host[:port][#commonName] with net one of tcp, tcp-tls or udp", input, err)
+	}
 
-		if err != nil {
-			err = fmt.Errorf("can't convert port to number %v", err)
-			return
+	return Upstream{Net: netType, Host: host, Port: port, CommonName: commonName}, nil
+}
+
+// parses host with optional port: IPv4 address, IPv6 address (in brackets, if port is defined) or host name.
+// Returns normalized host (IP in canonical form, host name in lower case) and port (default port if not defined)
+func parseHostPort(hostPort string, defaultPort uint16) (host string, port uint16, err error) {
+	port = defaultPort
+	host = hostPort
+
+	switch {
+	case strings.HasPrefix(hostPort, "["):
+		end := strings.Index(hostPort, "]")
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing ']' in address")
+		}
+
+		host = hostPort[1:end]
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return "", 0, fmt.Errorf("invalid IPv6 address '%s'", host)
+		}
+
+		rest := hostPort[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", 0, fmt.Errorf("unexpected '%s' after address", rest)
+			}
+
+			if port, err = parsePort(rest[1:]); err != nil {
+				return "", 0, err
+			}
 		}
+	case net.ParseIP(hostPort) != nil:
+		// IPv4 or IPv6 address without port
+	case strings.Count(hostPort, ":") == 1:
+		i := strings.Index(hostPort, ":")
+		host = strings.TrimSpace(hostPort[:i])
 
-		if p < 1 || p > 65535 {
-			err = fmt.Errorf("invalid port %d", p)
-			return
+		if port, err = parsePort(hostPort[i+1:]); err != nil {
+			return "", 0, err
+		}
+	case strings.Contains(hostPort, ":"):
+		return "", 0, fmt.Errorf("invalid address '%s', IPv6 address with port must be enclosed in brackets", hostPort)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), port, nil
+	}
+
+	if !isHostName(host) {
+		return "", 0, fmt.Errorf("invalid host '%s'", host)
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), "."), port, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("can't convert port to number %v", err)
+	}
+
+	if p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %d", p)
+	}
+
+	return uint16(p), nil
+}
+
+// returns true if the string is a syntactically valid host name. A numeric top level label (e.g. invalid
+// IPv4 address 1.2.3) is not allowed
+func isHostName(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	labels := strings.Split(host, ".")
+
+	for _, l := range labels {
+		if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+
+		for _, c := range strings.ToLower(l) {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	_, err := strconv.Atoi(labels[len(labels)-1])
+
+	return err != nil
+}
+
+// parseHTTPSUpstream creates new DNS-over-HTTPS Upstream from passed URL in format https://host[:port]/path
+func parseHTTPSUpstream(upstream string) (result Upstream, err error) {
+	u, err := url.Parse(strings.TrimSpace(upstream))
+	if err != nil {
+		return Upstream{}, fmt.Errorf("wrong configuration, couldn't parse URL '%s': %v", upstream, err)
+	}
+
+	if u.Hostname() == "" {
+		return Upstream{}, fmt.Errorf("wrong configuration, missing host in URL '%s'", upstream)
+	}
+
+	port := netDefaultPort["https"]
+
+	if u.Port() != "" {
+		var p int
+		p, err = strconv.Atoi(u.Port())
+
+		if err != nil || p < 1 || p > 65535 {
+			return Upstream{}, fmt.Errorf("invalid port '%s'", u.Port())
 		}
 
 		port = uint16(p)
-	} else {
-		port = netDefaultPort[net]
 	}
 
-	return Upstream{Net: net, Host: host, Port: port}, nil
+	path := u.EscapedPath()
+	if path == "" {
+		path = defaultDoHPath
+	}
+
+	return Upstream{Net: "https", Host: u.Hostname(), Port: port, Path: path}, nil
 }
 
 // main configuration
 type Config struct {
-	Upstream     UpstreamConfig            `yaml:"upstream"`
-	CustomDNS    CustomDNSConfig           `yaml:"customDNS"`
-	Conditional  ConditionalUpstreamConfig `yaml:"conditional"`
-	Blocking     BlockingConfig            `yaml:"blocking"`
-	ClientLookup ClientLookupConfig        `yaml:"clientLookup"`
-	QueryLog     QueryLogConfig            `yaml:"queryLog"`
-	Port         uint16
-	LogLevel     string `yaml:"logLevel"`
+	Upstream         UpstreamConfig            `yaml:"upstream"`
+	UpstreamStrategy string                    `yaml:"upstreamStrategy"` // parallel_best (default), random or strict
+	BootstrapDNS     Upstream                  `yaml:"bootstrapDns"`     // IP upstream to resolve upstream host names
+	EdnsClientSubnet EdnsClientSubnetConfig    `yaml:"ednsClientSubnet"`
+	ValidateDNSSEC   bool                      `yaml:"validateDnssec"` // validate signatures of upstream answers
+	RateLimit        RateLimitConfig           `yaml:"rateLimit"`
+	RebindProtection RebindProtectionConfig    `yaml:"rebindProtection"`
+	DNS64            DNS64Config               `yaml:"dns64"`
+	QueryTypeFilter  QueryTypeFilterConfig     `yaml:"queryTypeFilter"`
+	SpecialUseNames  SpecialUseNamesConfig     `yaml:"specialUseNames"`
+	OwnNames         OwnNamesConfig            `yaml:"ownNames"`
+	CustomDNS        CustomDNSConfig           `yaml:"customDNS"`
+	Conditional      ConditionalUpstreamConfig `yaml:"conditional"`
+	Blocking         BlockingConfig            `yaml:"blocking"`
+	Caching          CachingConfig             `yaml:"caching"`
+	ClientLookup     ClientLookupConfig        `yaml:"clientLookup"`
+	QueryLog         QueryLogConfig            `yaml:"queryLog"`
+	Port             ListenConfig
+	BindAddress      string `yaml:"bindAddress"`
+	TLSPort          uint16 `yaml:"tlsPort"`
+	HTTPSPort        uint16 `yaml:"httpsPort"`
+	HTTPPort         uint16 `yaml:"httpPort"`
+	MetricsPort      uint16 `yaml:"metricsPort"`
+	CertFile         string `yaml:"certFile"`
+	KeyFile          string `yaml:"keyFile"`
+	LogLevel         string `yaml:"logLevel"`
+	LogFormat        string `yaml:"logFormat"`    // text (default) or json
+	LogTimestamp     bool   `yaml:"logTimestamp"` // default: true
+	// client IPs or networks (CIDR), which are allowed to query. All clients are allowed if empty
+	AllowedClients []string `yaml:"allowedClients"`
+	// refuse (default): answer queries of other clients with REFUSED, drop: don't answer
+	DisallowedClientAction string `yaml:"disallowedClientAction"`
+	// IPs or networks (CIDR) of reverse proxies, whose X-Forwarded-For header is used for DoH requests.
+	// Loopback addresses are trusted if empty
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// timeout in seconds to wait for in-flight queries on shutdown
+	ShutdownTimeout uint `yaml:"shutdownTimeout"`
+	// overall timeout in seconds for the resolution of one query
+	QueryTimeout uint `yaml:"queryTimeout"`
+	// max number of concurrently processed requests (DNS and DoH), 0: unlimited
+	MaxConcurrentRequests uint `yaml:"maxConcurrentRequests"`
+	// domain, which is resolved by the health check endpoint
+	HealthCheckDomain string `yaml:"healthCheckDomain"`
+	// order of the resolver chain (names of DefaultResolverOrder), default order is used if empty
+	ResolverOrder []string `yaml:"resolverOrder"`
+	// unprivileged user and group (name or ID), to which the process switches after all listeners are bound
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+	// names of environment variables, which override values of the configuration file, and unknown variables
+	envOverrides []string
+	unknownEnv   []string
+	// path of the loaded configuration file or directory
+	path string
+}
+
+// Path returns the path of the configuration file or directory, from which the configuration was loaded
+func (c *Config) Path() string {
+	if c.path == "" {
+		return DefaultPath
+	}
+
+	return c.path
+}
+
+// EffectiveResolverOrder returns the order of the resolver chain: the configured order or the default order. Resolvers,
+// which are missing in the configured order (e.g. added by a later version), are inserted after all resolvers, which
+// precede them in the default order, and returned as added
+func (c *Config) EffectiveResolverOrder() (order []string, added []string) {
+	if len(c.ResolverOrder) == 0 {
+		return append([]string(nil), DefaultResolverOrder...), nil
+	}
+
+	order = append([]string(nil), c.ResolverOrder...)
+
+	for i, name := range DefaultResolverOrder {
+		if contains(order, name) {
+			continue
+		}
+
+		pos := 0
+
+		for _, predecessor := range DefaultResolverOrder[:i] {
+			if k := indexOf(order, predecessor); k+1 > pos {
+				pos = k + 1
+			}
+		}
+
+		order = append(order[:pos], append([]string{name}, order[pos:]...)...)
+		added = append(added, name)
+	}
+
+	return order, added
+}
+
+// EnvOverrides returns the names of environment variables, which were applied to the configuration, and of variables
+// with configuration prefix, which don't match any configuration key
+func (c *Config) EnvOverrides() (applied []string, unknown []string) {
+	return c.envOverrides, c.unknownEnv
+}
+
+// ListenConfig is a list of listener addresses in format [host:]port
+type ListenConfig []string
+
+func (l *ListenConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addresses []string
+	if err := unmarshal(&addresses); err == nil {
+		*l = addresses
+		return nil
+	}
+
+	var address string
+	if err := unmarshal(&address); err != nil {
+		return err
+	}
+
+	*l = ListenConfig{address}
+
+	return nil
+}
+
+// Duration is a time.Duration, which is defined as duration string ("30s", "4h"). Numbers without unit are
+// rejected (except 0), since the unit would be ambiguous
+type Duration time.Duration
+
+// UnmarshalYAML creates Duration from YAML value
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var number int
+	if err := unmarshal(&number); err == nil {
+		if number != 0 {
+			return fmt.Errorf("can't parse duration '%d': unit is missing, e.g. '%ds' or '%dm'", number, number, number)
+		}
+
+		*d = 0
+
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("can't parse duration '%s': %v", s, err)
+	}
+
+	*d = Duration(duration)
+
+	return nil
+}
+
+// MinutesDuration is a Duration, which can also be defined as number of minutes (legacy format of refreshPeriod)
+type MinutesDuration Duration
+
+// UnmarshalYAML creates MinutesDuration from YAML value
+func (d *MinutesDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var minutes int
+	if err := unmarshal(&minutes); err == nil {
+		*d = MinutesDuration(time.Duration(minutes) * time.Minute)
+		return nil
+	}
+
+	return unmarshal((*Duration)(d))
 }
 
 type UpstreamConfig struct {
+	// upstreams of the "default" group
 	ExternalResolvers []Upstream `yaml:"externalResolvers"`
+	// additional named upstream groups, e.g. filtered upstreams for kids
+	Groups map[string][]Upstream `yaml:"groups"`
+	// client name (wildcards are supported), IP or CIDR -> upstream group. Other clients use the default group
+	ClientGroups map[string]string `yaml:"clientGroups"`
+	// default timeout for all upstreams
+	Timeout Duration `yaml:"timeout"`
+	// number of retries after timeout
+	Retries     int               `yaml:"retries"`
+	HealthCheck HealthCheckConfig `yaml:"healthCheck"`
+	// local IP address, which is used as source address for all upstream queries
+	OutgoingAddress string `yaml:"outgoingAddress"`
+	// upstream group -> local IP address, overrides the global outgoing address for upstreams of the group
+	GroupOutgoingAddresses map[string]string `yaml:"groupOutgoingAddresses"`
 }
 
+// HealthCheckConfig defines when an upstream is evicted temporarily (consecutive failures)
+// and how it is probed in background
+type HealthCheckConfig struct {
+	FailureThreshold int      `yaml:"failureThreshold"`
+	Domain           string   `yaml:"domain"`
+	Interval         Duration `yaml:"interval"`
+}
+
+// CustomDNSConfig contains custom DNS entries from config mapping and hosts files.
+// ExactMatch: entries don't cover sub-domains, only wildcard entries ("*.domain") do.
+// DisablePTR: no PTR records are created for A and AAAA entries
 type CustomDNSConfig struct {
-	Mapping map[string]net.IP `yaml:"mapping"`
+	CustomTTL               Duration                    `yaml:"customTTL"`
+	Mapping                 map[string]CustomDNSEntries `yaml:"mapping"`
+	ExactMatch              bool                        `yaml:"exactMatch"`
+	DisablePTR              bool                        `yaml:"disablePTR"`
+	HostsFiles              []string                    `yaml:"hostsFiles"`
+	HostsFilesRefreshPeriod Duration                    `yaml:"hostsFilesRefreshPeriod"`
 }
 
+// CustomDNSEntries contains DNS records of one domain name in format "TYPE value" (e.g. "A 192.168.178.3",
+// "CNAME nas.lan", "TXT text"). In YAML, it can be defined as list of records or as comma separated list of IPs
+type CustomDNSEntries []string
+
+// UnmarshalYAML creates CustomDNSEntries from YAML value, IP addresses are converted to A or AAAA records
+func (e *CustomDNSEntries) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var values []string
+	if err := unmarshal(&values); err != nil {
+		var s string
+		if err := unmarshal(&s); err != nil {
+			return err
+		}
+
+		values = strings.Split(s, ",")
+	}
+
+	result := make(CustomDNSEntries, 0, len(values))
+
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+
+		if ip := net.ParseIP(v); ip != nil {
+			if ip.To4() != nil {
+				v = "A " + ip.String()
+			} else {
+				v = "AAAA " + ip.String()
+			}
+		} else if !strings.Contains(v, " ") {
+			return fmt.Errorf("invalid custom DNS entry '%s': should be IP or record in format 'TYPE value'", v)
+		}
+
+		result = append(result, v)
+	}
+
+	*e = result
+
+	return nil
+}
+
+// ConditionalUpstreamConfig contains upstreams per domain. Queries for domains from rewrite map
+// (e.g. "home" -> "fritz.box") are resolved with the rewritten name. Additional mapping entries can be defined
+// in a file with one "domain upstream[,upstream]" entry per line
 type ConditionalUpstreamConfig struct {
-	Mapping map[string]Upstream `yaml:"mapping"`
+	Rewrite                  map[string]string             `yaml:"rewrite"`
+	Mapping                  map[string]ConditionalMapping `yaml:"mapping"`
+	MappingFile              string                        `yaml:"mappingFile"`
+	MappingFileRefreshPeriod Duration                      `yaml:"mappingFileRefreshPeriod"`
+	Caching                  ConditionalCachingConfig      `yaml:"caching"`
+}
+
+// ConditionalCachingConfig defines the cache of conditional answers, which is separate from the main cache.
+// Zones (with sub domains) in excludedZones are never cached, e.g. zones with rapidly changing records
+type ConditionalCachingConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	MinCachingTime Duration `yaml:"minCachingTime"` // default: 0 (TTL of the answer)
+	MaxCachingTime Duration `yaml:"maxCachingTime"` // default: 0 (no maximum)
+	MaxItemsCount  int      `yaml:"maxItemsCount"`  // default: 0 (unlimited)
+	ExcludedZones  []string `yaml:"excludedZones"`
+}
+
+// ConditionalMapping contains the upstreams of a conditional zone. In YAML, it can be defined as list or comma
+// separated string of upstreams or as map with keys "upstreams" and "cache" (false: answers are never cached)
+type ConditionalMapping struct {
+	Upstreams    Upstreams
+	DisableCache bool
+}
+
+// UnmarshalYAML creates ConditionalMapping from YAML value
+func (m *ConditionalMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var upstreams Upstreams
+	if err := unmarshal(&upstreams); err == nil {
+		*m = ConditionalMapping{Upstreams: upstreams}
+
+		return nil
+	}
+
+	var entry struct {
+		Upstreams Upstreams `yaml:"upstreams"`
+		Cache     *bool     `yaml:"cache"`
+	}
+
+	if err := unmarshal(&entry); err != nil {
+		return err
+	}
+
+	if len(entry.Upstreams) == 0 {
+		return fmt.Errorf("no upstreams defined")
+	}
+
+	*m = ConditionalMapping{
+		Upstreams:    entry.Upstreams,
+		DisableCache: entry.Cache != nil && !*entry.Cache,
+	}
+
+	return nil
+}
+
+// Upstreams is a list of upstreams, which are used in configured order (failover).
+// In YAML, it can be defined as list or as comma separated string
+type Upstreams []Upstream
+
+func (u *Upstreams) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []Upstream
+	if err := unmarshal(&list); err == nil {
+		*u = list
+
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	result, err := ParseUpstreams(s)
+	if err != nil {
+		return err
+	}
+
+	*u = result
+
+	return nil
+}
+
+// ParseUpstreams creates upstream list from comma separated string
+func ParseUpstreams(s string) (Upstreams, error) {
+	values := strings.Split(s, ",")
+	result := make(Upstreams, 0, len(values))
+
+	for _, v := range values {
+		upstream, err := parseUpstream(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, upstream)
+	}
+
+	return result, nil
 }
 
 type BlockingConfig struct {
@@ -119,32 +641,392 @@ type BlockingConfig struct {
 	WhiteLists        map[string][]string `yaml:"whiteLists"`
 	ClientGroupsBlock map[string][]string `yaml:"clientGroupsBlock"`
 	BlockType         string              `yaml:"blockType"`
-	RefreshPeriod     int                 `yaml:"refreshPeriod"`
+	BlockTTL          Duration            `yaml:"blockTTL"`
+	RefreshPeriod     MinutesDuration     `yaml:"refreshPeriod"`
+	MatchSubdomains   bool                `yaml:"matchSubdomains"`
+	CNAMEGroups       []string            `yaml:"cnameGroups"`
+	SafeSearchGroups  []string            `yaml:"safeSearchGroups"`   // groups with enforced safe search
+	SafeSearch        map[string]string   `yaml:"safeSearchMappings"` // domain -> safe host, overrides built-in
+	// blocking (default), failOnError or fast (lists are loaded in background)
+	StartStrategy string `yaml:"startStrategy"`
+	// max number of lists, which are downloaded and parsed concurrently (default 4)
+	ProcessingConcurrency uint           `yaml:"processingConcurrency"`
+	Download              DownloadConfig `yaml:"download"`
+	// list entries added at runtime via API are saved to this file and loaded on start
+	RuntimeListsFile string `yaml:"runtimeListsFile"`
+	// group -> time windows, in which the group is active. Groups without schedule are always active
+	Schedules map[string][]ScheduleWindow `yaml:"schedules"`
+	// IANA time zone name for schedules, e.g. "Europe/Berlin". Local time zone is used if empty
+	ScheduleTimeZone string `yaml:"scheduleTimeZone"`
+}
+
+// nolint:gochecknoglobals
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ScheduleWindow is a daily time range on defined week days. If To is not after From, the window ends on the next day
+// (e.g. 21:00-07:00), equal times define a window of 24 hours
+type ScheduleWindow struct {
+	// indexed by time.Weekday, the day on which the window starts
+	Days [7]bool
+	// time of day as duration since midnight
+	From time.Duration
+	To   time.Duration
+}
+
+// String returns the normalized form, which can be parsed again
+func (w ScheduleWindow) String() string {
+	var days []string
+
+	for i, active := range w.Days {
+		if active {
+			days = append(days, weekdayNames[i])
+		}
+	}
+
+	timeOfDay := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+
+	times := fmt.Sprintf("%s-%s", timeOfDay(w.From), timeOfDay(w.To))
+	if len(days) == len(w.Days) {
+		return times
+	}
+
+	return fmt.Sprintf("%s %s", strings.Join(days, ","), times)
+}
+
+// UnmarshalYAML creates ScheduleWindow from string "[days ]HH:MM-HH:MM", days are a comma separated list of
+// week days or ranges (e.g. "sun-thu,sat"). Without days, the window is active on every day
+func (w *ScheduleWindow) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	window, err := ParseScheduleWindow(s)
+	if err != nil {
+		return err
+	}
+
+	*w = window
+
+	return nil
+}
+
+// ParseScheduleWindow creates ScheduleWindow from string "[days ]HH:MM-HH:MM"
+func ParseScheduleWindow(s string) (ScheduleWindow, error) {
+	var w ScheduleWindow
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("invalid schedule '%s', please use format '[days ]HH:MM-HH:MM'", s)
+	}
+
+	if len(fields) == 1 {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	} else if err := parseWeekdays(fields[0], &w.Days); err != nil {
+		return w, fmt.Errorf("invalid schedule '%s': %v", s, err)
+	}
+
+	parts := strings.Split(fields[len(fields)-1], "-")
+	if len(parts) != 2 {
+		return w, fmt.Errorf("invalid schedule '%s', please use format '[days ]HH:MM-HH:MM'", s)
+	}
+
+	var err error
+	if w.From, err = parseTimeOfDay(parts[0]); err == nil {
+		w.To, err = parseTimeOfDay(parts[1])
+	}
+
+	if err != nil {
+		return w, fmt.Errorf("invalid schedule '%s': %v", s, err)
+	}
+
+	return w, nil
+}
+
+// parses comma separated week days or ranges, e.g. "mon,wed-fri"
+func parseWeekdays(s string, days *[7]bool) error {
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("invalid day range '%s'", part)
+		}
+
+		start, err := parseWeekday(bounds[0])
+		if err != nil {
+			return err
+		}
+
+		end := start
+		if len(bounds) == 2 {
+			if end, err = parseWeekday(bounds[1]); err != nil {
+				return err
+			}
+		}
+
+		// ranges can wrap around the end of the week, e.g. "fri-mon"
+		for d := start; ; d = (d + 1) % 7 {
+			days[d] = true
+
+			if d == end {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// parses short ("mon") or full ("monday") week day name to time.Weekday index
+func parseWeekday(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	for i, name := range weekdayNames {
+		if s == name || s == strings.ToLower(time.Weekday(i).String()) {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown week day '%s'", s)
+}
+
+// parses "HH:MM" to duration since midnight, "24:00" is allowed as end of the day
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var hours, minutes int
+
+	if n, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); err != nil || n != 2 || len(s) != 5 ||
+		hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time of day '%s', please use format 'HH:MM'", s)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// DownloadConfig contains settings for the download of lists via HTTP(S)
+type DownloadConfig struct {
+	// timeout for the whole download of one list (default 30s)
+	Timeout Duration `yaml:"timeout"`
+	// max size of one list in MB, bigger lists are not loaded (default 100)
+	MaxSizeMB int64  `yaml:"maxSizeMB"`
+	UserAgent string `yaml:"userAgent"`
+	// proxy URL, proxy from environment variables HTTP_PROXY/HTTPS_PROXY is used if empty
+	Proxy string `yaml:"proxy"`
+}
+
+type CachingConfig struct {
+	MinCachingTime    Duration `yaml:"minCachingTime"`
+	MaxCachingTime    Duration `yaml:"maxCachingTime"`
+	CacheTimeNegative Duration `yaml:"cacheTimeNegative"`
+	// SERVFAIL responses are cached max. this time (0 -> not cached, max. 30s)
+	CacheTimeServfail     Duration `yaml:"cacheTimeServfail"`
+	StaleGracePeriod      Duration `yaml:"staleGracePeriod"`
+	MaxItemsCount         int      `yaml:"maxItemsCount"`
+	Prefetching           bool     `yaml:"prefetching"`
+	PrefetchExpires       Duration `yaml:"prefetchExpires"`
+	PrefetchThreshold     int      `yaml:"prefetchThreshold"`
+	PrefetchMaxItemsCount int      `yaml:"prefetchMaxItemsCount"`
+	Persistence           bool     `yaml:"persistence"`
+	PersistenceFile       string   `yaml:"persistenceFile"`
+	// caching time limits per domain (with sub domains), override minCachingTime and maxCachingTime
+	DomainMinCachingTime map[string]Duration `yaml:"domainMinCachingTime"`
+	DomainMaxCachingTime map[string]Duration `yaml:"domainMaxCachingTime"`
+	// optional: cache shared by multiple instances
+	Redis RedisConfig `yaml:"redis"`
+}
+
+// RedisConfig defines the Redis server for the shared cache, disabled if address is empty
+type RedisConfig struct {
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	Database int    `yaml:"database"`
+	// interval of connection checks, Redis is not queried while it is not reachable
+	ReconnectInterval Duration `yaml:"reconnectInterval"`
 }
 
 type ClientLookupConfig struct {
-	Upstream        Upstream `yaml:"upstream"`
-	SingleNameOrder []uint   `yaml:"singleNameOrder"`
+	Upstream        Upstream            `yaml:"upstream"`
+	SingleNameOrder []uint              `yaml:"singleNameOrder"`
+	Clients         map[string][]string `yaml:"clients"` // static client names per IP or CIDR
+	CacheTime       Duration            `yaml:"cacheTime"`
+	// all names are kept, the first existing name in this order (index in sorted names) is the primary name
+	PrimaryNameOrder []uint `yaml:"primaryNameOrder"`
+	// ask clients without rDNS name directly via mDNS, the lookup takes at most MDNSTimeout (default 250ms)
+	MDNS        bool     `yaml:"mdns"`
+	MDNSTimeout Duration `yaml:"mdnsTimeout"`
+	// DHCP lease file with client names, format: dnsmasq (default), isc or kea
+	LeaseFile              string   `yaml:"leaseFile"`
+	LeaseFileFormat        string   `yaml:"leaseFileFormat"`
+	LeaseFileRefreshPeriod Duration `yaml:"leaseFileRefreshPeriod"`
+}
+
+// EdnsClientSubnetConfig defines handling of the EDNS client subnet option (RFC 7871) in client queries
+type EdnsClientSubnetConfig struct {
+	Mode     string `yaml:"mode"`     // strip (default), forward or add
+	IPv4Mask uint8  `yaml:"ipv4Mask"` // prefix length of the client IPv4 address in mode add, default 24
+	IPv6Mask uint8  `yaml:"ipv6Mask"` // prefix length of the client IPv6 address in mode add, default 56
+}
+
+// RateLimitConfig limits the queries per second per client IP and overall, 0 disables the limit.
+// Burst is the number of queries, which can exceed the rate for a short time (default: rate)
+type RateLimitConfig struct {
+	PerClient      uint     `yaml:"perClient"`
+	PerClientBurst uint     `yaml:"perClientBurst"`
+	Global         uint     `yaml:"global"`
+	GlobalBurst    uint     `yaml:"globalBurst"`
+	Whitelist      []string `yaml:"whitelist"` // client IPs or networks (CIDR) without limits
+}
+
+// RebindProtectionConfig defines handling of upstream answers with private IP addresses
+type RebindProtectionConfig struct {
+	Mode           string   `yaml:"mode"`           // remove (private addresses) or nxdomain, disabled if empty
+	AllowedDomains []string `yaml:"allowedDomains"` // domains (with sub domains), which can resolve to private IPs
+}
+
+// DNS64Config defines the synthesis of AAAA records from A records for IPv6-only clients with NAT64 (RFC 6147)
+type DNS64Config struct {
+	Enabled bool   `yaml:"enabled"`
+	Prefix  string `yaml:"prefix"` // NAT64 prefix with length 32, 40, 48, 56, 64 or 96, default: 64:ff9b::/96
+}
+
+// QueryTypeFilterConfig defines query types, which are answered with NODATA
+type QueryTypeFilterConfig struct {
+	QueryTypes   []string            `yaml:"queryTypes"`   // filtered query types for all clients, e.g. AAAA
+	ClientGroups map[string][]string `yaml:"clientGroups"` // client (name, IP or CIDR) -> filtered query types
+	RefuseAny    bool                `yaml:"refuseAny"`    // answer ANY queries with NOTIMP
+}
+
+// OwnNamesConfig defines names, which are answered with the addresses of blocky: the host name of the system
+// and additional names (default "blocky.local"). CHAOS TXT queries for version.bind are answered with the version
+type OwnNamesConfig struct {
+	Names           []string `yaml:"names"`
+	DisableHostname bool     `yaml:"disableHostname"`
+	HideVersion     bool     `yaml:"hideVersion"`
+}
+
+// SpecialUseNamesConfig defines names, which are answered with NXDOMAIN instead of being forwarded to the upstreams.
+// Names of conditional mappings and custom DNS entries are resolved as usual
+type SpecialUseNamesConfig struct {
+	Enabled bool     `yaml:"enabled"` // filter special-use zones
+	Zones   []string `yaml:"zones"`   // default: home.arpa, invalid, lan, local, onion
+	// filter names without dot, e.g. "printer"
+	BlockSingleLabelNames bool `yaml:"blockSingleLabelNames"`
 }
 
 type QueryLogConfig struct {
-	Dir              string `yaml:"dir"`
-	PerClient        bool   `yaml:"perClient"`
-	LogRetentionDays uint64 `yaml:"logRetentionDays"`
+	Type              string   `yaml:"type"`     // csv (default), mysql, syslog or mqtt
+	Target            string   `yaml:"target"`   // data source name for database types, address for syslog and mqtt
+	Facility          string   `yaml:"facility"` // syslog facility, default: daemon
+	Topic             string   `yaml:"topic"`    // mqtt topic with placeholders, default: blocky/query/{client}
+	QoS               uint8    `yaml:"qos"`      // mqtt quality of service: 0 (default) or 1
+	Dir               string   `yaml:"dir"`
+	PerClient         bool     `yaml:"perClient"`
+	LogRetentionDays  uint64   `yaml:"logRetentionDays"`
+	Filter            []string `yaml:"filter"`            // blocked and/or errors, all queries are logged if empty
+	AnonymizeClientIP string   `yaml:"anonymizeClientIP"` // mask or hash, client IPs are not anonymized if empty
+	AnonymizationSalt string   `yaml:"anonymizationSalt"`
+	// client names, IPs or CIDRs, whose queries are never logged or counted in statistics
+	ExcludedClients []string `yaml:"excludedClients"`
 }
 
+// DefaultPath is the path of the configuration file
+const DefaultPath = "config.yml"
+
 func NewConfig() Config {
-	cfg := Config{}
-	data, err := ioutil.ReadFile("config.yml")
+	cfg, err := LoadConfig(DefaultPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return cfg
+}
+
+// LoadConfig reads and parses the configuration file or the merged files of the configuration directory
+func LoadConfig(path string) (Config, error) {
+	data, err := ReadConfig(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg, err := ParseConfig(data)
+	cfg.path = path
+
+	return cfg, err
+}
+
+// ParseConfig parses the configuration, applies environment variables and default values
+func ParseConfig(data []byte) (Config, error) {
+	cfg := Config{
+		Blocking: BlockingConfig{
+			RefreshPeriod: MinutesDuration(defaultRefreshPeriod),
+		},
+		Caching: CachingConfig{
+			CacheTimeNegative: Duration(defaultCacheTimeNegative),
+		},
+		Upstream: UpstreamConfig{
+			Retries: defaultUpstreamRetries,
+		},
+		LogTimestamp: true,
+	}
 
+	err := yaml.UnmarshalStrict(data, &cfg)
 	if err != nil {
-		log.Fatal("Can't read config file: ", err)
+		return cfg, fmt.Errorf("wrong file structure: %v", err)
 	}
 
-	err = yaml.UnmarshalStrict(data, &cfg)
+	cfg.envOverrides, cfg.unknownEnv, err = cfg.applyEnvOverrides(os.Environ())
 	if err != nil {
-		log.Fatal("wrong file structure: ", err)
+		return cfg, err
 	}
 
-	return cfg
+	cfg.applyUpstreamDefaults()
+
+	return cfg, nil
+}
+
+// sets global timeout (if not defined per upstream), retries and outgoing address for all upstreams
+func (c *Config) applyUpstreamDefaults() {
+	apply := func(u *Upstream, outgoingAddress string) {
+		if u.Timeout == 0 {
+			u.Timeout = time.Duration(c.Upstream.Timeout)
+		}
+
+		u.Retries = c.Upstream.Retries
+		u.OutgoingAddress = outgoingAddress
+	}
+
+	for i := range c.Upstream.ExternalResolvers {
+		apply(&c.Upstream.ExternalResolvers[i], c.Upstream.groupOutgoingAddress("default"))
+	}
+
+	for name, upstreams := range c.Upstream.Groups {
+		for i := range upstreams {
+			apply(&upstreams[i], c.Upstream.groupOutgoingAddress(name))
+		}
+	}
+
+	for _, mapping := range c.Conditional.Mapping {
+		for i := range mapping.Upstreams {
+			apply(&mapping.Upstreams[i], c.Upstream.OutgoingAddress)
+		}
+	}
+
+	if (Upstream{}) != c.ClientLookup.Upstream {
+		apply(&c.ClientLookup.Upstream, c.Upstream.OutgoingAddress)
+	}
+
+	if (Upstream{}) != c.BootstrapDNS {
+		apply(&c.BootstrapDNS, c.Upstream.OutgoingAddress)
+	}
+}
+
+// returns the outgoing address of the upstream group, the global one if not defined for the group
+func (c *UpstreamConfig) groupOutgoingAddress(group string) string {
+	if address, ok := c.GroupOutgoingAddresses[group]; ok {
+		return address
+	}
+
+	return c.OutgoingAddress
 }
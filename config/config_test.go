@@ -1,13 +1,14 @@
 package config
 
 import (
-	"net"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 func Test_NewConfig(t *testing.T) {
@@ -16,19 +17,147 @@ func Test_NewConfig(t *testing.T) {
 
 	cfg := NewConfig()
 
-	assert.Equal(t, uint16(55555), cfg.Port)
+	assert.Equal(t, ListenConfig{"55555"}, cfg.Port)
 	assert.Len(t, cfg.Upstream.ExternalResolvers, 3)
 	assert.Equal(t, "8.8.8.8", cfg.Upstream.ExternalResolvers[0].Host)
 	assert.Equal(t, "8.8.4.4", cfg.Upstream.ExternalResolvers[1].Host)
 	assert.Equal(t, "1.1.1.1", cfg.Upstream.ExternalResolvers[2].Host)
 	assert.Len(t, cfg.CustomDNS.Mapping, 1)
-	assert.Equal(t, net.ParseIP("192.168.178.3"), cfg.CustomDNS.Mapping["my.duckdns.org"])
+	assert.Equal(t, CustomDNSEntries{"A 192.168.178.3"}, cfg.CustomDNS.Mapping["my.duckdns.org"])
 	assert.Len(t, cfg.Conditional.Mapping, 1)
 	assert.Equal(t, "192.168.178.1", cfg.ClientLookup.Upstream.Host)
 	assert.Equal(t, []uint{2, 1}, cfg.ClientLookup.SingleNameOrder)
 	assert.Len(t, cfg.Blocking.BlackLists, 2)
 	assert.Len(t, cfg.Blocking.WhiteLists, 1)
 	assert.Len(t, cfg.Blocking.ClientGroupsBlock, 2)
+	assert.Equal(t, MinutesDuration(4*time.Hour), cfg.Blocking.RefreshPeriod)
+	assert.Equal(t, Duration(30*time.Minute), cfg.Caching.CacheTimeNegative)
+	assert.Equal(t, defaultUpstreamRetries, cfg.Upstream.ExternalResolvers[0].Retries)
+	assert.Equal(t, defaultUpstreamRetries, cfg.ClientLookup.Upstream.Retries)
+	assert.True(t, cfg.LogTimestamp)
+}
+
+func TestUpstream_Timeout(t *testing.T) {
+	cfg := Config{}
+
+	err := yaml.UnmarshalStrict([]byte(`upstream:
+  timeout: 1s
+  retries: 1
+  externalResolvers:
+    - udp:8.8.8.8
+    - upstream: udp:1.1.1.1
+      timeout: 500ms
+  groups:
+    kids:
+      - udp:185.228.168.168
+conditional:
+  mapping:
+    fritz.box:
+      - upstream: udp:192.168.178.1
+        timeout: 200ms
+      - udp:192.168.178.2`), &cfg)
+	assert.NoError(t, err)
+
+	cfg.applyUpstreamDefaults()
+
+	assert.Equal(t, Upstream{Net: "udp", Host: "8.8.8.8", Port: 53, Timeout: time.Second, Retries: 1},
+		cfg.Upstream.ExternalResolvers[0])
+	assert.Equal(t, Upstream{Net: "udp", Host: "1.1.1.1", Port: 53, Timeout: 500 * time.Millisecond, Retries: 1},
+		cfg.Upstream.ExternalResolvers[1])
+	assert.Equal(t, Upstream{Net: "udp", Host: "185.228.168.168", Port: 53, Timeout: time.Second, Retries: 1},
+		cfg.Upstream.Groups["kids"][0])
+	assert.Equal(t, 200*time.Millisecond, cfg.Conditional.Mapping["fritz.box"].Upstreams[0].Timeout)
+	assert.Equal(t, time.Second, cfg.Conditional.Mapping["fritz.box"].Upstreams[1].Timeout)
+	assert.Equal(t, Upstream{}, cfg.ClientLookup.Upstream)
+
+	err = yaml.UnmarshalStrict([]byte(`upstream:
+  externalResolvers:
+    - upstream: udp:invalid:port`), &cfg)
+	assert.Error(t, err)
+}
+
+func TestUpstream_OutgoingAddress(t *testing.T) {
+	cfg := Config{}
+
+	err := yaml.UnmarshalStrict([]byte(`upstream:
+  outgoingAddress: 192.168.178.10
+  groupOutgoingAddresses:
+    kids: 10.0.0.10
+  externalResolvers:
+    - udp:8.8.8.8
+  groups:
+    kids:
+      - udp:185.228.168.168
+    guests:
+      - udp:1.1.1.1
+conditional:
+  mapping:
+    fritz.box: udp:192.168.178.1`), &cfg)
+	assert.NoError(t, err)
+
+	cfg.applyUpstreamDefaults()
+
+	assert.Equal(t, "192.168.178.10", cfg.Upstream.ExternalResolvers[0].OutgoingAddress)
+	assert.Equal(t, "10.0.0.10", cfg.Upstream.Groups["kids"][0].OutgoingAddress)
+	assert.Equal(t, "192.168.178.10", cfg.Upstream.Groups["guests"][0].OutgoingAddress)
+	assert.Equal(t, "192.168.178.10", cfg.Conditional.Mapping["fritz.box"].Upstreams[0].OutgoingAddress)
+}
+
+func TestListenConfig_Unmarshal(t *testing.T) {
+	cfg := struct {
+		Port ListenConfig `yaml:"port"`
+	}{}
+
+	err := yaml.UnmarshalStrict([]byte("port: 53"), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, ListenConfig{"53"}, cfg.Port)
+
+	err = yaml.UnmarshalStrict([]byte("port:\n  - 53\n  - 127.0.0.1:5353\n  - '[::1]:5353'"), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, ListenConfig{"53", "127.0.0.1:5353", "[::1]:5353"}, cfg.Port)
+
+	err = yaml.UnmarshalStrict([]byte("port:\n  a: b"), &cfg)
+	assert.Error(t, err)
+}
+
+func TestDuration_Unmarshal(t *testing.T) {
+	cfg := struct {
+		TTL Duration `yaml:"ttl"`
+	}{}
+
+	// number without unit is ambiguous
+	err := yaml.UnmarshalStrict([]byte("ttl: 5"), &cfg)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unit is missing")
+
+	err = yaml.UnmarshalStrict([]byte("ttl: 1h30m"), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, Duration(90*time.Minute), cfg.TTL)
+
+	err = yaml.UnmarshalStrict([]byte("ttl: 0"), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, Duration(0), cfg.TTL)
+
+	err = yaml.UnmarshalStrict([]byte("ttl: abc"), &cfg)
+	assert.Error(t, err)
+}
+
+func TestMinutesDuration_Unmarshal(t *testing.T) {
+	cfg := struct {
+		RefreshPeriod MinutesDuration `yaml:"refreshPeriod"`
+	}{}
+
+	// legacy format in minutes
+	err := yaml.UnmarshalStrict([]byte("refreshPeriod: 5"), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, MinutesDuration(5*time.Minute), cfg.RefreshPeriod)
+
+	err = yaml.UnmarshalStrict([]byte("refreshPeriod: 1h30m"), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, MinutesDuration(90*time.Minute), cfg.RefreshPeriod)
+
+	err = yaml.UnmarshalStrict([]byte("refreshPeriod: abc"), &cfg)
+	assert.Error(t, err)
 }
 
 func Test_NewConfig_FileDoesNotExist(t *testing.T) {
@@ -76,6 +205,36 @@ var tests = []struct {
 		args:       "tcp-tls:4.4.4.4",
 		wantResult: Upstream{Net: "tcp-tls", Host: "4.4.4.4", Port: 853},
 	},
+	{
+		name:       "tcpTlsWithCommonName",
+		args:       "tcp-tls:1.1.1.1:853#cloudflare-dns.com",
+		wantResult: Upstream{Net: "tcp-tls", Host: "1.1.1.1", Port: 853, CommonName: "cloudflare-dns.com"},
+	},
+	{
+		name:    "udpWithCommonName",
+		args:    "udp:1.1.1.1#cloudflare-dns.com",
+		wantErr: true,
+	},
+	{
+		name:       "httpsDefault",
+		args:       "https://dns.google/dns-query",
+		wantResult: Upstream{Net: "https", Host: "dns.google", Port: 443, Path: "/dns-query"},
+	},
+	{
+		name:       "httpsWithPortWithoutPath",
+		args:       "https://1.1.1.1:8443",
+		wantResult: Upstream{Net: "https", Host: "1.1.1.1", Port: 8443, Path: "/dns-query"},
+	},
+	{
+		name:    "httpsInvalidPort",
+		args:    "https://1.1.1.1:0/dns-query",
+		wantErr: true,
+	},
+	{
+		name:    "httpsWithoutURL",
+		args:    "https:1.1.1.1",
+		wantErr: true,
+	},
 	{
 		name:       "empty",
 		args:       "",
@@ -106,6 +265,114 @@ var tests = []struct {
 		args:    "tcp-4.4.4.4",
 		wantErr: true,
 	},
+	{
+		name:       "withoutNet",
+		args:       "4.4.4.4",
+		wantResult: Upstream{Net: "udp", Host: "4.4.4.4", Port: 53},
+	},
+	{
+		name:       "withoutNetWithPort",
+		args:       "4.4.4.4:5353",
+		wantResult: Upstream{Net: "udp", Host: "4.4.4.4", Port: 5353},
+	},
+	{
+		name:       "hostName",
+		args:       "tcp-tls:Dns.Quad9.net",
+		wantResult: Upstream{Net: "tcp-tls", Host: "dns.quad9.net", Port: 853},
+	},
+	{
+		name:       "hostNameWithoutNet",
+		args:       "dns.example:5353",
+		wantResult: Upstream{Net: "udp", Host: "dns.example", Port: 5353},
+	},
+	{
+		name:       "ipv6",
+		args:       "udp:2620:fe::fe",
+		wantResult: Upstream{Net: "udp", Host: "2620:fe::fe", Port: 53},
+	},
+	{
+		name:       "ipv6Normalized",
+		args:       "tcp:2620:00fe:0:0:0:0:0:00fe",
+		wantResult: Upstream{Net: "tcp", Host: "2620:fe::fe", Port: 53},
+	},
+	{
+		name:       "ipv6WithoutNet",
+		args:       "2620:fe::fe",
+		wantResult: Upstream{Net: "udp", Host: "2620:fe::fe", Port: 53},
+	},
+	{
+		name:       "ipv6InBrackets",
+		args:       "tcp-tls:[2620:fe::fe]",
+		wantResult: Upstream{Net: "tcp-tls", Host: "2620:fe::fe", Port: 853},
+	},
+	{
+		name:       "ipv6WithPort",
+		args:       "tcp-tls:[2620:fe::fe]:8853#dns.quad9.net",
+		wantResult: Upstream{Net: "tcp-tls", Host: "2620:fe::fe", Port: 8853, CommonName: "dns.quad9.net"},
+	},
+	{
+		name:       "ipv6WithPortWithoutNet",
+		args:       "[::1]:5353",
+		wantResult: Upstream{Net: "udp", Host: "::1", Port: 5353},
+	},
+	{
+		name:    "ipv6MissingBracket",
+		args:    "udp:[2620:fe::fe:53",
+		wantErr: true,
+	},
+	{
+		name:    "ipv6InvalidPort",
+		args:    "udp:[2620:fe::fe]:x",
+		wantErr: true,
+	},
+	{
+		name:    "ipv4InBrackets",
+		args:    "udp:[1.1.1.1]:53",
+		wantErr: true,
+	},
+	{
+		name:    "invalidHost",
+		args:    "udp:dns_server!:53",
+		wantErr: true,
+	},
+	{
+		name:    "invalidIPv4",
+		args:    "udp:1.2.3",
+		wantErr: true,
+	},
+}
+
+func TestUpstream_String(t *testing.T) {
+	assert.Equal(t, "udp:8.8.8.8:53", Upstream{Net: "udp", Host: "8.8.8.8", Port: 53}.String())
+	assert.Equal(t, "https://dns.google:443/dns-query",
+		Upstream{Net: "https", Host: "dns.google", Port: 443, Path: "/dns-query"}.String())
+	assert.Equal(t, "tcp-tls:[2620:fe::fe]:853#dns.quad9.net",
+		Upstream{Net: "tcp-tls", Host: "2620:fe::fe", Port: 853, CommonName: "dns.quad9.net"}.String())
+}
+
+func TestUpstream_StringRoundTrip(t *testing.T) {
+	for _, tt := range tests {
+		if tt.wantErr || tt.args == "" {
+			continue
+		}
+
+		rr := tt
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := parseUpstream(rr.args)
+			assert.NoError(t, err)
+
+			reparsed, err := parseUpstream(parsed.String())
+			assert.NoError(t, err)
+			assert.Equal(t, parsed, reparsed)
+		})
+	}
+}
+
+func Test_parseUpstream_ErrorNamesEntry(t *testing.T) {
+	_, err := parseUpstream("udp:2620:fe::fe:53:x")
+	assert.EqualError(t, err, "wrong configuration, couldn't parse upstream 'udp:2620:fe::fe:53:x': invalid address "+
+		"'2620:fe::fe:53:x', IPv6 address with port must be enclosed in brackets, please use "+
+		"[net:]host[:port][#commonName] with net one of tcp, tcp-tls or udp")
 }
 
 func Test_parseUpstream(t *testing.T) {
@@ -123,3 +390,134 @@ func Test_parseUpstream(t *testing.T) {
 		})
 	}
 }
+
+func TestCustomDNSEntries_Unmarshal(t *testing.T) {
+	cfg := struct {
+		Mapping map[string]CustomDNSEntries `yaml:"mapping"`
+	}{}
+
+	err := yaml.UnmarshalStrict([]byte(`mapping:
+  printer.lan: 192.168.178.3, fd00::3
+  nas.lan:
+    - 192.168.178.10
+    - TXT "some text"
+  www.lan:
+    - CNAME nas.lan`), &cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, CustomDNSEntries{"A 192.168.178.3", "AAAA fd00::3"}, cfg.Mapping["printer.lan"])
+	assert.Equal(t, CustomDNSEntries{"A 192.168.178.10", `TXT "some text"`}, cfg.Mapping["nas.lan"])
+	assert.Equal(t, CustomDNSEntries{"CNAME nas.lan"}, cfg.Mapping["www.lan"])
+
+	err = yaml.UnmarshalStrict([]byte(`mapping:
+  printer.lan: invalid`), &cfg)
+	assert.Error(t, err)
+}
+
+func TestUpstreams_Unmarshal(t *testing.T) {
+	cfg := ConditionalUpstreamConfig{}
+
+	err := yaml.UnmarshalStrict([]byte(`mapping:
+  fritz.box: udp:192.168.178.1
+  corp.example.com: udp:10.0.0.1, tcp:10.0.0.2
+  other.example.com:
+    - udp:10.0.0.3
+    - tcp-tls:1.1.1.1:853`), &cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, Upstreams{{Net: "udp", Host: "192.168.178.1", Port: 53}}, cfg.Mapping["fritz.box"].Upstreams)
+	assert.Equal(t, Upstreams{
+		{Net: "udp", Host: "10.0.0.1", Port: 53},
+		{Net: "tcp", Host: "10.0.0.2", Port: 53}}, cfg.Mapping["corp.example.com"].Upstreams)
+	assert.Len(t, cfg.Mapping["other.example.com"].Upstreams, 2)
+	assert.False(t, cfg.Mapping["fritz.box"].DisableCache)
+
+	err = yaml.UnmarshalStrict([]byte(`mapping:
+  fritz.box: invalid`), &cfg)
+	assert.Error(t, err)
+}
+
+func TestConditionalMapping_Unmarshal(t *testing.T) {
+	cfg := ConditionalUpstreamConfig{}
+
+	err := yaml.UnmarshalStrict([]byte(`mapping:
+  dyn.example.com:
+    upstreams: udp:10.0.0.1, udp:10.0.0.2
+    cache: false
+  static.example.com:
+    upstreams:
+      - udp:10.0.0.3
+    cache: true`), &cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, ConditionalMapping{
+		Upstreams: Upstreams{
+			{Net: "udp", Host: "10.0.0.1", Port: 53},
+			{Net: "udp", Host: "10.0.0.2", Port: 53}},
+		DisableCache: true,
+	}, cfg.Mapping["dyn.example.com"])
+	assert.Equal(t, ConditionalMapping{Upstreams: Upstreams{{Net: "udp", Host: "10.0.0.3", Port: 53}}},
+		cfg.Mapping["static.example.com"])
+
+	// upstreams are mandatory
+	err = yaml.UnmarshalStrict([]byte(`mapping:
+  dyn.example.com:
+    cache: false`), &cfg)
+	assert.Error(t, err)
+
+	err = yaml.UnmarshalStrict([]byte(`mapping:
+  dyn.example.com:
+    upstreams: udp:10.0.0.1
+    unknown: true`), &cfg)
+	assert.Error(t, err)
+}
+
+func TestParseScheduleWindow(t *testing.T) {
+	w, err := ParseScheduleWindow("sun-thu 21:00-07:00")
+	assert.NoError(t, err)
+	assert.Equal(t, ScheduleWindow{
+		Days: [7]bool{true, true, true, true, true, false, false},
+		From: 21 * time.Hour,
+		To:   7 * time.Hour,
+	}, w)
+	assert.Equal(t, "sun,mon,tue,wed,thu 21:00-07:00", w.String())
+
+	w, err = ParseScheduleWindow("Friday-mon,wed 08:30-24:00")
+	assert.NoError(t, err)
+	assert.Equal(t, [7]bool{true, true, false, true, false, true, true}, w.Days)
+	assert.Equal(t, 8*time.Hour+30*time.Minute, w.From)
+	assert.Equal(t, 24*time.Hour, w.To)
+
+	reparsed, err := ParseScheduleWindow(w.String())
+	assert.NoError(t, err)
+	assert.Equal(t, w, reparsed)
+
+	// without days: every day
+	w, err = ParseScheduleWindow("12:00-13:00")
+	assert.NoError(t, err)
+	assert.Equal(t, [7]bool{true, true, true, true, true, true, true}, w.Days)
+	assert.Equal(t, "12:00-13:00", w.String())
+
+	for _, s := range []string{"", "mon", "mon 21:00", "mon 21:00-7:00", "xyz 21:00-07:00", "mon-tue-wed 21:00-07:00",
+		"mon 25:00-07:00", "mon 21:60-07:00", "mon 24:30-07:00", "mon tue 21:00-07:00"} {
+		_, err = ParseScheduleWindow(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestScheduleWindow_Unmarshal(t *testing.T) {
+	var cfg BlockingConfig
+
+	err := yaml.UnmarshalStrict([]byte(`schedules:
+  youtube:
+    - sun-thu 21:00-07:00
+    - sat 12:00-14:00`), &cfg)
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Schedules["youtube"], 2)
+	assert.Equal(t, 12*time.Hour, cfg.Schedules["youtube"][1].From)
+
+	err = yaml.UnmarshalStrict([]byte(`schedules:
+  youtube:
+    - sun-thu 21:00`), &cfg)
+	assert.Error(t, err)
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// prefix of environment variables, which override configuration values
+const envPrefix = "BLOCKY_"
+
+// nolint:gochecknoglobals
+var yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// applyEnvOverrides sets configuration values from environment variables ("KEY=value"), which take precedence over
+// the configuration file. The variable name is the YAML path of the value in upper case with "_" as separator, e.g.
+// BLOCKY_UPSTREAM_EXTERNALRESOLVERS for upstream.externalResolvers. Values are parsed like in the configuration file:
+// lists as comma separated values, maps and complex lists in YAML flow style, e.g. {default: [ads]}.
+// Returns the names of applied and unknown variables
+func (c *Config) applyEnvOverrides(environ []string) (applied []string, unknown []string, err error) {
+	env := make(map[string]string)
+
+	for _, e := range environ {
+		if i := strings.Index(e, "="); i > 0 && strings.HasPrefix(e[:i], envPrefix) {
+			env[e[:i]] = e[i+1:]
+		}
+	}
+
+	if len(env) == 0 {
+		return nil, nil, nil
+	}
+
+	if err := applyEnvToStruct(reflect.ValueOf(c).Elem(), envPrefix, env, &applied); err != nil {
+		return nil, nil, err
+	}
+
+	for name := range env {
+		unknown = append(unknown, name)
+	}
+
+	sort.Strings(applied)
+	sort.Strings(unknown)
+
+	return applied, unknown, nil
+}
+
+// sets fields of the struct from matching variables, applied variables are removed from env
+func applyEnvToStruct(v reflect.Value, prefix string, env map[string]string, applied *[]string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		key := yamlKey(field)
+		if key == "" {
+			continue
+		}
+
+		name := prefix + strings.ToUpper(key)
+		fieldValue := v.Field(i)
+
+		if value, ok := env[name]; ok {
+			if err := setFromEnv(fieldValue, value); err != nil {
+				return fmt.Errorf("can't parse environment variable %s: %v", name, err)
+			}
+
+			*applied = append(*applied, name)
+
+			delete(env, name)
+
+			continue
+		}
+
+		// nested values, types with own YAML format can only be set as a whole
+		if fieldValue.Kind() == reflect.Struct && !reflect.PtrTo(field.Type).Implements(yamlUnmarshalerType) {
+			if err := applyEnvToStruct(fieldValue, name+"_", env, applied); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// returns the YAML key of the struct field like the YAML parser, empty string for ignored fields
+func yamlKey(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+
+	switch key {
+	case "-":
+		return ""
+	case "":
+		return strings.ToLower(field.Name)
+	default:
+		return key
+	}
+}
+
+// parses the value into a new value of the field type and replaces the field
+func setFromEnv(field reflect.Value, value string) error {
+	parsed := reflect.New(field.Type())
+	trimmed := strings.TrimSpace(value)
+
+	switch {
+	case strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{"):
+		// YAML flow style
+		if err := yaml.UnmarshalStrict([]byte(trimmed), parsed.Interface()); err != nil {
+			return err
+		}
+	case field.Kind() == reflect.String:
+		// used as is, e.g. data source names with special characters
+		parsed.Elem().SetString(value)
+	case field.Kind() == reflect.Slice:
+		var values []string
+
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+
+		data, err := yaml.Marshal(values)
+		if err != nil {
+			return err
+		}
+
+		if err := yaml.UnmarshalStrict(data, parsed.Interface()); err != nil {
+			return err
+		}
+	default:
+		if err := yaml.UnmarshalStrict([]byte(value), parsed.Interface()); err != nil {
+			return err
+		}
+	}
+
+	field.Set(parsed.Elem())
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_applyEnvOverrides(t *testing.T) {
+	cfg := Config{
+		Port:     ListenConfig{"53"},
+		LogLevel: "info",
+		Blocking: BlockingConfig{ClientGroupsBlock: map[string][]string{"laptop": {"ads"}}},
+	}
+
+	applied, unknown, err := cfg.applyEnvOverrides([]string{
+		"PATH=/usr/bin",
+		"BLOCKY_PORT=5353",
+		"BLOCKY_LOGLEVEL=debug",
+		"BLOCKY_UPSTREAM_EXTERNALRESOLVERS=udp:1.1.1.1, udp:9.9.9.9",
+		"BLOCKY_UPSTREAM_TIMEOUT=500ms",
+		"BLOCKY_BOOTSTRAPDNS=udp:8.8.8.8",
+		"BLOCKY_CACHING_PREFETCHING=true",
+		"BLOCKY_BLOCKING_CLIENTGROUPSBLOCK={default: [ads, kids]}",
+		"BLOCKY_QUERYLOG_TARGET=user:p=ss,word@tcp(db:3306)/blocky",
+		"BLOCKY_CUSTOMDNS_MAPPING={printer.lan: 192.168.178.3}",
+		"BLOCKY_UNKNOWN=1",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"BLOCKY_BLOCKING_CLIENTGROUPSBLOCK",
+		"BLOCKY_BOOTSTRAPDNS",
+		"BLOCKY_CACHING_PREFETCHING",
+		"BLOCKY_CUSTOMDNS_MAPPING",
+		"BLOCKY_LOGLEVEL",
+		"BLOCKY_PORT",
+		"BLOCKY_QUERYLOG_TARGET",
+		"BLOCKY_UPSTREAM_EXTERNALRESOLVERS",
+		"BLOCKY_UPSTREAM_TIMEOUT",
+	}, applied)
+	assert.Equal(t, []string{"BLOCKY_UNKNOWN"}, unknown)
+
+	assert.Equal(t, ListenConfig{"5353"}, cfg.Port)
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.Equal(t, []Upstream{
+		{Net: "udp", Host: "1.1.1.1", Port: 53},
+		{Net: "udp", Host: "9.9.9.9", Port: 53},
+	}, cfg.Upstream.ExternalResolvers)
+	assert.Equal(t, Duration(500*time.Millisecond), cfg.Upstream.Timeout)
+	assert.Equal(t, Upstream{Net: "udp", Host: "8.8.8.8", Port: 53}, cfg.BootstrapDNS)
+	assert.True(t, cfg.Caching.Prefetching)
+	// maps are replaced completely
+	assert.Equal(t, map[string][]string{"default": {"ads", "kids"}}, cfg.Blocking.ClientGroupsBlock)
+	// strings are used as is
+	assert.Equal(t, "user:p=ss,word@tcp(db:3306)/blocky", cfg.QueryLog.Target)
+	assert.Equal(t, CustomDNSEntries{"A 192.168.178.3"}, cfg.CustomDNS.Mapping["printer.lan"])
+}
+
+func TestConfig_applyEnvOverrides_Invalid(t *testing.T) {
+	cfg := Config{}
+
+	_, _, err := cfg.applyEnvOverrides([]string{"BLOCKY_UPSTREAM_EXTERNALRESOLVERS=udp:1.1.1.1:x"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "can't parse environment variable BLOCKY_UPSTREAM_EXTERNALRESOLVERS")
+
+	_, _, err = cfg.applyEnvOverrides([]string{"BLOCKY_HTTPPORT=abc"})
+	assert.Error(t, err)
+
+	applied, unknown, err := cfg.applyEnvOverrides([]string{"HOME=/root"})
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+	assert.Empty(t, unknown)
+}
+
+func TestLoadConfig_EnvOverrides(t *testing.T) {
+	os.Setenv("BLOCKY_UPSTREAM_TIMEOUT", "3s")
+	os.Setenv("BLOCKY_PORT", "5353")
+
+	defer os.Unsetenv("BLOCKY_UPSTREAM_TIMEOUT")
+	defer os.Unsetenv("BLOCKY_PORT")
+
+	file, err := ioutil.TempFile("", "config")
+	assert.NoError(t, err)
+
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("upstream:\n  externalResolvers:\n    - udp:8.8.8.8\nport: 55\n")
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	cfg, err := LoadConfig(file.Name())
+	assert.NoError(t, err)
+
+	assert.Equal(t, ListenConfig{"5353"}, cfg.Port)
+	// upstream defaults are applied after the overrides
+	assert.Equal(t, 3*time.Second, cfg.Upstream.ExternalResolvers[0].Timeout)
+
+	applied, unknown := cfg.EnvOverrides()
+	assert.Equal(t, []string{"BLOCKY_PORT", "BLOCKY_UPSTREAM_TIMEOUT"}, applied)
+	assert.Empty(t, unknown)
+}
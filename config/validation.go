@@ -0,0 +1,512 @@
+package config
+
+import (
+	"blocky/util"
+	"fmt"
+	"net"
+	"net/url"
+	"os/user"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ValidationError describes an invalid configuration value with its YAML path
+type ValidationError struct {
+	Path    string
+	Message string
+	// warnings don't prevent the start, e.g. missing bootstrap DNS
+	Warning bool
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationErrors is a list of validation problems
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(messages, "; "))
+}
+
+// Fatal returns the problems, which are no warnings
+func (e ValidationErrors) Fatal() (result ValidationErrors) {
+	for _, err := range e {
+		if !err.Warning {
+			result = append(result, err)
+		}
+	}
+
+	return
+}
+
+// address of a remote syslog daemon or path of the local socket
+var syslogTargetPattern = regexp.MustCompile(`^((udp|tcp)://[^/]+|unix:///.+)$`) // nolint:gochecknoglobals
+
+var mqttTargetPattern = regexp.MustCompile(`^(tcp|mqtt|tls|ssl|mqtts)://[^/]+/?$`) // nolint:gochecknoglobals
+
+type validator struct {
+	errors ValidationErrors
+}
+
+func (v *validator) fail(path, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warn(path, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+
+	names := make([]string, 0, len(allowed))
+
+	for _, a := range allowed {
+		if a != "" {
+			names = append(names, a)
+		}
+	}
+
+	v.fail(path, "unknown value '%s', please use one of: %s", value, strings.Join(names, ", "))
+}
+
+func (v *validator) ipNets(path string, entries []string) {
+	if _, err := util.ParseIPNets(entries); err != nil {
+		v.fail(path, "%v", err)
+	}
+}
+
+func (v *validator) queryTypes(path string, types []string) {
+	for _, t := range types {
+		if _, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(t))]; !ok {
+			v.fail(path, "unknown query type '%s'", t)
+		}
+	}
+}
+
+// Validate checks the configuration values, which are not checked on parsing. The same checks are used on server
+// start and by the validate command. Returns nil if no problems were found
+func (c *Config) Validate() ValidationErrors {
+	v := &validator{}
+
+	c.validateUpstreams(v)
+	c.validateBlocking(v)
+	c.validateQueryLog(v)
+	c.validateResolverOrder(v)
+
+	v.oneOf("ednsClientSubnet.mode", c.EdnsClientSubnet.Mode, "", "strip", "forward", "add")
+
+	if c.EdnsClientSubnet.IPv4Mask > 32 {
+		v.fail("ednsClientSubnet.ipv4Mask", "prefix length %d is greater than 32", c.EdnsClientSubnet.IPv4Mask)
+	}
+
+	if c.EdnsClientSubnet.IPv6Mask > 128 {
+		v.fail("ednsClientSubnet.ipv6Mask", "prefix length %d is greater than 128", c.EdnsClientSubnet.IPv6Mask)
+	}
+
+	if d := time.Duration(c.Caching.CacheTimeServfail); d < 0 || d > MaxCacheTimeServfail {
+		v.fail("caching.cacheTimeServfail", "must be between 0 and %s", MaxCacheTimeServfail)
+	}
+
+	c.validateDomainCachingTimes(v)
+
+	if cc := c.Conditional.Caching; cc.MaxCachingTime > 0 && cc.MinCachingTime > cc.MaxCachingTime {
+		v.fail("conditional.caching.minCachingTime", "min. caching time %s is greater than max. caching time %s",
+			time.Duration(cc.MinCachingTime), time.Duration(cc.MaxCachingTime))
+	}
+
+	v.ipNets("rateLimit.whitelist", c.RateLimit.Whitelist)
+	v.oneOf("rebindProtection.mode", c.RebindProtection.Mode, "", "remove", "nxdomain")
+	c.validateDNS64(v)
+	v.oneOf("clientLookup.leaseFileFormat", c.ClientLookup.LeaseFileFormat, "", "dnsmasq", "isc", "kea")
+
+	if len(c.ClientLookup.SingleNameOrder) > 0 && len(c.ClientLookup.PrimaryNameOrder) > 0 {
+		v.warn("clientLookup.primaryNameOrder", "primaryNameOrder is ignored, because singleNameOrder is defined")
+	}
+	v.queryTypes("queryTypeFilter.queryTypes", c.QueryTypeFilter.QueryTypes)
+
+	for _, client := range sortedKeys(c.QueryTypeFilter.ClientGroups) {
+		v.queryTypes(fmt.Sprintf("queryTypeFilter.clientGroups.%s", client), c.QueryTypeFilter.ClientGroups[client])
+	}
+
+	v.ipNets("allowedClients", c.AllowedClients)
+	v.oneOf("disallowedClientAction", c.DisallowedClientAction, "", "refuse", "drop")
+	v.ipNets("trustedProxies", c.TrustedProxies)
+
+	v.oneOf("logFormat", c.LogFormat, "", "text", "json")
+
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			v.fail("logLevel", "%v", err)
+		}
+	}
+
+	if address := strings.Trim(strings.TrimSpace(c.BindAddress), "[]"); address != "" && net.ParseIP(address) == nil {
+		v.fail("bindAddress", "invalid bind address '%s', please use an IPv4 or IPv6 address", c.BindAddress)
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") || ((c.HTTPSPort > 0 || c.TLSPort > 0) && c.CertFile == "") {
+		v.fail("certFile", "certFile and keyFile must be defined together, both are required for tlsPort and httpsPort")
+	}
+
+	if c.User != "" {
+		if _, err := user.Lookup(c.User); err != nil {
+			if _, err := user.LookupId(c.User); err != nil {
+				v.fail("user", "unknown user '%s'", c.User)
+			}
+		}
+	}
+
+	if c.Group != "" {
+		if _, err := user.LookupGroup(c.Group); err != nil {
+			if _, err := user.LookupGroupId(c.Group); err != nil {
+				v.fail("group", "unknown group '%s'", c.Group)
+			}
+		}
+	}
+
+	if len(v.errors) == 0 {
+		return nil
+	}
+
+	return v.errors
+}
+
+func (c *Config) validateUpstreams(v *validator) {
+	if len(c.Upstream.ExternalResolvers) == 0 {
+		v.warn("upstream.externalResolvers", "no upstream is defined, only custom DNS and conditional queries "+
+			"can be resolved")
+	}
+
+	v.oneOf("upstreamStrategy", c.UpstreamStrategy, "", "parallel_best", "random", "strict")
+
+	if _, ok := c.Upstream.Groups["default"]; ok {
+		v.fail("upstream.groups.default", "the default group is defined with upstream.externalResolvers")
+	}
+
+	for _, name := range sortedGroupKeys(c.Upstream.Groups) {
+		if len(c.Upstream.Groups[name]) == 0 {
+			v.fail(fmt.Sprintf("upstream.groups.%s", name), "group has no upstreams")
+		}
+	}
+
+	for _, client := range sortedClientKeys(c.Upstream.ClientGroups) {
+		path := fmt.Sprintf("upstream.clientGroups.%s", client)
+
+		if strings.Contains(client, "/") {
+			if _, _, err := net.ParseCIDR(client); err != nil {
+				v.fail(path, "invalid client CIDR: %v", err)
+			}
+		}
+
+		if group := c.Upstream.ClientGroups[client]; group != "default" {
+			if _, ok := c.Upstream.Groups[group]; !ok {
+				v.fail(path, "unknown upstream group '%s'", group)
+			}
+		}
+	}
+
+	if address := c.Upstream.OutgoingAddress; address != "" && net.ParseIP(address) == nil {
+		v.fail("upstream.outgoingAddress", "invalid IP address '%s'", address)
+	}
+
+	for _, group := range sortedClientKeys(c.Upstream.GroupOutgoingAddresses) {
+		path := fmt.Sprintf("upstream.groupOutgoingAddresses.%s", group)
+
+		if _, ok := c.Upstream.Groups[group]; !ok && group != "default" {
+			v.fail(path, "unknown upstream group '%s'", group)
+		}
+
+		if address := c.Upstream.GroupOutgoingAddresses[group]; net.ParseIP(address) == nil {
+			v.fail(path, "invalid IP address '%s'", address)
+		}
+	}
+
+	if c.BootstrapDNS != (Upstream{}) && net.ParseIP(c.BootstrapDNS.Host) == nil {
+		v.fail("bootstrapDns", "bootstrap DNS '%s' must be defined with IP address", c.BootstrapDNS)
+	}
+
+	if c.BootstrapDNS == (Upstream{}) {
+		for i, u := range c.Upstream.ExternalResolvers {
+			if net.ParseIP(u.Host) == nil {
+				v.warn(fmt.Sprintf("upstream.externalResolvers[%d]", i), "upstream '%s' is defined with host name and "+
+					"no bootstrap DNS is configured, the host name is resolved with the system resolver", u)
+			}
+		}
+	}
+}
+
+func (c *Config) validateBlocking(v *validator) {
+	v.oneOf("blocking.startStrategy", c.Blocking.StartStrategy, "", "blocking", "failOnError", "fast")
+
+	if proxy := c.Blocking.Download.Proxy; proxy != "" {
+		if u, err := url.Parse(proxy); err != nil || u.Host == "" {
+			v.fail("blocking.download.proxy", "invalid proxy URL '%s'", proxy)
+		}
+	}
+
+	blockType := strings.TrimSpace(strings.ToUpper(c.Blocking.BlockType))
+	if blockType != "" && blockType != "ZEROIP" && blockType != "NXDOMAIN" {
+		for _, part := range strings.Split(blockType, ",") {
+			if net.ParseIP(strings.TrimSpace(part)) == nil {
+				v.fail("blocking.blockType", "unknown block type '%s', please use one of: zeroIp, nxDomain or "+
+					"comma separated list of IP addresses", c.Blocking.BlockType)
+
+				break
+			}
+		}
+	}
+
+	for _, client := range sortedKeys(c.Blocking.ClientGroupsBlock) {
+		if strings.Contains(client, "/") {
+			if _, _, err := net.ParseCIDR(client); err != nil {
+				v.fail(fmt.Sprintf("blocking.clientGroupsBlock.%s", client), "invalid client CIDR: %v", err)
+			}
+		}
+
+		for _, group := range c.Blocking.ClientGroupsBlock[client] {
+			_, black := c.Blocking.BlackLists[group]
+			_, white := c.Blocking.WhiteLists[group]
+
+			if !black && !white && !contains(c.Blocking.SafeSearchGroups, group) {
+				v.warn(fmt.Sprintf("blocking.clientGroupsBlock.%s", client), "group '%s' has no lists", group)
+			}
+		}
+	}
+
+	if c.Blocking.ScheduleTimeZone != "" {
+		if _, err := time.LoadLocation(c.Blocking.ScheduleTimeZone); err != nil {
+			v.fail("blocking.scheduleTimeZone", "unknown time zone '%s'", c.Blocking.ScheduleTimeZone)
+		}
+	}
+
+	groups := make([]string, 0, len(c.Blocking.Schedules))
+	for group := range c.Blocking.Schedules {
+		groups = append(groups, group)
+	}
+
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		_, black := c.Blocking.BlackLists[group]
+		_, white := c.Blocking.WhiteLists[group]
+
+		if !black && !white {
+			v.warn(fmt.Sprintf("blocking.schedules.%s", group), "group '%s' has no lists", group)
+		}
+	}
+}
+
+func (c *Config) validateQueryLog(v *validator) {
+	cfg := c.QueryLog
+
+	v.oneOf("queryLog.type", cfg.Type, "", "csv", "mysql", "syslog", "mqtt")
+
+	if cfg.Type == "mysql" && cfg.Target == "" {
+		v.fail("queryLog.target", "data source name is required for query log type mysql")
+	}
+
+	if cfg.Type == "syslog" {
+		v.oneOf("queryLog.facility", cfg.Facility, "", "kern", "user", "mail", "daemon", "auth", "syslog", "lpr",
+			"news", "uucp", "cron", "authpriv", "ftp", "local0", "local1", "local2", "local3", "local4", "local5",
+			"local6", "local7")
+
+		if cfg.Target != "" && !syslogTargetPattern.MatchString(cfg.Target) {
+			v.fail("queryLog.target", "syslog address '%s' must be in format udp://host:port, tcp://host:port or "+
+				"unix:///path", cfg.Target)
+		}
+	}
+
+	if cfg.Type == "mqtt" {
+		c.validateQueryLogMqtt(v)
+	}
+
+	if cfg.Dir != "" && unix.Access(cfg.Dir, unix.W_OK) != nil {
+		v.fail("queryLog.dir", "query log directory '%s' does not exist or is not writable", cfg.Dir)
+	}
+
+	for _, f := range cfg.Filter {
+		v.oneOf("queryLog.filter", f, "blocked", "errors")
+	}
+
+	v.oneOf("queryLog.anonymizeClientIP", cfg.AnonymizeClientIP, "", "mask", "hash")
+
+	for i, client := range cfg.ExcludedClients {
+		if strings.Contains(client, "/") {
+			if _, _, err := net.ParseCIDR(client); err != nil {
+				v.fail(fmt.Sprintf("queryLog.excludedClients[%d]", i), "invalid client CIDR: %v", err)
+			}
+		}
+	}
+}
+
+func (c *Config) validateQueryLogMqtt(v *validator) {
+	cfg := c.QueryLog
+
+	if !mqttTargetPattern.MatchString(cfg.Target) {
+		v.fail("queryLog.target", "mqtt broker '%s' must be in format tcp://host:port, mqtt://, tls://, ssl:// "+
+			"or mqtts://", cfg.Target)
+	}
+
+	if cfg.QoS > 1 {
+		v.fail("queryLog.qos", "QoS %d is not supported, must be 0 or 1", cfg.QoS)
+	}
+
+	if strings.ContainsAny(cfg.Topic, "+#") {
+		v.fail("queryLog.topic", "topic '%s' must not contain wildcards + or #", cfg.Topic)
+	}
+}
+
+// caching times per domain must be positive, the min. time of a domain must not exceed its max. time
+func (c *Config) validateDomainCachingTimes(v *validator) {
+	check := func(path string, times map[string]Duration) {
+		for _, domain := range sortedDurationKeys(times) {
+			if times[domain] <= 0 {
+				v.fail(fmt.Sprintf("%s.%s", path, domain), "caching time must be positive")
+			}
+		}
+	}
+
+	check("caching.domainMinCachingTime", c.Caching.DomainMinCachingTime)
+	check("caching.domainMaxCachingTime", c.Caching.DomainMaxCachingTime)
+
+	for _, domain := range sortedDurationKeys(c.Caching.DomainMinCachingTime) {
+		minTime := c.Caching.DomainMinCachingTime[domain]
+
+		if maxTime, ok := c.Caching.DomainMaxCachingTime[domain]; ok && minTime > maxTime {
+			v.fail(fmt.Sprintf("caching.domainMinCachingTime.%s", domain), "min. caching time %s is greater than "+
+				"max. caching time %s", time.Duration(minTime), time.Duration(maxTime))
+		}
+	}
+}
+
+// the NAT64 prefix must be an IPv6 network with one of the prefix lengths of RFC 6052
+func (c *Config) validateDNS64(v *validator) {
+	if c.DNS64.Prefix == "" {
+		return
+	}
+
+	ip, network, err := net.ParseCIDR(c.DNS64.Prefix)
+	if err != nil || ip.To4() != nil {
+		v.fail("dns64.prefix", "invalid IPv6 prefix '%s'", c.DNS64.Prefix)
+		return
+	}
+
+	switch ones, _ := network.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		v.fail("dns64.prefix", "prefix length %d is not supported, must be 32, 40, 48, 56, 64 or 96", ones)
+	}
+}
+
+// each resolver must be defined at most once, missing resolvers are inserted at their default position
+func (c *Config) validateResolverOrder(v *validator) {
+	if len(c.ResolverOrder) == 0 {
+		return
+	}
+
+	seen := make(map[string]bool, len(c.ResolverOrder))
+
+	for i, name := range c.ResolverOrder {
+		path := fmt.Sprintf("resolverOrder[%d]", i)
+
+		switch {
+		case !contains(DefaultResolverOrder, name):
+			v.fail(path, "unknown resolver '%s', please use: %s", name, strings.Join(DefaultResolverOrder, ", "))
+		case seen[name]:
+			v.fail(path, "resolver '%s' is defined more than once", name)
+		}
+
+		seen[name] = true
+	}
+
+	order, added := c.EffectiveResolverOrder()
+	for _, name := range added {
+		v.warn("resolverOrder", "resolver '%s' is missing, it is inserted at its default position", name)
+	}
+
+	if i := indexOf(order, "specialUseNames"); i < indexOf(order, "conditional") || i < indexOf(order, "customDNS") {
+		v.warn("resolverOrder", "specialUseNames is placed before conditional or customDNS, "+
+			"their names are answered with NXDOMAIN")
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedDurationKeys(m map[string]Duration) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedGroupKeys(m map[string][]Upstream) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedClientKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
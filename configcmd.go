@@ -0,0 +1,49 @@
+package main
+
+import (
+	"blocky/config"
+	"flag"
+	"fmt"
+)
+
+// configCommand runs the subcommand of "blocky config". Returns the exit code
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Println("usage: blocky config print [--config path]")
+		return 1
+	}
+
+	return printConfig(args[1:])
+}
+
+// printConfig prints the effective configuration file, files of a configuration directory are merged.
+// Environment variables, which override values, are listed as comment
+func printConfig(args []string) int {
+	flags := flag.NewFlagSet("config print", flag.ContinueOnError)
+	path := flags.String("config", config.DefaultPath, "path of the configuration file or directory")
+
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	data, err := config.ReadConfig(*path)
+	if err != nil {
+		fmt.Printf("ERROR   %v\n", err)
+		return 1
+	}
+
+	cfg, err := config.ParseConfig(data)
+	if err != nil {
+		fmt.Printf("ERROR   %v\n", err)
+		return 1
+	}
+
+	applied, _ := cfg.EnvOverrides()
+	for _, name := range applied {
+		fmt.Printf("# overridden by environment variable %s\n", name)
+	}
+
+	fmt.Print(string(data))
+
+	return 0
+}
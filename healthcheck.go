@@ -0,0 +1,66 @@
+package main
+
+import (
+	"blocky/config"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultHealthCheckPort   = 53
+	defaultHealthCheckDomain = "example.com"
+	healthCheckTimeout       = 2 * time.Second
+)
+
+// healthcheck sends a DNS query to the local instance and returns the exit code: 0 if the query was answered with
+// NOERROR or NXDOMAIN, 1 otherwise. Port and domain are taken from the configuration file, if present
+func healthcheck(args []string) int {
+	port, domain := uint(defaultHealthCheckPort), defaultHealthCheckDomain
+
+	if cfg, err := config.LoadConfig(config.DefaultPath); err == nil {
+		if len(cfg.Port) > 0 {
+			if p, err := strconv.ParseUint(cfg.Port[0][strings.LastIndex(cfg.Port[0], ":")+1:], 10, 16); err == nil {
+				port = uint(p)
+			}
+		}
+
+		if cfg.HealthCheckDomain != "" {
+			domain = cfg.HealthCheckDomain
+		}
+	}
+
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	flags.UintVar(&port, "port", port, "DNS port")
+	flags.StringVar(&domain, "domain", domain, "domain to resolve")
+
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+
+	client := &dns.Client{Net: "udp", Timeout: healthCheckTimeout}
+
+	response, _, err := client.Exchange(msg, net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "health check failed: %v\n", err)
+		return 1
+	}
+
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		fmt.Fprintf(os.Stderr, "health check failed: return code %s\n", dns.RcodeToString[response.Rcode])
+		return 1
+	}
+
+	fmt.Printf("OK: %s resolved with return code %s\n", domain, dns.RcodeToString[response.Rcode])
+
+	return 0
+}
@@ -0,0 +1,113 @@
+package helpertest
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	mochi "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+// MqttMessage is a message, which was published to the MqttBroker
+type MqttMessage struct {
+	Topic   string
+	Payload string
+	QoS     byte
+}
+
+// MqttConnect contains the credentials of a client connect
+type MqttConnect struct {
+	ClientID string
+	Username string
+	Password string
+}
+
+// MqttBroker is an embedded MQTT broker for tests. It accepts all connects and records published messages
+type MqttBroker struct {
+	Addr     string
+	server   *mochi.Server
+	lock     sync.Mutex
+	messages []MqttMessage
+	connects []MqttConnect
+}
+
+// NewMqttBroker starts broker on random local port
+func NewMqttBroker() *MqttBroker {
+	// the listener doesn't expose the bound address: find free port first
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal("can't find free port for mqtt broker: ", err)
+	}
+
+	address := l.Addr().String()
+	_ = l.Close()
+
+	return NewMqttBrokerOn(address)
+}
+
+// NewMqttBrokerOn starts broker on passed address, e.g. to restart a stopped broker
+func NewMqttBrokerOn(address string) *MqttBroker {
+	b := &MqttBroker{
+		Addr:   address,
+		server: mochi.NewServer(nil),
+	}
+
+	b.server.Events.OnConnect = func(client events.Client, pk events.Packet) {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		b.connects = append(b.connects, MqttConnect{
+			ClientID: client.ID,
+			Username: string(pk.Username),
+			Password: string(pk.Password),
+		})
+	}
+
+	b.server.Events.OnMessage = func(client events.Client, pk events.Packet) (events.Packet, error) {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		b.messages = append(b.messages, MqttMessage{
+			Topic:   pk.TopicName,
+			Payload: string(pk.Payload),
+			QoS:     pk.FixedHeader.Qos,
+		})
+
+		return pk, nil
+	}
+
+	err := b.server.AddListener(listeners.NewTCP("tcp", address), &listeners.Config{Auth: &auth.Allow{}})
+	if err != nil {
+		log.Fatal("can't start mqtt broker: ", err)
+	}
+
+	if err := b.server.Serve(); err != nil {
+		log.Fatal("can't start mqtt broker: ", err)
+	}
+
+	return b
+}
+
+// Close stops the broker and closes all client connections
+func (b *MqttBroker) Close() {
+	_ = b.server.Close()
+}
+
+// Messages returns all published messages
+func (b *MqttBroker) Messages() []MqttMessage {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]MqttMessage(nil), b.messages...)
+}
+
+// Connects returns the credentials of all client connects
+func (b *MqttBroker) Connects() []MqttConnect {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]MqttConnect(nil), b.connects...)
+}
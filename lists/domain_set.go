@@ -0,0 +1,218 @@
+package lists
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+const (
+	// the domain itself is contained
+	flagExact uint8 = 1 << iota
+	// all sub domains are contained (list entry with matchSubdomains)
+	flagSubdomains
+	// all sub domains are contained ("*.domain" entry), the domain itself only with flagExact
+	flagWildcard
+)
+
+// domainSet is an immutable, sorted and deduplicated set of domain names. All names are stored in one backing
+// string, so the memory usage is about the size of the names plus 5 bytes per entry. Lookups use binary search
+type domainSet struct {
+	data string
+	// start of each entry in data, the last element is the end of the last entry
+	offsets []uint32
+	flags   []uint8
+	count   int
+}
+
+// nolint:gochecknoglobals
+var emptyDomainSet = &domainSet{offsets: []uint32{0}}
+
+func (s *domainSet) len() int {
+	return len(s.flags)
+}
+
+func (s *domainSet) entry(i int) string {
+	return s.data[s.offsets[i]:s.offsets[i+1]]
+}
+
+// returns flags of the domain, 0 if the domain is not contained
+func (s *domainSet) lookup(domain string) uint8 {
+	i := sort.Search(s.len(), func(i int) bool {
+		return s.entry(i) >= domain
+	})
+
+	if i < s.len() && s.entry(i) == domain {
+		return s.flags[i]
+	}
+
+	return 0
+}
+
+func (s *domainSet) contains(domain string) bool {
+	return s.match(domain) != ""
+}
+
+// returns the entry, which matches the domain: the domain itself, a parent domain (entry with matchSubdomains)
+// or "*.parent" (wildcard entry). Parent domains are checked from the top level domain. Empty if no entry matches
+func (s *domainSet) match(domain string) string {
+	if s.len() == 0 {
+		return ""
+	}
+
+	flags := s.lookup(domain)
+	if flags&flagExact != 0 {
+		return domain
+	}
+
+	for i := len(domain) - 1; i > 0; i-- {
+		if domain[i-1] != '.' {
+			continue
+		}
+
+		parent := domain[i:]
+		parentFlags := s.lookup(parent)
+
+		if parentFlags&flagSubdomains != 0 {
+			return parent
+		}
+
+		if parentFlags&flagWildcard != 0 {
+			return "*." + parent
+		}
+	}
+
+	return ""
+}
+
+// domainSetBuilder collects domain names in one buffer and builds the set
+type domainSetBuilder struct {
+	data    []byte
+	entries []builderEntry
+}
+
+type builderEntry struct {
+	offset uint32
+	length uint16
+	flags  uint8
+}
+
+func newDomainSetBuilder() *domainSetBuilder {
+	return &domainSetBuilder{}
+}
+
+// adds domain name entry: "*.example.com" matches all sub domains of "example.com",
+// with matchSubdomains plain entries match the domain itself and all sub domains
+func (b *domainSetBuilder) addDomain(domain string, matchSubdomains bool) {
+	switch {
+	case strings.HasPrefix(domain, "*."):
+		b.add(strings.TrimPrefix(domain, "*."), flagWildcard)
+	case matchSubdomains:
+		b.add(domain, flagExact|flagSubdomains)
+	default:
+		b.add(domain, flagExact)
+	}
+}
+
+func (b *domainSetBuilder) add(domain string, flags uint8) {
+	b.entries = append(b.entries, builderEntry{
+		offset: uint32(len(b.data)),
+		length: uint16(len(domain)),
+		flags:  flags,
+	})
+	b.data = append(b.data, domain...)
+}
+
+// adds all entries of passed set
+func (b *domainSetBuilder) addSet(s *domainSet) {
+	for i := 0; i < s.len(); i++ {
+		b.add(s.entry(i), s.flags[i])
+	}
+}
+
+func (b *domainSetBuilder) bytes(e builderEntry) []byte {
+	return b.data[e.offset : e.offset+uint32(e.length)]
+}
+
+// sorts and deduplicates the collected entries (flags of duplicates are combined) and returns the set.
+// The builder must not be used afterwards
+func (b *domainSetBuilder) build() *domainSet {
+	if len(b.entries) == 0 {
+		return emptyDomainSet
+	}
+
+	sort.Slice(b.entries, func(i, j int) bool {
+		return bytes.Compare(b.bytes(b.entries[i]), b.bytes(b.entries[j])) < 0
+	})
+
+	// deduplicate in place
+	unique := b.entries[:1]
+	size := int(b.entries[0].length)
+
+	for _, e := range b.entries[1:] {
+		last := &unique[len(unique)-1]
+		if bytes.Equal(b.bytes(*last), b.bytes(e)) {
+			last.flags |= e.flags
+			continue
+		}
+
+		unique = append(unique, e)
+		size += int(e.length)
+	}
+
+	var sb strings.Builder
+
+	sb.Grow(size)
+
+	result := &domainSet{
+		offsets: make([]uint32, 0, len(unique)+1),
+		flags:   make([]uint8, 0, len(unique)),
+	}
+
+	for _, e := range unique {
+		result.offsets = append(result.offsets, uint32(sb.Len()))
+		result.flags = append(result.flags, e.flags)
+		sb.Write(b.bytes(e))
+
+		if e.flags&(flagExact|flagSubdomains) != 0 {
+			result.count++
+		}
+
+		if e.flags&flagWildcard != 0 {
+			result.count++
+		}
+	}
+
+	result.offsets = append(result.offsets, uint32(sb.Len()))
+	result.data = sb.String()
+
+	b.data, b.entries = nil, nil
+
+	return result
+}
+
+// returns set with the entries of all passed sets
+func mergeDomainSets(sets ...*domainSet) *domainSet {
+	var nonEmpty []*domainSet
+
+	for _, s := range sets {
+		if s.len() > 0 {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+
+	switch len(nonEmpty) {
+	case 0:
+		return emptyDomainSet
+	case 1:
+		// sets are immutable and can be shared
+		return nonEmpty[0]
+	}
+
+	b := newDomainSetBuilder()
+	for _, s := range nonEmpty {
+		b.addSet(s)
+	}
+
+	return b.build()
+}
@@ -0,0 +1,130 @@
+package lists
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDomainSet(matchSubdomains bool, domains ...string) *domainSet {
+	b := newDomainSetBuilder()
+	for _, domain := range domains {
+		b.addDomain(domain, matchSubdomains)
+	}
+
+	return b.build()
+}
+
+func Test_domainSet_Wildcard(t *testing.T) {
+	sut := newTestDomainSet(false, "*.doubleclick.net")
+
+	assert.True(t, sut.contains("ad.doubleclick.net"))
+	assert.True(t, sut.contains("a.b.doubleclick.net"))
+	assert.False(t, sut.contains("doubleclick.net"))
+	assert.False(t, sut.contains("net"))
+	assert.False(t, sut.contains("mydoubleclick.net"))
+	assert.Equal(t, "*.doubleclick.net", sut.match("a.b.doubleclick.net"))
+	assert.Equal(t, 1, sut.count)
+}
+
+func Test_domainSet_ExactAndSubdomains(t *testing.T) {
+	sut := newTestDomainSet(true, "example.com")
+	exact := newTestDomainSet(false, "exact.org", "exact.org", "a.exact.org")
+
+	assert.True(t, sut.contains("example.com"))
+	assert.True(t, sut.contains("www.example.com"))
+	assert.Equal(t, "example.com", sut.match("www.example.com"))
+	assert.False(t, sut.contains("com"))
+	assert.False(t, sut.contains("anexample.com"))
+
+	assert.True(t, exact.contains("exact.org"))
+	assert.True(t, exact.contains("a.exact.org"))
+	assert.False(t, exact.contains("www.exact.org"))
+	assert.Equal(t, 2, exact.count)
+	assert.Equal(t, 2, exact.len())
+}
+
+func Test_domainSet_Empty(t *testing.T) {
+	sut := newDomainSetBuilder().build()
+
+	assert.False(t, sut.contains("example.com"))
+	assert.Equal(t, 0, sut.count)
+}
+
+func Test_mergeDomainSets(t *testing.T) {
+	s1 := newTestDomainSet(false, "example.com", "b.org")
+	s2 := newTestDomainSet(false, "*.example.com", "sub.domain.org", "b.org")
+
+	sut := mergeDomainSets(s1, emptyDomainSet, s2)
+
+	assert.True(t, sut.contains("example.com"))
+	assert.True(t, sut.contains("www.example.com"))
+	assert.Equal(t, "*.example.com", sut.match("www.example.com"))
+	assert.True(t, sut.contains("sub.domain.org"))
+	assert.True(t, sut.contains("b.org"))
+	assert.False(t, sut.contains("domain.org"))
+	assert.Equal(t, 4, sut.count)
+
+	// a single set is shared
+	assert.Same(t, s1, mergeDomainSets(emptyDomainSet, s1))
+}
+
+const benchmarkEntries = 3000000
+
+func benchmarkDomain(i int) string {
+	return fmt.Sprintf("host%d.domain%d.com", i, i%1000)
+}
+
+// memory usage and lookup time of the sorted set
+func BenchmarkDomainSet(b *testing.B) {
+	before := heapAlloc()
+
+	builder := newDomainSetBuilder()
+	for i := 0; i < benchmarkEntries; i++ {
+		builder.addDomain(benchmarkDomain(i), true)
+	}
+
+	set := builder.build()
+
+	memory := heapAlloc() - before
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		set.contains("www." + benchmarkDomain(i%benchmarkEntries))
+	}
+
+	b.ReportMetric(float64(memory)/(1024*1024), "MB")
+}
+
+// memory usage and lookup time of the previous storage: one map entry per domain
+func BenchmarkDomainMap(b *testing.B) {
+	before := heapAlloc()
+
+	domains := make(map[string]struct{})
+	for i := 0; i < benchmarkEntries; i++ {
+		domains[benchmarkDomain(i)] = struct{}{}
+	}
+
+	memory := heapAlloc() - before
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_ = domains[benchmarkDomain(i%benchmarkEntries)]
+	}
+
+	b.ReportMetric(float64(memory)/(1024*1024), "MB")
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+
+	var m runtime.MemStats
+
+	runtime.ReadMemStats(&m)
+
+	return m.HeapAlloc
+}
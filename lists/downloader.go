@@ -0,0 +1,173 @@
+package lists
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDownloadTimeout = 30 * time.Second
+	defaultMaxDownloadSize = 100 * 1024 * 1024
+	defaultUserAgent       = "blocky"
+)
+
+// returned if the list was not changed since the last download (HTTP 304)
+var errNotModified = errors.New("list was not modified") // nolint:gochecknoglobals
+
+// Downloader downloads lists via HTTP(S)
+type Downloader struct {
+	client    *http.Client
+	maxSize   int64
+	userAgent string
+}
+
+// validators of the last download, sent on the next download to avoid the transfer of an unchanged list
+type cacheValidators struct {
+	etag         string
+	lastModified string
+}
+
+// NewDownloader creates downloader with passed timeout for the whole download (0 -> 30s), max. size of the
+// (uncompressed) list in bytes (0 -> 100 MB) and user agent (empty -> "blocky"). Requests are sent via the proxy, if
+// configured, otherwise via the proxy from environment variables HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+func NewDownloader(timeout time.Duration, maxSize int64, userAgent, proxy string) (*Downloader, error) {
+	if timeout <= 0 {
+		timeout = defaultDownloadTimeout
+	}
+
+	if maxSize <= 0 {
+		maxSize = defaultMaxDownloadSize
+	}
+
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL '%s'", proxy)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &Downloader{
+		client:    &http.Client{Timeout: timeout, Transport: transport},
+		maxSize:   maxSize,
+		userAgent: userAgent,
+	}, nil
+}
+
+// downloads the list, returns errNotModified if the list was not changed since the download with passed validators.
+// Gzip compressed lists (".gz" or gzip content type) are decompressed
+func (d *Downloader) download(link string, previous cacheValidators) (io.ReadCloser, cacheValidators, error) {
+	logger().WithField("link", link).Info("starting download")
+
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return nil, cacheValidators{}, err
+	}
+
+	req.Header.Set("User-Agent", d.userAgent)
+
+	if previous.etag != "" {
+		req.Header.Set("If-None-Match", previous.etag)
+	}
+
+	if previous.lastModified != "" {
+		req.Header.Set("If-Modified-Since", previous.lastModified)
+	}
+
+	//nolint:bodyclose
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, cacheValidators{}, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		resp.Body.Close()
+
+		return nil, previous, errNotModified
+	default:
+		resp.Body.Close()
+
+		return nil, cacheValidators{}, fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+
+	validators := cacheValidators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	var body io.ReadCloser = resp.Body
+
+	contentType := resp.Header.Get("Content-Type")
+	if strings.HasSuffix(req.URL.Path, ".gz") || contentType == "application/gzip" || contentType == "application/x-gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+
+			return nil, cacheValidators{}, fmt.Errorf("can't decompress list: %v", err)
+		}
+
+		body = &gzipBody{Reader: gz, body: resp.Body}
+	}
+
+	return &limitedReader{r: body, remaining: d.maxSize, max: d.maxSize}, validators, nil
+}
+
+// decompressed response body, closes the response body
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gzipBody) Close() error {
+	g.Reader.Close()
+
+	return g.body.Close()
+}
+
+// returns an error if more than max bytes are read
+type limitedReader struct {
+	r         io.ReadCloser
+	remaining int64
+	max       int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// list with exactly max. size
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 && err == io.EOF {
+			return 0, io.EOF
+		}
+
+		return 0, fmt.Errorf("list exceeds max. size of %d bytes", l.max)
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+
+	return n, err
+}
+
+func (l *limitedReader) Close() error {
+	return l.r.Close()
+}
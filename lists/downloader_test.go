@@ -0,0 +1,135 @@
+package lists
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Refresh_NotModified(t *testing.T) {
+	var downloads int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		atomic.AddInt32(&downloads, 1)
+
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("blocked1.com"))
+	}))
+	defer server.Close()
+
+	sut, err := NewListCache(map[string][]string{"gr1": {server.URL}}, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	// unchanged list is not downloaded again, previous entries are kept
+	assert.NoError(t, sut.refresh())
+
+	found, group := sut.Match("blocked1.com", []string{"gr1"})
+	assert.True(t, found)
+	assert.Equal(t, "gr1", group)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+	assert.Equal(t, 0, sut.linkFailures[server.URL])
+}
+
+func Test_Download_MaxSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("blocked1.com\nblocked2.com\n"))
+	}))
+	defer server.Close()
+
+	downloader, err := NewDownloader(0, 26, "", "")
+	assert.NoError(t, err)
+
+	// exactly max. size
+	sut, err := NewListCache(map[string][]string{"gr1": {server.URL}}, 0, false, 0, StartStrategyFailOnError,
+		downloader)
+	assert.NoError(t, err)
+
+	found, _ := sut.Match("blocked2.com", []string{"gr1"})
+	assert.True(t, found)
+
+	downloader, err = NewDownloader(0, 20, "", "")
+	assert.NoError(t, err)
+
+	_, err = NewListCache(map[string][]string{"gr1": {server.URL}}, 0, false, 0, StartStrategyFailOnError, downloader)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "list exceeds max. size of 20 bytes")
+}
+
+func Test_Download_Gzip(t *testing.T) {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte("blocked1.com\nblocked2.com\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	sut, err := NewListCache(map[string][]string{"gr1": {server.URL + "/list.txt.gz"}}, 0, false, 0,
+		StartStrategyFailOnError, nil)
+	assert.NoError(t, err)
+
+	found, _ := sut.Match("blocked2.com", []string{"gr1"})
+	assert.True(t, found)
+}
+
+func Test_Download_ProxyAndUserAgent(t *testing.T) {
+	var requested, userAgent atomic.Value
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(r.URL.String())
+		userAgent.Store(r.Header.Get("User-Agent"))
+
+		_, _ = w.Write([]byte("blocked1.com"))
+	}))
+	defer proxy.Close()
+
+	downloader, err := NewDownloader(0, 0, "my-agent", proxy.URL)
+	assert.NoError(t, err)
+
+	r, _, err := downloader.download("http://lists.example/list.txt", cacheValidators{})
+	assert.NoError(t, err)
+
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "blocked1.com", string(content))
+	assert.Equal(t, "http://lists.example/list.txt", requested.Load())
+	assert.Equal(t, "my-agent", userAgent.Load())
+
+	_, err = NewDownloader(0, 0, "", "::invalid")
+	assert.Error(t, err)
+}
+
+func Test_Download_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+
+		_, _ = w.Write([]byte("blocked1.com"))
+	}))
+	defer server.Close()
+
+	downloader, err := NewDownloader(50*time.Millisecond, 0, "", "")
+	assert.NoError(t, err)
+
+	_, _, err = downloader.download(server.URL, cacheValidators{})
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "Client.Timeout"), err.Error())
+}
@@ -0,0 +1,141 @@
+package lists
+
+import "net"
+
+// ipTrie stores IP networks as binary prefix tree (one bit per level), separately for IPv4 and IPv6,
+// so a lookup walks max. the bit length of the address
+type ipTrie struct {
+	v4    ipTrieNode
+	v6    ipTrieNode
+	count int
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	// network ending at this node is contained
+	terminal bool
+}
+
+func newIPTrie() *ipTrie {
+	return &ipTrie{}
+}
+
+// returns root node and address bytes for the network's address family
+func (t *ipTrie) rootFor(ip net.IP, ipv4 bool) (*ipTrieNode, net.IP) {
+	if ipv4 {
+		return &t.v4, ip.To4()
+	}
+
+	return &t.v6, ip.To16()
+}
+
+// inserts network, networks covered by already contained networks are ignored
+func (t *ipTrie) insert(network *net.IPNet) {
+	ones, _ := network.Mask.Size()
+	node, ip := t.rootFor(network.IP, len(network.Mask) == net.IPv4len)
+
+	if ip == nil {
+		return
+	}
+
+	for i := 0; i < ones; i++ {
+		if node.terminal {
+			return
+		}
+
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &ipTrieNode{}
+		}
+
+		node = node.children[bit]
+	}
+
+	if !node.terminal {
+		node.terminal = true
+		t.count++
+	}
+}
+
+// returns true if a contained network includes the IP address
+func (t *ipTrie) contains(ip net.IP) bool {
+	return t.match(ip) != nil
+}
+
+// returns the contained network, which includes the IP address, nil if no network matches
+func (t *ipTrie) match(ip net.IP) *net.IPNet {
+	node, addr := t.rootFor(ip, ip.To4() != nil)
+	if addr == nil {
+		return nil
+	}
+
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			mask := net.CIDRMask(i, len(addr)*8)
+
+			return &net.IPNet{IP: addr.Mask(mask), Mask: mask}
+		}
+
+		if i == len(addr)*8 {
+			return nil
+		}
+
+		node = node.children[addr[i/8]>>(7-uint(i%8))&1]
+	}
+
+	return nil
+}
+
+// inserts all networks of passed trie
+func (t *ipTrie) merge(other *ipTrie) {
+	other.v4.walk(make(net.IP, net.IPv4len), 0, func(network *net.IPNet) { t.insert(network) })
+	other.v6.walk(make(net.IP, net.IPv6len), 0, func(network *net.IPNet) { t.insert(network) })
+}
+
+// calls passed function for each contained network, prefix contains the bits of the path to this node
+func (n *ipTrieNode) walk(prefix net.IP, depth int, fn func(network *net.IPNet)) {
+	if n.terminal {
+		ip := make(net.IP, len(prefix))
+		copy(ip, prefix)
+
+		fn(&net.IPNet{IP: ip, Mask: net.CIDRMask(depth, len(prefix)*8)})
+
+		return
+	}
+
+	for bit, child := range n.children {
+		if child == nil {
+			continue
+		}
+
+		if bit == 1 {
+			prefix[depth/8] |= 0x80 >> uint(depth%8)
+		}
+
+		child.walk(prefix, depth+1, fn)
+
+		prefix[depth/8] &^= 0x80 >> uint(depth%8)
+	}
+}
+
+// parses list entry with IP address or network in CIDR notation. Unspecified addresses (0.0.0.0, ::)
+// are no valid entries, they appear as incomplete lines in hosts files
+func parseIPEntry(entry string) (*net.IPNet, bool) {
+	if ip := net.ParseIP(entry); ip != nil {
+		if ip.IsUnspecified() {
+			return nil, false
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}, true
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}, true
+	}
+
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		return network, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,60 @@
+package lists
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustIPNet(t *testing.T, entry string) *net.IPNet {
+	network, ok := parseIPEntry(entry)
+	assert.True(t, ok, entry)
+
+	return network
+}
+
+func Test_ipTrie_Contains(t *testing.T) {
+	sut := newIPTrie()
+	sut.insert(mustIPNet(t, "10.0.0.0/8"))
+	sut.insert(mustIPNet(t, "192.168.1.1"))
+	sut.insert(mustIPNet(t, "2001:db8::/32"))
+
+	// covered by 10.0.0.0/8
+	sut.insert(mustIPNet(t, "10.1.0.0/16"))
+
+	assert.True(t, sut.contains(net.ParseIP("10.0.0.0")))
+	assert.True(t, sut.contains(net.ParseIP("10.255.255.255")))
+	assert.True(t, sut.contains(net.ParseIP("192.168.1.1")))
+	assert.True(t, sut.contains(net.ParseIP("2001:db8:1::1")))
+	assert.True(t, sut.contains(net.ParseIP("::ffff:10.0.0.1")))
+	assert.False(t, sut.contains(net.ParseIP("11.0.0.1")))
+	assert.False(t, sut.contains(net.ParseIP("192.168.1.2")))
+	assert.False(t, sut.contains(net.ParseIP("2001:db9::1")))
+	assert.Equal(t, 3, sut.count)
+}
+
+func Test_ipTrie_Merge(t *testing.T) {
+	t1 := newIPTrie()
+	t1.insert(mustIPNet(t, "10.0.0.0/8"))
+
+	t2 := newIPTrie()
+	t2.insert(mustIPNet(t, "172.16.0.0/12"))
+	t2.insert(mustIPNet(t, "10.0.0.1"))
+	t2.insert(mustIPNet(t, "fd00::1"))
+
+	t1.merge(t2)
+
+	assert.True(t, t1.contains(net.ParseIP("172.31.255.255")))
+	assert.False(t, t1.contains(net.ParseIP("172.32.0.0")))
+	assert.True(t, t1.contains(net.ParseIP("fd00::1")))
+	assert.False(t, t1.contains(net.ParseIP("fd00::2")))
+	assert.Equal(t, 3, t1.count)
+}
+
+func Test_parseIPEntry(t *testing.T) {
+	for _, entry := range []string{"example.com", "1.2.3", "10.0.0.0/33", "", "0.0.0.0", "::"} {
+		_, ok := parseIPEntry(entry)
+		assert.False(t, ok, entry)
+	}
+}
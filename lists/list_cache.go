@@ -2,37 +2,243 @@ package lists
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"io/ioutil"
+	"net"
 	"os"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	timeout              = 30 * time.Second
-	defaultRefreshPeriod = 4 * time.Hour
+	// default number of lists, which are downloaded and parsed concurrently
+	defaultConcurrency = 4
+	// list name of entries, which were added at runtime
+	runtimeListName = "[runtime]"
+)
+
+// StartStrategy defines the initial loading of the lists
+type StartStrategy string
+
+const (
+	// wait until all lists are loaded, download errors are logged (default)
+	StartStrategyBlocking StartStrategy = "blocking"
+	// wait until all lists are loaded, fail on any download error
+	StartStrategyFailOnError StartStrategy = "failOnError"
+	// load lists in background, the cache is empty until they are loaded
+	StartStrategyFast StartStrategy = "fast"
 )
 
 type Matcher interface {
 	// matches passed domain name against cached list entries
 	Match(domain string, groupsToCheck []string) (found bool, group string)
 
+	// matches passed IP address against cached IP and CIDR entries
+	MatchIP(ip net.IP, groupsToCheck []string) (found bool, group string)
+
 	// returns current configuration and stats
 	Configuration() []string
+
+	// reloads all lists asynchronously
+	Refresh()
+
+	// returns name of the list in passed group and the list entry, which matches the domain or IP address
+	MatchingList(domainOrIP string, group string) (list string, entry string)
+
+	// returns number of entries per group and time of the last refresh
+	Stats() (entries map[string]int, lastRefresh time.Time)
+
+	// adds domain entry to the group, the entry is kept on refresh
+	AddEntry(group string, domain string) error
+
+	// removes entry, which was added with AddEntry. Returns false if the entry doesn't exist
+	RemoveEntry(group string, domain string) bool
+
+	// returns sorted entries per group, which were added with AddEntry
+	RuntimeEntries() map[string][]string
 }
 
-type ListCache struct {
-	groupCaches map[string][]string
-	lock        sync.RWMutex
+// contains domain names and wildcard entries (sorted set), regular expressions
+// and IP addresses or networks (prefix trie) of one group. A group cache is not modified after it was built
+type groupCache struct {
+	domains *domainSet
+	regexes []*regexp.Regexp
+	ips     *ipTrie
+}
+
+func newGroupCache() *groupCache {
+	return &groupCache{
+		domains: emptyDomainSet,
+		ips:     newIPTrie(),
+	}
+}
+
+// returns new cache with the entries of all passed caches
+func mergeGroupCaches(caches ...*groupCache) *groupCache {
+	result := newGroupCache()
+	sets := make([]*domainSet, 0, len(caches))
+
+	for _, c := range caches {
+		sets = append(sets, c.domains)
+		result.ips.merge(c.ips)
+
+		for _, regex := range c.regexes {
+			if !result.hasRegex(regex) {
+				result.regexes = append(result.regexes, regex)
+			}
+		}
+	}
+
+	result.domains = mergeDomainSets(sets...)
+
+	return result
+}
+
+func (c *groupCache) hasRegex(regex *regexp.Regexp) bool {
+	for _, r := range c.regexes {
+		if r.String() == regex.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exact match first, regular expressions are only checked if domain was not found
+func (c *groupCache) contains(domain string) bool {
+	if c.domains.contains(domain) {
+		return true
+	}
+
+	for _, regex := range c.regexes {
+		if regex.MatchString(domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns the entry, which matches the domain, as written in the list (regular expressions with slashes).
+// Empty if no entry matches
+func (c *groupCache) matchingEntry(domain string) string {
+	if entry := c.domains.match(domain); entry != "" {
+		return entry
+	}
+
+	for _, regex := range c.regexes {
+		if regex.MatchString(domain) {
+			return "/" + regex.String() + "/"
+		}
+	}
+
+	return ""
+}
+
+// returns the network or IP address, which includes the IP address. Empty if no entry matches
+func (c *groupCache) matchingIPEntry(ip net.IP) string {
+	network := c.ips.match(ip)
+	if network == nil {
+		return ""
+	}
+
+	if ones, bits := network.Mask.Size(); ones == bits {
+		return network.IP.String()
+	}
+
+	return network.String()
+}
+
+func (c *groupCache) elementCount() int {
+	return c.domains.count + len(c.regexes) + c.ips.count
+}
+
+// immutable lookup structures of all groups. Refresh and changes of runtime entries build a new state and swap it,
+// a published state is never modified, so queries can read it without locking
+type listCacheState struct {
+	groupCaches map[string]*groupCache
+	// content of each link at the time of the last refresh, used to determine the matching list
+	groupLinkCaches map[string]map[string]*groupCache
+	lastRefresh     time.Time
+	// entries added at runtime per group and their cache, merged into the group caches on each refresh
+	runtimeEntries map[string]map[string]struct{}
+	runtimeCaches  map[string]*groupCache
+}
+
+// returns shallow copy of the state, maps of groups can be replaced without changing this state
+func (s *listCacheState) copy() *listCacheState {
+	result := &listCacheState{
+		groupCaches:     make(map[string]*groupCache, len(s.groupCaches)),
+		groupLinkCaches: s.groupLinkCaches,
+		lastRefresh:     s.lastRefresh,
+		runtimeEntries:  make(map[string]map[string]struct{}, len(s.runtimeEntries)),
+		runtimeCaches:   make(map[string]*groupCache, len(s.runtimeCaches)),
+	}
+
+	for group, cache := range s.groupCaches {
+		result.groupCaches[group] = cache
+	}
+
+	for group, entries := range s.runtimeEntries {
+		result.runtimeEntries[group] = entries
+	}
+
+	for group, cache := range s.runtimeCaches {
+		result.runtimeCaches[group] = cache
+	}
+
+	return result
+}
 
-	groupToLinks  map[string][]string
-	refreshPeriod time.Duration
+// builds new cache of the group from the lists of the last refresh and the runtime entries
+func (s *listCacheState) buildGroupCache(group string) *groupCache {
+	caches := make([]*groupCache, 0, len(s.groupLinkCaches[group])+1)
+
+	for _, c := range s.groupLinkCaches[group] {
+		caches = append(caches, c)
+	}
+
+	if c, ok := s.runtimeCaches[group]; ok {
+		caches = append(caches, c)
+	}
+
+	return mergeGroupCaches(caches...)
+}
+
+type ListCache struct {
+	// current *listCacheState, swapped atomically
+	state atomic.Value
+	// serializes changes of the state (refresh and runtime entries), never acquired by queries
+	lock sync.Mutex
+
+	// last successfully loaded content, HTTP cache validators of the content and number of consecutive failures
+	// per link, used only during refresh
+	linkCaches     map[string]*groupCache
+	linkValidators map[string]cacheValidators
+	linkFailures   map[string]int
+	refreshLock    sync.Mutex
+
+	// state of asynchronous refresh, used to coalesce concurrent refresh requests
+	refreshStateLock sync.Mutex
+	refreshing       bool
+	refreshPending   bool
+
+	groupToLinks    map[string][]string
+	refreshPeriod   time.Duration
+	matchSubdomains bool
+	concurrency     uint
+	downloader      *Downloader
+	stop            chan struct{}
+	// closed after the initial load
+	loaded chan struct{}
 }
 
 func (b *ListCache) Configuration() (result []string) {
@@ -42,21 +248,29 @@ func (b *ListCache) Configuration() (result []string) {
 		result = append(result, "refresh: disabled")
 	}
 
+	b.refreshLock.Lock()
 	result = append(result, "group links:")
+
 	for group, links := range b.groupToLinks {
 		result = append(result, fmt.Sprintf("  %s:", group))
+
 		for _, link := range links {
-			result = append(result, fmt.Sprintf("   - %s", link))
+			if failures := b.linkFailures[link]; failures > 0 {
+				result = append(result, fmt.Sprintf("   - %s (consecutive failures: %d)", linkName(link), failures))
+			} else {
+				result = append(result, fmt.Sprintf("   - %s", linkName(link)))
+			}
 		}
 	}
+	b.refreshLock.Unlock()
 
 	result = append(result, "group caches:")
 
 	var total int
 
-	for group, cache := range b.groupCaches {
-		result = append(result, fmt.Sprintf("  %s: %d entries", group, len(cache)))
-		total += len(cache)
+	for group, cache := range b.currentState().groupCaches {
+		result = append(result, fmt.Sprintf("  %s: %d entries", group, cache.elementCount()))
+		total += cache.elementCount()
 	}
 
 	result = append(result, fmt.Sprintf("  TOTAL: %d entries", total))
@@ -64,41 +278,73 @@ func (b *ListCache) Configuration() (result []string) {
 	return
 }
 
-// removes duplicates
-func unique(in []string) []string {
-	keys := make(map[string]bool)
-
-	var list []string
-
-	for _, entry := range in {
-		if _, value := keys[entry]; !value {
-			keys[entry] = true
-
-			list = append(list, entry)
-		}
+// NewListCache creates new cache for passed groups with links, if matchSubdomains is true,
+// list entries match the domain itself and all its sub domains. Refresh period <= 0 disables the periodical refresh.
+// Max. concurrency lists are loaded at the same time (0 -> default 4). The start strategy defines, if the initial
+// load is performed in background or if download errors are returned. Lists are downloaded with passed downloader
+// (nil -> downloader with default settings)
+func NewListCache(groupToLinks map[string][]string, refreshPeriod time.Duration, matchSubdomains bool,
+	concurrency uint, startStrategy StartStrategy, downloader *Downloader) (*ListCache, error) {
+	if concurrency == 0 {
+		concurrency = defaultConcurrency
 	}
 
-	return list
-}
-
-func NewListCache(groupToLinks map[string][]string, refreshPeriod int) *ListCache {
-	groupCaches := make(map[string][]string)
-
-	p := time.Duration(refreshPeriod) * time.Minute
-	if refreshPeriod == 0 {
-		p = defaultRefreshPeriod
+	if downloader == nil {
+		// default settings are always valid
+		downloader, _ = NewDownloader(0, 0, "", "")
 	}
 
 	b := &ListCache{
-		groupToLinks:  groupToLinks,
-		groupCaches:   groupCaches,
-		refreshPeriod: p,
+		groupToLinks:    groupToLinks,
+		linkCaches:      make(map[string]*groupCache),
+		linkValidators:  make(map[string]cacheValidators),
+		linkFailures:    make(map[string]int),
+		refreshPeriod:   refreshPeriod,
+		matchSubdomains: matchSubdomains,
+		concurrency:     concurrency,
+		downloader:      downloader,
+		stop:            make(chan struct{}),
+		loaded:          make(chan struct{}),
+	}
+
+	b.state.Store(&listCacheState{
+		groupCaches:     make(map[string]*groupCache),
+		groupLinkCaches: make(map[string]map[string]*groupCache),
+		runtimeEntries:  make(map[string]map[string]struct{}),
+		runtimeCaches:   make(map[string]*groupCache),
+	})
+
+	switch startStrategy {
+	case StartStrategyFast:
+		go func() {
+			_ = b.refresh()
+			close(b.loaded)
+		}()
+	case StartStrategyFailOnError:
+		err := b.refresh()
+		close(b.loaded)
+
+		if err != nil {
+			return nil, err
+		}
+	default:
+		_ = b.refresh()
+		close(b.loaded)
 	}
-	b.refresh()
 
 	go periodicUpdate(b)
 
-	return b
+	return b, nil
+}
+
+// returns the current state, the state must not be modified
+func (b *ListCache) currentState() *listCacheState {
+	return b.state.Load().(*listCacheState)
+}
+
+// Loaded returns channel, which is closed after the initial load of all lists
+func (b *ListCache) Loaded() <-chan struct{} {
+	return b.loaded
 }
 
 // triggers periodical refresh (and download) of list entries
@@ -108,55 +354,108 @@ func periodicUpdate(cache *ListCache) {
 		defer ticker.Stop()
 
 		for {
-			<-ticker.C
-			cache.refresh()
+			select {
+			case <-ticker.C:
+				_ = cache.refresh()
+			case <-cache.stop:
+				return
+			}
 		}
 	}
 }
 
+// Stop stops the periodical refresh
+func (b *ListCache) Stop() {
+	close(b.stop)
+}
+
 func logger() *logrus.Entry {
 	return logrus.WithField("prefix", "list_cache")
 }
 
-// downloads and reads files with domain names and creates cache for them
-func createCacheForGroup(links []string) []string {
-	cache := make([]string, 0)
+// downloads and reads files with domain names of all groups, max. concurrency files at the same time. Links used
+// in multiple groups are loaded once. If a link can't be loaded, the previously loaded content of this link is kept.
+// Returns the first error
+func (b *ListCache) loadLinks() error {
+	var links []string
+
+	seen := make(map[string]bool)
+
+	for _, groupLinks := range b.groupToLinks {
+		for _, link := range groupLinks {
+			if !seen[link] {
+				seen[link] = true
+
+				links = append(links, link)
+			}
+		}
+	}
 
 	var wg sync.WaitGroup
 
-	c := make(chan []string, len(links))
+	results := make([]*groupCache, len(links))
+	validators := make([]cacheValidators, len(links))
+	errs := make([]error, len(links))
+	slots := make(chan struct{}, b.concurrency)
 
-	for _, link := range links {
+	for i, link := range links {
 		wg.Add(1)
 
-		go processFile(link, c, &wg)
+		slots <- struct{}{}
+
+		go func(i int, link string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			results[i], validators[i], errs[i] = b.processFile(link)
+		}(i, link)
 	}
 
 	wg.Wait()
 
-Loop:
-	for {
-		select {
-		case res := <-c:
-			cache = append(cache, res...)
-		default:
-			close(c)
-			break Loop
+	var firstErr error
+
+	for i, link := range links {
+		if errs[i] == errNotModified {
+			logger().WithField("link", linkName(link)).Info("list was not modified, using previous data")
+
+			b.linkFailures[link] = 0
+
+			continue
 		}
-	}
 
-	cache = unique(cache)
-	sort.Strings(cache)
+		if errs[i] != nil {
+			b.linkFailures[link]++
+
+			logger().WithFields(logrus.Fields{
+				"link":                 linkName(link),
+				"consecutive_failures": b.linkFailures[link],
+			}).Warn("can't load list, using previous data: ", errs[i])
 
-	return cache
+			if firstErr == nil {
+				firstErr = fmt.Errorf("can't load list '%s': %v", linkName(link), errs[i])
+			}
+
+			continue
+		}
+
+		b.linkFailures[link] = 0
+		b.linkCaches[link] = results[i]
+		b.linkValidators[link] = validators[i]
+	}
+
+	return firstErr
 }
 
 func (b *ListCache) Match(domain string, groupsToCheck []string) (found bool, group string) {
-	b.lock.RLock()
-	defer b.lock.RUnlock()
+	groupCaches := b.currentState().groupCaches
+
+	domain = strings.ToLower(domain)
 
 	for _, g := range groupsToCheck {
-		if contains(domain, b.groupCaches[g]) {
+		if cache, ok := groupCaches[g]; ok && cache.contains(domain) {
 			return true, g
 		}
 	}
@@ -164,44 +463,243 @@ func (b *ListCache) Match(domain string, groupsToCheck []string) (found bool, gr
 	return false, ""
 }
 
-func contains(domain string, cache []string) bool {
-	idx := sort.SearchStrings(cache, domain)
-	if idx < len(cache) {
-		return cache[idx] == strings.ToLower(domain)
+// MatchIP returns true and the first matching group, if a group contains the IP address or a network including it
+func (b *ListCache) MatchIP(ip net.IP, groupsToCheck []string) (found bool, group string) {
+	groupCaches := b.currentState().groupCaches
+
+	for _, g := range groupsToCheck {
+		if cache, ok := groupCaches[g]; ok && cache.ips.contains(ip) {
+			return true, g
+		}
 	}
 
-	return false
+	return false, ""
 }
 
-func (b *ListCache) refresh() {
+// Refresh reloads all lists in background. Concurrent calls are coalesced: while a refresh is running,
+// only one further refresh will be performed after it has finished
+func (b *ListCache) Refresh() {
+	b.refreshStateLock.Lock()
+	defer b.refreshStateLock.Unlock()
+
+	if b.refreshing {
+		logger().Debug("refresh is already running, scheduling next refresh")
+
+		b.refreshPending = true
+
+		return
+	}
+
+	b.refreshing = true
+
+	go func() {
+		for {
+			_ = b.refresh()
+
+			b.refreshStateLock.Lock()
+
+			if !b.refreshPending {
+				b.refreshing = false
+				b.refreshStateLock.Unlock()
+
+				return
+			}
+
+			b.refreshPending = false
+			b.refreshStateLock.Unlock()
+		}
+	}()
+}
+
+// loads all lists, builds new group caches in background and swaps them atomically, queries are never blocked and
+// see either the old or the new caches. Returns the first download error
+func (b *ListCache) refresh() error {
+	b.refreshLock.Lock()
+	defer b.refreshLock.Unlock()
+
+	err := b.loadLinks()
+
+	// changes of runtime entries wait for the new state, queries use the current state until the swap
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
+	state := b.currentState().copy()
+	state.groupLinkCaches = make(map[string]map[string]*groupCache, len(b.groupToLinks))
+	state.lastRefresh = time.Now()
+
 	for group, links := range b.groupToLinks {
-		b.groupCaches[group] = createCacheForGroup(links)
+		state.groupLinkCaches[group] = make(map[string]*groupCache, len(links))
+
+		for _, link := range links {
+			if c, ok := b.linkCaches[link]; ok {
+				state.groupLinkCaches[group][link] = c
+			}
+		}
+	}
+
+	state.groupCaches = make(map[string]*groupCache, len(b.groupToLinks))
+
+	for group := range b.groupToLinks {
+		state.groupCaches[group] = state.buildGroupCache(group)
 
 		logger().WithFields(logrus.Fields{
 			"group":       group,
-			"total_count": len(b.groupCaches[group]),
+			"total_count": state.groupCaches[group].elementCount(),
 		}).Info("group import finished")
 	}
+
+	for group := range state.runtimeCaches {
+		if _, ok := state.groupCaches[group]; !ok {
+			state.groupCaches[group] = state.buildGroupCache(group)
+		}
+	}
+
+	b.state.Store(state)
+
+	return err
 }
 
-func downloadFile(link string) (io.ReadCloser, error) {
-	client := http.Client{
-		Timeout: timeout,
+// MatchingList returns name of the first list in passed group, which contains the domain or IP address, and
+// the matching entry of this list (e.g. parent domain, wildcard, regular expression or network).
+// Empty if no list matches
+func (b *ListCache) MatchingList(domainOrIP string, group string) (list string, entry string) {
+	state := b.currentState()
+
+	domain := strings.ToLower(domainOrIP)
+	ip := net.ParseIP(domainOrIP)
+
+	for _, link := range b.groupToLinks[group] {
+		c, ok := state.groupLinkCaches[group][link]
+		if !ok {
+			continue
+		}
+
+		if ip != nil {
+			entry = c.matchingIPEntry(ip)
+		} else {
+			entry = c.matchingEntry(domain)
+		}
+
+		if entry != "" {
+			return linkName(link), entry
+		}
+	}
+
+	if c, ok := state.runtimeCaches[group]; ok && ip == nil {
+		if entry = c.matchingEntry(domain); entry != "" {
+			return runtimeListName, entry
+		}
 	}
 
-	logger().WithField("link", link).Info("starting download")
+	return "", ""
+}
 
-	//nolint:bodyclose
-	resp, err := client.Get(link)
+// AddEntry adds domain (or wildcard "*.domain") to the group. The entry is active immediately and kept on refresh
+func (b *ListCache) AddEntry(group string, domain string) error {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
 
-	if err != nil {
-		return nil, err
+	if strings.TrimSpace(group) == "" {
+		return errors.New("group is missing")
+	}
+
+	if !isValidDomain(domain) {
+		return fmt.Errorf("invalid domain '%s'", domain)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state := b.currentState().copy()
+
+	entries := make(map[string]struct{}, len(state.runtimeEntries[group])+1)
+	for entry := range state.runtimeEntries[group] {
+		entries[entry] = struct{}{}
+	}
+
+	entries[domain] = struct{}{}
+
+	b.setRuntimeEntries(state, group, entries)
+
+	return nil
+}
+
+// RemoveEntry removes an entry, which was added with AddEntry. The group cache is rebuilt from the last loaded lists.
+// Returns false if the entry doesn't exist
+func (b *ListCache) RemoveEntry(group string, domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state := b.currentState().copy()
+
+	if _, ok := state.runtimeEntries[group][domain]; !ok {
+		return false
+	}
+
+	entries := make(map[string]struct{}, len(state.runtimeEntries[group]))
+	for entry := range state.runtimeEntries[group] {
+		if entry != domain {
+			entries[entry] = struct{}{}
+		}
+	}
+
+	b.setRuntimeEntries(state, group, entries)
+
+	return true
+}
+
+// replaces runtime entries of the group in passed state, rebuilds the group cache and publishes the state.
+// Must be called with acquired lock
+func (b *ListCache) setRuntimeEntries(state *listCacheState, group string, entries map[string]struct{}) {
+	if len(entries) == 0 {
+		delete(state.runtimeEntries, group)
+		delete(state.runtimeCaches, group)
+	} else {
+		domains := newDomainSetBuilder()
+		for entry := range entries {
+			domains.addDomain(entry, b.matchSubdomains)
+		}
+
+		runtimeCache := newGroupCache()
+		runtimeCache.domains = domains.build()
+
+		state.runtimeEntries[group] = entries
+		state.runtimeCaches[group] = runtimeCache
+	}
+
+	state.groupCaches[group] = state.buildGroupCache(group)
+
+	b.state.Store(state)
+}
+
+// RuntimeEntries returns sorted entries per group, which were added with AddEntry
+func (b *ListCache) RuntimeEntries() map[string][]string {
+	runtimeEntries := b.currentState().runtimeEntries
+
+	result := make(map[string][]string, len(runtimeEntries))
+
+	for group, entries := range runtimeEntries {
+		for entry := range entries {
+			result[group] = append(result[group], entry)
+		}
+
+		sort.Strings(result[group])
+	}
+
+	return result
+}
+
+// Stats returns number of entries per group and time of the last refresh
+func (b *ListCache) Stats() (entries map[string]int, lastRefresh time.Time) {
+	state := b.currentState()
+
+	entries = make(map[string]int, len(state.groupCaches))
+	for group, cache := range state.groupCaches {
+		entries[group] = cache.elementCount()
 	}
 
-	return resp.Body, nil
+	return entries, state.lastRefresh
 }
 
 func readFile(file string) (io.ReadCloser, error) {
@@ -211,58 +709,199 @@ func readFile(file string) (io.ReadCloser, error) {
 	return os.Open(file)
 }
 
-// downloads file (or reads local file) and writes file content as string array in the channel
-func processFile(link string, ch chan<- []string, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	result := make([]string, 0)
+// downloads file (or reads local file) and returns parsed file content with HTTP cache validators. Returns
+// errNotModified, if the list was not changed since the last successful download.
+// Must be called during refresh (with acquired refresh lock)
+func (b *ListCache) processFile(link string) (*groupCache, cacheValidators, error) {
+	result := newGroupCache()
+	builder := newDomainSetBuilder()
 
 	var r io.ReadCloser
 
+	var validators cacheValidators
+
 	var err error
 
-	if strings.HasPrefix(link, "http") {
-		r, err = downloadFile(link)
-	} else {
+	switch {
+	case isInline(link):
+		r = ioutil.NopCloser(strings.NewReader(link))
+	case strings.HasPrefix(link, "http"):
+		r, validators, err = b.downloader.download(link, b.linkValidators[link])
+	default:
 		r, err = readFile(link)
 	}
 
 	if err != nil {
-		logger().Warn("error during file processing: ", err)
-		return
+		return nil, validators, err
 	}
 	defer r.Close()
 
-	var count int
+	var count, skipped, lineNumber int
 
 	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSpace(scanner.Text())
+		lineNumber++
+
 		// skip comments
-		if !strings.HasPrefix(line, "#") {
-			result = append(result, processLine(line))
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+
+		if isRegex(line) {
+			regex, err := regexp.Compile(line[1 : len(line)-1])
+			if err != nil {
+				logger().WithFields(logrus.Fields{
+					"source": linkName(link),
+					"line":   lineNumber,
+				}).Warnf("invalid regular expression '%s': %v", line, err)
+
+				skipped++
+
+				continue
+			}
+
+			result.regexes = append(result.regexes, regex)
+			count++
+
+			continue
+		}
+
+		if network, ok := parseIPEntry(strings.TrimSpace(stripComment(line))); ok {
+			result.ips.insert(network)
+			count++
+
+			continue
+		}
+
+		domains, ok := processLine(line)
+		if !ok {
+			logger().WithFields(logrus.Fields{
+				"source": linkName(link),
+				"line":   lineNumber,
+			}).Debugf("skipping invalid line '%s'", line)
+
+			skipped++
+
+			continue
+		}
+
+		for _, domain := range domains {
+			builder.addDomain(domain, b.matchSubdomains)
 			count++
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		logger().Warn("can't parse file: ", err)
-	} else {
-		logger().WithFields(logrus.Fields{
-			"source": link,
-			"count":  count,
-		}).Info("file imported")
+		return nil, cacheValidators{}, fmt.Errorf("can't parse file: %v", err)
+	}
+
+	result.domains = builder.build()
+
+	logger().WithField("source", linkName(link)).Infof("parsed %d entries, skipped %d invalid lines", count, skipped)
+
+	return result, validators, nil
+}
+
+// inline list entries are defined directly in the configuration as multi-line string
+func isInline(link string) bool {
+	return strings.Contains(link, "\n")
+}
+
+// returns link or short description for inline entries
+func linkName(link string) string {
+	if isInline(link) {
+		return fmt.Sprintf("[inline: %d lines]", strings.Count(strings.TrimSpace(link), "\n")+1)
 	}
-	ch <- result
+
+	return link
 }
 
-// return only first column (see hosts format)
-func processLine(line string) string {
-	parts := strings.Fields(line)
-	if len(parts) > 0 {
-		return parts[len(parts)-1]
+// regular expressions are enclosed in slashes, e.g. /^ads[0-9]*\..*/
+func isRegex(line string) bool {
+	return len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/")
+}
+
+// parses one line of a plain list (one domain per line) or a hosts file ("0.0.0.0 domain1 domain2 # comment"),
+// returns false if the line contains no valid domain
+func processLine(line string) (domains []string, ok bool) {
+	fields := strings.Fields(strings.ToLower(stripComment(line)))
+	if len(fields) == 0 {
+		return nil, false
 	}
 
-	return ""
+	if net.ParseIP(fields[0]) != nil {
+		// hosts format: leading IP address followed by one or more host names
+		fields = fields[1:]
+	} else if len(fields) > 1 {
+		return nil, false
+	}
+
+	if len(fields) == 0 {
+		return nil, false
+	}
+
+	for _, field := range fields {
+		if _, skip := hostsFileLocalNames[field]; skip {
+			continue
+		}
+
+		if !isValidDomain(field) {
+			return nil, false
+		}
+
+		domains = append(domains, field)
+	}
+
+	// a hosts line with local names only is valid, but contains no domain to block
+	return domains, true
+}
+
+func stripComment(line string) string {
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		return line[:idx]
+	}
+
+	return line
+}
+
+// local host names, which are often contained in hosts files and should not be blocked
+// nolint:gochecknoglobals
+var hostsFileLocalNames = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// checks if passed string is a syntactically valid domain name (optionally with "*." wildcard prefix)
+func isValidDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, "*.")
+
+	if domain == "" || len(domain) > 253 || net.ParseIP(domain) != nil {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
 }
@@ -2,8 +2,15 @@ package lists
 
 import (
 	"blocky/helpertest"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,7 +23,8 @@ func Test_NoMatch_With_Empty_List(t *testing.T) {
 		"gr1": {file1.Name()},
 	}
 
-	sut := NewListCache(lists, 0)
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
 
 	found, group := sut.Match("google.com", []string{"gr1"})
 	assert.Equal(t, false, found)
@@ -38,7 +46,8 @@ func Test_Match_Download_Multiple_Groups(t *testing.T) {
 		"gr2": {server3.URL},
 	}
 
-	sut := NewListCache(lists, 0)
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
 
 	found, group := sut.Match("blocked1.com", []string{"gr1", "gr2"})
 	assert.Equal(t, true, found)
@@ -69,7 +78,8 @@ func Test_Match_Download_No_Group(t *testing.T) {
 		"withDeadLink": {"http://wrong.host.name"},
 	}
 
-	sut := NewListCache(lists, 0)
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
 
 	found, group := sut.Match("blocked1.com", []string{})
 	assert.Equal(t, false, found)
@@ -91,7 +101,8 @@ func Test_Match_Files_Multiple_Groups(t *testing.T) {
 		"gr2": {"file://" + file3.Name()},
 	}
 
-	sut := NewListCache(lists, 0)
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
 
 	found, group := sut.Match("blocked1.com", []string{"gr1", "gr2"})
 	assert.Equal(t, true, found)
@@ -106,14 +117,517 @@ func Test_Match_Files_Multiple_Groups(t *testing.T) {
 	assert.Equal(t, "gr2", group)
 }
 
+func Test_Match_Regex(t *testing.T) {
+	file1 := helpertest.TempFile("blocked1.com\n/^ads[0-9]*\\..*/\n/invalid[/\n/.*tracker.*/")
+	defer os.Remove(file1.Name())
+
+	lists := map[string][]string{
+		"gr1": {file1.Name()},
+	}
+
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	found, group := sut.Match("blocked1.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+	assert.Equal(t, "gr1", group)
+
+	found, _ = sut.Match("ads123.example.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+
+	found, _ = sut.Match("ADS.example.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+
+	found, _ = sut.Match("my.tracker.org", []string{"gr1"})
+	assert.Equal(t, true, found)
+
+	found, _ = sut.Match("noads.example.com", []string{"gr1"})
+	assert.Equal(t, false, found)
+
+	// invalid regex is skipped: 1 domain and 2 regexes
+	assert.Equal(t, 3, sut.currentState().groupCaches["gr1"].elementCount())
+}
+
+func Test_Match_Wildcard(t *testing.T) {
+	file1 := helpertest.TempFile("*.doubleclick.net\nblocked1.com")
+	defer os.Remove(file1.Name())
+
+	lists := map[string][]string{
+		"gr1": {file1.Name()},
+	}
+
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	found, _ := sut.Match("ad.doubleclick.net", []string{"gr1"})
+	assert.Equal(t, true, found)
+
+	found, _ = sut.Match("a.b.doubleclick.net", []string{"gr1"})
+	assert.Equal(t, true, found)
+
+	found, _ = sut.Match("doubleclick.net", []string{"gr1"})
+	assert.Equal(t, false, found)
+
+	found, _ = sut.Match("www.blocked1.com", []string{"gr1"})
+	assert.Equal(t, false, found)
+}
+
+func Test_Match_Subdomains(t *testing.T) {
+	file1 := helpertest.TempFile("blocked1.com\n*.doubleclick.net")
+	defer os.Remove(file1.Name())
+
+	lists := map[string][]string{
+		"gr1": {file1.Name()},
+	}
+
+	sut, err := NewListCache(lists, 0, true, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	found, _ := sut.Match("blocked1.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+
+	found, _ = sut.Match("www.blocked1.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+
+	found, _ = sut.Match("notblocked1.com", []string{"gr1"})
+	assert.Equal(t, false, found)
+
+	found, _ = sut.Match("doubleclick.net", []string{"gr1"})
+	assert.Equal(t, false, found)
+
+	assert.Equal(t, 2, sut.currentState().groupCaches["gr1"].elementCount())
+}
+
+func Test_Match_HostsFile(t *testing.T) {
+	file1 := helpertest.TempFile(`# hosts file
+127.0.0.1	localhost
+255.255.255.255	broadcasthost
+::1 localhost ip6-localhost
+0.0.0.0 blocked1.com # trailing comment
+0.0.0.0	blocked2.com	blocked3.com
+0.0.0.0
+plain.com
+invalid line with spaces
+0.0.0.0 inv@lid.com`)
+	defer os.Remove(file1.Name())
+
+	lists := map[string][]string{
+		"gr1": {file1.Name()},
+	}
+
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	for _, domain := range []string{"blocked1.com", "blocked2.com", "blocked3.com", "plain.com"} {
+		found, _ := sut.Match(domain, []string{"gr1"})
+		assert.Equal(t, true, found, domain)
+	}
+
+	found, _ := sut.Match("localhost", []string{"gr1"})
+	assert.Equal(t, false, found)
+
+	assert.Equal(t, 4, sut.currentState().groupCaches["gr1"].elementCount())
+}
+
+func Test_processLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		domains []string
+		ok      bool
+	}{
+		{"example.com", []string{"example.com"}, true},
+		{"Example.COM", []string{"example.com"}, true},
+		{"*.example.com", []string{"*.example.com"}, true},
+		{"0.0.0.0 example.com", []string{"example.com"}, true},
+		{"127.0.0.1	a.com	b.com # comment", []string{"a.com", "b.com"}, true},
+		{"::1 localhost", nil, true},
+		{"0.0.0.0 0.0.0.0", nil, true},
+		{"0.0.0.0", nil, false},
+		{"192.168.178.1", nil, false},
+		{"two domains.com", nil, false},
+		{"ex$ample.com", nil, false},
+		{"example..com", nil, false},
+	}
+
+	for _, tt := range tests {
+		domains, ok := processLine(tt.line)
+		assert.Equal(t, tt.ok, ok, tt.line)
+		assert.Equal(t, tt.domains, domains, tt.line)
+	}
+}
+
+func Test_Refresh_KeepsPreviousDataOnFailure(t *testing.T) {
+	var fail bool
+
+	data := "blocked1.com"
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if fail {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		_, _ = rw.Write([]byte(data))
+	}))
+	defer server.Close()
+
+	lists := map[string][]string{
+		"gr1": {server.URL},
+	}
+
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	found, _ := sut.Match("blocked1.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+
+	// download fails -> previous data is used
+	fail = true
+
+	sut.refresh()
+	sut.refresh()
+
+	found, _ = sut.Match("blocked1.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+	assert.Equal(t, 2, sut.linkFailures[server.URL])
+	assert.Contains(t, sut.Configuration(), fmt.Sprintf("   - %s (consecutive failures: 2)", server.URL))
+
+	// new data after successful download
+	fail = false
+	data = "blocked2.com"
+
+	sut.refresh()
+
+	found, _ = sut.Match("blocked1.com", []string{"gr1"})
+	assert.Equal(t, false, found)
+
+	found, _ = sut.Match("blocked2.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+	assert.Equal(t, 0, sut.linkFailures[server.URL])
+}
+
+func Test_PeriodicRefresh(t *testing.T) {
+	file1 := helpertest.TempFile("blocked1.com")
+	defer os.Remove(file1.Name())
+
+	lists := map[string][]string{
+		"gr1": {file1.Name()},
+	}
+
+	sut, err := NewListCache(lists, 50*time.Millisecond, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+	defer sut.Stop()
+
+	found, _ := sut.Match("blocked2.com", []string{"gr1"})
+	assert.Equal(t, false, found)
+
+	assert.NoError(t, ioutil.WriteFile(file1.Name(), []byte("blocked2.com"), 0600))
+
+	time.Sleep(200 * time.Millisecond)
+
+	found, _ = sut.Match("blocked2.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+}
+
+func Test_Match_InlineAndMissingFile(t *testing.T) {
+	file1 := helpertest.TempFile("blocked1.com")
+	defer os.Remove(file1.Name())
+
+	lists := map[string][]string{
+		"gr1": {"file://" + file1.Name(), "/does/not/exist.txt", "# inline entries\nblocked2.com\n*.blocked3.com\n"},
+	}
+
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	for _, domain := range []string{"blocked1.com", "blocked2.com", "sub.blocked3.com"} {
+		found, _ := sut.Match(domain, []string{"gr1"})
+		assert.Equal(t, true, found, domain)
+	}
+
+	assert.Equal(t, 1, sut.linkFailures["/does/not/exist.txt"])
+	assert.Contains(t, sut.Configuration(), "   - [inline: 3 lines]")
+}
+
+func Test_Refresh_Coalesced(t *testing.T) {
+	var downloads int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		time.Sleep(50 * time.Millisecond)
+
+		_, _ = rw.Write([]byte("blocked1.com"))
+	}))
+	defer server.Close()
+
+	sut, err := NewListCache(map[string][]string{"gr1": {server.URL}}, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+
+	for i := 0; i < 5; i++ {
+		sut.Refresh()
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	// running refresh and one coalesced refresh
+	assert.Equal(t, int32(3), atomic.LoadInt32(&downloads))
+
+	found, _ := sut.Match("blocked1.com", []string{"gr1"})
+	assert.Equal(t, true, found)
+}
+
 func Test_Configuration(t *testing.T) {
 	lists := map[string][]string{
 		"gr1": {"file1", "file2"},
 	}
 
-	sut := NewListCache(lists, 0)
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
 
 	c := sut.Configuration()
 
 	assert.Len(t, c, 8)
 }
+
+func Test_MatchingListAndStats(t *testing.T) {
+	file1 := helpertest.TempFile("blocked1.com")
+	defer os.Remove(file1.Name())
+
+	lists := map[string][]string{
+		"gr1": {"file://" + file1.Name(), "blocked2.com\nblocked3.com"},
+	}
+
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	list, entry := sut.MatchingList("blocked1.com", "gr1")
+	assert.Equal(t, "file://"+file1.Name(), list)
+	assert.Equal(t, "blocked1.com", entry)
+
+	list, entry = sut.MatchingList("BLOCKED2.com", "gr1")
+	assert.Equal(t, "[inline: 2 lines]", list)
+	assert.Equal(t, "blocked2.com", entry)
+
+	list, entry = sut.MatchingList("example.com", "gr1")
+	assert.Equal(t, "", list)
+	assert.Equal(t, "", entry)
+
+	list, _ = sut.MatchingList("blocked1.com", "gr2")
+	assert.Equal(t, "", list)
+
+	entries, lastRefresh := sut.Stats()
+	assert.Equal(t, map[string]int{"gr1": 3}, entries)
+	assert.WithinDuration(t, time.Now(), lastRefresh, time.Minute)
+}
+
+func Test_MatchIP(t *testing.T) {
+	file1 := helpertest.TempFile("1.2.3.0/24")
+	defer os.Remove(file1.Name())
+
+	file2 := helpertest.TempFile("1.2.3.4")
+	defer os.Remove(file2.Name())
+
+	lists := map[string][]string{
+		"gr1": {"10.0.0.0/8\n192.168.1.1 # single IP\nfd00::/8\n0.0.0.0 blocked.com", file1.Name()},
+		"gr2": {file2.Name()},
+	}
+
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	for ip, expected := range map[string]string{
+		"10.1.2.3":    "gr1",
+		"192.168.1.1": "gr1",
+		"fd00::1":     "gr1",
+		"1.2.3.4":     "gr1",
+		"192.168.1.2": "",
+		"fe80::1":     "",
+		"11.0.0.1":    "",
+	} {
+		_, group := sut.MatchIP(net.ParseIP(ip), []string{"gr1", "gr2"})
+		assert.Equal(t, expected, group, ip)
+	}
+
+	found, group := sut.MatchIP(net.ParseIP("1.2.3.4"), []string{"gr2"})
+	assert.True(t, found)
+	assert.Equal(t, "gr2", group)
+
+	// hosts lines are no IP entries
+	found, _ = sut.MatchIP(net.IPv4zero, []string{"gr1"})
+	assert.False(t, found)
+
+	found, _ = sut.Match("blocked.com", []string{"gr1"})
+	assert.True(t, found)
+
+	list, entry := sut.MatchingList("1.2.3.4", "gr1")
+	assert.Equal(t, file1.Name(), list)
+	assert.Equal(t, "1.2.3.0/24", entry)
+
+	_, entry = sut.MatchingList("192.168.1.1", "gr1")
+	assert.Equal(t, "192.168.1.1", entry)
+
+	list, _ = sut.MatchingList("1.2.4.4", "gr1")
+	assert.Equal(t, "", list)
+
+	entries, _ := sut.Stats()
+	assert.Equal(t, map[string]int{"gr1": 5, "gr2": 1}, entries)
+}
+
+func Test_StartStrategy_FailOnError(t *testing.T) {
+	lists := map[string][]string{
+		"gr1": {"/does/not/exist.txt", "blocked1.com\nblocked2.com"},
+	}
+
+	_, err := NewListCache(lists, 0, false, 0, StartStrategyFailOnError, nil)
+	assert.EqualError(t, err, "can't load list '/does/not/exist.txt': open /does/not/exist.txt: no such file or directory")
+
+	// errors are only logged with blocking strategy
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	found, _ := sut.Match("blocked1.com", []string{"gr1"})
+	assert.True(t, found)
+}
+
+func Test_StartStrategy_Fast(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		_, _ = rw.Write([]byte("blocked1.com"))
+	}))
+	defer server.Close()
+
+	sut, err := NewListCache(map[string][]string{"gr1": {server.URL}}, 0, false, 0, StartStrategyFast, nil)
+	assert.NoError(t, err)
+
+	// returns before the list is loaded
+	found, _ := sut.Match("blocked1.com", []string{"gr1"})
+	assert.False(t, found)
+
+	close(release)
+
+	select {
+	case <-sut.Loaded():
+	case <-time.After(2 * time.Second):
+		t.Fatal("list was not loaded")
+	}
+
+	found, _ = sut.Match("blocked1.com", []string{"gr1"})
+	assert.True(t, found)
+}
+
+func Test_Refresh_BoundedConcurrency(t *testing.T) {
+	var current, max int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		_, _ = rw.Write([]byte(req.URL.Path[1:] + ".com"))
+	}))
+	defer server.Close()
+
+	lists := map[string][]string{}
+
+	for i := 0; i < 10; i++ {
+		group := fmt.Sprintf("gr%d", i%3)
+		lists[group] = append(lists[group], fmt.Sprintf("%s/blocked%d", server.URL, i))
+	}
+
+	// link used in two groups is loaded once
+	lists["gr0"] = append(lists["gr0"], server.URL+"/blocked1")
+
+	sut, err := NewListCache(lists, 0, false, 2, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&max))
+
+	entries, _ := sut.Stats()
+	assert.Equal(t, map[string]int{"gr0": 5, "gr1": 3, "gr2": 3}, entries)
+}
+
+func Test_MatchingList_Entry(t *testing.T) {
+	lists := map[string][]string{
+		"gr1": {"*.wildcard.com\n/^ads[0-9]+\\./"},
+		"gr2": {"example.com\nexample.org"},
+	}
+
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	_, entry := sut.MatchingList("www.wildcard.com", "gr1")
+	assert.Equal(t, "*.wildcard.com", entry)
+
+	_, entry = sut.MatchingList("ads1.example.com", "gr1")
+	assert.Equal(t, "/^ads[0-9]+\\./", entry)
+
+	sut, err = NewListCache(lists, 0, true, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	// parent domain matches with matchSubdomains
+	_, entry = sut.MatchingList("sub.example.com", "gr2")
+	assert.Equal(t, "example.com", entry)
+}
+
+func Test_RuntimeEntries(t *testing.T) {
+	lists := map[string][]string{
+		"gr1": {"blocked1.com\nblocked2.com"},
+	}
+
+	sut, err := NewListCache(lists, 0, false, 0, StartStrategyBlocking, nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, sut.AddEntry("gr1", "Runtime.com."))
+	assert.NoError(t, sut.AddEntry("gr1", "blocked1.com"))
+	assert.NoError(t, sut.AddEntry("gr2", "*.wildcard.com"))
+	assert.Error(t, sut.AddEntry("gr1", "in valid"))
+	assert.Error(t, sut.AddEntry("", "example.com"))
+
+	found, group := sut.Match("runtime.com", []string{"gr1"})
+	assert.True(t, found)
+	assert.Equal(t, "gr1", group)
+
+	found, group = sut.Match("www.wildcard.com", []string{"gr1", "gr2"})
+	assert.True(t, found)
+	assert.Equal(t, "gr2", group)
+
+	list, entry := sut.MatchingList("runtime.com", "gr1")
+	assert.Equal(t, "[runtime]", list)
+	assert.Equal(t, "runtime.com", entry)
+
+	assert.Equal(t, map[string][]string{"gr1": {"blocked1.com", "runtime.com"}, "gr2": {"*.wildcard.com"}},
+		sut.RuntimeEntries())
+
+	// runtime entries survive refresh
+	assert.NoError(t, sut.refresh())
+
+	found, _ = sut.Match("runtime.com", []string{"gr1"})
+	assert.True(t, found)
+
+	assert.True(t, sut.RemoveEntry("gr1", "runtime.com"))
+	assert.False(t, sut.RemoveEntry("gr1", "runtime.com"))
+	assert.True(t, sut.RemoveEntry("gr2", "*.wildcard.com"))
+
+	found, _ = sut.Match("runtime.com", []string{"gr1"})
+	assert.False(t, found)
+
+	found, _ = sut.Match("www.wildcard.com", []string{"gr2"})
+	assert.False(t, found)
+
+	// entry is still contained in the list
+	assert.True(t, sut.RemoveEntry("gr1", "blocked1.com"))
+
+	found, _ = sut.Match("blocked1.com", []string{"gr1"})
+	assert.True(t, found)
+	assert.Equal(t, map[string][]string{}, sut.RuntimeEntries())
+}
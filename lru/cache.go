@@ -0,0 +1,214 @@
+package lru
+
+import (
+	"container/list"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Cache is a thread safe cache with expiring entries. If max items count is reached,
+// least recently used entries will be evicted
+type Cache struct {
+	*cache
+}
+
+type cache struct {
+	lock          sync.Mutex
+	maxItemsCount int
+	items         map[string]*list.Element
+	// most recently used entry is at front
+	order     *list.List
+	evictions uint64
+	stop      chan struct{}
+}
+
+type entry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+// New creates new cache, maxItemsCount 0 means unlimited. Expired entries are removed periodically
+// with passed cleanup interval
+func New(maxItemsCount int, cleanupInterval time.Duration) *Cache {
+	c := &cache{
+		maxItemsCount: maxItemsCount,
+		items:         make(map[string]*list.Element),
+		order:         list.New(),
+		stop:          make(chan struct{}),
+	}
+
+	go c.periodicCleanUp(cleanupInterval)
+
+	// wrapper is used to stop the cleanup goroutine if the cache is not used anymore
+	result := &Cache{c}
+	runtime.SetFinalizer(result, func(c *Cache) {
+		close(c.stop)
+	})
+
+	return result
+}
+
+func (c *cache) periodicCleanUp(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.DeleteExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Get returns value for passed key, if present and not expired
+func (c *cache) Get(key string) (interface{}, bool) {
+	value, _, found := c.GetWithExpiration(key)
+
+	return value, found
+}
+
+// GetWithExpiration returns value and expiration time for passed key, if present and not expired
+func (c *cache) GetWithExpiration(key string) (interface{}, time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, found := c.items[key]
+	if !found {
+		return nil, time.Time{}, false
+	}
+
+	e := el.Value.(*entry)
+	if time.Now().After(e.expiresAt) {
+		c.removeElement(el)
+
+		return nil, time.Time{}, false
+	}
+
+	c.order.MoveToFront(el)
+
+	return e.value, e.expiresAt, true
+}
+
+// Set puts value with passed time to live into the cache, least recently used entry is evicted if
+// max items count is reached
+func (c *cache) Set(key string, value interface{}, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expiresAt := time.Now().Add(ttl)
+
+	if el, found := c.items[key]; found {
+		e := el.Value.(*entry)
+		e.value = value
+		e.expiresAt = expiresAt
+		c.order.MoveToFront(el)
+
+		return
+	}
+
+	if c.maxItemsCount > 0 && c.order.Len() >= c.maxItemsCount {
+		c.removeElement(c.order.Back())
+		c.evictions++
+	}
+
+	c.items[key] = c.order.PushFront(&entry{key: key, value: value, expiresAt: expiresAt})
+}
+
+// Delete removes entry with passed key
+func (c *cache) Delete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, found := c.items[key]; found {
+		c.removeElement(el)
+	}
+}
+
+// DeleteMatching removes all entries with key matching the passed function, returns number of removed entries
+func (c *cache) DeleteMatching(matches func(key string) bool) (count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+
+		if matches(el.Value.(*entry).key) {
+			c.removeElement(el)
+			count++
+		}
+
+		el = next
+	}
+
+	return
+}
+
+// Clear removes all entries, returns number of removed entries
+func (c *cache) Clear() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	count := c.order.Len()
+
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+
+	return count
+}
+
+// DeleteExpired removes all expired entries
+func (c *cache) DeleteExpired() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+
+		if now.After(el.Value.(*entry).expiresAt) {
+			c.removeElement(el)
+		}
+
+		el = next
+	}
+}
+
+// ForEach calls passed function for each not expired entry, from most to least recently used
+func (c *cache) ForEach(fn func(key string, value interface{}, expiresAt time.Time)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*entry); now.Before(e.expiresAt) {
+			fn(e.key, e.value, e.expiresAt)
+		}
+	}
+}
+
+// ItemCount returns number of entries in the cache, can contain expired entries, which are not cleaned up yet
+func (c *cache) ItemCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
+
+// Evictions returns number of entries, which were removed because max items count was reached
+func (c *cache) Evictions() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.evictions
+}
+
+func (c *cache) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
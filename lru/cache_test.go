@@ -0,0 +1,142 @@
+package lru
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SetGet(t *testing.T) {
+	sut := New(0, time.Minute)
+
+	sut.Set("key1", "value1", time.Minute)
+
+	val, expiresAt, found := sut.GetWithExpiration("key1")
+	assert.True(t, found)
+	assert.Equal(t, "value1", val)
+	assert.InDelta(t, 60, time.Until(expiresAt).Seconds(), 1)
+
+	// replace
+	sut.Set("key1", "value2", time.Minute)
+
+	val, found = sut.Get("key1")
+	assert.True(t, found)
+	assert.Equal(t, "value2", val)
+	assert.Equal(t, 1, sut.ItemCount())
+
+	_, found = sut.Get("unknown")
+	assert.False(t, found)
+
+	sut.Delete("key1")
+
+	_, found = sut.Get("key1")
+	assert.False(t, found)
+}
+
+func Test_Expiration(t *testing.T) {
+	sut := New(0, 50*time.Millisecond)
+
+	sut.Set("key1", "value1", 10*time.Millisecond)
+	sut.Set("key2", "value2", 10*time.Millisecond)
+	sut.Set("key3", "value3", time.Minute)
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, found := sut.Get("key1")
+	assert.False(t, found)
+	assert.Equal(t, 2, sut.ItemCount())
+
+	// cleanup removes expired entries
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, sut.ItemCount())
+}
+
+func Test_EvictLeastRecentlyUsed(t *testing.T) {
+	sut := New(2, time.Minute)
+
+	sut.Set("key1", "value1", time.Minute)
+	sut.Set("key2", "value2", time.Minute)
+
+	// key1 is used -> key2 is least recently used
+	_, found := sut.Get("key1")
+	assert.True(t, found)
+
+	sut.Set("key3", "value3", time.Minute)
+
+	_, found = sut.Get("key2")
+	assert.False(t, found)
+
+	_, found = sut.Get("key1")
+	assert.True(t, found)
+
+	_, found = sut.Get("key3")
+	assert.True(t, found)
+
+	assert.Equal(t, 2, sut.ItemCount())
+	assert.Equal(t, uint64(1), sut.Evictions())
+}
+
+func Test_ConcurrentAccess(t *testing.T) {
+	sut := New(100, time.Minute)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 1000; j++ {
+				key := fmt.Sprintf("key%d", (i*1000+j)%300)
+				sut.Set(key, j, time.Minute)
+				sut.Get(key)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, 100, sut.ItemCount())
+}
+
+func Test_DeleteMatchingAndClear(t *testing.T) {
+	sut := New(0, time.Minute)
+
+	sut.Set("a1", "value", time.Minute)
+	sut.Set("a2", "value", time.Minute)
+	sut.Set("b1", "value", time.Minute)
+
+	assert.Equal(t, 2, sut.DeleteMatching(func(key string) bool {
+		return key[0] == 'a'
+	}))
+
+	_, found := sut.Get("b1")
+	assert.True(t, found)
+	assert.Equal(t, 1, sut.ItemCount())
+
+	assert.Equal(t, 1, sut.Clear())
+	assert.Equal(t, 0, sut.ItemCount())
+
+	_, found = sut.Get("b1")
+	assert.False(t, found)
+}
+
+func Test_ForEach(t *testing.T) {
+	sut := New(0, time.Minute)
+
+	sut.Set("key1", "value1", time.Minute)
+	sut.Set("key2", "value2", -time.Second)
+	sut.Set("key3", "value3", time.Minute)
+
+	var keys []string
+
+	sut.ForEach(func(key string, value interface{}, expiresAt time.Time) {
+		keys = append(keys, key)
+	})
+
+	assert.Equal(t, []string{"key3", "key1"}, keys)
+}
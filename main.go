@@ -3,9 +3,12 @@ package main
 import (
 	"blocky/config"
 	"blocky/server"
+	"blocky/util"
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 
@@ -13,19 +16,32 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-//nolint:gochecknoglobals
-var version = "undefined"
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "healthcheck":
+			os.Exit(healthcheck(os.Args[2:]))
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "config":
+			os.Exit(configCommand(os.Args[2:]))
+		}
+	}
 
-//nolint:gochecknoglobals
-var buildTime = "undefined"
+	path := flag.String("config", config.DefaultPath, "path of the configuration file or directory")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-func main() {
-	cfg := config.NewConfig()
 	configureLog(&cfg)
+	logEnvOverrides(&cfg)
 
 	printBanner()
 
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	done := make(chan bool)
 
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
@@ -41,12 +57,26 @@ func main() {
 		<-signals
 		log.Infof("Terminating...")
 		server.Stop()
+		log.Infof("Terminated")
 		done <- true
 	}()
 
 	<-done
 }
 
+// logs configuration keys, which are set by environment variables. Values are not logged, they can contain secrets
+func logEnvOverrides(cfg *config.Config) {
+	applied, unknown := cfg.EnvOverrides()
+
+	for _, name := range applied {
+		log.Debugf("configuration value overridden by environment variable %s", name)
+	}
+
+	for _, name := range unknown {
+		log.Warnf("environment variable %s doesn't match any configuration key", name)
+	}
+}
+
 func configureLog(cfg *config.Config) {
 	if level, err := log.ParseLevel(cfg.LogLevel); err != nil {
 		log.Fatalf("invalid log level %s %v", cfg.LogLevel, err)
@@ -54,9 +84,19 @@ func configureLog(cfg *config.Config) {
 		log.SetLevel(level)
 	}
 
+	if cfg.LogFormat == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat:  time.RFC3339Nano,
+			DisableTimestamp: !cfg.LogTimestamp,
+		})
+
+		return
+	}
+
 	logFormatter := &prefixed.TextFormatter{
 		TimestampFormat:  "2006-01-02 15:04:05",
 		FullTimestamp:    true,
+		DisableTimestamp: !cfg.LogTimestamp,
 		ForceFormatting:  true,
 		ForceColors:      true,
 		QuoteEmptyFields: true}
@@ -82,7 +122,7 @@ func printBanner() {
 	log.Info("_/                                               _/_/           _/")
 	log.Info("_/                                                              _/")
 	log.Info("_/                                                              _/")
-	log.Infof("_/  Version: %-18s Build time: %-18s  _/", version, buildTime)
+	log.Infof("_/  Version: %-18s Build time: %-18s  _/", util.Version, util.BuildTime)
 	log.Info("_/                                                              _/")
 	log.Info("_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/_/")
 }
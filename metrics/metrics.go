@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Path of the prometheus metrics endpoint
+const Path = "/metrics"
+
+// ListStats contains entry count per group of black or white list
+type ListStats struct {
+	Type        string
+	Entries     map[string]int
+	LastRefresh time.Time
+}
+
+// CacheStats contains current state of the response cache
+type CacheStats struct {
+	ItemCount int
+	Evictions uint64
+}
+
+//nolint:gochecknoglobals
+var (
+	registry   = prometheus.NewRegistry()
+	enableOnce sync.Once
+	enabled    bool
+
+	queryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blocky_query_total",
+		Help: "Number of processed DNS queries",
+	}, []string{"type", "rcode"})
+
+	blockedQueryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blocky_blocked_query_total",
+		Help: "Number of blocked DNS queries",
+	}, []string{"group", "list"})
+
+	cacheHitTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blocky_cache_hit_total",
+		Help: "Number of queries answered from cache",
+	})
+
+	cacheMissTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blocky_cache_miss_total",
+		Help: "Number of queries not found in cache",
+	})
+
+	upstreamRequestTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blocky_upstream_request_total",
+		Help: "Number of requests sent to upstream DNS server",
+	}, []string{"upstream"})
+
+	upstreamErrorTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blocky_upstream_error_total",
+		Help: "Number of failed requests to upstream DNS server",
+	}, []string{"upstream"})
+
+	rateLimitedQueryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blocky_rate_limited_query_total",
+		Help: "Number of queries refused by rate limit",
+	}, []string{"limit"})
+
+	coalescedQueryTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blocky_coalesced_query_total",
+		Help: "Number of queries, which shared the upstream exchange of an identical in-flight query",
+	})
+
+	overloadedQueryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blocky_overloaded_query_total",
+		Help: "Number of queries, which exceeded the limit of concurrent requests (dropped or answered with SERVFAIL)",
+	}, []string{"action"})
+
+	rejectedQueryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blocky_rejected_query_total",
+		Help: "Number of unsupported requests (other opcode than QUERY, zone transfer, no question), which were rejected",
+	}, []string{"reason"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blocky_upstream_request_duration_seconds",
+		Help:    "Response time of upstream DNS server",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"upstream"})
+
+	stats = &statsCollector{
+		listEntries: prometheus.NewDesc("blocky_list_cache_entries",
+			"Number of entries in black or white list group", []string{"type", "group"}, nil),
+		listRefresh: prometheus.NewDesc("blocky_list_last_refresh_timestamp_seconds",
+			"Time of last black or white list refresh", []string{"type"}, nil),
+		cacheEntries: prometheus.NewDesc("blocky_cache_entries",
+			"Number of entries in response cache", nil, nil),
+		cacheEvictions: prometheus.NewDesc("blocky_cache_evictions_total",
+			"Number of entries evicted from response cache", nil, nil),
+	}
+)
+
+// Enable registers all metrics, until then all recording functions do nothing
+func Enable() {
+	enableOnce.Do(func() {
+		registry.MustRegister(queryTotal, blockedQueryTotal, cacheHitTotal, cacheMissTotal,
+			upstreamRequestTotal, upstreamErrorTotal, upstreamDuration, rateLimitedQueryTotal,
+			coalescedQueryTotal, overloadedQueryTotal, rejectedQueryTotal, stats)
+
+		enabled = true
+	})
+}
+
+// IsEnabled returns true if metrics are collected
+func IsEnabled() bool {
+	return enabled
+}
+
+// Handler returns http handler which serves metrics in prometheus format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RecordQuery counts processed query with type and response code
+func RecordQuery(qType, rcode string) {
+	if enabled {
+		queryTotal.WithLabelValues(qType, rcode).Inc()
+	}
+}
+
+// RecordBlocked counts blocked query with group and list, which contains the domain
+func RecordBlocked(group, list string) {
+	if enabled {
+		blockedQueryTotal.WithLabelValues(group, list).Inc()
+	}
+}
+
+// RecordCacheHit counts query answered from cache
+func RecordCacheHit() {
+	if enabled {
+		cacheHitTotal.Inc()
+	}
+}
+
+// RecordCacheMiss counts query, which was not found in cache
+func RecordCacheMiss() {
+	if enabled {
+		cacheMissTotal.Inc()
+	}
+}
+
+// RecordUpstreamRequest counts request to upstream with its duration
+func RecordUpstreamRequest(upstream string, duration time.Duration, err error) {
+	if enabled {
+		upstreamRequestTotal.WithLabelValues(upstream).Inc()
+
+		if err != nil {
+			upstreamErrorTotal.WithLabelValues(upstream).Inc()
+		} else {
+			upstreamDuration.WithLabelValues(upstream).Observe(duration.Seconds())
+		}
+	}
+}
+
+// RecordRateLimited counts query refused by the rate limit (client or global)
+func RecordRateLimited(limit string) {
+	if enabled {
+		rateLimitedQueryTotal.WithLabelValues(limit).Inc()
+	}
+}
+
+// RecordCoalescedQuery counts query, which was answered with the result of an identical in-flight query
+func RecordCoalescedQuery() {
+	if enabled {
+		coalescedQueryTotal.Inc()
+	}
+}
+
+// RecordOverloadedQuery counts query, which exceeded the limit of concurrent requests. Action is "drop" or "servfail"
+func RecordOverloadedQuery(action string) {
+	if enabled {
+		overloadedQueryTotal.WithLabelValues(action).Inc()
+	}
+}
+
+// RecordRejectedQuery counts unsupported request. Reason is "opcode", "zone_transfer" or "no_question"
+func RecordRejectedQuery(reason string) {
+	if enabled {
+		rejectedQueryTotal.WithLabelValues(reason).Inc()
+	}
+}
+
+// SetListStatsSource sets function, which returns current stats of black and white lists.
+// Replaces previous source (e.g. after configuration reload)
+func SetListStatsSource(source func() []ListStats) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.listSource = source
+}
+
+// SetCacheStatsSource sets function, which returns current state of the response cache
+func SetCacheStatsSource(source func() CacheStats) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.cacheSource = source
+}
+
+// collects values of lists and cache on each scrape
+type statsCollector struct {
+	lock        sync.Mutex
+	listSource  func() []ListStats
+	cacheSource func() CacheStats
+
+	listEntries    *prometheus.Desc
+	listRefresh    *prometheus.Desc
+	cacheEntries   *prometheus.Desc
+	cacheEvictions *prometheus.Desc
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.listEntries
+	ch <- c.listRefresh
+	ch <- c.cacheEntries
+	ch <- c.cacheEvictions
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	listSource, cacheSource := c.listSource, c.cacheSource
+	c.lock.Unlock()
+
+	if listSource != nil {
+		for _, l := range listSource() {
+			for group, count := range l.Entries {
+				ch <- prometheus.MustNewConstMetric(c.listEntries, prometheus.GaugeValue, float64(count), l.Type, group)
+			}
+
+			if !l.LastRefresh.IsZero() {
+				ch <- prometheus.MustNewConstMetric(c.listRefresh, prometheus.GaugeValue,
+					float64(l.LastRefresh.Unix()), l.Type)
+			}
+		}
+	}
+
+	if cacheSource != nil {
+		s := cacheSource()
+		ch <- prometheus.MustNewConstMetric(c.cacheEntries, prometheus.GaugeValue, float64(s.ItemCount))
+		ch <- prometheus.MustNewConstMetric(c.cacheEvictions, prometheus.CounterValue, float64(s.Evictions))
+	}
+}
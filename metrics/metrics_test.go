@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, Path, nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	body, err := ioutil.ReadAll(rec.Body)
+	assert.NoError(t, err)
+
+	return string(body)
+}
+
+func Test_DisabledMetrics(t *testing.T) {
+	RecordQuery("A", "NOERROR")
+
+	assert.False(t, IsEnabled())
+	assert.NotContains(t, scrape(t), "blocky_query_total")
+}
+
+func Test_EnabledMetrics(t *testing.T) {
+	Enable()
+	Enable()
+
+	assert.True(t, IsEnabled())
+
+	RecordQuery("A", "NOERROR")
+	RecordBlocked("ads", "https://example.com/list.txt")
+	RecordCacheHit()
+	RecordCacheMiss()
+	RecordUpstreamRequest("udp:8.8.8.8", 10*time.Millisecond, nil)
+	RecordUpstreamRequest("udp:8.8.8.8", 0, errors.New("timeout"))
+
+	SetListStatsSource(func() []ListStats {
+		return []ListStats{{Type: "blacklist", Entries: map[string]int{"ads": 42}, LastRefresh: time.Unix(1000, 0)}}
+	})
+	SetCacheStatsSource(func() CacheStats {
+		return CacheStats{ItemCount: 5, Evictions: 2}
+	})
+
+	body := scrape(t)
+
+	assert.Contains(t, body, `blocky_query_total{rcode="NOERROR",type="A"} 1`)
+	assert.Contains(t, body, `blocky_blocked_query_total{group="ads",list="https://example.com/list.txt"} 1`)
+	assert.Contains(t, body, "blocky_cache_hit_total 1")
+	assert.Contains(t, body, "blocky_cache_miss_total 1")
+	assert.Contains(t, body, `blocky_upstream_request_total{upstream="udp:8.8.8.8"} 2`)
+	assert.Contains(t, body, `blocky_upstream_error_total{upstream="udp:8.8.8.8"} 1`)
+	assert.Contains(t, body, `blocky_upstream_request_duration_seconds_count{upstream="udp:8.8.8.8"} 1`)
+	assert.Contains(t, body, `blocky_list_cache_entries{group="ads",type="blacklist"} 42`)
+	assert.Contains(t, body, `blocky_list_last_refresh_timestamp_seconds{type="blacklist"} 1000`)
+	assert.Contains(t, body, "blocky_cache_entries 5")
+	assert.Contains(t, body, "blocky_cache_evictions_total 2")
+}
@@ -0,0 +1,249 @@
+package mqtt
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMinReconnectWait = time.Second
+	maxReconnectWait        = time.Minute
+	connectTimeout          = 5 * time.Second
+	// timeout for the acknowledgement of a message with QoS 1
+	ackTimeout = 5 * time.Second
+	keepAlive  = 60 * time.Second
+	// max number of pending messages, further messages are dropped
+	queueSize = 1000
+	// time to complete pending work on disconnect in milliseconds
+	disconnectQuiesce = 250
+)
+
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// Client publishes messages with QoS 0 or 1 asynchronously via the paho MQTT client. Messages are queued, if the
+// broker is not reachable, the connection is retried with backoff and messages are dropped if the queue is full
+type Client struct {
+	address  string
+	clientID string
+	qos      byte
+	client   paho.Client
+
+	minReconnectWait time.Duration
+
+	messages chan message
+	stop     chan struct{}
+	dropped  uint64
+}
+
+func logger() *logrus.Entry {
+	return logrus.WithField("prefix", "mqtt")
+}
+
+// NewClient creates client for the broker URL (tcp://host:port, mqtt://, tls://, ssl:// or mqtts://, credentials as
+// user info) and connects in background
+func NewClient(broker string, qos uint8) (*Client, error) {
+	return newClient(broker, qos, defaultMinReconnectWait)
+}
+
+func newClient(broker string, qos uint8, minReconnectWait time.Duration) (*Client, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL '%s': %v", broker, err)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid broker URL '%s': host is missing", broker)
+	}
+
+	if qos > 1 {
+		return nil, fmt.Errorf("unsupported QoS %d, must be 0 or 1", qos)
+	}
+
+	c := &Client{
+		address:          u.Host,
+		qos:              qos,
+		clientID:         randomClientID(),
+		minReconnectWait: minReconnectWait,
+		messages:         make(chan message, queueSize),
+		stop:             make(chan struct{}),
+	}
+
+	opts := paho.NewClientOptions().
+		SetClientID(c.clientID).
+		SetCleanSession(true).
+		SetKeepAlive(keepAlive).
+		SetConnectTimeout(connectTimeout).
+		// reconnects after connection loss, the first connect is retried by the client
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(maxReconnectWait).
+		SetOnConnectHandler(c.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logger().Warnf("connection to %s lost, will reconnect: %v", c.address, err)
+		})
+
+	port, scheme := "1883", "tcp"
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "tls", "ssl", "mqtts":
+		port, scheme = "8883", "ssl"
+		opts.SetTLSConfig(&tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12})
+	default:
+		return nil, fmt.Errorf("invalid broker URL '%s': protocol must be tcp, mqtt, tls, ssl or mqtts", broker)
+	}
+
+	if u.Port() == "" {
+		c.address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	opts.AddBroker(scheme + "://" + c.address)
+
+	if u.User != nil {
+		opts.SetUsername(u.User.Username())
+
+		password, _ := u.User.Password()
+		opts.SetPassword(password)
+	}
+
+	c.client = paho.NewClient(opts)
+
+	go c.run()
+
+	return c, nil
+}
+
+func randomClientID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+
+	return "blocky-" + hex.EncodeToString(b)
+}
+
+// Publish adds the message to the queue, never blocks. The message is dropped if the queue is full
+func (c *Client) Publish(topic string, payload []byte) {
+	select {
+	case c.messages <- message{topic: topic, payload: payload}:
+	default:
+		if atomic.AddUint64(&c.dropped, 1) == 1 {
+			logger().Warnf("broker %s is not available, dropping messages", c.address)
+		}
+	}
+}
+
+// Dropped returns the number of messages, which were dropped since the last successful connect
+func (c *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// IsConnected returns true if the connection to the broker is established
+func (c *Client) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+// Close disconnects from the broker and stops the client, pending messages are dropped
+func (c *Client) Close() {
+	close(c.stop)
+}
+
+func (c *Client) String() string {
+	status := "disconnected"
+	if c.IsConnected() {
+		status = "connected"
+	}
+
+	return fmt.Sprintf("%s, QoS %d (%s)", c.address, c.qos, status)
+}
+
+func (c *Client) onConnect(_ paho.Client) {
+	logger().Infof("connected to %s", c.address)
+
+	if dropped := atomic.SwapUint64(&c.dropped, 0); dropped > 0 {
+		logger().Warnf("connected to %s, %d messages were dropped", c.address, dropped)
+	}
+}
+
+// connects to the broker and publishes queued messages, while the connection is lost, messages stay in the queue
+func (c *Client) run() {
+	defer c.client.Disconnect(disconnectQuiesce)
+
+	if !c.connect() {
+		return
+	}
+
+	for {
+		select {
+		case m := <-c.messages:
+			// wait for automatic reconnect
+			for !c.client.IsConnectionOpen() {
+				if !c.wait(c.minReconnectWait) {
+					return
+				}
+			}
+
+			token := c.client.Publish(m.topic, c.qos, false, m.payload)
+			if !token.WaitTimeout(ackTimeout) {
+				logger().Warnf("timeout on publishing message to %s", c.address)
+			} else if err := token.Error(); err != nil {
+				logger().Warnf("can't publish message to %s: %v", c.address, err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// connects with backoff until the connection is established, returns false if the client was closed
+func (c *Client) connect() bool {
+	backoff := c.minReconnectWait
+
+	for {
+		token := c.client.Connect()
+
+		err := fmt.Errorf("timeout after %s", connectTimeout)
+		if token.WaitTimeout(connectTimeout) {
+			err = token.Error()
+		}
+
+		if err == nil {
+			return true
+		}
+
+		logger().Warnf("can't connect to %s, will retry in %s: %v", c.address, backoff, err)
+
+		if !c.wait(backoff) {
+			return false
+		}
+
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// waits passed duration, returns false if the client was closed
+func (c *Client) wait(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+func nextBackoff(current time.Duration) time.Duration {
+	if current*2 > maxReconnectWait {
+		return maxReconnectWait
+	}
+
+	return current * 2
+}
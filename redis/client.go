@@ -0,0 +1,294 @@
+package redis
+
+import (
+	"blocky/config"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReconnectInterval = 10 * time.Second
+	connectTimeout           = 2 * time.Second
+	// timeout of one command, queries must not wait long for an unreachable Redis
+	commandTimeout = 250 * time.Millisecond
+	// max number of pending asynchronous writes, further writes are dropped
+	writeQueueSize = 1000
+	// number of goroutines, which process the asynchronous writes
+	writeWorkers = 4
+	scanCount    = 1000
+)
+
+var errNotConnected = errors.New("not connected to redis")
+
+// Client wraps a go-redis client with connection pool. Redis is optional: if it's not reachable, commands fail
+// immediately and the connection is checked periodically in background
+type Client struct {
+	address           string
+	reconnectInterval time.Duration
+	client            *redis.Client
+	// 1 if the last ping or command succeeded
+	connected int32
+
+	lock sync.Mutex
+	// subscriptions, closed on Close
+	pubSubs []*redis.PubSub
+
+	writes    chan write
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type write struct {
+	key   string
+	value []byte
+	ttl   time.Duration
+}
+
+func logger() *logrus.Entry {
+	return logrus.WithField("prefix", "redis")
+}
+
+// NewClient creates client and connects to the server in background
+func NewClient(cfg config.RedisConfig) *Client {
+	reconnectInterval := time.Duration(cfg.ReconnectInterval)
+	if reconnectInterval <= 0 {
+		reconnectInterval = defaultReconnectInterval
+	}
+
+	c := &Client{
+		address:           cfg.Address,
+		reconnectInterval: reconnectInterval,
+		client: redis.NewClient(&redis.Options{
+			Addr:         cfg.Address,
+			Password:     cfg.Password,
+			DB:           cfg.Database,
+			DialTimeout:  connectTimeout,
+			ReadTimeout:  commandTimeout,
+			WriteTimeout: commandTimeout,
+			// failed commands are not retried, the answer is resolved without Redis
+			MaxRetries: -1,
+		}),
+		writes: make(chan write, writeQueueSize),
+		stop:   make(chan struct{}),
+	}
+
+	go c.checkConnection()
+
+	for i := 0; i < writeWorkers; i++ {
+		go c.processWrites()
+	}
+
+	return c
+}
+
+// Address returns the address of the Redis server
+func (c *Client) Address() string {
+	return c.address
+}
+
+// IsConnected returns true if the Redis server is reachable
+func (c *Client) IsConnected() bool {
+	return atomic.LoadInt32(&c.connected) == 1
+}
+
+// pings the server on start and periodically until the client is closed
+func (c *Client) checkConnection() {
+	ticker := time.NewTicker(c.reconnectInterval)
+	defer ticker.Stop()
+
+	failed := false
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		err := c.client.Ping(ctx).Err()
+
+		cancel()
+
+		switch {
+		case err != nil:
+			// log only the first failure
+			if !failed {
+				logger().Warnf("can't connect to %s, using local cache only: %v", c.address, err)
+			}
+
+			failed = true
+
+			atomic.StoreInt32(&c.connected, 0)
+		case !c.IsConnected():
+			logger().Infof("connected to %s", c.address)
+
+			failed = false
+
+			atomic.StoreInt32(&c.connected, 1)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// returns context with command timeout, errNotConnected if the server is not reachable
+func (c *Client) commandContext() (context.Context, context.CancelFunc, error) {
+	if !c.IsConnected() {
+		return nil, nil, errNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+
+	return ctx, cancel, nil
+}
+
+// marks the client as disconnected on network errors, error replies of the server don't affect the connection
+func (c *Client) checkError(err error) error {
+	var redisErr redis.Error
+
+	if err != nil && err != redis.Nil && !errors.As(err, &redisErr) &&
+		atomic.CompareAndSwapInt32(&c.connected, 1, 0) {
+		logger().Warnf("connection to %s lost, using local cache only: %v", c.address, err)
+	}
+
+	return err
+}
+
+// Get returns the value of the key, nil if the key doesn't exist
+func (c *Client) Get(key string) ([]byte, error) {
+	ctx, cancel, err := c.commandContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	value, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	return value, c.checkError(err)
+}
+
+// Set stores the value with expiration asynchronously, the write is dropped if Redis is not connected
+// or too many writes are pending
+func (c *Client) Set(key string, value []byte, ttl time.Duration) {
+	if ttl.Milliseconds() <= 0 {
+		return
+	}
+
+	select {
+	case c.writes <- write{key: key, value: value, ttl: ttl}:
+	default:
+		logger().Debug("too many pending writes, dropping write")
+	}
+}
+
+func (c *Client) processWrites() {
+	for {
+		select {
+		case w := <-c.writes:
+			ctx, cancel, err := c.commandContext()
+			if err != nil {
+				continue
+			}
+
+			if err := c.checkError(c.client.Set(ctx, w.key, w.value, w.ttl).Err()); err != nil {
+				logger().Debugf("can't write key '%s': %v", w.key, err)
+			}
+
+			cancel()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Keys returns all keys matching the glob-style pattern (iterates with SCAN)
+func (c *Client) Keys(pattern string) ([]string, error) {
+	if !c.IsConnected() {
+		return nil, errNotConnected
+	}
+
+	var result []string
+
+	iter := c.client.Scan(context.Background(), 0, pattern, scanCount).Iterator()
+	for iter.Next(context.Background()) {
+		result = append(result, iter.Val())
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, c.checkError(err)
+	}
+
+	return result, nil
+}
+
+// Del removes the keys and returns the number of removed keys
+func (c *Client) Del(keys ...string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel, err := c.commandContext()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	count, err := c.client.Del(ctx, keys...).Result()
+
+	return int(count), c.checkError(err)
+}
+
+// Publish sends the message to all subscribers of the channel
+func (c *Client) Publish(channel, message string) error {
+	ctx, cancel, err := c.commandContext()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	return c.checkError(c.client.Publish(ctx, channel, message).Err())
+}
+
+// Subscribe calls the handler for each message of the channel until the client is closed.
+// The subscription is re-established after connection loss
+func (c *Client) Subscribe(channel string, handler func(message string)) {
+	pubSub := c.client.Subscribe(context.Background(), channel)
+
+	c.lock.Lock()
+	c.pubSubs = append(c.pubSubs, pubSub)
+	c.lock.Unlock()
+
+	go func() {
+		// channel is closed on Close
+		for msg := range pubSub.Channel() {
+			handler(msg.Payload)
+		}
+	}()
+}
+
+// Close closes all connections and stops background tasks
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+
+		c.lock.Lock()
+		for _, pubSub := range c.pubSubs {
+			_ = pubSub.Close()
+		}
+		c.lock.Unlock()
+
+		atomic.StoreInt32(&c.connected, 0)
+
+		if err := c.client.Close(); err != nil {
+			logger().Debug("can't close connection: ", err)
+		}
+	})
+}
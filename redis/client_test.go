@@ -0,0 +1,190 @@
+package redis
+
+import (
+	"blocky/config"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient(t *testing.T, address string) *Client {
+	c := NewClient(config.RedisConfig{
+		Address:           address,
+		ReconnectInterval: config.Duration(50 * time.Millisecond),
+	})
+
+	waitFor(t, c.IsConnected)
+
+	return c
+}
+
+// waits max. 2 seconds for the condition
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("condition not met")
+}
+
+func Test_SetGetDel(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	sut := newTestClient(t, server.Addr())
+	defer sut.Close()
+
+	value, err := sut.Get("key1")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+
+	// asynchronous write
+	sut.Set("key1", []byte("value1"), time.Minute)
+	waitFor(t, func() bool { return len(server.Keys()) == 1 })
+
+	value, err = sut.Get("key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "value1", string(value))
+
+	assert.NoError(t, server.Set("key2", "value2"))
+
+	keys, err := sut.Keys("key*")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"key1", "key2"}, keys)
+
+	count, err := sut.Del("key1", "unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, []string{"key2"}, server.Keys())
+}
+
+func Test_Set_Expiration(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	sut := newTestClient(t, server.Addr())
+	defer sut.Close()
+
+	sut.Set("key1", []byte("value1"), 50*time.Millisecond)
+	waitFor(t, func() bool { return len(server.Keys()) == 1 })
+
+	assert.Equal(t, 50*time.Millisecond, server.TTL("key1"))
+
+	server.FastForward(60 * time.Millisecond)
+
+	value, err := sut.Get("key1")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func Test_PublishSubscribe(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	sut := newTestClient(t, server.Addr())
+	defer sut.Close()
+
+	var (
+		lock     sync.Mutex
+		received []string
+	)
+
+	sut.Subscribe("channel1", func(message string) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		received = append(received, message)
+	})
+
+	// the subscription is established asynchronously
+	waitFor(t, func() bool {
+		assert.NoError(t, sut.Publish("channel1", "ping"))
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		return len(received) > 0
+	})
+
+	assert.NoError(t, sut.Publish("channel2", "other"))
+	assert.NoError(t, sut.Publish("channel1", "msg"))
+
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return received[len(received)-1] == "msg"
+	})
+}
+
+func Test_ConcurrentCommands(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	sut := newTestClient(t, server.Addr())
+	defer sut.Close()
+
+	var wg sync.WaitGroup
+
+	// commands use connections of the pool
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := sut.Get("key1")
+			assert.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func Test_NotConnected(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	sut := newTestClient(t, server.Addr())
+	defer sut.Close()
+
+	server.Close()
+
+	// first command detects the connection loss
+	_, err := sut.Get("key1")
+	assert.Error(t, err)
+	assert.False(t, sut.IsConnected())
+
+	_, err = sut.Get("key1")
+	assert.Equal(t, errNotConnected, err)
+
+	// writes are dropped
+	sut.Set("key1", []byte("value1"), time.Minute)
+
+	// reconnects periodically
+	assert.NoError(t, server.Restart())
+
+	waitFor(t, sut.IsConnected)
+
+	sut.Set("key1", []byte("value1"), time.Minute)
+	waitFor(t, func() bool { return len(server.Keys()) == 1 })
+}
+
+func Test_Unreachable(t *testing.T) {
+	server := miniredis.RunT(t)
+	address := server.Addr()
+	server.Close()
+
+	sut := NewClient(config.RedisConfig{Address: address})
+	defer sut.Close()
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.False(t, sut.IsConnected())
+
+	value, err := sut.Get("key1")
+	assert.Equal(t, errNotConnected, err)
+	assert.Nil(t, value)
+}
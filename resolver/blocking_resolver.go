@@ -1,21 +1,32 @@
 package resolver
 
 import (
+	"blocky/api"
 	"blocky/config"
 	"blocky/lists"
+	"blocky/metrics"
 	"blocky/util"
 	"fmt"
+	"math"
 	"net"
+	"path"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	BlockTTL = 6 * 60 * 60
+	defaultBlockTTL = 6 * time.Hour
+	// max number of CNAME records in a response chain, which are checked
+	maxCNAMEDepth = 10
+	// group name of blocked queries for clients with whitelist only groups
+	whitelistOnlyGroup = "WHITELIST ONLY"
 )
 
 type BlockType uint8
@@ -23,10 +34,11 @@ type BlockType uint8
 const (
 	ZeroIP BlockType = iota
 	NxDomain
+	CustomIP
 )
 
 func (b BlockType) String() string {
-	return [...]string{"ZeroIP", "NxDomain"}[b]
+	return [...]string{"ZeroIP", "NxDomain", "CustomIP"}[b]
 }
 
 // nolint:gochecknoglobals
@@ -35,19 +47,45 @@ var typeToZeroIP = map[uint16]net.IP{
 	dns.TypeAAAA: net.IPv6zero,
 }
 
-func resolveBlockType(cfg config.BlockingConfig) BlockType {
+// blockType can be "zeroIP", "nxDomain" or comma separated list of IP addresses
+func resolveBlockType(cfg config.BlockingConfig) (BlockType, []net.IP, error) {
 	cfgBlockType := strings.TrimSpace(strings.ToUpper(cfg.BlockType))
 	if cfgBlockType == "" || cfgBlockType == "ZEROIP" {
-		return ZeroIP
+		return ZeroIP, nil, nil
 	}
 
 	if cfgBlockType == "NXDOMAIN" {
-		return NxDomain
+		return NxDomain, nil, nil
 	}
 
-	logrus.Fatalf("unknown blockType, please use one of: ZeroIP, NxDomain")
+	var ips []net.IP
 
-	return ZeroIP
+	for _, part := range strings.Split(cfgBlockType, ",") {
+		ip := net.ParseIP(strings.TrimSpace(part))
+		if ip == nil {
+			return ZeroIP, nil, fmt.Errorf("unknown blockType '%s', please use one of: ZeroIP, NxDomain or comma "+
+				"separated list of IP addresses", cfg.BlockType)
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return CustomIP, ips, nil
+}
+
+// enabled state of blocking, can be shared between resolver instances (e.g. after configuration reload)
+type blockingStatus struct {
+	lock        sync.RWMutex
+	enabled     bool
+	disableEnd  time.Time
+	enableTimer *time.Timer
+}
+
+func (s *blockingStatus) isEnabled() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.enabled
 }
 
 // checks request's question (domain name) against black and white lists
@@ -56,23 +94,145 @@ type BlockingResolver struct {
 	blacklistMatcher    lists.Matcher
 	whitelistMatcher    lists.Matcher
 	clientGroupsBlock   map[string][]string
+	clientCIDRs         map[string]*net.IPNet
+	cnameGroups         map[string]struct{}
+	safeSearchGroups    map[string]struct{}
+	safeSearch          *safeSearch
+	status              *blockingStatus
 	blockType           BlockType
+	customIPs           []net.IP
+	blockTTL            uint32
 	whitelistOnlyGroups []string
+	schedule            *blockingSchedule
+	// 1 if the lists are loaded, queries are not blocked before
+	listsLoaded int32
+	// entries added at runtime are saved to this file, if configured
+	runtimeListsFile string
+	runtimeListsLock sync.Mutex
 }
 
-func NewBlockingResolver(cfg config.BlockingConfig) ChainedResolver {
-	bt := resolveBlockType(cfg)
-	blacklistMatcher := lists.NewListCache(cfg.BlackLists, cfg.RefreshPeriod)
-	whitelistMatcher := lists.NewListCache(cfg.WhiteLists, cfg.RefreshPeriod)
+// NewBlockingResolver creates resolver and loads the lists. With start strategy "fast", the lists are loaded in
+// background and queries are not blocked until they are loaded. With "failOnError", download errors are returned
+func NewBlockingResolver(cfg config.BlockingConfig) (ChainedResolver, error) {
+	bt, customIPs, err := resolveBlockType(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	blockTTL := time.Duration(cfg.BlockTTL)
+	if blockTTL <= 0 {
+		blockTTL = defaultBlockTTL
+	}
+
+	startStrategy := lists.StartStrategy(cfg.StartStrategy)
+
+	downloader, err := lists.NewDownloader(time.Duration(cfg.Download.Timeout), cfg.Download.MaxSizeMB*1024*1024,
+		cfg.Download.UserAgent, cfg.Download.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	blacklistMatcher, err := lists.NewListCache(cfg.BlackLists, time.Duration(cfg.RefreshPeriod), cfg.MatchSubdomains,
+		cfg.ProcessingConcurrency, startStrategy, downloader)
+	if err != nil {
+		return nil, fmt.Errorf("can't load blacklists: %v", err)
+	}
+
+	whitelistMatcher, err := lists.NewListCache(cfg.WhiteLists, time.Duration(cfg.RefreshPeriod), cfg.MatchSubdomains,
+		cfg.ProcessingConcurrency, startStrategy, downloader)
+	if err != nil {
+		blacklistMatcher.Stop()
+
+		return nil, fmt.Errorf("can't load whitelists: %v", err)
+	}
+
 	whitelistOnlyGroups := determineWhitelistOnlyGroups(&cfg)
 
-	return &BlockingResolver{
+	schedule, err := newBlockingSchedule(cfg)
+	if err != nil {
+		blacklistMatcher.Stop()
+		whitelistMatcher.Stop()
+
+		return nil, err
+	}
+
+	r := &BlockingResolver{
 		blockType:           bt,
+		customIPs:           customIPs,
+		blockTTL:            uint32(blockTTL.Seconds()),
 		clientGroupsBlock:   cfg.ClientGroupsBlock,
+		clientCIDRs:         parseClientCIDRs(cfg.ClientGroupsBlock),
+		cnameGroups:         toSet(cfg.CNAMEGroups),
+		safeSearchGroups:    toSet(cfg.SafeSearchGroups),
+		safeSearch:          newSafeSearch(cfg.SafeSearch),
+		status:              &blockingStatus{enabled: true},
 		blacklistMatcher:    blacklistMatcher,
 		whitelistMatcher:    whitelistMatcher,
 		whitelistOnlyGroups: whitelistOnlyGroups,
+		schedule:            schedule,
+		runtimeListsFile:    cfg.RuntimeListsFile,
+	}
+
+	if r.runtimeListsFile != "" {
+		if err := r.loadRuntimeLists(); err != nil {
+			r.Stop()
+
+			return nil, err
+		}
 	}
+
+	metrics.SetListStatsSource(r.listStats)
+
+	if startStrategy == lists.StartStrategyFast {
+		go r.waitForLists(blacklistMatcher, whitelistMatcher)
+	} else {
+		r.listsLoaded = 1
+	}
+
+	return r, nil
+}
+
+// activates blocking after black and white lists are loaded in background
+func (r *BlockingResolver) waitForLists(blacklist, whitelist *lists.ListCache) {
+	<-blacklist.Loaded()
+	<-whitelist.Loaded()
+
+	atomic.StoreInt32(&r.listsLoaded, 1)
+
+	logger("blacklist_resolver").Info("lists are loaded, blocking is active")
+}
+
+// returns entry counts of black and white lists for metrics
+func (r *BlockingResolver) listStats() []metrics.ListStats {
+	blacklistEntries, blacklistRefresh := r.blacklistMatcher.Stats()
+	whitelistEntries, whitelistRefresh := r.whitelistMatcher.Stats()
+
+	return []metrics.ListStats{
+		{Type: "blacklist", Entries: blacklistEntries, LastRefresh: blacklistRefresh},
+		{Type: "whitelist", Entries: whitelistEntries, LastRefresh: whitelistRefresh},
+	}
+}
+
+// ListStatus returns entry counts and last refresh of black and white lists
+func (r *BlockingResolver) ListStatus() []api.ListStatus {
+	stats := r.listStats()
+
+	result := make([]api.ListStatus, len(stats))
+	for i, s := range stats {
+		result[i] = api.ListStatus{Type: s.Type, Entries: s.Entries, LastRefresh: s.LastRefresh}
+	}
+
+	return result
+}
+
+// determines the matching list of the blocked domain (or answer IP) and counts the blocked query
+func (r *BlockingResolver) blockingInfo(domainOrIP string, group string) *BlockingInfo {
+	list, entry := r.blacklistMatcher.MatchingList(domainOrIP, group)
+	info := &BlockingInfo{Group: group, List: list, Entry: entry}
+
+	metrics.RecordBlocked(info.Group, info.List)
+
+	return info
 }
 
 // returns groups, which have only whitelist entries
@@ -93,13 +253,15 @@ func determineWhitelistOnlyGroups(cfg *config.BlockingConfig) (result []string)
 // sets answer and/or return code for DNS response, if request should be blocked
 func (r *BlockingResolver) handleBlocked(question dns.Question, response *dns.Msg) (*dns.Msg, error) {
 	switch r.blockType {
-	case ZeroIP:
-		rr, err := util.CreateAnswerFromQuestion(question, typeToZeroIP[question.Qtype], BlockTTL)
-		if err != nil {
-			return nil, err
-		}
+	case ZeroIP, CustomIP:
+		for _, ip := range r.blockIPs(question.Qtype) {
+			rr, err := util.CreateAnswerFromQuestion(question, ip, r.blockTTL)
+			if err != nil {
+				return nil, err
+			}
 
-		response.Answer = append(response.Answer, rr)
+			response.Answer = append(response.Answer, rr)
+		}
 
 	case NxDomain:
 		response.Rcode = dns.RcodeNameError
@@ -108,6 +270,27 @@ func (r *BlockingResolver) handleBlocked(question dns.Question, response *dns.Ms
 	return response, nil
 }
 
+// returns IP addresses for the answer of blocked query: custom IPs with matching family or zero IP
+// if no custom IP matches. Query types other than A and AAAA get an empty answer
+func (r *BlockingResolver) blockIPs(qType uint16) (result []net.IP) {
+	zeroIP, ok := typeToZeroIP[qType]
+	if !ok {
+		return nil
+	}
+
+	for _, ip := range r.customIPs {
+		if (ip.To4() != nil) == (qType == dns.TypeA) {
+			result = append(result, ip)
+		}
+	}
+
+	if len(result) == 0 {
+		result = []net.IP{zeroIP}
+	}
+
+	return result
+}
+
 func (r *BlockingResolver) Configuration() (result []string) {
 	if len(r.clientGroupsBlock) > 0 {
 		result = append(result, "clientGroupsBlock")
@@ -117,6 +300,34 @@ func (r *BlockingResolver) Configuration() (result []string) {
 
 		result = append(result, fmt.Sprintf("blockType = \"%s\"", r.blockType))
 
+		if r.blockType == CustomIP {
+			result = append(result, fmt.Sprintf("customIPs = \"%s\"", ipsToString(r.customIPs)))
+		}
+
+		result = append(result, fmt.Sprintf("blockTTL = %d", r.blockTTL))
+
+		if len(r.cnameGroups) > 0 {
+			groups := make([]string, 0, len(r.cnameGroups))
+			for g := range r.cnameGroups {
+				groups = append(groups, g)
+			}
+
+			sort.Strings(groups)
+			result = append(result, fmt.Sprintf("cnameGroups = \"%s\"", strings.Join(groups, ";")))
+		}
+
+		if len(r.safeSearchGroups) > 0 {
+			groups := make([]string, 0, len(r.safeSearchGroups))
+			for g := range r.safeSearchGroups {
+				groups = append(groups, g)
+			}
+
+			sort.Strings(groups)
+			result = append(result, fmt.Sprintf("safeSearchGroups = \"%s\"", strings.Join(groups, ";")))
+		}
+
+		result = append(result, r.schedule.configuration()...)
+
 		result = append(result, "blacklist:")
 		for _, c := range r.blacklistMatcher.Configuration() {
 			result = append(result, fmt.Sprintf("  %s", c))
@@ -136,25 +347,39 @@ func (r *BlockingResolver) Configuration() (result []string) {
 func (r *BlockingResolver) Resolve(request *Request) (*Response, error) {
 	logger := withPrefix(request.Log, "blacklist_resolver")
 	groupsToCheck := r.groupsToCheckForClient(request)
+	enabled := r.status.isEnabled() && atomic.LoadInt32(&r.listsLoaded) == 1
 
-	if len(groupsToCheck) > 0 {
-		logger.WithField("groupsToCheck", strings.Join(groupsToCheck, "; ")).Debug("checking groups for request")
+	// answer IPs of whitelisted domains are not checked
+	var whitelisted bool
+
+	if enabled && len(groupsToCheck) > 0 {
+		if logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			logger.WithField("groupsToCheck", strings.Join(groupsToCheck, "; ")).Debug("checking groups for request")
+		}
 
 		for _, question := range request.Req.Question {
 			domain := util.ExtractDomain(question)
-			logger := logger.WithField("domain", domain)
+			logger := logger
+
+			if logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+				logger = logger.WithField("domain", domain)
+			}
 			whitelistOnlyAlowed := reflect.DeepEqual(groupsToCheck, r.whitelistOnlyGroups)
 
-			if whitelisted, group := r.matches(groupsToCheck, r.whitelistMatcher, domain); whitelisted {
+			if found, group := r.matches(groupsToCheck, r.whitelistMatcher, domain); found {
 				logger.WithField("group", group).Debugf("domain is whitelisted")
+
+				whitelisted = true
 			} else {
 				if whitelistOnlyAlowed {
 					logger.WithField("client_groups", groupsToCheck).Debug("white list only for client group(s), blocking...")
+					metrics.RecordBlocked(whitelistOnlyGroup, "")
 					response := new(dns.Msg)
 					response.SetReply(request.Req)
 					resp, err := r.handleBlocked(question, response)
 
-					return &Response{Res: resp, rType: BLOCKED, Reason: fmt.Sprintf("BLOCKED (WHITELIST ONLY)")}, err
+					return &Response{Res: resp, rType: BLOCKED, Reason: fmt.Sprintf("BLOCKED (%s)", whitelistOnlyGroup),
+						Blocking: &BlockingInfo{Group: whitelistOnlyGroup}}, err
 				}
 				if blocked, group := r.matches(groupsToCheck, r.blacklistMatcher, domain); blocked {
 					logger.WithField("group", group).Debug("domain is blocked")
@@ -163,44 +388,371 @@ func (r *BlockingResolver) Resolve(request *Request) (*Response, error) {
 					response.SetReply(request.Req)
 					resp, err := r.handleBlocked(question, response)
 
-					return &Response{Res: resp, rType: BLOCKED, Reason: fmt.Sprintf("BLOCKED (%s)", group)}, err
+					return &Response{Res: resp, rType: BLOCKED, Reason: fmt.Sprintf("BLOCKED (%s)", group),
+						Blocking: r.blockingInfo(domain, group)}, err
 				}
 			}
+
+			if host := r.safeSearchHost(groupsToCheck, question); host != "" {
+				return r.resolveSafeSearch(logger, request, question, host)
+			}
 		}
 	}
 
-	logger.WithField("next_resolver", r.next).Trace("go to next resolver")
+	withDebugField(logger, "next_resolver", r.next).Trace("go to next resolver")
 
-	return r.next.Resolve(request)
+	response, err := r.next.Resolve(request)
+
+	if enabled && err == nil && response != nil && response.Res != nil {
+		if cnameGroups := r.cnameGroupsToCheck(groupsToCheck); len(cnameGroups) > 0 {
+			response, err = r.checkCNAMEs(logger, request, response, cnameGroups)
+			if err != nil || response.rType == BLOCKED {
+				return response, err
+			}
+		}
+
+		if !whitelisted && len(groupsToCheck) > 0 {
+			return r.checkAnswerIPs(logger, request, response, groupsToCheck)
+		}
+	}
+
+	return response, err
 }
 
-// returns groups which should be checked for client's request
-func (r *BlockingResolver) groupsToCheckForClient(request *Request) (groups []string) {
-	// try client names
-	for _, cName := range request.ClientNames {
-		groupsByName, found := r.clientGroupsBlock[cName]
-		if found {
-			groups = append(groups, groupsByName...)
+// ExplainBlocking checks the domain against black and white lists of the client's groups (client is an IP address or
+// a client name) without resolving the domain. CNAME targets and answer IPs are not checked
+func (r *BlockingResolver) ExplainBlocking(domain string, client string) api.BlockingExplanation {
+	request := &Request{}
+	if ip := net.ParseIP(client); ip != nil {
+		request.ClientIP = ip
+	} else if client != "" {
+		request.ClientNames = []string{client}
+	}
+
+	domain = strings.ToLower(domain)
+	groupsToCheck := r.groupsToCheckForClient(request)
+
+	result := api.BlockingExplanation{
+		Domain:          domain,
+		Client:          client,
+		Groups:          groupsToCheck,
+		BlockingEnabled: r.status.isEnabled() && atomic.LoadInt32(&r.listsLoaded) == 1,
+	}
+
+	if found, group := r.matches(groupsToCheck, r.whitelistMatcher, domain); found {
+		result.Whitelist = listMatch(r.whitelistMatcher, domain, group)
+	}
+
+	if found, group := r.matches(groupsToCheck, r.blacklistMatcher, domain); found {
+		result.Blacklist = listMatch(r.blacklistMatcher, domain, group)
+	}
+
+	switch {
+	case result.Whitelist != nil:
+		result.Reason = fmt.Sprintf("WHITELISTED (%s)", result.Whitelist.Group)
+	case len(groupsToCheck) > 0 && reflect.DeepEqual(groupsToCheck, r.whitelistOnlyGroups):
+		result.Blocked = true
+		result.Reason = fmt.Sprintf("BLOCKED (%s)", whitelistOnlyGroup)
+	case result.Blacklist != nil:
+		result.Blocked = true
+		result.Reason = fmt.Sprintf("BLOCKED (%s)", result.Blacklist.Group)
+	default:
+		result.Reason = "NOT LISTED"
+	}
+
+	if result.Blocked && !result.BlockingEnabled {
+		result.Blocked = false
+		result.Reason = "BLOCKING DISABLED"
+	}
+
+	return result
+}
+
+func listMatch(m lists.Matcher, domain string, group string) *api.ListMatch {
+	list, entry := m.MatchingList(domain, group)
+
+	return &api.ListMatch{Group: group, List: list, Entry: entry}
+}
+
+// blocks the whole response if an A or AAAA record of the answer contains a blacklisted IP address
+func (r *BlockingResolver) checkAnswerIPs(logger *logrus.Entry, request *Request, response *Response,
+	groupsToCheck []string) (*Response, error) {
+	if len(request.Req.Question) == 0 {
+		return response, nil
+	}
+
+	for _, rr := range response.Res.Answer {
+		var ip net.IP
+
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
 		}
+
+		if found, _ := r.whitelistMatcher.MatchIP(ip, groupsToCheck); found {
+			continue
+		}
+
+		if blocked, group := r.blacklistMatcher.MatchIP(ip, groupsToCheck); blocked {
+			question := request.Req.Question[0]
+
+			logger.WithFields(logrus.Fields{
+				"domain": util.ExtractDomain(question),
+				"ip":     ip,
+				"group":  group,
+			}).Debug("answer IP is blocked")
+
+			info := r.blockingInfo(ip.String(), group)
+			info.IP = ip.String()
+
+			blockedResponse := new(dns.Msg)
+			blockedResponse.SetReply(request.Req)
+			resp, err := r.handleBlocked(question, blockedResponse)
+
+			return &Response{Res: resp, rType: BLOCKED, Reason: fmt.Sprintf("BLOCKED IP (%s)", group),
+				Blocking: info}, err
+		}
+	}
+
+	return response, nil
+}
+
+// EnableBlocking enables blocking, stops the timer of a temporary disabling
+func (r *BlockingResolver) EnableBlocking() {
+	s := r.status
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.enable()
+}
+
+// must be called with acquired lock
+func (s *blockingStatus) enable() {
+	if s.enableTimer != nil {
+		s.enableTimer.Stop()
+		s.enableTimer = nil
+	}
+
+	s.enabled = true
+	s.disableEnd = time.Time{}
+}
+
+// DisableBlocking disables blocking, it will be enabled automatically after passed duration (0 means infinite)
+func (r *BlockingResolver) DisableBlocking(duration time.Duration) {
+	s := r.status
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.enable()
+	s.enabled = false
+
+	if duration > 0 {
+		s.disableEnd = time.Now().Add(duration)
+
+		var timer *time.Timer
+		timer = time.AfterFunc(duration, func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+
+			// ignore outdated timer
+			if s.enableTimer == timer {
+				s.enable()
+				logger("blacklist_resolver").Info("blocking enabled again")
+			}
+		})
+		s.enableTimer = timer
+	}
+}
+
+// BlockingStatus returns the current blocking state
+func (r *BlockingResolver) BlockingStatus() api.BlockingStatus {
+	s := r.status
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var autoEnableInSec uint
+
+	if !s.enabled && !s.disableEnd.IsZero() {
+		autoEnableInSec = uint(math.Ceil(time.Until(s.disableEnd).Seconds()))
+	}
+
+	return api.BlockingStatus{
+		Enabled:         s.enabled,
+		AutoEnableInSec: autoEnableInSec,
+		ScheduledGroups: r.schedule.status(time.Now()),
 	}
+}
 
-	// try IP
-	groupsByIP, found := r.clientGroupsBlock[request.ClientIP.String()]
+// ShareStatus uses the blocking state of the passed resolver (e.g. to keep it after configuration reload). Runtime
+// list entries are copied, if no runtime lists file is configured
+func (r *BlockingResolver) ShareStatus(other *BlockingResolver) {
+	r.status = other.status
 
-	if found {
-		groups = append(groups, groupsByIP...)
+	if r.runtimeListsFile == "" {
+		r.copyRuntimeEntries(other)
 	}
+}
 
-	if len(groups) == 0 {
-		if !found {
-			// return default
-			groups = r.clientGroupsBlock["default"]
+// returns groups of the client, for which CNAME targets should be checked
+func (r *BlockingResolver) cnameGroupsToCheck(groupsToCheck []string) (result []string) {
+	for _, g := range groupsToCheck {
+		if _, ok := r.cnameGroups[g]; ok {
+			result = append(result, g)
 		}
 	}
 
+	return
+}
+
+// returns the safe search host for A/AAAA query, if safe search is enforced for a group of the client
+func (r *BlockingResolver) safeSearchHost(groupsToCheck []string, question dns.Question) string {
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return ""
+	}
+
+	for _, g := range groupsToCheck {
+		if _, ok := r.safeSearchGroups[g]; ok {
+			return r.safeSearch.safeHost(util.ExtractDomain(question))
+		}
+	}
+
+	return ""
+}
+
+// follows CNAME chain of the response and blocks the whole response if a CNAME target is blacklisted
+func (r *BlockingResolver) checkCNAMEs(logger *logrus.Entry, request *Request, response *Response,
+	groupsToCheck []string) (*Response, error) {
+	targets := make(map[string]string)
+
+	for _, rr := range response.Res.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets[strings.ToLower(cname.Hdr.Name)] = strings.ToLower(cname.Target)
+		}
+	}
+
+	if len(targets) == 0 {
+		return response, nil
+	}
+
+	for _, question := range request.Req.Question {
+		name := strings.ToLower(question.Name)
+
+		for depth := 0; depth < maxCNAMEDepth; depth++ {
+			target, ok := targets[name]
+			if !ok {
+				break
+			}
+
+			domain := strings.TrimSuffix(target, ".")
+
+			if whitelisted, _ := r.matches(groupsToCheck, r.whitelistMatcher, domain); !whitelisted {
+				if blocked, group := r.matches(groupsToCheck, r.blacklistMatcher, domain); blocked {
+					logger.WithFields(logrus.Fields{
+						"domain": util.ExtractDomain(question),
+						"cname":  domain,
+						"group":  group,
+					}).Debug("CNAME target is blocked")
+
+					info := r.blockingInfo(domain, group)
+					info.CNAME = domain
+
+					blockedResponse := new(dns.Msg)
+					blockedResponse.SetReply(request.Req)
+					resp, err := r.handleBlocked(question, blockedResponse)
+
+					return &Response{Res: resp, rType: BLOCKED, Reason: fmt.Sprintf("BLOCKED CNAME (%s)", group),
+						Blocking: info}, err
+				}
+			}
+
+			name = target
+		}
+	}
+
+	return response, nil
+}
+
+// returns groups which should be checked for client's request. Client can be defined by name (wildcards like "tablet-*"
+// are possible), IP address or CIDR notation (e.g. "192.168.178.0/24"), "default" is used if no definition matches
+func (r *BlockingResolver) groupsToCheckForClient(request *Request) []string {
+	var found bool
+
+	groupSet := make(map[string]struct{})
+
+	for key, groups := range r.clientGroupsBlock {
+		if clientMatches(key, r.clientCIDRs, request) {
+			found = true
+
+			for _, g := range groups {
+				groupSet[g] = struct{}{}
+			}
+		}
+	}
+
+	if !found {
+		// return default
+		for _, g := range r.clientGroupsBlock["default"] {
+			groupSet[g] = struct{}{}
+		}
+	}
+
+	groups := make([]string, 0, len(groupSet))
+	for g := range groupSet {
+		groups = append(groups, g)
+	}
+
 	sort.Strings(groups)
 
-	return
+	// groups with schedule are only checked in their time windows
+	return r.schedule.activeGroups(groups, time.Now())
+}
+
+// checks if the client definition (name, name with wildcards, IP or CIDR) matches the request's client
+func clientMatches(key string, clientCIDRs map[string]*net.IPNet, request *Request) bool {
+	if cidr, ok := clientCIDRs[key]; ok {
+		return request.ClientIP != nil && cidr.Contains(request.ClientIP)
+	}
+
+	if request.ClientIP != nil && key == request.ClientIP.String() {
+		return true
+	}
+
+	for _, cName := range request.ClientNames {
+		if key == cName {
+			return true
+		}
+
+		if strings.ContainsAny(key, "*?[") {
+			if matched, _ := path.Match(key, cName); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parses client definitions in CIDR notation
+func parseClientCIDRs(clientGroupsBlock map[string][]string) map[string]*net.IPNet {
+	result := make(map[string]*net.IPNet)
+
+	for key := range clientGroupsBlock {
+		if strings.Contains(key, "/") {
+			_, cidr, err := net.ParseCIDR(key)
+			if err != nil {
+				logger("blacklist_resolver").Warnf("invalid client CIDR '%s': %v", key, err)
+				continue
+			}
+
+			result[key] = cidr
+		}
+	}
+
+	return result
 }
 
 func (r *BlockingResolver) matches(groupsToCheck []string, m lists.Matcher,
@@ -215,6 +767,39 @@ func (r *BlockingResolver) matches(groupsToCheck []string, m lists.Matcher,
 	return false, ""
 }
 
-func (r BlockingResolver) String() string {
+// RefreshLists triggers asynchronous reload of black and white lists
+func (r *BlockingResolver) RefreshLists() {
+	r.blacklistMatcher.Refresh()
+	r.whitelistMatcher.Refresh()
+}
+
+// Stop stops periodical refresh of black and white lists
+func (r *BlockingResolver) Stop() {
+	for _, m := range []lists.Matcher{r.blacklistMatcher, r.whitelistMatcher} {
+		if s, ok := m.(Stopper); ok {
+			s.Stop()
+		}
+	}
+}
+
+func toSet(values []string) map[string]struct{} {
+	result := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		result[v] = struct{}{}
+	}
+
+	return result
+}
+
+func ipsToString(ips []net.IP) string {
+	result := make([]string, len(ips))
+	for i, ip := range ips {
+		result[i] = ip.String()
+	}
+
+	return strings.Join(result, ", ")
+}
+
+func (r *BlockingResolver) String() string {
 	return fmt.Sprintf("blacklist resolver")
 }
@@ -1,11 +1,22 @@
 package resolver
 
 import (
+	"blocky/api"
 	"blocky/config"
 	"blocky/helpertest"
 	"blocky/util"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -13,11 +24,18 @@ import (
 	"github.com/stretchr/testify/mock"
 )
 
+func newTestBlockingResolver(t *testing.T, cfg config.BlockingConfig) *BlockingResolver {
+	r, err := NewBlockingResolver(cfg)
+	assert.NoError(t, err)
+
+	return r.(*BlockingResolver)
+}
+
 func Test_Resolve_ClientName_IpZero(t *testing.T) {
 	file := helpertest.TempFile("blocked1.com")
 	defer file.Close()
 
-	sut := NewBlockingResolver(config.BlockingConfig{
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
 		BlackLists: map[string][]string{"gr1": {file.Name()}},
 		ClientGroupsBlock: map[string][]string{
 			"client1": {"gr1"},
@@ -36,6 +54,7 @@ func Test_Resolve_ClientName_IpZero(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
 	assert.Equal(t, "blocked1.com.	21600	IN	A	0.0.0.0", resp.Res.Answer[0].String())
+	assert.Equal(t, &BlockingInfo{Group: "gr1", List: file.Name(), Entry: "blocked1.com"}, resp.Blocking)
 
 	// AAAA
 	req = util.NewMsgWithQuestion("blocked1.com.", dns.TypeAAAA)
@@ -54,7 +73,7 @@ func Test_Resolve_ClientIp_A_IpZero(t *testing.T) {
 	file := helpertest.TempFile("blocked1.com")
 	defer file.Close()
 
-	sut := NewBlockingResolver(config.BlockingConfig{
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
 		BlackLists: map[string][]string{"gr1": {file.Name()}},
 		ClientGroupsBlock: map[string][]string{
 			"192.168.178.55": {"gr1"},
@@ -81,7 +100,7 @@ func Test_Resolve_ClientWith2Names_A_IpZero(t *testing.T) {
 	file2 := helpertest.TempFile("blocked2.com")
 	defer file2.Close()
 
-	sut := NewBlockingResolver(config.BlockingConfig{
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
 		BlackLists: map[string][]string{
 			"gr1": {file1.Name()},
 			"gr2": {file2.Name()},
@@ -117,11 +136,59 @@ func Test_Resolve_ClientWith2Names_A_IpZero(t *testing.T) {
 	assert.Equal(t, "blocked2.com.	21600	IN	A	0.0.0.0", resp.Res.Answer[0].String())
 }
 
+func Test_Resolve_ClientCIDR_And_Wildcard(t *testing.T) {
+	file1 := helpertest.TempFile("blocked1.com")
+	defer file1.Close()
+
+	file2 := helpertest.TempFile("blocked2.com")
+	defer file2.Close()
+
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
+		BlackLists: map[string][]string{
+			"gr1": {file1.Name()},
+			"gr2": {file2.Name()},
+		},
+		ClientGroupsBlock: map[string][]string{
+			"192.168.178.0/24": {"gr1"},
+			"tablet-*":         {"gr2"},
+			"10.0.0.0/invalid": {"gr2"},
+		},
+	})
+
+	tests := []struct {
+		clientNames []string
+		clientIP    string
+		groups      []string
+	}{
+		{[]string{"unknown"}, "192.168.178.55", []string{"gr1"}},
+		{[]string{"tablet-kid1"}, "192.168.178.55", []string{"gr1", "gr2"}},
+		{[]string{"tablet-kid1"}, "192.168.179.1", []string{"gr2"}},
+		{[]string{"mytablet-1"}, "10.0.0.1", []string{}},
+	}
+
+	for _, tt := range tests {
+		groups := sut.groupsToCheckForClient(&Request{
+			ClientNames: tt.clientNames,
+			ClientIP:    net.ParseIP(tt.clientIP),
+		})
+		assert.Equal(t, tt.groups, groups)
+	}
+
+	resp, err := sut.Resolve(&Request{
+		Req:         util.NewMsgWithQuestion("blocked2.com.", dns.TypeA),
+		ClientNames: []string{"tablet-kid1"},
+		ClientIP:    net.ParseIP("192.168.179.1"),
+		Log:         logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "blocked2.com.	21600	IN	A	0.0.0.0", resp.Res.Answer[0].String())
+}
+
 func Test_Resolve_Default_A_IpZero(t *testing.T) {
 	file := helpertest.TempFile("blocked1.com")
 	defer file.Close()
 
-	sut := NewBlockingResolver(config.BlockingConfig{
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
 		BlackLists: map[string][]string{"gr1": {file.Name()}},
 		ClientGroupsBlock: map[string][]string{
 			"default": {"gr1"},
@@ -144,7 +211,7 @@ func Test_Resolve_Default_Block_With_Whitelist(t *testing.T) {
 	file := helpertest.TempFile("blocked1.com")
 	defer file.Close()
 
-	sut := NewBlockingResolver(config.BlockingConfig{
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
 		BlackLists: map[string][]string{"gr1": {file.Name()}},
 		WhiteLists: map[string][]string{"gr1": {file.Name()}},
 		ClientGroupsBlock: map[string][]string{
@@ -171,7 +238,7 @@ func Test_Resolve_Whitelist_Only(t *testing.T) {
 	file := helpertest.TempFile("whitelisted.com")
 	defer file.Close()
 
-	sut := NewBlockingResolver(config.BlockingConfig{
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
 		WhiteLists: map[string][]string{"gr1": {file.Name()}},
 		ClientGroupsBlock: map[string][]string{
 			"default": {"gr1"},
@@ -229,7 +296,7 @@ func Test_Resolve_Default_A_NxRecord(t *testing.T) {
 	file := helpertest.TempFile("blocked1.com")
 	defer file.Close()
 
-	sut := NewBlockingResolver(config.BlockingConfig{
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
 		BlackLists: map[string][]string{"gr1": {file.Name()}},
 		ClientGroupsBlock: map[string][]string{
 			"default": {"gr1"},
@@ -248,11 +315,304 @@ func Test_Resolve_Default_A_NxRecord(t *testing.T) {
 	assert.Equal(t, dns.RcodeNameError, resp.Res.Rcode)
 }
 
+func Test_Resolve_Default_CustomIP(t *testing.T) {
+	file := helpertest.TempFile("blocked1.com")
+	defer file.Close()
+
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
+		BlackLists: map[string][]string{"gr1": {file.Name()}},
+		ClientGroupsBlock: map[string][]string{
+			"default": {"gr1"},
+		},
+		BlockType: "12.12.12.12, 13.13.13.13, 2001:db8::1",
+		BlockTTL:  config.Duration(time.Minute),
+	})
+
+	tests := []struct {
+		qType   uint16
+		answers []string
+	}{
+		{dns.TypeA, []string{"blocked1.com.	60	IN	A	12.12.12.12", "blocked1.com.	60	IN	A	13.13.13.13"}},
+		{dns.TypeAAAA, []string{"blocked1.com.	60	IN	AAAA	2001:db8::1"}},
+		{dns.TypeMX, []string{}},
+	}
+
+	for _, tt := range tests {
+		resp, err := sut.Resolve(&Request{
+			Req:         util.NewMsgWithQuestion("blocked1.com.", tt.qType),
+			ClientNames: []string{"unknown"},
+			ClientIP:    net.ParseIP("192.168.178.1"),
+			Log:         logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+
+		answers := make([]string, len(resp.Res.Answer))
+		for i, rr := range resp.Res.Answer {
+			answers[i] = rr.String()
+		}
+
+		assert.Equal(t, tt.answers, answers)
+	}
+}
+
+func Test_Resolve_CustomIP_FallbackToZeroIP(t *testing.T) {
+	file := helpertest.TempFile("blocked1.com")
+	defer file.Close()
+
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
+		BlackLists: map[string][]string{"gr1": {file.Name()}},
+		ClientGroupsBlock: map[string][]string{
+			"default": {"gr1"},
+		},
+		BlockType: "12.12.12.12",
+	})
+
+	resp, err := sut.Resolve(&Request{
+		Req:         util.NewMsgWithQuestion("blocked1.com.", dns.TypeAAAA),
+		ClientNames: []string{"unknown"},
+		ClientIP:    net.ParseIP("192.168.178.1"),
+		Log:         logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "blocked1.com.	21600	IN	AAAA	::", resp.Res.Answer[0].String())
+}
+
+func Test_Resolve_CNAMEBlocked(t *testing.T) {
+	file := helpertest.TempFile("tracker.net")
+	defer file.Close()
+
+	whitelist := helpertest.TempFile("allowed.tracker.net")
+	defer whitelist.Close()
+
+	resolve := func(cnameGroups []string, domain string, answer ...string) *Response {
+		sut := newTestBlockingResolver(t, config.BlockingConfig{
+			BlackLists: map[string][]string{"gr1": {file.Name()}},
+			WhiteLists: map[string][]string{"gr1": {whitelist.Name()}},
+			ClientGroupsBlock: map[string][]string{
+				"default": {"gr1"},
+			},
+			CNAMEGroups: cnameGroups,
+		})
+
+		upstreamResponse := new(dns.Msg)
+		for _, a := range answer {
+			upstreamResponse.Answer = append(upstreamResponse.Answer, mustRR(t, a))
+		}
+
+		m := &resolverMock{}
+		m.On("Resolve", mock.Anything).Return(&Response{Res: upstreamResponse}, nil)
+		sut.Next(m)
+
+		resp, err := sut.Resolve(&Request{
+			Req:         util.NewMsgWithQuestion(domain, dns.TypeA),
+			ClientNames: []string{"unknown"},
+			ClientIP:    net.ParseIP("192.168.178.1"),
+			Log:         logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	cloaked := []string{"metrics.example.com. 300 IN CNAME cdn.example.net.",
+		"cdn.example.net. 300 IN CNAME tracker.net.",
+		"tracker.net. 300 IN A 123.123.123.123"}
+
+	// CNAME check is not active for group
+	resp := resolve(nil, "metrics.example.com.", cloaked...)
+	assert.Len(t, resp.Res.Answer, 3)
+
+	resp = resolve([]string{"gr1"}, "metrics.example.com.", cloaked...)
+	assert.Equal(t, BLOCKED, resp.rType)
+	assert.Equal(t, "BLOCKED CNAME (gr1)", resp.Reason)
+	assert.Equal(t, []dns.RR{mustRR(t, "metrics.example.com. 21600 IN A 0.0.0.0")}, resp.Res.Answer)
+
+	// whitelisted CNAME target
+	resp = resolve([]string{"gr1"}, "ok.example.com.",
+		"ok.example.com. 300 IN CNAME allowed.tracker.net.",
+		"allowed.tracker.net. 300 IN A 123.123.123.124")
+	assert.Len(t, resp.Res.Answer, 2)
+}
+
+func Test_Resolve_AnswerIPBlocked(t *testing.T) {
+	blacklist := "# bad hosting\n10.20.30.0/24\n2001:db8::/32\n123.123.123.123"
+	whitelist := "10.20.30.40\nallowed.example.com"
+
+	resolve := func(domain string, answer ...string) *Response {
+		sut := newTestBlockingResolver(t, config.BlockingConfig{
+			BlackLists:        map[string][]string{"gr1": {blacklist}},
+			WhiteLists:        map[string][]string{"gr1": {whitelist}},
+			ClientGroupsBlock: map[string][]string{"default": {"gr1"}},
+		})
+
+		upstreamResponse := new(dns.Msg)
+		for _, a := range answer {
+			upstreamResponse.Answer = append(upstreamResponse.Answer, mustRR(t, a))
+		}
+
+		m := &resolverMock{}
+		m.On("Resolve", mock.Anything).Return(&Response{Res: upstreamResponse}, nil)
+		sut.Next(m)
+
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(domain, dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	resp := resolve("c2.example.com.", "c2.example.com. 300 IN A 10.20.30.1")
+	assert.Equal(t, BLOCKED, resp.rType)
+	assert.Equal(t, "BLOCKED IP (gr1)", resp.Reason)
+	assert.Equal(t, &BlockingInfo{Group: "gr1", List: "[inline: 4 lines]", Entry: "10.20.30.0/24",
+		IP: "10.20.30.1"}, resp.Blocking)
+	assert.Equal(t, []dns.RR{mustRR(t, "c2.example.com. 21600 IN A 0.0.0.0")}, resp.Res.Answer)
+
+	// any record of the answer, also IPv6 and single IPs
+	resp = resolve("c2.example.com.",
+		"c2.example.com. 300 IN A 1.2.3.4",
+		"c2.example.com. 300 IN AAAA 2001:db8::1")
+	assert.Equal(t, BLOCKED, resp.rType)
+
+	resp = resolve("c2.example.com.", "c2.example.com. 300 IN A 123.123.123.123")
+	assert.Equal(t, BLOCKED, resp.rType)
+
+	// not listed
+	resp = resolve("example.com.", "example.com. 300 IN A 10.20.31.1")
+	assert.Len(t, resp.Res.Answer, 1)
+	assert.Nil(t, resp.Blocking)
+
+	// whitelisted IP and whitelisted domain
+	resp = resolve("example.com.", "example.com. 300 IN A 10.20.30.40")
+	assert.Len(t, resp.Res.Answer, 1)
+
+	resp = resolve("allowed.example.com.", "allowed.example.com. 300 IN A 10.20.30.1")
+	assert.Len(t, resp.Res.Answer, 1)
+}
+
+func Test_Resolve_SafeSearch(t *testing.T) {
+	file := helpertest.TempFile("blocked1.com")
+	defer file.Close()
+
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
+		BlackLists: map[string][]string{"kids": {file.Name()}},
+		ClientGroupsBlock: map[string][]string{
+			"kid-tablet": {"kids"},
+		},
+		SafeSearchGroups: []string{"kids"},
+		SafeSearch:       map[string]string{"search.example.com": "safe.example.com", "www.bing.com": ""},
+	})
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.MatchedBy(func(req *Request) bool {
+		return req.Req.Question[0].Name == "forcesafesearch.google.com."
+	})).Return(&Response{Res: &dns.Msg{Answer: []dns.RR{mustRR(t, "forcesafesearch.google.com. 300 IN A 216.239.38.120")}},
+		Upstream: "udp:8.8.8.8"}, nil)
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	resolve := func(domain string, qType uint16, clientName string) *Response {
+		resp, err := sut.Resolve(&Request{
+			Req:         util.NewMsgWithQuestion(domain, qType),
+			ClientNames: []string{clientName},
+			ClientIP:    net.ParseIP("192.168.178.1"),
+			Log:         logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	// built-in mapping with wildcard
+	resp := resolve("www.google.co.uk.", dns.TypeA, "kid-tablet")
+	assert.Equal(t, "SAFE SEARCH (forcesafesearch.google.com)", resp.Reason)
+	assert.Equal(t, "udp:8.8.8.8", resp.Upstream)
+	assert.Equal(t, []dns.RR{
+		mustRR(t, "www.google.co.uk. 300 IN CNAME forcesafesearch.google.com."),
+		mustRR(t, "forcesafesearch.google.com. 300 IN A 216.239.38.120"),
+	}, resp.Res.Answer)
+
+	// configured mapping
+	resp = resolve("search.example.com.", dns.TypeAAAA, "kid-tablet")
+	assert.Equal(t, "SAFE SEARCH (safe.example.com)", resp.Reason)
+
+	// removed built-in mapping, other query type, client without safe search group
+	assert.Equal(t, "RESOLVED", resolve("www.bing.com.", dns.TypeA, "kid-tablet").Reason)
+	assert.Equal(t, "RESOLVED", resolve("www.google.com.", dns.TypeMX, "kid-tablet").Reason)
+	assert.Equal(t, "RESOLVED", resolve("www.google.com.", dns.TypeA, "laptop").Reason)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	assert.NoError(t, err)
+
+	return rr
+}
+
+func Test_ExplainBlocking(t *testing.T) {
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
+		BlackLists: map[string][]string{
+			"ads":  {"*.ads.com\nblocked.com"},
+			"kids": {"games.com\nblocked.com"},
+		},
+		WhiteLists: map[string][]string{
+			"ads":       {"ok.ads.com\nexample.com"},
+			"whitelist": {"allowed.com\nexample.com"},
+		},
+		ClientGroupsBlock: map[string][]string{
+			"default":        {"ads"},
+			"192.168.1.0/24": {"ads", "kids"},
+			"laptop":         {"whitelist"},
+		},
+	})
+
+	result := sut.ExplainBlocking("www.ads.com", "")
+	assert.True(t, result.Blocked)
+	assert.True(t, result.BlockingEnabled)
+	assert.Equal(t, []string{"ads"}, result.Groups)
+	assert.Equal(t, "BLOCKED (ads)", result.Reason)
+	assert.Equal(t, &api.ListMatch{Group: "ads", List: "[inline: 2 lines]", Entry: "*.ads.com"}, result.Blacklist)
+	assert.Nil(t, result.Whitelist)
+
+	// whitelist overrides blacklist
+	result = sut.ExplainBlocking("OK.ads.com", "192.168.1.5")
+	assert.False(t, result.Blocked)
+	assert.Equal(t, "ok.ads.com", result.Domain)
+	assert.Equal(t, []string{"ads", "kids"}, result.Groups)
+	assert.Equal(t, "WHITELISTED (ads)", result.Reason)
+	assert.Equal(t, "*.ads.com", result.Blacklist.Entry)
+	assert.Equal(t, "ok.ads.com", result.Whitelist.Entry)
+
+	result = sut.ExplainBlocking("games.com", "192.168.1.5")
+	assert.True(t, result.Blocked)
+	assert.Equal(t, "kids", result.Blacklist.Group)
+
+	result = sut.ExplainBlocking("games.com", "")
+	assert.False(t, result.Blocked)
+	assert.Equal(t, "NOT LISTED", result.Reason)
+
+	// client name with whitelist only group
+	result = sut.ExplainBlocking("games.com", "laptop")
+	assert.True(t, result.Blocked)
+	assert.Equal(t, "BLOCKED (WHITELIST ONLY)", result.Reason)
+
+	sut.DisableBlocking(0)
+
+	result = sut.ExplainBlocking("blocked.com", "")
+	assert.False(t, result.Blocked)
+	assert.False(t, result.BlockingEnabled)
+	assert.Equal(t, "BLOCKING DISABLED", result.Reason)
+	assert.Equal(t, "blocked.com", result.Blacklist.Entry)
+}
+
 func Test_Resolve_NoBlock(t *testing.T) {
 	file := helpertest.TempFile("blocked1.com")
 	defer file.Close()
 
-	sut := NewBlockingResolver(config.BlockingConfig{
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
 		BlackLists: map[string][]string{"gr1": {file.Name()}},
 		ClientGroupsBlock: map[string][]string{
 			"client1": {"gr1"},
@@ -278,7 +638,7 @@ func Test_Configuration_BlockingResolver(t *testing.T) {
 	file := helpertest.TempFile("blocked1.com")
 	defer file.Close()
 
-	sut := NewBlockingResolver(config.BlockingConfig{
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
 		BlackLists: map[string][]string{"gr1": {file.Name()}},
 		WhiteLists: map[string][]string{"gr1": {file.Name()}},
 		ClientGroupsBlock: map[string][]string{
@@ -290,22 +650,68 @@ func Test_Configuration_BlockingResolver(t *testing.T) {
 	assert.True(t, len(c) > 1)
 }
 
-func Test_Resolve_WrongBlockType(t *testing.T) {
-	defer func() { logrus.StandardLogger().ExitFunc = nil }()
+func Test_Resolve_StartStrategyFast(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		_, _ = rw.Write([]byte("blocked1.com"))
+	}))
+	defer server.Close()
+
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
+		BlackLists:        map[string][]string{"gr1": {server.URL}},
+		ClientGroupsBlock: map[string][]string{"default": {"gr1"}},
+		StartStrategy:     "fast",
+	})
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	resolve := func() *Response {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("blocked1.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
 
-	var fatal bool
+		return resp
+	}
 
-	logrus.StandardLogger().ExitFunc = func(int) { fatal = true }
+	// not blocked until the lists are loaded
+	assert.Equal(t, "RESOLVED", resolve().Reason)
 
-	_ = NewBlockingResolver(config.BlockingConfig{
+	close(release)
+
+	for i := 0; i < 100 && resolve().rType != BLOCKED; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, "BLOCKED (gr1)", resolve().Reason)
+}
+
+func Test_NewBlockingResolver_FailOnError(t *testing.T) {
+	_, err := NewBlockingResolver(config.BlockingConfig{
+		BlackLists:    map[string][]string{"gr1": {"/does/not/exist.txt"}},
+		StartStrategy: "failOnError",
+	})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "can't load blacklists")
+}
+
+func Test_Resolve_WrongBlockType(t *testing.T) {
+	_, err := NewBlockingResolver(config.BlockingConfig{
 		BlockType: "wrong",
 	})
 
-	assert.True(t, fatal)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown blockType 'wrong'")
 }
 
 func Test_Resolve_NoLists(t *testing.T) {
-	sut := NewBlockingResolver(config.BlockingConfig{})
+	sut := newTestBlockingResolver(t, config.BlockingConfig{})
 	m := &resolverMock{}
 	m.On("Resolve", mock.Anything).Return(new(Response), nil)
 	sut.Next(m)
@@ -324,3 +730,192 @@ func Test_Resolve_NoLists(t *testing.T) {
 
 	assert.Equal(t, []string{"deactivated"}, c)
 }
+
+func Test_Resolve_BlockingDisabled(t *testing.T) {
+	file := helpertest.TempFile("blocked1.com")
+	defer file.Close()
+
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
+		BlackLists: map[string][]string{"gr1": {file.Name()}},
+		ClientGroupsBlock: map[string][]string{
+			"default": {"gr1"},
+		},
+	})
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	resolve := func() *Response {
+		resp, err := sut.Resolve(&Request{
+			Req:         util.NewMsgWithQuestion("blocked1.com.", dns.TypeA),
+			ClientNames: []string{"unknown"},
+			ClientIP:    net.ParseIP("192.168.178.1"),
+			Log:         logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	assert.Equal(t, api.BlockingStatus{Enabled: true}, sut.BlockingStatus())
+	assert.Equal(t, BLOCKED, resolve().rType)
+
+	// disable infinite
+	sut.DisableBlocking(0)
+	assert.Equal(t, api.BlockingStatus{Enabled: false}, sut.BlockingStatus())
+	assert.Equal(t, "RESOLVED", resolve().Reason)
+
+	sut.EnableBlocking()
+	assert.Equal(t, BLOCKED, resolve().rType)
+
+	// disable with automatic enabling
+	sut.DisableBlocking(100 * time.Millisecond)
+	assert.Equal(t, api.BlockingStatus{Enabled: false, AutoEnableInSec: 1}, sut.BlockingStatus())
+	assert.Equal(t, "RESOLVED", resolve().Reason)
+
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Equal(t, api.BlockingStatus{Enabled: true}, sut.BlockingStatus())
+	assert.Equal(t, BLOCKED, resolve().rType)
+
+	// status is shared with new instance
+	sut.DisableBlocking(0)
+
+	other := newTestBlockingResolver(t, config.BlockingConfig{})
+	other.ShareStatus(sut)
+	assert.False(t, other.BlockingStatus().Enabled)
+}
+
+func Test_Resolve_ConcurrentRefresh(t *testing.T) {
+	const entries = 20000
+
+	// both versions of the list contain the same common entries, a partially loaded list would miss some of them
+	listContent := func(version string) []byte {
+		var sb strings.Builder
+
+		for i := 0; i < entries; i++ {
+			fmt.Fprintf(&sb, "common%d.com\n", i)
+		}
+
+		sb.WriteString(version + ".com\n")
+
+		return []byte(sb.String())
+	}
+
+	file := helpertest.TempFile(string(listContent("a")))
+	defer os.Remove(file.Name())
+
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
+		BlackLists:        map[string][]string{"gr1": {file.Name()}},
+		ClientGroupsBlock: map[string][]string{"default": {"gr1"}},
+	})
+	defer sut.Stop()
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	domains := []string{"common0.com.", fmt.Sprintf("common%d.com.", entries/2), fmt.Sprintf("common%d.com.", entries-1)}
+
+	// resolves domains of the list in parallel, returns sorted durations of all queries
+	hammer := func(d time.Duration) (durations []time.Duration, failed int32) {
+		var wg sync.WaitGroup
+
+		var lock sync.Mutex
+
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				var local []time.Duration
+
+				for end := time.Now().Add(d); time.Now().Before(end); {
+					for _, domain := range domains {
+						start := time.Now()
+						resp, err := sut.Resolve(&Request{
+							Req:         util.NewMsgWithQuestion(domain, dns.TypeA),
+							ClientNames: []string{"unknown"},
+							ClientIP:    net.ParseIP("192.168.178.1"),
+							Log:         logrus.NewEntry(logrus.New()),
+						})
+						local = append(local, time.Since(start))
+
+						if err != nil || resp.rType != BLOCKED {
+							atomic.AddInt32(&failed, 1)
+						}
+					}
+				}
+
+				lock.Lock()
+				durations = append(durations, local...)
+				lock.Unlock()
+			}()
+		}
+
+		wg.Wait()
+
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+		return durations, failed
+	}
+
+	p99 := func(durations []time.Duration) time.Duration {
+		return durations[len(durations)*99/100]
+	}
+
+	baseline, failed := hammer(200 * time.Millisecond)
+	assert.Equal(t, int32(0), failed)
+
+	// refresh in a loop, the list file is replaced atomically with the other version on each iteration
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	var refreshes int
+
+	go func() {
+		defer close(done)
+
+		for version := 0; ; version++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			tmp := file.Name() + ".tmp"
+			assert.NoError(t, ioutil.WriteFile(tmp, listContent(string(rune('a'+version%2))), 0600))
+			assert.NoError(t, os.Rename(tmp, file.Name()))
+
+			_, before := sut.blacklistMatcher.Stats()
+
+			sut.RefreshLists()
+
+			for _, after := sut.blacklistMatcher.Stats(); !after.After(before); _, after = sut.blacklistMatcher.Stats() {
+				time.Sleep(time.Millisecond)
+			}
+
+			refreshes++
+		}
+	}()
+
+	durations, failed := hammer(time.Second)
+
+	close(stop)
+	<-done
+
+	assert.True(t, refreshes > 1, "refreshes: %d", refreshes)
+
+	// every query sees the complete old or the complete new list
+	assert.Equal(t, int32(0), failed)
+
+	// queries are not paused by the refresh
+	limit := 10 * p99(baseline)
+	if limit < 5*time.Millisecond {
+		limit = 5 * time.Millisecond
+	}
+
+	assert.True(t, p99(durations) < limit, "p99 with refresh %s, without refresh %s", p99(durations), p99(baseline))
+}
@@ -0,0 +1,152 @@
+package resolver
+
+import (
+	"blocky/lists"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	blacklistType = "blacklist"
+	whitelistType = "whitelist"
+)
+
+// content of the runtime lists file: entries per list type and group
+type persistedRuntimeLists map[string]map[string][]string
+
+// returns the matcher for "blacklist" or "whitelist"
+func (r *BlockingResolver) matcherForType(listType string) (lists.Matcher, error) {
+	switch listType {
+	case blacklistType:
+		return r.blacklistMatcher, nil
+	case whitelistType:
+		return r.whitelistMatcher, nil
+	default:
+		return nil, fmt.Errorf("unknown list type '%s'", listType)
+	}
+}
+
+// AddListEntry adds domain to the group of the black or white list. The entry is active immediately, kept on list
+// refresh and saved to the runtime lists file, if configured
+func (r *BlockingResolver) AddListEntry(listType string, group string, domain string) error {
+	m, err := r.matcherForType(listType)
+	if err != nil {
+		return err
+	}
+
+	if err := m.AddEntry(group, domain); err != nil {
+		return err
+	}
+
+	r.saveRuntimeLists()
+
+	return nil
+}
+
+// RemoveListEntry removes domain, which was added with AddListEntry. Returns false if the entry doesn't exist
+func (r *BlockingResolver) RemoveListEntry(listType string, group string, domain string) bool {
+	m, err := r.matcherForType(listType)
+	if err != nil || !m.RemoveEntry(group, domain) {
+		return false
+	}
+
+	r.saveRuntimeLists()
+
+	return true
+}
+
+// ListEntries returns entries per group of the black or white list, which were added at runtime
+func (r *BlockingResolver) ListEntries(listType string) map[string][]string {
+	m, err := r.matcherForType(listType)
+	if err != nil {
+		return map[string][]string{}
+	}
+
+	return m.RuntimeEntries()
+}
+
+// copies runtime entries of passed resolver, e.g. after configuration reload without runtime lists file
+func (r *BlockingResolver) copyRuntimeEntries(other *BlockingResolver) {
+	for _, listType := range []string{blacklistType, whitelistType} {
+		for group, entries := range other.ListEntries(listType) {
+			for _, entry := range entries {
+				_ = r.addRuntimeEntry(listType, group, entry)
+			}
+		}
+	}
+}
+
+func (r *BlockingResolver) addRuntimeEntry(listType string, group string, domain string) error {
+	m, err := r.matcherForType(listType)
+	if err != nil {
+		return err
+	}
+
+	return m.AddEntry(group, domain)
+}
+
+// writes runtime entries of black and white lists to the runtime lists file, errors are logged
+func (r *BlockingResolver) saveRuntimeLists() {
+	if r.runtimeListsFile == "" {
+		return
+	}
+
+	r.runtimeListsLock.Lock()
+	defer r.runtimeListsLock.Unlock()
+
+	persisted := persistedRuntimeLists{
+		blacklistType: r.ListEntries(blacklistType),
+		whitelistType: r.ListEntries(whitelistType),
+	}
+
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err == nil {
+		// write to temp file first, so the file is never incomplete
+		tmpFile := r.runtimeListsFile + ".tmp"
+		if err = ioutil.WriteFile(tmpFile, data, 0600); err == nil {
+			err = os.Rename(tmpFile, r.runtimeListsFile)
+		}
+	}
+
+	if err != nil {
+		logger("blacklist_resolver").WithField("file", r.runtimeListsFile).Error("can't save runtime list entries: ", err)
+	}
+}
+
+// loads runtime entries from the runtime lists file, a missing file is no error. Invalid entries are skipped
+func (r *BlockingResolver) loadRuntimeLists() error {
+	data, err := ioutil.ReadFile(r.runtimeListsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("can't read runtime lists file: %v", err)
+	}
+
+	var persisted persistedRuntimeLists
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return fmt.Errorf("can't parse runtime lists file '%s': %v", r.runtimeListsFile, err)
+	}
+
+	var count int
+
+	for listType, groups := range persisted {
+		for group, entries := range groups {
+			for _, entry := range entries {
+				if err := r.addRuntimeEntry(listType, group, entry); err != nil {
+					logger("blacklist_resolver").Warnf("skipping runtime list entry '%s': %v", entry, err)
+					continue
+				}
+
+				count++
+			}
+		}
+	}
+
+	logger("blacklist_resolver").WithField("file", r.runtimeListsFile).Infof("loaded %d runtime list entries", count)
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package resolver
+
+import (
+	"blocky/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RuntimeLists_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocky")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	cfg := config.BlockingConfig{
+		BlackLists:        map[string][]string{"gr1": {"blocked1.com\nblocked2.com"}},
+		ClientGroupsBlock: map[string][]string{"default": {"gr1"}},
+		RuntimeListsFile:  filepath.Join(dir, "runtime.json"),
+	}
+
+	sut := newTestBlockingResolver(t, cfg)
+
+	assert.NoError(t, sut.AddListEntry("blacklist", "gr1", "runtime.com"))
+	assert.NoError(t, sut.AddListEntry("whitelist", "gr1", "blocked2.com"))
+	assert.Error(t, sut.AddListEntry("blacklist", "gr1", "in valid"))
+	assert.Error(t, sut.AddListEntry("greylist", "gr1", "runtime.com"))
+
+	assert.True(t, sut.ExplainBlocking("runtime.com", "").Blocked)
+	assert.False(t, sut.ExplainBlocking("blocked2.com", "").Blocked)
+
+	// entries are loaded from file
+	sut = newTestBlockingResolver(t, cfg)
+	assert.Equal(t, map[string][]string{"gr1": {"runtime.com"}}, sut.ListEntries("blacklist"))
+	assert.Equal(t, map[string][]string{"gr1": {"blocked2.com"}}, sut.ListEntries("whitelist"))
+
+	assert.True(t, sut.RemoveListEntry("blacklist", "gr1", "runtime.com"))
+	assert.False(t, sut.RemoveListEntry("blacklist", "gr1", "runtime.com"))
+
+	sut = newTestBlockingResolver(t, cfg)
+	assert.Empty(t, sut.ListEntries("blacklist"))
+	assert.False(t, sut.ExplainBlocking("runtime.com", "").Blocked)
+}
+
+func Test_RuntimeLists_KeptOnReload(t *testing.T) {
+	cfg := config.BlockingConfig{
+		BlackLists:        map[string][]string{"gr1": {"blocked1.com\nblocked2.com"}},
+		ClientGroupsBlock: map[string][]string{"default": {"gr1"}},
+	}
+
+	old := newTestBlockingResolver(t, cfg)
+	assert.NoError(t, old.AddListEntry("blacklist", "gr1", "runtime.com"))
+
+	sut := newTestBlockingResolver(t, cfg)
+	sut.ShareStatus(old)
+
+	assert.Equal(t, map[string][]string{"gr1": {"runtime.com"}}, sut.ListEntries("blacklist"))
+	assert.True(t, sut.ExplainBlocking("runtime.com", "").Blocked)
+}
@@ -0,0 +1,176 @@
+package resolver
+
+import (
+	"blocky/api"
+	"blocky/config"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// max days to search for the next toggle of a group, all windows repeat weekly
+const scheduleSearchDays = 8
+
+// time windows of block groups, groups without schedule are always active
+type blockingSchedule struct {
+	windows  map[string][]config.ScheduleWindow
+	location *time.Location
+}
+
+func newBlockingSchedule(cfg config.BlockingConfig) (*blockingSchedule, error) {
+	location := time.Local
+
+	if cfg.ScheduleTimeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(cfg.ScheduleTimeZone); err != nil {
+			return nil, fmt.Errorf("can't load schedule time zone: %v", err)
+		}
+	}
+
+	return &blockingSchedule{
+		windows:  cfg.Schedules,
+		location: location,
+	}, nil
+}
+
+// returns true if the group has no schedule or one of its windows contains t
+func (s *blockingSchedule) isActive(group string, t time.Time) bool {
+	windows, ok := s.windows[group]
+	if !ok {
+		return true
+	}
+
+	t = t.In(s.location)
+
+	for _, w := range windows {
+		if windowContains(w, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns passed groups, which are active at t
+func (s *blockingSchedule) activeGroups(groups []string, t time.Time) []string {
+	if len(s.windows) == 0 {
+		return groups
+	}
+
+	result := make([]string, 0, len(groups))
+
+	for _, g := range groups {
+		if s.isActive(g, t) {
+			result = append(result, g)
+		}
+	}
+
+	return result
+}
+
+// returns the next time after t, on which the group is activated or deactivated. Zero time if the state doesn't change
+func (s *blockingSchedule) nextToggle(group string, t time.Time) time.Time {
+	active := s.isActive(group, t)
+	t = t.In(s.location)
+
+	var candidates []time.Time
+
+	for i := 0; i < scheduleSearchDays; i++ {
+		for _, w := range s.windows[group] {
+			for _, timeOfDay := range []time.Duration{w.From, w.To} {
+				// time.Date handles daylight saving time changes
+				c := time.Date(t.Year(), t.Month(), t.Day()+i, int(timeOfDay.Hours()), int(timeOfDay.Minutes())%60,
+					0, 0, s.location)
+				if c.After(t) {
+					candidates = append(candidates, c)
+				}
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Before(candidates[j])
+	})
+
+	for _, c := range candidates {
+		if s.isActive(group, c) != active {
+			return c
+		}
+	}
+
+	return time.Time{}
+}
+
+// returns sorted names of groups with schedule
+func (s *blockingSchedule) groups() []string {
+	groups := make([]string, 0, len(s.windows))
+	for g := range s.windows {
+		groups = append(groups, g)
+	}
+
+	sort.Strings(groups)
+
+	return groups
+}
+
+// returns the current state of all groups with schedule
+func (s *blockingSchedule) status(t time.Time) (result []api.GroupSchedule) {
+	for _, g := range s.groups() {
+		status := api.GroupSchedule{
+			Group:  g,
+			Active: s.isActive(g, t),
+		}
+
+		if next := s.nextToggle(g, t); !next.IsZero() {
+			status.NextToggle = &next
+		}
+
+		result = append(result, status)
+	}
+
+	return result
+}
+
+func (s *blockingSchedule) configuration() (result []string) {
+	if len(s.windows) == 0 {
+		return nil
+	}
+
+	result = append(result, fmt.Sprintf("schedules (time zone %s):", s.location))
+
+	for _, g := range s.groups() {
+		result = append(result, fmt.Sprintf("  %s = \"%s\"", g, windowsToString(s.windows[g])))
+	}
+
+	return result
+}
+
+// checks if the window contains t. A window, which ends on the next day, contains also the early hours of the day
+// after a defined week day
+func windowContains(w config.ScheduleWindow, t time.Time) bool {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+
+	if w.From < w.To {
+		return w.Days[day] && sinceMidnight >= w.From && sinceMidnight < w.To
+	}
+
+	previousDay := (day + 6) % 7
+
+	return (w.Days[day] && sinceMidnight >= w.From) || (w.Days[previousDay] && sinceMidnight < w.To)
+}
+
+func windowsToString(windows []config.ScheduleWindow) string {
+	result := ""
+
+	for i, w := range windows {
+		if i > 0 {
+			result += "; "
+		}
+
+		result += w.String()
+	}
+
+	return result
+}
@@ -0,0 +1,164 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/helpertest"
+	"blocky/util"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestSchedule(t *testing.T, windows map[string][]string) *blockingSchedule {
+	schedules := make(map[string][]config.ScheduleWindow)
+
+	for group, values := range windows {
+		for _, v := range values {
+			w, err := config.ParseScheduleWindow(v)
+			assert.NoError(t, err)
+
+			schedules[group] = append(schedules[group], w)
+		}
+	}
+
+	s, err := newBlockingSchedule(config.BlockingConfig{Schedules: schedules, ScheduleTimeZone: "Europe/Berlin"})
+	assert.NoError(t, err)
+
+	return s
+}
+
+func berlinTime(t *testing.T, value string) time.Time {
+	location, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+
+	result, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	assert.NoError(t, err)
+
+	return result
+}
+
+func Test_blockingSchedule_isActive(t *testing.T) {
+	sut := newTestSchedule(t, map[string][]string{
+		"youtube": {"sun-thu 21:00-07:00"},
+		"games":   {"mon-fri 08:00-13:00", "mon-fri 12:00-16:00"},
+	})
+
+	tests := []struct {
+		time    string
+		youtube bool
+		games   bool
+	}{
+		// 2023-11-12 is a sunday
+		{"2023-11-12 20:59", false, false},
+		{"2023-11-12 21:00", true, false},
+		// monday morning: window of sunday crosses midnight
+		{"2023-11-13 06:59", true, false},
+		{"2023-11-13 07:00", false, false},
+		// overlapping windows
+		{"2023-11-13 12:30", false, true},
+		{"2023-11-13 15:59", false, true},
+		{"2023-11-13 16:00", false, false},
+		// thursday evening until friday morning
+		{"2023-11-17 06:00", true, false},
+		// no window on friday evening and saturday
+		{"2023-11-17 22:00", false, false},
+		{"2023-11-18 02:00", false, false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.youtube, sut.isActive("youtube", berlinTime(t, tt.time)), "youtube %s", tt.time)
+		assert.Equal(t, tt.games, sut.isActive("games", berlinTime(t, tt.time)), "games %s", tt.time)
+	}
+
+	// groups without schedule are always active
+	assert.True(t, sut.isActive("ads", berlinTime(t, "2023-11-18 02:00")))
+	assert.Equal(t, []string{"ads", "youtube"},
+		sut.activeGroups([]string{"ads", "games", "youtube"}, berlinTime(t, "2023-11-12 23:00")))
+
+	// schedule time zone is used
+	assert.True(t, sut.isActive("youtube", berlinTime(t, "2023-11-12 21:30").UTC()))
+}
+
+func Test_blockingSchedule_nextToggle(t *testing.T) {
+	sut := newTestSchedule(t, map[string][]string{
+		"youtube": {"sun-thu 21:00-07:00"},
+		"games":   {"mon-fri 08:00-13:00", "mon-fri 12:00-16:00"},
+		"always":  {"00:00-00:00"},
+	})
+
+	assert.Equal(t, berlinTime(t, "2023-11-12 21:00"), sut.nextToggle("youtube", berlinTime(t, "2023-11-12 20:00")))
+	assert.Equal(t, berlinTime(t, "2023-11-13 07:00"), sut.nextToggle("youtube", berlinTime(t, "2023-11-12 21:00")))
+	// friday and saturday evening without window
+	assert.Equal(t, berlinTime(t, "2023-11-19 21:00"), sut.nextToggle("youtube", berlinTime(t, "2023-11-17 07:00")))
+	// overlapping windows are merged
+	assert.Equal(t, berlinTime(t, "2023-11-13 16:00"), sut.nextToggle("games", berlinTime(t, "2023-11-13 09:00")))
+	// end of daylight saving time
+	assert.Equal(t, berlinTime(t, "2023-10-30 07:00"), sut.nextToggle("youtube", berlinTime(t, "2023-10-29 23:00")))
+
+	assert.True(t, sut.nextToggle("always", berlinTime(t, "2023-11-13 09:00")).IsZero())
+
+	status := sut.status(berlinTime(t, "2023-11-13 09:00"))
+	assert.Len(t, status, 3)
+	assert.Equal(t, "always", status[0].Group)
+	assert.True(t, status[0].Active)
+	assert.Nil(t, status[0].NextToggle)
+	assert.Equal(t, "games", status[1].Group)
+	assert.True(t, status[1].Active)
+	assert.Equal(t, berlinTime(t, "2023-11-13 16:00"), *status[1].NextToggle)
+	assert.Equal(t, "youtube", status[2].Group)
+	assert.False(t, status[2].Active)
+}
+
+func Test_newBlockingSchedule_InvalidTimeZone(t *testing.T) {
+	_, err := newBlockingSchedule(config.BlockingConfig{ScheduleTimeZone: "Mars/Olympus_Mons"})
+	assert.Error(t, err)
+}
+
+func Test_Resolve_Blocking_Schedule(t *testing.T) {
+	file := helpertest.TempFile("blocked1.com\n")
+	defer file.Close()
+
+	sut := newTestBlockingResolver(t, config.BlockingConfig{
+		BlackLists: map[string][]string{"active": {file.Name()}, "inactive": {file.Name()}},
+		ClientGroupsBlock: map[string][]string{
+			"default": {"inactive"},
+			"laptop":  {"active", "inactive"},
+		},
+		Schedules: map[string][]config.ScheduleWindow{
+			// window without days is never active
+			"inactive": {{}},
+			"active":   {{Days: [7]bool{true, true, true, true, true, true, true}}},
+		},
+	})
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	resolve := func(client string) *Response {
+		resp, err := sut.Resolve(&Request{
+			Req:         util.NewMsgWithQuestion("blocked1.com.", dns.TypeA),
+			ClientNames: []string{client},
+			ClientIP:    net.ParseIP("192.168.178.1"),
+			Log:         logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	assert.Equal(t, "RESOLVED", resolve("unknown").Reason)
+	assert.Equal(t, "BLOCKED (active)", resolve("laptop").Reason)
+
+	status := sut.BlockingStatus().ScheduledGroups
+	assert.Len(t, status, 2)
+	assert.True(t, status[0].Active)
+	assert.False(t, status[1].Active)
+
+	assert.Contains(t, sut.Configuration(), "  active = \"00:00-00:00\"")
+}
@@ -0,0 +1,135 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resolved IPs are cached at least for this time, even if the TTL is lower
+const minBootstrapCacheTime = time.Minute
+
+// Bootstrap resolves host names of upstream resolvers with the bootstrap DNS server (plain IP upstream).
+// Resolved IPs are cached with TTL of the answer and resolved again after expiration
+type Bootstrap struct {
+	resolver Resolver
+	lock     sync.Mutex
+	cache    map[string]bootstrapEntry
+}
+
+type bootstrapEntry struct {
+	ip        net.IP
+	expiresAt time.Time
+}
+
+// NewBootstrap creates new instance, returns nil if no bootstrap DNS is configured
+func NewBootstrap(upstream config.Upstream) (*Bootstrap, error) {
+	if (config.Upstream{}) == upstream {
+		return nil, nil
+	}
+
+	if net.ParseIP(upstream.Host) == nil {
+		return nil, fmt.Errorf("bootstrap DNS '%s' must be defined with IP address", upstream)
+	}
+
+	return &Bootstrap{
+		resolver: NewUpstreamResolver(upstream, nil),
+		cache:    make(map[string]bootstrapEntry),
+	}, nil
+}
+
+// resolveHost returns IP of the host, IP addresses are returned unchanged. Expired entries are kept, if the
+// host can't be resolved again
+func (b *Bootstrap) resolveHost(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	entry, found := b.cache[host]
+	if found && time.Now().Before(entry.expiresAt) {
+		return entry.ip, nil
+	}
+
+	ip, ttl, err := b.lookup(host)
+	if err != nil {
+		if found {
+			logger("bootstrap").Warnf("can't resolve '%s' again, using expired IP %s: %v", host, entry.ip, err)
+
+			return entry.ip, nil
+		}
+
+		return nil, err
+	}
+
+	if ttl < minBootstrapCacheTime {
+		ttl = minBootstrapCacheTime
+	}
+
+	b.cache[host] = bootstrapEntry{ip: ip, expiresAt: time.Now().Add(ttl)}
+
+	logger("bootstrap").Debugf("resolved '%s' to %s", host, ip)
+
+	return ip, nil
+}
+
+// queries A record, AAAA if no A record exists
+func (b *Bootstrap) lookup(host string) (net.IP, time.Duration, error) {
+	for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := b.resolver.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(dns.Fqdn(host), qType),
+			Log: logger("bootstrap"),
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, rr := range resp.Res.Answer {
+			ttl := time.Duration(rr.Header().Ttl) * time.Second
+
+			switch v := rr.(type) {
+			case *dns.A:
+				return v.A, ttl, nil
+			case *dns.AAAA:
+				return v.AAAA, ttl, nil
+			}
+		}
+	}
+
+	return nil, 0, fmt.Errorf("no IP address for '%s' found", host)
+}
+
+// resolveAddress replaces the host in "host:port" address with resolved IP
+func (b *Bootstrap) resolveAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	ip, err := b.resolveHost(host)
+	if err != nil {
+		return "", fmt.Errorf("can't resolve upstream host '%s' with bootstrap DNS: %v", host, err)
+	}
+
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// dialContext returns the dial function for HTTP transport, the host name is resolved with bootstrap DNS
+func (b *Bootstrap) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		resolved, err := b.resolveAddress(address)
+		if err != nil {
+			return nil, err
+		}
+
+		return dialer.DialContext(ctx, network, resolved)
+	}
+}
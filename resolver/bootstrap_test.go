@@ -0,0 +1,98 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Bootstrap(t *testing.T) {
+	var calls int32
+
+	bootstrapUpstream := TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+		atomic.AddInt32(&calls, 1)
+
+		if request.Question[0].Name == "dns.example." && request.Question[0].Qtype == dns.TypeA {
+			response, _ = util.NewMsgWithAnswer("dns.example. 300 IN A 127.0.0.1")
+		} else {
+			response = new(dns.Msg)
+			response.SetReply(request)
+		}
+
+		return response
+	})
+
+	sut, err := NewBootstrap(bootstrapUpstream)
+	assert.NoError(t, err)
+
+	ip, err := sut.resolveHost("dns.example")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip.String())
+
+	// cached
+	_, err = sut.resolveHost("dns.example")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// IP is returned unchanged
+	ip, err = sut.resolveHost("192.168.178.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.178.1", ip.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// unknown host: A and AAAA query
+	_, err = sut.resolveHost("unknown.example")
+	assert.Error(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// expired entry is used if host can't be resolved
+	sut.cache["other.example"] = bootstrapEntry{ip: ip, expiresAt: time.Now().Add(-time.Minute)}
+	ip, err = sut.resolveHost("other.example")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.178.1", ip.String())
+
+	address, err := sut.resolveAddress("dns.example:853")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:853", address)
+
+	// not configured
+	sut, err = NewBootstrap(config.Upstream{})
+	assert.NoError(t, err)
+	assert.Nil(t, sut)
+
+	_, err = NewBootstrap(config.Upstream{Net: "udp", Host: "dns.example", Port: 53})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "must be defined with IP address")
+}
+
+func Test_Resolve_Upstream_WithBootstrap(t *testing.T) {
+	bootstrap, err := NewBootstrap(TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+		response, _ = util.NewMsgWithAnswer(fmt.Sprintf("%s 300 IN A 127.0.0.1", request.Question[0].Name))
+
+		return response
+	}))
+	assert.NoError(t, err)
+
+	upstream := TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+		response, _ = util.NewMsgWithAnswer("example.com. 123 IN A 123.124.122.122")
+
+		return response
+	})
+	upstream.Host = "dns.example"
+
+	sut := NewUpstreamResolver(upstream, bootstrap)
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.\t123\tIN\tA\t123.124.122.122", resp.Res.Answer[0].String())
+}
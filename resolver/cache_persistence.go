@@ -0,0 +1,210 @@
+package resolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// version of the persistence file format, files with other version are ignored
+	cachePersistenceVersion = 1
+	cachePersistencePeriod  = 10 * time.Minute
+	defaultPersistenceFile  = "blocky_cache.json"
+)
+
+type persistedCache struct {
+	Version int               `json:"version"`
+	Entries []persistedAnswer `json:"entries"`
+}
+
+// cached answer with records in presentation format
+type persistedAnswer struct {
+	Key       string    `json:"key"`
+	Answer    []string  `json:"answer,omitempty"`
+	Ns        []string  `json:"ns,omitempty"`
+	Rcode     int       `json:"rcode"`
+	AD        bool      `json:"ad,omitempty"`
+	CachedAt  time.Time `json:"cachedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// end of the stale grace period
+	RemovedAt time.Time `json:"removedAt"`
+}
+
+// writes all not expired cache entries to the persistence file
+func (r *CachingResolver) saveCache() error {
+	result := persistedCache{Version: cachePersistenceVersion}
+
+	r.cache.ForEach(func(key string, value interface{}, removedAt time.Time) {
+		result.Entries = append(result.Entries, newPersistedAnswer(key, value.(cachedAnswer), removedAt))
+	})
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("can't serialize cache: %v", err)
+	}
+
+	// write to temp file first, so the persistence file is never incomplete
+	tmpFile := r.persistenceFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		return fmt.Errorf("can't write cache file: %v", err)
+	}
+
+	if err := os.Rename(tmpFile, r.persistenceFile); err != nil {
+		return fmt.Errorf("can't write cache file: %v", err)
+	}
+
+	logger("caching_resolver").WithField("file", r.persistenceFile).Debugf("saved %d cache entries", len(result.Entries))
+
+	return nil
+}
+
+// loads cache entries from persistence file, expired entries are skipped
+func (r *CachingResolver) loadCache() error {
+	data, err := ioutil.ReadFile(r.persistenceFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("can't read cache file: %v", err)
+	}
+
+	var persisted persistedCache
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return fmt.Errorf("can't parse cache file: %v", err)
+	}
+
+	if persisted.Version != cachePersistenceVersion {
+		return fmt.Errorf("cache file has unsupported version %d, expected %d", persisted.Version, cachePersistenceVersion)
+	}
+
+	var count int
+
+	now := time.Now()
+
+	// entries are saved from most to least recently used
+	for i := len(persisted.Entries) - 1; i >= 0; i-- {
+		e := persisted.Entries[i]
+
+		if !now.Before(e.RemovedAt) {
+			continue
+		}
+
+		entry, err := e.toCachedAnswer()
+		if err != nil {
+			return err
+		}
+
+		r.cache.Set(e.Key, entry, time.Until(e.RemovedAt))
+		count++
+	}
+
+	logger("caching_resolver").WithField("file", r.persistenceFile).Infof("loaded %d cache entries", count)
+
+	return nil
+}
+
+// saves the cache periodically until resolver is stopped
+func (r *CachingResolver) periodicSave() {
+	ticker := time.NewTicker(cachePersistencePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.saveCache(); err != nil {
+				logger("caching_resolver").Warn("can't save cache: ", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Flush writes the cache to the persistence file (if configured)
+func (r *CachingResolver) Flush(_ time.Duration) {
+	if r.persistenceFile == "" {
+		return
+	}
+
+	if err := r.saveCache(); err != nil {
+		logger("caching_resolver").Error("can't save cache: ", err)
+	}
+}
+
+func newPersistedAnswer(key string, entry cachedAnswer, removedAt time.Time) persistedAnswer {
+	return persistedAnswer{
+		Key:       key,
+		Answer:    rrsToStrings(entry.answer),
+		Ns:        rrsToStrings(entry.ns),
+		Rcode:     entry.rcode,
+		AD:        entry.authenticated,
+		CachedAt:  entry.cachedAt,
+		ExpiresAt: entry.expiresAt,
+		RemovedAt: removedAt,
+	}
+}
+
+func (e persistedAnswer) toCachedAnswer() (cachedAnswer, error) {
+	answer, err := stringsToRRs(e.Answer)
+	if err != nil {
+		return cachedAnswer{}, err
+	}
+
+	ns, err := stringsToRRs(e.Ns)
+	if err != nil {
+		return cachedAnswer{}, err
+	}
+
+	return cachedAnswer{
+		answer:        answer,
+		ns:            ns,
+		rcode:         e.Rcode,
+		authenticated: e.AD,
+		cachedAt:      e.CachedAt,
+		expiresAt:     e.ExpiresAt,
+	}, nil
+}
+
+func rrsToStrings(rrs []dns.RR) []string {
+	result := make([]string, len(rrs))
+	for i, rr := range rrs {
+		result[i] = rr.String()
+	}
+
+	return result
+}
+
+func stringsToRRs(values []string) ([]dns.RR, error) {
+	result := make([]dns.RR, len(values))
+
+	for i, v := range values {
+		rr, err := dns.NewRR(v)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse cached record '%s': %v", v, err)
+		}
+
+		result[i] = rr
+	}
+
+	return result, nil
+}
+
+// returns path of the persistence file, relative paths are resolved against working directory
+func persistenceFilePath(cfg string) string {
+	if cfg == "" {
+		cfg = defaultPersistenceFile
+	}
+
+	if abs, err := filepath.Abs(cfg); err == nil {
+		return abs
+	}
+
+	return cfg
+}
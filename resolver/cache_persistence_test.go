@@ -0,0 +1,96 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_CachePersistence_SaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocky_cache")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cache.json")
+	cfg := config.CachingConfig{Persistence: true, PersistenceFile: file}
+
+	sut := NewCachingResolver(cfg)
+	m := &resolverMock{}
+	mockResp, err := util.NewMsgWithAnswer("example.com. 600 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+	sut.Next(m)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+
+	// save on shutdown
+	sut.(Flusher).Flush(time.Second)
+	sut.(Stopper).Stop()
+
+	// new resolver loads persisted entries, upstream is not asked
+	loaded := NewCachingResolver(cfg)
+	defer loaded.(Stopper).Stop()
+
+	m2 := &resolverMock{}
+	loaded.Next(m2)
+
+	resp, err := loaded.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, CACHED, resp.rType)
+	assert.Equal(t, "123.122.121.120", resp.Res.Answer[0].(*dns.A).A.String())
+	assert.InDelta(t, 600, resp.Res.Answer[0].Header().Ttl, 1)
+	assert.Equal(t, 0, len(m2.Calls))
+}
+
+func Test_CachePersistence_SkipExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocky_cache")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cache.json")
+	data := `{"version":1,"entries":[
+{"key":"A:expired.com","answer":["expired.com. 300 IN A 1.1.1.1"],"rcode":0,
+"cachedAt":"2020-01-01T10:00:00Z","expiresAt":"2020-01-01T10:05:00Z","removedAt":"2020-01-01T10:05:00Z"}]}`
+	assert.NoError(t, ioutil.WriteFile(file, []byte(data), 0600))
+
+	sut := NewCachingResolver(config.CachingConfig{Persistence: true, PersistenceFile: file})
+	defer sut.(Stopper).Stop()
+
+	assert.Equal(t, 0, sut.(*CachingResolver).cache.ItemCount())
+}
+
+func Test_CachePersistence_IncompatibleVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocky_cache")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cache.json")
+	data := `{"version":99,"entries":[
+{"key":"A:example.com","answer":["example.com. 300 IN A 1.1.1.1"],"rcode":0,
+"cachedAt":"2020-01-01T10:00:00Z","expiresAt":"2100-01-01T10:05:00Z","removedAt":"2100-01-01T10:05:00Z"}]}`
+	assert.NoError(t, ioutil.WriteFile(file, []byte(data), 0600))
+
+	sut := NewCachingResolver(config.CachingConfig{Persistence: true, PersistenceFile: file})
+	defer sut.(Stopper).Stop()
+
+	assert.Equal(t, 0, sut.(*CachingResolver).cache.ItemCount())
+}
@@ -0,0 +1,110 @@
+package resolver
+
+import (
+	"blocky/redis"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix of cache entries in Redis
+	redisKeyPrefix = "blocky:cache:"
+	// channel for cache flushes, message format: "<instance id> <domain>", empty domain flushes the whole cache
+	redisFlushChannel = "blocky:cache:flush"
+)
+
+// shared cache of multiple blocky instances, stored in Redis. Entries are also cached locally
+type redisCache struct {
+	client *redis.Client
+	// identifies own flush messages
+	instanceID string
+}
+
+func newRedisCache(client *redis.Client, onFlush func(domain string)) *redisCache {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	c := &redisCache{client: client, instanceID: hex.EncodeToString(id)}
+
+	client.Subscribe(redisFlushChannel, func(message string) {
+		parts := strings.SplitN(message, " ", 2)
+		if len(parts) != 2 || parts[0] == c.instanceID {
+			return
+		}
+
+		logger("caching_resolver").WithField("domain", parts[1]).Debug("received cache flush from other instance")
+		onFlush(parts[1])
+	})
+
+	return c
+}
+
+// returns entry from Redis, false if Redis has no entry or is not reachable
+func (c *redisCache) get(key string) (cachedAnswer, time.Duration, bool) {
+	data, err := c.client.Get(redisKeyPrefix + key)
+	if err != nil || data == nil {
+		return cachedAnswer{}, 0, false
+	}
+
+	var persisted persistedAnswer
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		logger("caching_resolver").Warnf("ignoring invalid redis cache entry '%s': %v", key, err)
+		return cachedAnswer{}, 0, false
+	}
+
+	remaining := time.Until(persisted.RemovedAt)
+	if remaining <= 0 {
+		return cachedAnswer{}, 0, false
+	}
+
+	entry, err := persisted.toCachedAnswer()
+	if err != nil {
+		logger("caching_resolver").Warnf("ignoring invalid redis cache entry '%s': %v", key, err)
+		return cachedAnswer{}, 0, false
+	}
+
+	return entry, remaining, true
+}
+
+// writes entry asynchronously with expiration
+func (c *redisCache) set(key string, entry cachedAnswer, expiration time.Duration) {
+	data, err := json.Marshal(newPersistedAnswer(key, entry, time.Now().Add(expiration)))
+	if err != nil {
+		logger("caching_resolver").Warn("can't serialize cache entry: ", err)
+		return
+	}
+
+	c.client.Set(redisKeyPrefix+key, data, expiration)
+}
+
+// removes entries of the domain (all entries if domain is empty) and notifies other instances
+func (c *redisCache) flush(domain string) {
+	keys, err := c.client.Keys(redisKeyPrefix + "*")
+	if err != nil {
+		logger("caching_resolver").Warn("can't flush redis cache: ", err)
+		return
+	}
+
+	var matching []string
+
+	for _, key := range keys {
+		if domain == "" || cacheKeyMatchesDomain(strings.TrimPrefix(key, redisKeyPrefix), domain) {
+			matching = append(matching, key)
+		}
+	}
+
+	if _, err := c.client.Del(matching...); err != nil {
+		logger("caching_resolver").Warn("can't flush redis cache: ", err)
+	}
+
+	if err := c.client.Publish(redisFlushChannel, c.instanceID+" "+domain); err != nil {
+		logger("caching_resolver").Warn("can't notify other instances about cache flush: ", err)
+	}
+}
+
+func (c *redisCache) close() {
+	c.client.Close()
+}
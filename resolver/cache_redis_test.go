@@ -0,0 +1,116 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newRedisCachingResolver(address string) (*CachingResolver, *resolverMock) {
+	sut := NewCachingResolver(config.CachingConfig{Redis: config.RedisConfig{
+		Address:           address,
+		ReconnectInterval: config.Duration(50 * time.Millisecond),
+	}}).(*CachingResolver)
+
+	m := &resolverMock{}
+	mockResp, _ := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+	sut.Next(m)
+
+	return sut, m
+}
+
+// waits max. 2 seconds for the condition
+func waitUntil(t *testing.T, condition func() bool) {
+	for i := 0; i < 200 && !condition(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.True(t, condition())
+}
+
+func Test_RedisCache_SharedBetweenInstances(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	sut1, m1 := newRedisCachingResolver(server.Addr())
+	defer sut1.Stop()
+
+	sut2, m2 := newRedisCachingResolver(server.Addr())
+	defer sut2.Stop()
+
+	waitUntil(t, func() bool { return sut1.redis.client.IsConnected() && sut2.redis.client.IsConnected() })
+
+	resp, err := sut1.Resolve(newRequest("example.com.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, RESOLVED, resp.rType)
+	assert.Equal(t, 1, len(m1.Calls))
+
+	waitUntil(t, func() bool { return len(server.Keys()) == 1 })
+	assert.Equal(t, []string{redisKeyPrefix + "A:example.com"}, server.Keys())
+
+	// second instance uses the entry of the first instance and caches it locally
+	resp, err = sut2.Resolve(newRequest("example.com.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, CACHED, resp.rType)
+	assert.Equal(t, "123.122.121.120", resp.Res.Answer[0].(*dns.A).A.String())
+	assert.InDelta(t, 300, resp.Res.Answer[0].Header().Ttl, 1)
+	assert.Equal(t, 0, len(m2.Calls))
+	assert.Equal(t, 1, sut2.cache.ItemCount())
+}
+
+func Test_RedisCache_FlushPropagation(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	sut1, _ := newRedisCachingResolver(server.Addr())
+	defer sut1.Stop()
+
+	sut2, _ := newRedisCachingResolver(server.Addr())
+	defer sut2.Stop()
+
+	waitUntil(t, func() bool { return sut1.redis.client.IsConnected() && sut2.redis.client.IsConnected() })
+
+	_, err := sut1.Resolve(newRequest("example.com.", dns.TypeA, ""))
+	assert.NoError(t, err)
+
+	waitUntil(t, func() bool { return len(server.Keys()) == 1 })
+
+	_, err = sut2.Resolve(newRequest("example.com.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sut2.cache.ItemCount())
+
+	// subscription of the second instance is established asynchronously: flush until the message arrives
+	waitUntil(t, func() bool {
+		sut1.FlushCache("example.com")
+
+		return sut2.cache.ItemCount() == 0
+	})
+
+	assert.Equal(t, 0, sut1.cache.ItemCount())
+	assert.Empty(t, server.Keys())
+}
+
+func Test_RedisCache_Unreachable(t *testing.T) {
+	server := miniredis.RunT(t)
+	address := server.Addr()
+	server.Close()
+
+	sut, m := newRedisCachingResolver(address)
+	defer sut.Stop()
+
+	// local cache works without Redis
+	for i := 0; i < 2; i++ {
+		resp, err := sut.Resolve(newRequest("example.com.", dns.TypeA, ""))
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	}
+
+	assert.Equal(t, 1, len(m.Calls))
+	assert.Equal(t, 1, sut.FlushCache(""))
+	assert.Contains(t, sut.Configuration(), "redis = "+address+" (disconnected)")
+}
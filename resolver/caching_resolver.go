@@ -1,23 +1,79 @@
 package resolver
 
 import (
+	"blocky/config"
+	"blocky/lru"
+	"blocky/metrics"
+	"blocky/redis"
 	"blocky/util"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
 )
 
 // caches answers from dns queries with their TTL time, to avoid external resolver calls for recurrent queries
 type CachingResolver struct {
 	NextResolver
-	cachesPerType map[uint16]*cache.Cache
+	minCacheTime      time.Duration
+	maxCacheTime      time.Duration
+	cacheTimeNegative time.Duration
+	cacheTimeServfail time.Duration
+	staleGracePeriod  time.Duration
+	// caching time limits per domain (lower case, with sub domains), override min and max caching time
+	domainMinCacheTime map[string]time.Duration
+	domainMaxCacheTime map[string]time.Duration
+	// cached answers per query type and domain
+	cache       *lru.Cache
+	prefetching *prefetching
+	// cache is saved to this file on shutdown and periodically, empty if persistence is disabled
+	persistenceFile string
+	stop            chan struct{}
+	// shared cache of multiple instances, nil if not configured
+	redis *redisCache
+}
+
+// prefetching of frequently queried domains: query counts are tracked per domain and query type,
+// cache entries of domains with more queries than threshold are refreshed shortly before expiry
+type prefetching struct {
+	threshold     int
+	maxItemsCount int
+	// query count per key, entries expire after the tracking window
+	queryCounts *cache.Cache
+	timersLock  sync.Mutex
+	timers      map[string]*time.Timer
+	stopped     bool
+}
+
+// cached answer with the time of caching, used to decrement the TTL on cache hit.
+// Negative answers (NXDOMAIN or NOERROR without answer) contain the return code and authority section
+type cachedAnswer struct {
+	answer []dns.RR
+	ns     []dns.RR
+	rcode  int
+	// AD flag of the answer (validated DNSSEC signatures)
+	authenticated bool
+	cachedAt      time.Time
+	expiresAt     time.Time
 }
 
 const (
-	minTTL            = 250
-	cacheTimeNegative = 30 * time.Minute
+	defaultMinCacheTime          = 250 * time.Second
+	defaultPrefetchExpires       = 2 * time.Hour
+	defaultPrefetchThreshold     = 5
+	defaultPrefetchMaxItemsCount = 10000
+	// entries are prefetched this time before expiry
+	prefetchBeforeExpiry = 5 * time.Second
+	// TTL of stale answers, served if the resolution fails
+	staleTTL = 30
+	// min. TTL of records served from cache
+	minServedTTL = 1
 )
 
 type Type uint8
@@ -27,22 +83,270 @@ const (
 	AAAA
 )
 
-func NewCachingResolver() ChainedResolver {
-	return &CachingResolver{
-		cachesPerType: map[uint16]*cache.Cache{
-			dns.TypeA:    cache.New(15*time.Minute, 5*time.Minute),
-			dns.TypeAAAA: cache.New(15*time.Minute, 5*time.Minute),
-		},
+// NewCachingResolver creates new resolver, TTLs of cached answers are adjusted to be between minCachingTime
+// (default 250s, negative value disables the minimum) and maxCachingTime (0 -> no maximum), limits per domain
+// (domainMinCachingTime, domainMaxCachingTime) take precedence.
+// Negative answers are cached max. cacheTimeNegative (0 -> negative caching is disabled), SERVFAIL responses
+// cacheTimeServfail (0 -> not cached, max. 30s) to absorb retry storms during upstream outages.
+// Expired entries are kept for staleGracePeriod and served, if the resolution fails
+func NewCachingResolver(cfg config.CachingConfig) ChainedResolver {
+	minCacheTime := time.Duration(cfg.MinCachingTime)
+	if minCacheTime == 0 {
+		minCacheTime = defaultMinCacheTime
+	} else if minCacheTime < 0 {
+		minCacheTime = 0
+	}
+
+	cacheTimeServfail := time.Duration(cfg.CacheTimeServfail)
+	if cacheTimeServfail > config.MaxCacheTimeServfail {
+		cacheTimeServfail = config.MaxCacheTimeServfail
+	}
+
+	r := &CachingResolver{
+		minCacheTime:      minCacheTime,
+		maxCacheTime:      time.Duration(cfg.MaxCachingTime),
+		cacheTimeNegative: time.Duration(cfg.CacheTimeNegative),
+		cacheTimeServfail: cacheTimeServfail,
+		staleGracePeriod:  time.Duration(cfg.StaleGracePeriod),
+		cache:             lru.New(cfg.MaxItemsCount, time.Minute),
+
+		domainMinCacheTime: domainCacheTimes(cfg.DomainMinCachingTime),
+		domainMaxCacheTime: domainCacheTimes(cfg.DomainMaxCachingTime),
+	}
+
+	if cfg.Prefetching {
+		r.prefetching = newPrefetching(cfg)
+	}
+
+	metrics.SetCacheStatsSource(r.cacheStats)
+
+	if cfg.Persistence {
+		r.persistenceFile = persistenceFilePath(cfg.PersistenceFile)
+		r.stop = make(chan struct{})
+
+		if err := r.loadCache(); err != nil {
+			logger("caching_resolver").Warn("ignoring persisted cache: ", err)
+			r.cache.Clear()
+		}
+
+		go r.periodicSave()
+	}
+
+	if cfg.Redis.Address != "" {
+		r.redis = newRedisCache(redis.NewClient(cfg.Redis), func(domain string) { r.flushLocal(domain) })
 	}
+
+	return r
 }
 
-func (r *CachingResolver) getCache(queryType uint16) *cache.Cache {
-	return r.cachesPerType[queryType]
+// returns caching times with normalized domain names, nil if no domain is configured
+func domainCacheTimes(cfg map[string]config.Duration) map[string]time.Duration {
+	if len(cfg) == 0 {
+		return nil
+	}
+
+	result := make(map[string]time.Duration, len(cfg))
+	for domain, d := range cfg {
+		result[strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")] = time.Duration(d)
+	}
+
+	return result
+}
+
+func newPrefetching(cfg config.CachingConfig) *prefetching {
+	window := time.Duration(cfg.PrefetchExpires)
+	if window <= 0 {
+		window = defaultPrefetchExpires
+	}
+
+	threshold := cfg.PrefetchThreshold
+	if threshold <= 0 {
+		threshold = defaultPrefetchThreshold
+	}
+
+	maxItemsCount := cfg.PrefetchMaxItemsCount
+	if maxItemsCount <= 0 {
+		maxItemsCount = defaultPrefetchMaxItemsCount
+	}
+
+	return &prefetching{
+		threshold:     threshold,
+		maxItemsCount: maxItemsCount,
+		queryCounts:   cache.New(window, time.Minute),
+		timers:        make(map[string]*time.Timer),
+	}
+}
+
+// counts query for passed key, returns true if the key is queried frequently
+func (p *prefetching) countQuery(key string) bool {
+	count, err := p.queryCounts.IncrementInt(key, 1)
+	if err != nil {
+		// unknown key: rarely seen names are not tracked if max count is reached
+		if p.queryCounts.ItemCount() >= p.maxItemsCount {
+			return false
+		}
+
+		if p.queryCounts.Add(key, 1, cache.DefaultExpiration) != nil {
+			// concurrently added
+			count, _ = p.queryCounts.IncrementInt(key, 1)
+		} else {
+			count = 1
+		}
+	}
+
+	return count >= p.threshold
+}
+
+func (p *prefetching) isFrequent(key string) bool {
+	count, found := p.queryCounts.Get(key)
+
+	return found && count.(int) >= p.threshold
+}
+
+// schedules function execution, if no execution for the same key is scheduled yet
+func (p *prefetching) schedule(key string, delay time.Duration, fn func()) {
+	p.timersLock.Lock()
+	defer p.timersLock.Unlock()
+
+	if _, ok := p.timers[key]; ok || p.stopped {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		p.timersLock.Lock()
+		current := p.timers[key] == timer && !p.stopped
+
+		if current {
+			delete(p.timers, key)
+		}
+		p.timersLock.Unlock()
+
+		if current {
+			fn()
+		}
+	})
+	p.timers[key] = timer
+}
+
+func (p *prefetching) stop() {
+	p.timersLock.Lock()
+	defer p.timersLock.Unlock()
+
+	p.stopped = true
+
+	for key, t := range p.timers {
+		t.Stop()
+		delete(p.timers, key)
+	}
+}
+
+// Stop stops scheduled prefetching
+func (r *CachingResolver) Stop() {
+	if r.prefetching != nil {
+		r.prefetching.stop()
+	}
+
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+
+	if r.redis != nil {
+		r.redis.close()
+	}
+}
+
+// returns current state of the cache for metrics
+func (r *CachingResolver) cacheStats() metrics.CacheStats {
+	return metrics.CacheStats{ItemCount: r.cache.ItemCount(), Evictions: r.cache.Evictions()}
+}
+
+// CacheEntries returns the number of cached responses
+func (r *CachingResolver) CacheEntries() int {
+	return r.cache.ItemCount()
+}
+
+// ShareCache uses the cache of the passed resolver, cached entries are preserved on configuration reload
+func (r *CachingResolver) ShareCache(other *CachingResolver) {
+	r.cache = other.cache
+}
+
+// FlushCache removes all cached answers for passed domain and its sub domains (any query type),
+// the whole cache is cleared if domain is empty. The shared cache and other instances are flushed too.
+// Returns number of removed local entries
+func (r *CachingResolver) FlushCache(domain string) int {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+
+	count := r.flushLocal(domain)
+
+	if r.redis != nil {
+		r.redis.flush(domain)
+	}
+
+	return count
+}
+
+func (r *CachingResolver) flushLocal(domain string) (count int) {
+	if domain == "" {
+		count = r.cache.Clear()
+	} else {
+		count = r.cache.DeleteMatching(func(key string) bool {
+			return cacheKeyMatchesDomain(key, domain)
+		})
+	}
+
+	logger("caching_resolver").WithField("domain", domain).Infof("flushed cache, removed %d entries", count)
+
+	return count
+}
+
+// returns true if the cache key belongs to the domain or one of its sub domains
+func cacheKeyMatchesDomain(key, domain string) bool {
+	keyDomain := key[strings.Index(key, ":")+1:]
+
+	// entry for EDNS client subnet, DNSSEC or upstream group
+	if i := strings.Index(keyDomain, "|"); i >= 0 {
+		keyDomain = keyDomain[:i]
+	}
+
+	return keyDomain == domain || strings.HasSuffix(keyDomain, "."+domain)
 }
 
 func (r *CachingResolver) Configuration() (result []string) {
-	for t, cache := range r.cachesPerType {
-		result = append(result, fmt.Sprintf("%s cache items count = %d", dns.TypeToString[t], cache.ItemCount()))
+	result = append(result, fmt.Sprintf("minCacheTimeInSec = %d", int(r.minCacheTime.Seconds())))
+	result = append(result, fmt.Sprintf("maxCacheTimeInSec = %d", int(r.maxCacheTime.Seconds())))
+	result = append(result, fmt.Sprintf("cacheTimeNegativeInSec = %d", int(r.cacheTimeNegative.Seconds())))
+	result = append(result, fmt.Sprintf("cacheTimeServfailInSec = %d", int(r.cacheTimeServfail.Seconds())))
+	result = append(result, fmt.Sprintf("staleGracePeriodInSec = %d", int(r.staleGracePeriod.Seconds())))
+
+	for _, domain := range sortedDomains(r.domainMinCacheTime) {
+		result = append(result, fmt.Sprintf("minCacheTimeInSec[%s] = %d", domain,
+			int(r.domainMinCacheTime[domain].Seconds())))
+	}
+
+	for _, domain := range sortedDomains(r.domainMaxCacheTime) {
+		result = append(result, fmt.Sprintf("maxCacheTimeInSec[%s] = %d", domain,
+			int(r.domainMaxCacheTime[domain].Seconds())))
+	}
+
+	if r.prefetching != nil {
+		result = append(result, fmt.Sprintf("prefetching threshold = %d", r.prefetching.threshold))
+		result = append(result, fmt.Sprintf("prefetching tracked items count = %d", r.prefetching.queryCounts.ItemCount()))
+	} else {
+		result = append(result, "prefetching = disabled")
+	}
+
+	result = append(result, fmt.Sprintf("cache items count = %d", r.cache.ItemCount()))
+	result = append(result, fmt.Sprintf("cache evictions count = %d", r.cache.Evictions()))
+
+	if r.redis != nil {
+		state := "disconnected"
+		if r.redis.client.IsConnected() {
+			state = "connected"
+		}
+
+		result = append(result, fmt.Sprintf("redis = %s (%s)", r.redis.client.Address(), state))
 	}
 
 	return
@@ -56,49 +360,58 @@ func (r *CachingResolver) Resolve(request *Request) (response *Response, err err
 
 	for _, question := range request.Req.Question {
 		domain := util.ExtractDomain(question)
-		logger := logger.WithField("domain", domain)
+		logger := logger
+
+		if logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			logger = logger.WithField("domain", domain)
+		}
 
 		// we caching only A and AAAA queries
 		if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
-			val, expiresAt, found := r.getCache(question.Qtype).GetWithExpiration(domain)
+			key := queryCacheKey(question.Qtype, domain, request)
+			frequent := r.prefetching != nil && r.prefetching.countQuery(key)
+			subnet := ecsSubnet(request.Req)
+
+			val, found := r.getCached(key, subnet)
+
+			var stale *cachedAnswer
 
 			if found {
-				logger.Debug("domain is cached")
+				v := val.(cachedAnswer)
 
-				// calculate remaining TTL
-				remainingTTL := uint32(time.Until(expiresAt).Seconds())
+				if time.Now().Before(v.expiresAt) {
+					logger.Debug("domain is cached")
+					metrics.RecordCacheHit()
 
-				v, ok := val.([]dns.RR)
-				if ok {
-					// Answer from successful request
-					resp.Answer = v
-					for _, rr := range resp.Answer {
-						rr.Header().Ttl = remainingTTL
+					if frequent {
+						r.schedulePrefetch(question.Qtype, domain, time.Until(v.expiresAt))
 					}
 
-					return &Response{Res: resp, rType: CACHED, Reason: "CACHED"}, nil
+					return v.toResponse(request.Req, resp), nil
 				}
-				// Answer with response code != OK
-				resp.Rcode = val.(int)
 
-				return &Response{Res: resp, rType: CACHED, Reason: "CACHED NEGATIVE"}, nil
+				// expired entry in grace period: can be used if the resolution fails
+				if v.rcode != dns.RcodeServerFailure {
+					stale = &v
+				}
 			}
 
 			logger.WithField("next_resolver", r.next).Debug("not in cache: go to next resolver")
+			metrics.RecordCacheMiss()
 			response, err = r.next.Resolve(request)
 
-			if err == nil {
-				answer := response.Res.Answer
+			if stale != nil && (err != nil || response.Res.Rcode == dns.RcodeServerFailure) {
+				logger.Debugf("resolution failed, serving stale answer: %v", err)
 
-				var maxTTL = adjustTTLs(answer)
+				resp.Answer = restoreOwnerCase(setTTLs(stale.answer, staleTTL), question.Name)
+				resp.Ns = setTTLs(stale.ns, staleTTL)
+				resp.Rcode = stale.rcode
 
-				if response.Res.Rcode == dns.RcodeSuccess {
-					// put value into cache
-					r.getCache(question.Qtype).Set(domain, answer, time.Duration(maxTTL)*time.Second)
-				} else if response.Res.Rcode == dns.RcodeNameError {
-					// put return code if NXDOMAIN
-					r.getCache(question.Qtype).Set(domain, response.Res.Rcode, cacheTimeNegative)
-				}
+				return &Response{Res: resp, rType: CACHED, Reason: "STALE"}, nil
+			}
+
+			if err == nil {
+				r.putInCache(question.Qtype, domain, request, response.Res)
 			}
 		} else {
 			logger.Debugf("not A/AAAA: go to next %s", r.next)
@@ -109,21 +422,377 @@ func (r *CachingResolver) Resolve(request *Request) (response *Response, err err
 	return response, err
 }
 
-func adjustTTLs(answer []dns.RR) (maxTTL uint32) {
-	for _, a := range answer {
-		// if TTL < mitTTL -> adjust the value, set minTTL
-		if a.Header().Ttl < minTTL {
-			a.Header().Ttl = minTTL
+// creates response from cached entry with TTLs decremented by the age of the entry
+func (c cachedAnswer) toResponse(req *dns.Msg, resp *dns.Msg) *Response {
+	age := time.Since(c.cachedAt)
+
+	// cached answer has the spelling of the query, which was cached (e.g. with 0x20 randomization)
+	resp.Answer = restoreOwnerCase(decrementTTLs(c.answer, age), req.Question[0].Name)
+	resp.Ns = decrementTTLs(c.ns, age)
+	resp.Rcode = c.rcode
+	resp.AuthenticatedData = c.authenticated
+
+	if isDNSSECRequested(req) {
+		resp.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	if isNegative(resp) {
+		return &Response{Res: resp, rType: CACHED, Reason: "CACHED NEGATIVE"}
+	}
+
+	if resp.Rcode == dns.RcodeServerFailure {
+		return &Response{Res: resp, rType: CACHED, Reason: "CACHED SERVFAIL"}
+	}
+
+	return &Response{Res: resp, rType: CACHED, Reason: "CACHED"}
+}
+
+// returns cached entry, the entry for the EDNS client subnet of the query is preferred.
+// The shared cache is used if the local cache has no entry
+func (r *CachingResolver) getCached(key, subnet string) (interface{}, bool) {
+	keys := []string{key}
+	if subnet != "" {
+		keys = []string{subnetCacheKey(key, subnet), key}
+	}
+
+	for _, k := range keys {
+		if val, found := r.cache.Get(k); found {
+			return val, true
 		}
+	}
 
-		if maxTTL < a.Header().Ttl {
-			maxTTL = a.Header().Ttl
+	if r.redis != nil {
+		for _, k := range keys {
+			if entry, remaining, found := r.redis.get(k); found {
+				r.cache.Set(k, entry, remaining)
+
+				return entry, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// stores entry in the local and the shared cache
+func (r *CachingResolver) setCache(key string, entry cachedAnswer, expiration time.Duration) {
+	r.cache.Set(key, entry, expiration)
+
+	if r.redis != nil {
+		r.redis.set(key, entry, expiration)
+	}
+}
+
+// puts successful and negative answers into the cache, SERVFAIL responses only for the short SERVFAIL caching time
+// without grace period. Other responses (e.g. REFUSED) are not cached.
+// Answers with EDNS client subnet scope are cached only for the subnet of the query
+func (r *CachingResolver) putInCache(qType uint16, domain string, request *Request, res *dns.Msg) {
+	req := request.Req
+
+	entry := cachedAnswer{
+		rcode:         res.Rcode,
+		authenticated: res.AuthenticatedData,
+		cachedAt:      time.Now(),
+	}
+
+	var cacheTime time.Duration
+
+	switch {
+	case isNegative(res):
+		entry.ns = copyRRs(res.Ns)
+		cacheTime = r.negativeCacheTime(res)
+	case res.Rcode == dns.RcodeSuccess:
+		cacheTime = time.Duration(r.adjustTTLs(res.Answer, domain)) * time.Second
+		entry.answer = copyRRs(res.Answer)
+	case res.Rcode == dns.RcodeServerFailure:
+		// failures are never served as stale answer and not prefetched
+		if r.cacheTimeServfail > 0 {
+			entry.expiresAt = entry.cachedAt.Add(r.cacheTimeServfail)
+			r.setCache(queryCacheKey(qType, domain, request), entry, r.cacheTimeServfail)
+		}
+
+		return
+	}
+
+	// zero duration would mean default expiration of the cache
+	if cacheTime > 0 {
+		entry.expiresAt = entry.cachedAt.Add(cacheTime)
+
+		key := queryCacheKey(qType, domain, request)
+
+		if scope := ecsOption(res); scope != nil && scope.SourceScope > 0 && ecsSubnet(req) != "" {
+			// expired entries are kept for the grace period to be served if the resolution fails
+			r.setCache(subnetCacheKey(key, ecsSubnet(req)), entry, cacheTime+r.staleGracePeriod)
+
+			return
+		}
+
+		r.setCache(key, entry, cacheTime+r.staleGracePeriod)
+
+		// only answers without DNSSEC records are prefetched
+		if key == cacheKey(qType, domain) {
+			r.schedulePrefetch(qType, domain, cacheTime)
+		}
+	}
+}
+
+// cache entries are keyed by query type and lower case domain, queries with different spelling share the entry
+func cacheKey(qType uint16, domain string) string {
+	return dns.TypeToString[qType] + ":" + strings.ToLower(domain)
+}
+
+// answers with DNSSEC records, unvalidated answers (CD bit) and answers of other upstream groups than the default
+// group are cached separately
+func queryCacheKey(qType uint16, domain string, request *Request) string {
+	key := cacheKey(qType, domain)
+
+	if isDNSSECRequested(request.Req) {
+		key += "|DO"
+	}
+
+	// the DNSSEC resolver doesn't validate these answers, they must not be returned to other clients
+	if request.Req.CheckingDisabled {
+		key += "|CD"
+	}
+
+	if request.UpstreamGroup != "" {
+		key += "|" + request.UpstreamGroup
+	}
+
+	return key
+}
+
+// returns true if the DO (DNSSEC OK) bit is set in the query
+func isDNSSECRequested(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+
+	return opt != nil && opt.Do()
+}
+
+func subnetCacheKey(key, subnet string) string {
+	return key + "|" + subnet
+}
+
+// returns the EDNS client subnet of the query ("address/prefix length"), empty if the query has no ECS option
+func ecsSubnet(req *dns.Msg) string {
+	if subnet := ecsOption(req); subnet != nil {
+		return fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+	}
+
+	return ""
+}
+
+// schedules refresh of the cache entry shortly before expiry, if the domain is queried frequently
+func (r *CachingResolver) schedulePrefetch(qType uint16, domain string, remaining time.Duration) {
+	if r.prefetching == nil || remaining <= prefetchBeforeExpiry {
+		return
+	}
+
+	key := cacheKey(qType, domain)
+	if !r.prefetching.isFrequent(key) {
+		return
+	}
+
+	r.prefetching.schedule(key, remaining-prefetchBeforeExpiry, func() {
+		// domain could be queried rarely in the meantime
+		if !r.prefetching.isFrequent(key) {
+			return
+		}
+
+		logger := logger("caching_resolver").WithFields(logrus.Fields{
+			"domain": domain,
+			"type":   dns.TypeToString[qType],
+		})
+		logger.Debug("prefetching domain")
+
+		request := &Request{
+			Req: util.NewMsgWithQuestion(dns.Fqdn(domain), qType),
+			Log: logger,
+		}
+
+		response, err := r.next.Resolve(request)
+		if err != nil {
+			logger.Warn("prefetching failed: ", err)
+			return
+		}
+
+		r.putInCache(qType, domain, request, response.Res)
+	})
+}
+
+// NXDOMAIN or NOERROR without answer (NODATA)
+func isNegative(res *dns.Msg) bool {
+	return res.Rcode == dns.RcodeNameError || (res.Rcode == dns.RcodeSuccess && len(res.Answer) == 0)
+}
+
+// returns caching time for negative answer: minimum of SOA TTL and SOA minimum field (RFC 2308),
+// capped by configured negative cache time
+func (r *CachingResolver) negativeCacheTime(res *dns.Msg) time.Duration {
+	for _, rr := range res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+
+			if d := time.Duration(ttl) * time.Second; d < r.cacheTimeNegative {
+				return d
+			}
+
+			break
+		}
+	}
+
+	return r.cacheTimeNegative
+}
+
+// returns min and max caching time for the domain: limits of the most specific configured domain take precedence
+// over the global limits. A domain max. time below the global min. time lowers the min. time and vice versa
+func (r *CachingResolver) cacheTimeLimits(domain string) (minTime, maxTime time.Duration) {
+	minTime, maxTime = r.minCacheTime, r.maxCacheTime
+
+	if d, ok := lookupDomain(r.domainMinCacheTime, domain); ok {
+		minTime = d
+
+		if maxTime > 0 && maxTime < d {
+			maxTime = d
+		}
+	}
+
+	if d, ok := lookupDomain(r.domainMaxCacheTime, domain); ok {
+		maxTime = d
+
+		if minTime > d {
+			minTime = d
+		}
+	}
+
+	return minTime, maxTime
+}
+
+// returns the value of the domain or its nearest parent domain
+func lookupDomain(m map[string]time.Duration, domain string) (time.Duration, bool) {
+	if len(m) == 0 {
+		return 0, false
+	}
+
+	for {
+		if d, ok := m[domain]; ok {
+			return d, true
+		}
+
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return 0, false
+		}
+
+		domain = domain[i+1:]
+	}
+}
+
+func sortedDomains(m map[string]time.Duration) []string {
+	result := make([]string, 0, len(m))
+	for domain := range m {
+		result = append(result, domain)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// clamps TTLs of answer records into range of min and max caching time of the domain, returns the min TTL.
+// The cache entry expires with the record, which expires first
+func (r *CachingResolver) adjustTTLs(answer []dns.RR, domain string) (minTTL uint32) {
+	minTime, maxTime := r.cacheTimeLimits(domain)
+
+	return limitTTLs(answer, minTime, maxTime)
+}
+
+// clamps TTLs of answer records into range of min and max time (0 -> no maximum), returns the min TTL
+func limitTTLs(answer []dns.RR, minTime, maxTime time.Duration) (minTTL uint32) {
+	minAllowedTTL := uint32(minTime.Seconds())
+	maxAllowedTTL := uint32(maxTime.Seconds())
+
+	for i, a := range answer {
+		if a.Header().Ttl < minAllowedTTL {
+			a.Header().Ttl = minAllowedTTL
+		}
+
+		if maxAllowedTTL > 0 && a.Header().Ttl > maxAllowedTTL {
+			a.Header().Ttl = maxAllowedTTL
+		}
+
+		if i == 0 || a.Header().Ttl < minTTL {
+			minTTL = a.Header().Ttl
 		}
 	}
 
 	return
 }
 
+// returns copies of cached records with TTLs decremented by the age of the cache entry. TTLs don't go below
+// minServedTTL: a record with TTL 0 must not be cached by the client at all
+func decrementTTLs(answer []dns.RR, age time.Duration) []dns.RR {
+	ageInSec := uint32(math.Ceil(age.Seconds()))
+	result := copyRRs(answer)
+
+	for _, rr := range result {
+		if rr.Header().Ttl > ageInSec+minServedTTL {
+			rr.Header().Ttl -= ageInSec
+		} else {
+			rr.Header().Ttl = minServedTTL
+		}
+	}
+
+	return result
+}
+
+// returns copies of records with passed TTL
+func setTTLs(rrs []dns.RR, ttl uint32) []dns.RR {
+	result := copyRRs(rrs)
+	for _, rr := range result {
+		rr.Header().Ttl = ttl
+	}
+
+	return result
+}
+
+// sets owner names, which are equal to the question name except for case, to the spelling of the question.
+// Other names (e.g. targets of a CNAME chain) are not changed
+func restoreOwnerCase(rrs []dns.RR, name string) []dns.RR {
+	for _, rr := range rrs {
+		if strings.EqualFold(rr.Header().Name, name) {
+			rr.Header().Name = name
+		}
+	}
+
+	return rrs
+}
+
+func copyRRs(rrs []dns.RR) []dns.RR {
+	result := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		result[i] = copyRR(rr)
+	}
+
+	return result
+}
+
+// copies the record, A and AAAA records share the IP with the cached record (IPs of answers are never modified)
+func copyRR(rr dns.RR) dns.RR {
+	switch v := rr.(type) {
+	case *dns.A:
+		c := *v
+		return &c
+	case *dns.AAAA:
+		c := *v
+		return &c
+	default:
+		return dns.Copy(rr)
+	}
+}
+
 func (r CachingResolver) String() string {
 	return fmt.Sprintf("caching resolver")
 }
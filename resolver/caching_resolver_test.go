@@ -1,7 +1,11 @@
 package resolver
 
 import (
+	"blocky/config"
 	"blocky/util"
+	"errors"
+	"fmt"
+	"net"
 	"testing"
 	"time"
 
@@ -12,7 +16,7 @@ import (
 )
 
 func Test_Resolve_A_WithCachingAndMinTtl(t *testing.T) {
-	sut := NewCachingResolver()
+	sut := NewCachingResolver(config.CachingConfig{})
 	m := &resolverMock{}
 	mockResp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
 
@@ -52,7 +56,7 @@ func Test_Resolve_A_WithCachingAndMinTtl(t *testing.T) {
 }
 
 func Test_Resolve_AAAA_WithCachingAndMinTtl(t *testing.T) {
-	sut := NewCachingResolver()
+	sut := NewCachingResolver(config.CachingConfig{})
 	m := &resolverMock{}
 
 	mockResp, err := util.NewMsgWithAnswer("example.com. 123 IN AAAA 2001:0db8:85a3:08d3:1319:8a2e:0370:7344")
@@ -93,7 +97,7 @@ func Test_Resolve_AAAA_WithCachingAndMinTtl(t *testing.T) {
 }
 
 func Test_Resolve_A_NegativeCache(t *testing.T) {
-	sut := NewCachingResolver()
+	sut := NewCachingResolver(config.CachingConfig{CacheTimeNegative: config.Duration(30 * time.Minute)})
 	m := &resolverMock{}
 
 	mockResp := new(dns.Msg)
@@ -130,7 +134,7 @@ func Test_Resolve_A_NegativeCache(t *testing.T) {
 }
 
 func Test_Resolve_MX(t *testing.T) {
-	sut := NewCachingResolver()
+	sut := NewCachingResolver(config.CachingConfig{})
 	m := &resolverMock{}
 	mockResp, err := util.NewMsgWithAnswer("google.de.\t180\tIN\tMX\t20\talt1.aspmx.l.google.com.")
 
@@ -154,7 +158,682 @@ func Test_Resolve_MX(t *testing.T) {
 }
 
 func Test_Configuration_CachingResolver(t *testing.T) {
-	sut := NewCachingResolver()
+	sut := NewCachingResolver(config.CachingConfig{})
 	c := sut.Configuration()
-	assert.Len(t, c, 2)
+	assert.Len(t, c, 8)
+	assert.Contains(t, c, "minCacheTimeInSec = 250")
+}
+
+func Test_Configuration_CachingResolver_DomainCachingTimes(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{
+		DomainMinCachingTime: map[string]config.Duration{"cdn.example.com": config.Duration(5 * time.Minute)},
+		DomainMaxCachingTime: map[string]config.Duration{"home.dyndns.org": config.Duration(time.Minute)},
+	})
+	c := sut.Configuration()
+	assert.Contains(t, c, "minCacheTimeInSec[cdn.example.com] = 300")
+	assert.Contains(t, c, "maxCacheTimeInSec[home.dyndns.org] = 60")
+}
+
+func Test_Resolve_MinMaxCachingTime(t *testing.T) {
+	domainTimes := func(domain string, d time.Duration) map[string]config.Duration {
+		return map[string]config.Duration{domain: config.Duration(d)}
+	}
+
+	tests := []struct {
+		cfg         config.CachingConfig
+		upstreamTTL uint32
+		expectedTTL uint32
+	}{
+		// default min
+		{config.CachingConfig{}, 5, 250},
+		{config.CachingConfig{MinCachingTime: config.Duration(time.Minute)}, 5, 60},
+		// min disabled
+		{config.CachingConfig{MinCachingTime: config.Duration(-1)}, 5, 5},
+		{config.CachingConfig{MaxCachingTime: config.Duration(time.Hour)}, 604800, 3600},
+		{config.CachingConfig{MaxCachingTime: config.Duration(time.Hour)}, 1000, 1000},
+		// max per domain (parent domain matches) lowers the global min
+		{config.CachingConfig{DomainMaxCachingTime: domainTimes("Example.com.", time.Minute)}, 3600, 60},
+		{config.CachingConfig{DomainMaxCachingTime: domainTimes("com", time.Minute)}, 30, 60},
+		{config.CachingConfig{DomainMaxCachingTime: domainTimes("other.com", time.Minute)}, 3600, 3600},
+		// min per domain raises the global max
+		{config.CachingConfig{MaxCachingTime: config.Duration(time.Minute),
+			DomainMinCachingTime: domainTimes("example.com", 5*time.Minute)}, 10, 300},
+		// most specific domain wins
+		{config.CachingConfig{DomainMinCachingTime: map[string]config.Duration{
+			"com":         config.Duration(time.Hour),
+			"example.com": config.Duration(10 * time.Minute),
+		}}, 10, 600},
+	}
+
+	for _, tt := range tests {
+		sut := NewCachingResolver(tt.cfg)
+		m := &resolverMock{}
+
+		mockResp, err := util.NewMsgWithAnswer(fmt.Sprintf("example.com. %d IN A 123.122.121.120", tt.upstreamTTL))
+		assert.NoError(t, err)
+
+		m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+		sut.Next(m)
+
+		request := &Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		}
+
+		resp, err := sut.Resolve(request)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expectedTTL, resp.Res.Answer[0].Header().Ttl)
+
+		// cached response has the adjusted TTL too
+		resp, err = sut.Resolve(request)
+		assert.NoError(t, err)
+		assert.Equal(t, CACHED, resp.rType)
+		assert.InDelta(t, tt.expectedTTL, resp.Res.Answer[0].Header().Ttl, 1)
+	}
+}
+
+func Test_Resolve_NegativeCache_NoDataWithSOA(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{CacheTimeNegative: config.Duration(30 * time.Minute)}).(*CachingResolver)
+	m := &resolverMock{}
+
+	mockResp := new(dns.Msg)
+	mockResp.Rcode = dns.RcodeSuccess
+	soa, err := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 300")
+	assert.NoError(t, err)
+
+	mockResp.Ns = []dns.RR{soa}
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+	sut.Next(m)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeAAAA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+
+	// lifetime is derived from SOA minimum
+	_, expiresAt, found := sut.cache.GetWithExpiration(cacheKey(dns.TypeAAAA, "example.com"))
+	assert.True(t, found)
+	assert.InDelta(t, 300, time.Until(expiresAt).Seconds(), 1)
+
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Equal(t, "CACHED NEGATIVE", resp.Reason)
+	assert.Len(t, resp.Res.Answer, 0)
+	assert.Len(t, resp.Res.Ns, 1)
+	assert.Len(t, m.Calls, 1)
+}
+
+func Test_Resolve_NegativeCache_Disabled(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{})
+	m := &resolverMock{}
+
+	mockResp := new(dns.Msg)
+	mockResp.Rcode = dns.RcodeNameError
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+	sut.Next(m)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	_, err := sut.Resolve(request)
+	assert.NoError(t, err)
+
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, resp.Res.Rcode)
+	assert.Len(t, m.Calls, 2)
+}
+
+func Test_Resolve_Prefetching(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{
+		MinCachingTime:    config.Duration(-1),
+		Prefetching:       true,
+		PrefetchThreshold: 2,
+	}).(*CachingResolver)
+	defer sut.Stop()
+
+	m := &resolverMock{}
+	mockResp, err := util.NewMsgWithAnswer("example.com. 6 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+	sut.Next(m)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	// first query: not frequent
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+
+	// second query: cache hit, threshold is reached -> prefetching is scheduled 5s before expiry
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, CACHED, resp.rType)
+	assert.Len(t, m.Calls, 1)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	// entry was refreshed in background
+	assert.Len(t, m.Calls, 2)
+
+	_, expiresAt, found := sut.cache.GetWithExpiration(cacheKey(dns.TypeA, "example.com"))
+	assert.True(t, found)
+	assert.True(t, time.Until(expiresAt) > 5*time.Second)
+}
+
+func Test_Resolve_Prefetching_NotFrequent(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{
+		MinCachingTime:        config.Duration(-1),
+		Prefetching:           true,
+		PrefetchThreshold:     2,
+		PrefetchMaxItemsCount: 1,
+	}).(*CachingResolver)
+	defer sut.Stop()
+
+	// max items count is reached -> other domains are not tracked
+	assert.False(t, sut.prefetching.countQuery("A:example.com"))
+	assert.True(t, sut.prefetching.countQuery("A:example.com"))
+	assert.False(t, sut.prefetching.countQuery("A:other.com"))
+	assert.False(t, sut.prefetching.countQuery("A:other.com"))
+	assert.Equal(t, 1, sut.prefetching.queryCounts.ItemCount())
+}
+
+func Test_Resolve_ServeStale(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{
+		MinCachingTime:   config.Duration(-1),
+		StaleGracePeriod: config.Duration(time.Minute),
+	})
+
+	m := &resolverMock{}
+
+	mockResp, err := util.NewMsgWithAnswer("example.com. 1 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	newResp, err := util.NewMsgWithAnswer("example.com. 1 IN A 123.122.121.121")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil).Once()
+	m.On("Resolve", mock.Anything).Return((*Response)(nil), errors.New("timeout")).Once()
+	m.On("Resolve", mock.Anything).Return(&Response{Res: newResp}, nil).Once()
+	sut.Next(m)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// entry is expired and resolution fails -> stale answer
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "STALE", resp.Reason)
+	assert.Equal(t, "example.com.	30	IN	A	123.122.121.120", resp.Res.Answer[0].String())
+
+	// successful resolution replaces stale entry
+	resp, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.	1	IN	A	123.122.121.121", resp.Res.Answer[0].String())
+
+	resp, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "CACHED", resp.Reason)
+	assert.Equal(t, "123.122.121.121", resp.Res.Answer[0].(*dns.A).A.String())
+
+	m.AssertExpectations(t)
+}
+
+func Test_Resolve_ServeStale_Disabled(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{
+		MinCachingTime: config.Duration(-1),
+	})
+
+	m := &resolverMock{}
+
+	mockResp, err := util.NewMsgWithAnswer("example.com. 1 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil).Once()
+	m.On("Resolve", mock.Anything).Return((*Response)(nil), errors.New("timeout")).Once()
+	sut.Next(m)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	_, err = sut.Resolve(request)
+	assert.Error(t, err)
+}
+
+func Test_Resolve_Servfail_NotCached(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{StaleGracePeriod: config.Duration(time.Minute)})
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	failed := new(dns.Msg)
+	failed.SetRcode(request.Req, dns.RcodeServerFailure)
+
+	recovered, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: failed}, nil).Once()
+	m.On("Resolve", mock.Anything).Return(&Response{Res: recovered}, nil).Once()
+	sut.Next(m)
+
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Res.Rcode)
+
+	// recovered upstream is used immediately
+	resp, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+
+	resp, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "CACHED", resp.Reason)
+	m.AssertExpectations(t)
+}
+
+func Test_Resolve_Servfail_CachedShortly(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{
+		CacheTimeServfail: config.Duration(time.Second),
+		StaleGracePeriod:  config.Duration(time.Minute),
+	})
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	failed := new(dns.Msg)
+	failed.SetRcode(request.Req, dns.RcodeServerFailure)
+
+	recovered, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: failed}, nil).Once()
+	m.On("Resolve", mock.Anything).Return(&Response{Res: recovered}, nil).Once()
+	sut.Next(m)
+
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+
+	// retries within the SERVFAIL caching time are answered from cache
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Res.Rcode)
+	assert.Equal(t, "CACHED SERVFAIL", resp.Reason)
+	m.AssertNumberOfCalls(t, "Resolve", 1)
+
+	// recovery is visible after the SERVFAIL caching time, the failure is not served as stale answer
+	time.Sleep(1100 * time.Millisecond)
+
+	resp, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Equal(t, "example.com.	300	IN	A	123.122.121.120", resp.Res.Answer[0].String())
+	m.AssertExpectations(t)
+
+	// caching time is capped
+	sut = NewCachingResolver(config.CachingConfig{CacheTimeServfail: config.Duration(time.Hour)})
+	assert.Equal(t, 30*time.Second, sut.(*CachingResolver).cacheTimeServfail)
+}
+
+func Test_Resolve_MaxItemsCount(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{MaxItemsCount: 1})
+	m := &resolverMock{}
+
+	mockResp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+	sut.Next(m)
+
+	for _, domain := range []string{"example.com.", "example.org."} {
+		_, err = sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(domain, dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+	}
+
+	c := sut.Configuration()
+	assert.Contains(t, c, "cache items count = 1")
+	assert.Contains(t, c, "cache evictions count = 1")
+}
+
+func Test_FlushCache(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{}).(*CachingResolver)
+	m := &resolverMock{}
+
+	mockResp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+	sut.Next(m)
+
+	fill := func() {
+		for _, domain := range []string{"example.com.", "www.example.com.", "myexample.com.", "example.org."} {
+			for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				_, err = sut.Resolve(&Request{
+					Req: util.NewMsgWithQuestion(domain, qType),
+					Log: logrus.NewEntry(logrus.New()),
+				})
+				assert.NoError(t, err)
+			}
+		}
+	}
+
+	fill()
+	assert.Equal(t, 8, sut.cache.ItemCount())
+
+	// domain with sub domains, all query types
+	assert.Equal(t, 4, sut.FlushCache("Example.com."))
+
+	_, found := sut.cache.Get(cacheKey(dns.TypeA, "myexample.com"))
+	assert.True(t, found)
+
+	// whole cache
+	assert.Equal(t, 4, sut.FlushCache(""))
+	assert.Equal(t, 0, sut.cache.ItemCount())
+}
+
+func Test_Resolve_ECSScope(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{}).(*CachingResolver)
+	m := &resolverMock{}
+
+	scoped, err := util.NewMsgWithAnswer("geo.example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+	scoped.SetEdns0(4096, false).IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.ParseIP("10.1.2.0")}}
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: scoped}, nil)
+	sut.Next(m)
+
+	request := func(subnet string) *Request {
+		req := util.NewMsgWithQuestion("geo.example.com.", dns.TypeA)
+		req.SetEdns0(4096, false).IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet)}}
+
+		return &Request{Req: req, Log: logrus.NewEntry(logrus.New())}
+	}
+
+	// same subnet: cached
+	for i := 0; i < 2; i++ {
+		_, err = sut.Resolve(request("10.1.2.0"))
+		assert.NoError(t, err)
+	}
+
+	m.AssertNumberOfCalls(t, "Resolve", 1)
+
+	// other subnet: not cached
+	_, err = sut.Resolve(request("10.1.3.0"))
+	assert.NoError(t, err)
+	m.AssertNumberOfCalls(t, "Resolve", 2)
+
+	_, found := sut.cache.Get(cacheKey(dns.TypeA, "geo.example.com"))
+	assert.False(t, found)
+
+	// entries for subnets are flushed with the domain
+	assert.Equal(t, 2, sut.FlushCache("example.com"))
+}
+
+func Test_Resolve_DNSSECRecords(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{}).(*CachingResolver)
+	m := &resolverMock{}
+
+	signed, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	sig, err := dns.NewRR("example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. " +
+		"dGVzdA==")
+	assert.NoError(t, err)
+
+	signed.Answer = append(signed.Answer, sig)
+	signed.AuthenticatedData = true
+	signed.SetEdns0(4096, true)
+
+	unsigned, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: unsigned}, nil).Once()
+	m.On("Resolve", mock.Anything).Return(&Response{Res: signed}, nil).Once()
+	sut.Next(m)
+
+	doRequest := func() *Request {
+		req := util.NewMsgWithQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(4096, true)
+
+		return &Request{Req: req, Log: logrus.NewEntry(logrus.New())}
+	}
+
+	_, err = sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+
+	// query with DO bit is not answered with the cached answer without signatures
+	for i := 0; i < 2; i++ {
+		resp, err := sut.Resolve(doRequest())
+		assert.NoError(t, err)
+		assert.Len(t, resp.Res.Answer, 2)
+		assert.True(t, resp.Res.AuthenticatedData)
+		assert.True(t, resp.Res.IsEdns0().Do())
+	}
+
+	m.AssertNumberOfCalls(t, "Resolve", 2)
+}
+
+func Test_Resolve_CheckingDisabled(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{}).(*CachingResolver)
+	m := &resolverMock{}
+
+	unvalidated, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	validated, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.121")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: unvalidated}, nil).Once()
+	m.On("Resolve", mock.Anything).Return(&Response{Res: validated}, nil).Once()
+	sut.Next(m)
+
+	cdRequest := util.NewMsgWithQuestion("example.com.", dns.TypeA)
+	cdRequest.CheckingDisabled = true
+
+	_, err = sut.Resolve(&Request{Req: cdRequest, Log: logrus.NewEntry(logrus.New())})
+	assert.NoError(t, err)
+
+	// unvalidated answer of the query with CD bit is not returned to other clients
+	for i := 0; i < 2; i++ {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "A (123.122.121.121)", util.AnswerToString(resp.Res.Answer))
+	}
+
+	m.AssertNumberOfCalls(t, "Resolve", 2)
+}
+
+func Test_Resolve_MixedCase(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{})
+	m := &resolverMock{}
+	mockResp, err := util.NewMsgWithAnswer("wWw.ExAmple.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+	sut.Next(m)
+
+	resolve := func(name string) *dns.Msg {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(name, dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp.Res
+	}
+
+	resolve("wWw.ExAmple.com.")
+
+	// other spelling: served from the same cache entry with the spelling of the query
+	for _, name := range []string{"www.example.com.", "WWW.EXAMPLE.COM."} {
+		res := resolve(name)
+		assert.Equal(t, name, res.Question[0].Name)
+		assert.Equal(t, name, res.Answer[0].Header().Name)
+	}
+
+	assert.Equal(t, 1, len(m.Calls))
+	assert.Equal(t, 1, sut.(*CachingResolver).CacheEntries())
+}
+
+func Test_Resolve_CNAMEPerQueryType(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{})
+	m := &resolverMock{}
+
+	respA, err := util.NewMsgWithAnswer("www.example.com. 300 IN CNAME cdn.example.net.")
+	assert.NoError(t, err)
+
+	rr, err := dns.NewRR("cdn.example.net. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	respA.Answer = append(respA.Answer, rr)
+
+	respAAAA, err := util.NewMsgWithAnswer("www.example.com. 300 IN CNAME cdn.example.net.")
+	assert.NoError(t, err)
+
+	rr, err = dns.NewRR("cdn.example.net. 300 IN AAAA 2001:db8::1")
+	assert.NoError(t, err)
+
+	respAAAA.Answer = append(respAAAA.Answer, rr)
+
+	isType := func(qType uint16) func(*Request) bool {
+		return func(req *Request) bool { return req.Req.Question[0].Qtype == qType }
+	}
+
+	m.On("Resolve", mock.MatchedBy(isType(dns.TypeA))).Return(&Response{Res: respA}, nil)
+	m.On("Resolve", mock.MatchedBy(isType(dns.TypeAAAA))).Return(&Response{Res: respAAAA}, nil)
+	sut.Next(m)
+
+	resolve := func(name string, qType uint16) *Response {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(name, qType),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	resolve("www.example.com.", dns.TypeA)
+
+	// CNAME chain cached for A is not used for AAAA
+	resp := resolve("WWW.example.com.", dns.TypeAAAA)
+	assert.Equal(t, RESOLVED, resp.rType)
+	assert.Equal(t, "CNAME (cdn.example.net.), AAAA (2001:db8::1)", util.AnswerToString(resp.Res.Answer))
+
+	resp = resolve("www.EXAMPLE.com.", dns.TypeA)
+	assert.Equal(t, CACHED, resp.rType)
+	assert.Equal(t, "www.EXAMPLE.com.", resp.Res.Answer[0].Header().Name)
+	// target of the chain is not changed
+	assert.Equal(t, "cdn.example.net.", resp.Res.Answer[1].Header().Name)
+	assert.Equal(t, "CNAME (cdn.example.net.), A (123.122.121.120)", util.AnswerToString(resp.Res.Answer))
+
+	resp = resolve("www.example.com.", dns.TypeAAAA)
+	assert.Equal(t, CACHED, resp.rType)
+	assert.Equal(t, "CNAME (cdn.example.net.), AAAA (2001:db8::1)", util.AnswerToString(resp.Res.Answer))
+
+	assert.Equal(t, 2, len(m.Calls))
+}
+
+func Test_Resolve_DecrementTTLs_MinTTL(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{MinCachingTime: -1}).(*CachingResolver)
+	m := &resolverMock{}
+
+	mockResp, err := util.NewMsgWithAnswer("example.com. 600 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	rr, err := dns.NewRR("example.com. 300 IN A 123.122.121.121")
+	assert.NoError(t, err)
+
+	mockResp.Answer = append(mockResp.Answer, rr)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mockResp}, nil)
+	sut.Next(m)
+
+	resolve := func() *Response {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	resolve()
+
+	// entry expires with the record with the smallest TTL
+	val, found := sut.cache.Get("A:example.com")
+	assert.True(t, found)
+
+	entry := val.(cachedAnswer)
+	assert.Equal(t, 300*time.Second, entry.expiresAt.Sub(entry.cachedAt))
+
+	age := func(d time.Duration) {
+		entry.cachedAt = entry.cachedAt.Add(-d)
+		entry.expiresAt = entry.expiresAt.Add(-d)
+		sut.cache.Set("A:example.com", entry, time.Hour)
+	}
+
+	// TTLs are decremented by the age of the entry (rounded up to full seconds)
+	age(100 * time.Second)
+
+	resp := resolve()
+	assert.Equal(t, CACHED, resp.rType)
+	assert.Equal(t, uint32(499), resp.Res.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(199), resp.Res.Answer[1].Header().Ttl)
+
+	// not below 1 second
+	age(199*time.Second + 500*time.Millisecond)
+
+	resp = resolve()
+	assert.Equal(t, CACHED, resp.rType)
+	assert.Equal(t, uint32(1), resp.Res.Answer[1].Header().Ttl)
+
+	// expired: not served from cache
+	age(time.Second)
+
+	resp = resolve()
+	assert.Equal(t, RESOLVED, resp.rType)
+	assert.Equal(t, 2, len(m.Calls))
 }
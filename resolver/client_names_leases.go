@@ -0,0 +1,270 @@
+package resolver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	leaseFormatDnsmasq = "dnsmasq"
+	leaseFormatISC     = "isc"
+	leaseFormatKea     = "kea"
+)
+
+// lease of the Kea API response (lease4-get-all / lease6-get-all)
+type keaLease struct {
+	IPAddress string `json:"ip-address"`
+	Hostname  string `json:"hostname"`
+}
+
+type keaResponse struct {
+	Arguments struct {
+		Leases []keaLease `json:"leases"`
+	} `json:"arguments"`
+}
+
+// parses the DHCP lease file in passed format and returns client names per IP. Invalid entries are logged and skipped
+func parseLeaseFile(path string, format string) (map[string][]string, error) {
+	switch format {
+	case "", leaseFormatDnsmasq:
+		return parseLeaseLines(path, parseDnsmasqLease)
+	case leaseFormatISC:
+		return parseISCLeaseFile(path)
+	case leaseFormatKea:
+		return parseKeaLeaseFile(path)
+	default:
+		return nil, fmt.Errorf("unknown lease file format '%s'", format)
+	}
+}
+
+// parses a lease file with one lease per line
+func parseLeaseLines(path string, parseLine func(fields []string) (ip net.IP, name string, ok bool)) (
+	map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := scanner.Text()
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip, name, ok := parseLine(fields)
+		if !ok {
+			logger("client_names_resolver").Warnf("invalid entry in lease file %s:%d: '%s'", path, lineNumber, line)
+			continue
+		}
+
+		if name != "" {
+			result[ip.String()] = []string{name}
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// dnsmasq format: "expiry MAC IP hostname client-id", hostname is "*" if unknown. Lines of the DUID (IPv6) have 3 fields
+func parseDnsmasqLease(fields []string) (net.IP, string, bool) {
+	if fields[0] == "duid" {
+		return nil, "", true
+	}
+
+	if len(fields) < 4 {
+		return nil, "", false
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, "", false
+	}
+
+	return ip, leaseHostName(fields[3]), true
+}
+
+// ISC dhcpd format: blocks "lease IP { ... client-hostname "name"; binding state active; ... }". Later leases of
+// the same IP replace earlier ones, only active leases are used
+func parseISCLeaseFile(path string) (map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	var (
+		ip     net.IP
+		name   string
+		active bool
+	)
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "lease":
+			ip, name, active = nil, "", true
+
+			if len(fields) != 3 || fields[2] != "{" || net.ParseIP(fields[1]) == nil {
+				logger("client_names_resolver").Warnf("invalid entry in lease file %s:%d: '%s'", path, lineNumber, line)
+				continue
+			}
+
+			ip = net.ParseIP(fields[1])
+		case ip == nil:
+			// outside of a lease block or in an invalid block
+			continue
+		case fields[0] == "client-hostname" && len(fields) == 2:
+			name = leaseHostName(strings.Trim(fields[1], "\""))
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			active = fields[2] == "active"
+		case fields[0] == "}":
+			if !active {
+				delete(result, ip.String())
+			} else if name != "" {
+				result[ip.String()] = []string{name}
+			}
+
+			ip = nil
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// Kea format: JSON response of the lease4-get-all or lease6-get-all command, as single object or list
+func parseKeaLeaseFile(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []keaResponse
+
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		err = json.Unmarshal(data, &responses)
+	} else {
+		responses = make([]keaResponse, 1)
+		err = json.Unmarshal(data, &responses[0])
+	}
+
+	if err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+			return nil, fmt.Errorf("invalid JSON in line %d: %v", line, err)
+		}
+
+		return nil, err
+	}
+
+	result := make(map[string][]string)
+
+	for _, response := range responses {
+		for i, lease := range response.Arguments.Leases {
+			ip := net.ParseIP(lease.IPAddress)
+			if ip == nil {
+				logger("client_names_resolver").Warnf("invalid entry in lease file %s: lease %d has invalid IP '%s'",
+					path, i+1, lease.IPAddress)
+
+				continue
+			}
+
+			if name := leaseHostName(lease.Hostname); name != "" {
+				result[ip.String()] = []string{name}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// normalizes host name of a lease, returns empty string for unknown host name
+func leaseHostName(name string) string {
+	if name == "*" {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// reads the lease file, the current names are kept if the file can't be read
+func (r *ClientNamesResolver) loadLeaseFile() {
+	r.leaseModTime = modTime(r.leaseFile)
+
+	names, err := parseLeaseFile(r.leaseFile, r.leaseFileFormat)
+	if err != nil {
+		logger("client_names_resolver").Errorf("can't read lease file %s: %v", r.leaseFile, err)
+		return
+	}
+
+	r.lock.Lock()
+	r.leaseNames = names
+	r.lock.Unlock()
+
+	logger("client_names_resolver").Debugf("lease file %s loaded, %d entries", r.leaseFile, len(names))
+}
+
+// returns client names from the lease file
+func (r *ClientNamesResolver) leaseClientNames(ip net.IP) []string {
+	if r.leaseFile == "" {
+		return nil
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.leaseNames[ip.String()]
+}
+
+func (r *ClientNamesResolver) periodicLeaseFileCheck(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !modTime(r.leaseFile).Equal(r.leaseModTime) {
+				r.loadLeaseFile()
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the periodic check of the lease file
+func (r *ClientNamesResolver) Stop() {
+	if r.stop != nil {
+		close(r.stop)
+	}
+}
@@ -0,0 +1,169 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/helpertest"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_parseLeaseFile_Dnsmasq(t *testing.T) {
+	file := helpertest.TempFile(`1700000000 aa:bb:cc:dd:ee:01 192.168.178.20 iPhone 01:aa:bb:cc:dd:ee:01
+1700000000 aa:bb:cc:dd:ee:02 192.168.178.21 * *
+invalid line
+duid 00:01:00:01:2a:2b:2c:2d:aa:bb:cc:dd:ee:ff
+1700000000 1234 fd00::22 laptop 00:01:00:01
+`)
+	defer os.Remove(file.Name())
+
+	names, err := parseLeaseFile(file.Name(), "dnsmasq")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"192.168.178.20": {"iphone"},
+		"fd00::22":       {"laptop"},
+	}, names)
+
+	_, err = parseLeaseFile("wrong/file", "")
+	assert.Error(t, err)
+
+	_, err = parseLeaseFile(file.Name(), "unknown")
+	assert.Error(t, err)
+}
+
+func Test_parseLeaseFile_ISC(t *testing.T) {
+	file := helpertest.TempFile(`# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.178.20 {
+  starts 4 2023/11/16 10:00:00;
+  binding state active;
+  next binding state free;
+  client-hostname "macbook";
+}
+lease 192.168.178.21 {
+  binding state active;
+  client-hostname "old-name";
+}
+lease 192.168.178.21 {
+  binding state free;
+}
+lease invalid {
+  client-hostname "invalid";
+}
+lease 192.168.178.22 {
+  client-hostname "tv";
+}
+`)
+	defer os.Remove(file.Name())
+
+	names, err := parseLeaseFile(file.Name(), "isc")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"192.168.178.20": {"macbook"},
+		"192.168.178.22": {"tv"},
+	}, names)
+}
+
+func Test_parseLeaseFile_Kea(t *testing.T) {
+	file := helpertest.TempFile(`[{
+  "arguments": {
+    "leases": [
+      {"ip-address": "192.168.178.20", "hostname": "printer.home.lan."},
+      {"ip-address": "invalid", "hostname": "invalid"},
+      {"ip-address": "192.168.178.21", "hostname": ""}
+    ]
+  },
+  "result": 0
+}]`)
+	defer os.Remove(file.Name())
+
+	names, err := parseLeaseFile(file.Name(), "kea")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"192.168.178.20": {"printer.home.lan"},
+	}, names)
+
+	single := helpertest.TempFile(`{"arguments": {"leases": [{"ip-address": "fd00::20", "hostname": "nas"}]}}`)
+	defer os.Remove(single.Name())
+
+	names, err = parseLeaseFile(single.Name(), "kea")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"fd00::20": {"nas"}}, names)
+
+	invalid := helpertest.TempFile("{\n  \"arguments\": {\n    \"leases\": [,]\n  }\n}")
+	defer os.Remove(invalid.Name())
+
+	_, err = parseLeaseFile(invalid.Name(), "kea")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 3")
+}
+
+func TestClientNamesLeaseFile(t *testing.T) {
+	file := helpertest.TempFile("1700000000 aa:bb:cc:dd:ee:01 192.168.178.20 iphone *\n" +
+		"1700000000 aa:bb:cc:dd:ee:02 192.168.178.21 laptop *\n")
+	defer os.Remove(file.Name())
+
+	sut := NewClientNamesResolver(config.ClientLookupConfig{
+		Clients:                map[string][]string{"192.168.178.21": {"static-laptop"}},
+		LeaseFile:              file.Name(),
+		LeaseFileRefreshPeriod: config.Duration(10 * time.Millisecond),
+	})
+	defer sut.(Stopper).Stop()
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	clientNames := func(ip string) []string {
+		request := &Request{ClientIP: net.ParseIP(ip), Log: logrus.NewEntry(logrus.New())}
+		_, err := sut.Resolve(request)
+		assert.NoError(t, err)
+
+		return request.ClientNames
+	}
+
+	assert.Equal(t, []string{"iphone"}, clientNames("192.168.178.20"))
+	// static names have precedence
+	assert.Equal(t, []string{"static-laptop"}, clientNames("192.168.178.21"))
+	assert.Equal(t, []string{"192.168.178.22"}, clientNames("192.168.178.22"))
+	assert.Contains(t, sut.Configuration(), "leaseFile = \""+file.Name()+"\" (2 entries)")
+
+	// change file, should be reloaded
+	err := ioutil.WriteFile(file.Name(), []byte("1700000000 aa:bb:cc:dd:ee:01 192.168.178.20 ipad *\n"), 0600)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chtimes(file.Name(), time.Now(), time.Now().Add(time.Minute)))
+
+	for i := 0; i < 100 && clientNames("192.168.178.20")[0] != "ipad"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, []string{"ipad"}, clientNames("192.168.178.20"))
+}
+
+func TestClientNamesLeaseFile_PrecedenceOverUpstream(t *testing.T) {
+	file := helpertest.TempFile("1700000000 aa:bb:cc:dd:ee:01 192.168.178.20 iphone *\n")
+	defer os.Remove(file.Name())
+
+	sut := NewClientNamesResolver(config.ClientLookupConfig{
+		Upstream:  config.Upstream{Net: "udp", Host: "192.0.2.1", Port: 53},
+		LeaseFile: file.Name(),
+	})
+	defer sut.(Stopper).Stop()
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	// no upstream call, the upstream is not reachable
+	request := &Request{ClientIP: net.ParseIP("192.168.178.20"), Log: logrus.NewEntry(logrus.New())}
+	_, err := sut.Resolve(request)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"iphone"}, request.ClientNames)
+}
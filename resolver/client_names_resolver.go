@@ -5,7 +5,10 @@ import (
 	"blocky/util"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -13,33 +16,178 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// ClientNamesResolver tries to determine client name by asking responsible DNS server vie rDNS (reverse lookup)
+const (
+	defaultClientNamesCacheTime   = time.Hour
+	negativeClientNamesCacheTime  = time.Minute
+	clientNamesCleanupInterval    = 10 * time.Minute
+	defaultMDNSTimeout            = 250 * time.Millisecond
+	defaultLeaseFileRefreshPeriod = time.Minute
+	mdnsPort                      = 5353
+)
+
+// ClientNamesResolver tries to determine client name by asking responsible DNS server vie rDNS (reverse lookup).
+// If enabled, clients without rDNS name are asked directly via mDNS.
+// Statically configured client names take precedence over names from the DHCP lease file, which take
+// precedence over the lookup
 type ClientNamesResolver struct {
 	cache            *cache.Cache
 	externalResolver Resolver
 	singleNameOrder  []uint
+	primaryNameOrder []uint
+	clientIPs        map[string][]string
+	clientCIDRs      []clientCIDR
+	// max duration of the mDNS lookup, 0 if mDNS is disabled
+	mdnsTimeout time.Duration
+	mdnsPort    uint16
+	// client names per IP from the DHCP lease file, replaced completely on reload
+	leaseFile       string
+	leaseFileFormat string
+	leaseModTime    time.Time
+	leaseNames      map[string][]string
+	lock            sync.RWMutex
+	stop            chan bool
 	NextResolver
 }
 
+// static client names for a network
+type clientCIDR struct {
+	cidr  *net.IPNet
+	names []string
+}
+
 func NewClientNamesResolver(cfg config.ClientLookupConfig) ChainedResolver {
 	var r Resolver
 	if (config.Upstream{}) != cfg.Upstream {
-		r = NewUpstreamResolver(cfg.Upstream)
+		r = NewUpstreamResolver(cfg.Upstream, nil)
+	}
+
+	clientIPs, clientCIDRs := parseStaticClients(cfg.Clients)
+
+	cacheTime := time.Duration(cfg.CacheTime)
+	if cacheTime <= 0 {
+		cacheTime = defaultClientNamesCacheTime
 	}
 
-	return &ClientNamesResolver{
-		cache:            cache.New(1*time.Hour, 1*time.Hour),
+	var mdnsTimeout time.Duration
+	if cfg.MDNS {
+		mdnsTimeout = time.Duration(cfg.MDNSTimeout)
+		if mdnsTimeout <= 0 {
+			mdnsTimeout = defaultMDNSTimeout
+		}
+	}
+
+	res := &ClientNamesResolver{
+		cache:            cache.New(cacheTime, clientNamesCleanupInterval),
 		externalResolver: r,
 		singleNameOrder:  cfg.SingleNameOrder,
+		primaryNameOrder: cfg.PrimaryNameOrder,
+		clientIPs:        clientIPs,
+		clientCIDRs:      clientCIDRs,
+		mdnsTimeout:      mdnsTimeout,
+		mdnsPort:         mdnsPort,
+		leaseFile:        cfg.LeaseFile,
+		leaseFileFormat:  cfg.LeaseFileFormat,
+	}
+
+	if res.leaseFile != "" {
+		res.loadLeaseFile()
+
+		period := time.Duration(cfg.LeaseFileRefreshPeriod)
+		if period <= 0 {
+			period = defaultLeaseFileRefreshPeriod
+		}
+
+		res.stop = make(chan bool)
+
+		go res.periodicLeaseFileCheck(period)
+	}
+
+	return res
+}
+
+// splits static client definitions into single IPs and networks, networks are sorted from most to least specific
+func parseStaticClients(clients map[string][]string) (map[string][]string, []clientCIDR) {
+	clientIPs := make(map[string][]string)
+
+	var clientCIDRs []clientCIDR
+
+	for key, names := range clients {
+		if strings.Contains(key, "/") {
+			_, cidr, err := net.ParseCIDR(key)
+			if err != nil {
+				logger("client_names_resolver").Warnf("invalid client CIDR '%s': %v", key, err)
+				continue
+			}
+
+			clientCIDRs = append(clientCIDRs, clientCIDR{cidr: cidr, names: names})
+
+			continue
+		}
+
+		ip := net.ParseIP(key)
+		if ip == nil {
+			logger("client_names_resolver").Warnf("invalid client IP '%s'", key)
+			continue
+		}
+
+		clientIPs[ip.String()] = names
+	}
+
+	sort.Slice(clientCIDRs, func(i, j int) bool {
+		iOnes, _ := clientCIDRs[i].cidr.Mask.Size()
+		jOnes, _ := clientCIDRs[j].cidr.Mask.Size()
+
+		return iOnes > jOnes
+	})
+
+	return clientIPs, clientCIDRs
+}
+
+// returns statically configured names for the IP, the single IP definition has precedence over networks
+func (r *ClientNamesResolver) staticClientNames(ip net.IP) []string {
+	if len(r.clientIPs) > 0 {
+		if names, ok := r.clientIPs[ip.String()]; ok {
+			return names
+		}
+	}
+
+	for _, c := range r.clientCIDRs {
+		if c.cidr.Contains(ip) {
+			return c.names
+		}
 	}
+
+	return nil
 }
 
 func (r *ClientNamesResolver) Configuration() (result []string) {
-	if r.externalResolver != nil {
+	if len(r.clientIPs) > 0 || len(r.clientCIDRs) > 0 {
+		result = append(result, fmt.Sprintf("static clients count = %d", len(r.clientIPs)+len(r.clientCIDRs)))
+	}
+
+	if r.leaseFile != "" {
+		r.lock.RLock()
+		result = append(result, fmt.Sprintf("leaseFile = \"%s\" (%d entries)", r.leaseFile, len(r.leaseNames)))
+		r.lock.RUnlock()
+	}
+
+	if r.externalResolver != nil || r.mdnsTimeout > 0 {
 		result = append(result, fmt.Sprintf("singleNameOrder = \"%v\"", r.singleNameOrder))
-		result = append(result, fmt.Sprintf("externalResolver = \"%s\"", r.externalResolver))
+
+		if len(r.primaryNameOrder) > 0 {
+			result = append(result, fmt.Sprintf("primaryNameOrder = \"%v\"", r.primaryNameOrder))
+		}
+
+		if r.externalResolver != nil {
+			result = append(result, fmt.Sprintf("externalResolver = \"%s\"", r.externalResolver))
+		}
+
+		if r.mdnsTimeout > 0 {
+			result = append(result, fmt.Sprintf("mdnsTimeout = %s", r.mdnsTimeout))
+		}
+
 		result = append(result, fmt.Sprintf("cache item count = %d", r.cache.ItemCount()))
-	} else {
+	} else if len(result) == 0 {
 		result = []string{"deactivated, use only IP address"}
 	}
 
@@ -47,10 +195,15 @@ func (r *ClientNamesResolver) Configuration() (result []string) {
 }
 
 func (r *ClientNamesResolver) Resolve(request *Request) (*Response, error) {
-	clientNames := r.getClientNames(request)
+	clientNames := request.ClientNames
+	if !request.FixedClientNames {
+		clientNames = r.getClientNames(request)
+		request.ClientNames = clientNames
+	}
 
-	request.ClientNames = clientNames
-	request.Log = request.Log.WithField("client_names", strings.Join(clientNames, "; "))
+	if request.Log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		request.Log = request.Log.WithField("client_names", strings.Join(clientNames, "; "))
+	}
 
 	return r.next.Resolve(request)
 }
@@ -58,6 +211,15 @@ func (r *ClientNamesResolver) Resolve(request *Request) (*Response, error) {
 // returns names of client
 func (r *ClientNamesResolver) getClientNames(request *Request) []string {
 	ip := request.ClientIP
+
+	if names := r.staticClientNames(ip); len(names) > 0 {
+		return names
+	}
+
+	if names := r.leaseClientNames(ip); len(names) > 0 {
+		return names
+	}
+
 	c, found := r.cache.Get(ip.String())
 
 	if found {
@@ -66,70 +228,143 @@ func (r *ClientNamesResolver) getClientNames(request *Request) []string {
 		}
 	}
 
-	names := r.resolveClientNames(ip, withPrefix(request.Log, "client_names_resolver"))
-	r.cache.Set(ip.String(), names, cache.DefaultExpiration)
+	names, resolved := r.resolveClientNames(ip, requestLogger(request, "client_names_resolver"))
+
+	// failed lookups are cached only briefly, to avoid a lookup for each query of the client
+	cacheTime := cache.DefaultExpiration
+	if !resolved {
+		cacheTime = negativeClientNamesCacheTime
+	}
+
+	r.cache.Set(ip.String(), names, cacheTime)
 
 	return names
 }
 
-// performs reverse DNS lookup
-func (r *ClientNamesResolver) resolveClientNames(ip net.IP, logger *logrus.Entry) (result []string) {
+// performs reverse DNS lookup and mDNS lookup as fallback, resolved is false if the lookup failed or returned no names
+func (r *ClientNamesResolver) resolveClientNames(ip net.IP, logger *logrus.Entry) (result []string, resolved bool) {
+	if r.externalResolver == nil && r.mdnsTimeout == 0 {
+		return []string{ip.String()}, true
+	}
+
+	reverse, err := dns.ReverseAddr(ip.String())
+
+	if err != nil {
+		logger.Warnf("can't create reverse address for %s", ip.String())
+		return
+	}
+
+	var clientNames []string
+
 	if r.externalResolver != nil {
-		reverse, err := dns.ReverseAddr(ip.String())
+		clientNames, err = r.reverseLookup(reverse, logger)
+	}
 
-		if err != nil {
-			logger.Warnf("can't create reverse address for %s", ip.String())
-			return
-		}
+	if len(clientNames) == 0 && r.mdnsTimeout > 0 {
+		clientNames = r.mdnsLookup(reverse, ip, logger)
+	}
 
-		resp, err := r.externalResolver.Resolve(&Request{
-			Req: util.NewMsgWithQuestion(reverse, dns.TypePTR),
-			Log: logger,
-		})
+	if err != nil && len(clientNames) == 0 {
+		return
+	}
 
-		if err != nil {
-			logger.Error("can't resolve client name", err)
-			return
-		}
+	resolved = len(clientNames) > 0
 
-		var clientNames []string
+	if !resolved {
+		clientNames = []string{ip.String()}
+	}
 
-		for _, answer := range resp.Res.Answer {
-			if t, ok := answer.(*dns.PTR); ok {
-				hostName := strings.TrimSuffix(t.Ptr, ".")
-				clientNames = append(clientNames, hostName)
+	if len(r.singleNameOrder) > 0 {
+		// optional: if singleNameOrder is set, use only one name in the defined order
+		for _, i := range r.singleNameOrder {
+			if i > 0 && int(i) <= len(clientNames) {
+				result = []string{clientNames[i-1]}
+				break
 			}
 		}
+	} else {
+		result = orderClientNames(clientNames, r.primaryNameOrder)
+	}
 
-		if len(clientNames) == 0 {
-			clientNames = []string{ip.String()}
-		}
+	logger.WithField("client_names", strings.Join(result, "; ")).Debug("resolved client name(s)")
 
-		// optional: if singleNameOrder is set, use only one name in the defined order
-		if len(r.singleNameOrder) > 0 {
-			for _, i := range r.singleNameOrder {
-				if i > 0 && int(i) <= len(clientNames) {
-					result = []string{clientNames[i-1]}
-					break
-				}
-			}
-		} else {
-			result = clientNames
+	return result, resolved
+}
+
+// asks the external resolver for PTR records of the reverse address
+func (r *ClientNamesResolver) reverseLookup(reverse string, logger *logrus.Entry) ([]string, error) {
+	resp, err := r.externalResolver.Resolve(&Request{
+		Req: util.NewMsgWithQuestion(reverse, dns.TypePTR),
+		Log: logger,
+	})
+
+	if err != nil {
+		logger.Error("can't resolve client name", err)
+		return nil, err
+	}
+
+	return ptrNames(resp.Res), nil
+}
+
+// asks the client directly for its name with an unicast mDNS query (RFC 6762, legacy unicast). The lookup is best
+// effort: errors are only logged and the lookup takes at most the mDNS timeout
+func (r *ClientNamesResolver) mdnsLookup(reverse string, ip net.IP, logger *logrus.Entry) []string {
+	client := &dns.Client{
+		Net:     "udp",
+		Timeout: r.mdnsTimeout,
+	}
+
+	resp, _, err := client.Exchange(util.NewMsgWithQuestion(reverse, dns.TypePTR),
+		net.JoinHostPort(ip.String(), strconv.Itoa(int(r.mdnsPort))))
+	if err != nil {
+		logger.Debugf("can't resolve client name with mDNS: %v", err)
+		return nil
+	}
+
+	return ptrNames(resp)
+}
+
+// returns host names of PTR records in the answer
+func ptrNames(msg *dns.Msg) (names []string) {
+	for _, answer := range msg.Answer {
+		if t, ok := answer.(*dns.PTR); ok {
+			names = append(names, strings.TrimSuffix(t.Ptr, "."))
 		}
+	}
 
-		logger.WithField("client_names", strings.Join(result, "; ")).Debug("resolved client name(s)")
-	} else {
-		result = []string{ip.String()}
+	return names
+}
+
+// sorts names to be independent of the order in the upstream answer. If primaryNameOrder is set, the first existing
+// name in the defined order (1-based index in sorted names) is the primary name and is moved to the first position
+func orderClientNames(names []string, primaryNameOrder []uint) []string {
+	result := make([]string, len(names))
+	copy(result, names)
+	sort.Strings(result)
+
+	for _, i := range primaryNameOrder {
+		if i > 0 && int(i) <= len(result) {
+			primary := result[i-1]
+			copy(result[1:i], result[0:i-1])
+			result[0] = primary
+
+			break
+		}
 	}
 
 	return result
 }
 
-func (r ClientNamesResolver) String() string {
+func (r *ClientNamesResolver) String() string {
 	return fmt.Sprintf("client names resolver")
 }
 
-// reset client name cache
-func (r *ClientNamesResolver) FlushCache() {
+// FlushCache removes all cached client names, returns number of removed entries
+func (r *ClientNamesResolver) FlushCache() int {
+	count := r.cache.ItemCount()
 	r.cache.Flush()
+
+	logger("client_names_resolver").Infof("flushed client names cache, removed %d entries", count)
+
+	return count
 }
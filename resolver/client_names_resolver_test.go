@@ -7,6 +7,7 @@ import (
 	"net"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -172,6 +173,57 @@ func TestClientInfoFromUpstreamMultipleNamesSingleNameOrder(t *testing.T) {
 	assert.Equal(t, "myhost2", request.ClientNames[0])
 }
 
+func TestClientInfoFromUpstreamMultipleNamesVaryingOrder(t *testing.T) {
+	var callCount int32
+
+	upstream := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		r, err := dns.ReverseAddr("192.168.178.25")
+		assert.NoError(t, err)
+
+		rr1, err := dns.NewRR(fmt.Sprintf("%s 300 IN PTR laptop.fritz.box", r))
+		assert.NoError(t, err)
+		rr2, err := dns.NewRR(fmt.Sprintf("%s 300 IN PTR laptop", r))
+		assert.NoError(t, err)
+
+		msg := new(dns.Msg)
+
+		// answer order changes on each call
+		if atomic.AddInt32(&callCount, 1)%2 == 0 {
+			msg.Answer = []dns.RR{rr1, rr2}
+		} else {
+			msg.Answer = []dns.RR{rr2, rr1}
+		}
+
+		return msg
+	})
+
+	for i := 0; i < 2; i++ {
+		sut := NewClientNamesResolver(config.ClientLookupConfig{
+			Upstream:         upstream,
+			PrimaryNameOrder: []uint{2, 1}})
+		m := &resolverMock{}
+		m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+		sut.Next(m)
+
+		request := &Request{
+			ClientIP: net.ParseIP("192.168.178.25"),
+			Log:      logrus.NewEntry(logrus.New())}
+		_, err := sut.Resolve(request)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"laptop.fritz.box", "laptop"}, request.ClientNames)
+	}
+
+	assert.Equal(t, int32(2), callCount)
+}
+
+func Test_orderClientNames(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, orderClientNames([]string{"c", "a", "b"}, nil))
+	assert.Equal(t, []string{"c", "a", "b"}, orderClientNames([]string{"c", "a", "b"}, []uint{3}))
+	assert.Equal(t, []string{"b", "a"}, orderClientNames([]string{"b", "a"}, []uint{5, 2, 1}))
+	assert.Equal(t, []string{"a", "b"}, orderClientNames([]string{"b", "a"}, []uint{0}))
+}
+
 func TestClientInfoFromUpstreamNotFound(t *testing.T) {
 	upstream := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
 		msg := new(dns.Msg)
@@ -237,3 +289,221 @@ func Test_Configuration_ClientNamesResolver_Disabled(t *testing.T) {
 	c := sut.Configuration()
 	assert.Equal(t, []string{"deactivated, use only IP address"}, c)
 }
+
+func TestClientNamesStatic(t *testing.T) {
+	callCount := 0
+	upstream := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		callCount++
+		r, err := dns.ReverseAddr("10.0.0.30")
+		assert.NoError(t, err)
+
+		response, err := util.NewMsgWithAnswer(fmt.Sprintf("%s 300 IN PTR myhost", r))
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	sut := NewClientNamesResolver(config.ClientLookupConfig{
+		Upstream: upstream,
+		Clients: map[string][]string{
+			"192.168.178.25":   {"laptop", "kids"},
+			"192.168.178.0/28": {"iot"},
+			"192.168.0.0/16":   {"home"},
+			"invalid":          {"invalid"},
+		},
+	})
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	resolve := func(ip string) []string {
+		request := &Request{
+			ClientIP: net.ParseIP(ip),
+			Log:      logrus.NewEntry(logrus.New())}
+		_, err := sut.Resolve(request)
+		assert.NoError(t, err)
+
+		return request.ClientNames
+	}
+
+	// single IP has precedence, multiple names
+	assert.Equal(t, []string{"laptop", "kids"}, resolve("192.168.178.25"))
+
+	// most specific network
+	assert.Equal(t, []string{"iot"}, resolve("192.168.178.3"))
+	assert.Equal(t, []string{"home"}, resolve("192.168.1.3"))
+	assert.Equal(t, 0, callCount)
+
+	// not configured: rDNS lookup
+	assert.Equal(t, []string{"myhost"}, resolve("10.0.0.30"))
+	assert.Equal(t, 1, callCount)
+
+	// names set by the caller are kept
+	request := &Request{
+		ClientIP:         net.ParseIP("192.168.178.25"),
+		ClientNames:      []string{"simulated"},
+		FixedClientNames: true,
+		Log:              logrus.NewEntry(logrus.New())}
+	_, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"simulated"}, request.ClientNames)
+}
+
+func TestClientNamesCache(t *testing.T) {
+	var callCount int32
+
+	upstream := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		atomic.AddInt32(&callCount, 1)
+
+		msg := new(dns.Msg)
+		msg.SetRcode(request, dns.RcodeNameError)
+
+		return msg
+	})
+
+	sut := NewClientNamesResolver(config.ClientLookupConfig{
+		Upstream:  upstream,
+		CacheTime: config.Duration(2 * time.Hour),
+	}).(*ClientNamesResolver)
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	request := &Request{ClientIP: net.ParseIP("192.168.178.25"),
+		Log: logrus.NewEntry(logrus.New())}
+	_, err := sut.Resolve(request)
+	assert.NoError(t, err)
+
+	// no name found: IP is cached only briefly
+	_, expiration, found := sut.cache.GetWithExpiration("192.168.178.25")
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Now().Add(negativeClientNamesCacheTime), expiration, time.Second)
+
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&callCount))
+
+	// flush: next query triggers lookup
+	assert.Equal(t, 1, sut.FlushCache())
+
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&callCount))
+}
+
+func TestClientNamesCacheTime(t *testing.T) {
+	upstream := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		r, err := dns.ReverseAddr("192.168.178.25")
+		assert.NoError(t, err)
+
+		response, err := util.NewMsgWithAnswer(fmt.Sprintf("%s 300 IN PTR myhost", r))
+		assert.NoError(t, err)
+
+		return response
+	})
+
+	sut := NewClientNamesResolver(config.ClientLookupConfig{
+		Upstream:  upstream,
+		CacheTime: config.Duration(2 * time.Hour),
+	}).(*ClientNamesResolver)
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	_, err := sut.Resolve(&Request{ClientIP: net.ParseIP("192.168.178.25"),
+		Log: logrus.NewEntry(logrus.New())})
+	assert.NoError(t, err)
+
+	_, expiration, found := sut.cache.GetWithExpiration("192.168.178.25")
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), expiration, time.Second)
+}
+
+func TestClientNamesMDNSFallback(t *testing.T) {
+	upstream := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetRcode(request, dns.RcodeNameError)
+
+		return msg
+	})
+
+	// client answers the unicast mDNS query
+	client := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer(fmt.Sprintf("%s 120 IN PTR iphone.local.", request.Question[0].Name))
+		assert.NoError(t, err)
+
+		return response
+	})
+
+	sut := NewClientNamesResolver(config.ClientLookupConfig{Upstream: upstream, MDNS: true}).(*ClientNamesResolver)
+	sut.mdnsPort = client.Port
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	request := &Request{ClientIP: net.ParseIP("127.0.0.1"),
+		Log: logrus.NewEntry(logrus.New())}
+	_, err := sut.Resolve(request)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"iphone.local"}, request.ClientNames)
+
+	_, expiration, found := sut.cache.GetWithExpiration("127.0.0.1")
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Now().Add(defaultClientNamesCacheTime), expiration, time.Second)
+}
+
+func TestClientNamesMDNSWithoutUpstream(t *testing.T) {
+	client := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer(fmt.Sprintf("%s 120 IN PTR macbook.local.", request.Question[0].Name))
+		assert.NoError(t, err)
+
+		return response
+	})
+
+	sut := NewClientNamesResolver(config.ClientLookupConfig{MDNS: true}).(*ClientNamesResolver)
+	sut.mdnsPort = client.Port
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	request := &Request{ClientIP: net.ParseIP("127.0.0.1"),
+		Log: logrus.NewEntry(logrus.New())}
+	_, err := sut.Resolve(request)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"macbook.local"}, request.ClientNames)
+	assert.Contains(t, sut.Configuration(), "mdnsTimeout = 250ms")
+}
+
+func TestClientNamesMDNSTimeout(t *testing.T) {
+	// client doesn't answer in time
+	client := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		time.Sleep(300 * time.Millisecond)
+
+		return new(dns.Msg)
+	})
+
+	sut := NewClientNamesResolver(config.ClientLookupConfig{
+		MDNS:        true,
+		MDNSTimeout: config.Duration(50 * time.Millisecond),
+	}).(*ClientNamesResolver)
+	sut.mdnsPort = client.Port
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	start := time.Now()
+	request := &Request{ClientIP: net.ParseIP("127.0.0.1"),
+		Log: logrus.NewEntry(logrus.New())}
+	_, err := sut.Resolve(request)
+
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 200*time.Millisecond)
+	assert.Equal(t, []string{"127.0.0.1"}, request.ClientNames)
+
+	// failed lookup is cached briefly
+	_, expiration, found := sut.cache.GetWithExpiration("127.0.0.1")
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Now().Add(negativeClientNamesCacheTime), expiration, time.Second)
+}
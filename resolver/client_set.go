@@ -0,0 +1,46 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+)
+
+// set of client definitions: names (wildcards like "tablet-*" are possible), IP addresses or networks in CIDR
+// notation (e.g. "192.168.178.0/24")
+type clientSet struct {
+	keys  []string
+	cidrs map[string]*net.IPNet
+}
+
+func newClientSet(keys []string) *clientSet {
+	cidrs := make(map[string]*net.IPNet)
+
+	for _, key := range keys {
+		if strings.Contains(key, "/") {
+			_, cidr, err := net.ParseCIDR(key)
+			if err != nil {
+				logger("client_set").Warnf("invalid client CIDR '%s': %v", key, err)
+				continue
+			}
+
+			cidrs[key] = cidr
+		}
+	}
+
+	return &clientSet{keys: keys, cidrs: cidrs}
+}
+
+// returns true if a definition matches the client IP or a client name of the request
+func (s *clientSet) contains(request *Request) bool {
+	for _, key := range s.keys {
+		if clientMatches(key, s.cidrs, request) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *clientSet) size() int {
+	return len(s.keys)
+}
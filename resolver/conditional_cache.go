@@ -0,0 +1,167 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/lru"
+	"blocky/util"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// caches answers of conditional upstreams (all query types) separately from the main cache, which is placed
+// after the conditional resolver in the chain. Answers of excluded zones are not cached
+type conditionalCache struct {
+	// configuration of the cache, the cache is shared on reload only if it's unchanged
+	cfg          config.ConditionalCachingConfig
+	minCacheTime time.Duration
+	maxCacheTime time.Duration
+	// lower case zones without trailing dot
+	excludedZones map[string]bool
+	cache         *lru.Cache
+}
+
+// returns nil if caching is disabled
+func newConditionalCache(cfg config.ConditionalCachingConfig) *conditionalCache {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	excluded := make(map[string]bool, len(cfg.ExcludedZones))
+	for _, zone := range cfg.ExcludedZones {
+		excluded[strings.ToLower(strings.Trim(strings.TrimSpace(zone), "."))] = true
+	}
+
+	return &conditionalCache{
+		cfg:           cfg,
+		minCacheTime:  time.Duration(cfg.MinCachingTime),
+		maxCacheTime:  time.Duration(cfg.MaxCachingTime),
+		excludedZones: excluded,
+		cache:         lru.New(cfg.MaxItemsCount, time.Minute),
+	}
+}
+
+// returns true if the domain is in an excluded zone
+func (c *conditionalCache) isExcluded(domain string) bool {
+	for len(domain) > 0 {
+		if c.excludedZones[domain] {
+			return true
+		}
+
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+
+		domain = domain[i+1:]
+	}
+
+	return false
+}
+
+// returns the cached answer of the query, nil if the query is not cached
+func (c *conditionalCache) get(request *Request) *Response {
+	question := request.Req.Question[0]
+	domain := util.ExtractDomain(question)
+
+	if c.isExcluded(domain) {
+		return nil
+	}
+
+	val, found := c.cache.Get(queryCacheKey(question.Qtype, domain, request))
+	if !found {
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(request.Req)
+
+	return val.(cachedAnswer).toResponse(request.Req, resp)
+}
+
+// puts successful and negative answers into the cache, TTLs of the answer are adjusted to min and max caching
+// time. Negative answers are cached with the TTL of the SOA record (max. the max caching time)
+func (c *conditionalCache) put(request *Request, res *dns.Msg) {
+	question := request.Req.Question[0]
+	domain := util.ExtractDomain(question)
+
+	if c.isExcluded(domain) {
+		return
+	}
+
+	entry := cachedAnswer{
+		rcode:         res.Rcode,
+		authenticated: res.AuthenticatedData,
+		cachedAt:      time.Now(),
+	}
+
+	var cacheTime time.Duration
+
+	switch {
+	case isNegative(res):
+		entry.ns = copyRRs(res.Ns)
+		cacheTime = c.negativeCacheTime(res)
+	case res.Rcode == dns.RcodeSuccess:
+		cacheTime = time.Duration(limitTTLs(res.Answer, c.minCacheTime, c.maxCacheTime)) * time.Second
+		entry.answer = copyRRs(res.Answer)
+	}
+
+	// zero duration would mean default expiration of the cache
+	if cacheTime > 0 {
+		entry.expiresAt = entry.cachedAt.Add(cacheTime)
+		c.cache.Set(queryCacheKey(question.Qtype, domain, request), entry, cacheTime)
+	}
+}
+
+func (c *conditionalCache) negativeCacheTime(res *dns.Msg) time.Duration {
+	for _, rr := range res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+
+			cacheTime := time.Duration(ttl) * time.Second
+			if c.maxCacheTime > 0 && cacheTime > c.maxCacheTime {
+				cacheTime = c.maxCacheTime
+			}
+
+			return cacheTime
+		}
+	}
+
+	return 0
+}
+
+// removes all cached answers for passed domain and its sub domains, the whole cache is cleared
+// if domain is empty. Returns number of removed entries
+func (c *conditionalCache) flush(domain string) int {
+	if domain == "" {
+		return c.cache.Clear()
+	}
+
+	return c.cache.DeleteMatching(func(key string) bool {
+		return cacheKeyMatchesDomain(key, domain)
+	})
+}
+
+func (c *conditionalCache) configuration() (result []string) {
+	result = append(result, fmt.Sprintf("cache = enabled (min = %s, max = %s, items = %d)",
+		c.minCacheTime, c.maxCacheTime, c.cache.ItemCount()))
+
+	zones := make([]string, 0, len(c.excludedZones))
+	for zone := range c.excludedZones {
+		zones = append(zones, zone)
+	}
+
+	sort.Strings(zones)
+
+	for _, zone := range zones {
+		result = append(result, fmt.Sprintf("cache excluded zone = %s", zone))
+	}
+
+	return
+}
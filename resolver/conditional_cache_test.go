@@ -0,0 +1,198 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_Resolve_Conditional_Caching(t *testing.T) {
+	var calls int32
+
+	sut := NewConditionalUpstreamResolver(config.ConditionalUpstreamConfig{
+		Mapping: map[string]config.ConditionalMapping{
+			"fritz.box": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+				atomic.AddInt32(&calls, 1)
+
+				if request.Question[0].Qtype == dns.TypeAAAA {
+					// NODATA
+					response := new(dns.Msg)
+
+					soa, _ := dns.NewRR("fritz.box. 3600 IN SOA fritz.box. admin.fritz.box. 1 3600 600 86400 30")
+					response.Ns = []dns.RR{soa}
+
+					return response
+				}
+
+				response, _ := util.NewMsgWithAnswer(fmt.Sprintf("%s 3600 IN A 192.168.178.2", request.Question[0].Name))
+
+				return response
+			})}},
+			"live.fritz.box": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+				atomic.AddInt32(&calls, 1)
+
+				response, _ := util.NewMsgWithAnswer(fmt.Sprintf("%s 3600 IN A 192.168.178.3", request.Question[0].Name))
+
+				return response
+			})}, DisableCache: true},
+		},
+		Caching: config.ConditionalCachingConfig{
+			Enabled:        true,
+			MaxCachingTime: config.Duration(time.Minute),
+			ExcludedZones:  []string{"Dyn.Fritz.Box."},
+		},
+	}, nil).(*ConditionalUpstreamResolver)
+
+	next := &resolverMock{}
+	next.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(next)
+
+	resolve := func(domain string, qType uint16) *Response {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(domain, qType),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	// TTL is limited to max caching time
+	resp := resolve("nas.fritz.box.", dns.TypeA)
+	assert.Equal(t, "CONDITIONAL", resp.Reason)
+	assert.Equal(t, uint32(60), resp.Res.Answer[0].Header().Ttl)
+
+	resp = resolve("NAS.fritz.box.", dns.TypeA)
+	assert.Equal(t, "CACHED", resp.Reason)
+	assert.Equal(t, CACHED, resp.Type())
+	assert.Equal(t, "NAS.fritz.box.", resp.Res.Answer[0].Header().Name)
+	assert.True(t, resp.Res.Answer[0].Header().Ttl <= 60)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// other query types are cached separately
+	resolve("nas.fritz.box.", dns.TypeMX)
+	resolve("nas.fritz.box.", dns.TypeMX)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// negative answer is cached with TTL of SOA record
+	resp = resolve("nas.fritz.box.", dns.TypeAAAA)
+	assert.Empty(t, resp.Res.Answer)
+
+	resp = resolve("nas.fritz.box.", dns.TypeAAAA)
+	assert.Equal(t, "CACHED NEGATIVE", resp.Reason)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// excluded zone
+	resolve("host.dyn.fritz.box.", dns.TypeA)
+	resp = resolve("host.dyn.fritz.box.", dns.TypeA)
+	assert.Equal(t, "CONDITIONAL", resp.Reason)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+
+	// zone with disabled caching
+	resolve("host.live.fritz.box.", dns.TypeA)
+	resp = resolve("host.live.fritz.box.", dns.TypeA)
+	assert.Equal(t, "CONDITIONAL", resp.Reason)
+	assert.Equal(t, int32(7), atomic.LoadInt32(&calls))
+
+	assert.Contains(t, sut.Configuration(), "cache = enabled (min = 0s, max = 1m0s, items = 3)")
+	assert.Contains(t, sut.Configuration(), "cache excluded zone = dyn.fritz.box")
+	assert.Contains(t, strings.Join(sut.Configuration(), "\n"), "live.fritz.box = \"")
+	assert.Contains(t, strings.Join(sut.Configuration(), "\n"), "(not cached)")
+
+	// flush
+	assert.Equal(t, 3, sut.FlushCache("nas.fritz.box."))
+
+	resp = resolve("nas.fritz.box.", dns.TypeA)
+	assert.Equal(t, "CONDITIONAL", resp.Reason)
+	assert.Equal(t, 1, sut.FlushCache(""))
+
+	next.AssertNotCalled(t, "Resolve", mock.Anything)
+}
+
+func Test_Resolve_Conditional_CachingDisabled(t *testing.T) {
+	sut, _ := setup()
+
+	request := func() *Request {
+		return &Request{
+			Req: util.NewMsgWithQuestion("fritz.box.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		}
+	}
+
+	_, err := sut.Resolve(request())
+	assert.NoError(t, err)
+
+	resp, err := sut.Resolve(request())
+	assert.NoError(t, err)
+	assert.Equal(t, "CONDITIONAL", resp.Reason)
+	assert.Equal(t, 0, sut.(*ConditionalUpstreamResolver).FlushCache(""))
+}
+
+func Test_Conditional_ShareCache(t *testing.T) {
+	var calls int32
+
+	cfg := config.ConditionalUpstreamConfig{
+		Mapping: map[string]config.ConditionalMapping{
+			"fritz.box": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+				atomic.AddInt32(&calls, 1)
+
+				response, _ := util.NewMsgWithAnswer(fmt.Sprintf("%s 3600 IN A 192.168.178.2", request.Question[0].Name))
+
+				return response
+			})}},
+		},
+		Caching: config.ConditionalCachingConfig{Enabled: true},
+	}
+
+	resolve := func(sut ChainedResolver) *Response {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("nas.fritz.box.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	old := NewConditionalUpstreamResolver(cfg, nil).(*ConditionalUpstreamResolver)
+	resolve(old)
+
+	// same mapping: cached answers are preserved
+	sut := NewConditionalUpstreamResolver(cfg, nil).(*ConditionalUpstreamResolver)
+	sut.ShareCache(old)
+
+	assert.Equal(t, "CACHED", resolve(sut).Reason)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// changed mapping: cached answers are removed
+	cfg.Mapping = map[string]config.ConditionalMapping{"fritz.box": cfg.Mapping["fritz.box"],
+		"other.box": cfg.Mapping["fritz.box"]}
+
+	sut = NewConditionalUpstreamResolver(cfg, nil).(*ConditionalUpstreamResolver)
+	sut.ShareCache(old)
+
+	assert.Equal(t, "CONDITIONAL", resolve(sut).Reason)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// changed caching configuration: cache isn't shared
+	resolve(old)
+
+	cfg.Caching.MaxItemsCount = 100
+
+	sut = NewConditionalUpstreamResolver(cfg, nil).(*ConditionalUpstreamResolver)
+	sut.ShareCache(old)
+
+	assert.Equal(t, "CONDITIONAL", resolve(sut).Reason)
+	assert.Equal(t, "CACHED", resolve(sut).Reason)
+	assert.Equal(t, "CACHED", resolve(old).Reason)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
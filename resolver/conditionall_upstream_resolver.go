@@ -3,31 +3,340 @@ package resolver
 import (
 	"blocky/config"
 	"blocky/util"
+	"bufio"
 	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
+const defaultMappingFileRefreshPeriod = time.Minute
+
 // ConditionalUpstreamResolver delegates DNS question to other DNS resolver dependent on domain name in question
 type ConditionalUpstreamResolver struct {
 	NextResolver
+	// zone -> resolver, replaced completely on reload of the mapping file
 	mapping map[string]Resolver
+	// zones with disabled caching, replaced together with mapping
+	uncachedZones map[string]bool
+	rewrite       map[string]string
+	configMapping map[string]config.ConditionalMapping
+	bootstrap     *Bootstrap
+	mappingFile   string
+	// modification time of the loaded mapping file and number of zones from it
+	fileModTime time.Time
+	fileZones   int
+	lock        sync.RWMutex
+	stop        chan bool
+	// nil if caching of conditional answers is disabled
+	cache *conditionalCache
 }
 
-func NewConditionalUpstreamResolver(cfg config.ConditionalUpstreamConfig) ChainedResolver {
-	m := make(map[string]Resolver)
-	for domain, upstream := range cfg.Mapping {
-		m[strings.ToLower(domain)] = NewUpstreamResolver(upstream)
+// NewConditionalUpstreamResolver creates new resolver instance. Mapping keys can be domain names or
+// IP networks in CIDR notation, which are converted to the corresponding reverse zones. If multiple upstreams
+// are defined for one key, they are used in configured order. Entries from the mapping file are reloaded,
+// if the file was changed. Answers are cached separately from the main cache, if caching is enabled and not
+// disabled for the zone
+func NewConditionalUpstreamResolver(cfg config.ConditionalUpstreamConfig, bootstrap *Bootstrap) ChainedResolver {
+	rewrite := make(map[string]string)
+	for from, to := range cfg.Rewrite {
+		rewrite[strings.ToLower(strings.Trim(from, "."))] = strings.ToLower(strings.Trim(to, "."))
+	}
+
+	r := &ConditionalUpstreamResolver{
+		rewrite:       rewrite,
+		configMapping: cfg.Mapping,
+		bootstrap:     bootstrap,
+		mappingFile:   cfg.MappingFile,
+		cache:         newConditionalCache(cfg.Caching),
+	}
+
+	r.mapping, r.uncachedZones = r.createMapping()
+
+	if r.mappingFile != "" {
+		period := time.Duration(cfg.MappingFileRefreshPeriod)
+		if period <= 0 {
+			period = defaultMappingFileRefreshPeriod
+		}
+
+		r.stop = make(chan bool)
+
+		go r.periodicMappingFileCheck(period)
 	}
 
-	return &ConditionalUpstreamResolver{mapping: m}
+	return r
+}
+
+// creates resolvers for entries from mapping file and config mapping and returns them with the zones, which are
+// not cached. Config mapping has precedence
+func (r *ConditionalUpstreamResolver) createMapping() (m map[string]Resolver, uncached map[string]bool) {
+	m = make(map[string]Resolver)
+	uncached = make(map[string]bool)
+
+	if r.mappingFile != "" {
+		r.fileModTime = modTime(r.mappingFile)
+
+		entries, err := parseConditionalMappingFile(r.mappingFile)
+		if err != nil {
+			logger("conditional_resolver").Errorf("can't read conditional mapping file %s: %v", r.mappingFile, err)
+		}
+
+		addConditionalMapping(m, uncached, entries, r.bootstrap)
+
+		r.fileZones = len(m)
+	}
+
+	addConditionalMapping(m, uncached, r.configMapping, r.bootstrap)
+
+	return m, uncached
+}
+
+// adds resolvers for passed entries, keys are normalized (lower case, without trailing dot) zones
+func addConditionalMapping(m map[string]Resolver, uncached map[string]bool,
+	entries map[string]config.ConditionalMapping, bootstrap *Bootstrap) {
+	for key, entry := range entries {
+		domains := []string{strings.ToLower(strings.TrimSuffix(key, "."))}
+
+		if strings.Contains(key, "/") {
+			zones, err := reverseZones(key)
+			if err != nil {
+				logger("conditional_resolver").Errorf("invalid conditional mapping '%s': %v", key, err)
+				continue
+			}
+
+			domains = zones
+		}
+
+		var resolver Resolver
+		if len(entry.Upstreams) == 1 {
+			resolver = NewUpstreamResolver(entry.Upstreams[0], bootstrap)
+		} else {
+			resolver = NewFailoverResolver(entry.Upstreams, bootstrap)
+		}
+
+		for _, domain := range domains {
+			m[domain] = resolver
+
+			if entry.DisableCache {
+				uncached[domain] = true
+			} else {
+				delete(uncached, domain)
+			}
+		}
+	}
+}
+
+// parses mapping file with one "domain upstream[,upstream]" entry per line. Lines starting with "#" are comments,
+// invalid lines are logged and skipped
+func parseConditionalMappingFile(path string) (map[string]config.ConditionalMapping, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make(map[string]config.ConditionalMapping)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			logger("conditional_resolver").Warnf("invalid entry in conditional mapping file %s:%d: '%s'",
+				path, lineNumber, line)
+
+			continue
+		}
+
+		upstreams, err := config.ParseUpstreams(strings.Join(fields[1:], ""))
+		if err == nil {
+			for _, u := range upstreams {
+				if u.Host == "" {
+					err = fmt.Errorf("empty upstream")
+				}
+			}
+		}
+
+		if err != nil {
+			logger("conditional_resolver").Warnf("invalid upstream in conditional mapping file %s:%d: %v",
+				path, lineNumber, err)
+
+			continue
+		}
+
+		result[fields[0]] = config.ConditionalMapping{Upstreams: upstreams}
+	}
+
+	return result, scanner.Err()
+}
+
+func (r *ConditionalUpstreamResolver) periodicMappingFileCheck(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !modTime(r.mappingFile).Equal(r.fileModTime) {
+				mapping, uncached := r.createMapping()
+
+				r.lock.Lock()
+				r.mapping, r.uncachedZones = mapping, uncached
+				r.lock.Unlock()
+
+				// cached answers can be from upstreams, which are not used anymore
+				r.FlushCache("")
+
+				logger("conditional_resolver").Infof("conditional mapping file reloaded, %d zones", r.fileZones)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the periodic check of the mapping file
+func (r *ConditionalUpstreamResolver) Stop() {
+	if r.stop != nil {
+		close(r.stop)
+	}
+}
+
+// FlushCache removes all cached conditional answers for passed domain and its sub domains, the whole cache
+// is cleared if domain is empty. Returns number of removed entries
+func (r *ConditionalUpstreamResolver) FlushCache(domain string) int {
+	if r.cache == nil {
+		return 0
+	}
+
+	return r.cache.flush(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), "."))
+}
+
+// ShareCache uses the cache of the passed resolver, cached answers are preserved on configuration reload.
+// They are removed, if the mapping was changed, since they can be from upstreams, which are not used anymore.
+// The cache isn't shared, if the caching configuration was changed
+func (r *ConditionalUpstreamResolver) ShareCache(other *ConditionalUpstreamResolver) {
+	if r.cache == nil || other.cache == nil {
+		return
+	}
+
+	if !reflect.DeepEqual(r.cache.cfg, other.cache.cfg) {
+		logger("conditional_resolver").Info("caching configuration was changed, conditional cache was reset")
+
+		return
+	}
+
+	r.cache.cache = other.cache.cache
+
+	if r.mappingFile != other.mappingFile || !reflect.DeepEqual(r.configMapping, other.configMapping) {
+		r.FlushCache("")
+	}
+}
+
+func (r *ConditionalUpstreamResolver) getMapping() (map[string]Resolver, map[string]bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.mapping, r.uncachedZones
+}
+
+// returns reverse zones (in-addr.arpa or ip6.arpa), which cover the network. Networks with prefix length,
+// which is not on the label boundary (8 bits for IPv4, 4 bits for IPv6), are split into multiple zones
+func reverseZones(cidr string) ([]string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, _ := network.Mask.Size()
+
+	bitsPerLabel, suffix := 8, "in-addr.arpa"
+	if network.IP.To4() == nil {
+		bitsPerLabel, suffix = 4, "ip6.arpa"
+	}
+
+	labelCount := (ones + bitsPerLabel - 1) / bitsPerLabel
+	extraBits := labelCount*bitsPerLabel - ones
+	zones := make([]string, 0, 1<<extraBits)
+
+	for k := 0; k < 1<<extraBits; k++ {
+		ip := make(net.IP, len(network.IP))
+		copy(ip, network.IP)
+
+		// set the bits between prefix length and label boundary
+		for j := 0; j < extraBits; j++ {
+			if k&(1<<(extraBits-1-j)) != 0 {
+				pos := ones + j
+				ip[pos/8] |= 0x80 >> (pos % 8)
+			}
+		}
+
+		labels := make([]string, 0, labelCount+1)
+
+		for i := labelCount - 1; i >= 0; i-- {
+			if bitsPerLabel == 8 {
+				labels = append(labels, strconv.Itoa(int(ip[i])))
+			} else {
+				labels = append(labels, strconv.FormatInt(int64(ip[i/2]>>(4*uint(1-i%2))&0xf), 16))
+			}
+		}
+
+		zones = append(zones, strings.Join(append(labels, suffix), "."))
+	}
+
+	return zones, nil
+}
+
+// returns the normalized zones of a mapping key
+func configuredZones(key string) []string {
+	if strings.Contains(key, "/") {
+		zones, _ := reverseZones(key)
+		return zones
+	}
+
+	return []string{strings.ToLower(strings.TrimSuffix(key, "."))}
 }
 
 func (r *ConditionalUpstreamResolver) Configuration() (result []string) {
-	if len(r.mapping) > 0 {
-		for key, val := range r.mapping {
-			result = append(result, fmt.Sprintf("%s = \"%s\"", key, val))
+	mapping, uncached := r.getMapping()
+
+	if len(mapping) > 0 || len(r.rewrite) > 0 {
+		// zones from the mapping file are not listed, there can be hundreds of them
+		if r.mappingFile != "" {
+			result = append(result, fmt.Sprintf("mappingFile = \"%s\" (%d zones)", r.mappingFile, r.fileZones))
+		}
+
+		for key := range r.configMapping {
+			for _, zone := range configuredZones(key) {
+				entry := fmt.Sprintf("%s = \"%s\"", zone, mapping[zone])
+				if r.cache != nil && uncached[zone] {
+					entry += " (not cached)"
+				}
+
+				result = append(result, entry)
+			}
+		}
+
+		for from, to := range r.rewrite {
+			result = append(result, fmt.Sprintf("rewrite %s = \"%s\"", from, to))
+		}
+
+		if r.cache != nil {
+			result = append(result, r.cache.configuration()...)
 		}
 	} else {
 		result = []string{"deactivated"}
@@ -36,30 +345,119 @@ func (r *ConditionalUpstreamResolver) Configuration() (result []string) {
 	return
 }
 
+// returns the domain with rewritten suffix, if a rewrite rule matches
+func (r *ConditionalUpstreamResolver) rewriteDomain(domain string) (string, bool) {
+	for suffix := domain; len(suffix) > 0; {
+		if to, found := r.rewrite[suffix]; found {
+			return strings.TrimSuffix(domain, suffix) + to, true
+		}
+
+		if i := strings.Index(suffix, "."); i >= 0 {
+			suffix = suffix[i+1:]
+		} else {
+			break
+		}
+	}
+
+	return "", false
+}
+
 func (r *ConditionalUpstreamResolver) Resolve(request *Request) (*Response, error) {
+	if len(r.rewrite) == 0 || len(request.Req.Question) == 0 {
+		return r.resolve(request)
+	}
+
+	question := request.Req.Question[0]
+
+	rewritten, found := r.rewriteDomain(util.ExtractDomain(question))
+	if !found {
+		return r.resolve(request)
+	}
+
+	withPrefix(request.Log, "conditional_resolver").WithFields(logrus.Fields{
+		"domain":    util.ExtractDomain(question),
+		"rewritten": rewritten,
+	}).Debug("rewriting query")
+
+	req := request.Req.Copy()
+	req.Question[0].Name = dns.Fqdn(rewritten)
+
+	response, err := r.resolve(&Request{
+		ClientIP:      request.ClientIP,
+		ClientNames:   request.ClientNames,
+		Req:           req,
+		Log:           request.Log,
+		Ctx:           request.Ctx,
+		UpstreamGroup: request.UpstreamGroup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// map owner names back to the original question, CNAME targets are left unchanged
+	res := response.Res.Copy()
+	res.Question = request.Req.Question
+
+	for _, rr := range res.Answer {
+		if strings.EqualFold(rr.Header().Name, req.Question[0].Name) {
+			rr.Header().Name = question.Name
+		}
+	}
+
+	response.Res = res
+
+	return response, nil
+}
+
+func (r *ConditionalUpstreamResolver) resolve(request *Request) (*Response, error) {
 	logger := withPrefix(request.Log, "conditional_resolver")
 
-	if len(r.mapping) > 0 {
+	mapping, uncached := r.getMapping()
+
+	if len(mapping) > 0 {
 		for _, question := range request.Req.Question {
 			domain := util.ExtractDomain(question)
 
-			// try with domain with and without sub-domains
+			// try with domain with and without sub-domains, the most specific zone wins
 			for len(domain) > 0 {
-				r, found := r.mapping[domain]
+				upstream, found := mapping[domain]
 				if found {
-					response, err := r.Resolve(request)
-					if err == nil {
-						response.Reason = "CONDITIONAL"
-						response.rType = CONDITIONAL
+					cache := r.cache
+					if uncached[domain] {
+						cache = nil
+					}
+
+					if cache != nil {
+						if response := cache.get(request); response != nil {
+							logger.WithField("domain", domain).Debug("conditional answer is cached")
+
+							return response, nil
+						}
+					}
+
+					// errors are returned and not passed to the next resolver to prevent leaking internal names
+					response, err := upstream.Resolve(request)
+					if err != nil {
+						requestLogger(request, "conditional_resolver").WithField("upstream", upstream).
+							Warnf("conditional upstream failed: %v", err)
+
+						return nil, err
+					}
+
+					response.Reason = "CONDITIONAL"
+					response.rType = CONDITIONAL
+
+					if cache != nil {
+						cache.put(request, response.Res)
 					}
 
 					logger.WithFields(logrus.Fields{
 						"answer":   util.AnswerToString(response.Res.Answer),
 						"domain":   domain,
-						"upstream": r,
+						"upstream": upstream,
 					}).Debugf("received response from conditional upstream")
 
-					return response, err
+					return response, nil
 				}
 
 				if i := strings.Index(domain, "."); i >= 0 {
@@ -71,11 +469,11 @@ func (r *ConditionalUpstreamResolver) Resolve(request *Request) (*Response, erro
 		}
 	}
 
-	logger.WithField("next_resolver", r.next).Trace("go to next resolver")
+	withDebugField(logger, "next_resolver", r.next).Trace("go to next resolver")
 
 	return r.next.Resolve(request)
 }
 
-func (r ConditionalUpstreamResolver) String() string {
+func (r *ConditionalUpstreamResolver) String() string {
 	return fmt.Sprintf("conditional resolver")
 }
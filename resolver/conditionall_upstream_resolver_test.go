@@ -4,7 +4,10 @@ import (
 	"blocky/config"
 	"blocky/util"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -14,19 +17,19 @@ import (
 
 func setup() (sut ChainedResolver, next *resolverMock) {
 	sut = NewConditionalUpstreamResolver(config.ConditionalUpstreamConfig{
-		Mapping: map[string]config.Upstream{
-			"fritz.box": TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+		Mapping: map[string]config.ConditionalMapping{
+			"fritz.box": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
 				response, _ = util.NewMsgWithAnswer(fmt.Sprintf("%s 123 IN A 123.124.122.122", request.Question[0].Name))
 
 				return response
-			}),
-			"other.box": TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+			})}},
+			"other.box": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
 				response, _ = util.NewMsgWithAnswer(fmt.Sprintf("%s 250 IN A 192.192.192.192", request.Question[0].Name))
 
 				return response
-			}),
+			})}},
 		},
-	})
+	}, nil)
 
 	next = &resolverMock{}
 
@@ -100,7 +103,199 @@ func Test_Configuration_ConditionalResolver_WithConfig(t *testing.T) {
 }
 
 func Test_Configuration_ConditionalResolver_Disabled(t *testing.T) {
-	sut := NewConditionalUpstreamResolver(config.ConditionalUpstreamConfig{})
+	sut := NewConditionalUpstreamResolver(config.ConditionalUpstreamConfig{}, nil)
 	c := sut.Configuration()
 	assert.Equal(t, []string{"deactivated"}, c)
 }
+
+func Test_reverseZones(t *testing.T) {
+	tests := map[string][]string{
+		"192.168.178.0/24": {"178.168.192.in-addr.arpa"},
+		"10.0.0.0/8":       {"10.in-addr.arpa"},
+		"192.168.0.0/23":   {"0.168.192.in-addr.arpa", "1.168.192.in-addr.arpa"},
+		"192.168.178.5/32": {"5.178.168.192.in-addr.arpa"},
+		"fd00::/8":         {"d.f.ip6.arpa"},
+		"2001:db8::/32":    {"8.b.d.0.1.0.0.2.ip6.arpa"},
+		"2001:db8::/31":    {"8.b.d.0.1.0.0.2.ip6.arpa", "9.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+
+	for cidr, expected := range tests {
+		zones, err := reverseZones(cidr)
+		assert.NoError(t, err, cidr)
+		assert.Equal(t, expected, zones, cidr)
+	}
+
+	_, err := reverseZones("192.168.178.0/33")
+	assert.Error(t, err)
+}
+
+func Test_Resolve_Conditional_ReverseZone(t *testing.T) {
+	sut := NewConditionalUpstreamResolver(config.ConditionalUpstreamConfig{
+		Mapping: map[string]config.ConditionalMapping{
+			"192.168.178.0/24": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+				response, _ = util.NewMsgWithAnswer(fmt.Sprintf("%s 123 IN PTR fritz.box.", request.Question[0].Name))
+
+				return response
+			})}},
+			"invalid/cidr": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+				return nil
+			})}},
+		},
+	}, nil)
+
+	next := &resolverMock{}
+	next.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(next)
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("1.178.168.192.in-addr.arpa.", dns.TypePTR),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "CONDITIONAL", resp.Reason)
+	assert.Equal(t, "1.178.168.192.in-addr.arpa.\t123\tIN\tPTR\tfritz.box.", resp.Res.Answer[0].String())
+	next.AssertNotCalled(t, "Resolve", mock.Anything)
+
+	// other network
+	_, err = sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("1.179.168.192.in-addr.arpa.", dns.TypePTR),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	next.AssertNumberOfCalls(t, "Resolve", 1)
+}
+
+func Test_Resolve_Conditional_AllUpstreamsFail(t *testing.T) {
+	unreachable := config.Upstream{Net: "udp", Host: "127.0.0.1", Port: 1}
+
+	sut := NewConditionalUpstreamResolver(config.ConditionalUpstreamConfig{
+		Mapping: map[string]config.ConditionalMapping{"corp.example.com": {Upstreams: config.Upstreams{unreachable, unreachable}}},
+	}, nil)
+
+	next := &resolverMock{}
+	next.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(next)
+
+	// error is returned (SERVFAIL), next resolver is not used
+	_, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("host.corp.example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.Error(t, err)
+	next.AssertNotCalled(t, "Resolve", mock.Anything)
+}
+
+func Test_Resolve_Conditional_Rewrite(t *testing.T) {
+	sut := NewConditionalUpstreamResolver(config.ConditionalUpstreamConfig{
+		Rewrite: map[string]string{"home": "fritz.box", "other.lan": "example.com"},
+		Mapping: map[string]config.ConditionalMapping{
+			"fritz.box": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+				response, _ = util.NewMsgWithAnswer(fmt.Sprintf("%s 123 IN CNAME nas-1.fritz.box.", request.Question[0].Name))
+				rr, _ := dns.NewRR("nas-1.fritz.box. 123 IN A 192.168.178.10")
+				response.Answer = append(response.Answer, rr)
+
+				return response
+			})}},
+		},
+	}, nil)
+
+	next := &resolverMock{}
+	next.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(next)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("NAS.home.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "CONDITIONAL", resp.Reason)
+	assert.Equal(t, "NAS.home.", resp.Res.Question[0].Name)
+	assert.Len(t, resp.Res.Answer, 2)
+	assert.Equal(t, "NAS.home.\t123\tIN\tCNAME\tnas-1.fritz.box.", resp.Res.Answer[0].String())
+	assert.Equal(t, "nas-1.fritz.box.\t123\tIN\tA\t192.168.178.10", resp.Res.Answer[1].String())
+	// original request is not changed
+	assert.Equal(t, "NAS.home.", request.Req.Question[0].Name)
+	next.AssertNotCalled(t, "Resolve", mock.Anything)
+
+	// rewritten domain without conditional mapping -> next resolver with rewritten query
+	_, err = sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("www.other.lan.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	next.AssertCalled(t, "Resolve", mock.MatchedBy(func(req *Request) bool {
+		return req.Req.Question[0].Name == "www.example.com."
+	}))
+
+	// no rewrite for other domains
+	_, err = sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("myhome.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	next.AssertCalled(t, "Resolve", mock.MatchedBy(func(req *Request) bool {
+		return req.Req.Question[0].Name == "myhome."
+	}))
+}
+
+func Test_Resolve_Conditional_MappingFile(t *testing.T) {
+	answerWith := func(ip string) config.Upstream {
+		return TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+			response, _ = util.NewMsgWithAnswer(fmt.Sprintf("%s 123 IN A %s", request.Question[0].Name, ip))
+
+			return response
+		})
+	}
+
+	corp, team, fromConfig := answerWith("10.0.0.1"), answerWith("10.0.1.1"), answerWith("10.0.2.1")
+
+	file, err := ioutil.TempFile("", "conditional")
+	assert.NoError(t, err)
+
+	defer os.Remove(file.Name())
+
+	_, err = fmt.Fprintf(file, "# internal zones\ncorp.example.com %s\nteam1.corp.example.com %s, %s\ninvalid\n"+
+		"config.example.com %s\n", corp, team, corp, corp)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	sut := NewConditionalUpstreamResolver(config.ConditionalUpstreamConfig{
+		Mapping:                  map[string]config.ConditionalMapping{"config.example.com": {Upstreams: config.Upstreams{fromConfig}}},
+		MappingFile:              file.Name(),
+		MappingFileRefreshPeriod: config.Duration(10 * time.Millisecond),
+	}, nil)
+
+	defer sut.(Stopper).Stop()
+
+	next := &resolverMock{}
+	next.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(next)
+
+	resolve := func(domain string) string {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(domain, dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return util.AnswerToString(resp.Res.Answer)
+	}
+
+	// the most specific zone wins, config mapping has precedence
+	assert.Equal(t, "A (10.0.0.1)", resolve("host.corp.example.com."))
+	assert.Equal(t, "A (10.0.1.1)", resolve("host.team1.corp.example.com."))
+	assert.Equal(t, "A (10.0.2.1)", resolve("host.config.example.com."))
+	assert.Contains(t, sut.Configuration(), fmt.Sprintf("mappingFile = \"%s\" (3 zones)", file.Name()))
+
+	// changed file is reloaded
+	assert.NoError(t, ioutil.WriteFile(file.Name(), []byte(fmt.Sprintf("corp.example.com %s\n", team)), 0600))
+	assert.NoError(t, os.Chtimes(file.Name(), time.Now(), time.Now().Add(time.Minute)))
+
+	for i := 0; i < 100 && resolve("host.corp.example.com.") != "A (10.0.1.1)"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, "A (10.0.1.1)", resolve("host.corp.example.com."))
+}
@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"blocky/config"
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// parses hosts file in format "IP name1 name2 # comment". Invalid lines are logged and skipped
+func parseHostsFile(path string) (map[string]config.CustomDNSEntries, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make(map[string]config.CustomDNSEntries)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			logger("custom_dns_resolver").Warnf("invalid entry in hosts file %s:%d: '%s'", path, lineNumber, line)
+			continue
+		}
+
+		entry := "A " + ip.String()
+		if ip.To4() == nil {
+			entry = "AAAA " + ip.String()
+		}
+
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			result[name] = append(result[name], entry)
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// reads all configured hosts files and remembers their modification times
+func (r *CustomDNSResolver) loadHostsFiles() map[string]config.CustomDNSEntries {
+	result := make(map[string]config.CustomDNSEntries)
+
+	for _, path := range r.hostsFiles {
+		r.hostsModTimes[path] = modTime(path)
+
+		entries, err := parseHostsFile(path)
+		if err != nil {
+			logger("custom_dns_resolver").Errorf("can't read hosts file %s: %v", path, err)
+			continue
+		}
+
+		for name, e := range entries {
+			result[name] = append(result[name], e...)
+		}
+	}
+
+	return result
+}
+
+func (r *CustomDNSResolver) hostsFilesChanged() bool {
+	for _, path := range r.hostsFiles {
+		if !modTime(path).Equal(r.hostsModTimes[path]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns modification time of the file or zero time, if file is not readable
+func modTime(path string) time.Time {
+	if info, err := os.Stat(path); err == nil {
+		return info.ModTime()
+	}
+
+	return time.Time{}
+}
+
+func (r *CustomDNSResolver) periodicHostsFilesCheck(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if r.hostsFilesChanged() {
+				records := r.createRecords(r.entries())
+
+				r.lock.Lock()
+				r.records = records
+				r.lock.Unlock()
+
+				logger("custom_dns_resolver").Infof("hosts files reloaded, %d entries", len(records.mapping))
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the periodic check of hosts files
+func (r *CustomDNSResolver) Stop() {
+	if r.stop != nil {
+		close(r.stop)
+	}
+}
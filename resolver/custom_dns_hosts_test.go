@@ -0,0 +1,86 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/helpertest"
+	"blocky/util"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_parseHostsFile(t *testing.T) {
+	file := helpertest.TempFile(`# comment
+192.168.178.10 nas nas.home.lan # NAS
+fd00::10       nas.home.lan
+
+invalid        name.lan
+192.168.178.11
+192.168.178.12	printer.lan.	Printer.home.lan
+`)
+	defer os.Remove(file.Name())
+
+	entries, err := parseHostsFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]config.CustomDNSEntries{
+		"nas":              {"A 192.168.178.10"},
+		"nas.home.lan":     {"A 192.168.178.10", "AAAA fd00::10"},
+		"printer.lan":      {"A 192.168.178.12"},
+		"printer.home.lan": {"A 192.168.178.12"},
+	}, entries)
+
+	_, err = parseHostsFile("wrong/file")
+	assert.Error(t, err)
+}
+
+func Test_Resolve_Custom_HostsFile(t *testing.T) {
+	file := helpertest.TempFile("192.168.178.10 nas.home.lan\n192.168.178.11 printer.lan\n")
+	defer os.Remove(file.Name())
+
+	sut := NewCustomDNSResolver(config.CustomDNSConfig{
+		Mapping:                 map[string]config.CustomDNSEntries{"printer.lan": {"A 192.168.178.20"}},
+		HostsFiles:              []string{file.Name(), "wrong/file"},
+		HostsFilesRefreshPeriod: config.Duration(10 * time.Millisecond),
+	})
+	defer sut.(Stopper).Stop()
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "upstream"}, nil)
+	sut.Next(m)
+
+	resolve := func(name string) string {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(name, dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		if len(resp.Res.Answer) == 1 {
+			return resp.Res.Answer[0].(*dns.A).A.String()
+		}
+
+		return resp.Reason
+	}
+
+	assert.Equal(t, "192.168.178.10", resolve("nas.home.lan."))
+	// config mapping has precedence
+	assert.Equal(t, "192.168.178.20", resolve("printer.lan."))
+
+	// change file, should be reloaded
+	err := ioutil.WriteFile(file.Name(), []byte("192.168.178.30 nas.home.lan\n"), 0600)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chtimes(file.Name(), time.Now(), time.Now().Add(time.Minute)))
+
+	for i := 0; i < 100 && resolve("nas.home.lan.") != "192.168.178.30"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, "192.168.178.30", resolve("nas.home.lan."))
+	assert.Equal(t, "192.168.178.20", resolve("printer.lan."))
+}
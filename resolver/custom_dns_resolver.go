@@ -5,94 +5,322 @@ import (
 	"blocky/util"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
-const customDNSTTL = 60 * 60
+const (
+	defaultCustomDNSTTL            = time.Hour
+	defaultHostsFilesRefreshPeriod = time.Minute
+	wildcardPrefix                 = "*."
+	// max number of CNAME records, which are followed inside of custom DNS entries
+	maxCustomCNAMEDepth = 10
+)
 
-// CustomDNSResolver resolves passed domain name to ip address defined in domain-IP map
+// CustomDNSResolver resolves passed domain name to DNS records defined in domain-records map.
+// If a domain is defined, but not the requested record type, an empty answer is returned
 type CustomDNSResolver struct {
 	NextResolver
-	mapping map[string]net.IP
+	mapping       map[string]config.CustomDNSEntries
+	hostsFiles    []string
+	hostsModTimes map[string]time.Time
+	ttl           uint32
+	exactMatch    bool
+	disablePTR    bool
+	records       *customRecords
+	lock          sync.RWMutex
+	stop          chan bool
+}
+
+// records created from configured entries, replaced completely on reload of hosts files
+type customRecords struct {
+	mapping   map[string][]dns.RR
+	wildcards map[string][]dns.RR
+	reverse   map[string][]dns.RR
+}
+
+func (c *customRecords) empty() bool {
+	return len(c.mapping) == 0 && len(c.wildcards) == 0
 }
 
 func NewCustomDNSResolver(cfg config.CustomDNSConfig) ChainedResolver {
-	m := make(map[string]net.IP)
-	for url, ip := range cfg.Mapping {
-		m[strings.ToLower(url)] = ip
+	ttl := time.Duration(cfg.CustomTTL)
+	if ttl <= 0 {
+		ttl = defaultCustomDNSTTL
+	}
+
+	r := &CustomDNSResolver{
+		mapping:       cfg.Mapping,
+		hostsFiles:    cfg.HostsFiles,
+		hostsModTimes: make(map[string]time.Time),
+		ttl:           uint32(ttl.Seconds()),
+		exactMatch:    cfg.ExactMatch,
+		disablePTR:    cfg.DisablePTR,
+	}
+
+	r.records = r.createRecords(r.entries())
+
+	if len(r.hostsFiles) > 0 {
+		period := time.Duration(cfg.HostsFilesRefreshPeriod)
+		if period <= 0 {
+			period = defaultHostsFilesRefreshPeriod
+		}
+
+		r.stop = make(chan bool)
+
+		go r.periodicHostsFilesCheck(period)
+	}
+
+	return r
+}
+
+// returns entries from hosts files and config mapping. Config mapping has precedence
+func (r *CustomDNSResolver) entries() map[string]config.CustomDNSEntries {
+	result := r.loadHostsFiles()
+
+	for domain, entries := range r.mapping {
+		result[strings.ToLower(strings.TrimSuffix(domain, "."))] = entries
 	}
 
-	return &CustomDNSResolver{mapping: m}
+	return result
+}
+
+func (r *CustomDNSResolver) createRecords(entries map[string]config.CustomDNSEntries) *customRecords {
+	records := &customRecords{
+		mapping:   make(map[string][]dns.RR),
+		wildcards: make(map[string][]dns.RR),
+		reverse:   make(map[string][]dns.RR),
+	}
+
+	for domain, domainEntries := range entries {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+		// wildcard entries are stored with the parent domain as key
+		target := records.mapping
+		if strings.HasPrefix(domain, wildcardPrefix) {
+			domain = strings.TrimPrefix(domain, wildcardPrefix)
+			target = records.wildcards
+		}
+
+		for _, entry := range domainEntries {
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s", dns.Fqdn(domain), r.ttl, entry))
+			if err != nil || rr == nil {
+				logger("custom_dns_resolver").Errorf("invalid custom DNS entry '%s' for '%s': %v", entry, domain, err)
+				continue
+			}
+
+			target[domain] = append(target[domain], rr)
+		}
+	}
+
+	if !r.disablePTR {
+		r.createReverseRecords(records)
+	}
+
+	return records
+}
+
+// creates PTR records for all A and AAAA entries (wildcard entries excluded)
+func (r *CustomDNSResolver) createReverseRecords(records *customRecords) {
+	domains := make([]string, 0, len(records.mapping))
+	for domain := range records.mapping {
+		domains = append(domains, domain)
+	}
+
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		for _, rr := range records.mapping[domain] {
+			var ip net.IP
+
+			switch v := rr.(type) {
+			case *dns.A:
+				ip = v.A
+			case *dns.AAAA:
+				ip = v.AAAA
+			default:
+				continue
+			}
+
+			reverse, err := dns.ReverseAddr(ip.String())
+			if err != nil {
+				continue
+			}
+
+			reverse = strings.TrimSuffix(reverse, ".")
+
+			ptr := new(dns.PTR)
+			ptr.Hdr = dns.RR_Header{Name: dns.Fqdn(reverse), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: r.ttl}
+			ptr.Ptr = dns.Fqdn(domain)
+
+			records.reverse[reverse] = append(records.reverse[reverse], ptr)
+		}
+	}
+}
+
+func (r *CustomDNSResolver) currentRecords() *customRecords {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.records
 }
 
 func (r *CustomDNSResolver) Configuration() (result []string) {
-	if len(r.mapping) > 0 {
-		for key, val := range r.mapping {
-			result = append(result, fmt.Sprintf("%s = \"%s\"", key, val))
+	records := r.currentRecords()
+
+	if records.empty() && len(r.hostsFiles) == 0 {
+		return []string{"deactivated"}
+	}
+
+	result = append(result, fmt.Sprintf("TTL = %d", r.ttl), fmt.Sprintf("exactMatch = %t", r.exactMatch),
+		fmt.Sprintf("PTR records = %d", len(records.reverse)))
+
+	if len(r.hostsFiles) > 0 {
+		result = append(result, fmt.Sprintf("hostsFiles = \"%s\"", strings.Join(r.hostsFiles, ", ")))
+	}
+
+	var entries []string
+	entries = append(entries, configurationEntries("", records.mapping)...)
+	entries = append(entries, configurationEntries(wildcardPrefix, records.wildcards)...)
+	sort.Strings(entries)
+
+	return append(result, entries...)
+}
+
+func configurationEntries(prefix string, mapping map[string][]dns.RR) (result []string) {
+	for key, val := range mapping {
+		entries := make([]string, len(val))
+		for i, rr := range val {
+			entries[i] = strings.TrimPrefix(rr.String(), rr.Header().String())
 		}
-	} else {
-		result = []string{"deactivated"}
+
+		result = append(result, fmt.Sprintf("%s%s = \"%s\"", prefix, key, strings.Join(entries, ", ")))
 	}
 
 	return
 }
 
-func isSupportedType(ip net.IP, question dns.Question) bool {
-	return (ip.To4() != nil && question.Qtype == dns.TypeA) ||
-		(strings.Contains(ip.String(), ":") && question.Qtype == dns.TypeAAAA)
+// returns records of the most specific matching entry: exact match, wildcard entry of a parent domain
+// or (if not exactMatch) the parent domain itself
+func (r *CustomDNSResolver) findRecords(records *customRecords, domain string) ([]dns.RR, bool) {
+	if rr, found := records.mapping[domain]; found {
+		return rr, true
+	}
+
+	for i := strings.Index(domain, "."); i >= 0; i = strings.Index(domain, ".") {
+		domain = domain[i+1:]
+
+		if rr, found := records.wildcards[domain]; found {
+			return rr, true
+		}
+
+		if rr, found := records.mapping[domain]; found && !r.exactMatch {
+			return rr, true
+		}
+	}
+
+	return nil, false
+}
+
+// returns copies of the records with passed type with the queried name as owner name
+func recordsOfType(records []dns.RR, name string, qType uint16) (result []dns.RR) {
+	for _, rr := range records {
+		if rr.Header().Rrtype == qType {
+			c := dns.Copy(rr)
+			c.Header().Name = name
+			result = append(result, c)
+		}
+	}
+
+	return
 }
 
 func (r *CustomDNSResolver) Resolve(request *Request) (*Response, error) {
 	logger := withPrefix(request.Log, "custom_dns_resolver")
 
-	if len(r.mapping) > 0 {
+	if current := r.currentRecords(); !current.empty() {
 		for _, question := range request.Req.Question {
 			domain := util.ExtractDomain(question)
-			for len(domain) > 0 {
-				ip, found := r.mapping[domain]
-				if found {
-					response := new(dns.Msg)
-					response.SetReply(request.Req)
 
-					if isSupportedType(ip, question) {
-						rr, err := util.CreateAnswerFromQuestion(question, ip, customDNSTTL)
-
-						if err == nil {
-							response.Answer = append(response.Answer, rr)
-
-							logger.WithFields(logrus.Fields{
-								"answer": util.AnswerToString(response.Answer),
-								"domain": domain,
-							}).Debugf("returning custom dns entry")
+			records, found := r.findRecords(current, domain)
+			if !found {
+				records, found = current.reverse[domain]
+			}
 
-							return &Response{Res: response, rType: CUSTOMDNS, Reason: "CUSTOM DNS"}, nil
-						}
+			if found {
+				response := new(dns.Msg)
+				response.SetReply(request.Req)
 
-						return nil, err
-					}
+				answer, err := r.answer(request, question, current, records)
+				if err != nil {
+					return nil, err
+				}
 
-					response.Rcode = dns.RcodeNameError
+				response.Answer = answer
 
-					return &Response{Res: response, rType: CUSTOMDNS, Reason: "CUSTOM DNS"}, nil
-				}
+				logger.WithFields(logrus.Fields{
+					"answer": util.AnswerToString(response.Answer),
+					"domain": domain,
+				}).Debugf("returning custom dns entry")
 
-				if i := strings.Index(domain, "."); i >= 0 {
-					domain = domain[i+1:]
-				} else {
-					break
-				}
+				return &Response{Res: response, rType: CUSTOMDNS, Reason: "CUSTOM DNS"}, nil
 			}
 		}
 	}
 
-	logger.WithField("resolver", r.next).Trace("go to next resolver")
+	withDebugField(logger, "resolver", r.next).Trace("go to next resolver")
 
 	return r.next.Resolve(request)
 }
 
-func (r CustomDNSResolver) String() string {
+// creates answer for the question from custom records. CNAME targets are resolved with custom records
+// or with the next resolver. Empty answer (NODATA), if no record with the requested type exists
+func (r *CustomDNSResolver) answer(request *Request, question dns.Question, current *customRecords,
+	records []dns.RR) ([]dns.RR, error) {
+	name := question.Name
+
+	var result []dns.RR
+
+	for depth := 0; depth < maxCustomCNAMEDepth; depth++ {
+		if answer := recordsOfType(records, name, question.Qtype); len(answer) > 0 {
+			return append(result, answer...), nil
+		}
+
+		cnames := recordsOfType(records, name, dns.TypeCNAME)
+		if len(cnames) == 0 {
+			return result, nil
+		}
+
+		result = append(result, cnames[0])
+		name = cnames[0].(*dns.CNAME).Target
+
+		var found bool
+		if records, found = r.findRecords(current, strings.ToLower(strings.TrimSuffix(name, "."))); !found {
+			// target is not a custom entry
+			resp, err := r.next.Resolve(&Request{
+				ClientIP:      request.ClientIP,
+				ClientNames:   request.ClientNames,
+				Req:           util.NewMsgWithQuestion(name, question.Qtype),
+				Log:           request.Log,
+				Ctx:           request.Ctx,
+				UpstreamGroup: request.UpstreamGroup,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			return append(result, resp.Res.Answer...), nil
+		}
+	}
+
+	return result, nil
+}
+
+func (r *CustomDNSResolver) String() string {
 	return fmt.Sprintf("custom resolver")
 }
@@ -3,8 +3,8 @@ package resolver
 import (
 	"blocky/config"
 	"blocky/util"
-	"net"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -14,7 +14,7 @@ import (
 
 func Test_Resolve_Custom_Name_Ip4_A(t *testing.T) {
 	sut := NewCustomDNSResolver(config.CustomDNSConfig{
-		Mapping: map[string]net.IP{"custom.domain": net.ParseIP("192.168.143.123")}})
+		Mapping: map[string]config.CustomDNSEntries{"custom.domain": {"A 192.168.143.123"}}})
 	m := &resolverMock{}
 	sut.Next(m)
 
@@ -32,7 +32,7 @@ func Test_Resolve_Custom_Name_Ip4_A(t *testing.T) {
 
 func Test_Resolve_Custom_Name_Ip4_AAAA(t *testing.T) {
 	sut := NewCustomDNSResolver(config.CustomDNSConfig{
-		Mapping: map[string]net.IP{"custom.domain": net.ParseIP("192.168.143.123")}})
+		Mapping: map[string]config.CustomDNSEntries{"custom.domain": {"A 192.168.143.123"}}})
 	m := &resolverMock{}
 	sut.Next(m)
 
@@ -41,15 +41,17 @@ func Test_Resolve_Custom_Name_Ip4_AAAA(t *testing.T) {
 		Log: logrus.NewEntry(logrus.New()),
 	}
 
+	// domain is defined, but has no AAAA record: empty answer
 	resp, err := sut.Resolve(request)
 	assert.NoError(t, err)
-	assert.Equal(t, dns.RcodeNameError, resp.Res.Rcode)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Empty(t, resp.Res.Answer)
 	m.AssertNotCalled(t, "Resolve", mock.Anything)
 }
 
 func Test_Resolve_Custom_Name_Ip6_AAAA(t *testing.T) {
 	sut := NewCustomDNSResolver(config.CustomDNSConfig{
-		Mapping: map[string]net.IP{"custom.domain": net.ParseIP("2001:0db8:85a3:0000:0000:8a2e:0370:7334")}})
+		Mapping: map[string]config.CustomDNSEntries{"custom.domain": {"AAAA 2001:0db8:85a3:0000:0000:8a2e:0370:7334"}}})
 	m := &resolverMock{}
 	sut.Next(m)
 
@@ -66,7 +68,7 @@ func Test_Resolve_Custom_Name_Ip6_AAAA(t *testing.T) {
 
 func Test_Resolve_Custom_Name_Subdomain(t *testing.T) {
 	sut := NewCustomDNSResolver(config.CustomDNSConfig{
-		Mapping: map[string]net.IP{"custom.domain": net.ParseIP("192.168.143.123")}})
+		Mapping: map[string]config.CustomDNSEntries{"custom.domain": {"A 192.168.143.123"}}})
 	m := &resolverMock{}
 	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
 	sut.Next(m)
@@ -85,7 +87,7 @@ func Test_Resolve_Custom_Name_Subdomain(t *testing.T) {
 
 func Test_Resolve_Delegate_Next(t *testing.T) {
 	sut := NewCustomDNSResolver(config.CustomDNSConfig{
-		Mapping: map[string]net.IP{"custom.domain": net.ParseIP("192.168.143.123")}})
+		Mapping: map[string]config.CustomDNSEntries{"custom.domain": {"A 192.168.143.123"}}})
 	m := &resolverMock{}
 	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
 	sut.Next(m)
@@ -100,11 +102,164 @@ func Test_Resolve_Delegate_Next(t *testing.T) {
 	m.AssertExpectations(t)
 }
 
+func Test_Resolve_Custom_RecordTypes(t *testing.T) {
+	sut := NewCustomDNSResolver(config.CustomDNSConfig{
+		Mapping: map[string]config.CustomDNSEntries{
+			"nas.home.lan":                 {"A 192.168.178.10", "AAAA fd00::10"},
+			"www.home.lan":                 {"CNAME nas.home.lan"},
+			"_acme-challenge.home.lan":     {`TXT "token"`},
+			"external.home.lan":            {"CNAME example.com"},
+			"mail.home.lan":                {"MX 10 nas.home.lan"},
+			"www.external.example.home.ln": {"CNAME www.external.example.home.ln"},
+		}})
+
+	external, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: external}, nil)
+	sut.Next(m)
+
+	resolve := func(name string, qType uint16) []string {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(name, qType),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+
+		result := make([]string, len(resp.Res.Answer))
+		for i, rr := range resp.Res.Answer {
+			result[i] = rr.String()
+		}
+
+		return result
+	}
+
+	assert.Equal(t, []string{"nas.home.lan.\t3600\tIN\tAAAA\tfd00::10"}, resolve("nas.home.lan.", dns.TypeAAAA))
+	assert.Equal(t, []string{
+		"www.home.lan.\t3600\tIN\tCNAME\tnas.home.lan.",
+		"nas.home.lan.\t3600\tIN\tA\t192.168.178.10"},
+		resolve("www.home.lan.", dns.TypeA))
+	assert.Equal(t, []string{"www.home.lan.\t3600\tIN\tCNAME\tnas.home.lan."}, resolve("www.home.lan.", dns.TypeCNAME))
+	assert.Equal(t, []string{"_acme-challenge.home.lan.\t3600\tIN\tTXT\t\"token\""},
+		resolve("_acme-challenge.home.lan.", dns.TypeTXT))
+	assert.Equal(t, []string{"mail.home.lan.\t3600\tIN\tMX\t10 nas.home.lan."}, resolve("mail.home.lan.", dns.TypeMX))
+
+	// NODATA: name is defined, type not
+	assert.Empty(t, resolve("_acme-challenge.home.lan.", dns.TypeA))
+	m.AssertNotCalled(t, "Resolve", mock.Anything)
+
+	// CNAME loop is limited
+	assert.Len(t, resolve("www.external.example.home.ln.", dns.TypeA), maxCustomCNAMEDepth)
+
+	// CNAME target is resolved by next resolver
+	assert.Equal(t, []string{
+		"external.home.lan.\t3600\tIN\tCNAME\texample.com.",
+		"example.com.\t300\tIN\tA\t123.122.121.120"},
+		resolve("external.home.lan.", dns.TypeA))
+	m.AssertNumberOfCalls(t, "Resolve", 1)
+}
+
 func Test_Configuration_CustomDNSResolver_WithConfig(t *testing.T) {
 	sut := NewCustomDNSResolver(config.CustomDNSConfig{
-		Mapping: map[string]net.IP{"custom.domain": net.ParseIP("192.168.143.123")}})
+		Mapping: map[string]config.CustomDNSEntries{"custom.domain": {"A 192.168.143.123"}}})
 	c := sut.Configuration()
-	assert.Len(t, c, 1)
+	assert.Len(t, c, 4)
+}
+
+func Test_Resolve_Custom_PTR(t *testing.T) {
+	mapping := map[string]config.CustomDNSEntries{
+		"nas.home.lan":   {"A 192.168.1.10", "AAAA fd00::10"},
+		"files.home.lan": {"A 192.168.1.10"},
+		"*.apps.lan":     {"A 192.168.1.20"},
+	}
+
+	resolve := func(sut ChainedResolver, name string) *Response {
+		m := &resolverMock{}
+		m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "upstream"}, nil)
+		sut.Next(m)
+
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(name, dns.TypePTR),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	sut := NewCustomDNSResolver(config.CustomDNSConfig{Mapping: mapping})
+
+	// all names of the IP
+	resp := resolve(sut, "10.1.168.192.in-addr.arpa.")
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Len(t, resp.Res.Answer, 2)
+	assert.Equal(t, "10.1.168.192.in-addr.arpa.\t3600\tIN\tPTR\tfiles.home.lan.", resp.Res.Answer[0].String())
+	assert.Equal(t, "10.1.168.192.in-addr.arpa.\t3600\tIN\tPTR\tnas.home.lan.", resp.Res.Answer[1].String())
+
+	// IPv6
+	resp = resolve(sut, "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.")
+	assert.Len(t, resp.Res.Answer, 1)
+	assert.Equal(t, "nas.home.lan.", resp.Res.Answer[0].(*dns.PTR).Ptr)
+
+	// no PTR for wildcard entries
+	resp = resolve(sut, "20.1.168.192.in-addr.arpa.")
+	assert.Equal(t, "upstream", resp.Reason)
+
+	// disabled
+	sut = NewCustomDNSResolver(config.CustomDNSConfig{Mapping: mapping, DisablePTR: true})
+	resp = resolve(sut, "10.1.168.192.in-addr.arpa.")
+	assert.Equal(t, "upstream", resp.Reason)
+}
+
+func Test_Resolve_Custom_Wildcard(t *testing.T) {
+	mapping := map[string]config.CustomDNSEntries{
+		"*.apps.home.lan":   {"A 192.168.178.100"},
+		"nas.apps.home.lan": {"A 192.168.178.10"},
+		"home.lan":          {"A 192.168.178.1"},
+	}
+
+	// returns the single answer record or the reason
+	resolve := func(sut ChainedResolver, name string) string {
+		m := &resolverMock{}
+		m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "upstream"}, nil)
+		sut.Next(m)
+
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(name, dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+
+		if len(resp.Res.Answer) == 1 {
+			return resp.Res.Answer[0].String()
+		}
+
+		return resp.Reason
+	}
+
+	for _, exactMatch := range []bool{false, true} {
+		sut := NewCustomDNSResolver(config.CustomDNSConfig{
+			Mapping:    mapping,
+			CustomTTL:  config.Duration(5 * time.Minute),
+			ExactMatch: exactMatch,
+		})
+
+		// wildcard
+		assert.Equal(t, "grafana.apps.home.lan.\t300\tIN\tA\t192.168.178.100", resolve(sut, "grafana.apps.home.lan."))
+		assert.Equal(t, "a.b.apps.home.lan.\t300\tIN\tA\t192.168.178.100", resolve(sut, "a.b.apps.home.lan."))
+
+		// more specific entry wins
+		assert.Equal(t, "nas.apps.home.lan.\t300\tIN\tA\t192.168.178.10", resolve(sut, "nas.apps.home.lan."))
+
+		// wildcard doesn't match the domain itself
+		if exactMatch {
+			assert.Equal(t, "upstream", resolve(sut, "apps.home.lan."))
+		} else {
+			assert.Equal(t, "apps.home.lan.\t300\tIN\tA\t192.168.178.1", resolve(sut, "apps.home.lan."))
+		}
+	}
 }
 
 func Test_Configuration_CustomDNSResolver__Disabled(t *testing.T) {
@@ -0,0 +1,123 @@
+package resolver
+
+import (
+	"blocky/metrics"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// DedupResolver coalesces identical concurrent queries: only the first query is passed to the next resolver,
+// other queries wait for its result and get a copy of it
+type DedupResolver struct {
+	NextResolver
+	lock     sync.Mutex
+	inFlight map[string]*inFlightQuery
+	// number of queries, which shared the result of an in-flight query
+	coalesced uint64
+}
+
+type inFlightQuery struct {
+	done     chan struct{}
+	response *Response
+	err      error
+	// the context of the leading query was done before it was resolved, waiters must not use its result
+	canceled bool
+}
+
+// returned to waiters, if the leading query didn't finish (e.g. panic)
+var errInFlightQueryFailed = errors.New("identical in-flight query failed")
+
+func NewDedupResolver() ChainedResolver {
+	return &DedupResolver{inFlight: make(map[string]*inFlightQuery)}
+}
+
+func (r *DedupResolver) Configuration() (result []string) {
+	return []string{fmt.Sprintf("coalesced queries = %d", atomic.LoadUint64(&r.coalesced))}
+}
+
+func (r *DedupResolver) Resolve(request *Request) (*Response, error) {
+	if len(request.Req.Question) != 1 {
+		return r.next.Resolve(request)
+	}
+
+	key := dedupKey(request)
+
+	for {
+		r.lock.Lock()
+
+		q, ok := r.inFlight[key]
+		if !ok {
+			q = &inFlightQuery{done: make(chan struct{}), err: errInFlightQueryFailed}
+			r.inFlight[key] = q
+			r.lock.Unlock()
+
+			return r.lead(key, q, request)
+		}
+
+		r.lock.Unlock()
+
+		atomic.AddUint64(&r.coalesced, 1)
+		metrics.RecordCoalescedQuery()
+		withPrefix(request.Log, "dedup_resolver").Debug("waiting for identical in-flight query")
+
+		select {
+		case <-q.done:
+			// the leading query was canceled by its client: retry with the own context
+			if q.canceled && request.Context().Err() == nil {
+				continue
+			}
+
+			return copyResponse(q.response, request.Req), q.err
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+	}
+}
+
+// resolves the query and passes the result to the waiters
+func (r *DedupResolver) lead(key string, q *inFlightQuery, request *Request) (*Response, error) {
+	// waiters must be released, even if the next resolver panics
+	defer func() {
+		r.lock.Lock()
+		delete(r.inFlight, key)
+		r.lock.Unlock()
+
+		close(q.done)
+	}()
+
+	q.response, q.err = r.next.Resolve(request)
+	q.canceled = request.Context().Err() != nil
+
+	return copyResponse(q.response, request.Req), q.err
+}
+
+// identical queries have the same name, type, class, DO and CD bit, EDNS client subnet and upstream group
+func dedupKey(request *Request) string {
+	req := request.Req
+	q := req.Question[0]
+
+	return fmt.Sprintf("%s|%d|%d|%t|%t|%s|%s", strings.ToLower(q.Name), q.Qtype, q.Qclass, isDNSSECRequested(req),
+		req.CheckingDisabled, ecsSubnet(req), request.UpstreamGroup)
+}
+
+// returns copy of the response with the ID of the request, each waiter can modify its own message
+func copyResponse(response *Response, req *dns.Msg) *Response {
+	if response == nil || response.Res == nil {
+		return response
+	}
+
+	result := *response
+	result.Res = response.Res.Copy()
+	result.Res.Id = req.Id
+
+	return &result
+}
+
+func (r *DedupResolver) String() string {
+	return fmt.Sprintf("dedup resolver")
+}
@@ -0,0 +1,183 @@
+package resolver
+
+import (
+	"blocky/util"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// answers queries after a delay, counts the queries
+type slowResolver struct {
+	lock    sync.Mutex
+	queries int
+}
+
+func (s *slowResolver) Resolve(request *Request) (*Response, error) {
+	s.lock.Lock()
+	s.queries++
+	s.lock.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := request.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(request.Req)
+	rr, _ := dns.NewRR(request.Req.Question[0].Name + " 300 IN A 123.122.121.120")
+	resp.Answer = []dns.RR{rr}
+
+	return &Response{Res: resp, Reason: "RESOLVED"}, nil
+}
+
+func (s *slowResolver) Configuration() []string {
+	return nil
+}
+
+func Test_Resolve_Dedup(t *testing.T) {
+	sut := NewDedupResolver()
+	next := &slowResolver{}
+	sut.Next(next)
+
+	newMsg := func(domain string, do bool) *dns.Msg {
+		msg := util.NewMsgWithQuestion(domain, dns.TypeA)
+		if do {
+			msg.SetEdns0(4096, true)
+		}
+
+		return msg
+	}
+
+	msgs := []*dns.Msg{
+		newMsg("example.com.", false),
+		newMsg("EXAMPLE.com.", false),
+		newMsg("example.com.", false),
+		// differs in DO bit
+		newMsg("example.com.", true),
+		newMsg("other.com.", false),
+	}
+
+	// differs in CD bit
+	cd := newMsg("example.com.", false)
+	cd.CheckingDisabled = true
+	msgs = append(msgs, cd)
+
+	responses := make([]*Response, len(msgs))
+
+	var wg sync.WaitGroup
+
+	for i, msg := range msgs {
+		wg.Add(1)
+
+		go func(i int, msg *dns.Msg) {
+			defer wg.Done()
+
+			resp, err := sut.Resolve(&Request{Req: msg, Log: logrus.NewEntry(logrus.New())})
+			assert.NoError(t, err)
+
+			responses[i] = resp
+		}(i, msg)
+
+		// first query is in flight
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, 4, next.queries)
+	assert.Equal(t, []string{"coalesced queries = 2"}, sut.Configuration())
+
+	// each response has own message with the ID of the request
+	for i, resp := range responses {
+		assert.Equal(t, msgs[i].Id, resp.Res.Id)
+	}
+
+	assert.False(t, responses[0].Res == responses[1].Res)
+}
+
+func Test_Resolve_Dedup_CanceledLeader(t *testing.T) {
+	sut := NewDedupResolver()
+	next := &slowResolver{}
+	sut.Next(next)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		_, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+			Ctx: ctx,
+		})
+		assert.Equal(t, context.Canceled, err)
+	}()
+
+	// first query is in flight
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	// waiter resolves the query again with its own context
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.	300	IN	A	123.122.121.120", resp.Res.Answer[0].String())
+
+	wg.Wait()
+
+	assert.Equal(t, 2, next.queries)
+}
+
+// panics after a delay
+type panicResolver struct{}
+
+func (p *panicResolver) Resolve(_ *Request) (*Response, error) {
+	time.Sleep(50 * time.Millisecond)
+
+	panic("resolver failed")
+}
+
+func (p *panicResolver) Configuration() []string {
+	return nil
+}
+
+func Test_Resolve_Dedup_PanicReleasesWaiters(t *testing.T) {
+	sut := NewDedupResolver()
+	sut.Next(&panicResolver{})
+
+	go func() {
+		defer func() {
+			assert.NotNil(t, recover())
+		}()
+
+		_, _ = sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+	}()
+
+	// first query is in flight
+	time.Sleep(10 * time.Millisecond)
+
+	_, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.Equal(t, errInFlightQueryFailed, err)
+	assert.Empty(t, sut.(*DedupResolver).inFlight)
+}
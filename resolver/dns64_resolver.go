@@ -0,0 +1,147 @@
+package resolver
+
+import (
+	"blocky/config"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// well-known NAT64 prefix (RFC 6052)
+const defaultDNS64Prefix = "64:ff9b::/96"
+
+// DNS64Resolver synthesizes AAAA records from A records for domains without native AAAA records (RFC 6147),
+// so IPv6-only clients can reach IPv4-only hosts via NAT64. Answers with native AAAA records are not changed.
+// Synthesized records can't be signed, so queries of clients with DO bit are not synthesized
+type DNS64Resolver struct {
+	NextResolver
+	prefix *net.IPNet
+}
+
+func NewDNS64Resolver(cfg config.DNS64Config) (ChainedResolver, error) {
+	if !cfg.Enabled {
+		return &DNS64Resolver{}, nil
+	}
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultDNS64Prefix
+	}
+
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix '%s': %v", prefix, err)
+	}
+
+	return &DNS64Resolver{prefix: network}, nil
+}
+
+func (r *DNS64Resolver) Configuration() (result []string) {
+	if r.prefix == nil {
+		return []string{"deactivated"}
+	}
+
+	return []string{fmt.Sprintf("prefix = %s", r.prefix)}
+}
+
+func (r *DNS64Resolver) Resolve(request *Request) (*Response, error) {
+	response, err := r.next.Resolve(request)
+	if err != nil || r.prefix == nil || !r.shouldSynthesize(request, response) {
+		return response, err
+	}
+
+	aRequest := *request
+	aRequest.Req = request.Req.Copy()
+	aRequest.Req.Question[0].Qtype = dns.TypeA
+
+	aResponse, err := r.next.Resolve(&aRequest)
+	if err != nil {
+		// the AAAA answer is still valid
+		requestLogger(request, "dns64_resolver").Warn("can't resolve A record for DNS64: ", err)
+
+		return response, nil
+	}
+
+	answer := make([]dns.RR, 0, len(aResponse.Res.Answer))
+
+	var synthesized int
+
+	for _, rr := range aResponse.Res.Answer {
+		switch v := rr.(type) {
+		case *dns.CNAME, *dns.DNAME:
+			answer = append(answer, rr)
+		case *dns.A:
+			answer = append(answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   v.Hdr.Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  v.Hdr.Class,
+					Ttl:    v.Hdr.Ttl,
+				},
+				AAAA: r.synthesizeIP(v.A),
+			})
+			synthesized++
+		}
+	}
+
+	if synthesized == 0 {
+		return response, nil
+	}
+
+	res := response.Res.Copy()
+	res.Answer = answer
+	res.Ns = nil
+	res.AuthenticatedData = false
+
+	withPrefix(request.Log, "dns64_resolver").WithField("domain", request.Req.Question[0].Name).
+		Debugf("synthesized %d AAAA records", synthesized)
+
+	return &Response{Res: res, Reason: "DNS64", Upstream: aResponse.Upstream}, nil
+}
+
+// AAAA queries with a NODATA answer (no error and no AAAA record) are synthesized, except for clients
+// with DO bit
+func (r *DNS64Resolver) shouldSynthesize(request *Request, response *Response) bool {
+	if len(request.Req.Question) != 1 || request.Req.Question[0].Qtype != dns.TypeAAAA ||
+		request.Req.Question[0].Qclass != dns.ClassINET {
+		return false
+	}
+
+	if response.Res.Rcode != dns.RcodeSuccess || isDNSSECRequested(request.Req) {
+		return false
+	}
+
+	for _, rr := range response.Res.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return false
+		}
+	}
+
+	return true
+}
+
+// embeds the IPv4 address in the prefix (RFC 6052, section 2.2): the address follows the prefix,
+// bits 64 to 71 are skipped
+func (r *DNS64Resolver) synthesizeIP(ip net.IP) net.IP {
+	result := make(net.IP, net.IPv6len)
+	copy(result, r.prefix.IP.To16())
+
+	ones, _ := r.prefix.Mask.Size()
+	pos := ones / 8
+
+	for _, b := range ip.To4() {
+		if pos == 8 {
+			pos++
+		}
+
+		result[pos] = b
+		pos++
+	}
+
+	return result
+}
+
+func (r *DNS64Resolver) String() string {
+	return "dns64 resolver"
+}
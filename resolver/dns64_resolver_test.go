@@ -0,0 +1,177 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// answers queries with the configured records per query type
+type dns64TestUpstream struct {
+	answers map[uint16][]string
+	queries []uint16
+}
+
+func (u *dns64TestUpstream) Resolve(request *Request) (*Response, error) {
+	qType := request.Req.Question[0].Qtype
+	u.queries = append(u.queries, qType)
+
+	answer, ok := u.answers[qType]
+	if !ok {
+		return nil, errors.New("no answer")
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(request.Req)
+
+	for _, a := range answer {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	if len(answer) == 0 {
+		soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300")
+		resp.Ns = []dns.RR{soa}
+	}
+
+	return &Response{Res: resp, Reason: "RESOLVED", Upstream: "udp:8.8.8.8"}, nil
+}
+
+func (u *dns64TestUpstream) Configuration() []string {
+	return nil
+}
+
+func Test_Resolve_DNS64_Synthesize(t *testing.T) {
+	sut, err := NewDNS64Resolver(config.DNS64Config{Enabled: true})
+	assert.NoError(t, err)
+	sut.Next(&dns64TestUpstream{answers: map[uint16][]string{
+		dns.TypeAAAA: {},
+		dns.TypeA: {
+			"www.example.com. 600 IN CNAME example.com.",
+			"example.com. 120 IN A 192.0.2.33",
+			"example.com. 120 IN A 198.51.100.1",
+		},
+	}})
+
+	resp, err := sut.Resolve(newRequest("www.example.com.", dns.TypeAAAA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Equal(t, "DNS64", resp.Reason)
+	assert.Equal(t, "udp:8.8.8.8", resp.Upstream)
+	assert.Empty(t, resp.Res.Ns)
+	assert.Len(t, resp.Res.Answer, 3)
+	assert.Equal(t, "www.example.com.	600	IN	CNAME	example.com.", resp.Res.Answer[0].String())
+	assert.Equal(t, "example.com.	120	IN	AAAA	64:ff9b::c000:221", resp.Res.Answer[1].String())
+	assert.Equal(t, "example.com.	120	IN	AAAA	64:ff9b::c633:6401", resp.Res.Answer[2].String())
+}
+
+func Test_Resolve_DNS64_Prefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+
+	for _, tt := range tests {
+		sut, err := NewDNS64Resolver(config.DNS64Config{Enabled: true, Prefix: tt.prefix})
+		assert.NoError(t, err)
+		sut.Next(&dns64TestUpstream{answers: map[uint16][]string{
+			dns.TypeAAAA: {},
+			dns.TypeA:    {"example.com. 120 IN A 192.0.2.33"},
+		}})
+
+		resp, err := sut.Resolve(newRequest("example.com.", dns.TypeAAAA, ""))
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, resp.Res.Answer[0].(*dns.AAAA).AAAA.String(), tt.prefix)
+	}
+}
+
+func Test_Resolve_DNS64_NotSynthesized(t *testing.T) {
+	answers := map[uint16][]string{
+		dns.TypeAAAA: {"example.com. 300 IN AAAA 2001:db8::1"},
+		dns.TypeA:    {"example.com. 120 IN A 192.0.2.33"},
+	}
+
+	upstream := &dns64TestUpstream{answers: answers}
+
+	// native AAAA record
+	sut, err := NewDNS64Resolver(config.DNS64Config{Enabled: true})
+	assert.NoError(t, err)
+	sut.Next(upstream)
+
+	resp, err := sut.Resolve(newRequest("example.com.", dns.TypeAAAA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "RESOLVED", resp.Reason)
+	assert.Equal(t, "AAAA (2001:db8::1)", util.AnswerToString(resp.Res.Answer))
+	assert.Equal(t, []uint16{dns.TypeAAAA}, upstream.queries)
+
+	// A query
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "A (192.0.2.33)", util.AnswerToString(resp.Res.Answer))
+
+	// client with DO bit
+	answers[dns.TypeAAAA] = []string{}
+	request := newRequest("example.com.", dns.TypeAAAA, "")
+	request.Req.SetEdns0(4096, true)
+
+	resp, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "RESOLVED", resp.Reason)
+	assert.Empty(t, resp.Res.Answer)
+
+	// no A record
+	answers[dns.TypeA] = []string{}
+
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeAAAA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "RESOLVED", resp.Reason)
+	assert.Empty(t, resp.Res.Answer)
+	assert.Len(t, resp.Res.Ns, 1)
+
+	// A lookup fails -> NODATA answer
+	delete(answers, dns.TypeA)
+
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeAAAA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "RESOLVED", resp.Reason)
+
+	// disabled
+	upstream = &dns64TestUpstream{answers: map[uint16][]string{dns.TypeAAAA: {}}}
+
+	sut, err = NewDNS64Resolver(config.DNS64Config{})
+	assert.NoError(t, err)
+	sut.Next(upstream)
+
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeAAAA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "RESOLVED", resp.Reason)
+	assert.Equal(t, []uint16{dns.TypeAAAA}, upstream.queries)
+}
+
+func Test_Configuration_DNS64(t *testing.T) {
+	sut, err := NewDNS64Resolver(config.DNS64Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deactivated"}, sut.Configuration())
+
+	sut, err = NewDNS64Resolver(config.DNS64Config{Enabled: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefix = 64:ff9b::/96"}, sut.Configuration())
+
+	_, err = NewDNS64Resolver(config.DNS64Config{Enabled: true, Prefix: "invalid"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,625 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// EDNS option code and info code of the Extended DNS Error (RFC 8914)
+	ednsOptionExtendedError = 15
+	extendedErrorBogus      = 6
+	// verified keys are cached at least for this time, even if the TTL is lower
+	minDNSKEYCacheTime = time.Minute
+)
+
+// root zone trust anchors (KSK-2017 and KSK-2024)
+// nolint:gochecknoglobals
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// the parent zone proved with NSEC/NSEC3 records, that it has no DS record for the zone: answer can't be validated
+var errInsecureDelegation = errors.New("insecure delegation")
+
+// DNSSECResolver validates signatures of upstream answers against the root trust anchor. Answers with valid
+// signatures get the AD flag, bogus answers are replaced with SERVFAIL. DNSSEC records are returned only to
+// clients with DO bit. Without validation, the query is passed unchanged
+type DNSSECResolver struct {
+	NextResolver
+	validate bool
+	anchors  []*dns.DS
+	lock     sync.Mutex
+	// verified keys per zone
+	keys map[string]verifiedKeys
+	// zones with proven insecure delegation and expiry of the proof
+	insecure map[string]time.Time
+	// expired entries of keys and insecure are removed at most once per minDNSKEYCacheTime
+	lastPruned time.Time
+}
+
+type verifiedKeys struct {
+	keys      []*dns.DNSKEY
+	expiresAt time.Time
+}
+
+func NewDNSSECResolver(validate bool) (ChainedResolver, error) {
+	anchors := make([]*dns.DS, len(rootTrustAnchors))
+
+	for i, a := range rootTrustAnchors {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor '%s': %v", a, err)
+		}
+
+		anchors[i] = rr.(*dns.DS)
+	}
+
+	return &DNSSECResolver{
+		validate: validate,
+		anchors:  anchors,
+		keys:     make(map[string]verifiedKeys),
+		insecure: make(map[string]time.Time),
+	}, nil
+}
+
+func (r *DNSSECResolver) Configuration() (result []string) {
+	if !r.validate {
+		return []string{"validation = disabled"}
+	}
+
+	result = append(result, "validation = enabled")
+
+	for _, a := range r.anchors {
+		result = append(result, fmt.Sprintf("trust anchor = %d", a.KeyTag))
+	}
+
+	return
+}
+
+func (r *DNSSECResolver) Resolve(request *Request) (*Response, error) {
+	// client with CD (checking disabled) validates itself
+	if !r.validate || request.Req.CheckingDisabled {
+		return r.next.Resolve(request)
+	}
+
+	clientOpt := request.Req.IsEdns0()
+	clientDO := clientOpt != nil && clientOpt.Do()
+
+	req := request.Req.Copy()
+	setDO(req)
+
+	response, err := r.next.Resolve(withReq(request, req))
+	if err != nil {
+		return nil, err
+	}
+
+	res := response.Res
+
+	if res.Rcode == dns.RcodeSuccess || res.Rcode == dns.RcodeNameError {
+		secure, err := r.validateMsg(request, res)
+		if err != nil {
+			requestLogger(request, "dnssec_resolver").Warnf("DNSSEC validation failed: %v", err)
+
+			return &Response{
+				Res:      bogusResponse(request.Req, err, clientOpt != nil),
+				Reason:   fmt.Sprintf("BOGUS (%v)", err),
+				Upstream: response.Upstream,
+			}, nil
+		}
+
+		res.AuthenticatedData = secure
+	}
+
+	if !clientDO {
+		stripDNSSECRecords(res, request.Req)
+	}
+
+	if clientOpt == nil {
+		removeOPT(res)
+	}
+
+	return response, nil
+}
+
+// validates signed RRsets of the answer and authority section. Returns true if all answer records are signed
+// with valid signatures, error if a signature is invalid or an unsigned record is not below a proven insecure
+// delegation (bogus). Denial of existence of the queried name is not proven
+func (r *DNSSECResolver) validateMsg(request *Request, msg *dns.Msg) (bool, error) {
+	secure := msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0
+
+	for i, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		rrsets, sigs := splitRRsets(section)
+
+		for key, rrset := range rrsets {
+			var err error
+
+			if len(sigs[key]) == 0 {
+				// unsigned records are only accepted in zones, which are proven to be insecure
+				err = r.proveInsecure(request, rrset[0].Header().Name)
+			} else {
+				err = r.verifyWithZoneKeys(request, rrset, sigs[key])
+			}
+
+			switch {
+			case err == errInsecureDelegation:
+				// only the answer section affects the AD flag
+				if i == 0 {
+					secure = false
+				}
+			case err != nil:
+				return false, err
+			}
+		}
+	}
+
+	return secure, nil
+}
+
+// verifies the RRset with the keys of the signer zone
+func (r *DNSSECResolver) verifyWithZoneKeys(request *Request, rrset []dns.RR, sigs []*dns.RRSIG) error {
+	signer := sigs[0].SignerName
+	owner := rrset[0].Header().Name
+
+	if !dns.IsSubDomain(signer, owner) {
+		return fmt.Errorf("signer '%s' is not a parent of '%s'", signer, owner)
+	}
+
+	keys, err := r.zoneKeys(request, signer, 0)
+	if err != nil {
+		return err
+	}
+
+	return verifyRRset(rrset, sigs, keys)
+}
+
+// returns the verified DNSKEYs of the zone, the chain of trust is followed to the root zone
+func (r *DNSSECResolver) zoneKeys(request *Request, zone string, depth int) ([]*dns.DNSKEY, error) {
+	zone = canonicalName(zone)
+
+	r.lock.Lock()
+	cached, found := r.keys[zone]
+	r.lock.Unlock()
+
+	if found && time.Now().Before(cached.expiresAt) {
+		return cached.keys, nil
+	}
+
+	if depth > dns.CountLabel(zone)+1 {
+		return nil, fmt.Errorf("chain of trust for '%s' is too long", zone)
+	}
+
+	var ds []*dns.DS
+
+	if zone == "." {
+		ds = r.anchors
+	} else {
+		var err error
+		if ds, err = r.zoneDS(request, zone, depth); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := r.query(request, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	rrsets, sigs := splitRRsets(resp.Answer)
+	key := rrsetKey(zone, dns.TypeDNSKEY)
+
+	if len(rrsets[key]) == 0 {
+		return nil, fmt.Errorf("no DNSKEY for zone '%s'", zone)
+	}
+
+	var keys, trusted []*dns.DNSKEY
+
+	for _, rr := range rrsets[key] {
+		k := rr.(*dns.DNSKEY)
+		keys = append(keys, k)
+
+		if matchesDS(k, ds) {
+			trusted = append(trusted, k)
+		}
+	}
+
+	// the key set must be signed by a key, which is referenced by DS record of the parent zone
+	if err := verifyRRset(rrsets[key], sigs[key], trusted); err != nil {
+		return nil, fmt.Errorf("DNSKEY of zone '%s' is not trusted: %v", zone, err)
+	}
+
+	ttl := time.Duration(keys[0].Hdr.Ttl) * time.Second
+	if ttl < minDNSKEYCacheTime {
+		ttl = minDNSKEYCacheTime
+	}
+
+	r.lock.Lock()
+	r.pruneExpired()
+	r.keys[zone] = verifiedKeys{keys: keys, expiresAt: time.Now().Add(ttl)}
+	r.lock.Unlock()
+
+	return keys, nil
+}
+
+// returns the verified DS records of the zone, signed by the parent zone
+func (r *DNSSECResolver) zoneDS(request *Request, zone string, depth int) ([]*dns.DS, error) {
+	resp, err := r.query(request, zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	rrsets, sigs := splitRRsets(resp.Answer)
+	key := rrsetKey(zone, dns.TypeDS)
+
+	if len(rrsets[key]) == 0 {
+		// signed zone without DS record: can't be validated if the parent proves the insecure delegation
+		return nil, r.proveInsecure(request, zone)
+	}
+
+	if len(sigs[key]) == 0 {
+		return nil, fmt.Errorf("DS of zone '%s' is not signed", zone)
+	}
+
+	parent := canonicalName(sigs[key][0].SignerName)
+	if parent == zone || !dns.IsSubDomain(parent, zone) {
+		return nil, fmt.Errorf("DS of zone '%s' is signed by '%s'", zone, parent)
+	}
+
+	parentKeys, err := r.zoneKeys(request, parent, depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyRRset(rrsets[key], sigs[key], parentKeys); err != nil {
+		return nil, fmt.Errorf("DS of zone '%s': %v", zone, err)
+	}
+
+	result := make([]*dns.DS, len(rrsets[key]))
+	for i, rr := range rrsets[key] {
+		result[i] = rr.(*dns.DS)
+	}
+
+	return result, nil
+}
+
+// returns errInsecureDelegation, if there is a zone cut between the root and the name, whose parent zone proves with
+// validated NSEC/NSEC3 records, that the cut has no DS record. Returns another error (bogus), if the name is in a
+// signed zone or the missing DS record is not proven
+func (r *DNSSECResolver) proveInsecure(request *Request, name string) error {
+	name = canonicalName(name)
+
+	if r.isProvenInsecure(name) {
+		return errInsecureDelegation
+	}
+
+	labels := dns.SplitDomainName(name)
+	// closest zone with verified keys, which encloses the current name
+	secureZone := "."
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		resp, err := r.query(request, zone, dns.TypeDS)
+		if err != nil {
+			return err
+		}
+
+		rrsets, _ := splitRRsets(resp.Answer)
+		if len(rrsets[rrsetKey(zone, dns.TypeDS)]) > 0 {
+			// signed delegation, keys of the child zone are verified with the DS records
+			if _, err := r.zoneKeys(request, zone, 0); err != nil {
+				return err
+			}
+
+			secureZone = zone
+
+			continue
+		}
+
+		delegation, ttl, err := r.verifyNoDS(request, zone, secureZone, resp.Ns)
+		if err != nil {
+			return err
+		}
+
+		if delegation {
+			r.setProvenInsecure(zone, ttl)
+
+			return errInsecureDelegation
+		}
+	}
+
+	return fmt.Errorf("'%s' is in signed zone '%s', but has no valid signature", name, secureZone)
+}
+
+// verifies the NSEC/NSEC3 records of a DS query without DS record, they must be signed by the enclosing secure zone.
+// Returns true if they prove an unsigned delegation (NS without DS), false if the name is no zone cut.
+// Returns an error if the missing DS record is not proven
+func (r *DNSSECResolver) verifyNoDS(request *Request, zone, secureZone string,
+	authority []dns.RR) (delegation bool, ttl uint32, err error) {
+	keys, err := r.zoneKeys(request, secureZone, 0)
+	if err != nil {
+		return false, 0, err
+	}
+
+	rrsets, sigs := splitRRsets(authority)
+
+	var nsec3s []*dns.NSEC3
+
+	for key, rrset := range rrsets {
+		t := rrset[0].Header().Rrtype
+		if t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+
+		if err := verifyRRset(rrset, sigs[key], keys); err != nil {
+			return false, 0, fmt.Errorf("denial of DS for '%s': %v", zone, err)
+		}
+
+		for _, rr := range rrset {
+			switch v := rr.(type) {
+			case *dns.NSEC:
+				if canonicalName(v.Hdr.Name) == zone {
+					return checkDSBitmap(zone, v.TypeBitMap, v.Hdr.Ttl)
+				}
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, v)
+			}
+		}
+	}
+
+	if len(nsec3s) > 0 {
+		return checkNSEC3NoDS(zone, nsec3s)
+	}
+
+	return false, 0, fmt.Errorf("missing denial of DS for '%s'", zone)
+}
+
+// checks NSEC3 records: matching record for the zone or opt-out record, which covers the zone, with closest
+// encloser proof of the parent name (RFC 5155, section 8.6)
+func checkNSEC3NoDS(zone string, nsec3s []*dns.NSEC3) (delegation bool, ttl uint32, err error) {
+	for _, n := range nsec3s {
+		if n.Match(zone) {
+			return checkDSBitmap(zone, n.TypeBitMap, n.Hdr.Ttl)
+		}
+	}
+
+	parent := "."
+	if labels := dns.SplitDomainName(zone); len(labels) > 1 {
+		parent = dns.Fqdn(strings.Join(labels[1:], "."))
+	}
+
+	var parentMatch, optOutCover bool
+
+	for _, n := range nsec3s {
+		parentMatch = parentMatch || n.Match(parent)
+		optOutCover = optOutCover || (n.Flags&1 == 1 && n.Cover(zone))
+		ttl = n.Hdr.Ttl
+	}
+
+	if parentMatch && optOutCover {
+		return true, ttl, nil
+	}
+
+	return false, 0, fmt.Errorf("missing denial of DS for '%s'", zone)
+}
+
+// the type bitmap of the name proves an unsigned delegation, if it contains NS, but neither DS nor SOA
+func checkDSBitmap(zone string, types []uint16, ttl uint32) (delegation bool, _ uint32, err error) {
+	var hasNS, hasSOA bool
+
+	for _, t := range types {
+		switch t {
+		case dns.TypeDS:
+			return false, 0, fmt.Errorf("denial of DS for '%s' contains DS type", zone)
+		case dns.TypeNS:
+			hasNS = true
+		case dns.TypeSOA:
+			hasSOA = true
+		}
+	}
+
+	return hasNS && !hasSOA, ttl, nil
+}
+
+// returns true if the name is in a zone with proven insecure delegation
+func (r *DNSSECResolver) isProvenInsecure(name string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for zone, expiresAt := range r.insecure {
+		if time.Now().Before(expiresAt) && dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *DNSSECResolver) setProvenInsecure(zone string, ttl uint32) {
+	cacheTime := time.Duration(ttl) * time.Second
+	if cacheTime < minDNSKEYCacheTime {
+		cacheTime = minDNSKEYCacheTime
+	}
+
+	r.lock.Lock()
+	r.pruneExpired()
+	r.insecure[zone] = time.Now().Add(cacheTime)
+	r.lock.Unlock()
+}
+
+// removes expired keys and insecure proofs, must be called with lock
+func (r *DNSSECResolver) pruneExpired() {
+	now := time.Now()
+	if now.Sub(r.lastPruned) < minDNSKEYCacheTime {
+		return
+	}
+
+	r.lastPruned = now
+
+	for zone, cached := range r.keys {
+		if !now.Before(cached.expiresAt) {
+			delete(r.keys, zone)
+		}
+	}
+
+	for zone, expiresAt := range r.insecure {
+		if !now.Before(expiresAt) {
+			delete(r.insecure, zone)
+		}
+	}
+}
+
+// queries records, which are needed for the validation
+func (r *DNSSECResolver) query(request *Request, name string, qType uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qType)
+	req.CheckingDisabled = true
+	setDO(req)
+
+	resp, err := r.next.Resolve(&Request{
+		ClientIP:      request.ClientIP,
+		Req:           req,
+		Log:           request.Log,
+		Ctx:           request.Ctx,
+		UpstreamGroup: request.UpstreamGroup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't query %s of '%s': %v", dns.TypeToString[qType], name, err)
+	}
+
+	if resp.Res.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("can't query %s of '%s': %s", dns.TypeToString[qType], name,
+			dns.RcodeToString[resp.Res.Rcode])
+	}
+
+	return resp.Res, nil
+}
+
+func (r *DNSSECResolver) String() string {
+	return fmt.Sprintf("DNSSEC resolver")
+}
+
+// verifies the RRset with one of the signatures and one of the keys
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	now := time.Now()
+
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, rrset) == nil {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("no valid signature for %s %s", rrset[0].Header().Name,
+		dns.TypeToString[rrset[0].Header().Rrtype])
+}
+
+// returns true if the key is referenced by one of the DS records
+func matchesDS(k *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if d.KeyTag != k.KeyTag() || d.Algorithm != k.Algorithm {
+			continue
+		}
+
+		if computed := k.ToDS(d.DigestType); computed != nil && strings.EqualFold(computed.Digest, d.Digest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// groups records by owner name and type, signatures are grouped by owner name and covered type
+func splitRRsets(rrs []dns.RR) (rrsets map[string][]dns.RR, sigs map[string][]*dns.RRSIG) {
+	rrsets = make(map[string][]dns.RR)
+	sigs = make(map[string][]*dns.RRSIG)
+
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey(sig.Hdr.Name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+
+			continue
+		}
+
+		key := rrsetKey(rr.Header().Name, rr.Header().Rrtype)
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	return
+}
+
+func rrsetKey(name string, rrType uint16) string {
+	return fmt.Sprintf("%s %d", canonicalName(name), rrType)
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// sets the DO bit, OPT record is added if not present
+func setDO(msg *dns.Msg) {
+	if opt := msg.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+	}
+}
+
+// removes signatures and denial of existence records, which were not requested by the client
+func stripDNSSECRecords(msg *dns.Msg, req *dns.Msg) {
+	var qType uint16
+	if len(req.Question) > 0 {
+		qType = req.Question[0].Qtype
+	}
+
+	strip := func(rrs []dns.RR) []dns.RR {
+		result := rrs[:0]
+
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t == qType {
+					result = append(result, rr)
+				}
+			default:
+				result = append(result, rr)
+			}
+		}
+
+		return result
+	}
+
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+}
+
+// returns SERVFAIL response with Extended DNS Error "DNSSEC Bogus"
+func bogusResponse(req *dns.Msg, err error, withEdns bool) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+
+	if withEdns {
+		text := err.Error()
+		data := make([]byte, 2+len(text))
+		binary.BigEndian.PutUint16(data, extendedErrorBogus)
+		copy(data[2:], text)
+
+		opt := resp.SetEdns0(dns.DefaultMsgSize, false).IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsOptionExtendedError, Data: data})
+	}
+
+	return resp
+}
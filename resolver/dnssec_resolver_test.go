@@ -0,0 +1,302 @@
+package resolver
+
+import (
+	"blocky/util"
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// answers queries with signed test records, empty answers contain the denial records of the name
+type signedZones struct {
+	records map[string][]dns.RR
+	denials map[string][]dns.RR
+	queries int
+}
+
+func (z *signedZones) Resolve(request *Request) (*Response, error) {
+	z.queries++
+
+	q := request.Req.Question[0]
+
+	resp := new(dns.Msg)
+	resp.SetReply(request.Req)
+	resp.Answer = copyRRs(z.records[rrsetKey(q.Name, q.Qtype)])
+
+	if len(resp.Answer) == 0 {
+		resp.Ns = copyRRs(z.denials[canonicalName(q.Name)])
+	}
+
+	return &Response{Res: resp, Upstream: "test"}, nil
+}
+
+func (z *signedZones) Configuration() []string {
+	return nil
+}
+
+type testZoneKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZoneKey(t *testing.T, zone string) testZoneKey {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	assert.NoError(t, err)
+
+	return testZoneKey{key: key, priv: priv.(crypto.Signer)}
+}
+
+// adds the records with signature of the zone key
+func (z *signedZones) addSigned(t *testing.T, signer testZoneKey, rrs ...dns.RR) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		KeyTag:     signer.key.KeyTag(),
+		SignerName: signer.key.Hdr.Name,
+		Algorithm:  signer.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+
+	assert.NoError(t, sig.Sign(signer.priv, rrs))
+
+	key := rrsetKey(rrs[0].Header().Name, rrs[0].Header().Rrtype)
+	z.records[key] = append(z.records[key], rrs...)
+	z.records[key] = append(z.records[key], sig)
+
+	return sig
+}
+
+func newSignedTestZones(t *testing.T) (*signedZones, testZoneKey, testZoneKey) {
+	zones := &signedZones{records: make(map[string][]dns.RR), denials: make(map[string][]dns.RR)}
+
+	root := newTestZoneKey(t, ".")
+	example := newTestZoneKey(t, "example.")
+
+	zones.addSigned(t, root, root.key)
+	zones.addSigned(t, example, example.key)
+
+	ds := example.key.ToDS(dns.SHA256)
+	ds.Hdr = dns.RR_Header{Name: "example.", Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 3600}
+	zones.addSigned(t, root, ds)
+
+	return zones, root, example
+}
+
+func newTestDNSSECResolver(t *testing.T, zones *signedZones, root testZoneKey) *DNSSECResolver {
+	r, err := NewDNSSECResolver(true)
+	assert.NoError(t, err)
+
+	sut := r.(*DNSSECResolver)
+	sut.anchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+	sut.Next(zones)
+
+	return sut
+}
+
+func Test_Resolve_DNSSEC_Valid(t *testing.T) {
+	zones, root, example := newSignedTestZones(t)
+
+	a, err := dns.NewRR("www.example. 300 IN A 10.0.0.1")
+	assert.NoError(t, err)
+	zones.addSigned(t, example, a)
+
+	sut := newTestDNSSECResolver(t, zones, root)
+
+	// client without DO bit: AD flag, no signatures
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("www.example.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.True(t, resp.Res.AuthenticatedData)
+	assert.Len(t, resp.Res.Answer, 1)
+	assert.Nil(t, resp.Res.IsEdns0())
+
+	// client with DO bit: signatures are returned, keys are cached
+	req := util.NewMsgWithQuestion("www.example.", dns.TypeA)
+	req.SetEdns0(4096, true)
+
+	resp, err = sut.Resolve(&Request{Req: req, Log: logrus.NewEntry(logrus.New())})
+	assert.NoError(t, err)
+	assert.True(t, resp.Res.AuthenticatedData)
+	assert.Len(t, resp.Res.Answer, 2)
+	assert.Equal(t, 5, zones.queries)
+}
+
+func Test_Resolve_DNSSEC_Bogus(t *testing.T) {
+	zones, root, example := newSignedTestZones(t)
+
+	a, err := dns.NewRR("www.example. 300 IN A 10.0.0.1")
+	assert.NoError(t, err)
+	zones.addSigned(t, example, a)
+
+	// record was modified after signing
+	zones.records[rrsetKey("www.example.", dns.TypeA)][0].(*dns.A).A[3] = 2
+
+	sut := newTestDNSSECResolver(t, zones, root)
+
+	req := util.NewMsgWithQuestion("www.example.", dns.TypeA)
+	req.SetEdns0(4096, false)
+
+	resp, err := sut.Resolve(&Request{Req: req, Log: logrus.NewEntry(logrus.New())})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Res.Rcode)
+	assert.Empty(t, resp.Res.Answer)
+
+	ede := resp.Res.IsEdns0().Option[0].(*dns.EDNS0_LOCAL)
+	assert.Equal(t, uint16(ednsOptionExtendedError), ede.Code)
+	assert.Equal(t, []byte{0, extendedErrorBogus}, ede.Data[:2])
+}
+
+func Test_Resolve_DNSSEC_UntrustedKey(t *testing.T) {
+	zones, _, example := newSignedTestZones(t)
+
+	a, err := dns.NewRR("www.example. 300 IN A 10.0.0.1")
+	assert.NoError(t, err)
+	zones.addSigned(t, example, a)
+
+	// other root key as trust anchor
+	sut := newTestDNSSECResolver(t, zones, newTestZoneKey(t, "."))
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("www.example.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Res.Rcode)
+}
+
+func Test_Resolve_DNSSEC_Unsigned(t *testing.T) {
+	zones, root, _ := newSignedTestZones(t)
+
+	a, err := dns.NewRR("www.unsigned. 300 IN A 10.0.0.1")
+	assert.NoError(t, err)
+	zones.records[rrsetKey("www.unsigned.", dns.TypeA)] = []dns.RR{a}
+
+	// root proves the delegation without DS record
+	nsec := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "unsigned.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: "zzz.",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+	zones.addSigned(t, root, nsec)
+	zones.denials["unsigned."] = zones.records[rrsetKey("unsigned.", dns.TypeNSEC)]
+
+	sut := newTestDNSSECResolver(t, zones, root)
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("www.unsigned.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.False(t, resp.Res.AuthenticatedData)
+	assert.Len(t, resp.Res.Answer, 1)
+
+	// proof is cached
+	queries := zones.queries
+	_, err = sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("www.unsigned.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, queries+1, zones.queries)
+}
+
+func Test_Resolve_DNSSEC_UnsignedWithoutDenial(t *testing.T) {
+	zones, root, _ := newSignedTestZones(t)
+
+	a, err := dns.NewRR("www.unsigned. 300 IN A 10.0.0.1")
+	assert.NoError(t, err)
+	zones.records[rrsetKey("www.unsigned.", dns.TypeA)] = []dns.RR{a}
+
+	sut := newTestDNSSECResolver(t, zones, root)
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("www.unsigned.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Res.Rcode)
+}
+
+func Test_Resolve_DNSSEC_StrippedSignatures(t *testing.T) {
+	zones, root, example := newSignedTestZones(t)
+
+	a, err := dns.NewRR("www.example. 300 IN A 10.0.0.1")
+	assert.NoError(t, err)
+	zones.addSigned(t, example, a)
+
+	// signatures are removed by an attacker
+	for key, rrs := range zones.records {
+		var unsigned []dns.RR
+
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeRRSIG || rr.Header().Name != "www.example." {
+				unsigned = append(unsigned, rr)
+			}
+		}
+
+		zones.records[key] = unsigned
+	}
+
+	sut := newTestDNSSECResolver(t, zones, root)
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("www.example.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Res.Rcode)
+	assert.Empty(t, resp.Res.Answer)
+}
+
+func Test_Resolve_DNSSEC_Disabled(t *testing.T) {
+	zones, _, _ := newSignedTestZones(t)
+
+	sut, err := NewDNSSECResolver(false)
+	assert.NoError(t, err)
+	sut.Next(zones)
+
+	req := util.NewMsgWithQuestion("example.", dns.TypeDNSKEY)
+
+	resp, err := sut.Resolve(&Request{Req: req, Log: logrus.NewEntry(logrus.New())})
+	assert.NoError(t, err)
+	assert.False(t, resp.Res.AuthenticatedData)
+	assert.Equal(t, 1, zones.queries)
+	assert.Equal(t, []string{"validation = disabled"}, sut.Configuration())
+}
+
+func Test_DNSSEC_PruneExpired(t *testing.T) {
+	sut, err := NewDNSSECResolver(true)
+	assert.NoError(t, err)
+
+	r := sut.(*DNSSECResolver)
+	r.keys["expired."] = verifiedKeys{expiresAt: time.Now().Add(-time.Second)}
+	r.keys["valid."] = verifiedKeys{expiresAt: time.Now().Add(time.Hour)}
+	r.insecure["expired.insecure."] = time.Now().Add(-time.Second)
+
+	r.setProvenInsecure("insecure.", 3600)
+
+	assert.Len(t, r.keys, 1)
+	assert.Contains(t, r.keys, "valid.")
+	assert.Len(t, r.insecure, 1)
+	assert.Contains(t, r.insecure, "insecure.")
+
+	// pruning is done at most once per interval
+	r.insecure["expired.insecure."] = time.Now().Add(-time.Second)
+	r.setProvenInsecure("other.", 3600)
+	assert.Len(t, r.insecure, 3)
+}
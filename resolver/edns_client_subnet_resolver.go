@@ -0,0 +1,197 @@
+package resolver
+
+import (
+	"blocky/config"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ecsModeStrip   = "strip"
+	ecsModeForward = "forward"
+	ecsModeAdd     = "add"
+
+	defaultECSIPv4Mask = 24
+	defaultECSIPv6Mask = 56
+
+	ecsFamilyIPv4 = 1
+	ecsFamilyIPv6 = 2
+)
+
+// EdnsClientSubnetResolver removes the EDNS client subnet option (ECS) from client queries, passes it through
+// or replaces it with the subnet of the client IP, before the query is forwarded
+type EdnsClientSubnetResolver struct {
+	NextResolver
+	mode     string
+	ipv4Mask uint8
+	ipv6Mask uint8
+}
+
+func NewEdnsClientSubnetResolver(cfg config.EdnsClientSubnetConfig) (ChainedResolver, error) {
+	r := &EdnsClientSubnetResolver{
+		mode:     cfg.Mode,
+		ipv4Mask: cfg.IPv4Mask,
+		ipv6Mask: cfg.IPv6Mask,
+	}
+
+	if r.mode == "" {
+		r.mode = ecsModeStrip
+	}
+
+	if r.mode != ecsModeStrip && r.mode != ecsModeForward && r.mode != ecsModeAdd {
+		return nil, fmt.Errorf("unknown EDNS client subnet mode '%s', please use one of: strip, forward or add",
+			r.mode)
+	}
+
+	if r.ipv4Mask == 0 {
+		r.ipv4Mask = defaultECSIPv4Mask
+	}
+
+	if r.ipv6Mask == 0 {
+		r.ipv6Mask = defaultECSIPv6Mask
+	}
+
+	if r.ipv4Mask > 32 || r.ipv6Mask > 128 {
+		return nil, fmt.Errorf("invalid EDNS client subnet prefix length (IPv4: %d, IPv6: %d)",
+			r.ipv4Mask, r.ipv6Mask)
+	}
+
+	return r, nil
+}
+
+func (r *EdnsClientSubnetResolver) Configuration() (result []string) {
+	result = append(result, fmt.Sprintf("mode = %s", r.mode))
+
+	if r.mode == ecsModeAdd {
+		result = append(result, fmt.Sprintf("ipv4Mask = %d", r.ipv4Mask), fmt.Sprintf("ipv6Mask = %d", r.ipv6Mask))
+	}
+
+	return
+}
+
+func (r *EdnsClientSubnetResolver) Resolve(request *Request) (*Response, error) {
+	switch r.mode {
+	case ecsModeStrip:
+		if ecsOption(request.Req) == nil {
+			return r.next.Resolve(request)
+		}
+
+		withPrefix(request.Log, "ecs_resolver").Debug("removing EDNS client subnet from query")
+
+		req := request.Req.Copy()
+		removeECS(req)
+
+		return r.next.Resolve(withReq(request, req))
+	case ecsModeAdd:
+		return r.add(request)
+	default:
+		return r.next.Resolve(request)
+	}
+}
+
+// replaces the ECS option with the subnet of the client IP
+func (r *EdnsClientSubnetResolver) add(request *Request) (*Response, error) {
+	subnet := r.clientSubnet(request.ClientIP)
+	if subnet == nil {
+		return r.next.Resolve(request)
+	}
+
+	req := request.Req.Copy()
+	removeECS(req)
+
+	opt := req.IsEdns0()
+	clientEdns := opt != nil
+
+	if !clientEdns {
+		// payload size of clients without EDNS
+		opt = req.SetEdns0(dns.MinMsgSize, false).IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, subnet)
+
+	withPrefix(request.Log, "ecs_resolver").Debugf("adding EDNS client subnet %s/%d", subnet.Address,
+		subnet.SourceNetmask)
+
+	response, err := r.next.Resolve(withReq(request, req))
+
+	// client without EDNS doesn't expect an OPT record in the answer
+	if err == nil && !clientEdns {
+		removeOPT(response.Res)
+	}
+
+	return response, err
+}
+
+// returns ECS option with the masked client IP, nil if the client IP is unknown
+func (r *EdnsClientSubnetResolver) clientSubnet(ip net.IP) *dns.EDNS0_SUBNET {
+	if ip == nil {
+		return nil
+	}
+
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		subnet.Family = ecsFamilyIPv4
+		subnet.SourceNetmask = r.ipv4Mask
+		subnet.Address = ip4.Mask(net.CIDRMask(int(r.ipv4Mask), 32))
+	} else {
+		subnet.Family = ecsFamilyIPv6
+		subnet.SourceNetmask = r.ipv6Mask
+		subnet.Address = ip.Mask(net.CIDRMask(int(r.ipv6Mask), 128))
+	}
+
+	return subnet
+}
+
+func (r EdnsClientSubnetResolver) String() string {
+	return fmt.Sprintf("EDNS client subnet resolver")
+}
+
+// returns copy of the request with passed DNS message
+func withReq(request *Request, req *dns.Msg) *Request {
+	result := *request
+	result.Req = req
+
+	return &result
+}
+
+// returns the ECS option of the message, nil if not present
+func ecsOption(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return subnet
+			}
+		}
+	}
+
+	return nil
+}
+
+func removeECS(msg *dns.Msg) {
+	if opt := msg.IsEdns0(); opt != nil {
+		options := opt.Option[:0]
+
+		for _, o := range opt.Option {
+			if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+				options = append(options, o)
+			}
+		}
+
+		opt.Option = options
+	}
+}
+
+func removeOPT(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+
+	msg.Extra = extra
+}
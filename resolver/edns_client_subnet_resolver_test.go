@@ -0,0 +1,78 @@
+package resolver
+
+import (
+	"blocky/config"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func resolveWithECS(t *testing.T, cfg config.EdnsClientSubnetConfig, request *Request) (*dns.Msg, *dns.Msg) {
+	answer := new(dns.Msg)
+	answer.SetReply(request.Req)
+	answer.SetEdns0(4096, false)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: answer}, nil)
+
+	sut, err := NewEdnsClientSubnetResolver(cfg)
+	assert.NoError(t, err)
+	sut.Next(m)
+
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	m.AssertExpectations(t)
+
+	return m.Calls[0].Arguments.Get(0).(*Request).Req, resp.Res
+}
+
+func Test_Resolve_ECS_Strip(t *testing.T) {
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("10.1.2.0")}
+	request := newRequest("example.com.", dns.TypeA, "192.168.178.25")
+	opt := request.Req.SetEdns0(4096, false).IsEdns0()
+	opt.Option = append(opt.Option, subnet)
+
+	forwarded, _ := resolveWithECS(t, config.EdnsClientSubnetConfig{}, request)
+
+	assert.Nil(t, ecsOption(forwarded))
+	assert.NotNil(t, forwarded.IsEdns0())
+
+	// client query is not modified
+	assert.NotNil(t, ecsOption(request.Req))
+}
+
+func Test_Resolve_ECS_Forward(t *testing.T) {
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("10.1.2.0")}
+
+	request := newRequest("example.com.", dns.TypeA, "192.168.178.25")
+	opt := request.Req.SetEdns0(4096, false).IsEdns0()
+	opt.Option = append(opt.Option, subnet)
+
+	forwarded, _ := resolveWithECS(t, config.EdnsClientSubnetConfig{Mode: "forward"}, request)
+
+	assert.Equal(t, "10.1.2.0/24", ecsSubnet(forwarded))
+}
+
+func Test_Resolve_ECS_Add(t *testing.T) {
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("10.1.2.0")}
+
+	request := newRequest("example.com.", dns.TypeA, "192.168.178.25")
+	opt := request.Req.SetEdns0(4096, false).IsEdns0()
+	opt.Option = append(opt.Option, subnet)
+
+	// ECS of the client is replaced
+	forwarded, resp := resolveWithECS(t, config.EdnsClientSubnetConfig{Mode: "add"}, request)
+
+	assert.Equal(t, "192.168.178.0/24", ecsSubnet(forwarded))
+	assert.NotNil(t, resp.IsEdns0())
+
+	// client without EDNS: OPT record is removed from the answer
+	forwarded, resp = resolveWithECS(t, config.EdnsClientSubnetConfig{Mode: "add", IPv6Mask: 48},
+		newRequest("example.com.", dns.TypeA, "2001:db8:1:2::10"))
+
+	assert.Equal(t, "2001:db8:1::/48", ecsSubnet(forwarded))
+	assert.Nil(t, resp.IsEdns0())
+}
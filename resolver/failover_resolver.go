@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"blocky/api"
+	"blocky/config"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// FailoverResolver delegates the DNS message to the upstream resolvers in configured order. The next resolver
+// is used only if the previous one failed. SERVFAIL or REFUSED answer is retried once with the next resolver
+type FailoverResolver struct {
+	resolvers []Resolver
+	stats     []*upstreamStats
+}
+
+func NewFailoverResolver(upstreams []config.Upstream, bootstrap *Bootstrap) Resolver {
+	resolvers := make([]Resolver, len(upstreams))
+	stats := make([]*upstreamStats, len(upstreams))
+
+	for i, u := range upstreams {
+		resolvers[i] = NewUpstreamResolver(u, bootstrap)
+		stats[i] = &upstreamStats{}
+	}
+
+	return &FailoverResolver{resolvers: resolvers, stats: stats}
+}
+
+func (r *FailoverResolver) Configuration() (result []string) {
+	result = append(result, "strategy = strict", "upstream resolvers:")
+	for i, res := range r.resolvers {
+		result = append(result, fmt.Sprintf("- %s (%s)", res, r.stats[i]))
+	}
+
+	return
+}
+
+// UpstreamStatus returns statistics of all upstreams
+func (r *FailoverResolver) UpstreamStatus() []api.UpstreamStatus {
+	result := make([]api.UpstreamStatus, len(r.resolvers))
+	for i, res := range r.resolvers {
+		result[i] = r.stats[i].status(fmt.Sprint(res))
+	}
+
+	return result
+}
+
+func (r *FailoverResolver) Resolve(request *Request) (*Response, error) {
+	logger := withPrefix(request.Log, "failover_resolver")
+
+	var err error
+
+	// first SERVFAIL/REFUSED response, returned if the next resolver can't answer either
+	var failed *Response
+
+	for i, res := range r.resolvers {
+		var response *Response
+
+		response, err = resolveWithStats(res, r.stats[i], request)
+		if err == nil {
+			if !isServerFailure(response) || failed != nil {
+				return response, nil
+			}
+
+			failed = response
+
+			logger.WithFields(logrus.Fields{
+				"upstream":    res,
+				"return_code": dns.RcodeToString[response.Res.Rcode],
+			}).Debug("upstream returned failure, trying next one")
+
+			continue
+		}
+
+		if failed != nil {
+			return failed, nil
+		}
+
+		logger.WithFields(logrus.Fields{
+			"upstream": res,
+			"error":    err,
+		}).Debug("upstream failed, trying next one")
+	}
+
+	if failed != nil {
+		return failed, nil
+	}
+
+	return nil, fmt.Errorf("all upstreams failed, last error: %v", err)
+}
+
+func (r *FailoverResolver) String() string {
+	names := make([]string, len(r.resolvers))
+	for i, res := range r.resolvers {
+		names[i] = fmt.Sprintf("%s", res)
+	}
+
+	return fmt.Sprintf("failover (%s)", strings.Join(names, ", "))
+}
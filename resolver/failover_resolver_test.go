@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"fmt"
+	"github.com/stretchr/testify/mock"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Resolve_Failover(t *testing.T) {
+	unreachable := config.Upstream{Net: "udp", Host: "127.0.0.1", Port: 1}
+	working := TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
+		response, _ = util.NewMsgWithAnswer(fmt.Sprintf("%s 123 IN A 10.0.0.10", request.Question[0].Name))
+
+		return response
+	})
+
+	sut := NewFailoverResolver([]config.Upstream{unreachable, working}, nil)
+	assert.Len(t, sut.Configuration(), 4)
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("host.corp.example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "host.corp.example.com.\t123\tIN\tA\t10.0.0.10", resp.Res.Answer[0].String())
+
+	// all upstreams fail
+	sut = NewFailoverResolver([]config.Upstream{unreachable, unreachable}, nil)
+
+	_, err = sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("host.corp.example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.Error(t, err)
+}
+
+func Test_Resolve_Failover_ServerFailure(t *testing.T) {
+	servFail := &resolverMock{}
+	servFailMsg := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}
+	servFail.On("Resolve", mock.Anything).Return(&Response{Res: servFailMsg}, nil)
+
+	refused := &resolverMock{}
+	refused.On("Resolve", mock.Anything).Return(&Response{Res: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeRefused}}}, nil)
+
+	working := &resolverMock{}
+	working.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED (working)"}, nil)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	// SERVFAIL -> answer of next resolver
+	sut := &FailoverResolver{
+		resolvers: []Resolver{servFail, working},
+		stats:     []*upstreamStats{{}, {}},
+	}
+
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Equal(t, "RESOLVED (working)", resp.Reason)
+
+	// only one extra attempt: the third resolver is not asked
+	sut = &FailoverResolver{
+		resolvers: []Resolver{servFail, refused, working},
+		stats:     []*upstreamStats{{}, {}, {}},
+	}
+
+	resp, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Res.Rcode)
+	working.AssertNumberOfCalls(t, "Resolve", 1)
+}
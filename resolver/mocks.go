@@ -56,7 +56,7 @@ func TestUDPUpstream(fn func(request *dns.Msg) (response *dns.Msg)) config.Upstr
 			}
 
 			msg := new(dns.Msg)
-			err = msg.Unpack(buffer[0 : n-1])
+			err = msg.Unpack(buffer[0:n])
 
 			if err != nil {
 				log.Fatal("can't deserialize message: ", err)
@@ -0,0 +1,173 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const ownNamesTTL = 60
+
+// nolint:gochecknoglobals
+var (
+	defaultOwnNames = []string{"blocky.local"}
+	// names of CHAOS TXT queries for the server version
+	versionNames = map[string]bool{"version.bind": true, "version.server": true}
+)
+
+// OwnNamesResolver answers A/AAAA queries for the host name of the system and configured names (e.g. "blocky.local")
+// with the addresses of blocky, and CHAOS TXT queries for version.bind with the version. Should be placed before
+// conditional resolver, so these names are not forwarded
+type OwnNamesResolver struct {
+	NextResolver
+	names       map[string]bool
+	ips         []net.IP
+	hideVersion bool
+}
+
+// NewOwnNamesResolver creates new resolver, which answers with passed listen IPs. If no IPs are passed (blocky listens
+// on all interfaces), the addresses of all interfaces except loopback and link-local addresses are used
+func NewOwnNamesResolver(cfg config.OwnNamesConfig, listenIPs []net.IP) ChainedResolver {
+	names := make(map[string]bool)
+
+	configured := cfg.Names
+	if len(configured) == 0 {
+		configured = defaultOwnNames
+	}
+
+	for _, name := range configured {
+		names[strings.ToLower(strings.Trim(strings.TrimSpace(name), "."))] = true
+	}
+
+	if !cfg.DisableHostname {
+		if hostname, err := os.Hostname(); err == nil {
+			names[strings.ToLower(strings.Trim(hostname, "."))] = true
+		} else {
+			logger("own_names_resolver").Warn("can't determine host name: ", err)
+		}
+	}
+
+	ips := listenIPs
+	if len(ips) == 0 {
+		ips = interfaceIPs()
+	}
+
+	return &OwnNamesResolver{names: names, ips: ips, hideVersion: cfg.HideVersion}
+}
+
+// returns addresses of all interfaces, which are reachable by other hosts. Loopback addresses are returned,
+// if no other address exists
+func interfaceIPs() (result []net.IP) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger("own_names_resolver").Warn("can't list interface addresses: ", err)
+	}
+
+	var loopback []net.IP
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+
+		switch {
+		case !ok || ipNet.IP.IsLinkLocalUnicast():
+		case ipNet.IP.IsLoopback():
+			loopback = append(loopback, ipNet.IP)
+		default:
+			result = append(result, ipNet.IP)
+		}
+	}
+
+	if len(result) == 0 {
+		return loopback
+	}
+
+	return result
+}
+
+func (r *OwnNamesResolver) Configuration() (result []string) {
+	names := make([]string, 0, len(r.names))
+	for name := range r.names {
+		names = append(names, name)
+	}
+
+	ips := make([]string, len(r.ips))
+	for i, ip := range r.ips {
+		ips[i] = ip.String()
+	}
+
+	sort.Strings(names)
+
+	result = append(result, fmt.Sprintf("names = %s", strings.Join(names, ", ")))
+	result = append(result, fmt.Sprintf("addresses = %s", strings.Join(ips, ", ")))
+	result = append(result, fmt.Sprintf("hideVersion = %t", r.hideVersion))
+
+	return
+}
+
+func (r *OwnNamesResolver) Resolve(request *Request) (*Response, error) {
+	if len(request.Req.Question) == 0 {
+		return r.next.Resolve(request)
+	}
+
+	question := request.Req.Question[0]
+	domain := util.ExtractDomain(question)
+	logger := withPrefix(request.Log, "own_names_resolver")
+
+	if question.Qclass == dns.ClassCHAOS {
+		response := new(dns.Msg)
+		response.SetReply(request.Req)
+
+		if r.hideVersion || question.Qtype != dns.TypeTXT || !versionNames[domain] {
+			logger.WithField("domain", domain).Debug("refusing CHAOS query")
+
+			response.Rcode = dns.RcodeRefused
+
+			return &Response{Res: response, rType: FILTERED, Reason: "FILTERED (CHAOS)"}, nil
+		}
+
+		response.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+			Txt: []string{"blocky " + util.Version},
+		}}
+
+		return &Response{Res: response, rType: CUSTOMDNS, Reason: "VERSION"}, nil
+	}
+
+	if !r.names[domain] {
+		return r.next.Resolve(request)
+	}
+
+	logger.WithField("domain", domain).Debug("answering own name")
+
+	response := new(dns.Msg)
+	response.SetReply(request.Req)
+
+	for _, ip := range r.ips {
+		isIPv4 := ip.To4() != nil
+
+		switch {
+		case question.Qtype == dns.TypeA && isIPv4:
+			response.Answer = append(response.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ownNamesTTL},
+				A:   ip.To4(),
+			})
+		case question.Qtype == dns.TypeAAAA && !isIPv4:
+			response.Answer = append(response.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ownNamesTTL},
+				AAAA: ip,
+			})
+		}
+	}
+
+	return &Response{Res: response, rType: CUSTOMDNS, Reason: "OWN NAME"}, nil
+}
+
+func (r *OwnNamesResolver) String() string {
+	return "own names resolver"
+}
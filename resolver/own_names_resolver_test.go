@@ -0,0 +1,103 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newOwnNamesTestResolver(cfg config.OwnNamesConfig) (ChainedResolver, *resolverMock) {
+	cfg.DisableHostname = true
+	sut := NewOwnNamesResolver(cfg, []net.IP{net.ParseIP("192.168.178.2"), net.ParseIP("2001:db8::2")})
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	return sut, m
+}
+
+func Test_Resolve_OwnNames_A_AAAA(t *testing.T) {
+	sut, m := newOwnNamesTestResolver(config.OwnNamesConfig{})
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("Blocky.Local.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, CUSTOMDNS, resp.rType)
+	assert.Len(t, resp.Res.Answer, 1)
+	assert.Equal(t, "Blocky.Local.	60	IN	A	192.168.178.2", resp.Res.Answer[0].String())
+
+	resp, err = sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("blocky.local.", dns.TypeAAAA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Res.Answer, 1)
+	assert.Equal(t, "blocky.local.	60	IN	AAAA	2001:db8::2", resp.Res.Answer[0].String())
+
+	// other types: empty answer
+	resp, err = sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("blocky.local.", dns.TypeMX),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Empty(t, resp.Res.Answer)
+	m.AssertNotCalled(t, "Resolve", mock.Anything)
+}
+
+func Test_Resolve_OwnNames_OtherName(t *testing.T) {
+	sut, m := newOwnNamesTestResolver(config.OwnNamesConfig{Names: []string{"dns.home."}})
+
+	_, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("blocky.local.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	m.AssertNumberOfCalls(t, "Resolve", 1)
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("dns.home.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Res.Answer, 1)
+	m.AssertNumberOfCalls(t, "Resolve", 1)
+}
+
+func Test_Resolve_OwnNames_Version(t *testing.T) {
+	chaosRequest := func(name string, qType uint16) *Request {
+		msg := util.NewMsgWithQuestion(name, qType)
+		msg.Question[0].Qclass = dns.ClassCHAOS
+
+		return &Request{Req: msg, Log: logrus.NewEntry(logrus.New())}
+	}
+
+	sut, m := newOwnNamesTestResolver(config.OwnNamesConfig{})
+
+	resp, err := sut.Resolve(chaosRequest("version.bind.", dns.TypeTXT))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Len(t, resp.Res.Answer, 1)
+	assert.Equal(t, []string{"blocky " + util.Version}, resp.Res.Answer[0].(*dns.TXT).Txt)
+
+	// other CHAOS queries are refused
+	resp, err = sut.Resolve(chaosRequest("hostname.bind.", dns.TypeTXT))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Res.Rcode)
+
+	sut, _ = newOwnNamesTestResolver(config.OwnNamesConfig{HideVersion: true})
+
+	resp, err = sut.Resolve(chaosRequest("version.server.", dns.TypeTXT))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Res.Rcode)
+	assert.Equal(t, FILTERED, resp.rType)
+	m.AssertNotCalled(t, "Resolve", mock.Anything)
+}
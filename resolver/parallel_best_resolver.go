@@ -1,113 +1,325 @@
 package resolver
 
 import (
+	"blocky/api"
+	"blocky/config"
 	"blocky/util"
 	"fmt"
 	"math/rand"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
-// ParallelBestResolver delegates the DNS message to 2 upstream resolvers and returns the fastest answer
+const (
+	defaultFailureThreshold    = 3
+	defaultHealthCheckDomain   = "github.com"
+	defaultHealthCheckInterval = 30 * time.Second
+)
+
+// ParallelBestResolver delegates the DNS message to 2 upstream resolvers and returns the fastest answer.
+// Upstream resolvers are picked randomly, weighted by recent response time and error rate.
+// SERVFAIL or REFUSED answer is used only if the other resolver can't answer either.
+// Upstream resolvers with too many consecutive failures are evicted temporarily and probed in background
 type ParallelBestResolver struct {
-	resolvers []Resolver
+	resolvers        []*upstreamStatus
+	failureThreshold int
+	checkDomain      string
+	lock             sync.RWMutex
+	stop             chan bool
+}
+
+type upstreamStatus struct {
+	resolver Resolver
+	// number of consecutive failures
+	failures int
+	evicted  bool
+	stats    upstreamStats
 }
 
-func NewParallelBestResolver(resolvers []Resolver) Resolver {
-	return &ParallelBestResolver{resolvers: resolvers}
+type requestResponse struct {
+	status   *upstreamStatus
+	response *Response
+	err      error
+}
+
+func NewParallelBestResolver(resolvers []Resolver, cfg config.HealthCheckConfig) Resolver {
+	statuses := make([]*upstreamStatus, len(resolvers))
+	for i, res := range resolvers {
+		statuses[i] = &upstreamStatus{resolver: res}
+	}
+
+	r := &ParallelBestResolver{
+		resolvers:        statuses,
+		failureThreshold: cfg.FailureThreshold,
+		checkDomain:      cfg.Domain,
+		stop:             make(chan bool),
+	}
+
+	if r.failureThreshold <= 0 {
+		r.failureThreshold = defaultFailureThreshold
+	}
+
+	if r.checkDomain == "" {
+		r.checkDomain = defaultHealthCheckDomain
+	}
+
+	interval := time.Duration(cfg.Interval)
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	go r.periodicHealthCheck(interval)
+
+	return r
 }
 
 func (r *ParallelBestResolver) Configuration() (result []string) {
-	result = append(result, "upstream resolvers:")
-	for _, res := range r.resolvers {
-		result = append(result, fmt.Sprintf("- %s", res))
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	shares := r.selectionShares()
+
+	result = append(result, "strategy = parallel_best", "upstream resolvers:")
+	for i, s := range r.resolvers {
+		if s.evicted {
+			result = append(result, fmt.Sprintf("- %s (%s, evicted after %d failures)", s.resolver, &s.stats, s.failures))
+		} else {
+			result = append(result, fmt.Sprintf("- %s (%s, weight = %.0f%%)", s.resolver, &s.stats, 100*shares[i]))
+		}
 	}
 
 	return
 }
 
+// UpstreamStatus returns statistics and eviction state of all upstreams
+func (r *ParallelBestResolver) UpstreamStatus() []api.UpstreamStatus {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	shares := r.selectionShares()
+
+	result := make([]api.UpstreamStatus, len(r.resolvers))
+	for i, s := range r.resolvers {
+		result[i] = s.stats.status(fmt.Sprint(s.resolver))
+		result[i].Evicted = s.evicted
+		result[i].Weight = shares[i]
+	}
+
+	return result
+}
+
 func (r *ParallelBestResolver) Resolve(request *Request) (*Response, error) {
-	logger := request.Log.WithField("prefix", "parallel_best_resolver")
+	logger := withPrefix(request.Log, "parallel_best_resolver")
 
-	r1, r2 := r.pickRandom()
-	logger.Debugf("using %s and %s as resolver", r1, r2)
+	picked := r.pickRandom()
 
-	ch1 := make(chan struct {
-		*Response
-		error
-	})
-	ch2 := make(chan struct {
-		*Response
-		error
-	})
+	// buffered: the slower resolver must not block, if the faster one has already won
+	ch := make(chan requestResponse, len(picked))
 
-	var err1, err2 error
+	for _, s := range picked {
+		logger.WithField("resolver", s.resolver).Debug("delegating to resolver")
 
-	logger.WithField("resolver", r1).Debug("delegating to resolver")
+		go r.resolve(request, s, ch)
+	}
 
-	go resolve(request, r1, ch1)
+	errs := make([]string, 0, len(picked))
 
-	logger.WithField("resolver", r2).Debug("delegating to resolver")
+	// SERVFAIL/REFUSED response, returned if the other resolver can't answer either
+	var failed *Response
 
-	go resolve(request, r2, ch2)
+	for range picked {
+		result := <-ch
 
-	for err1 == nil || err2 == nil {
-		select {
-		case msg1 := <-ch1:
-			if msg1.error != nil {
-				err1 = msg1.error
-				ch1 = nil
-
-				logger.WithField("resolver", r1).Debug("resolution failed from resolver, cause: ", msg1.error)
-			} else {
-				logger.WithFields(logrus.Fields{
-					"resolver": r1,
-					"answer":   util.AnswerToString(msg1.Response.Res.Answer),
-				}).Debug("using response from resolver")
-				return msg1.Response, nil
+		switch {
+		case result.err != nil:
+			logger.WithField("resolver", result.status.resolver).
+				Debug("resolution failed from resolver, cause: ", result.err)
+			errs = append(errs, fmt.Sprintf("'%v'", result.err))
+		case isServerFailure(result.response):
+			logger.WithField("resolver", result.status.resolver).
+				Debugf("resolver returned %s, waiting for other resolver", dns.RcodeToString[result.response.Res.Rcode])
+
+			if failed == nil {
+				failed = result.response
 			}
-		case msg2 := <-ch2:
-			if msg2.error != nil {
-				err2 = msg2.error
-				ch2 = nil
-
-				logger.WithField("resolver", r2).Debug("resolution failed from resolver, cause: ", msg2.error)
-			} else {
-				logger.WithFields(logrus.Fields{
-					"resolver": r2,
-					"answer":   util.AnswerToString(msg2.Response.Res.Answer),
-				}).Debug("using response from resolver")
-				return msg2.Response, nil
+		default:
+			logger.WithFields(logrus.Fields{
+				"resolver": result.status.resolver,
+				"answer":   util.AnswerToString(result.response.Res.Answer),
+			}).Debug("using response from resolver")
+
+			return result.response, nil
+		}
+	}
+
+	if failed != nil {
+		return failed, nil
+	}
+
+	return nil, fmt.Errorf("resolution was not successful, errors: %s", strings.Join(errs, ", "))
+}
+
+// returns the selection probability of each resolver for the first pick, evicted resolvers have no share.
+// Must be called with acquired lock
+func (r *ParallelBestResolver) selectionShares() []float64 {
+	var healthy []*upstreamStats
+
+	for _, s := range r.resolvers {
+		if !s.evicted {
+			healthy = append(healthy, &s.stats)
+		}
+	}
+
+	result := make([]float64, len(r.resolvers))
+
+	if len(healthy) > 0 {
+		healthyShares := selectionShares(healthy)
+
+		for i, s := range r.resolvers {
+			if !s.evicted {
+				result[i], healthyShares = healthyShares[0], healthyShares[1:]
 			}
 		}
 	}
 
-	return nil, fmt.Errorf("resolution was not successful, errors: '%v', '%v'", err1, err2)
+	return result
 }
 
-// pick 2 different random resolvers from the resolver pool
-func (r *ParallelBestResolver) pickRandom() (resolver1, resolver2 Resolver) {
-	resolver1 = r.resolvers[rand.Intn(len(r.resolvers))]
-	for resolver2 == resolver1 || resolver2 == nil {
-		resolver2 = r.resolvers[rand.Intn(len(r.resolvers))]
+// pick 2 different random resolvers from the healthy resolvers, weighted by upstream statistics.
+// If less than 2 resolvers are healthy, evicted resolvers are used too. If all resolvers are evicted, all of them
+// are returned, so that a recovered upstream is found with the next query
+func (r *ParallelBestResolver) pickRandom() (result []*upstreamStatus) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var healthy, evicted []*upstreamStatus
+
+	for _, s := range r.resolvers {
+		if s.evicted {
+			evicted = append(evicted, s)
+		} else {
+			healthy = append(healthy, s)
+		}
+	}
+
+	for len(result) < 2 && len(healthy) > 0 {
+		stats := make([]*upstreamStats, len(healthy))
+		for i, s := range healthy {
+			stats[i] = &s.stats
+		}
+
+		i := pickByShares(selectionShares(stats))
+		result = append(result, healthy[i])
+		healthy = append(healthy[:i], healthy[i+1:]...)
+	}
+
+	if len(result) == 0 {
+		return evicted
+	}
+
+	for _, i := range rand.Perm(len(evicted)) {
+		if len(result) == 2 {
+			return
+		}
+
+		result = append(result, evicted[i])
 	}
 
 	return
 }
 
-func resolve(req *Request, resolver Resolver, ch chan struct {
-	*Response
-	error
-}) {
-	defer close(ch)
-
-	resp, err := resolver.Resolve(req)
-	ch <- struct {
-		*Response
-		error
-	}{resp, err}
+func (r *ParallelBestResolver) resolve(req *Request, s *upstreamStatus, ch chan requestResponse) {
+	resp, err := resolveWithStats(s.resolver, &s.stats, req)
+
+	// exceeded deadline of the query is not a failure of the upstream
+	if err == nil || req.Context().Err() == nil {
+		r.updateStatus(s, err)
+	}
+
+	ch <- requestResponse{status: s, response: resp, err: err}
+}
+
+// counts consecutive failures, evicts the resolver if the threshold is reached
+func (r *ParallelBestResolver) updateStatus(s *upstreamStatus, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err == nil {
+		s.failures = 0
+		return
+	}
+
+	s.failures++
+
+	if !s.evicted && s.failures >= r.failureThreshold {
+		s.evicted = true
+
+		logger("parallel_best_resolver").Warnf("evicting upstream %s after %d consecutive failures, last error: %v",
+			s.resolver, s.failures, err)
+	}
+}
+
+func (r *ParallelBestResolver) periodicHealthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.checkEvicted()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// probes all evicted resolvers with a query for the check domain, reinstates resolvers with successful answer
+func (r *ParallelBestResolver) checkEvicted() {
+	r.lock.RLock()
+
+	var evicted []*upstreamStatus
+
+	for _, s := range r.resolvers {
+		if s.evicted {
+			evicted = append(evicted, s)
+		}
+	}
+
+	r.lock.RUnlock()
+
+	for _, s := range evicted {
+		_, err := s.resolver.Resolve(&Request{
+			Req: util.NewMsgWithQuestion(dns.Fqdn(r.checkDomain), dns.TypeA),
+			Log: logger("parallel_best_resolver"),
+		})
+
+		if err == nil {
+			r.lock.Lock()
+			s.evicted = false
+			s.failures = 0
+			r.lock.Unlock()
+
+			logger("parallel_best_resolver").Infof("upstream %s recovered, using it again", s.resolver)
+		} else {
+			logger("parallel_best_resolver").Debugf("upstream %s is still failing: %v", s.resolver, err)
+		}
+	}
+}
+
+// Stop stops the background health check
+func (r *ParallelBestResolver) Stop() {
+	close(r.stop)
 }
 
-func (r ParallelBestResolver) String() string {
-	return fmt.Sprintf("parallel best resolver '%s'", r.resolvers)
+func (r *ParallelBestResolver) String() string {
+	names := make([]string, len(r.resolvers))
+	for i, s := range r.resolvers {
+		names[i] = fmt.Sprintf("%s", s.resolver)
+	}
+
+	return fmt.Sprintf("parallel best resolver '[%s]'", strings.Join(names, " "))
 }
@@ -1,7 +1,9 @@
 package resolver
 
 import (
+	"blocky/config"
 	"blocky/util"
+	"errors"
 	"testing"
 	"time"
 
@@ -24,7 +26,7 @@ func Test_Resolve_Best_Result(t *testing.T) {
 	slow := &resolverMock{}
 	slow.On("Resolve", mock.Anything).WaitUntil(time.After(50*time.Millisecond)).Return(&Response{Res: new(dns.Msg)}, nil)
 
-	sut := NewParallelBestResolver([]Resolver{slow, fast})
+	sut := NewParallelBestResolver([]Resolver{slow, fast}, config.HealthCheckConfig{})
 
 	resp, err := sut.Resolve(&Request{
 		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
@@ -34,14 +36,159 @@ func Test_Resolve_Best_Result(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
 	assert.Equal(t, "example.com.	123	IN	A	192.168.178.44", resp.Res.Answer[0].String())
+
+	// slow resolver is called asynchronously
+	time.Sleep(10 * time.Millisecond)
+
 	fast.AssertExpectations(t)
 	slow.AssertExpectations(t)
 }
 
 func Test_Configuration_ParallelResolver(t *testing.T) {
-	sut := NewParallelBestResolver([]Resolver{&resolverMock{}, &resolverMock{}})
+	sut := NewParallelBestResolver([]Resolver{&resolverMock{}, &resolverMock{}}, config.HealthCheckConfig{})
 
 	c := sut.Configuration()
 
-	assert.Len(t, c, 3)
+	assert.Len(t, c, 4)
+}
+
+func Test_Resolve_Eviction(t *testing.T) {
+	failing := &resolverMock{}
+	failing.On("Resolve", mock.Anything).Return((*Response)(nil), errors.New("timeout")).Times(2)
+	// health check is successful
+	failing.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+
+	healthy := &resolverMock{}
+	healthy.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+
+	sut := NewParallelBestResolver([]Resolver{failing, healthy, healthy},
+		config.HealthCheckConfig{FailureThreshold: 2, Interval: config.Duration(time.Hour)}).(*ParallelBestResolver)
+	defer sut.Stop()
+
+	status := sut.resolvers[0]
+
+	for i := 0; i < 2; i++ {
+		sut.resolve(&Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		}, status, make(chan requestResponse, 1))
+	}
+
+	assert.True(t, status.evicted)
+	assert.Contains(t, sut.Configuration()[2], "evicted")
+
+	// evicted resolver is not picked
+	for i := 0; i < 10; i++ {
+		assert.NotContains(t, sut.pickRandom(), status)
+	}
+
+	// recovered after successful health check
+	sut.checkEvicted()
+	assert.False(t, status.evicted)
+	assert.Equal(t, 0, status.failures)
+	failing.AssertNumberOfCalls(t, "Resolve", 3)
+}
+
+func Test_pickRandom_AllEvicted(t *testing.T) {
+	sut := NewParallelBestResolver([]Resolver{&resolverMock{}, &resolverMock{}, &resolverMock{}},
+		config.HealthCheckConfig{}).(*ParallelBestResolver)
+	defer sut.Stop()
+
+	for _, s := range sut.resolvers[1:] {
+		s.evicted = true
+	}
+
+	// healthy resolver is always used, evicted resolvers as second
+	for i := 0; i < 10; i++ {
+		picked := sut.pickRandom()
+		assert.Len(t, picked, 2)
+		assert.Equal(t, sut.resolvers[0], picked[0])
+	}
+
+	// all evicted -> all are used
+	sut.resolvers[0].evicted = true
+	assert.ElementsMatch(t, sut.resolvers, sut.pickRandom())
+
+	// only one resolver
+	sut = NewParallelBestResolver([]Resolver{&resolverMock{}}, config.HealthCheckConfig{}).(*ParallelBestResolver)
+	defer sut.Stop()
+
+	assert.Len(t, sut.pickRandom(), 1)
+}
+
+func Test_Resolve_ParallelBest_ServerFailure(t *testing.T) {
+	servFail := &resolverMock{}
+	servFailMsg := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}
+	servFail.On("Resolve", mock.Anything).Return(&Response{Res: servFailMsg}, nil)
+
+	slow := &resolverMock{}
+	slow.On("Resolve", mock.Anything).WaitUntil(time.After(20*time.Millisecond)).Return(&Response{Res: new(dns.Msg)}, nil)
+
+	sut := NewParallelBestResolver([]Resolver{servFail, slow}, config.HealthCheckConfig{}).(*ParallelBestResolver)
+	defer sut.Stop()
+
+	// faster SERVFAIL answer is ignored
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+
+	// both answer with SERVFAIL
+	sut = NewParallelBestResolver([]Resolver{servFail, servFail}, config.HealthCheckConfig{}).(*ParallelBestResolver)
+	defer sut.Stop()
+
+	resp, err = sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Res.Rcode)
+}
+
+func Test_pickRandom_WeightedByStats(t *testing.T) {
+	sut := NewParallelBestResolver([]Resolver{&resolverMock{}, &resolverMock{}, &resolverMock{}},
+		config.HealthCheckConfig{}).(*ParallelBestResolver)
+	defer sut.Stop()
+
+	sut.resolvers[0].stats.record(10*time.Millisecond, nil)
+	sut.resolvers[1].stats.record(500*time.Millisecond, nil)
+	sut.resolvers[2].stats.record(10*time.Millisecond, nil)
+
+	picked := make(map[*upstreamStatus]int)
+
+	for i := 0; i < 1000; i++ {
+		result := sut.pickRandom()
+		assert.Len(t, result, 2)
+		assert.True(t, result[0] != result[1])
+
+		picked[result[0]]++
+		picked[result[1]]++
+	}
+
+	// slow upstream is picked rarely, but still probed
+	assert.True(t, picked[sut.resolvers[1]] < picked[sut.resolvers[0]]/2)
+	assert.True(t, picked[sut.resolvers[1]] < picked[sut.resolvers[2]]/2)
+	assert.True(t, picked[sut.resolvers[1]] > 0)
+
+	status := sut.UpstreamStatus()
+	assert.InDelta(t, 1, status[0].Weight+status[1].Weight+status[2].Weight, 0.001)
+	assert.True(t, status[1].Weight < status[0].Weight)
+	assert.Contains(t, sut.Configuration()[3], "avg latency = 500 ms, weight = 4%")
+}
+
+func Test_selectionShares(t *testing.T) {
+	failing := &upstreamStats{}
+	failing.record(10*time.Millisecond, errors.New("timeout"))
+
+	working := &upstreamStats{}
+	working.record(10*time.Millisecond, nil)
+
+	shares := selectionShares([]*upstreamStats{failing, working})
+
+	assert.InDelta(t, 1, shares[0]+shares[1], 0.001)
+	// minimum share for probes
+	assert.True(t, shares[0] >= probeShare/2)
+	assert.True(t, shares[1] > 0.9)
 }
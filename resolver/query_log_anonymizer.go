@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// anonymization mode: zero the host part of the address (last octet of IPv4, last 80 bits of IPv6)
+	anonymizeMask = "mask"
+	// anonymization mode: replace the address with a salted hash
+	anonymizeHash = "hash"
+
+	hashLength = 16
+)
+
+// replaces client IP addresses and names derived from them in query log entries
+type ipAnonymizer struct {
+	mode string
+	salt []byte
+}
+
+// returns nil if anonymization is disabled (empty mode). Without salt, a random salt is used: hashes change on restart
+func newIPAnonymizer(mode string, salt string) (*ipAnonymizer, error) {
+	if mode == "" {
+		return nil, nil
+	}
+
+	a := &ipAnonymizer{mode: mode, salt: []byte(salt)}
+
+	if mode == anonymizeHash && salt == "" {
+		a.salt = make([]byte, 16)
+		if _, err := rand.Read(a.salt); err != nil {
+			return nil, fmt.Errorf("can't create random salt: %v", err)
+		}
+	}
+
+	return a, nil
+}
+
+func (a *ipAnonymizer) anonymizeIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	if a.mode == anonymizeHash {
+		h := sha256.New()
+		h.Write(a.salt)
+		h.Write(ip)
+
+		return hex.EncodeToString(h.Sum(nil))[:hashLength]
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// replaces names, which are derived from the IP address (e.g. IP as name or "192-168-178-25.fritz.box")
+func (a *ipAnonymizer) anonymizeNames(names []string, ip net.IP) []string {
+	if ip == nil {
+		return names
+	}
+
+	result := make([]string, len(names))
+
+	for i, name := range names {
+		if isDerivedFromIP(name, ip) {
+			result[i] = a.anonymizeIP(ip)
+		} else {
+			result[i] = name
+		}
+	}
+
+	return result
+}
+
+func isDerivedFromIP(name string, ip net.IP) bool {
+	ipString := ip.String()
+	name = strings.ToLower(name)
+
+	if strings.Contains(name, ipString) {
+		return true
+	}
+
+	separator := "."
+	if ip.To4() == nil {
+		separator = ":"
+	}
+
+	if strings.Contains(name, strings.ReplaceAll(ipString, separator, "-")) {
+		return true
+	}
+
+	// reverse notation, e.g. 25.178.168.192.in-addr.arpa
+	reverse, err := dns.ReverseAddr(ipString)
+	if err != nil {
+		return false
+	}
+
+	reverse = strings.TrimSuffix(strings.TrimSuffix(reverse, "in-addr.arpa."), "ip6.arpa.")
+
+	return strings.Contains(name, reverse)
+}
@@ -0,0 +1,47 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_anonymizeIP_Mask(t *testing.T) {
+	sut, err := newIPAnonymizer(anonymizeMask, "")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "192.168.178.0", sut.anonymizeIP(net.ParseIP("192.168.178.25")))
+	assert.Equal(t, "2001:db8:85a3::", sut.anonymizeIP(net.ParseIP("2001:db8:85a3:8d3:1319:8a2e:370:7347")))
+	assert.Equal(t, "", sut.anonymizeIP(nil))
+}
+
+func Test_anonymizeIP_Hash(t *testing.T) {
+	sut, err := newIPAnonymizer(anonymizeHash, "salt")
+	assert.NoError(t, err)
+
+	hash := sut.anonymizeIP(net.ParseIP("192.168.178.25"))
+
+	assert.Len(t, hash, hashLength)
+	assert.Equal(t, hash, sut.anonymizeIP(net.ParseIP("192.168.178.25")))
+	assert.NotEqual(t, hash, sut.anonymizeIP(net.ParseIP("192.168.178.26")))
+
+	other, err := newIPAnonymizer(anonymizeHash, "other")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other.anonymizeIP(net.ParseIP("192.168.178.25")))
+}
+
+func Test_anonymizeNames(t *testing.T) {
+	sut, err := newIPAnonymizer(anonymizeMask, "")
+	assert.NoError(t, err)
+
+	ip := net.ParseIP("192.168.178.25")
+
+	assert.Equal(t, []string{"192.168.178.0", "192.168.178.0", "192.168.178.0", "laptop"},
+		sut.anonymizeNames([]string{"192.168.178.25", "192-168-178-25.fritz.box",
+			"25.178.168.192.in-addr.arpa", "laptop"}, ip))
+
+	sut, err = newIPAnonymizer("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, sut)
+}
@@ -0,0 +1,216 @@
+package resolver
+
+import (
+	"blocky/util"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	// mysql driver for database/sql
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const (
+	databaseBatchSize   = 100
+	databaseWritePeriod = time.Second
+	// max number of not written entries, e.g. if database is not reachable. Older entries are dropped
+	databaseMaxPending = 10000
+)
+
+const createLogTableSQL = `CREATE TABLE IF NOT EXISTS log_entries (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	request_ts DATETIME(3) NOT NULL,
+	client_ip VARCHAR(50),
+	client_name VARCHAR(255),
+	duration_ms BIGINT,
+	reason VARCHAR(255),
+	blocked BOOLEAN,
+	question_name VARCHAR(255),
+	question_type VARCHAR(20),
+	response_code VARCHAR(20),
+	answer TEXT,
+	upstream VARCHAR(255),
+	INDEX (request_ts)
+)`
+
+// tables created by older versions have no upstream column
+const addUpstreamColumnSQL = `ALTER TABLE log_entries ADD COLUMN upstream VARCHAR(255)`
+
+const insertLogEntrySQL = `INSERT INTO log_entries (request_ts, client_ip, client_name, duration_ms, reason, blocked,
+	question_name, question_type, response_code, answer, upstream) VALUES `
+
+// one row of the log_entries table
+type databaseLogEntry struct {
+	start        time.Time
+	clientIP     string
+	clientName   string
+	durationMs   int64
+	reason       string
+	blocked      bool
+	questionName string
+	questionType string
+	responseCode string
+	answer       string
+	upstream     string
+}
+
+// writes query log entries in batches into a SQL database. Entries are buffered and written periodically,
+// if the database is not reachable, the write will be retried in the next period
+type databaseWriter struct {
+	db           *sql.DB
+	lock         sync.Mutex
+	pending      []databaseLogEntry
+	tableCreated bool
+	stop         chan struct{}
+}
+
+func newDatabaseWriter(driver, dsn string) (*databaseWriter, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("can't open database: %v", err)
+	}
+
+	w := newDatabaseWriterWithDB(db)
+
+	go w.periodicWrite()
+
+	return w, nil
+}
+
+func newDatabaseWriterWithDB(db *sql.DB) *databaseWriter {
+	return &databaseWriter{
+		db:   db,
+		stop: make(chan struct{}),
+	}
+}
+
+// adds entry to the pending entries, they are written by the periodic write
+func (w *databaseWriter) add(logEntry *queryLogEntry) {
+	entry := toDatabaseLogEntry(logEntry)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.pending) >= databaseMaxPending {
+		logger(queryLoggingResolverPrefix).Warn("query log database is not available, dropping oldest entry")
+
+		w.pending = w.pending[1:]
+	}
+
+	w.pending = append(w.pending, entry)
+}
+
+func (w *databaseWriter) periodicWrite() {
+	ticker := time.NewTicker(databaseWritePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.flush()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// writes all pending entries
+func (w *databaseWriter) flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.writePending()
+}
+
+// writes pending entries in batches, must be called with acquired lock. On error, entries are kept for next try
+func (w *databaseWriter) writePending() {
+	if len(w.pending) == 0 {
+		return
+	}
+
+	if !w.tableCreated {
+		if _, err := w.db.Exec(createLogTableSQL); err != nil {
+			logger(queryLoggingResolverPrefix).Warn("can't create query log table, will retry: ", err)
+			return
+		}
+
+		// fails if the column already exists
+		if _, err := w.db.Exec(addUpstreamColumnSQL); err == nil {
+			logger(queryLoggingResolverPrefix).Info("added column 'upstream' to query log table")
+		}
+
+		w.tableCreated = true
+	}
+
+	for len(w.pending) > 0 {
+		n := len(w.pending)
+		if n > databaseBatchSize {
+			n = databaseBatchSize
+		}
+
+		if err := w.insert(w.pending[:n]); err != nil {
+			logger(queryLoggingResolverPrefix).WithField("pending", len(w.pending)).
+				Warn("can't write query log entries to database, will retry: ", err)
+
+			return
+		}
+
+		w.pending = w.pending[n:]
+	}
+}
+
+// inserts entries with one multi-row statement
+func (w *databaseWriter) insert(entries []databaseLogEntry) error {
+	placeholders := make([]string, len(entries))
+	args := make([]interface{}, 0, len(entries)*11)
+
+	for i, e := range entries {
+		placeholders[i] = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		args = append(args, e.start, e.clientIP, e.clientName, e.durationMs, e.reason, e.blocked,
+			e.questionName, e.questionType, e.responseCode, e.answer, e.upstream)
+	}
+
+	_, err := w.db.Exec(insertLogEntrySQL+strings.Join(placeholders, ", "), args...)
+
+	return err
+}
+
+// writes pending entries and closes the database
+func (w *databaseWriter) close() {
+	close(w.stop)
+	w.flush()
+
+	if err := w.db.Close(); err != nil {
+		logger(queryLoggingResolverPrefix).Error("can't close database: ", err)
+	}
+}
+
+func toDatabaseLogEntry(logEntry *queryLogEntry) databaseLogEntry {
+	request := logEntry.request
+	response := logEntry.response
+
+	var questionName, questionType string
+
+	if len(request.Req.Question) > 0 {
+		questionName = util.ExtractDomain(request.Req.Question[0])
+		questionType = dns.TypeToString[request.Req.Question[0].Qtype]
+	}
+
+	return databaseLogEntry{
+		start:        logEntry.start,
+		clientIP:     logEntry.clientIP,
+		clientName:   strings.Join(logEntry.clientNames, "; "),
+		durationMs:   logEntry.durationMs,
+		reason:       response.Reason,
+		blocked:      response.rType == BLOCKED,
+		questionName: questionName,
+		questionType: questionType,
+		responseCode: dns.RcodeToString[response.Res.Rcode],
+		answer:       util.AnswerToString(response.Res.Answer),
+		upstream:     answeredBy(response),
+	}
+}
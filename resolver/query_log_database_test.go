@@ -0,0 +1,107 @@
+package resolver
+
+import (
+	"blocky/util"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLogEntry(t *testing.T, domain string, rType ResponseType) *queryLogEntry {
+	res, err := util.NewMsgWithAnswer(domain + ". 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	return &queryLogEntry{
+		clientIP:    "192.168.178.25",
+		clientNames: []string{"client1"},
+		request: &Request{
+			ClientIP:    net.ParseIP("192.168.178.25"),
+			ClientNames: []string{"client1"},
+			Req:         util.NewMsgWithQuestion(domain+".", dns.TypeA),
+			Log:         logrus.NewEntry(logrus.New()),
+		},
+		response: &Response{Res: res, rType: rType, Reason: "BLOCKED (ads)", Upstream: "udp:1.1.1.1:53",
+			Blocking: &BlockingInfo{Group: "ads"}},
+		start:      time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC),
+		durationMs: 15,
+	}
+}
+
+func Test_DatabaseWriter_WritesBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+
+	sut := newDatabaseWriterWithDB(db)
+
+	sut.add(newTestLogEntry(t, "example.com", BLOCKED))
+	sut.add(newTestLogEntry(t, "example2.com", RESOLVED))
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS log_entries").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE log_entries").WillReturnError(errors.New("duplicate column name 'upstream'"))
+	mock.ExpectExec("INSERT INTO log_entries").
+		WithArgs(time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC), "192.168.178.25", "client1", int64(15),
+			"BLOCKED (ads)", true, "example.com", "A", "NOERROR", "A (123.122.121.120)", "BLOCKED (ads)",
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), false,
+			"example2.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "udp:1.1.1.1:53").
+		WillReturnResult(sqlmock.NewResult(2, 2))
+
+	sut.flush()
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, sut.pending)
+}
+
+func Test_DatabaseWriter_RetriesOnError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+
+	sut := newDatabaseWriterWithDB(db)
+
+	sut.add(newTestLogEntry(t, "example.com", RESOLVED))
+
+	// database not reachable: entries are kept
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS log_entries").WillReturnError(errors.New("connection refused"))
+	sut.flush()
+	assert.Len(t, sut.pending, 1)
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS log_entries").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE log_entries").WillReturnError(errors.New("duplicate column name 'upstream'"))
+	mock.ExpectExec("INSERT INTO log_entries").WillReturnError(errors.New("connection lost"))
+	sut.flush()
+	assert.Len(t, sut.pending, 1)
+
+	// next try succeeds
+	mock.ExpectExec("INSERT INTO log_entries").WillReturnResult(sqlmock.NewResult(1, 1))
+	sut.flush()
+	assert.Empty(t, sut.pending)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_DatabaseWriter_SplitsBatches(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+
+	sut := newDatabaseWriterWithDB(db)
+
+	for i := 0; i < databaseBatchSize+1; i++ {
+		sut.add(newTestLogEntry(t, "example.com", RESOLVED))
+	}
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS log_entries").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE log_entries").WillReturnError(errors.New("duplicate column name 'upstream'"))
+	mock.ExpectExec("INSERT INTO log_entries").WillReturnResult(sqlmock.NewResult(0, databaseBatchSize))
+	mock.ExpectExec("INSERT INTO log_entries").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+		sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+		sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	sut.flush()
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
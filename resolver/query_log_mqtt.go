@@ -0,0 +1,115 @@
+package resolver
+
+import (
+	"blocky/mqtt"
+	"blocky/util"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const mqttDefaultTopic = "blocky/query/{client}"
+
+// replaces characters with special meaning in topics
+// nolint:gochecknoglobals
+var mqttTopicReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_", " ", "_")
+
+// event, which is published for each query
+type mqttQueryEvent struct {
+	Time         time.Time `json:"time"`
+	ClientIP     string    `json:"client_ip"`
+	ClientNames  []string  `json:"client_names"`
+	DurationMs   int64     `json:"duration_ms"`
+	Reason       string    `json:"reason"`
+	ResponseType string    `json:"response_type"`
+	QuestionName string    `json:"question_name"`
+	QuestionType string    `json:"question_type"`
+	Answer       string    `json:"answer"`
+	ResponseCode string    `json:"response_code"`
+	BlockedGroup string    `json:"blocked_group,omitempty"`
+	BlockedList  string    `json:"blocked_list,omitempty"`
+	Upstream     string    `json:"upstream"`
+}
+
+// publishes query log entries as JSON events to a MQTT broker. The topic can contain the placeholders {client}
+// (first client name or client IP), {client_ip} and {response_type}
+type mqttWriter struct {
+	client *mqtt.Client
+	topic  string
+}
+
+func newMqttWriter(broker, topic string, qos uint8) (*mqttWriter, error) {
+	client, err := mqtt.NewClient(broker, qos)
+	if err != nil {
+		return nil, err
+	}
+
+	if topic == "" {
+		topic = mqttDefaultTopic
+	}
+
+	return &mqttWriter{client: client, topic: topic}, nil
+}
+
+// publishes entry asynchronously, never blocks
+func (w *mqttWriter) add(logEntry *queryLogEntry) {
+	payload, err := json.Marshal(createMqttEvent(logEntry))
+	if err != nil {
+		logEntry.log().Error("can't create query log event: ", err)
+		return
+	}
+
+	w.client.Publish(w.createTopic(logEntry), payload)
+}
+
+func (w *mqttWriter) createTopic(logEntry *queryLogEntry) string {
+	client := logEntry.clientIP
+	if len(logEntry.clientNames) > 0 && logEntry.clientNames[0] != "" {
+		client = logEntry.clientNames[0]
+	}
+
+	return strings.NewReplacer(
+		"{client}", mqttTopicReplacer.Replace(client),
+		"{client_ip}", mqttTopicReplacer.Replace(logEntry.clientIP),
+		"{response_type}", mqttTopicReplacer.Replace(strings.ToLower(logEntry.response.rType.String())),
+	).Replace(w.topic)
+}
+
+func createMqttEvent(logEntry *queryLogEntry) mqttQueryEvent {
+	request := logEntry.request
+	response := logEntry.response
+
+	event := mqttQueryEvent{
+		Time:         logEntry.start,
+		ClientIP:     logEntry.clientIP,
+		ClientNames:  logEntry.clientNames,
+		DurationMs:   logEntry.durationMs,
+		Reason:       response.Reason,
+		ResponseType: response.rType.String(),
+		Answer:       util.AnswerToString(response.Res.Answer),
+		ResponseCode: dns.RcodeToString[response.Res.Rcode],
+		Upstream:     answeredBy(response),
+	}
+
+	if len(request.Req.Question) > 0 {
+		event.QuestionName = util.ExtractDomain(request.Req.Question[0])
+		event.QuestionType = dns.TypeToString[request.Req.Question[0].Qtype]
+	}
+
+	if b := response.Blocking; b != nil {
+		event.BlockedGroup = b.Group
+		event.BlockedList = b.List
+	}
+
+	return event
+}
+
+func (w *mqttWriter) close() {
+	w.client.Close()
+}
+
+func (w *mqttWriter) String() string {
+	return w.client.String() + ", topic " + w.topic
+}
@@ -0,0 +1,130 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/helpertest"
+	"blocky/util"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// waits max. 2 seconds for the published messages
+func receiveMqttMessages(t *testing.T, broker *helpertest.MqttBroker, count int) []helpertest.MqttMessage {
+	for i := 0; i < 200; i++ {
+		if messages := broker.Messages(); len(messages) >= count {
+			return messages
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("no mqtt message received")
+
+	return nil
+}
+
+func Test_MqttWriter_PublishesEvent(t *testing.T) {
+	broker := helpertest.NewMqttBroker()
+	defer broker.Close()
+
+	sut, err := newMqttWriter("tcp://"+broker.Addr, "", 1)
+	assert.NoError(t, err)
+
+	defer sut.close()
+
+	sut.add(newTestLogEntry(t, "example.com", BLOCKED))
+
+	m := receiveMqttMessages(t, broker, 1)[0]
+
+	assert.Equal(t, "blocky/query/client1", m.Topic)
+	assert.Equal(t, byte(1), m.QoS)
+
+	var event map[string]interface{}
+
+	assert.NoError(t, json.Unmarshal([]byte(m.Payload), &event))
+	assert.Equal(t, map[string]interface{}{
+		"time":          "2020-01-01T10:00:00Z",
+		"client_ip":     "192.168.178.25",
+		"client_names":  []interface{}{"client1"},
+		"duration_ms":   float64(15),
+		"reason":        "BLOCKED (ads)",
+		"response_type": "BLOCKED",
+		"question_name": "example.com",
+		"question_type": "A",
+		"answer":        "A (123.122.121.120)",
+		"response_code": "NOERROR",
+		"blocked_group": "ads",
+		"upstream":      "BLOCKED (ads)",
+	}, event)
+}
+
+func Test_MqttWriter_TopicPlaceholders(t *testing.T) {
+	sut := &mqttWriter{topic: "dns/{response_type}/{client}/{client_ip}"}
+
+	entry := newTestLogEntry(t, "example.com", CUSTOMDNS)
+	assert.Equal(t, "dns/custom_dns/client1/192.168.178.25", sut.createTopic(entry))
+
+	// client IP is used without name, characters with special meaning are replaced
+	entry.clientNames = nil
+	entry.clientIP = "fd00::1"
+	assert.Equal(t, "dns/custom_dns/fd00::1/fd00::1", sut.createTopic(entry))
+
+	entry.clientNames = []string{"laptop/#1+2"}
+	assert.Equal(t, "dns/custom_dns/laptop__1_2/fd00::1", sut.createTopic(entry))
+}
+
+func Test_NewMqttWriter_InvalidConfig(t *testing.T) {
+	_, err := newMqttWriter("localhost:1883", "", 0)
+	assert.Error(t, err)
+
+	_, err = newMqttWriter("tcp://localhost:1883", "", 2)
+	assert.Error(t, err)
+}
+
+func Test_Resolve_WithMqtt(t *testing.T) {
+	broker := helpertest.NewMqttBroker()
+	defer broker.Close()
+
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
+		Type:   "mqtt",
+		Target: "tcp://" + broker.Addr,
+		Topic:  "blocky/{client_ip}",
+		Filter: []string{"blocked"},
+	}).(*QueryLoggingResolver)
+	defer sut.Stop()
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "reason"}, nil).Once()
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "blocked", rType: BLOCKED,
+		Blocking: &BlockingInfo{Group: "ads"}}, nil)
+	sut.Next(m)
+
+	for _, domain := range []string{"example.com.", "blocked.com."} {
+		_, err := sut.Resolve(&Request{
+			ClientIP:    net.ParseIP("192.168.178.25"),
+			ClientNames: []string{"client1"},
+			Req:         util.NewMsgWithQuestion(domain, dns.TypeA),
+			Log:         logrus.NewEntry(logrus.New())})
+		assert.NoError(t, err)
+	}
+
+	sut.Flush(time.Second)
+
+	messages := receiveMqttMessages(t, broker, 1)
+
+	// only the blocked query matches the filter
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "blocky/192.168.178.25", messages[0].Topic)
+	assert.Contains(t, messages[0].Payload, `"question_name":"blocked.com"`)
+
+	c := sut.Configuration()
+	assert.Equal(t, `type = "mqtt"`, c[0])
+	assert.Contains(t, c[1], "topic blocky/{client_ip}")
+}
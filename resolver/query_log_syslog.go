@@ -0,0 +1,248 @@
+package resolver
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	syslogTag = "blocky"
+	// max number of not written entries, e.g. if the syslog daemon is not reachable. Newer entries are dropped
+	syslogBufferSize       = 1000
+	syslogMinReconnectWait = time.Second
+	syslogMaxReconnectWait = time.Minute
+	syslogDefaultFacility  = "daemon"
+)
+
+// names of the fields in a syslog line, same order as the columns of the csv log
+// nolint:gochecknoglobals
+var syslogFieldNames = []string{"time", "client_ip", "client_names", "duration_ms", "reason", "question",
+	"answer", "response_code", "blocked_list", "upstream"}
+
+// nolint:gochecknoglobals
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// writes query log entries as one line per query to a local or remote syslog daemon. Entries are buffered,
+// if the daemon is not reachable, the connection is retried with backoff and entries are dropped if the buffer is full
+type syslogWriter struct {
+	network  string
+	address  string
+	facility string
+	priority syslog.Priority
+	lines    chan string
+	stop     chan struct{}
+	dropped  uint64
+	// 1 if connected, accessed atomically
+	connected int32
+}
+
+// creates writer for passed target: empty for local syslog daemon, "udp://host:port", "tcp://host:port" or
+// "unix:///path/to/socket"
+func newSyslogWriter(target, facility string) (*syslogWriter, error) {
+	network, address, err := parseSyslogTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if facility == "" {
+		facility = syslogDefaultFacility
+	}
+
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility '%s'", facility)
+	}
+
+	w := &syslogWriter{
+		network:  network,
+		address:  address,
+		facility: facility,
+		priority: priority | syslog.LOG_INFO,
+		lines:    make(chan string, syslogBufferSize),
+		stop:     make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+func parseSyslogTarget(target string) (network, address string, err error) {
+	if target == "" {
+		return "", "", nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid syslog target '%s': %v", target, err)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("invalid syslog target '%s': host is missing", target)
+		}
+
+		return u.Scheme, u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("invalid syslog target '%s': socket path is missing", target)
+		}
+
+		return "unixgram", u.Path, nil
+	default:
+		return "", "", fmt.Errorf("invalid syslog target '%s': protocol must be udp, tcp or unix", target)
+	}
+}
+
+// adds entry to the buffer, never blocks
+func (w *syslogWriter) add(logEntry *queryLogEntry) {
+	select {
+	case w.lines <- createSyslogLine(logEntry):
+	default:
+		if atomic.AddUint64(&w.dropped, 1) == 1 {
+			logger(queryLoggingResolverPrefix).Warn("syslog is not available, dropping query log entries")
+		}
+	}
+}
+
+// connects to the syslog daemon and writes buffered lines. A line, which couldn't be written, is retried after
+// reconnect
+func (w *syslogWriter) run() {
+	var (
+		writer  *syslog.Writer
+		pending string
+		backoff = syslogMinReconnectWait
+	)
+
+	defer func() {
+		if writer != nil {
+			_ = writer.Close()
+		}
+	}()
+
+	for {
+		if pending == "" {
+			select {
+			case pending = <-w.lines:
+			case <-w.stop:
+				return
+			}
+		}
+
+		if writer == nil {
+			var err error
+
+			writer, err = syslog.Dial(w.network, w.address, w.priority, syslogTag)
+			if err != nil {
+				logger(queryLoggingResolverPrefix).Warnf("can't connect to syslog, will retry in %s: %v", backoff, err)
+
+				if !w.wait(backoff) {
+					return
+				}
+
+				backoff = nextBackoff(backoff)
+
+				continue
+			}
+
+			atomic.StoreInt32(&w.connected, 1)
+			backoff = syslogMinReconnectWait
+
+			if dropped := atomic.SwapUint64(&w.dropped, 0); dropped > 0 {
+				logger(queryLoggingResolverPrefix).Warnf("connected to syslog, %d query log entries were dropped", dropped)
+			}
+		}
+
+		if err := writer.Info(pending); err != nil {
+			logger(queryLoggingResolverPrefix).Warn("can't write query log entry to syslog, will reconnect: ", err)
+
+			atomic.StoreInt32(&w.connected, 0)
+
+			_ = writer.Close()
+			writer = nil
+
+			continue
+		}
+
+		pending = ""
+	}
+}
+
+// waits passed duration, returns false if the writer was stopped
+func (w *syslogWriter) wait(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-w.stop:
+		return false
+	}
+}
+
+func nextBackoff(current time.Duration) time.Duration {
+	if current*2 > syslogMaxReconnectWait {
+		return syslogMaxReconnectWait
+	}
+
+	return current * 2
+}
+
+func (w *syslogWriter) close() {
+	close(w.stop)
+}
+
+func (w *syslogWriter) String() string {
+	target := w.address
+	if target == "" {
+		target = "local"
+	}
+
+	status := "disconnected"
+	if atomic.LoadInt32(&w.connected) == 1 {
+		status = "connected"
+	}
+
+	return fmt.Sprintf("%s, facility %s (%s)", target, w.facility, status)
+}
+
+// creates line with key=value pairs, values with spaces or quotes are quoted
+func createSyslogLine(logEntry *queryLogEntry) string {
+	row := createQueryLogRow(logEntry)
+	fields := make([]string, len(row))
+
+	for i, value := range row {
+		if value == "" || strings.ContainsAny(value, " \"=\t") {
+			value = strconv.Quote(value)
+		}
+
+		fields[i] = syslogFieldNames[i] + "=" + value
+	}
+
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,113 @@
+package resolver
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reads lines from UDP listener in background
+func readSyslogUDP(conn net.PacketConn) chan string {
+	lines := make(chan string, 10)
+
+	go func() {
+		buf := make([]byte, 4096)
+
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			lines <- string(buf[:n])
+		}
+	}()
+
+	return lines
+}
+
+func receiveLine(t *testing.T, lines chan string) string {
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(2 * time.Second):
+		t.Fatal("no syslog line received")
+	}
+
+	return ""
+}
+
+func Test_SyslogWriter_WritesLine(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer conn.Close()
+
+	sut, err := newSyslogWriter("udp://"+conn.LocalAddr().String(), "local3")
+	assert.NoError(t, err)
+
+	defer sut.close()
+
+	sut.add(newTestLogEntry(t, "example.com", BLOCKED))
+
+	line := receiveLine(t, readSyslogUDP(conn))
+
+	// local3 (19) * 8 + info (6)
+	assert.True(t, strings.HasPrefix(line, "<158>"), line)
+	assert.Contains(t, line, `time="2020-01-01 10:00:00" client_ip=192.168.178.25 client_names=client1 `+
+		`duration_ms=15 reason="BLOCKED (ads)" question="A (example.com.)" answer="A (123.122.121.120)" `+
+		`response_code=NOERROR blocked_list="" upstream="BLOCKED (ads)"`)
+}
+
+func Test_SyslogWriter_ReconnectsAndDropsOnFullBuffer(t *testing.T) {
+	// reserve a free port, daemon is started later
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	addr := l.Addr().String()
+	assert.NoError(t, l.Close())
+
+	sut, err := newSyslogWriter("tcp://"+addr, "")
+	assert.NoError(t, err)
+
+	defer sut.close()
+
+	// not reachable: add doesn't block, entries above the buffer size are dropped (one entry is taken by the writer)
+	for i := 0; i < syslogBufferSize+10; i++ {
+		sut.add(newTestLogEntry(t, "example.com", RESOLVED))
+	}
+
+	assert.True(t, atomic.LoadUint64(&sut.dropped) >= 9)
+	assert.Contains(t, sut.String(), "disconnected")
+
+	l, err = net.Listen("tcp", addr)
+	assert.NoError(t, err)
+
+	defer l.Close()
+
+	c, err := l.Accept()
+	assert.NoError(t, err)
+
+	defer c.Close()
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, line, "example.com")
+	assert.Contains(t, sut.String(), "(connected)")
+}
+
+func Test_NewSyslogWriter_InvalidConfig(t *testing.T) {
+	_, err := newSyslogWriter("http://localhost", "")
+	assert.Error(t, err)
+
+	_, err = newSyslogWriter("udp://", "")
+	assert.Error(t, err)
+
+	_, err = newSyslogWriter("udp://localhost:514", "unknown")
+	assert.Error(t, err)
+}
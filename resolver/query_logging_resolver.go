@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,11 +21,19 @@ import (
 )
 
 const (
-	cleanUpRunPeriod           = 12 * time.Hour
+	cleanUpRunPeriod           = 24 * time.Hour
 	queryLoggingResolverPrefix = "query_logging_resolver"
 	logChanCap                 = 1000
+
+	// query log filter: only blocked queries
+	logFilterBlocked = "blocked"
+	// query log filter: only failed queries (resolution error or SERVFAIL)
+	logFilterErrors = "errors"
 )
 
+// names of log files written by blocky: date, client name (or ALL) and ".log" suffix
+var logFileNamePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}_[a-zA-Z0-9-_]*\.log$`) //nolint:gochecknoglobals
+
 // QueryLoggingResolver writes query information (question, answer, duration, ...) into
 // log file or as log entry (if log directory is not configured)
 type QueryLoggingResolver struct {
@@ -31,20 +41,48 @@ type QueryLoggingResolver struct {
 	logDir           string
 	perClient        bool
 	logRetentionDays uint64
-	logChan          chan *queryLogEntry
+	// if not empty, only queries of these categories are logged
+	filter map[string]bool
+	// replaces client IPs and names in log entries, nil if disabled
+	anonymizer *ipAnonymizer
+	// queries of these clients are not logged
+	excludedClients *clientSet
+	database        *databaseWriter
+	syslog          *syslogWriter
+	mqtt            *mqttWriter
+	logChan         chan *queryLogEntry
+	// held by senders to the log channel, the channel is closed on stop
+	sendLock sync.RWMutex
+	stopped  bool
+	stop     chan struct{}
+	// closed by the writer goroutine after all entries were written
+	writerDone chan struct{}
+	// open log files of the current day, used only by the writer goroutine
+	files     map[string]*os.File
+	filesDate string
 }
 
 type queryLogEntry struct {
-	request    *Request
-	response   *Response
-	start      time.Time
-	durationMs int64
-	logger     *logrus.Entry
+	request *Request
+	// client IP and names (anonymized if configured)
+	clientIP    string
+	clientNames []string
+	response    *Response
+	start       time.Time
+	durationMs  int64
+	logger      *logrus.Entry
+	// if set, entry is only a marker: channel will be closed after all previous entries were written
+	flushed chan struct{}
 }
 
-func NewQueryLoggingResolver(cfg config.QueryLogConfig) ChainedResolver {
+// returns the request logger with prefix, the prefix is only added in the writer to keep the hot path cheap
+func (e *queryLogEntry) log() *logrus.Entry {
+	return e.logger.WithField("prefix", queryLoggingResolverPrefix)
+}
+
+func NewQueryLoggingResolver(cfg config.QueryLogConfig) (ChainedResolver, error) {
 	if cfg.Dir != "" && unix.Access(cfg.Dir, unix.W_OK) != nil {
-		logger(queryLoggingResolverPrefix).Fatalf("query log directory '%s' does not exist or is not writable", cfg.Dir)
+		return nil, fmt.Errorf("query log directory '%s' does not exist or is not writable", cfg.Dir)
 	}
 
 	logChan := make(chan *queryLogEntry, logChanCap)
@@ -53,30 +91,122 @@ func NewQueryLoggingResolver(cfg config.QueryLogConfig) ChainedResolver {
 		logDir:           cfg.Dir,
 		perClient:        cfg.PerClient,
 		logRetentionDays: cfg.LogRetentionDays,
+		excludedClients:  newClientSet(cfg.ExcludedClients),
 		logChan:          logChan,
+		stop:             make(chan struct{}),
+		writerDone:       make(chan struct{}),
+		files:            make(map[string]*os.File),
+	}
+
+	switch cfg.AnonymizeClientIP {
+	case "", anonymizeMask, anonymizeHash:
+		anonymizer, err := newIPAnonymizer(cfg.AnonymizeClientIP, cfg.AnonymizationSalt)
+		if err != nil {
+			return nil, err
+		}
+
+		resolver.anonymizer = anonymizer
+	default:
+		return nil, fmt.Errorf("unknown client IP anonymization '%s'", cfg.AnonymizeClientIP)
+	}
+
+	if len(cfg.Filter) > 0 {
+		resolver.filter = make(map[string]bool)
+
+		for _, f := range cfg.Filter {
+			if f != logFilterBlocked && f != logFilterErrors {
+				return nil, fmt.Errorf("unknown query log filter '%s'", f)
+			}
+
+			resolver.filter[f] = true
+		}
+	}
+
+	switch cfg.Type {
+	case "", "csv":
+	case "mysql":
+		database, err := newDatabaseWriter("mysql", cfg.Target)
+		if err != nil {
+			return nil, fmt.Errorf("can't create query log database writer: %v", err)
+		}
+
+		resolver.database = database
+	case "syslog":
+		syslog, err := newSyslogWriter(cfg.Target, cfg.Facility)
+		if err != nil {
+			return nil, fmt.Errorf("can't create query log syslog writer: %v", err)
+		}
+
+		resolver.syslog = syslog
+	case "mqtt":
+		mqtt, err := newMqttWriter(cfg.Target, cfg.Topic, cfg.QoS)
+		if err != nil {
+			return nil, fmt.Errorf("can't create query log mqtt writer: %v", err)
+		}
+
+		resolver.mqtt = mqtt
+	default:
+		return nil, fmt.Errorf("unknown query log type '%s'", cfg.Type)
 	}
 
 	go resolver.writeLog()
 
-	if cfg.LogRetentionDays > 0 {
+	if cfg.LogRetentionDays > 0 && cfg.Dir != "" && resolver.database == nil && resolver.syslog == nil &&
+		resolver.mqtt == nil {
 		go resolver.periodicCleanUp()
 	}
 
-	return &resolver
+	return &resolver, nil
 }
 
-// triggers periodically cleanup of old log files
+// triggers cleanup of old log files on start and periodically
 func (r *QueryLoggingResolver) periodicCleanUp() {
+	r.doCleanUp()
+
 	ticker := time.NewTicker(cleanUpRunPeriod)
 	defer ticker.Stop()
 
 	for {
-		<-ticker.C
-		r.doCleanUp()
+		select {
+		case <-ticker.C:
+			r.doCleanUp()
+		case <-r.stop:
+			return
+		}
 	}
 }
 
-// deletes old log files
+// Stop stops periodical clean up of old log files, waits until the buffered log entries are written and closes the
+// log files and the database, syslog or mqtt connection
+func (r *QueryLoggingResolver) Stop() {
+	r.sendLock.Lock()
+
+	if r.stopped {
+		r.sendLock.Unlock()
+		return
+	}
+
+	r.stopped = true
+	close(r.stop)
+	close(r.logChan)
+	r.sendLock.Unlock()
+
+	<-r.writerDone
+
+	if r.database != nil {
+		r.database.close()
+	}
+
+	if r.syslog != nil {
+		r.syslog.close()
+	}
+
+	if r.mqtt != nil {
+		r.mqtt.close()
+	}
+}
+
+// deletes log files older than retention time, only files created by blocky (date prefix and ".log" suffix) are deleted
 func (r *QueryLoggingResolver) doCleanUp() {
 	logger := logger(queryLoggingResolverPrefix)
 
@@ -85,33 +215,48 @@ func (r *QueryLoggingResolver) doCleanUp() {
 	files, err := ioutil.ReadDir(r.logDir)
 	if err != nil {
 		logger.WithField("log_dir", r.logDir).Error("can't list log directory: ", err)
+		return
 	}
 
-	// search for log files, which names starts with date
+	// age is calculated in full days
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+	var removed int
+
 	for _, f := range files {
-		if strings.HasSuffix(f.Name(), ".log") && len(f.Name()) > 10 {
-			t, err := time.Parse("2006-01-02", f.Name()[:10])
-			if err == nil {
-				differenceDays := uint64(time.Since(t).Hours() / 24)
-				if r.logRetentionDays > 0 && differenceDays > r.logRetentionDays {
-					logger.WithFields(logrus.Fields{
-						"file":             f.Name(),
-						"ageInDays":        differenceDays,
-						"logRetentionDays": r.logRetentionDays,
-					}).Info("existing log file is older than retention time and will be deleted")
-
-					err := os.Remove(filepath.Join(r.logDir, f.Name()))
-					if err != nil {
-						logger.WithField("file", f.Name()).Error("can't remove file: ", err)
-					}
-				}
+		if f.IsDir() || !logFileNamePattern.MatchString(f.Name()) {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006-01-02", f.Name()[:10], time.Local)
+		if err != nil {
+			continue
+		}
+
+		differenceDays := int64(math.Round(today.Sub(t).Hours() / 24))
+		if differenceDays > int64(r.logRetentionDays) {
+			logger.WithFields(logrus.Fields{
+				"file":             f.Name(),
+				"ageInDays":        differenceDays,
+				"logRetentionDays": r.logRetentionDays,
+			}).Debug("existing log file is older than retention time and will be deleted")
+
+			if err := os.Remove(filepath.Join(r.logDir, f.Name())); err != nil {
+				logger.WithField("file", f.Name()).Error("can't remove file: ", err)
+			} else {
+				removed++
 			}
 		}
 	}
+
+	logger.WithField("log_dir", r.logDir).Infof("log clean up finished, removed %d files", removed)
 }
 
 func (r *QueryLoggingResolver) Resolve(request *Request) (*Response, error) {
-	logger := withPrefix(request.Log, queryLoggingResolverPrefix)
+	if r.excludedClients.contains(request) {
+		return r.next.Resolve(request)
+	}
 
 	start := time.Now()
 
@@ -119,73 +264,236 @@ func (r *QueryLoggingResolver) Resolve(request *Request) (*Response, error) {
 
 	duration := time.Since(start).Milliseconds()
 
-	if err == nil {
-		select {
-		case r.logChan <- &queryLogEntry{
-			request:    request,
-			response:   resp,
-			start:      start,
-			durationMs: duration,
-			logger:     logger}:
-		default:
-			logger.Error("query log writer is too slow, log entry will be dropped")
+	logResp := resp
+
+	if err != nil {
+		// failed resolution is logged as SERVFAIL with error as reason
+		failed := new(dns.Msg)
+		failed.SetRcode(request.Req, dns.RcodeServerFailure)
+		logResp = &Response{Res: failed, Reason: fmt.Sprintf("ERROR (%v)", err)}
+	}
+
+	if r.shouldLog(logResp, err) && r.hasOutput(request) {
+		entry := &queryLogEntry{
+			request:     request,
+			clientIP:    request.ClientIP.String(),
+			clientNames: request.ClientNames,
+			response:    logResp,
+			start:       start,
+			durationMs:  duration,
+			logger:      request.Log,
+		}
+
+		if r.anonymizer != nil {
+			entry.clientIP = r.anonymizer.anonymizeIP(request.ClientIP)
+			entry.clientNames = r.anonymizer.anonymizeNames(request.ClientNames, request.ClientIP)
+			entry.logger = request.Log.WithFields(logrus.Fields{
+				"client_ip":    entry.clientIP,
+				"client_names": strings.Join(entry.clientNames, "; "),
+			})
 		}
+
+		r.send(entry)
 	}
 
 	return resp, err
 }
 
-// write entry: if log directory is configured, write to log file
+// passes entry to the writer without blocking, entries are dropped if the writer is too slow or stopped
+func (r *QueryLoggingResolver) send(entry *queryLogEntry) {
+	r.sendLock.RLock()
+	defer r.sendLock.RUnlock()
+
+	if r.stopped {
+		return
+	}
+
+	select {
+	case r.logChan <- entry:
+	default:
+		entry.log().Error("query log writer is too slow, log entry will be dropped")
+	}
+}
+
+// returns true if the query matches the configured filter (all queries if no filter is configured)
+func (r *QueryLoggingResolver) shouldLog(resp *Response, err error) bool {
+	if len(r.filter) == 0 {
+		return true
+	}
+
+	if r.filter[logFilterBlocked] && resp.Blocking != nil {
+		return true
+	}
+
+	return r.filter[logFilterErrors] && (err != nil || resp.Res.Rcode == dns.RcodeServerFailure)
+}
+
+// log entries are written to the console on info level, if no other target is configured
+func (r *QueryLoggingResolver) hasOutput(request *Request) bool {
+	return r.database != nil || r.syslog != nil || r.mqtt != nil || r.logDir != "" ||
+		request.Log.Logger.IsLevelEnabled(logrus.InfoLevel)
+}
+
+// Flush blocks until all buffered log entries are written or the timeout is reached
+func (r *QueryLoggingResolver) Flush(timeout time.Duration) {
+	flushed := make(chan struct{})
+	deadline := time.After(timeout)
+
+	r.sendLock.RLock()
+	defer r.sendLock.RUnlock()
+
+	if r.stopped {
+		return
+	}
+
+	select {
+	case r.logChan <- &queryLogEntry{flushed: flushed}:
+	case <-deadline:
+		logger(queryLoggingResolverPrefix).Warn("timeout on query log flush")
+		return
+	}
+
+	select {
+	case <-flushed:
+	case <-deadline:
+		logger(queryLoggingResolverPrefix).Warn("timeout on query log flush")
+	}
+}
+
+// write entry: if database, syslog or mqtt is configured, write to it, if log directory is configured, write to file.
+// Returns after the channel was closed and all entries were written
 func (r *QueryLoggingResolver) writeLog() {
+	defer close(r.writerDone)
+	defer r.closeFiles()
+
 	for logEntry := range r.logChan {
-		if r.logDir != "" {
-			var clientPrefix string
+		if logEntry.flushed != nil {
+			if r.database != nil {
+				r.database.flush()
+			}
 
-			start := time.Now()
+			r.closeFiles()
+			close(logEntry.flushed)
 
-			dateString := logEntry.start.Format("2006-01-02")
+			continue
+		}
 
-			if r.perClient {
-				clientPrefix = strings.Join(logEntry.request.ClientNames, "-")
-			} else {
-				clientPrefix = "ALL"
+		switch {
+		case r.database != nil:
+			r.database.add(logEntry)
+		case r.syslog != nil:
+			r.syslog.add(logEntry)
+		case r.mqtt != nil:
+			r.mqtt.add(logEntry)
+		case r.logDir != "":
+			r.writeToFile(logEntry)
+		case logEntry.logger.Logger.IsLevelEnabled(logrus.InfoLevel):
+			fields := logrus.Fields{
+				"response_reason": logEntry.response.Reason,
+				"response_code":   dns.RcodeToString[logEntry.response.Res.Rcode],
+				"answer":          util.AnswerToString(logEntry.response.Res.Answer),
+				"duration_ms":     logEntry.durationMs,
+				"upstream":        answeredBy(logEntry.response),
+				"question":        util.QuestionToString(logEntry.request.Req.Question),
+				"client_ip":       logEntry.clientIP,
+				"client_names":    strings.Join(logEntry.clientNames, "; "),
 			}
 
-			fileName := fmt.Sprintf("%s_%s.log", dateString, escape(clientPrefix))
-			writePath := filepath.Join(r.logDir, fileName)
+			if b := logEntry.response.Blocking; b != nil {
+				fields["blocked_group"] = b.Group
+				fields["blocked_list"] = b.List
+				fields["blocked_entry"] = b.Entry
+			}
 
-			file, err := os.OpenFile(writePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+			logEntry.log().WithFields(fields).Infof("query resolved")
+		}
+	}
+}
 
-			if err != nil {
-				logEntry.logger.WithField("file_name", writePath).Error("can't create/open file", err)
-			} else {
-				writer := createCsvWriter(file)
+func (r *QueryLoggingResolver) writeToFile(logEntry *queryLogEntry) {
+	var clientPrefix string
 
-				err := writer.Write(createQueryLogRow(logEntry))
-				if err != nil {
-					logEntry.logger.WithField("file_name", writePath).Error("can't write to file", err)
-				}
-				writer.Flush()
-			}
+	start := time.Now()
 
-			halfCap := cap(r.logChan) / 2
+	// file is chosen by query time: entries buffered around midnight are written to the file of their day
+	dateString := logEntry.start.Format("2006-01-02")
 
-			// if log channel is > 50% full, this could be a problem with slow writer (external storage over network etc.)
-			if len(r.logChan) > halfCap {
-				logEntry.logger.WithField("channel_len",
-					len(r.logChan)).Warnf("query log writer is too slow, write duration: %d ms", time.Since(start).Milliseconds())
-			}
-		} else {
-			logEntry.logger.WithFields(
-				logrus.Fields{
-					"response_reason": logEntry.response.Reason,
-					"response_code":   dns.RcodeToString[logEntry.response.Res.Rcode],
-					"answer":          util.AnswerToString(logEntry.response.Res.Answer),
-					"duration_ms":     logEntry.durationMs,
-				},
-			).Infof("query resolved")
+	if r.perClient {
+		clientPrefix = strings.Join(logEntry.clientNames, "-")
+		if clientPrefix == "" {
+			clientPrefix = logEntry.clientIP
+		}
+	} else {
+		clientPrefix = "ALL"
+	}
+
+	fileName := fmt.Sprintf("%s_%s.log", dateString, escape(clientPrefix))
+	writePath := filepath.Join(r.logDir, fileName)
+
+	file, err := r.openFile(writePath, dateString)
+
+	if err != nil {
+		logEntry.log().WithField("file_name", writePath).Error("can't create/open file", err)
+	} else {
+		writer := createCsvWriter(file)
+
+		err := writer.Write(createQueryLogRow(logEntry))
+		if err != nil {
+			logEntry.log().WithField("file_name", writePath).Error("can't write to file", err)
+		}
+		writer.Flush()
+
+		// file of a previous day (late entry after rollover) is not kept open
+		if dateString < r.filesDate {
+			closeFile(file)
 		}
 	}
+
+	halfCap := cap(r.logChan) / 2
+
+	// if log channel is > 50% full, this could be a problem with slow writer (external storage over network etc.)
+	if len(r.logChan) > halfCap {
+		logEntry.log().WithField("channel_len",
+			len(r.logChan)).Warnf("query log writer is too slow, write duration: %d ms", time.Since(start).Milliseconds())
+	}
+}
+
+// returns open file for passed path, files of the current day are cached. On day rollover, all cached files are closed
+func (r *QueryLoggingResolver) openFile(path string, dateString string) (*os.File, error) {
+	if dateString > r.filesDate {
+		r.closeFiles()
+		r.filesDate = dateString
+	}
+
+	if dateString == r.filesDate {
+		if file, ok := r.files[path]; ok {
+			return file, nil
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if dateString == r.filesDate {
+		r.files[path] = file
+	}
+
+	return file, nil
+}
+
+func (r *QueryLoggingResolver) closeFiles() {
+	for path, file := range r.files {
+		closeFile(file)
+		delete(r.files, path)
+	}
+}
+
+func closeFile(file *os.File) {
+	if err := file.Close(); err != nil {
+		logger(queryLoggingResolverPrefix).WithField("file_name", file.Name()).Error("can't close file: ", err)
+	}
 }
 
 func escape(file string) string {
@@ -206,18 +514,57 @@ func createQueryLogRow(logEntry *queryLogEntry) []string {
 
 	return []string{
 		logEntry.start.Format("2006-01-02 15:04:05"),
-		request.ClientIP.String(),
-		strings.Join(request.ClientNames, "; "),
+		logEntry.clientIP,
+		strings.Join(logEntry.clientNames, "; "),
 		fmt.Sprintf("%d", logEntry.durationMs),
 		response.Reason,
 		util.QuestionToString(request.Req.Question),
 		util.AnswerToString(response.Res.Answer),
 		dns.RcodeToString[response.Res.Rcode],
+		blockingListName(response),
+		answeredBy(response),
+	}
+}
+
+// returns the source of the answer: upstream with protocol, CACHE, BLOCKED (list), CUSTOMDNS or FILTERED
+func answeredBy(response *Response) string {
+	switch response.rType {
+	case CACHED:
+		return "CACHE"
+	case BLOCKED:
+		if response.Blocking != nil && response.Blocking.List == "" {
+			return fmt.Sprintf("BLOCKED (%s)", response.Blocking.Group)
+		}
+
+		return fmt.Sprintf("BLOCKED (%s)", blockingListName(response))
+	case CUSTOMDNS:
+		return "CUSTOMDNS"
+	case FILTERED:
+		return "FILTERED"
+	default:
+		return response.Upstream
+	}
+}
+
+// returns the list, which contains the blocked domain (or blocked CNAME target)
+func blockingListName(response *Response) string {
+	if response.Blocking == nil {
+		return ""
 	}
+
+	return response.Blocking.List
 }
 
 func (r *QueryLoggingResolver) Configuration() (result []string) {
-	if r.logDir != "" {
+	if r.database != nil {
+		result = append(result, "type = \"mysql\"")
+	} else if r.syslog != nil {
+		result = append(result, "type = \"syslog\"")
+		result = append(result, fmt.Sprintf("syslog = %s", r.syslog))
+	} else if r.mqtt != nil {
+		result = append(result, "type = \"mqtt\"")
+		result = append(result, fmt.Sprintf("mqtt = %s", r.mqtt))
+	} else if r.logDir != "" {
 		result = append(result, fmt.Sprintf("logDir= \"%s\"", r.logDir))
 		result = append(result, fmt.Sprintf("perClient = %t", r.perClient))
 		result = append(result, fmt.Sprintf("logRetentionDays= %d", r.logRetentionDays))
@@ -229,9 +576,14 @@ func (r *QueryLoggingResolver) Configuration() (result []string) {
 		result = []string{"deactivated"}
 	}
 
+	// only the number of rules, the excluded clients should not appear in logs
+	if n := r.excludedClients.size(); n > 0 {
+		result = append(result, fmt.Sprintf("excludedClients = %d rules", n))
+	}
+
 	return
 }
 
-func (r QueryLoggingResolver) String() string {
+func (r *QueryLoggingResolver) String() string {
 	return fmt.Sprintf("query logging resolver")
 }
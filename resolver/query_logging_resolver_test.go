@@ -5,6 +5,7 @@ import (
 	"blocky/util"
 	"bufio"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -21,27 +22,39 @@ import (
 	"github.com/stretchr/testify/mock"
 )
 
+func newTestQueryLoggingResolver(t *testing.T, cfg config.QueryLogConfig) ChainedResolver {
+	r, err := NewQueryLoggingResolver(cfg)
+	assert.NoError(t, err)
+
+	return r
+}
+
 func Test_doCleanUp(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "queryLoggingResolver")
 	defer os.RemoveAll(tmpDir)
 	assert.NoError(t, err)
 
-	// create 2 files, 7 and 8 days old
+	// create 2 log files, 7 and 8 days old and 1 old unrelated file
 	dateBefore7Days := time.Now().AddDate(0, 0, -7)
 	dateBefore8Days := time.Now().AddDate(0, 0, -8)
 
-	f1, err := os.Create(filepath.Join(tmpDir, fmt.Sprintf("%s-test.log", dateBefore7Days.Format("2006-01-02"))))
+	f1, err := os.Create(filepath.Join(tmpDir, fmt.Sprintf("%s_ALL.log", dateBefore7Days.Format("2006-01-02"))))
+	assert.NoError(t, err)
+
+	f2, err := os.Create(filepath.Join(tmpDir, fmt.Sprintf("%s_client1.log", dateBefore8Days.Format("2006-01-02"))))
 	assert.NoError(t, err)
 
-	f2, err := os.Create(filepath.Join(tmpDir, fmt.Sprintf("%s-test.log", dateBefore8Days.Format("2006-01-02"))))
+	f3, err := os.Create(filepath.Join(tmpDir, fmt.Sprintf("%s-backup.log", dateBefore8Days.Format("2006-01-02"))))
 	assert.NoError(t, err)
 
-	sut := NewQueryLoggingResolver(config.QueryLogConfig{
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
 		Dir:              tmpDir,
 		LogRetentionDays: 7,
 	})
+	defer sut.(*QueryLoggingResolver).Stop()
 
-	sut.(*QueryLoggingResolver).doCleanUp()
+	// clean up runs on start
+	time.Sleep(100 * time.Millisecond)
 
 	// file 1 exist
 	_, err = os.Stat(f1.Name())
@@ -51,10 +64,221 @@ func Test_doCleanUp(t *testing.T) {
 	_, err = os.Stat(f2.Name())
 	assert.Error(t, err)
 	assert.True(t, os.IsNotExist(err))
+
+	// file 3 was not created by blocky
+	_, err = os.Stat(f3.Name())
+	assert.NoError(t, err)
+}
+
+func Test_WriteLog_DayRollover(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "queryLoggingResolver")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(tmpDir)
+
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
+		Dir: tmpDir,
+	}).(*QueryLoggingResolver)
+
+	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	beforeMidnight := time.Date(2020, 1, 1, 23, 59, 59, 0, time.Local)
+
+	// entry was buffered before midnight and is written after midnight
+	sut.logChan <- &queryLogEntry{
+		request: &Request{
+			ClientIP: net.ParseIP("192.168.178.25"),
+			Req:      util.NewMsgWithQuestion("google.de.", dns.TypeA),
+			Log:      logrus.NewEntry(logrus.New())},
+		response: &Response{Res: resp, Reason: "reason"},
+		start:    beforeMidnight,
+		logger:   logrus.NewEntry(logrus.New()),
+	}
+
+	sut.Flush(time.Second)
+
+	csvLines := readCsv(filepath.Join(tmpDir, "2020-01-01_ALL.log"))
+	assert.Len(t, csvLines, 1)
+}
+
+func Test_WriteLog_PerClientFileHandles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "queryLoggingResolver")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(tmpDir)
+
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
+		Dir:       tmpDir,
+		PerClient: true,
+	}).(*QueryLoggingResolver)
+
+	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	entry := func(start time.Time) *queryLogEntry {
+		return &queryLogEntry{
+			clientIP: "192.168.178.25",
+			request: &Request{
+				ClientIP: net.ParseIP("192.168.178.25"),
+				Req:      util.NewMsgWithQuestion("google.de.", dns.TypeA),
+				Log:      logrus.NewEntry(logrus.New())},
+			response: &Response{Res: resp, Reason: "reason"},
+			start:    start,
+			logger:   logrus.NewEntry(logrus.New()),
+		}
+	}
+
+	day1 := time.Date(2020, 1, 1, 23, 59, 59, 0, time.Local)
+	day2 := day1.Add(2 * time.Second)
+
+	// client without name: file name contains the IP, handle is cached
+	sut.writeToFile(entry(day1))
+	assert.Len(t, sut.files, 1)
+	assert.Contains(t, sut.files, filepath.Join(tmpDir, "2020-01-01_192_168_178_25.log"))
+
+	// rollover: handles of the previous day are closed
+	sut.writeToFile(entry(day2))
+	assert.Len(t, sut.files, 1)
+	assert.Contains(t, sut.files, filepath.Join(tmpDir, "2020-01-02_192_168_178_25.log"))
+
+	// late entry of previous day is written, but the file is not cached
+	sut.writeToFile(entry(day1))
+	assert.Len(t, sut.files, 1)
+
+	sut.closeFiles()
+
+	assert.Len(t, readCsv(filepath.Join(tmpDir, "2020-01-01_192_168_178_25.log")), 2)
+	assert.Len(t, readCsv(filepath.Join(tmpDir, "2020-01-02_192_168_178_25.log")), 1)
+}
+
+func Test_Resolve_WithFilter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "queryLoggingResolver")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(tmpDir)
+
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
+		Dir:    tmpDir,
+		Filter: []string{"blocked", "errors"},
+	})
+
+	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: resp, Reason: "RESOLVED"}, nil).Once()
+	m.On("Resolve", mock.Anything).Return(&Response{Res: resp, Reason: "BLOCKED (ads)", rType: BLOCKED,
+		Blocking: &BlockingInfo{Group: "ads", List: "ads.txt"}}, nil).Once()
+	m.On("Resolve", mock.Anything).Return((*Response)(nil), errors.New("upstream timeout")).Once()
+	sut.Next(m)
+
+	for i := 0; i < 3; i++ {
+		_, _ = sut.Resolve(&Request{
+			ClientIP: net.ParseIP("192.168.178.25"),
+			Req:      util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log:      logrus.NewEntry(logrus.New())})
+	}
+
+	sut.(*QueryLoggingResolver).Flush(time.Second)
+
+	csvLines := readCsv(filepath.Join(tmpDir, fmt.Sprintf("%s_ALL.log", time.Now().Format("2006-01-02"))))
+
+	assert.Len(t, csvLines, 2)
+	assert.Equal(t, "BLOCKED (ads)", csvLines[0][4])
+	assert.Equal(t, "ads.txt", csvLines[0][8])
+	assert.Equal(t, "BLOCKED (ads.txt)", csvLines[0][9])
+	assert.Equal(t, "ERROR (upstream timeout)", csvLines[1][4])
+	assert.Equal(t, "SERVFAIL", csvLines[1][7])
+}
+
+func Test_Resolve_ExcludedClients(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "queryLoggingResolver")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(tmpDir)
+
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
+		Dir:             tmpDir,
+		ExcludedClients: []string{"laptop-*", "10.0.0.0/8", "192.168.178.30"},
+	})
+
+	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: resp, Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	for _, client := range []struct {
+		ip   string
+		name string
+	}{
+		{"192.168.178.25", "laptop-anna"},
+		{"10.1.2.3", ""},
+		{"192.168.178.30", ""},
+		{"192.168.178.40", "phone"},
+	} {
+		_, err = sut.Resolve(&Request{
+			ClientIP:    net.ParseIP(client.ip),
+			ClientNames: []string{client.name},
+			Req:         util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log:         logrus.NewEntry(logrus.New())})
+		assert.NoError(t, err)
+	}
+
+	sut.(*QueryLoggingResolver).Flush(time.Second)
+
+	csvLines := readCsv(filepath.Join(tmpDir, fmt.Sprintf("%s_ALL.log", time.Now().Format("2006-01-02"))))
+
+	// queries of excluded clients are resolved, but not logged
+	m.AssertNumberOfCalls(t, "Resolve", 4)
+	assert.Len(t, csvLines, 1)
+	assert.Equal(t, "192.168.178.40", csvLines[0][1])
+
+	// only the number of rules is printed
+	c := sut.Configuration()
+	assert.Contains(t, c, "excludedClients = 3 rules")
+	assert.NotContains(t, fmt.Sprint(c), "laptop")
+}
+
+func Test_Resolve_AnonymizeClientIP(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "queryLoggingResolver")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(tmpDir)
+
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
+		Dir:               tmpDir,
+		PerClient:         true,
+		AnonymizeClientIP: "mask",
+	})
+
+	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: resp, Reason: "reason"}, nil)
+	sut.Next(m)
+
+	_, err = sut.Resolve(&Request{
+		ClientIP:    net.ParseIP("192.168.178.25"),
+		ClientNames: []string{"192.168.178.25"},
+		Req:         util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log:         logrus.NewEntry(logrus.New())})
+	assert.NoError(t, err)
+
+	sut.(*QueryLoggingResolver).Flush(time.Second)
+
+	csvLines := readCsv(filepath.Join(tmpDir, fmt.Sprintf("%s_192_168_178_0.log", time.Now().Format("2006-01-02"))))
+
+	assert.Len(t, csvLines, 1)
+	assert.Equal(t, "192.168.178.0", csvLines[0][1])
+	assert.Equal(t, "192.168.178.0", csvLines[0][2])
 }
 
 func Test_Resolve_WithEmptyConfig(t *testing.T) {
-	sut := NewQueryLoggingResolver(config.QueryLogConfig{})
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{})
 	m := &resolverMock{}
 	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
 	assert.NoError(t, err)
@@ -76,7 +300,7 @@ func Test_Resolve_WithLoggingPerClient(t *testing.T) {
 
 	defer os.RemoveAll(tmpDir)
 
-	sut := NewQueryLoggingResolver(config.QueryLogConfig{
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
 		Dir:       tmpDir,
 		PerClient: true,
 	})
@@ -135,7 +359,7 @@ func Test_Resolve_WithLoggingAll(t *testing.T) {
 
 	defer os.RemoveAll(tmpDir)
 
-	sut := NewQueryLoggingResolver(config.QueryLogConfig{
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
 		Dir:       tmpDir,
 		PerClient: false,
 	})
@@ -185,6 +409,80 @@ func Test_Resolve_WithLoggingAll(t *testing.T) {
 	assert.Equal(t, "A (123.122.121.120)", csvLines[1][6])
 }
 
+func Test_Flush_WritesBufferedEntries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "queryLoggingResolver")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(tmpDir)
+
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
+		Dir: tmpDir,
+	})
+
+	m := &resolverMock{}
+	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: resp, Reason: "reason"}, nil)
+	sut.Next(m)
+
+	for i := 0; i < 10; i++ {
+		_, err = sut.Resolve(&Request{
+			ClientIP:    net.ParseIP("192.168.178.25"),
+			ClientNames: []string{"client1"},
+			Req:         util.NewMsgWithQuestion("google.de.", dns.TypeA),
+			Log:         logrus.NewEntry(logrus.New())})
+		assert.NoError(t, err)
+	}
+
+	sut.(*QueryLoggingResolver).Flush(time.Second)
+
+	csvLines := readCsv(filepath.Join(tmpDir, fmt.Sprintf("%s_ALL.log", time.Now().Format("2006-01-02"))))
+	assert.Len(t, csvLines, 10)
+}
+
+func Test_Stop_WritesBufferedEntriesAndClosesFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "queryLoggingResolver")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(tmpDir)
+
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
+		Dir: tmpDir,
+	}).(*QueryLoggingResolver)
+
+	m := &resolverMock{}
+	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: resp, Reason: "reason"}, nil)
+	sut.Next(m)
+
+	request := func() *Request {
+		return &Request{
+			ClientIP: net.ParseIP("192.168.178.25"),
+			Req:      util.NewMsgWithQuestion("google.de.", dns.TypeA),
+			Log:      logrus.NewEntry(logrus.New())}
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err = sut.Resolve(request())
+		assert.NoError(t, err)
+	}
+
+	sut.Stop()
+
+	csvLines := readCsv(filepath.Join(tmpDir, fmt.Sprintf("%s_ALL.log", time.Now().Format("2006-01-02"))))
+	assert.Len(t, csvLines, 10)
+	assert.Empty(t, sut.files)
+
+	// queries after stop are resolved, but not logged
+	_, err = sut.Resolve(request())
+	assert.NoError(t, err)
+	sut.Flush(time.Second)
+	sut.Stop()
+}
+
 func readCsv(file string) [][]string {
 	var result [][]string
 
@@ -216,7 +514,7 @@ func Test_Configuration_QueryLoggingResolver_WithConfig(t *testing.T) {
 
 	defer os.RemoveAll(tmpDir)
 
-	sut := NewQueryLoggingResolver(config.QueryLogConfig{
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{
 		Dir:              tmpDir,
 		PerClient:        true,
 		LogRetentionDays: 3,
@@ -225,8 +523,30 @@ func Test_Configuration_QueryLoggingResolver_WithConfig(t *testing.T) {
 	assert.Len(t, c, 3)
 }
 
+func Test_NewQueryLoggingResolver_InvalidConfig(t *testing.T) {
+	_, err := NewQueryLoggingResolver(config.QueryLogConfig{Dir: "/does/not/exist"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not exist or is not writable")
+
+	_, err = NewQueryLoggingResolver(config.QueryLogConfig{Type: "unknown"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown query log type 'unknown'")
+}
+
 func Test_Configuration_QueryLoggingResolver_Disabled(t *testing.T) {
-	sut := NewQueryLoggingResolver(config.QueryLogConfig{})
+	sut := newTestQueryLoggingResolver(t, config.QueryLogConfig{})
 	c := sut.Configuration()
 	assert.Equal(t, []string{"deactivated"}, c)
 }
+
+func Test_answeredBy(t *testing.T) {
+	res := new(dns.Msg)
+
+	assert.Equal(t, "tcp+udp:1.1.1.1:53", answeredBy(&Response{Res: res, Upstream: "tcp+udp:1.1.1.1:53"}))
+	assert.Equal(t, "CACHE", answeredBy(&Response{Res: res, rType: CACHED, Upstream: "tcp+udp:1.1.1.1:53"}))
+	assert.Equal(t, "CUSTOMDNS", answeredBy(&Response{Res: res, rType: CUSTOMDNS}))
+	assert.Equal(t, "BLOCKED (ads)", answeredBy(&Response{Res: res, rType: BLOCKED,
+		Blocking: &BlockingInfo{Group: "ads"}}))
+	assert.Equal(t, "BLOCKED (ads.txt)", answeredBy(&Response{Res: res, rType: BLOCKED,
+		Blocking: &BlockingInfo{Group: "ads", List: "ads.txt"}}))
+}
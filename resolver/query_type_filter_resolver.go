@@ -0,0 +1,138 @@
+package resolver
+
+import (
+	"blocky/config"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QueryTypeFilterResolver answers queries with filtered query types (globally or per client) with NODATA
+// and refuses ANY queries with NOTIMP if configured
+type QueryTypeFilterResolver struct {
+	NextResolver
+	queryTypes   map[uint16]bool
+	clientGroups map[string]map[uint16]bool
+	clientCIDRs  map[string]*net.IPNet
+	refuseAny    bool
+}
+
+func NewQueryTypeFilterResolver(cfg config.QueryTypeFilterConfig) (ChainedResolver, error) {
+	queryTypes, err := parseQueryTypes(cfg.QueryTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	clientGroups := make(map[string]map[uint16]bool, len(cfg.ClientGroups))
+	for client, types := range cfg.ClientGroups {
+		if clientGroups[client], err = parseQueryTypes(types); err != nil {
+			return nil, err
+		}
+	}
+
+	return &QueryTypeFilterResolver{
+		queryTypes:   queryTypes,
+		clientGroups: clientGroups,
+		clientCIDRs:  parseClientCIDRs(cfg.ClientGroups),
+		refuseAny:    cfg.RefuseAny,
+	}, nil
+}
+
+func parseQueryTypes(types []string) (map[uint16]bool, error) {
+	result := make(map[uint16]bool, len(types))
+
+	for _, t := range types {
+		qType, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(t))]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type '%s'", t)
+		}
+
+		result[qType] = true
+	}
+
+	return result, nil
+}
+
+func queryTypesToString(types map[uint16]bool) string {
+	result := make([]string, 0, len(types))
+	for t := range types {
+		result = append(result, dns.TypeToString[t])
+	}
+
+	sort.Strings(result)
+
+	return strings.Join(result, ", ")
+}
+
+func (r *QueryTypeFilterResolver) Configuration() (result []string) {
+	if len(r.queryTypes) == 0 && len(r.clientGroups) == 0 && !r.refuseAny {
+		return []string{"deactivated"}
+	}
+
+	result = append(result, fmt.Sprintf("queryTypes = %s", queryTypesToString(r.queryTypes)))
+
+	if len(r.clientGroups) > 0 {
+		result = append(result, "clientGroups")
+
+		for client, types := range r.clientGroups {
+			result = append(result, fmt.Sprintf("  %s = %s", client, queryTypesToString(types)))
+		}
+	}
+
+	result = append(result, fmt.Sprintf("refuseAny = %t", r.refuseAny))
+
+	return
+}
+
+func (r *QueryTypeFilterResolver) Resolve(request *Request) (*Response, error) {
+	if len(request.Req.Question) == 0 {
+		return r.next.Resolve(request)
+	}
+
+	qType := request.Req.Question[0].Qtype
+	logger := withPrefix(request.Log, "query_type_filter_resolver")
+
+	if r.refuseAny && qType == dns.TypeANY {
+		logger.Debug("refusing ANY query")
+
+		response := new(dns.Msg)
+		response.SetRcode(request.Req, dns.RcodeNotImplemented)
+
+		return &Response{Res: response, rType: FILTERED, Reason: "FILTERED (ANY)"}, nil
+	}
+
+	if r.isFiltered(qType, request) {
+		logger.Debugf("query type %s is filtered", dns.TypeToString[qType])
+
+		// NODATA: success without answer
+		response := new(dns.Msg)
+		response.SetReply(request.Req)
+
+		return &Response{Res: response, rType: FILTERED,
+			Reason: fmt.Sprintf("FILTERED (%s)", dns.TypeToString[qType])}, nil
+	}
+
+	return r.next.Resolve(request)
+}
+
+// returns true if the query type is filtered globally or for the request's client
+func (r *QueryTypeFilterResolver) isFiltered(qType uint16, request *Request) bool {
+	if r.queryTypes[qType] {
+		return true
+	}
+
+	for client, types := range r.clientGroups {
+		if types[qType] && clientMatches(client, r.clientCIDRs, request) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *QueryTypeFilterResolver) String() string {
+	return fmt.Sprintf("query type filter resolver")
+}
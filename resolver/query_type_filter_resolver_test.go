@@ -0,0 +1,78 @@
+package resolver
+
+import (
+	"blocky/config"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_Resolve_QueryTypeFilter(t *testing.T) {
+	sut, err := NewQueryTypeFilterResolver(config.QueryTypeFilterConfig{
+		QueryTypes: []string{"aaaa"},
+		ClientGroups: map[string][]string{
+			"laptop*":        {"MX"},
+			"192.168.0.0/24": {"TXT"},
+		},
+		RefuseAny: true,
+	})
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	// filtered for all clients
+	resp, err := sut.Resolve(newRequest("example.com.", dns.TypeAAAA, "10.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Empty(t, resp.Res.Answer)
+	assert.Equal(t, FILTERED, resp.rType)
+	assert.Equal(t, "FILTERED (AAAA)", resp.Reason)
+
+	// ANY is refused
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeANY, "10.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeNotImplemented, resp.Res.Rcode)
+	assert.Equal(t, "FILTERED (ANY)", resp.Reason)
+
+	// filtered per client name and CIDR
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeMX, "10.0.0.1", "laptop-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "FILTERED (MX)", resp.Reason)
+
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeTXT, "192.168.0.5"))
+	assert.NoError(t, err)
+	assert.Equal(t, "FILTERED (TXT)", resp.Reason)
+
+	m.AssertNotCalled(t, "Resolve", mock.Anything)
+
+	// other client or type is resolved
+	for _, req := range []*Request{
+		newRequest("example.com.", dns.TypeA, "10.0.0.1"),
+		newRequest("example.com.", dns.TypeMX, "10.0.0.1", "pc"),
+		newRequest("example.com.", dns.TypeTXT, "192.168.1.5", "laptop-1"),
+	} {
+		resp, err = sut.Resolve(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "RESOLVED", resp.Reason)
+	}
+
+	m.AssertNumberOfCalls(t, "Resolve", 3)
+}
+
+func Test_Resolve_QueryTypeFilter_Deactivated(t *testing.T) {
+	sut, err := NewQueryTypeFilterResolver(config.QueryTypeFilterConfig{})
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	resp, err := sut.Resolve(newRequest("example.com.", dns.TypeANY, "10.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "RESOLVED", resp.Reason)
+	assert.Equal(t, []string{"deactivated"}, sut.Configuration())
+}
@@ -0,0 +1,123 @@
+package resolver
+
+import (
+	"blocky/api"
+	"blocky/util"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// number of different upstream resolvers, which are tried for one request
+const randomResolverAttempts = 2
+
+// RandomResolver delegates the DNS message to one random upstream resolver. Resolvers are weighted
+// by recent response time and error rate. If the resolver fails or answers with SERVFAIL/REFUSED, another one is tried
+type RandomResolver struct {
+	resolvers []Resolver
+	stats     []*upstreamStats
+}
+
+func NewRandomResolver(resolvers []Resolver) Resolver {
+	stats := make([]*upstreamStats, len(resolvers))
+	for i := range resolvers {
+		stats[i] = &upstreamStats{}
+	}
+
+	return &RandomResolver{resolvers: resolvers, stats: stats}
+}
+
+func (r *RandomResolver) Configuration() (result []string) {
+	shares := selectionShares(r.stats)
+
+	result = append(result, "strategy = random", "upstream resolvers:")
+	for i, res := range r.resolvers {
+		result = append(result, fmt.Sprintf("- %s (%s, weight = %.0f%%)", res, r.stats[i], 100*shares[i]))
+	}
+
+	return
+}
+
+// UpstreamStatus returns statistics of all upstreams
+func (r *RandomResolver) UpstreamStatus() []api.UpstreamStatus {
+	shares := selectionShares(r.stats)
+
+	result := make([]api.UpstreamStatus, len(r.resolvers))
+	for i, res := range r.resolvers {
+		result[i] = r.stats[i].status(fmt.Sprint(res))
+		result[i].Weight = shares[i]
+	}
+
+	return result
+}
+
+func (r *RandomResolver) Resolve(request *Request) (*Response, error) {
+	logger := withPrefix(request.Log, "random_resolver")
+
+	candidates := make([]int, len(r.resolvers))
+	for i := range candidates {
+		candidates[i] = i
+	}
+
+	var errs []string
+
+	// SERVFAIL/REFUSED response, returned if the other resolver can't answer either
+	var failed *Response
+
+	for attempt := 0; attempt < randomResolverAttempts && len(candidates) > 0; attempt++ {
+		pos := r.pickWeighted(candidates)
+		i := candidates[pos]
+		candidates = append(candidates[:pos], candidates[pos+1:]...)
+
+		logger.WithField("resolver", r.resolvers[i]).Debug("delegating to resolver")
+
+		resp, err := resolveWithStats(r.resolvers[i], r.stats[i], request)
+		if err == nil && isServerFailure(resp) && attempt+1 < randomResolverAttempts && len(candidates) > 0 {
+			logger.WithField("resolver", r.resolvers[i]).
+				Debugf("resolver returned %s, trying another one", dns.RcodeToString[resp.Res.Rcode])
+
+			failed = resp
+
+			continue
+		}
+
+		if err == nil {
+			logger.WithFields(logrus.Fields{
+				"resolver": r.resolvers[i],
+				"answer":   util.AnswerToString(resp.Res.Answer),
+			}).Debug("using response from resolver")
+
+			return resp, nil
+		}
+
+		logger.WithField("resolver", r.resolvers[i]).Debug("resolution failed from resolver, cause: ", err)
+		errs = append(errs, fmt.Sprintf("'%v'", err))
+	}
+
+	if failed != nil {
+		return failed, nil
+	}
+
+	return nil, fmt.Errorf("resolution was not successful, errors: %s", strings.Join(errs, ", "))
+}
+
+// returns position of random candidate, candidates are weighted with upstream statistics
+func (r *RandomResolver) pickWeighted(candidates []int) int {
+	stats := make([]*upstreamStats, len(candidates))
+	for pos, i := range candidates {
+		stats[pos] = r.stats[i]
+	}
+
+	return pickByShares(selectionShares(stats))
+}
+
+func (r *RandomResolver) String() string {
+	names := make([]string, len(r.resolvers))
+	for i, res := range r.resolvers {
+		names[i] = fmt.Sprintf("%s", res)
+	}
+
+	return fmt.Sprintf("random resolver '[%s]'", strings.Join(names, " "))
+}
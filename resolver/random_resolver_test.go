@@ -0,0 +1,105 @@
+package resolver
+
+import (
+	"blocky/util"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_Resolve_Random(t *testing.T) {
+	failing := &resolverMock{}
+	failing.On("Resolve", mock.Anything).Return((*Response)(nil), errors.New("timeout"))
+
+	working := &resolverMock{}
+	working.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+
+	sut := NewRandomResolver([]Resolver{failing, working}).(*RandomResolver)
+
+	// failing resolver is always followed by the working one
+	for i := 0; i < 10; i++ {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+		assert.NotNil(t, resp)
+	}
+
+	working.AssertNumberOfCalls(t, "Resolve", 10)
+	assert.Len(t, sut.Configuration(), 4)
+
+	// all fail
+	sut = NewRandomResolver([]Resolver{failing, failing}).(*RandomResolver)
+
+	_, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.Error(t, err)
+}
+
+func Test_pickWeighted(t *testing.T) {
+	sut := NewRandomResolver([]Resolver{&resolverMock{}, &resolverMock{}}).(*RandomResolver)
+
+	sut.stats[0].record(100*time.Millisecond, nil)
+	sut.stats[1].record(10*time.Millisecond, errors.New("error"))
+
+	// fast, but failing resolver has lower weight
+	assert.True(t, sut.stats[0].weight() > sut.stats[1].weight())
+
+	picked := make([]int, 2)
+	for i := 0; i < 1000; i++ {
+		picked[sut.pickWeighted([]int{0, 1})]++
+	}
+
+	assert.True(t, picked[0] > picked[1])
+	assert.True(t, picked[1] > 0)
+	assert.Equal(t, 0, sut.pickWeighted([]int{1}))
+}
+
+func Test_upstreamStats(t *testing.T) {
+	stats := &upstreamStats{}
+
+	stats.record(10*time.Millisecond, nil)
+	stats.record(20*time.Millisecond, errors.New("error"))
+
+	assert.Equal(t, "requests = 2, errors = 1, avg latency = 12 ms", stats.String())
+	assert.InDelta(t, 0.2, stats.errorRate, 0.001)
+}
+
+func Test_Resolve_Random_ServerFailure(t *testing.T) {
+	servFail := &resolverMock{}
+	servFailMsg := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}
+	servFail.On("Resolve", mock.Anything).Return(&Response{Res: servFailMsg}, nil)
+
+	working := &resolverMock{}
+	working.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+
+	sut := NewRandomResolver([]Resolver{servFail, working})
+
+	// SERVFAIL is followed by the working resolver
+	for i := 0; i < 10; i++ {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	}
+
+	// all resolvers fail -> SERVFAIL response is returned
+	sut = NewRandomResolver([]Resolver{servFail, servFail})
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Res.Rcode)
+}
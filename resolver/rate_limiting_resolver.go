@@ -0,0 +1,188 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/metrics"
+	"blocky/util"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// buckets of clients without queries are removed after this time
+	rateLimitBucketExpiration = 5 * time.Minute
+	// refused queries are logged at most once in this interval
+	rateLimitWarningInterval = 10 * time.Second
+
+	rateLimitClient = "client"
+	rateLimitGlobal = "global"
+)
+
+// RateLimitingResolver refuses queries, if the client or all clients together exceed the configured
+// number of queries per second (token bucket)
+type RateLimitingResolver struct {
+	NextResolver
+	perClient      float64
+	perClientBurst float64
+	global         *tokenBucket
+	globalRate     float64
+	globalBurst    float64
+	whitelist      []*net.IPNet
+	// token bucket per client IP
+	clients *cache.Cache
+	lock    sync.Mutex
+	refused map[string]uint64
+	// refused queries since the last warning
+	notLogged   uint64
+	lastWarning time.Time
+}
+
+// token bucket: tokens are refilled with the rate up to the burst size, each query consumes one token
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time, rate, burst float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+func NewRateLimitingResolver(cfg config.RateLimitConfig) (ChainedResolver, error) {
+	whitelist, err := util.ParseIPNets(cfg.Whitelist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit whitelist: %v", err)
+	}
+
+	r := &RateLimitingResolver{
+		perClient:      float64(cfg.PerClient),
+		perClientBurst: burstOrRate(cfg.PerClientBurst, cfg.PerClient),
+		globalRate:     float64(cfg.Global),
+		globalBurst:    burstOrRate(cfg.GlobalBurst, cfg.Global),
+		whitelist:      whitelist,
+		clients:        cache.New(rateLimitBucketExpiration, time.Minute),
+		refused:        make(map[string]uint64),
+	}
+
+	if r.globalRate > 0 {
+		r.global = &tokenBucket{tokens: r.globalBurst, last: time.Now()}
+	}
+
+	return r, nil
+}
+
+func burstOrRate(burst, rate uint) float64 {
+	if burst == 0 {
+		return float64(rate)
+	}
+
+	return float64(burst)
+}
+
+func (r *RateLimitingResolver) Configuration() (result []string) {
+	if r.perClient == 0 && r.globalRate == 0 {
+		return []string{"deactivated"}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result = append(result, fmt.Sprintf("perClient = %.0f/s (burst %.0f)", r.perClient, r.perClientBurst))
+	result = append(result, fmt.Sprintf("global = %.0f/s (burst %.0f)", r.globalRate, r.globalBurst))
+	result = append(result, fmt.Sprintf("whitelisted networks = %d", len(r.whitelist)))
+	result = append(result, fmt.Sprintf("refused queries = %d (client), %d (global)",
+		r.refused[rateLimitClient], r.refused[rateLimitGlobal]))
+
+	return
+}
+
+func (r *RateLimitingResolver) Resolve(request *Request) (*Response, error) {
+	if limit := r.exceededLimit(request.ClientIP); limit != "" {
+		r.warn(request, limit)
+		metrics.RecordRateLimited(limit)
+
+		response := new(dns.Msg)
+		response.SetRcode(request.Req, dns.RcodeRefused)
+
+		return &Response{Res: response, Reason: fmt.Sprintf("RATE LIMITED (%s)", limit)}, nil
+	}
+
+	return r.next.Resolve(request)
+}
+
+// returns the exceeded limit (client or global), empty if the query is allowed
+func (r *RateLimitingResolver) exceededLimit(ip net.IP) string {
+	if (r.perClient == 0 && r.global == nil) || (ip != nil && util.ContainsIP(r.whitelist, ip)) {
+		return ""
+	}
+
+	now := time.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.perClient > 0 && ip != nil {
+		key := ip.String()
+
+		var bucket *tokenBucket
+
+		if b, found := r.clients.Get(key); found {
+			bucket = b.(*tokenBucket)
+		} else {
+			bucket = &tokenBucket{tokens: r.perClientBurst, last: now}
+		}
+
+		// refreshes the expiration
+		r.clients.SetDefault(key, bucket)
+
+		if !bucket.allow(now, r.perClient, r.perClientBurst) {
+			return rateLimitClient
+		}
+	}
+
+	if r.global != nil && !r.global.allow(now, r.globalRate, r.globalBurst) {
+		return rateLimitGlobal
+	}
+
+	return ""
+}
+
+// logs refused query, at most one warning per interval
+func (r *RateLimitingResolver) warn(request *Request, limit string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.refused[limit]++
+	r.notLogged++
+
+	if time.Since(r.lastWarning) < rateLimitWarningInterval {
+		return
+	}
+
+	requestLogger(request, "rate_limiting_resolver").
+		Warnf("%s query limit exceeded, %d queries refused since last warning", limit, r.notLogged)
+
+	r.notLogged = 0
+	r.lastWarning = time.Now()
+}
+
+func (r *RateLimitingResolver) String() string {
+	return fmt.Sprintf("rate limiting resolver")
+}
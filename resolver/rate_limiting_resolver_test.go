@@ -0,0 +1,91 @@
+package resolver
+
+import (
+	"blocky/config"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_Resolve_RateLimit_PerClient(t *testing.T) {
+	sut, err := NewRateLimitingResolver(config.RateLimitConfig{
+		PerClient: 1,
+		Whitelist: []string{"192.168.178.0/24"},
+	})
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	resp, err := sut.Resolve(newRequest("example.com.", dns.TypeA, "10.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+
+	// second query within one second is refused
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeA, "10.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Res.Rcode)
+	assert.Equal(t, "RATE LIMITED (client)", resp.Reason)
+
+	// other client has own limit
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeA, "10.0.0.2"))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+
+	// whitelisted client is not limited
+	for i := 0; i < 5; i++ {
+		resp, err = sut.Resolve(newRequest("example.com.", dns.TypeA, "192.168.178.5"))
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	}
+
+	m.AssertNumberOfCalls(t, "Resolve", 7)
+	assert.Contains(t, sut.Configuration(), "refused queries = 1 (client), 0 (global)")
+}
+
+func Test_Resolve_RateLimit_Global(t *testing.T) {
+	sut, err := NewRateLimitingResolver(config.RateLimitConfig{
+		Global:      10,
+		GlobalBurst: 2,
+	})
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		_, err := sut.Resolve(newRequest("example.com.", dns.TypeA, ip))
+		assert.NoError(t, err)
+	}
+
+	m.AssertNumberOfCalls(t, "Resolve", 2)
+
+	// bucket is refilled
+	time.Sleep(200 * time.Millisecond)
+
+	resp, err := sut.Resolve(newRequest("example.com.", dns.TypeA, "10.0.0.4"))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+}
+
+func Test_Resolve_RateLimit_Deactivated(t *testing.T) {
+	sut, err := NewRateLimitingResolver(config.RateLimitConfig{})
+	assert.NoError(t, err)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	for i := 0; i < 100; i++ {
+		_, err := sut.Resolve(newRequest("example.com.", dns.TypeA, "10.0.0.1"))
+		assert.NoError(t, err)
+	}
+
+	m.AssertNumberOfCalls(t, "Resolve", 100)
+	assert.Equal(t, []string{"deactivated"}, sut.Configuration())
+}
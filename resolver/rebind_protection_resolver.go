@@ -0,0 +1,153 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	rebindModeRemove   = "remove"
+	rebindModeNxDomain = "nxdomain"
+)
+
+// private, loopback and link-local networks, which shouldn't be returned by public upstreams
+// nolint:gochecknoglobals
+var privateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// RebindProtectionResolver removes A/AAAA records with private IP addresses from upstream answers or replaces
+// the answer with NXDOMAIN (DNS rebinding protection). Domains in the allowed list are not checked
+type RebindProtectionResolver struct {
+	NextResolver
+	mode           string
+	allowedDomains map[string]bool
+	networks       []*net.IPNet
+}
+
+func NewRebindProtectionResolver(cfg config.RebindProtectionConfig) (ChainedResolver, error) {
+	if cfg.Mode != "" && cfg.Mode != rebindModeRemove && cfg.Mode != rebindModeNxDomain {
+		return nil, fmt.Errorf("unknown rebind protection mode '%s', please use one of: remove or nxdomain", cfg.Mode)
+	}
+
+	networks, err := util.ParseIPNets(privateNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private network: %v", err)
+	}
+
+	allowed := make(map[string]bool, len(cfg.AllowedDomains))
+	for _, d := range cfg.AllowedDomains {
+		allowed[strings.TrimSuffix(strings.ToLower(d), ".")] = true
+	}
+
+	return &RebindProtectionResolver{
+		mode:           cfg.Mode,
+		allowedDomains: allowed,
+		networks:       networks,
+	}, nil
+}
+
+func (r *RebindProtectionResolver) Configuration() (result []string) {
+	if r.mode == "" {
+		return []string{"deactivated"}
+	}
+
+	result = append(result, fmt.Sprintf("mode = %s", r.mode))
+
+	for d := range r.allowedDomains {
+		result = append(result, fmt.Sprintf("allowed domain = %s", d))
+	}
+
+	return
+}
+
+func (r *RebindProtectionResolver) Resolve(request *Request) (*Response, error) {
+	response, err := r.next.Resolve(request)
+	if err != nil || r.mode == "" || len(request.Req.Question) == 0 {
+		return response, err
+	}
+
+	domain := util.ExtractDomain(request.Req.Question[0])
+	if r.isAllowed(domain) {
+		return response, nil
+	}
+
+	filtered := make([]dns.RR, 0, len(response.Res.Answer))
+
+	for _, rr := range response.Res.Answer {
+		if ip := answerIP(rr); ip != nil && util.ContainsIP(r.networks, ip) {
+			continue
+		}
+
+		filtered = append(filtered, rr)
+	}
+
+	if len(filtered) == len(response.Res.Answer) {
+		return response, nil
+	}
+
+	requestLogger(request, "rebind_protection_resolver").WithField("domain", domain).
+		Warnf("upstream answer contains private IP address: %s", util.AnswerToString(response.Res.Answer))
+
+	res := response.Res
+
+	if r.mode == rebindModeNxDomain {
+		res = new(dns.Msg)
+		res.SetRcode(request.Req, dns.RcodeNameError)
+	} else {
+		res.Answer = filtered
+		// signatures don't match the changed answer
+		res.AuthenticatedData = false
+	}
+
+	return &Response{Res: res, Reason: "REBIND PROTECTION", Upstream: response.Upstream}, nil
+}
+
+// returns true if the domain or its parent domain is in the allowed list
+func (r *RebindProtectionResolver) isAllowed(domain string) bool {
+	for len(domain) > 0 {
+		if r.allowedDomains[domain] {
+			return true
+		}
+
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+
+		domain = domain[i+1:]
+	}
+
+	return false
+}
+
+func (r *RebindProtectionResolver) String() string {
+	return fmt.Sprintf("rebind protection resolver")
+}
+
+// returns the IP of A/AAAA records, nil for other record types
+func answerIP(rr dns.RR) net.IP {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A
+	case *dns.AAAA:
+		return v.AAAA
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// answers all queries with the configured records
+type rebindTestUpstream struct {
+	answer []string
+}
+
+func (u *rebindTestUpstream) Resolve(request *Request) (*Response, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(request.Req)
+
+	for _, a := range u.answer {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	return &Response{Res: resp, Reason: "RESOLVED", Upstream: "udp:8.8.8.8"}, nil
+}
+
+func (u *rebindTestUpstream) Configuration() []string {
+	return nil
+}
+
+func Test_Resolve_RebindProtection_Remove(t *testing.T) {
+	sut, err := NewRebindProtectionResolver(config.RebindProtectionConfig{Mode: "remove"})
+	assert.NoError(t, err)
+	sut.Next(&rebindTestUpstream{answer: []string{
+		"example.com. 300 IN A 192.168.178.1",
+		"example.com. 300 IN A 123.122.121.120",
+		"example.com. 300 IN AAAA fe80::1",
+	}})
+
+	resp, err := sut.Resolve(newRequest("example.com.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Equal(t, "REBIND PROTECTION", resp.Reason)
+	assert.Equal(t, "udp:8.8.8.8", resp.Upstream)
+	assert.Equal(t, "A (123.122.121.120)", util.AnswerToString(resp.Res.Answer))
+}
+
+func Test_Resolve_RebindProtection_NxDomain(t *testing.T) {
+	sut, err := NewRebindProtectionResolver(config.RebindProtectionConfig{Mode: "nxdomain"})
+	assert.NoError(t, err)
+	sut.Next(&rebindTestUpstream{answer: []string{
+		"example.com. 300 IN A 123.122.121.120",
+		"example.com. 300 IN A 127.0.0.1",
+	}})
+
+	resp, err := sut.Resolve(newRequest("example.com.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, resp.Res.Rcode)
+	assert.Empty(t, resp.Res.Answer)
+	assert.Equal(t, "REBIND PROTECTION", resp.Reason)
+}
+
+func Test_Resolve_RebindProtection_PublicAnswer(t *testing.T) {
+	sut, err := NewRebindProtectionResolver(config.RebindProtectionConfig{Mode: "nxdomain"})
+	assert.NoError(t, err)
+	sut.Next(&rebindTestUpstream{answer: []string{
+		"example.com. 300 IN A 123.122.121.120",
+		"example.com. 300 IN AAAA 2001:db8::1",
+	}})
+
+	resp, err := sut.Resolve(newRequest("example.com.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Equal(t, "RESOLVED", resp.Reason)
+	assert.Len(t, resp.Res.Answer, 2)
+}
+
+func Test_Resolve_RebindProtection_AllowedDomain(t *testing.T) {
+	sut, err := NewRebindProtectionResolver(config.RebindProtectionConfig{
+		Mode:           "remove",
+		AllowedDomains: []string{"MyHome.org."},
+	})
+	assert.NoError(t, err)
+	sut.Next(&rebindTestUpstream{answer: []string{"example.com. 300 IN A 192.168.178.1"}})
+
+	// sub domain of allowed domain
+	resp, err := sut.Resolve(newRequest("nas.myhome.org.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Len(t, resp.Res.Answer, 1)
+
+	resp, err = sut.Resolve(newRequest("notmyhome.org.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Empty(t, resp.Res.Answer)
+}
+
+func Test_Resolve_RebindProtection_Deactivated(t *testing.T) {
+	sut, err := NewRebindProtectionResolver(config.RebindProtectionConfig{})
+	assert.NoError(t, err)
+	sut.Next(&rebindTestUpstream{answer: []string{"example.com. 300 IN A 192.168.178.1"}})
+
+	resp, err := sut.Resolve(newRequest("example.com.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Len(t, resp.Res.Answer, 1)
+	assert.Equal(t, []string{"deactivated"}, sut.Configuration())
+}
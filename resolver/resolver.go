@@ -1,7 +1,12 @@
 package resolver
 
 import (
+	"blocky/api"
+	"blocky/util"
+	"context"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -10,8 +15,24 @@ import (
 type Request struct {
 	ClientIP    net.IP
 	ClientNames []string
-	Req         *dns.Msg
-	Log         *logrus.Entry
+	// if true, the client names were set by the caller (e.g. to simulate a client with a query over the API)
+	// and are not resolved
+	FixedClientNames bool
+	Req              *dns.Msg
+	Log              *logrus.Entry
+	// upstream group of the client, empty for the default group
+	UpstreamGroup string
+	// deadline for the processing of the request, background context is used if not set
+	Ctx context.Context
+}
+
+// Context returns the context of the request
+func (r *Request) Context() context.Context {
+	if r.Ctx == nil {
+		return context.Background()
+	}
+
+	return r.Ctx
 }
 
 type ResponseType int
@@ -22,16 +43,40 @@ const (
 	BLOCKED
 	CONDITIONAL
 	CUSTOMDNS
+	FILTERED
 )
 
 func (d ResponseType) String() string {
-	return [...]string{"RESOLVED", "CACHED", "BLOCKED", "CONDITIONAL", "CUSTOM DNS"}[d]
+	return [...]string{"RESOLVED", "CACHED", "BLOCKED", "CONDITIONAL", "CUSTOM DNS", "FILTERED"}[d]
 }
 
 type Response struct {
 	Res    *dns.Msg
 	Reason string
 	rType  ResponseType
+	// upstream (with protocol), which answered the query. Empty if the answer was not received from an upstream
+	Upstream string
+	// set if the query was blocked
+	Blocking *BlockingInfo
+}
+
+// Type returns the type of the response, which describes the resolver of the answer
+func (r *Response) Type() ResponseType {
+	return r.rType
+}
+
+// BlockingInfo describes why a query was blocked
+type BlockingInfo struct {
+	// matching group, "WHITELIST ONLY" if the domain is not in the whitelist of a whitelist only group
+	Group string
+	// matching list (link) in the group, empty if unknown
+	List string
+	// matching entry of the list, e.g. a parent domain, wildcard or regular expression, empty if unknown
+	Entry string
+	// blocked CNAME target, empty if the queried domain itself was blocked
+	CNAME string
+	// blocked IP address of the answer, empty if the queried domain itself was blocked
+	IP string
 }
 type Resolver interface {
 	Resolve(req *Request) (*Response, error)
@@ -44,6 +89,21 @@ type ChainedResolver interface {
 	GetNext() Resolver
 }
 
+// Flusher is implemented by resolvers, which process data asynchronously and should write it out on shutdown
+type Flusher interface {
+	Flush(timeout time.Duration)
+}
+
+// UpstreamStatusReporter is implemented by resolvers, which track statistics of their upstreams
+type UpstreamStatusReporter interface {
+	UpstreamStatus() []api.UpstreamStatus
+}
+
+// Stopper is implemented by resolvers with background tasks, which should be stopped if the resolver is not used anymore
+type Stopper interface {
+	Stop()
+}
+
 type NextResolver struct {
 	next Resolver
 }
@@ -60,8 +120,56 @@ func logger(prefix string) *logrus.Entry {
 	return logrus.WithField("prefix", prefix)
 }
 
+// returns the request logger with prefix field. To avoid allocations on the hot path, the field is only added if debug
+// messages are logged. Info messages, warnings and errors of requests must use requestLogger
 func withPrefix(logger *logrus.Entry, prefix string) *logrus.Entry {
-	return logger.WithField("prefix", prefix)
+	return withDebugField(logger, "prefix", prefix)
+}
+
+// returns the request logger with prefix and request fields for messages above debug level. The request logger
+// contains the request fields only if debug messages are logged, otherwise they are added here
+func requestLogger(request *Request, prefix string) *logrus.Entry {
+	if request.Log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return request.Log.WithField("prefix", prefix)
+	}
+
+	fields := logrus.Fields{"prefix": prefix}
+
+	if request.Req != nil {
+		fields["question"] = util.QuestionToString(request.Req.Question)
+	}
+
+	if request.ClientIP != nil {
+		fields["client_ip"] = request.ClientIP
+	}
+
+	if len(request.ClientNames) > 0 {
+		fields["client_names"] = strings.Join(request.ClientNames, "; ")
+	}
+
+	return request.Log.WithFields(fields)
+}
+
+// adds the field to the request logger, if debug messages are logged
+func withDebugField(logger *logrus.Entry, key string, value interface{}) *logrus.Entry {
+	if !logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return logger
+	}
+
+	return logger.WithField(key, value)
+}
+
+// ForEach calls passed function for each resolver in the chain, starting with passed resolver
+func ForEach(r Resolver, fn func(Resolver)) {
+	for r != nil {
+		fn(r)
+
+		if c, ok := r.(ChainedResolver); ok {
+			r = c.GetNext()
+		} else {
+			break
+		}
+	}
 }
 
 func Chain(resolvers ...Resolver) Resolver {
@@ -0,0 +1,56 @@
+package resolver
+
+import (
+	"blocky/util"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// returns request for the question, client IP and names are optional
+func newRequest(question string, qType uint16, clientIP string, clientNames ...string) *Request {
+	return &Request{
+		ClientIP:    net.ParseIP(clientIP),
+		ClientNames: clientNames,
+		Req:         util.NewMsgWithQuestion(question, qType),
+		Log:         logrus.NewEntry(logrus.New()),
+	}
+}
+
+func Test_requestLogger_AddsRequestFields(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.InfoLevel)
+
+	request := &Request{
+		ClientIP:    net.ParseIP("192.168.178.25"),
+		ClientNames: []string{"client1", "client2"},
+		Req:         util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log:         logrus.NewEntry(logger),
+	}
+
+	// debug fields aren't added on info level
+	assert.Empty(t, withPrefix(request.Log, "test").Data)
+
+	entry := requestLogger(request, "test")
+	assert.Equal(t, "test", entry.Data["prefix"])
+	assert.Equal(t, "A (example.com.)", entry.Data["question"])
+	assert.Equal(t, request.ClientIP, entry.Data["client_ip"])
+	assert.Equal(t, "client1; client2", entry.Data["client_names"])
+}
+
+func Test_requestLogger_DebugLevel(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	// on debug level, the request logger already contains the request fields
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logger).WithField("question", "A (example.com.)"),
+	}
+
+	entry := requestLogger(request, "test")
+	assert.Equal(t, logrus.Fields{"prefix": "test", "question": "A (example.com.)"}, entry.Data)
+}
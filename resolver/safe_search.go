@@ -0,0 +1,111 @@
+package resolver
+
+import (
+	"blocky/util"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// built-in mapping of search engine domains (wildcards are supported) to their safe search host
+// nolint:gochecknoglobals
+var defaultSafeSearchMappings = map[string]string{
+	"www.google.*":             "forcesafesearch.google.com",
+	"www.bing.com":             "strict.bing.com",
+	"bing.com":                 "strict.bing.com",
+	"duckduckgo.com":           "safe.duckduckgo.com",
+	"www.duckduckgo.com":       "safe.duckduckgo.com",
+	"www.youtube.com":          "restrict.youtube.com",
+	"m.youtube.com":            "restrict.youtube.com",
+	"youtubei.googleapis.com":  "restrict.youtube.com",
+	"youtube.googleapis.com":   "restrict.youtube.com",
+	"www.youtube-nocookie.com": "restrict.youtube.com",
+}
+
+// safeSearch maps domains to safe search hosts
+type safeSearch struct {
+	mappings map[string]string
+	// mapping keys with wildcards, sorted
+	patterns []string
+}
+
+// creates mapping with built-in entries, which are overridden by configured entries.
+// Configured entry with empty host removes the built-in entry
+func newSafeSearch(cfgMappings map[string]string) *safeSearch {
+	mappings := make(map[string]string, len(defaultSafeSearchMappings)+len(cfgMappings))
+
+	for domain, host := range defaultSafeSearchMappings {
+		mappings[domain] = host
+	}
+
+	for domain, host := range cfgMappings {
+		domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+		if host == "" {
+			delete(mappings, domain)
+			continue
+		}
+
+		mappings[domain] = strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+
+	var patterns []string
+
+	for domain := range mappings {
+		if strings.ContainsAny(domain, "*?[") {
+			patterns = append(patterns, domain)
+		}
+	}
+
+	sort.Strings(patterns)
+
+	return &safeSearch{mappings: mappings, patterns: patterns}
+}
+
+// returns the safe search host for the domain, empty if domain has no mapping
+func (s *safeSearch) safeHost(domain string) string {
+	if host, ok := s.mappings[domain]; ok {
+		return host
+	}
+
+	for _, p := range s.patterns {
+		if matched, _ := path.Match(p, domain); matched {
+			return s.mappings[p]
+		}
+	}
+
+	return ""
+}
+
+// resolves the safe search host with the next resolver and answers the query with a CNAME to this host
+// and its A/AAAA records
+func (r *BlockingResolver) resolveSafeSearch(logger *logrus.Entry, request *Request, question dns.Question,
+	host string) (*Response, error) {
+	logger.WithField("safe_host", host).Debug("enforcing safe search")
+
+	target := dns.Fqdn(host)
+
+	safeResponse, err := r.next.Resolve(withReq(request, util.NewMsgWithQuestion(target, question.Qtype)))
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := r.blockTTL
+	if len(safeResponse.Res.Answer) > 0 {
+		ttl = safeResponse.Res.Answer[0].Header().Ttl
+	}
+
+	response := new(dns.Msg)
+	response.SetReply(request.Req)
+	response.Rcode = safeResponse.Res.Rcode
+	response.Answer = append([]dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: target,
+	}}, safeResponse.Res.Answer...)
+
+	return &Response{Res: response, rType: safeResponse.rType, Upstream: safeResponse.Upstream,
+		Reason: fmt.Sprintf("SAFE SEARCH (%s)", host)}, nil
+}
@@ -0,0 +1,91 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// special-use zones, which are never resolvable by public upstreams (RFC 6761, 6762, 7686, 8375)
+// nolint:gochecknoglobals
+var defaultSpecialUseZones = []string{"home.arpa", "invalid", "lan", "local", "onion"}
+
+// SpecialUseNamesResolver answers queries for special-use zones and single-label names with NXDOMAIN,
+// so they don't leak to public upstreams. Should be placed after conditional and custom DNS resolver,
+// which answer the names of local zones (e.g. "fritz.box")
+type SpecialUseNamesResolver struct {
+	NextResolver
+	zones            []string
+	blockSingleLabel bool
+}
+
+func NewSpecialUseNamesResolver(cfg config.SpecialUseNamesConfig) ChainedResolver {
+	var zones []string
+
+	if cfg.Enabled {
+		zones = defaultSpecialUseZones
+
+		if len(cfg.Zones) > 0 {
+			zones = make([]string, len(cfg.Zones))
+			for i, zone := range cfg.Zones {
+				zones[i] = strings.ToLower(strings.Trim(strings.TrimSpace(zone), "."))
+			}
+		}
+	}
+
+	return &SpecialUseNamesResolver{zones: zones, blockSingleLabel: cfg.BlockSingleLabelNames}
+}
+
+func (r *SpecialUseNamesResolver) Configuration() (result []string) {
+	if len(r.zones) == 0 && !r.blockSingleLabel {
+		return []string{"deactivated"}
+	}
+
+	result = append(result, fmt.Sprintf("zones = %s", strings.Join(r.zones, ", ")))
+	result = append(result, fmt.Sprintf("blockSingleLabelNames = %t", r.blockSingleLabel))
+
+	return
+}
+
+func (r *SpecialUseNamesResolver) Resolve(request *Request) (*Response, error) {
+	if len(request.Req.Question) == 0 {
+		return r.next.Resolve(request)
+	}
+
+	domain := util.ExtractDomain(request.Req.Question[0])
+
+	if reason := r.filterReason(domain); reason != "" {
+		withPrefix(request.Log, "special_use_names_resolver").WithField("domain", domain).
+			Debug("answering special-use name with NXDOMAIN")
+
+		response := new(dns.Msg)
+		response.SetRcode(request.Req, dns.RcodeNameError)
+
+		return &Response{Res: response, rType: FILTERED, Reason: reason}, nil
+	}
+
+	return r.next.Resolve(request)
+}
+
+// returns the reason if the domain is filtered, empty otherwise
+func (r *SpecialUseNamesResolver) filterReason(domain string) string {
+	// root queries (empty domain) are no single-label names
+	if r.blockSingleLabel && domain != "" && !strings.Contains(domain, ".") {
+		return "FILTERED (SINGLE LABEL)"
+	}
+
+	for _, zone := range r.zones {
+		if domain == zone || strings.HasSuffix(domain, "."+zone) {
+			return "FILTERED (SPECIAL USE)"
+		}
+	}
+
+	return ""
+}
+
+func (r *SpecialUseNamesResolver) String() string {
+	return "special use names resolver"
+}
@@ -0,0 +1,106 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_Resolve_SpecialUseNames(t *testing.T) {
+	sut := NewSpecialUseNamesResolver(config.SpecialUseNamesConfig{Enabled: true, BlockSingleLabelNames: true})
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	for question, reason := range map[string]string{
+		"printer.":                "FILTERED (SINGLE LABEL)",
+		"nas.local.":              "FILTERED (SPECIAL USE)",
+		"Router.Home.Arpa.":       "FILTERED (SPECIAL USE)",
+		"lan.":                    "FILTERED (SINGLE LABEL)",
+		"something.onion.":        "FILTERED (SPECIAL USE)",
+		"example.com.":            "RESOLVED",
+		"fritz.box.":              "RESOLVED",
+		"local.example.com.":      "RESOLVED",
+		"1.0.0.127.in-addr.arpa.": "RESOLVED",
+		".":                       "RESOLVED",
+	} {
+		resp, err := sut.Resolve(newRequest(question, dns.TypeA, ""))
+		assert.NoError(t, err)
+		assert.Equal(t, reason, resp.Reason, question)
+
+		if reason != "RESOLVED" {
+			assert.Equal(t, dns.RcodeNameError, resp.Res.Rcode)
+			assert.Equal(t, FILTERED, resp.rType)
+		}
+	}
+
+	assert.Len(t, m.Calls, 5)
+}
+
+func Test_Resolve_SpecialUseNames_CustomZones(t *testing.T) {
+	sut := NewSpecialUseNamesResolver(config.SpecialUseNamesConfig{Enabled: true, Zones: []string{".Corp."}})
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+	sut.Next(m)
+
+	resp, err := sut.Resolve(newRequest("host.corp.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, resp.Res.Rcode)
+
+	// default zones and single-label names are not filtered
+	for _, question := range []string{"nas.local.", "printer."} {
+		resp, err = sut.Resolve(newRequest(question, dns.TypeA, ""))
+		assert.NoError(t, err)
+		assert.Equal(t, "RESOLVED", resp.Reason)
+	}
+}
+
+func Test_Resolve_SpecialUseNames_ConditionalFirst(t *testing.T) {
+	conditional := NewConditionalUpstreamResolver(config.ConditionalUpstreamConfig{
+		Rewrite: map[string]string{"home": "fritz.box"},
+		Mapping: map[string]config.ConditionalMapping{
+			"fritz.box": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+				response, _ := util.NewMsgWithAnswer(request.Question[0].Name + " 300 IN A 192.168.178.1")
+				return response
+			})}},
+			"lan": {Upstreams: config.Upstreams{TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+				response, _ := util.NewMsgWithAnswer(request.Question[0].Name + " 300 IN A 192.168.0.2")
+				return response
+			})}},
+		},
+	}, nil)
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Reason: "RESOLVED"}, nil)
+
+	sut := Chain(conditional,
+		NewSpecialUseNamesResolver(config.SpecialUseNamesConfig{Enabled: true, BlockSingleLabelNames: true}), m)
+
+	// conditional zones are forwarded, also single-label names rewritten into conditional zone
+	for _, question := range []string{"fritz.box.", "nas.fritz.box.", "nas.lan.", "home."} {
+		resp, err := sut.Resolve(newRequest(question, dns.TypeA, ""))
+		assert.NoError(t, err)
+		assert.Equal(t, CONDITIONAL, resp.rType, question)
+	}
+
+	resp, err := sut.Resolve(newRequest("nas.local.", dns.TypeA, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, resp.Res.Rcode)
+
+	assert.Len(t, m.Calls, 0)
+}
+
+func Test_Configuration_SpecialUseNames(t *testing.T) {
+	sut := NewSpecialUseNamesResolver(config.SpecialUseNamesConfig{})
+	assert.Equal(t, []string{"deactivated"}, sut.Configuration())
+
+	sut = NewSpecialUseNamesResolver(config.SpecialUseNamesConfig{Enabled: true})
+	assert.Equal(t, []string{"zones = home.arpa, invalid, lan, local, onion", "blockSingleLabelNames = false"},
+		sut.Configuration())
+}
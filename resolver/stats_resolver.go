@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"blocky/api"
 	"blocky/stats"
 	"blocky/util"
 	"fmt"
@@ -15,8 +16,14 @@ import (
 
 type StatsResolver struct {
 	NextResolver
-	recorders []*resolverStatRecorder
-	statsChan chan *statsEntry
+	queries        *stats.Counter
+	blockedQueries *stats.Counter
+	recorders      []*resolverStatRecorder
+	statsChan      chan statsEntry
+	signals        chan os.Signal
+	stop           chan struct{}
+	// queries of these clients are not counted
+	excludedClients *clientSet
 }
 
 type statsEntry struct {
@@ -26,25 +33,37 @@ type statsEntry struct {
 
 type resolverStatRecorder struct {
 	aggregator *stats.Aggregator
-	fn         func(*statsEntry) string
+	fn         func(statsEntry) string
+	// returns the field of the API result for this recorder
+	field func(*api.Stats) *[]api.StatsEntry
 }
 
-func newRecorder(name string, fn func(*statsEntry) string) *resolverStatRecorder {
+func newRecorder(name string, field func(*api.Stats) *[]api.StatsEntry,
+	fn func(statsEntry) string) *resolverStatRecorder {
 	return &resolverStatRecorder{
 		aggregator: stats.NewAggregator(name),
 		fn:         fn,
+		field:      field,
 	}
 }
 
-func newRecorderWithMax(name string, max uint, fn func(*statsEntry) string) *resolverStatRecorder {
+func newRecorderWithMax(name string, max uint, field func(*api.Stats) *[]api.StatsEntry,
+	fn func(statsEntry) string) *resolverStatRecorder {
 	return &resolverStatRecorder{
 		aggregator: stats.NewAggregatorWithMax(name, max),
 		fn:         fn,
+		field:      field,
 	}
 }
 
 func (r *StatsResolver) collectStats() {
 	for statsEntry := range r.statsChan {
+		r.queries.Inc()
+
+		if statsEntry.response.rType == BLOCKED {
+			r.blockedQueries.Inc()
+		}
+
 		for _, rec := range r.recorders {
 			rec.recordStats(statsEntry)
 		}
@@ -54,8 +73,8 @@ func (r *StatsResolver) collectStats() {
 func (r *StatsResolver) Resolve(request *Request) (*Response, error) {
 	resp, err := r.next.Resolve(request)
 
-	if err == nil {
-		r.statsChan <- &statsEntry{
+	if err == nil && !r.excludedClients.contains(request) {
+		r.statsChan <- statsEntry{
 			request:  request,
 			response: resp,
 		}
@@ -70,45 +89,95 @@ func (r *StatsResolver) Configuration() (result []string) {
 		result = append(result, fmt.Sprintf(" - %s", rec.aggregator.Name))
 	}
 
+	if n := r.excludedClients.size(); n > 0 {
+		result = append(result, fmt.Sprintf("excludedClients = %d rules", n))
+	}
+
 	return
 }
 
-func (r StatsResolver) String() string {
+func (r *StatsResolver) String() string {
 	return fmt.Sprintf("statistic resolver")
 }
 
-func (r *resolverStatRecorder) recordStats(e *statsEntry) {
+func (r *resolverStatRecorder) recordStats(e statsEntry) {
 	r.aggregator.Put(r.fn(e))
 }
 
-func NewStatsResolver() ChainedResolver {
+// NewStatsResolver creates resolver, which counts queries of all clients except passed excluded clients (names, IPs
+// or CIDRs)
+func NewStatsResolver(excludedClients []string) ChainedResolver {
 	resolver := &StatsResolver{
-		statsChan: make(chan *statsEntry, 20),
-		recorders: createRecorders(),
+		excludedClients: newClientSet(excludedClients),
+		statsChan:       make(chan statsEntry, 20),
+		queries:         stats.NewCounter("Total queries"),
+		blockedQueries:  stats.NewCounter("Blocked queries"),
+		recorders:       createRecorders(),
+		signals:         make(chan os.Signal, 1),
+		stop:            make(chan struct{}),
 	}
 
 	go resolver.collectStats()
 
-	signals := make(chan os.Signal)
-	signal.Notify(signals, syscall.SIGUSR2)
+	signal.Notify(resolver.signals, syscall.SIGUSR2)
 
 	go func() {
 		for {
-			<-signals
-			resolver.printStats()
+			select {
+			case <-resolver.signals:
+				resolver.PrintStats()
+			case <-resolver.stop:
+				return
+			}
 		}
 	}()
 
 	return resolver
 }
 
-func (r *StatsResolver) printStats() {
+// Stop stops printing of statistics on signal
+func (r *StatsResolver) Stop() {
+	signal.Stop(r.signals)
+	close(r.stop)
+}
+
+// ShareStats takes over the statistics of passed resolver, e.g. on configuration reload
+func (r *StatsResolver) ShareStats(other *StatsResolver) {
+	r.queries = other.queries
+	r.blockedQueries = other.blockedQueries
+	r.recorders = other.recorders
+}
+
+// Stats returns the statistics of the last 24 hours
+func (r *StatsResolver) Stats() api.Stats {
+	result := api.Stats{
+		TotalQueries:   r.queries.Sum(),
+		BlockedQueries: r.blockedQueries.Sum(),
+	}
+
+	for _, rec := range r.recorders {
+		entries := []api.StatsEntry{}
+
+		util.IterateValueSorted(rec.aggregator.AggregateResult(), func(k string, v int) {
+			entries = append(entries, api.StatsEntry{Name: k, Count: v})
+		})
+
+		*rec.field(&result) = entries
+	}
+
+	return result
+}
+
+// PrintStats logs the statistics of the last 24 hours
+func (r *StatsResolver) PrintStats() {
 	logger := logger("stats_resover")
 
 	w := logger.Writer()
 	defer w.Close()
 
 	logger.Info("******* STATS 24h *******")
+	logger.Infof("%s: %d", r.queries.Name, r.queries.Sum())
+	logger.Infof("%s: %d", r.blockedQueries.Name, r.blockedQueries.Sum())
 
 	for _, s := range r.recorders {
 		t := table.NewWriter()
@@ -127,26 +196,33 @@ func (r *StatsResolver) printStats() {
 
 func createRecorders() []*resolverStatRecorder {
 	return []*resolverStatRecorder{
-		newRecorderWithMax("Top 20 queries", 20, func(e *statsEntry) string {
-			return util.ExtractDomain(e.request.Req.Question[0])
-		}),
-		newRecorderWithMax("Top 20 blocked queries", 20, func(e *statsEntry) string {
-			if e.response.rType == BLOCKED {
+		newRecorderWithMax("Top 20 queries", 20, func(s *api.Stats) *[]api.StatsEntry { return &s.TopQueries },
+			func(e statsEntry) string {
 				return util.ExtractDomain(e.request.Req.Question[0])
-			}
-			return ""
-		}),
-		newRecorder("Query count per client", func(e *statsEntry) string {
-			return strings.Join(e.request.ClientNames, ",")
-		}),
-		newRecorder("Reason", func(e *statsEntry) string {
-			return e.response.Reason
-		}),
-		newRecorder("Query type", func(e *statsEntry) string {
-			return util.QTypeToString()(e.request.Req.Question[0].Qtype)
-		}),
-		newRecorder("Response type", func(e *statsEntry) string {
-			return dns.RcodeToString[e.response.Res.Rcode]
-		}),
+			}),
+		newRecorderWithMax("Top 20 blocked queries", 20,
+			func(s *api.Stats) *[]api.StatsEntry { return &s.TopBlockedQueries },
+			func(e statsEntry) string {
+				if e.response.rType == BLOCKED {
+					return util.ExtractDomain(e.request.Req.Question[0])
+				}
+				return ""
+			}),
+		newRecorderWithMax("Top 20 clients", 20, func(s *api.Stats) *[]api.StatsEntry { return &s.TopClients },
+			func(e statsEntry) string {
+				return strings.Join(e.request.ClientNames, ",")
+			}),
+		newRecorder("Reason", func(s *api.Stats) *[]api.StatsEntry { return &s.Reasons },
+			func(e statsEntry) string {
+				return e.response.Reason
+			}),
+		newRecorder("Query type", func(s *api.Stats) *[]api.StatsEntry { return &s.QueryTypes },
+			func(e statsEntry) string {
+				return util.QTypeToString()(e.request.Req.Question[0].Qtype)
+			}),
+		newRecorder("Response type", func(s *api.Stats) *[]api.StatsEntry { return &s.ResponseTypes },
+			func(e statsEntry) string {
+				return dns.RcodeToString[e.response.Res.Rcode]
+			}),
 	}
 }
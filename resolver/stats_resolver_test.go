@@ -2,6 +2,7 @@ package resolver
 
 import (
 	"blocky/util"
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -11,7 +12,7 @@ import (
 )
 
 func Test_Resolve_WithStats(t *testing.T) {
-	sut := NewStatsResolver()
+	sut := NewStatsResolver(nil)
 	m := &resolverMock{}
 
 	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
@@ -29,11 +30,51 @@ func Test_Resolve_WithStats(t *testing.T) {
 	assert.NoError(t, err)
 	m.AssertExpectations(t)
 
-	sut.(*StatsResolver).printStats()
+	sut.(*StatsResolver).PrintStats()
+
+	// only completed hours are aggregated
+	stats := sut.(*StatsResolver).Stats()
+	assert.Equal(t, 0, stats.TotalQueries)
+	assert.Empty(t, stats.TopQueries)
+	assert.NotNil(t, stats.TopClients)
+}
+
+func Test_Resolve_StatsExcludedClients(t *testing.T) {
+	sut := NewStatsResolver([]string{"192.168.178.0/24"}).(*StatsResolver)
+	m := &resolverMock{}
+
+	resp, err := util.NewMsgWithAnswer("example.com. 300 IN A 123.122.121.120")
+	assert.NoError(t, err)
+
+	m.On("Resolve", mock.Anything).Return(&Response{Res: resp, Reason: "reason"}, nil)
+	sut.Next(m)
+
+	// unbuffered channel: not excluded queries would block
+	sut.statsChan = make(chan statsEntry)
+
+	_, err = sut.Resolve(&Request{
+		ClientIP: net.ParseIP("192.168.178.25"),
+		Req:      util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log:      logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	m.AssertExpectations(t)
+	assert.Contains(t, sut.Configuration(), "excludedClients = 1 rules")
+}
+
+func Test_ShareStats(t *testing.T) {
+	old := NewStatsResolver(nil).(*StatsResolver)
+	sut := NewStatsResolver(nil).(*StatsResolver)
+
+	sut.ShareStats(old)
+
+	assert.Equal(t, old.queries, sut.queries)
+	assert.Equal(t, old.blockedQueries, sut.blockedQueries)
+	assert.Equal(t, old.recorders, sut.recorders)
 }
 
 func Test_Configuration_StatsResolverg(t *testing.T) {
-	sut := NewStatsResolver()
+	sut := NewStatsResolver(nil)
 	c := sut.Configuration()
 	assert.True(t, len(c) > 1)
 }
@@ -0,0 +1,156 @@
+package resolver
+
+import (
+	"blocky/api"
+	"blocky/config"
+	"fmt"
+	"net"
+	"sort"
+)
+
+const defaultUpstreamGroup = "default"
+
+// UpstreamGroupResolver assigns the upstream group to the request based on the client name, IP or CIDR.
+// Clients without mapping use the default group
+type UpstreamGroupResolver struct {
+	NextResolver
+	clientGroups map[string]string
+	// client keys in match order
+	clients     []string
+	clientCIDRs map[string]*net.IPNet
+}
+
+func NewUpstreamGroupResolver(cfg config.UpstreamConfig) ChainedResolver {
+	clients := make([]string, 0, len(cfg.ClientGroups))
+	groups := make(map[string][]string, len(cfg.ClientGroups))
+
+	for client, group := range cfg.ClientGroups {
+		clients = append(clients, client)
+		groups[client] = []string{group}
+	}
+
+	sort.Strings(clients)
+
+	return &UpstreamGroupResolver{
+		clientGroups: cfg.ClientGroups,
+		clients:      clients,
+		clientCIDRs:  parseClientCIDRs(groups),
+	}
+}
+
+func (r *UpstreamGroupResolver) Configuration() (result []string) {
+	if len(r.clients) == 0 {
+		return []string{"deactivated"}
+	}
+
+	for _, client := range r.clients {
+		result = append(result, fmt.Sprintf("%s = \"%s\"", client, r.clientGroups[client]))
+	}
+
+	return
+}
+
+func (r *UpstreamGroupResolver) Resolve(request *Request) (*Response, error) {
+	if group := r.groupOf(request); group != defaultUpstreamGroup {
+		withPrefix(request.Log, "upstream_group_resolver").WithField("upstream_group", group).
+			Debug("using upstream group")
+
+		request.UpstreamGroup = group
+	}
+
+	return r.next.Resolve(request)
+}
+
+// returns the group of the first matching client (in alphabetical order), default group if no client matches
+func (r *UpstreamGroupResolver) groupOf(request *Request) string {
+	for _, client := range r.clients {
+		if clientMatches(client, r.clientCIDRs, request) {
+			return r.clientGroups[client]
+		}
+	}
+
+	return defaultUpstreamGroup
+}
+
+func (r *UpstreamGroupResolver) String() string {
+	return "upstream group resolver"
+}
+
+// GroupedUpstreamResolver delegates the request to the upstream resolver of the request's upstream group
+type GroupedUpstreamResolver struct {
+	groups map[string]Resolver
+	// group names, sorted
+	names []string
+}
+
+// NewGroupedUpstreamResolver creates resolver with upstream resolver per group, the "default" group is required
+func NewGroupedUpstreamResolver(groups map[string]Resolver) Resolver {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return &GroupedUpstreamResolver{groups: groups, names: names}
+}
+
+func (r *GroupedUpstreamResolver) Configuration() (result []string) {
+	for _, name := range r.names {
+		result = append(result, fmt.Sprintf("group '%s': %s", name, r.groups[name]))
+
+		for _, c := range r.groups[name].Configuration() {
+			result = append(result, fmt.Sprintf("  %s", c))
+		}
+	}
+
+	return
+}
+
+func (r *GroupedUpstreamResolver) Resolve(request *Request) (*Response, error) {
+	group := request.UpstreamGroup
+	if group == "" {
+		group = defaultUpstreamGroup
+	}
+
+	res, ok := r.groups[group]
+	if !ok {
+		requestLogger(request, "grouped_upstream_resolver").Warnf("unknown upstream group '%s', using default group", group)
+
+		group = defaultUpstreamGroup
+		res = r.groups[group]
+	}
+
+	response, err := res.Resolve(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Upstream = fmt.Sprintf("%s (%s)", response.Upstream, group)
+
+	return response, nil
+}
+
+// UpstreamStatus returns statistics of the upstreams of all groups
+func (r *GroupedUpstreamResolver) UpstreamStatus() (result []api.UpstreamStatus) {
+	for _, name := range r.names {
+		if reporter, ok := r.groups[name].(UpstreamStatusReporter); ok {
+			result = append(result, reporter.UpstreamStatus()...)
+		}
+	}
+
+	return
+}
+
+// Stop stops background tasks of the group resolvers
+func (r *GroupedUpstreamResolver) Stop() {
+	for _, res := range r.groups {
+		if st, ok := res.(Stopper); ok {
+			st.Stop()
+		}
+	}
+}
+
+func (r *GroupedUpstreamResolver) String() string {
+	return fmt.Sprintf("grouped upstream resolver '%v'", r.names)
+}
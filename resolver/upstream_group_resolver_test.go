@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_Resolve_UpstreamGroup(t *testing.T) {
+	sut := NewUpstreamGroupResolver(config.UpstreamConfig{
+		ClientGroups: map[string]string{
+			"kid-*":          "kids",
+			"192.168.0.0/24": "guests",
+		},
+	})
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg)}, nil)
+	sut.Next(m)
+
+	request := newRequest("example.com.", dns.TypeA, "10.0.0.1", "kid-laptop")
+	_, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "kids", request.UpstreamGroup)
+
+	request = newRequest("example.com.", dns.TypeA, "192.168.0.5")
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "guests", request.UpstreamGroup)
+
+	// not mapped: default group
+	request = newRequest("example.com.", dns.TypeA, "10.0.0.1", "laptop")
+	_, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Empty(t, request.UpstreamGroup)
+
+	m.AssertNumberOfCalls(t, "Resolve", 3)
+	assert.Len(t, sut.Configuration(), 2)
+	assert.Equal(t, []string{"deactivated"}, NewUpstreamGroupResolver(config.UpstreamConfig{}).Configuration())
+}
+
+func Test_Resolve_GroupedUpstream(t *testing.T) {
+	defaultUpstream := &resolverMock{}
+	defaultUpstream.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Upstream: "udp:1.1.1.1:53"}, nil)
+
+	kidsUpstream := &resolverMock{}
+	kidsUpstream.On("Resolve", mock.Anything).Return(&Response{Res: new(dns.Msg), Upstream: "udp:185.228.168.168:53"},
+		nil)
+
+	sut := NewGroupedUpstreamResolver(map[string]Resolver{"default": defaultUpstream, "kids": kidsUpstream})
+
+	request := newRequest("example.com.", dns.TypeA, "10.0.0.1")
+	request.UpstreamGroup = "kids"
+
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "udp:185.228.168.168:53 (kids)", resp.Upstream)
+	kidsUpstream.AssertNumberOfCalls(t, "Resolve", 1)
+
+	resp, err = sut.Resolve(newRequest("example.com.", dns.TypeA, "10.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "udp:1.1.1.1:53 (default)", resp.Upstream)
+	defaultUpstream.AssertNumberOfCalls(t, "Resolve", 1)
+
+	assert.Equal(t, "group 'default': ", sut.Configuration()[0][:len("group 'default': ")])
+}
+
+func Test_Resolve_UpstreamGroup_SeparateCache(t *testing.T) {
+	sut := NewCachingResolver(config.CachingConfig{})
+
+	m := &resolverMock{}
+	m.On("Resolve", mock.Anything).Return(&Response{Res: mustMsgWithAnswer(t, "example.com. 300 IN A 1.2.3.4")}, nil)
+	sut.Next(m)
+
+	_, err := sut.Resolve(newRequest("example.com.", dns.TypeA, "10.0.0.1"))
+	assert.NoError(t, err)
+
+	// answer of the default group is not used for other groups
+	request := newRequest("example.com.", dns.TypeA, "10.0.0.2")
+	request.UpstreamGroup = "kids"
+
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.NotEqual(t, CACHED, resp.rType)
+
+	resp, err = sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, CACHED, resp.rType)
+
+	m.AssertNumberOfCalls(t, "Resolve", 2)
+}
+
+func mustMsgWithAnswer(t *testing.T, answer string) *dns.Msg {
+	msg, err := util.NewMsgWithAnswer(answer)
+	assert.NoError(t, err)
+
+	return msg
+}
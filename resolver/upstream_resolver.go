@@ -2,9 +2,15 @@ package resolver
 
 import (
 	"blocky/config"
+	"blocky/metrics"
 	"blocky/util"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -12,23 +18,350 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	tlsConnPoolSize = 5
+	defaultTimeout  = 2 * time.Second
+	dnsContentType  = "application/dns-message"
+	// wait time before retry, multiplied with the attempt number
+	retryBackoff = 50 * time.Millisecond
+)
+
 // UpstreamResolver sends request to external DNS server
 type UpstreamResolver struct {
 	NextResolver
-	client   *dns.Client
-	upstream string
+	upstreamClient upstreamClient
+	tcpClient      upstreamClient // used for UDP upstreams, if the response is truncated
+	upstream       string
+	net            string
+	timeout        time.Duration
+	retries        int
+	bootstrap      *Bootstrap
+	// local address for outgoing queries, empty if not configured
+	outgoingAddress string
+}
+
+type upstreamClient interface {
+	callExternal(ctx context.Context, msg *dns.Msg, upstreamURL string) (response *dns.Msg, rtt time.Duration, err error)
+}
+
+// plain UDP or TCP client, new connection is used for each query
+type dnsUpstreamClient struct {
+	client *dns.Client
+}
+
+// DNS-over-TLS client, keeps a small pool of persistent connections to avoid TLS handshake on each query
+type tlsUpstreamClient struct {
+	client *dns.Client
+	pool   chan *dns.Conn
+}
+
+// DNS-over-HTTPS client, the underlying HTTP/2 connections are reused across queries
+type httpUpstreamClient struct {
+	client *http.Client
+}
+
+// NewUpstreamResolver creates new resolver instance. If bootstrap is passed, the host name of the upstream
+// is resolved with it, otherwise with the system resolver
+func NewUpstreamResolver(upstream config.Upstream, bootstrap *Bootstrap) Resolver {
+	upstreamURL := net.JoinHostPort(upstream.Host, strconv.Itoa(int(upstream.Port)))
+	if upstream.Net == "https" {
+		upstreamURL = upstream.String()
+	}
+
+	if net.ParseIP(upstream.Host) == nil && bootstrap == nil {
+		logger("upstream_resolver").Warnf("upstream '%s' is defined with host name and no bootstrap DNS is configured: "+
+			"the host name is resolved with the system resolver, which can lead to a loop, if it uses blocky", upstream)
+	}
+
+	timeout := timeoutOrDefault(upstream.Timeout)
+
+	if upstream.OutgoingAddress != "" {
+		if err := checkOutgoingAddress(upstream.OutgoingAddress); err != nil {
+			logger("upstream_resolver").Errorf("can't use outgoing address '%s' for upstream '%s', "+
+				"queries to this upstream will fail: %v", upstream.OutgoingAddress, upstream, err)
+		}
+	}
+
+	r := &UpstreamResolver{
+		upstreamClient:  createUpstreamClient(upstream, timeout, bootstrap),
+		upstream:        upstreamURL,
+		net:             upstream.Net,
+		timeout:         timeout,
+		retries:         upstream.Retries,
+		bootstrap:       bootstrap,
+		outgoingAddress: upstream.OutgoingAddress,
+	}
+
+	if upstream.Net == "udp" {
+		tcpUpstream := upstream
+		tcpUpstream.Net = "tcp"
+		r.tcpClient = createUpstreamClient(tcpUpstream, timeout, bootstrap)
+	}
+
+	return r
 }
 
-func NewUpstreamResolver(upstream config.Upstream) Resolver {
+// checks if the local address can be bound, e.g. the address is assigned to an interface of this host
+func checkOutgoingAddress(address string) error {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(address, "0"))
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// returns the local address for dialing with passed network, nil if no outgoing address is configured
+func localAddr(outgoingAddress string, network string) net.Addr {
+	ip := net.ParseIP(outgoingAddress)
+	if ip == nil {
+		return nil
+	}
+
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip}
+	}
+
+	return &net.TCPAddr{IP: ip}
+}
+
+func createUpstreamClient(upstream config.Upstream, timeout time.Duration, bootstrap *Bootstrap) upstreamClient {
+	if upstream.Net == "https" {
+		dialer := &net.Dialer{
+			Timeout:   timeout,
+			LocalAddr: localAddr(upstream.OutgoingAddress, "tcp"),
+		}
+
+		transport := &http.Transport{
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: tlsConnPoolSize,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: timeout,
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			},
+		}
+
+		if bootstrap != nil {
+			transport.DialContext = bootstrap.dialContext(dialer)
+		} else if dialer.LocalAddr != nil {
+			transport.DialContext = dialer.DialContext
+		}
+
+		return &httpUpstreamClient{
+			client: &http.Client{
+				Timeout:   timeout,
+				Transport: transport,
+			},
+		}
+	}
+
 	client := new(dns.Client)
 	client.Net = upstream.Net
+	client.DialTimeout = timeout
+	client.ReadTimeout = timeout
+	client.WriteTimeout = timeout
+
+	if addr := localAddr(upstream.OutgoingAddress, upstream.Net); addr != nil {
+		// dialer replaces the dial timeout
+		client.Dialer = &net.Dialer{Timeout: timeout, LocalAddr: addr}
+	}
+
+	if upstream.Net == "tcp-tls" {
+		// host name is used for certificate verification, if the upstream is called with resolved IP
+		serverName := upstream.CommonName
+		if serverName == "" && net.ParseIP(upstream.Host) == nil {
+			serverName = upstream.Host
+		}
+
+		client.TLSConfig = &tls.Config{
+			ServerName: serverName,
+			MinVersion: tls.VersionTLS12,
+		}
+
+		return &tlsUpstreamClient{
+			client: client,
+			pool:   make(chan *dns.Conn, tlsConnPoolSize),
+		}
+	}
+
+	return &dnsUpstreamClient{client: client}
+}
+
+func (r *dnsUpstreamClient) callExternal(ctx context.Context, msg *dns.Msg,
+	upstreamURL string) (*dns.Msg, time.Duration, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return r.client.Exchange(msg, upstreamURL)
+	}
+
+	// ExchangeContext modifies the client -> new client for each exchange with timeouts limited by the deadline
+	client := &dns.Client{
+		Net:          r.client.Net,
+		DialTimeout:  limitTimeout(ctx, r.client.DialTimeout),
+		ReadTimeout:  limitTimeout(ctx, r.client.ReadTimeout),
+		WriteTimeout: limitTimeout(ctx, r.client.WriteTimeout),
+	}
+
+	if r.client.Dialer != nil {
+		// ExchangeContext replaces the dialer -> keep the local address with limited dial timeout
+		dialer := *r.client.Dialer
+		dialer.Timeout = limitTimeout(ctx, dialer.Timeout)
+		client.Dialer = &dialer
 
-	return &UpstreamResolver{
-		client:   client,
-		upstream: net.JoinHostPort(upstream.Host, strconv.Itoa(int(upstream.Port)))}
+		return client.Exchange(msg, upstreamURL)
+	}
+
+	return client.ExchangeContext(ctx, msg, upstreamURL)
+}
+
+func (r *httpUpstreamClient) callExternal(ctx context.Context, msg *dns.Msg,
+	upstreamURL string) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+
+	rawDNSMessage, err := msg.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't pack message: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstreamURL, bytes.NewReader(rawDNSMessage))
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't create http request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", dnsContentType)
+	req.Header.Set("Accept", dnsContentType)
+
+	httpResponse, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("http return code should be %d, but received %d", http.StatusOK, httpResponse.StatusCode)
+	}
+
+	contentType := httpResponse.Header.Get("Content-Type")
+	if contentType != dnsContentType {
+		return nil, 0, fmt.Errorf("http return content type should be '%s', but was '%s'", dnsContentType, contentType)
+	}
+
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't read response body: %v", err)
+	}
+
+	response := new(dns.Msg)
+	if err = response.Unpack(body); err != nil {
+		return nil, 0, fmt.Errorf("can't unpack message: %v", err)
+	}
+
+	return response, time.Since(start), nil
+}
+
+func (r *tlsUpstreamClient) callExternal(ctx context.Context, msg *dns.Msg,
+	upstreamURL string) (*dns.Msg, time.Duration, error) {
+	conn, reused, err := r.getConn(upstreamURL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, rtt, err := r.exchange(ctx, conn, msg)
+
+	if err != nil && reused {
+		// pooled connection could be closed by the server in the meantime -> retry with a new connection
+		conn.Close()
+
+		if conn, err = r.client.Dial(upstreamURL); err != nil {
+			return nil, 0, err
+		}
+
+		response, rtt, err = r.exchange(ctx, conn, msg)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	r.putConn(conn)
+
+	return response, rtt, nil
+}
+
+// returns a pooled connection if available, creates a new one otherwise
+func (r *tlsUpstreamClient) getConn(upstreamURL string) (conn *dns.Conn, reused bool, err error) {
+	select {
+	case conn = <-r.pool:
+		return conn, true, nil
+	default:
+		conn, err = r.client.Dial(upstreamURL)
+		return conn, false, err
+	}
+}
+
+// puts the connection back to the pool, closes it if the pool is full
+func (r *tlsUpstreamClient) putConn(conn *dns.Conn) {
+	select {
+	case r.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (r *tlsUpstreamClient) exchange(ctx context.Context, conn *dns.Conn,
+	msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+
+	if err := conn.SetWriteDeadline(start.Add(limitTimeout(ctx, timeoutOrDefault(r.client.WriteTimeout)))); err != nil {
+		return nil, 0, err
+	}
+
+	if err := conn.WriteMsg(msg); err != nil {
+		return nil, 0, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(limitTimeout(ctx, timeoutOrDefault(r.client.ReadTimeout)))); err != nil {
+		return nil, 0, err
+	}
+
+	response, err := conn.ReadMsg()
+	if err == nil && response.Id != msg.Id {
+		err = dns.ErrId
+	}
+
+	return response, time.Since(start), err
+}
+
+func timeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+
+	return defaultTimeout
+}
+
+// returns the timeout or the remaining time until the deadline of the context, if it is shorter
+func limitTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < timeout {
+			return remaining
+		}
+	}
+
+	return timeout
 }
 
 func (r *UpstreamResolver) Configuration() (result []string) {
+	result = append(result, fmt.Sprintf("protocol = \"%s\"", r.net))
+	result = append(result, fmt.Sprintf("upstream = \"%s\"", r.upstream))
+	result = append(result, fmt.Sprintf("timeout = %s", r.timeout))
+	result = append(result, fmt.Sprintf("retries = %d", r.retries))
+
+	if r.outgoingAddress != "" {
+		result = append(result, fmt.Sprintf("outgoingAddress = %s", r.outgoingAddress))
+	}
+
 	return
 }
 
@@ -41,20 +374,71 @@ func (r *UpstreamResolver) Resolve(request *Request) (response *Response, err er
 
 	var resp *dns.Msg
 
-	for attempt <= 3 {
-		if resp, rtt, err = r.client.Exchange(request.Req, r.upstream); err == nil {
+	address := r.upstream
+
+	if r.bootstrap != nil && r.net != "https" {
+		if address, err = r.bootstrap.resolveAddress(r.upstream); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := request.Context()
+
+	for attempt <= r.retries+1 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		resp, rtt, err = r.upstreamClient.callExternal(ctx, request.Req, address)
+
+		if err == nil && resp.Truncated && r.tcpClient != nil {
+			logger.Debug("response is truncated, retrying with TCP")
+
+			var tcpRtt time.Duration
+
+			// the response time contains both requests
+			resp, tcpRtt, err = r.tcpClient.callExternal(ctx, request.Req, address)
+			rtt += tcpRtt
+		}
+
+		if err == nil {
+			err = validateResponse(request.Req, resp)
+		}
+
+		metrics.RecordUpstreamRequest(r.protocolPrefix()+r.upstream, rtt, err)
+
+		if err == nil {
+			if removed := stripUnrelatedRecords(request.Req, resp); removed > 0 {
+				requestLogger(request, "upstream_resolver").WithField("upstream", r.protocolPrefix()+r.upstream).
+					Warnf("removed %d records from response, which don't belong to the query", removed)
+			}
+
 			logger.WithFields(logrus.Fields{
 				"answer":           util.AnswerToString(resp.Answer),
 				"return_code":      dns.RcodeToString[resp.Rcode],
-				"upstream":         r.upstream,
+				"upstream":         r.protocolPrefix() + r.upstream,
 				"response_time_ms": rtt.Milliseconds(),
 			}).Debugf("received response from upstream")
 
-			return &Response{Res: resp, Reason: fmt.Sprintf("RESOLVED (%s)", r.upstream)}, err
+			return &Response{
+				Res:      resp,
+				Reason:   fmt.Sprintf("RESOLVED (%s)", r.upstream),
+				Upstream: r.protocolPrefix() + r.upstream,
+			}, err
 		}
 
-		if errNet, ok := err.(net.Error); ok && (errNet.Timeout() || errNet.Temporary()) {
+		if _, ok := err.(*invalidResponseError); ok {
+			requestLogger(request, "upstream_resolver").WithField("attempt", attempt).
+				Warnf("discarding response from upstream '%s': %v", r.protocolPrefix()+r.upstream, err)
+		}
+
+		if isRetryable(err) {
 			logger.WithField("attempt", attempt).Debugf("Temporary network error / Timeout occurred, retrying...")
+
+			if attempt <= r.retries {
+				time.Sleep(retryBackoff * time.Duration(attempt))
+			}
+
 			attempt++
 		} else {
 			return nil, err
@@ -64,6 +448,26 @@ func (r *UpstreamResolver) Resolve(request *Request) (response *Response, err er
 	return
 }
 
+// returns true for timeouts, temporary network errors and invalid responses
+func isRetryable(err error) bool {
+	if _, ok := err.(*invalidResponseError); ok {
+		return true
+	}
+
+	errNet, ok := err.(net.Error)
+
+	return ok && (errNet.Timeout() || errNet.Temporary())
+}
+
 func (r UpstreamResolver) String() string {
-	return fmt.Sprintf("upstream '%s'", r.upstream)
+	return fmt.Sprintf("upstream '%s'", r.protocolPrefix()+r.upstream)
+}
+
+// returns protocol prefix for non-URL upstreams
+func (r UpstreamResolver) protocolPrefix() string {
+	if r.net == "https" {
+		return ""
+	}
+
+	return r.net + ":"
 }
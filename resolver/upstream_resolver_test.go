@@ -1,9 +1,20 @@
 package resolver
 
 import (
+	"blocky/config"
 	"blocky/util"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -20,7 +31,7 @@ func Test_Resolve_Upstream(t *testing.T) {
 		return response
 	})
 
-	sut := NewUpstreamResolver(upstream)
+	sut := NewUpstreamResolver(upstream, nil)
 
 	request := &Request{
 		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
@@ -31,6 +42,56 @@ func Test_Resolve_Upstream(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
 	assert.Equal(t, "example.com.	123	IN	A	123.124.122.122", resp.Res.Answer[0].String())
+	assert.Equal(t, fmt.Sprintf("%s:%s:%d", upstream.Net, upstream.Host, upstream.Port), resp.Upstream)
+}
+
+func Test_Resolve_Upstream_OutgoingAddress(t *testing.T) {
+	upstream := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+	upstream.OutgoingAddress = "127.0.0.1"
+
+	sut := NewUpstreamResolver(upstream, nil)
+
+	assert.Contains(t, sut.Configuration(), "outgoingAddress = 127.0.0.1")
+
+	// with and without query deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, c := range []context.Context{nil, ctx} {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+			Ctx: c,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "example.com.	123	IN	A	123.124.122.122", resp.Res.Answer[0].String())
+	}
+}
+
+func Test_Resolve_Upstream_OutgoingAddressNotAvailable(t *testing.T) {
+	upstream := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+	// documentation address, not assigned to any interface
+	upstream.OutgoingAddress = "192.0.2.1"
+
+	assert.Error(t, checkOutgoingAddress(upstream.OutgoingAddress))
+
+	sut := NewUpstreamResolver(upstream, nil)
+
+	_, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.Error(t, err)
 }
 
 func TestUpstreamTimeout(t *testing.T) {
@@ -50,8 +111,9 @@ func TestUpstreamTimeout(t *testing.T) {
 		return response
 	})
 
-	sut := NewUpstreamResolver(upstream).(*UpstreamResolver)
-	sut.client.ReadTimeout = 100 * time.Millisecond
+	upstream.Timeout = 100 * time.Millisecond
+	upstream.Retries = 2
+	sut := NewUpstreamResolver(upstream, nil).(*UpstreamResolver)
 
 	request := &Request{
 		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
@@ -77,3 +139,357 @@ func TestUpstreamTimeout(t *testing.T) {
 	assert.True(t, strings.HasSuffix(err.Error(), "i/o timeout"))
 	assert.Nil(t, response)
 }
+
+func TestUpstream_QueryDeadline(t *testing.T) {
+	var counter int32
+
+	upstream := TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		atomic.AddInt32(&counter, 1)
+		time.Sleep(300 * time.Millisecond)
+
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+		assert.NoError(t, err)
+
+		return response
+	})
+
+	upstream.Timeout = time.Second
+	upstream.Retries = 2
+	sut := NewUpstreamResolver(upstream, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	// upstream exchange is cancelled after the deadline, no further retries
+	response, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+		Ctx: ctx,
+	})
+
+	assert.Error(t, err)
+	assert.Nil(t, response)
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&counter))
+}
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+
+	return conn, err
+}
+
+func Test_Resolve_TLSUpstream_ReusesConnection(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../testdata/cert.pem", "../testdata/key.pem")
+	assert.NoError(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.NoError(t, err)
+
+	listener := &countingListener{Listener: ln}
+	server := &dns.Server{
+		Listener: listener,
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, request *dns.Msg) {
+			response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+			assert.NoError(t, err)
+			response.SetReply(request)
+			assert.NoError(t, w.WriteMsg(response))
+		}),
+	}
+
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+
+	defer func() {
+		_ = server.Shutdown()
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	sut := NewUpstreamResolver(config.Upstream{
+		Net:        "tcp-tls",
+		Host:       addr.IP.String(),
+		Port:       uint16(addr.Port),
+		CommonName: "blocky.local",
+	}, nil).(*UpstreamResolver)
+
+	certPool := x509.NewCertPool()
+	certPEM, err := ioutil.ReadFile("../testdata/cert.pem")
+	assert.NoError(t, err)
+	certPool.AppendCertsFromPEM(certPEM)
+	sut.upstreamClient.(*tlsUpstreamClient).client.TLSConfig.RootCAs = certPool
+
+	for i := 0; i < 3; i++ {
+		resp, err := sut.Resolve(&Request{
+			Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			Log: logrus.NewEntry(logrus.New()),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "example.com.\t123\tIN\tA\t123.124.122.122", resp.Res.Answer[0].String())
+	}
+
+	// one TLS connection for all queries
+	assert.Equal(t, int32(1), atomic.LoadInt32(&listener.accepted))
+
+	// server closes pooled connection -> reconnect transparently
+	conn := <-sut.upstreamClient.(*tlsUpstreamClient).pool
+	conn.Close()
+	sut.upstreamClient.(*tlsUpstreamClient).pool <- conn
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.\t123\tIN\tA\t123.124.122.122", resp.Res.Answer[0].String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&listener.accepted))
+}
+
+func TestDoHUpstream(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "application/dns-message", req.Header.Get("Content-Type"))
+
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+
+		request := new(dns.Msg)
+		assert.NoError(t, request.Unpack(body))
+
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+		assert.NoError(t, err)
+		response.SetReply(request)
+
+		b, err := response.Pack()
+		assert.NoError(t, err)
+
+		rw.Header().Set("Content-Type", "application/dns-message")
+		_, err = rw.Write(b)
+		assert.NoError(t, err)
+	}))
+	defer server.Close()
+
+	sut := newDoHUpstreamResolver(t, server)
+
+	assert.Equal(t, []string{"protocol = \"https\"", fmt.Sprintf("upstream = \"%s/dns-query\"", server.URL),
+		"timeout = 2s", "retries = 0"}, sut.Configuration())
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Res.Rcode)
+	assert.Equal(t, "example.com.\t123\tIN\tA\t123.124.122.122", resp.Res.Answer[0].String())
+}
+
+func TestDoHUpstream_WrongResponse(t *testing.T) {
+	statusCode := http.StatusInternalServerError
+	contentType := "application/dns-message"
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		rw.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	sut := newDoHUpstreamResolver(t, server)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	// wrong http status
+	_, err := sut.Resolve(request)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "http return code should be 200")
+
+	// wrong content type
+	statusCode = http.StatusOK
+	contentType = "text/plain"
+	_, err = sut.Resolve(request)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "http return content type should be")
+}
+
+func newDoHUpstreamResolver(t *testing.T, server *httptest.Server) *UpstreamResolver {
+	upstream, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	port, err := strconv.Atoi(upstream.Port())
+	assert.NoError(t, err)
+
+	sut := NewUpstreamResolver(config.Upstream{
+		Net:  "https",
+		Host: upstream.Hostname(),
+		Port: uint16(port),
+		Path: "/dns-query",
+	}, nil).(*UpstreamResolver)
+
+	// trust test server's certificate
+	sut.upstreamClient.(*httpUpstreamClient).client = server.Client()
+
+	return sut
+}
+
+func Test_Resolve_Truncated_TCPFallback(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, request *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetReply(request)
+
+		if w.RemoteAddr().Network() == "udp" {
+			// answer doesn't fit into UDP response
+			response.Truncated = true
+		} else {
+			rr, err := dns.NewRR("example.com 123 IN TXT \"long text\"")
+			assert.NoError(t, err)
+			response.Answer = []dns.RR{rr}
+		}
+
+		assert.NoError(t, w.WriteMsg(response))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	addr := ln.Addr().(*net.TCPAddr)
+
+	pc, err := net.ListenPacket("udp", addr.String())
+	assert.NoError(t, err)
+
+	tcpServer := &dns.Server{Listener: ln, Net: "tcp", Handler: handler}
+	udpServer := &dns.Server{PacketConn: pc, Net: "udp", Handler: handler}
+
+	for _, s := range []*dns.Server{tcpServer, udpServer} {
+		s := s
+
+		go func() {
+			_ = s.ActivateAndServe()
+		}()
+
+		defer func() {
+			_ = s.Shutdown()
+		}()
+	}
+
+	sut := NewUpstreamResolver(config.Upstream{Net: "udp", Host: addr.IP.String(), Port: uint16(addr.Port)}, nil)
+
+	resp, err := sut.Resolve(&Request{
+		Req: util.NewMsgWithQuestion("example.com.", dns.TypeTXT),
+		Log: logrus.NewEntry(logrus.New()),
+	})
+	assert.NoError(t, err)
+	assert.False(t, resp.Res.Truncated)
+	assert.Equal(t, "example.com.\t123\tIN\tTXT\t\"long text\"", resp.Res.Answer[0].String())
+}
+
+func TestDoHUpstream_ResponseValidation(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+
+		request := new(dns.Msg)
+		assert.NoError(t, request.Unpack(body))
+
+		response := new(dns.Msg)
+		response.SetReply(request)
+
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// spoofed response for other question
+			response.Question[0].Name = "other.com."
+		}
+
+		response.Answer = []dns.RR{
+			mustRR(t, "www.EXAMPLE.com. 300 IN CNAME cdn.example.net."),
+			mustRR(t, "cdn.example.net. 300 IN A 123.124.122.122"),
+			mustRR(t, "unrelated.com. 300 IN A 10.0.0.1"),
+		}
+		response.Extra = []dns.RR{mustRR(t, "ns.unrelated.com. 300 IN A 10.0.0.2")}
+
+		b, err := response.Pack()
+		assert.NoError(t, err)
+
+		rw.Header().Set("Content-Type", "application/dns-message")
+		_, err = rw.Write(b)
+		assert.NoError(t, err)
+	}))
+	defer server.Close()
+
+	sut := newDoHUpstreamResolver(t, server)
+
+	request := &Request{
+		Req: util.NewMsgWithQuestion("www.example.com.", dns.TypeA),
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	// invalid response without retry
+	_, err := sut.Resolve(request)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid upstream response: question")
+
+	// invalid response is retried, unrelated records are removed
+	sut.retries = 1
+	atomic.StoreInt32(&attempts, 0)
+
+	resp, err := sut.Resolve(request)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	assert.Equal(t, "CNAME (cdn.example.net.), A (123.124.122.122)", util.AnswerToString(resp.Res.Answer))
+	assert.Empty(t, resp.Res.Extra)
+}
+
+func Test_validateResponse_ID(t *testing.T) {
+	req := util.NewMsgWithQuestion("example.com.", dns.TypeA)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Id = req.Id + 1
+
+	err := validateResponse(req, resp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't match query ID")
+
+	// error response without question
+	resp.Id = req.Id
+	resp.Question = nil
+	resp.Rcode = dns.RcodeRefused
+	assert.NoError(t, validateResponse(req, resp))
+}
+
+func Test_stripUnrelatedRecords_DNAME(t *testing.T) {
+	req := util.NewMsgWithQuestion("www.sub.example.com.", dns.TypeA)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		mustRR(t, "example.com. 300 IN DNAME example.net."),
+		mustRR(t, "example.com. 300 IN RRSIG DNAME 8 2 300 20300101000000 20200101000000 12345 example.com. AAAA"),
+		mustRR(t, "example.com. 300 IN RRSIG A 8 2 300 20300101000000 20200101000000 12345 example.com. AAAA"),
+		mustRR(t, "example.com. 300 IN A 10.0.0.1"),
+		mustRR(t, "www.sub.example.com. 300 IN CNAME www.sub.example.net."),
+		mustRR(t, "www.sub.example.net. 300 IN A 123.124.122.122"),
+		mustRR(t, "other.example.net. 300 IN A 10.0.0.2"),
+	}
+
+	assert.Equal(t, 3, stripUnrelatedRecords(req, resp))
+	assert.Equal(t, []dns.RR{
+		mustRR(t, "example.com. 300 IN DNAME example.net."),
+		mustRR(t, "example.com. 300 IN RRSIG DNAME 8 2 300 20300101000000 20200101000000 12345 example.com. AAAA"),
+		mustRR(t, "www.sub.example.com. 300 IN CNAME www.sub.example.net."),
+		mustRR(t, "www.sub.example.net. 300 IN A 123.124.122.122"),
+	}, resp.Answer)
+}
@@ -0,0 +1,128 @@
+package resolver
+
+import (
+	"blocky/api"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// weight of the latest value in the moving averages
+	statsSmoothingFactor = 0.2
+	// part of the requests, which is distributed equally to all upstreams. Slow or failing upstreams get occasional
+	// requests, so their statistics can recover
+	probeShare = 0.1
+)
+
+// upstreamStats contains statistics of recent requests to one upstream resolver
+type upstreamStats struct {
+	lock     sync.RWMutex
+	requests uint64
+	errors   uint64
+	// moving average of response time in ms
+	latency float64
+	// moving average of failed requests (0..1)
+	errorRate float64
+}
+
+func (s *upstreamStats) record(duration time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	failed := 0.0
+
+	if err != nil {
+		s.errors++
+		failed = 1
+	}
+
+	ms := float64(duration) / float64(time.Millisecond)
+
+	if s.requests == 0 {
+		s.latency, s.errorRate = ms, failed
+	} else {
+		s.latency += statsSmoothingFactor * (ms - s.latency)
+		s.errorRate += statsSmoothingFactor * (failed - s.errorRate)
+	}
+
+	s.requests++
+}
+
+// weight for random selection: fast upstreams with less errors have higher weight. Failing upstreams keep a small
+// weight to detect recovery
+func (s *upstreamStats) weight() float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	latency := s.latency
+	if latency < 1 {
+		latency = 1
+	}
+
+	return (1 - 0.99*s.errorRate) / latency
+}
+
+// returns the probability of each upstream to be selected: weighted by statistics, with a minimum share for probes
+func selectionShares(stats []*upstreamStats) []float64 {
+	shares := make([]float64, len(stats))
+	sum := 0.0
+
+	for i, s := range stats {
+		shares[i] = s.weight()
+		sum += shares[i]
+	}
+
+	for i := range shares {
+		shares[i] = (1-probeShare)*shares[i]/sum + probeShare/float64(len(shares))
+	}
+
+	return shares
+}
+
+// returns random index, weighted by passed shares
+func pickByShares(shares []float64) int {
+	x := rand.Float64()
+
+	for i, share := range shares {
+		if x < share {
+			return i
+		}
+
+		x -= share
+	}
+
+	return len(shares) - 1
+}
+
+func (s *upstreamStats) String() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return fmt.Sprintf("requests = %d, errors = %d, avg latency = %.0f ms", s.requests, s.errors, s.latency)
+}
+
+// returns the statistics of the upstream for the status API
+func (s *upstreamStats) status(name string) api.UpstreamStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return api.UpstreamStatus{Name: name, Requests: s.requests, Errors: s.errors, AvgLatencyMs: s.latency}
+}
+
+// returns true if the upstream answered with SERVFAIL or REFUSED, another upstream should be asked
+func isServerFailure(resp *Response) bool {
+	return resp.Res.Rcode == dns.RcodeServerFailure || resp.Res.Rcode == dns.RcodeRefused
+}
+
+// resolves the request with passed resolver and records the result in statistics
+func resolveWithStats(resolver Resolver, stats *upstreamStats, request *Request) (*Response, error) {
+	start := time.Now()
+	resp, err := resolver.Resolve(request)
+	stats.record(time.Since(start), err)
+
+	return resp, err
+}
@@ -0,0 +1,156 @@
+package resolver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// invalidResponseError is returned if the upstream response doesn't match the query
+type invalidResponseError struct {
+	reason string
+}
+
+func (e *invalidResponseError) Error() string {
+	return fmt.Sprintf("invalid upstream response: %s", e.reason)
+}
+
+// checks that the response belongs to the query: same ID and question. Error responses without question are accepted
+func validateResponse(req, resp *dns.Msg) error {
+	if resp.Id != req.Id {
+		return &invalidResponseError{fmt.Sprintf("ID %d doesn't match query ID %d", resp.Id, req.Id)}
+	}
+
+	if len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	if len(resp.Question) != len(req.Question) {
+		return &invalidResponseError{fmt.Sprintf("response contains %d questions, expected %d",
+			len(resp.Question), len(req.Question))}
+	}
+
+	for i, q := range req.Question {
+		rq := resp.Question[i]
+		if !strings.EqualFold(rq.Name, q.Name) || rq.Qtype != q.Qtype || rq.Qclass != q.Qclass {
+			return &invalidResponseError{fmt.Sprintf("question '%s' doesn't match query '%s'",
+				strings.TrimPrefix(rq.String(), ";"), strings.TrimPrefix(q.String(), ";"))}
+		}
+	}
+
+	return nil
+}
+
+// removes answer records, which don't belong to the queried name or its CNAME/DNAME chain, and additional records,
+// which don't belong to a name in the answer (e.g. MX or SRV target). Returns the number of removed records
+func stripUnrelatedRecords(req, resp *dns.Msg) (removed int) {
+	if len(req.Question) == 0 {
+		return 0
+	}
+
+	names := map[string]bool{strings.ToLower(req.Question[0].Name): true}
+	// owners of DNAME records, which redirect a name of the chain
+	dnameOwners := make(map[string]bool)
+
+	// follow CNAME and DNAME chain, records can be in any order
+	for changed := true; changed; {
+		changed = false
+
+		for _, rr := range resp.Answer {
+			for _, target := range chainTargets(rr, names, dnameOwners) {
+				if !names[target] {
+					names[target] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	answer := resp.Answer[:0]
+	targets := make(map[string]bool)
+
+	for _, rr := range resp.Answer {
+		if !names[strings.ToLower(rr.Header().Name)] && !isDNAMERecord(rr, dnameOwners) {
+			removed++
+			continue
+		}
+
+		answer = append(answer, rr)
+
+		for _, t := range recordTargets(rr) {
+			targets[strings.ToLower(t)] = true
+		}
+	}
+
+	resp.Answer = answer
+
+	extra := resp.Extra[:0]
+
+	for _, rr := range resp.Extra {
+		name := strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype != dns.TypeOPT && !names[name] && !targets[name] {
+			removed++
+			continue
+		}
+
+		extra = append(extra, rr)
+	}
+
+	resp.Extra = extra
+
+	return removed
+}
+
+// returns the names, to which the record redirects names of the chain: target of a CNAME of a chain name or
+// the names below a DNAME target for chain names below the DNAME owner (the owner is added to dnameOwners)
+func chainTargets(rr dns.RR, names, dnameOwners map[string]bool) (result []string) {
+	switch v := rr.(type) {
+	case *dns.CNAME:
+		if names[strings.ToLower(v.Hdr.Name)] {
+			result = append(result, strings.ToLower(v.Target))
+		}
+	case *dns.DNAME:
+		owner := strings.ToLower(v.Hdr.Name)
+
+		for name := range names {
+			if name != owner && dns.IsSubDomain(owner, name) {
+				dnameOwners[owner] = true
+
+				result = append(result, name[:len(name)-len(owner)]+strings.ToLower(v.Target))
+			}
+		}
+	}
+
+	return result
+}
+
+// returns true if the record is a DNAME of the chain or its signature
+func isDNAMERecord(rr dns.RR, dnameOwners map[string]bool) bool {
+	if !dnameOwners[strings.ToLower(rr.Header().Name)] {
+		return false
+	}
+
+	switch v := rr.(type) {
+	case *dns.DNAME:
+		return true
+	case *dns.RRSIG:
+		return v.TypeCovered == dns.TypeDNAME
+	}
+
+	return false
+}
+
+// returns names referenced by the record, for which additional records can be present
+func recordTargets(rr dns.RR) []string {
+	switch v := rr.(type) {
+	case *dns.MX:
+		return []string{v.Mx}
+	case *dns.SRV:
+		return []string{v.Target}
+	case *dns.NS:
+		return []string{v.Ns}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"blocky/config"
+	"blocky/util"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	disallowedClientRefuse = "refuse"
+	disallowedClientDrop   = "drop"
+	// denied queries are logged at most once in this interval
+	accessWarningInterval = 10 * time.Second
+)
+
+// clientAccess checks if the client is allowed to query. Loopback addresses are always allowed,
+// all clients are allowed, if no networks are configured
+type clientAccess struct {
+	networks []*net.IPNet
+	drop     bool
+	lock     sync.Mutex
+	// denied queries since the last warning
+	notLogged   uint64
+	lastWarning time.Time
+}
+
+func newClientAccess(cfg *config.Config) (*clientAccess, error) {
+	networks, err := util.ParseIPNets(cfg.AllowedClients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed clients: %v", err)
+	}
+
+	switch cfg.DisallowedClientAction {
+	case "", disallowedClientRefuse, disallowedClientDrop:
+	default:
+		return nil, fmt.Errorf("unknown disallowed client action '%s', please use one of: refuse or drop",
+			cfg.DisallowedClientAction)
+	}
+
+	return &clientAccess{
+		networks: networks,
+		drop:     cfg.DisallowedClientAction == disallowedClientDrop,
+	}, nil
+}
+
+// returns true if the client is allowed, denied query is logged (at most one warning per interval)
+func (a *clientAccess) isAllowed(ip net.IP) bool {
+	if a == nil || len(a.networks) == 0 || (ip != nil && (ip.IsLoopback() || util.ContainsIP(a.networks, ip))) {
+		return true
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.notLogged++
+
+	if time.Since(a.lastWarning) >= accessWarningInterval {
+		logger().Warnf("query from not allowed client %s denied, %d queries denied since last warning", ip, a.notLogged)
+
+		a.notLogged = 0
+		a.lastWarning = time.Now()
+	}
+
+	return false
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"blocky/config"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_clientAccess(t *testing.T) {
+	sut, err := newClientAccess(&config.Config{AllowedClients: []string{"192.168.178.0/24", "2001:db8::/32", "10.0.0.1"}})
+	assert.NoError(t, err)
+	assert.False(t, sut.drop)
+
+	assert.True(t, sut.isAllowed(net.ParseIP("192.168.178.25")))
+	assert.True(t, sut.isAllowed(net.ParseIP("2001:db8::1")))
+	assert.True(t, sut.isAllowed(net.ParseIP("10.0.0.1")))
+	assert.False(t, sut.isAllowed(net.ParseIP("10.0.0.2")))
+	assert.False(t, sut.isAllowed(net.ParseIP("2001:db9::1")))
+
+	// loopback is always allowed
+	assert.True(t, sut.isAllowed(net.ParseIP("127.0.0.1")))
+	assert.True(t, sut.isAllowed(net.ParseIP("::1")))
+
+	// no networks: all clients are allowed
+	sut, err = newClientAccess(&config.Config{DisallowedClientAction: "drop"})
+	assert.NoError(t, err)
+	assert.True(t, sut.drop)
+	assert.True(t, sut.isAllowed(net.ParseIP("8.8.8.8")))
+}
+
+func Test_clientAccess_InvalidConfig(t *testing.T) {
+	_, err := newClientAccess(&config.Config{AllowedClients: []string{"192.168.178.0/33"}})
+	assert.Error(t, err)
+
+	_, err = newClientAccess(&config.Config{DisallowedClientAction: "ignore"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"blocky/metrics"
+	"blocky/util"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dohMessageType = "application/dns-message"
+	dohMaxSize     = 65535
+)
+
+// OnDoHRequest handles DNS-over-HTTPS (RFC 8484) requests: GET with base64url encoded "dns" parameter
+// or POST with wire format message as body
+func (s *Server) OnDoHRequest(rw http.ResponseWriter, req *http.Request) {
+	logger().Debug("new DoH request")
+
+	s.inFlight.Add(1)
+	defer s.inFlight.Done()
+
+	var rawMsg []byte
+
+	var err error
+
+	// proxy on loopback interface is allowed, X-Forwarded-For header can't be trusted for access control
+	host, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if !s.access.isAllowed(net.ParseIP(host)) {
+		http.Error(rw, "client is not allowed", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		rawMsg, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("can't decode 'dns' parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dohMessageType {
+			http.Error(rw, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		rawMsg, err = ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, dohMaxSize))
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("can't read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err = msg.Unpack(rawMsg); err != nil {
+		http.Error(rw, fmt.Sprintf("can't parse DNS message: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if rejected := rejectUnsupported(msg); rejected != nil {
+		writeDoHResponse(rw, rejected)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), s.queryTimeout)
+	defer cancel()
+
+	var responseMsg *dns.Msg
+
+	if !s.limiter.acquire() {
+		logger().Debug("too many concurrent requests, answering DoH request with SERVFAIL")
+		metrics.RecordOverloadedQuery("servfail")
+
+		responseMsg = new(dns.Msg)
+		responseMsg.SetRcode(msg, dns.RcodeServerFailure)
+		writeDoHResponse(rw, responseMsg)
+
+		return
+	}
+	defer s.limiter.release()
+
+	response, err := s.getResolver().Resolve(newRequest(ctx, extractClientIP(req, s.trustedProxies), msg))
+	recordQuery(msg, response, err)
+
+	if err != nil {
+		s.logResolveError(ctx, "error on processing DoH request", err)
+
+		responseMsg = new(dns.Msg)
+		responseMsg.SetRcode(msg, dns.RcodeServerFailure)
+	} else {
+		responseMsg = response.Res
+		responseMsg.MsgHdr.RecursionAvailable = msg.MsgHdr.RecursionDesired
+	}
+
+	writeDoHResponse(rw, responseMsg)
+}
+
+// writes DNS message in wire format, Cache-Control max-age is the smallest TTL of the message
+func writeDoHResponse(rw http.ResponseWriter, responseMsg *dns.Msg) {
+	b, err := responseMsg.Pack()
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("can't serialize DNS message: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", dohMessageType)
+
+	if ttl, ok := minTTL(responseMsg); ok {
+		rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+
+	if _, err := rw.Write(b); err != nil {
+		logger().Error("can't write DoH response: ", err)
+	}
+}
+
+// returns the smallest TTL of all answer and authority records
+func minTTL(msg *dns.Msg) (ttl uint32, found bool) {
+	for _, rr := range append(msg.Answer, msg.Ns...) {
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+
+	return
+}
+
+// returns client's IP address. If the request comes from a trusted proxy (loopback address if no proxies are
+// configured), the X-Forwarded-For entries are walked from the right (each proxy appends its peer) and the first
+// address, which is not a trusted proxy, is used. Entries left of it can be set by the client and are ignored
+func extractClientIP(req *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	client := net.ParseIP(host)
+	if !isTrustedProxy(client, trustedProxies) {
+		return client
+	}
+
+	// repeated headers are combined in order
+	var entries []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		entries = append(entries, strings.Split(value, ",")...)
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(entries[i]))
+		if ip == nil {
+			// invalid entry, the addresses left of it can't be trusted
+			break
+		}
+
+		client = ip
+
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+
+	return client
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	if len(trustedProxies) == 0 {
+		return ip.IsLoopback()
+	}
+
+	return util.ContainsIP(trustedProxies, ip)
+}
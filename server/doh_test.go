@@ -0,0 +1,225 @@
+package server
+
+import (
+	"blocky/config"
+	"blocky/resolver"
+	"blocky/util"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDoHTestServer(t *testing.T) *Server {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	return &Server{
+		queryResolver: resolver.Chain(
+			resolver.NewCustomDNSResolver(config.CustomDNSConfig{
+				Mapping: map[string]config.CustomDNSEntries{"custom.lan": {"A 192.168.178.55"}},
+			}),
+			resolver.NewUpstreamResolver(upstream, nil),
+		),
+		queryTimeout: defaultQueryTimeout,
+	}
+}
+
+func TestDoHRequest_Post(t *testing.T) {
+	sut := newDoHTestServer(t)
+
+	msg, err := util.NewMsgWithQuestion("custom.lan.", dns.TypeA).Pack()
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(msg))
+	req.Header.Set("Content-Type", dohMessageType)
+
+	rec := httptest.NewRecorder()
+	sut.OnDoHRequest(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, dohMessageType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "max-age=3600", rec.Header().Get("Cache-Control"))
+
+	response := new(dns.Msg)
+	assert.NoError(t, response.Unpack(rec.Body.Bytes()))
+	assert.Equal(t, "custom.lan.\t3600\tIN\tA\t192.168.178.55", response.Answer[0].String())
+}
+
+func TestDoHRequest_Get(t *testing.T) {
+	sut := newDoHTestServer(t)
+
+	msg, err := util.NewMsgWithQuestion("example.com.", dns.TypeA).Pack()
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(msg), nil)
+
+	rec := httptest.NewRecorder()
+	sut.OnDoHRequest(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "max-age=123", rec.Header().Get("Cache-Control"))
+
+	response := new(dns.Msg)
+	assert.NoError(t, response.Unpack(rec.Body.Bytes()))
+	assert.Equal(t, "example.com.\t123\tIN\tA\t123.124.122.122", response.Answer[0].String())
+}
+
+func TestDoHRequest_QueryDeadlineExceeded(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		time.Sleep(200 * time.Millisecond)
+
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	sut := &Server{
+		queryResolver: resolver.NewUpstreamResolver(upstream, nil),
+		queryTimeout:  50 * time.Millisecond,
+	}
+
+	msg, err := util.NewMsgWithQuestion("example.com.", dns.TypeA).Pack()
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(msg))
+	req.Header.Set("Content-Type", dohMessageType)
+
+	rec := httptest.NewRecorder()
+	sut.OnDoHRequest(rec, req)
+
+	response := new(dns.Msg)
+	assert.NoError(t, response.Unpack(rec.Body.Bytes()))
+	assert.Equal(t, dns.RcodeServerFailure, response.Rcode)
+}
+
+func TestDoHRequest_InvalidRequests(t *testing.T) {
+	sut := newDoHTestServer(t)
+
+	// wrong method
+	rec := httptest.NewRecorder()
+	sut.OnDoHRequest(rec, httptest.NewRequest(http.MethodPut, dohPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// wrong content type
+	rec = httptest.NewRecorder()
+	sut.OnDoHRequest(rec, httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader([]byte("test"))))
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+
+	// invalid base64
+	rec = httptest.NewRecorder()
+	sut.OnDoHRequest(rec, httptest.NewRequest(http.MethodGet, dohPath+"?dns=%%%", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// invalid DNS message
+	rec = httptest.NewRecorder()
+	sut.OnDoHRequest(rec, httptest.NewRequest(http.MethodGet, dohPath+"?dns=AAAA", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestDoHRequest_OverHTTPS(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	server, err := NewServer(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port:      config.ListenConfig{"55557"},
+		TLSPort:   55854,
+		HTTPSPort: 55443,
+		CertFile:  "../testdata/cert.pem",
+		KeyFile:   "../testdata/key.pem",
+	})
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+		},
+	}
+
+	msg, err := util.NewMsgWithQuestion("example.com.", dns.TypeA).Pack()
+	assert.NoError(t, err)
+
+	resp, err := client.Post("https://127.0.0.1:55443"+dohPath, dohMessageType, bytes.NewReader(msg))
+	assert.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	response := new(dns.Msg)
+	assert.NoError(t, response.Unpack(body))
+	assert.Equal(t, dns.RcodeSuccess, response.Rcode)
+	assert.Equal(t, "example.com.\t250\tIN\tA\t123.124.122.122", response.Answer[0].String())
+}
+
+func Test_extractClientIP(t *testing.T) {
+	trustedProxies, err := util.ParseIPNets([]string{"192.168.178.0/24"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, dohPath, nil)
+	req.RemoteAddr = "192.168.178.10:12345"
+	assert.Equal(t, net.ParseIP("192.168.178.10"), extractClientIP(req, trustedProxies))
+
+	req.Header.Set("X-Forwarded-For", "10.0.0.5, 192.168.178.1")
+	assert.Equal(t, net.ParseIP("10.0.0.5"), extractClientIP(req, trustedProxies))
+
+	req.Header.Set("X-Forwarded-For", "invalid")
+	assert.Equal(t, net.ParseIP("192.168.178.10"), extractClientIP(req, trustedProxies))
+
+	// value injected by the client is left of the address appended by the proxy and is ignored
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.5")
+	assert.Equal(t, net.ParseIP("10.0.0.5"), extractClientIP(req, trustedProxies))
+
+	req.Header.Set("X-Forwarded-For", "invalid, 10.0.0.5, 192.168.178.1")
+	assert.Equal(t, net.ParseIP("10.0.0.5"), extractClientIP(req, trustedProxies))
+
+	// repeated headers are combined
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Add("X-Forwarded-For", "10.0.0.5")
+	req.Header.Add("X-Forwarded-For", "192.168.178.1")
+	assert.Equal(t, net.ParseIP("10.0.0.5"), extractClientIP(req, trustedProxies))
+
+	// all entries are trusted proxies: leftmost entry is used
+	req.Header.Set("X-Forwarded-For", "192.168.178.2, 192.168.178.1")
+	assert.Equal(t, net.ParseIP("192.168.178.2"), extractClientIP(req, trustedProxies))
+
+	// header of untrusted peer is ignored
+	req.Header.Set("X-Forwarded-For", "10.0.0.5")
+	req.RemoteAddr = "192.168.1.20:12345"
+	assert.Equal(t, net.ParseIP("192.168.1.20"), extractClientIP(req, trustedProxies))
+
+	// only loopback addresses are trusted by default
+	assert.Equal(t, net.ParseIP("192.168.1.20"), extractClientIP(req, nil))
+
+	req.RemoteAddr = "127.0.0.1:12345"
+	assert.Equal(t, net.ParseIP("10.0.0.5"), extractClientIP(req, nil))
+
+	req.RemoteAddr = "[::1]:12345"
+	assert.Equal(t, net.ParseIP("10.0.0.5"), extractClientIP(req, nil))
+}
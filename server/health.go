@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultHealthCheckDomain = "example.com"
+	healthCheckTimeout       = 2 * time.Second
+)
+
+// CheckHealth resolves the probe domain with the resolver chain, returns error if the resolution fails
+func (s *Server) CheckHealth(ctx context.Context) error {
+	s.resolverLock.RLock()
+	domain := s.cfg.HealthCheckDomain
+	s.resolverLock.RUnlock()
+
+	if domain == "" {
+		domain = defaultHealthCheckDomain
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+
+	response, err := s.getResolver().Resolve(newRequest(ctx, net.IPv6loopback, msg))
+	if err != nil {
+		return fmt.Errorf("can't resolve '%s': %v", domain, err)
+	}
+
+	return checkHealthResponse(domain, response.Res)
+}
+
+// answer with NOERROR or NXDOMAIN means that the query could be resolved
+func checkHealthResponse(domain string, response *dns.Msg) error {
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return fmt.Errorf("resolution of '%s' failed with return code %s", domain, dns.RcodeToString[response.Rcode])
+	}
+
+	return nil
+}
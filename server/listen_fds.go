@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// first file descriptor passed by the service manager (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// returns UDP sockets and TCP listeners, which were bound by the service manager and passed with LISTEN_FDS and
+// LISTEN_PID (e.g. systemd socket activation). Returns nothing if no descriptors were passed to this process
+func inheritedListeners() (packetConns []net.PacketConn, listeners []net.Listener, err error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil, nil
+	}
+
+	// descriptors are meant only for this process
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+
+		sockType, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+		if err != nil {
+			return nil, nil, fmt.Errorf("passed file descriptor %d is no socket: %v", fd, err)
+		}
+
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+
+		// net.FilePacketConn and net.FileListener use a copy of the descriptor
+		switch sockType {
+		case unix.SOCK_DGRAM:
+			var pc net.PacketConn
+			if pc, err = net.FilePacketConn(f); err == nil {
+				packetConns = append(packetConns, pc)
+			}
+		case unix.SOCK_STREAM:
+			var l net.Listener
+			if l, err = net.FileListener(f); err == nil {
+				listeners = append(listeners, l)
+			}
+		default:
+			err = fmt.Errorf("unsupported socket type %d", sockType)
+		}
+
+		f.Close()
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't use passed file descriptor %d: %v", fd, err)
+		}
+	}
+
+	return packetConns, listeners, nil
+}
+
+// creates DNS servers for inherited UDP sockets and TCP listeners
+func createInheritedServers(packetConns []net.PacketConn, listeners []net.Listener) []*dns.Server {
+	servers := make([]*dns.Server, 0, len(packetConns)+len(listeners))
+
+	for _, pc := range packetConns {
+		srv := createUDPServer(pc.LocalAddr().String())
+		srv.PacketConn = pc
+		servers = append(servers, srv)
+	}
+
+	for _, l := range listeners {
+		srv := createTCPServer(l.Addr().String())
+		srv.Listener = l
+		servers = append(servers, srv)
+	}
+
+	return servers
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_inheritedListeners_NotPassed(t *testing.T) {
+	packetConns, listeners, err := inheritedListeners()
+	assert.NoError(t, err)
+	assert.Empty(t, packetConns)
+	assert.Empty(t, listeners)
+
+	// descriptors for another process are ignored
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "2")
+
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	packetConns, listeners, err = inheritedListeners()
+	assert.NoError(t, err)
+	assert.Empty(t, packetConns)
+	assert.Empty(t, listeners)
+}
+
+func Test_createInheritedServers(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer pc.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer l.Close()
+
+	servers := createInheritedServers([]net.PacketConn{pc}, []net.Listener{l})
+	assert.Len(t, servers, 2)
+
+	assert.Equal(t, "udp", servers[0].Net)
+	assert.Equal(t, pc.LocalAddr().String(), servers[0].Addr)
+	assert.Equal(t, pc, servers[0].PacketConn)
+
+	assert.Equal(t, "tcp", servers[1].Net)
+	assert.Equal(t, l, servers[1].Listener)
+
+	// inherited listeners are not bound again
+	assert.NoError(t, bindListener(servers[0]))
+	assert.Equal(t, pc, servers[0].PacketConn)
+}
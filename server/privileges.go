@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// switches to passed user and group (name or ID), must be called after all listeners are bound. Without group,
+// the primary group of the user is used. Returns an error if the process could regain root privileges afterwards
+func dropPrivileges(userName, groupName string) error {
+	if userName == "" && groupName == "" {
+		return nil
+	}
+
+	uid, gid, err := lookupIDs(userName, groupName)
+	if err != nil {
+		return err
+	}
+
+	if os.Geteuid() == uid && os.Getegid() == gid {
+		logger().Infof("already running as user ID %d and group ID %d", uid, gid)
+		return nil
+	}
+
+	// supplementary groups of root must be removed first, requires root privileges
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("can't set supplementary groups: %v", err)
+	}
+
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("can't set group ID %d: %v", gid, err)
+	}
+
+	if userName != "" {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("can't set user ID %d: %v", uid, err)
+		}
+
+		if uid != 0 && (os.Geteuid() != uid || syscall.Setuid(0) == nil) {
+			return fmt.Errorf("user ID %d is not set for the whole process", uid)
+		}
+	}
+
+	if os.Getegid() != gid {
+		return fmt.Errorf("group ID %d is not set for the whole process", gid)
+	}
+
+	logger().Infof("dropped privileges, running as user ID %d and group ID %d", os.Geteuid(), os.Getegid())
+
+	return nil
+}
+
+// returns IDs of passed user and group, gid is the primary group of the user, if no group is passed
+func lookupIDs(userName, groupName string) (uid, gid int, err error) {
+	uid, gid = os.Getuid(), os.Getgid()
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return 0, 0, fmt.Errorf("unknown user '%s'", userName)
+			}
+		}
+
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("invalid user ID '%s'", u.Uid)
+		}
+
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return 0, 0, fmt.Errorf("invalid group ID '%s'", u.Gid)
+		}
+	}
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown group '%s'", groupName)
+			}
+		}
+
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("invalid group ID '%s'", g.Gid)
+		}
+	}
+
+	return uid, gid, nil
+}
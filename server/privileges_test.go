@@ -0,0 +1,43 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_lookupIDs(t *testing.T) {
+	uid, gid, err := lookupIDs("root", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, uid)
+	assert.Equal(t, 0, gid)
+
+	// IDs can be used instead of names
+	uid, gid, err = lookupIDs("0", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, uid)
+	assert.Equal(t, 0, gid)
+
+	// without user, the current user is kept
+	uid, _, err = lookupIDs("", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getuid(), uid)
+
+	_, _, err = lookupIDs("unknown-blocky-user", "")
+	assert.EqualError(t, err, "unknown user 'unknown-blocky-user'")
+
+	_, _, err = lookupIDs("root", "unknown-blocky-group")
+	assert.EqualError(t, err, "unknown group 'unknown-blocky-group'")
+}
+
+func Test_dropPrivileges(t *testing.T) {
+	// not configured
+	assert.NoError(t, dropPrivileges("", ""))
+
+	// already running as the user
+	assert.NoError(t, dropPrivileges(strconv.Itoa(os.Geteuid()), strconv.Itoa(os.Getegid())))
+
+	assert.Error(t, dropPrivileges("unknown-blocky-user", ""))
+}
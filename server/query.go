@@ -0,0 +1,89 @@
+package server
+
+import (
+	"blocky/api"
+	"blocky/resolver"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Query resolves the query of the API with the current resolver chain like a DNS request of the client. The client
+// can be an IP address or a client name (the IP address of the caller is used for the request in this case)
+func (s *Server) Query(ctx context.Context, query api.QueryRequest, callerIP net.IP) (api.QueryResult, error) {
+	qType, ok := dns.StringToType[query.Type]
+	if !ok {
+		return api.QueryResult{}, fmt.Errorf("unknown query type '%s'", query.Type)
+	}
+
+	name := dns.Fqdn(query.Name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return api.QueryResult{}, fmt.Errorf("invalid domain name '%s'", query.Name)
+	}
+
+	s.inFlight.Add(1)
+	defer s.inFlight.Done()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qType)
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	request := newRequest(ctx, callerIP, msg)
+
+	if ip := net.ParseIP(query.Client); ip != nil {
+		request.ClientIP = ip
+	} else if query.Client != "" {
+		request.ClientNames = []string{query.Client}
+		request.FixedClientNames = true
+	}
+
+	start := time.Now()
+	response, err := s.getResolver().Resolve(request)
+
+	clientNames := request.ClientNames
+	if clientNames == nil {
+		clientNames = []string{}
+	}
+
+	result := api.QueryResult{
+		Name:        name,
+		Type:        dns.TypeToString[qType],
+		ClientIP:    request.ClientIP.String(),
+		ClientNames: clientNames,
+		DurationMs:  time.Since(start).Milliseconds(),
+		Answers:     []api.QueryAnswer{},
+	}
+
+	if err != nil {
+		s.logResolveError(ctx, "error on processing API query", err)
+
+		result.ResponseCode = dns.RcodeToString[dns.RcodeServerFailure]
+		result.Error = err.Error()
+
+		return result, nil
+	}
+
+	result.ResponseCode = dns.RcodeToString[response.Res.Rcode]
+	result.Reason = response.Reason
+	result.ResponseType = response.Type().String()
+	result.Blocked = response.Type() == resolver.BLOCKED
+	result.Cached = response.Type() == resolver.CACHED
+	result.Upstream = response.Upstream
+
+	for _, rr := range response.Res.Answer {
+		result.Answers = append(result.Answers, api.QueryAnswer{
+			Name:  rr.Header().Name,
+			Type:  dns.TypeToString[rr.Header().Rrtype],
+			TTL:   rr.Header().Ttl,
+			Value: strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String())),
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"blocky/api"
+	"blocky/config"
+	"blocky/helpertest"
+	"blocky/resolver"
+	"blocky/util"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryAPI(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer(request.Question[0].Name + " 300 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	file := helpertest.TempFile("blocked.com")
+	defer os.Remove(file.Name())
+
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		ClientLookup: config.ClientLookupConfig{
+			Clients: map[string][]string{"192.168.1.5": {"laptop"}},
+		},
+		Blocking: config.BlockingConfig{
+			BlackLists:        map[string][]string{"ads": {file.Name()}},
+			ClientGroupsBlock: map[string][]string{"laptop": {"ads"}},
+		},
+		Port:     config.ListenConfig{"55578"},
+		HTTPPort: 55579,
+	}
+
+	server, err := NewServer(cfg)
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	query := func(method, params string, body []byte) (int, api.QueryResult) {
+		req, err := http.NewRequest(method, "http://127.0.0.1:55579"+api.PathQuery+params, bytes.NewReader(body))
+		assert.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		var result api.QueryResult
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		}
+
+		return resp.StatusCode, result
+	}
+
+	// caller is not in a blocking group
+	code, result := query(http.MethodGet, "?name=blocked.com", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "blocked.com.", result.Name)
+	assert.Equal(t, "A", result.Type)
+	assert.Equal(t, "127.0.0.1", result.ClientIP)
+	assert.Equal(t, "NOERROR", result.ResponseCode)
+	assert.Equal(t, "RESOLVED", result.ResponseType)
+	assert.False(t, result.Blocked)
+	assert.False(t, result.Cached)
+	assert.Equal(t, upstream.String(), result.Upstream)
+	assert.Equal(t, []api.QueryAnswer{{Name: "blocked.com.", Type: "A", TTL: 300, Value: "123.124.122.122"}},
+		result.Answers)
+
+	// answer from cache
+	_, result = query(http.MethodGet, "?name=blocked.com&type=a", nil)
+	assert.True(t, result.Cached)
+	assert.Equal(t, "CACHED", result.Reason)
+
+	// simulated client by IP and by name
+	_, result = query(http.MethodGet, "?name=blocked.com&client=192.168.1.5", nil)
+	assert.Equal(t, "192.168.1.5", result.ClientIP)
+	assert.Equal(t, []string{"laptop"}, result.ClientNames)
+	assert.True(t, result.Blocked)
+	assert.Equal(t, "BLOCKED (ads)", result.Reason)
+
+	_, result = query(http.MethodPost, "", []byte(`{"name":"blocked.com","type":"AAAA","client":"laptop"}`))
+	assert.Equal(t, "127.0.0.1", result.ClientIP)
+	assert.Equal(t, "AAAA", result.Type)
+	assert.True(t, result.Blocked)
+
+	code, _ = query(http.MethodGet, "?name=blocked.com&type=XYZ", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = query(http.MethodGet, "?name=in..valid", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
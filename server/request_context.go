@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// nolint:gochecknoglobals
+var canceledContext = func() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return ctx
+}()
+
+// requestContext is a context with deadline for DNS requests. The timer of the deadline is only created, if Done or
+// Err is called (e.g. for upstream requests): answers from cache don't need it, this saves allocations on the hot path
+type requestContext struct {
+	deadline time.Time
+	once     sync.Once
+	ctx      context.Context
+	cancelFn context.CancelFunc
+}
+
+func newRequestContext(timeout time.Duration) *requestContext {
+	return &requestContext{deadline: time.Now().Add(timeout)}
+}
+
+func (c *requestContext) init() {
+	c.once.Do(func() {
+		c.ctx, c.cancelFn = context.WithDeadline(context.Background(), c.deadline)
+	})
+}
+
+// cancel releases the timer, the context is canceled
+func (c *requestContext) cancel() {
+	c.once.Do(func() {
+		c.ctx = canceledContext
+	})
+
+	if c.cancelFn != nil {
+		c.cancelFn()
+	}
+}
+
+func (c *requestContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *requestContext) Done() <-chan struct{} {
+	c.init()
+
+	return c.ctx.Done()
+}
+
+func (c *requestContext) Err() error {
+	c.init()
+
+	return c.ctx.Err()
+}
+
+func (c *requestContext) Value(key interface{}) interface{} {
+	return nil
+}
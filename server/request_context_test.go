@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestContext(t *testing.T) {
+	ctx := newRequestContext(time.Minute)
+	defer ctx.cancel()
+
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	// timer is created on first use
+	assert.Nil(t, ctx.ctx)
+	assert.NoError(t, ctx.Err())
+	assert.NotNil(t, ctx.ctx)
+
+	ctx.cancel()
+
+	<-ctx.Done()
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestRequestContext_Deadline(t *testing.T) {
+	ctx := newRequestContext(10 * time.Millisecond)
+	defer ctx.cancel()
+
+	// derived contexts are canceled with the request context
+	child, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	select {
+	case <-child.Done():
+	case <-time.After(time.Second):
+		t.Fatal("deadline not reached")
+	}
+
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+	assert.Nil(t, ctx.Value("key"))
+}
+
+func TestRequestContext_CancelWithoutTimer(t *testing.T) {
+	ctx := newRequestContext(time.Minute)
+	ctx.cancel()
+
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
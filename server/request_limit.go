@@ -0,0 +1,104 @@
+package server
+
+import (
+	"blocky/metrics"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// max time a request waits for a free slot, if all slots are in use
+	overloadWaitTime = 100 * time.Millisecond
+	// initial size of pooled buffers for packed responses, larger responses get a new buffer
+	msgBufferSize = dns.DefaultMsgSize
+)
+
+// nolint:gochecknoglobals
+var msgBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, msgBufferSize)
+		return &b
+	},
+}
+
+// requestLimiter limits the number of concurrently processed requests. Nil limiter means unlimited
+type requestLimiter struct {
+	slots chan struct{}
+}
+
+func newRequestLimiter(maxConcurrentRequests uint) *requestLimiter {
+	if maxConcurrentRequests == 0 {
+		return nil
+	}
+
+	return &requestLimiter{slots: make(chan struct{}, maxConcurrentRequests)}
+}
+
+// acquires a slot for request processing, waits briefly if all slots are in use.
+// Returns false if no slot became free
+func (l *requestLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(overloadWaitTime)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// releases slot acquired with acquire
+func (l *requestLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// answers request, which exceeds the concurrency limit: UDP requests are dropped, TCP requests get SERVFAIL
+func onOverload(w dns.ResponseWriter, request *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		logger().Debug("too many concurrent requests, dropping UDP request")
+		metrics.RecordOverloadedQuery("drop")
+
+		return
+	}
+
+	logger().Debug("too many concurrent requests, answering with SERVFAIL")
+	metrics.RecordOverloadedQuery("servfail")
+
+	response := new(dns.Msg)
+	response.SetRcode(request, dns.RcodeServerFailure)
+
+	if err := writeMsg(w, response); err != nil {
+		logger().Error("can't write message: ", err)
+	}
+}
+
+// packs message into a pooled buffer and writes it, avoids the allocation of a new buffer per response
+func writeMsg(w dns.ResponseWriter, msg *dns.Msg) error {
+	buffer := msgBufferPool.Get().(*[]byte)
+	defer msgBufferPool.Put(buffer)
+
+	data, err := msg.PackBuffer(*buffer)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+
+	return err
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	sut := newRequestLimiter(2)
+
+	assert.True(t, sut.acquire())
+	assert.True(t, sut.acquire())
+
+	// all slots in use
+	assert.False(t, sut.acquire())
+
+	sut.release()
+	assert.True(t, sut.acquire())
+}
+
+func TestRequestLimiter_Unlimited(t *testing.T) {
+	sut := newRequestLimiter(0)
+	assert.Nil(t, sut)
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, sut.acquire())
+	}
+
+	sut.release()
+}
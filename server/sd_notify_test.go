@@ -0,0 +1,104 @@
+package server
+
+import (
+	"blocky/config"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// creates a notify socket and sets NOTIFY_SOCKET, returns the socket and a cleanup function
+func newNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "notify")
+	assert.NoError(t, err)
+
+	path := filepath.Join(dir, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.NoError(t, err)
+
+	os.Setenv("NOTIFY_SOCKET", path)
+
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+
+	return string(buf[:n])
+}
+
+func Test_sdNotify(t *testing.T) {
+	// without notify socket
+	assert.NoError(t, sdNotify(sdReady))
+
+	conn, cleanup := newNotifySocket(t)
+	defer cleanup()
+
+	assert.NoError(t, sdNotify(sdReady))
+	assert.Equal(t, "READY=1", readNotification(t, conn))
+
+	os.Setenv("NOTIFY_SOCKET", "/does/not/exist.sock")
+	assert.Error(t, sdNotify(sdReady))
+}
+
+func Test_watchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	assert.Equal(t, time.Duration(0), watchdogInterval())
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, watchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 30*time.Second, watchdogInterval())
+
+	// watchdog of another process
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	assert.Equal(t, time.Duration(0), watchdogInterval())
+}
+
+func TestServer_NotifyServiceManager(t *testing.T) {
+	conn, cleanup := newNotifySocket(t)
+	defer cleanup()
+
+	os.Setenv("WATCHDOG_USEC", "100000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	server, err := NewServer(&config.Config{
+		Port: config.ListenConfig{"55575"},
+	})
+	assert.NoError(t, err)
+
+	server.Start()
+
+	// ready after all listeners are started
+	assert.Equal(t, "READY=1", readNotification(t, conn))
+	assert.Equal(t, "WATCHDOG=1", readNotification(t, conn))
+
+	server.Stop()
+
+	// pending watchdog pings can be received before
+	for i := 0; i < 5; i++ {
+		if readNotification(t, conn) == "STOPPING=1" {
+			return
+		}
+	}
+
+	t.Error("STOPPING=1 was not received")
+}
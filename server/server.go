@@ -1,11 +1,23 @@
 package server
 
 import (
+	"blocky/api"
 	"blocky/config"
+	"blocky/lists"
+	"blocky/metrics"
 	"blocky/resolver"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"blocky/util"
 	"fmt"
@@ -15,10 +27,29 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	defaultPort            = 53
+	defaultShutdownTimeout = 5 * time.Second
+	defaultQueryTimeout    = 10 * time.Second
+)
+
 type Server struct {
-	udpServer     *dns.Server
-	tcpServer     *dns.Server
-	queryResolver resolver.Resolver
+	dnsServers      []*dns.Server
+	httpsServer     *http.Server
+	httpServer      *http.Server
+	metricsServer   *http.Server
+	queryResolver   resolver.Resolver
+	resolverLock    sync.RWMutex
+	inFlight        sync.WaitGroup
+	shutdownTimeout time.Duration
+	queryTimeout    time.Duration
+	access          *clientAccess
+	trustedProxies  []*net.IPNet
+	cfg             *config.Config
+	startTime       time.Time
+	limiter         *requestLimiter
+	// closed on shutdown, stops the watchdog pings
+	watchdogStop chan struct{}
 }
 
 func logger() *logrus.Entry {
@@ -26,148 +57,1135 @@ func logger() *logrus.Entry {
 }
 
 func NewServer(cfg *config.Config) (*Server, error) {
-	udpHandler := dns.NewServeMux()
-	tcpHandler := dns.NewServeMux()
-	udpServer := &dns.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Port),
+	if errs := cfg.Validate().Fatal(); len(errs) > 0 {
+		return nil, errs
+	}
+
+	bindIP, err := parseBindAddress(cfg.BindAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := resolveListenAddresses(cfg.Port, bindIP)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsServers := make([]*dns.Server, 0, 2*len(addresses))
+
+	// listeners passed by the service manager replace the configured DNS ports
+	packetConns, listeners, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(packetConns) > 0 || len(listeners) > 0 {
+		logger().Infof("using %d UDP and %d TCP listeners passed by the service manager", len(packetConns), len(listeners))
+
+		dnsServers = append(dnsServers, createInheritedServers(packetConns, listeners)...)
+	} else {
+		for _, address := range addresses {
+			dnsServers = append(dnsServers, createUDPServer(address), createTCPServer(address))
+		}
+	}
+
+	var httpsServer *http.Server
+
+	// certificate files are loaded if configured, DoT and DoH listeners are started only for configured ports
+	if cfg.CertFile != "" || cfg.KeyFile != "" || cfg.TLSPort > 0 || cfg.HTTPSPort > 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load certificate files '%s' and '%s': %v", cfg.CertFile, cfg.KeyFile, err)
+		}
+
+		if cfg.TLSPort > 0 {
+			dnsServers = append(dnsServers, createTLSServer(listenAddress(bindIP, cfg.TLSPort), cert))
+		}
+
+		if cfg.HTTPSPort > 0 {
+			httpsServer = createHTTPSServer(listenAddress(bindIP, cfg.HTTPSPort), cert)
+		}
+	}
+
+	var httpServer *http.Server
+
+	if cfg.HTTPPort > 0 {
+		httpServer = &http.Server{
+			Addr:    listenAddress(bindIP, cfg.HTTPPort),
+			Handler: http.NewServeMux(),
+		}
+	}
+
+	access, err := newClientAccess(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := util.ParseIPNets(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+
+	metricsServer := createMetricsServer(cfg, bindIP, httpServer)
+
+	queryResolver, err := createQueryResolver(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownTimeout := defaultShutdownTimeout
+	if cfg.ShutdownTimeout > 0 {
+		shutdownTimeout = time.Duration(cfg.ShutdownTimeout) * time.Second
+	}
+
+	queryTimeout := defaultQueryTimeout
+	if cfg.QueryTimeout > 0 {
+		queryTimeout = time.Duration(cfg.QueryTimeout) * time.Second
+	}
+
+	server := Server{
+		dnsServers:      dnsServers,
+		httpsServer:     httpsServer,
+		httpServer:      httpServer,
+		metricsServer:   metricsServer,
+		queryResolver:   queryResolver,
+		shutdownTimeout: shutdownTimeout,
+		queryTimeout:    queryTimeout,
+		access:          access,
+		trustedProxies:  trustedProxies,
+		cfg:             cfg,
+		startTime:       time.Now(),
+		limiter:         newRequestLimiter(cfg.MaxConcurrentRequests),
+	}
+
+	server.printConfiguration()
+
+	for _, dnsServer := range dnsServers {
+		handler := dnsServer.Handler.(*dns.ServeMux)
+		handler.HandleFunc(".", server.OnRequest)
+	}
+
+	if httpsServer != nil {
+		handler := httpsServer.Handler.(*http.ServeMux)
+		handler.HandleFunc(dohPath, server.OnDoHRequest)
+	}
+
+	if httpServer != nil {
+		api.RegisterEndpoint(httpServer.Handler.(*http.ServeMux), &server)
+		api.RegisterBlockingQueryEndpoint(httpServer.Handler.(*http.ServeMux), &server)
+		api.RegisterListsEndpoint(httpServer.Handler.(*http.ServeMux), &server)
+		api.RegisterListEntriesEndpoint(httpServer.Handler.(*http.ServeMux), &server)
+		api.RegisterCacheEndpoint(httpServer.Handler.(*http.ServeMux), &server)
+		api.RegisterClientNamesEndpoint(httpServer.Handler.(*http.ServeMux), &server)
+		api.RegisterStatusEndpoint(httpServer.Handler.(*http.ServeMux), &server)
+		api.RegisterStatsEndpoint(httpServer.Handler.(*http.ServeMux), &server)
+		api.RegisterQueryEndpoint(httpServer.Handler.(*http.ServeMux), &server)
+		api.RegisterHealthEndpoint(httpServer.Handler.(*http.ServeMux), &server, healthCheckTimeout)
+	}
+
+	return &server, nil
+}
+
+// enables metrics collection, if metrics port is configured. Metrics are served by the REST API listener,
+// if the ports are equal, otherwise the returned server should be started
+func createMetricsServer(cfg *config.Config, bindIP net.IP, httpServer *http.Server) *http.Server {
+	if cfg.MetricsPort == 0 {
+		return nil
+	}
+
+	metrics.Enable()
+
+	if httpServer != nil && cfg.MetricsPort == cfg.HTTPPort {
+		httpServer.Handler.(*http.ServeMux).Handle(metrics.Path, metrics.Handler())
+
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metrics.Path, metrics.Handler())
+
+	return &http.Server{
+		Addr:    listenAddress(bindIP, cfg.MetricsPort),
+		Handler: mux,
+	}
+}
+
+func createQueryResolver(cfg *config.Config) (resolver.Resolver, error) {
+	// lists are loaded first, no other resolver is created (and started) if the loading fails
+	blocking, err := resolver.NewBlockingResolver(cfg.Blocking)
+	if err != nil {
+		return nil, err
+	}
+
+	bootstrap, err := resolver.NewBootstrap(cfg.BootstrapDNS)
+	if err != nil {
+		stopResolvers(blocking)
+
+		return nil, err
+	}
+
+	// errors of constructors (e.g. not writable query log directory) are collected, the created resolvers are
+	// stopped on error
+	var errs []error
+
+	checked := func(r resolver.ChainedResolver, err error) resolver.Resolver {
+		if err != nil {
+			errs = append(errs, err)
+
+			return nil
+		}
+
+		return r
+	}
+
+	resolvers := map[string]resolver.Resolver{
+		"rateLimit":        checked(resolver.NewRateLimitingResolver(cfg.RateLimit)),
+		"clientNames":      resolver.NewClientNamesResolver(cfg.ClientLookup),
+		"upstreamGroup":    resolver.NewUpstreamGroupResolver(cfg.Upstream),
+		"queryLog":         checked(resolver.NewQueryLoggingResolver(cfg.QueryLog)),
+		"stats":            resolver.NewStatsResolver(cfg.QueryLog.ExcludedClients),
+		"queryTypeFilter":  checked(resolver.NewQueryTypeFilterResolver(cfg.QueryTypeFilter)),
+		"ednsClientSubnet": checked(resolver.NewEdnsClientSubnetResolver(cfg.EdnsClientSubnet)),
+		"ownNames":         resolver.NewOwnNamesResolver(cfg.OwnNames, listenIPs(cfg)),
+		"conditional":      resolver.NewConditionalUpstreamResolver(cfg.Conditional, bootstrap),
+		"customDNS":        resolver.NewCustomDNSResolver(cfg.CustomDNS),
+		"specialUseNames":  resolver.NewSpecialUseNamesResolver(cfg.SpecialUseNames),
+		"blocking":         blocking,
+		"caching":          resolver.NewCachingResolver(cfg.Caching),
+		"dedup":            resolver.NewDedupResolver(),
+		"dns64":            checked(resolver.NewDNS64Resolver(cfg.DNS64)),
+		"rebindProtection": checked(resolver.NewRebindProtectionResolver(cfg.RebindProtection)),
+		"dnssec":           checked(resolver.NewDNSSECResolver(cfg.ValidateDNSSEC)),
+	}
+
+	upstream, err := createUpstreamResolver(cfg.Upstream, cfg.UpstreamStrategy, bootstrap)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		stopResolvers(upstream)
+
+		for _, r := range resolvers {
+			stopResolvers(r)
+		}
+
+		return nil, errs[0]
+	}
+
+	order, added := cfg.EffectiveResolverOrder()
+	if len(added) > 0 {
+		logger().Warnf("resolvers %s are missing in the resolver order, they are inserted at their default position",
+			strings.Join(added, ", "))
+	}
+
+	chain := make([]resolver.Resolver, 0, len(order)+1)
+	for _, name := range order {
+		chain = append(chain, resolvers[name])
+	}
+
+	return resolver.Chain(append(chain, upstream)...), nil
+}
+
+// stops background tasks of passed resolvers, nil resolvers are ignored
+func stopResolvers(resolvers ...resolver.Resolver) {
+	for _, r := range resolvers {
+		if st, ok := r.(resolver.Stopper); ok {
+			st.Stop()
+		}
+	}
+}
+
+// returns the configured IPs of the DNS listeners, empty if blocky listens on all interfaces
+func listenIPs(cfg *config.Config) (result []net.IP) {
+	bindIP, err := parseBindAddress(cfg.BindAddress)
+	if err != nil {
+		return nil
+	}
+
+	addresses, err := resolveListenAddresses(cfg.Port, bindIP)
+	if err != nil {
+		return nil
+	}
+
+	for _, address := range addresses {
+		host, _, _ := net.SplitHostPort(address)
+
+		ip := net.ParseIP(host)
+		if ip == nil || ip.IsUnspecified() {
+			return nil
+		}
+
+		result = append(result, ip)
+	}
+
+	return result
+}
+
+// returns the current resolver chain
+func (s *Server) getResolver() resolver.Resolver {
+	s.resolverLock.RLock()
+	defer s.resolverLock.RUnlock()
+
+	return s.queryResolver
+}
+
+// Reload rebuilds the resolver chain with passed configuration and swaps it with the current one.
+// In-flight requests are finished with the old chain, cached entries are preserved unless the caching
+// configuration was changed.
+// Listener settings can't be changed without restart.
+func (s *Server) Reload(cfg *config.Config) {
+	logger().Info("reloading configuration")
+
+	if listenerConfigChanged(s.cfg, cfg) {
+		logger().Warn("listener configuration (ports, addresses, certificates, allowed clients, max concurrent " +
+			"requests) was changed, restart is required to apply")
+	}
+
+	// the current chain serves queries until the lists of the new chain are loaded
+	chainCfg := *cfg
+	if chainCfg.Blocking.StartStrategy == string(lists.StartStrategyFast) {
+		chainCfg.Blocking.StartStrategy = string(lists.StartStrategyBlocking)
+	}
+
+	newResolver, err := createQueryResolver(&chainCfg)
+	if err != nil {
+		logger().Errorf("can't reload configuration, keeping current configuration: %v", err)
+		return
+	}
+
+	s.resolverLock.Lock()
+	oldResolver := s.queryResolver
+
+	if newCache := findCachingResolver(newResolver); newCache != nil {
+		if oldCache := findCachingResolver(oldResolver); oldCache != nil {
+			if reflect.DeepEqual(s.cfg.Caching, cfg.Caching) {
+				newCache.ShareCache(oldCache)
+			} else {
+				logger().Info("caching configuration was changed, cache was reset")
+			}
+		}
+	}
+
+	if newConditional := findConditionalResolver(newResolver); newConditional != nil {
+		if oldConditional := findConditionalResolver(oldResolver); oldConditional != nil {
+			newConditional.ShareCache(oldConditional)
+		}
+	}
+
+	if newStats := findStatsResolver(newResolver); newStats != nil {
+		if oldStats := findStatsResolver(oldResolver); oldStats != nil {
+			newStats.ShareStats(oldStats)
+		}
+	}
+
+	if newBlocking := findBlockingResolver(newResolver); newBlocking != nil {
+		if oldBlocking := findBlockingResolver(oldResolver); oldBlocking != nil {
+			newBlocking.ShareStatus(oldBlocking)
+		}
+	}
+
+	s.queryResolver = newResolver
+	s.cfg = cfg
+	s.resolverLock.Unlock()
+
+	s.printConfiguration()
+
+	// stop background tasks of the old chain after in-flight requests are finished
+	go func() {
+		time.Sleep(s.shutdownTimeout)
+		resolver.ForEach(oldResolver, func(res resolver.Resolver) {
+			if st, ok := res.(resolver.Stopper); ok {
+				st.Stop()
+			}
+		})
+	}()
+}
+
+// reloads configuration from file, keeps current configuration on error
+func (s *Server) reloadFromFile() {
+	cfg, err := config.LoadConfig(s.cfg.Path())
+	if err != nil {
+		logger().Errorf("can't reload configuration, keeping current configuration: %v", err)
+		return
+	}
+
+	if errs := cfg.Validate().Fatal(); len(errs) > 0 {
+		logger().Errorf("can't reload configuration, keeping current configuration: %v", errs)
+		return
+	}
+
+	s.Reload(&cfg)
+}
+
+func findCachingResolver(r resolver.Resolver) (result *resolver.CachingResolver) {
+	resolver.ForEach(r, func(res resolver.Resolver) {
+		if c, ok := res.(*resolver.CachingResolver); ok {
+			result = c
+		}
+	})
+
+	return
+}
+
+func findConditionalResolver(r resolver.Resolver) (result *resolver.ConditionalUpstreamResolver) {
+	resolver.ForEach(r, func(res resolver.Resolver) {
+		if c, ok := res.(*resolver.ConditionalUpstreamResolver); ok {
+			result = c
+		}
+	})
+
+	return
+}
+
+func findStatsResolver(r resolver.Resolver) (result *resolver.StatsResolver) {
+	resolver.ForEach(r, func(res resolver.Resolver) {
+		if st, ok := res.(*resolver.StatsResolver); ok {
+			result = st
+		}
+	})
+
+	return
+}
+
+func findBlockingResolver(r resolver.Resolver) (result *resolver.BlockingResolver) {
+	resolver.ForEach(r, func(res resolver.Resolver) {
+		if b, ok := res.(*resolver.BlockingResolver); ok {
+			result = b
+		}
+	})
+
+	return
+}
+
+// EnableBlocking enables blocking of the current resolver chain
+func (s *Server) EnableBlocking() {
+	if b := findBlockingResolver(s.getResolver()); b != nil {
+		b.EnableBlocking()
+	}
+}
+
+// DisableBlocking disables blocking of the current resolver chain
+func (s *Server) DisableBlocking(duration time.Duration) {
+	if b := findBlockingResolver(s.getResolver()); b != nil {
+		b.DisableBlocking(duration)
+	}
+}
+
+// BlockingStatus returns the blocking state of the current resolver chain
+func (s *Server) BlockingStatus() api.BlockingStatus {
+	if b := findBlockingResolver(s.getResolver()); b != nil {
+		return b.BlockingStatus()
+	}
+
+	return api.BlockingStatus{}
+}
+
+// ExplainBlocking checks the domain against the black and white lists of the current resolver chain
+func (s *Server) ExplainBlocking(domain string, client string) api.BlockingExplanation {
+	if b := findBlockingResolver(s.getResolver()); b != nil {
+		return b.ExplainBlocking(domain, client)
+	}
+
+	return api.BlockingExplanation{Domain: domain, Client: client, Reason: "NOT LISTED"}
+}
+
+// RefreshLists triggers reload of black and white lists of the current resolver chain
+func (s *Server) RefreshLists() {
+	if b := findBlockingResolver(s.getResolver()); b != nil {
+		b.RefreshLists()
+	}
+}
+
+// AddListEntry adds entry to the black or white list of the current resolver chain
+func (s *Server) AddListEntry(listType string, group string, domain string) error {
+	if b := findBlockingResolver(s.getResolver()); b != nil {
+		return b.AddListEntry(listType, group, domain)
+	}
+
+	return errors.New("blocking is not configured")
+}
+
+// RemoveListEntry removes runtime entry from the black or white list of the current resolver chain
+func (s *Server) RemoveListEntry(listType string, group string, domain string) bool {
+	if b := findBlockingResolver(s.getResolver()); b != nil {
+		return b.RemoveListEntry(listType, group, domain)
+	}
+
+	return false
+}
+
+// ListEntries returns runtime entries of the black or white list of the current resolver chain
+func (s *Server) ListEntries(listType string) map[string][]string {
+	if b := findBlockingResolver(s.getResolver()); b != nil {
+		return b.ListEntries(listType)
+	}
+
+	return map[string][]string{}
+}
+
+// FlushCache removes entries from the cache and the cache of conditional answers of the current resolver chain
+func (s *Server) FlushCache(domain string) (count int) {
+	resolver.ForEach(s.getResolver(), func(res resolver.Resolver) {
+		switch c := res.(type) {
+		case *resolver.CachingResolver:
+			count += c.FlushCache(domain)
+		case *resolver.ConditionalUpstreamResolver:
+			count += c.FlushCache(domain)
+		}
+	})
+
+	return
+}
+
+// FlushClientNames removes all cached client names of the current resolver chain
+func (s *Server) FlushClientNames() (count int) {
+	resolver.ForEach(s.getResolver(), func(res resolver.Resolver) {
+		if c, ok := res.(*resolver.ClientNamesResolver); ok {
+			count = c.FlushCache()
+		}
+	})
+
+	return
+}
+
+// Stats returns the query statistics of the current resolver chain
+func (s *Server) Stats() api.Stats {
+	if st := findStatsResolver(s.getResolver()); st != nil {
+		return st.Stats()
+	}
+
+	return api.Stats{}
+}
+
+// Status returns the current state: resolver chain with configuration, blocking state, lists, cache and upstreams
+func (s *Server) Status() api.Status {
+	status := api.Status{
+		StartTime: s.startTime,
+		UptimeSec: uint64(time.Since(s.startTime).Seconds()),
+		Blocking:  s.BlockingStatus(),
+	}
+
+	resolver.ForEach(s.getResolver(), func(res resolver.Resolver) {
+		status.Resolvers = append(status.Resolvers, api.ResolverStatus{
+			Name:          fmt.Sprint(res),
+			Configuration: res.Configuration(),
+		})
+
+		switch r := res.(type) {
+		case *resolver.BlockingResolver:
+			status.Lists = r.ListStatus()
+		case *resolver.CachingResolver:
+			status.CacheEntries = r.CacheEntries()
+		}
+
+		if r, ok := res.(resolver.UpstreamStatusReporter); ok {
+			status.Upstreams = append(status.Upstreams, r.UpstreamStatus()...)
+		}
+	})
+
+	return status
+}
+
+func listenerConfigChanged(oldCfg, newCfg *config.Config) bool {
+	return !reflect.DeepEqual(oldCfg.Port, newCfg.Port) ||
+		oldCfg.BindAddress != newCfg.BindAddress ||
+		oldCfg.TLSPort != newCfg.TLSPort ||
+		oldCfg.HTTPSPort != newCfg.HTTPSPort ||
+		oldCfg.HTTPPort != newCfg.HTTPPort ||
+		oldCfg.MetricsPort != newCfg.MetricsPort ||
+		oldCfg.CertFile != newCfg.CertFile ||
+		oldCfg.KeyFile != newCfg.KeyFile ||
+		!reflect.DeepEqual(oldCfg.AllowedClients, newCfg.AllowedClients) ||
+		oldCfg.DisallowedClientAction != newCfg.DisallowedClientAction ||
+		!reflect.DeepEqual(oldCfg.TrustedProxies, newCfg.TrustedProxies) ||
+		oldCfg.MaxConcurrentRequests != newCfg.MaxConcurrentRequests
+}
+
+// parses and validates the configured bind address, empty address means all interfaces
+func parseBindAddress(bindAddress string) (net.IP, error) {
+	bindAddress = strings.Trim(strings.TrimSpace(bindAddress), "[]")
+	if bindAddress == "" {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(bindAddress)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid bind address '%s', please use an IPv4 or IPv6 address", bindAddress)
+	}
+
+	if ip.IsUnspecified() {
+		return ip, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("can't list interface addresses: %v", err)
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return ip, nil
+		}
+	}
+
+	return nil, fmt.Errorf("bind address '%s' is not assignable, no local interface has this address", bindAddress)
+}
+
+// returns address in format host:port, host is empty if no bind IP is defined
+func listenAddress(bindIP net.IP, port uint16) string {
+	host := ""
+	if bindIP != nil {
+		host = bindIP.String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// returns listen addresses (host:port) for passed entries in format [host:]port,
+// entries without host will use the bind IP
+func resolveListenAddresses(entries config.ListenConfig, bindIP net.IP) ([]string, error) {
+	if len(entries) == 0 {
+		entries = config.ListenConfig{strconv.Itoa(defaultPort)}
+	}
+
+	addresses := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		host, portString := "", entry
+
+		if strings.Contains(entry, ":") {
+			var err error
+			if host, portString, err = net.SplitHostPort(entry); err != nil {
+				return nil, fmt.Errorf("invalid listen address '%s': %v", entry, err)
+			}
+		}
+
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in listen address '%s'", entry)
+		}
+
+		ip := bindIP
+
+		if host != "" {
+			if ip, err = parseBindAddress(host); err != nil {
+				return nil, err
+			}
+		}
+
+		addresses = append(addresses, listenAddress(ip, uint16(port)))
+	}
+
+	return addresses, nil
+}
+
+func createUDPServer(address string) *dns.Server {
+	return &dns.Server{
+		Addr:    address,
 		Net:     "udp",
-		Handler: udpHandler,
+		Handler: dns.NewServeMux(),
 		NotifyStartedFunc: func() {
-			logger().Infof("udp server is up and running")
+			logger().Infof("udp server is up and running on %s", address)
 		},
 		UDPSize: 65535}
-	tcpServer := &dns.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Port),
+}
+
+func createTCPServer(address string) *dns.Server {
+	return &dns.Server{
+		Addr:    address,
 		Net:     "tcp",
-		Handler: tcpHandler,
+		Handler: dns.NewServeMux(),
 		NotifyStartedFunc: func() {
-			logger().Infof("tcp server is up and running")
+			logger().Infof("tcp server is up and running on %s", address)
 		},
 	}
+}
 
-	queryResolver := resolver.Chain(
-		resolver.NewClientNamesResolver(cfg.ClientLookup),
-		resolver.NewQueryLoggingResolver(cfg.QueryLog),
-		resolver.NewStatsResolver(),
-		resolver.NewConditionalUpstreamResolver(cfg.Conditional),
-		resolver.NewCustomDNSResolver(cfg.CustomDNS),
-		resolver.NewBlockingResolver(cfg.Blocking),
-		resolver.NewCachingResolver(),
-		createParallelUpstreamResolver(cfg.Upstream.ExternalResolvers),
-	)
-
-	server := Server{
-		udpServer:     udpServer,
-		tcpServer:     tcpServer,
-		queryResolver: queryResolver,
+// creates DNS-over-TLS server with passed certificate
+func createTLSServer(address string, cert tls.Certificate) *dns.Server {
+	return &dns.Server{
+		Addr: address,
+		Net:  "tcp-tls",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+		Handler: dns.NewServeMux(),
+		NotifyStartedFunc: func() {
+			logger().Infof("tcp-tls server is up and running on %s", address)
+		},
 	}
+}
 
-	server.printConfiguration()
-
-	udpHandler.HandleFunc(".", server.OnRequest)
-	tcpHandler.HandleFunc(".", server.OnRequest)
-
-	return &server, nil
+// creates DNS-over-HTTPS server with passed certificate
+func createHTTPSServer(address string, cert tls.Certificate) *http.Server {
+	return &http.Server{
+		Addr: address,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+		Handler: http.NewServeMux(),
+	}
 }
 
 func (s *Server) printConfiguration() {
 	logger().Info("current configuration:")
 
-	res := s.queryResolver
-	for res != nil {
+	resolver.ForEach(s.getResolver(), func(res resolver.Resolver) {
 		logger().Infof("-> resolver: '%s'", res)
 
 		for _, c := range res.Configuration() {
 			logger().Infof("     %s", c)
 		}
+	})
+}
 
-		if c, ok := res.(resolver.ChainedResolver); ok {
-			res = c.GetNext()
-		} else {
-			break
-		}
+func (s *Server) printStats() {
+	if st := findStatsResolver(s.getResolver()); st != nil {
+		st.PrintStats()
+	}
+}
+
+// creates resolver for external upstreams with passed strategy: "parallel_best" (default), "random" or "strict".
+// If upstream groups are configured, each group gets its own resolver
+func createUpstreamResolver(cfg config.UpstreamConfig, strategy string,
+	bootstrap *resolver.Bootstrap) (resolver.Resolver, error) {
+	switch strategy {
+	case "", "parallel_best", "random", "strict":
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy '%s'", strategy)
 	}
+
+	if len(cfg.Groups) == 0 {
+		return createGroupResolver(cfg.ExternalResolvers, cfg.HealthCheck, strategy, bootstrap), nil
+	}
+
+	groups := map[string]resolver.Resolver{
+		"default": createGroupResolver(cfg.ExternalResolvers, cfg.HealthCheck, strategy, bootstrap),
+	}
+
+	for name, upstreams := range cfg.Groups {
+		groups[name] = createGroupResolver(upstreams, cfg.HealthCheck, strategy, bootstrap)
+	}
+
+	return resolver.NewGroupedUpstreamResolver(groups), nil
 }
 
-func createParallelUpstreamResolver(upstream []config.Upstream) resolver.Resolver {
-	if len(upstream) == 1 {
-		return resolver.NewUpstreamResolver(upstream[0])
+// creates resolver for the upstreams of one group
+func createGroupResolver(upstreams []config.Upstream, healthCheck config.HealthCheckConfig, strategy string,
+	bootstrap *resolver.Bootstrap) resolver.Resolver {
+	if len(upstreams) == 1 {
+		return resolver.NewUpstreamResolver(upstreams[0], bootstrap)
 	}
 
-	resolvers := make([]resolver.Resolver, len(upstream))
+	if strategy == "strict" {
+		return resolver.NewFailoverResolver(upstreams, bootstrap)
+	}
+
+	resolvers := make([]resolver.Resolver, len(upstreams))
+
+	for i, u := range upstreams {
+		resolvers[i] = resolver.NewUpstreamResolver(u, bootstrap)
+	}
 
-	for i, u := range upstream {
-		resolvers[i] = resolver.NewUpstreamResolver(u)
+	if strategy == "random" {
+		return resolver.NewRandomResolver(resolvers)
 	}
 
-	return resolver.NewParallelBestResolver(resolvers)
+	return resolver.NewParallelBestResolver(resolvers, healthCheck)
 }
 
 func (s *Server) Start() {
 	logger().Info("Starting server")
 
-	go func() {
-		if err := s.udpServer.ListenAndServe(); err != nil {
-			logger().Fatalf("start %s listener failed: %v", s.udpServer.Net, err)
+	// bind all listeners first: startup is aborted if any listener can't be bound
+	for _, srv := range s.dnsServers {
+		if err := bindListener(srv); err != nil {
+			logger().Fatalf("start %s listener on %s failed: %v", srv.Net, srv.Addr, err)
 		}
-	}()
+	}
+
+	var httpsListener net.Listener
+
+	if s.httpsServer != nil {
+		var err error
+		if httpsListener, err = net.Listen("tcp", s.httpsServer.Addr); err != nil {
+			logger().Fatalf("start https listener on %s failed: %v", s.httpsServer.Addr, err)
+		}
+	}
+
+	var httpListener net.Listener
+
+	if s.httpServer != nil {
+		var err error
+		if httpListener, err = net.Listen("tcp", s.httpServer.Addr); err != nil {
+			logger().Fatalf("start http listener on %s failed: %v", s.httpServer.Addr, err)
+		}
+	}
+
+	var metricsListener net.Listener
+
+	if s.metricsServer != nil {
+		var err error
+		if metricsListener, err = net.Listen("tcp", s.metricsServer.Addr); err != nil {
+			logger().Fatalf("start metrics listener on %s failed: %v", s.metricsServer.Addr, err)
+		}
+	}
+
+	// all ports are bound -> root privileges are not needed anymore
+	if err := dropPrivileges(s.cfg.User, s.cfg.Group); err != nil {
+		logger().Fatalf("can't drop privileges to user '%s' and group '%s': %v", s.cfg.User, s.cfg.Group, err)
+	}
+
+	s.notifyReadyOnStart()
+
+	for _, srv := range s.dnsServers {
+		go func(srv *dns.Server) {
+			if err := srv.ActivateAndServe(); err != nil {
+				logger().Fatalf("start %s listener on %s failed: %v", srv.Net, srv.Addr, err)
+			}
+		}(srv)
+	}
+
+	if s.httpsServer != nil {
+		go func() {
+			logger().Infof("https server is up and running on %s", s.httpsServer.Addr)
+
+			if err := s.httpsServer.ServeTLS(httpsListener, "", ""); err != http.ErrServerClosed {
+				logger().Fatalf("start https listener on %s failed: %v", s.httpsServer.Addr, err)
+			}
+		}()
+	}
+
+	if s.httpServer != nil {
+		go func() {
+			logger().Infof("http server is up and running on %s", s.httpServer.Addr)
+
+			if err := s.httpServer.Serve(httpListener); err != http.ErrServerClosed {
+				logger().Fatalf("start http listener on %s failed: %v", s.httpServer.Addr, err)
+			}
+		}()
+	}
+
+	if s.metricsServer != nil {
+		go func() {
+			logger().Infof("metrics server is up and running on %s", s.metricsServer.Addr)
+
+			if err := s.metricsServer.Serve(metricsListener); err != http.ErrServerClosed {
+				logger().Fatalf("start metrics listener on %s failed: %v", s.metricsServer.Addr, err)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGHUP)
 
 	go func() {
-		if err := s.tcpServer.ListenAndServe(); err != nil {
-			logger().Fatalf("start %s listener failed: %v", s.tcpServer.Net, err)
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				s.reloadFromFile()
+			} else {
+				s.printConfiguration()
+				s.printStats()
+			}
 		}
 	}()
+}
+
+// creates network listener for the passed DNS server
+func bindListener(srv *dns.Server) error {
+	if srv.PacketConn != nil || srv.Listener != nil {
+		// already bound, e.g. passed by the service manager
+		return nil
+	}
+
+	switch srv.Net {
+	case "udp":
+		pc, err := net.ListenPacket("udp", srv.Addr)
+		if err != nil {
+			return err
+		}
+
+		srv.PacketConn = pc
+	case "tcp", "tcp-tls":
+		l, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			return err
+		}
+
+		if srv.Net == "tcp-tls" {
+			l = tls.NewListener(l, srv.TLSConfig)
+		}
+
+		srv.Listener = l
+	default:
+		return fmt.Errorf("unsupported network '%s'", srv.Net)
+	}
 
-	signals := make(chan os.Signal)
-	signal.Notify(signals, syscall.SIGUSR1)
+	return nil
+}
+
+// notifies the service manager, after all DNS listeners are started, and starts the watchdog pings, if enabled
+func (s *Server) notifyReadyOnStart() {
+	var started sync.WaitGroup
+
+	started.Add(len(s.dnsServers))
+
+	for _, srv := range s.dnsServers {
+		notifyStarted := srv.NotifyStartedFunc
+		srv.NotifyStartedFunc = func() {
+			if notifyStarted != nil {
+				notifyStarted()
+			}
+
+			started.Done()
+		}
+	}
+
+	s.watchdogStop = make(chan struct{})
 
 	go func() {
-		for {
-			<-signals
-			s.printConfiguration()
+		started.Wait()
+
+		if err := sdNotify(sdReady); err != nil {
+			logger().Warnf("can't notify service manager: %v", err)
+		}
+
+		if interval := watchdogInterval(); interval > 0 {
+			logger().Infof("sending watchdog pings every %s", interval/2)
+
+			go sendWatchdogPings(interval, s.watchdogStop)
 		}
 	}()
 }
 
+// Stop stops all listeners, waits for in-flight queries (until the shutdown timeout is reached)
+// and flushes buffered data (e.g. query log)
 func (s *Server) Stop() {
 	logger().Info("Stopping server")
 
-	if err := s.udpServer.Shutdown(); err != nil {
-		logger().Fatalf("stop %s listener failed: %v", s.udpServer.Net, err)
+	if err := sdNotify(sdStopping); err != nil {
+		logger().Warnf("can't notify service manager: %v", err)
+	}
+
+	if s.watchdogStop != nil {
+		close(s.watchdogStop)
+		s.watchdogStop = nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	for _, srv := range s.dnsServers {
+		if err := srv.ShutdownContext(ctx); err != nil {
+			logger().Errorf("stop %s listener on %s failed: %v", srv.Net, srv.Addr, err)
+		}
+	}
+
+	if s.httpsServer != nil {
+		if err := s.httpsServer.Shutdown(ctx); err != nil {
+			logger().Errorf("stop https listener failed: %v", err)
+		}
+	}
+
+	if s.httpServer != nil {
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			logger().Errorf("stop http listener failed: %v", err)
+		}
+	}
+
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			logger().Errorf("stop metrics listener failed: %v", err)
+		}
 	}
 
-	if err := s.tcpServer.Shutdown(); err != nil {
-		logger().Fatalf("stop %s listener failed: %v", s.tcpServer.Net, err)
+	inFlightDone := make(chan struct{})
+
+	go func() {
+		s.inFlight.Wait()
+		close(inFlightDone)
+	}()
+
+	select {
+	case <-inFlightDone:
+		logger().Debug("all in-flight queries finished")
+	case <-ctx.Done():
+		logger().Warn("shutdown timeout reached, in-flight queries will be aborted")
 	}
+
+	resolver.ForEach(s.getResolver(), func(res resolver.Resolver) {
+		if f, ok := res.(resolver.Flusher); ok {
+			f.Flush(s.shutdownTimeout)
+		}
+	})
 }
 
 func (s *Server) OnRequest(w dns.ResponseWriter, request *dns.Msg) {
-	logger().Debug("new request")
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		logger().Debug("new request")
+	}
+
+	s.inFlight.Add(1)
+	defer s.inFlight.Done()
 
 	clientIP := resolveClientIP(w.RemoteAddr())
-	r := &resolver.Request{
-		ClientIP: clientIP,
-		Req:      request,
-		Log: logrus.WithFields(logrus.Fields{
-			"question":  util.QuestionToString(request.Question),
-			"client_ip": clientIP,
-		}),
+
+	if !s.access.isAllowed(clientIP) {
+		if !s.access.drop {
+			refused := new(dns.Msg)
+			refused.SetRcode(request, dns.RcodeRefused)
+
+			if err := writeMsg(w, refused); err != nil {
+				logger().Error("can't write message: ", err)
+			}
+		}
+
+		return
 	}
 
-	response, err := s.queryResolver.Resolve(r)
+	if rejected := rejectUnsupported(request); rejected != nil {
+		if err := writeMsg(w, rejected); err != nil {
+			logger().Error("can't write message: ", err)
+		}
+
+		return
+	}
+
+	if !s.limiter.acquire() {
+		onOverload(w, request)
+		return
+	}
+	defer s.limiter.release()
+
+	ctx := newRequestContext(s.queryTimeout)
+	defer ctx.cancel()
+
+	response, err := s.getResolver().Resolve(newRequest(ctx, clientIP, request))
+	recordQuery(request, response, err)
 
 	if err != nil {
-		logger().Errorf("error on processing request: %v", err)
+		s.logResolveError(ctx, "error on processing request", err)
 		dns.HandleFailed(w, request)
 	} else {
 		response.Res.MsgHdr.RecursionAvailable = request.MsgHdr.RecursionDesired
 
-		if err := w.WriteMsg(response.Res); err != nil {
+		if err := writeMsg(w, truncateForClient(w, request, response.Res)); err != nil {
 			logger().Error("can't write message: ", err)
 		}
 	}
 }
 
+// truncates UDP answers to the EDNS buffer size of the client (512 bytes without EDNS) and sets the TC flag, the client
+// retries over TCP. The answer is copied, it can be shared with the cache
+func truncateForClient(w dns.ResponseWriter, request, response *dns.Msg) *dns.Msg {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return response
+	}
+
+	size := dns.MinMsgSize
+	// values below 512 bytes are treated as 512 (RFC 6891)
+	if opt := request.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+
+	if response.Len() <= size {
+		return response
+	}
+
+	truncated := response.Copy()
+	truncated.Truncate(size)
+
+	if truncated.Truncated {
+		logger().WithField("question", util.QuestionToString(request.Question)).
+			Debugf("answer exceeds UDP buffer size of client (%d bytes), sending truncated answer", size)
+	}
+
+	return truncated
+}
+
+// returns answer for requests, which are not forwarded to the resolver chain: NOTIMP for other opcodes than QUERY,
+// REFUSED for zone transfers and FORMERR for messages without question. Returns nil for regular queries.
+// Rejected requests are logged only on debug level, they are often sent by scanners
+func rejectUnsupported(request *dns.Msg) *dns.Msg {
+	var rcode int
+
+	var reason string
+
+	switch {
+	case request.Opcode != dns.OpcodeQuery:
+		rcode, reason = dns.RcodeNotImplemented, "opcode"
+	case len(request.Question) == 0:
+		rcode, reason = dns.RcodeFormatError, "no_question"
+	case request.Question[0].Qtype == dns.TypeAXFR || request.Question[0].Qtype == dns.TypeIXFR:
+		rcode, reason = dns.RcodeRefused, "zone_transfer"
+	default:
+		return nil
+	}
+
+	logger().WithFields(logrus.Fields{
+		"opcode":   dns.OpcodeToString[request.Opcode],
+		"question": util.QuestionToString(request.Question),
+	}).Debugf("unsupported request, answering with %s", dns.RcodeToString[rcode])
+
+	metrics.RecordRejectedQuery(reason)
+
+	response := new(dns.Msg)
+	response.SetRcode(request, rcode)
+
+	return response
+}
+
+// counts processed query for metrics, failed resolution is counted as SERVFAIL
+func recordQuery(request *dns.Msg, response *resolver.Response, err error) {
+	if !metrics.IsEnabled() || len(request.Question) == 0 {
+		return
+	}
+
+	rcode := dns.RcodeServerFailure
+	if err == nil && response != nil && response.Res != nil {
+		rcode = response.Res.Rcode
+	}
+
+	metrics.RecordQuery(dns.TypeToString[request.Question[0].Qtype], dns.RcodeToString[rcode])
+}
+
+// logs failed resolution, exceeded query deadline is logged separately
+func (s *Server) logResolveError(ctx context.Context, msg string, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		logger().Warnf("%s: query deadline of %s exceeded: %v", msg, s.queryTimeout, err)
+		return
+	}
+
+	logger().Errorf("%s: %v", msg, err)
+}
+
+// logger of requests without debug level
+// nolint:gochecknoglobals
+var requestLog = logrus.NewEntry(logrus.StandardLogger())
+
+func newRequest(ctx context.Context, clientIP net.IP, request *dns.Msg) *resolver.Request {
+	// request fields are only added for debug messages, to keep the hot path free of allocations. Resolvers add them
+	// to messages above debug level
+	log := requestLog
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		log = logrus.WithFields(logrus.Fields{
+			"question":  util.QuestionToString(request.Question),
+			"client_ip": clientIP,
+		})
+	}
+
+	return &resolver.Request{
+		ClientIP: clientIP,
+		Req:      request,
+		Ctx:      ctx,
+		Log:      log,
+	}
+}
+
 func resolveClientIP(addr net.Addr) net.IP {
 	var clientIP net.IP
 	if t, ok := addr.(*net.UDPAddr); ok {
@@ -1,16 +1,28 @@
 package server
 
 import (
+	"blocky/api"
 	"blocky/config"
+	"blocky/helpertest"
+	"blocky/metrics"
 	"blocky/resolver"
 	"blocky/util"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -185,13 +197,13 @@ func TestDnsRequest(t *testing.T) {
 	// create server
 	server, err := NewServer(&config.Config{
 		CustomDNS: config.CustomDNSConfig{
-			Mapping: map[string]net.IP{
-				"custom.lan": net.ParseIP("192.168.178.55"),
-				"lan.home":   net.ParseIP("192.168.178.56"),
+			Mapping: map[string]config.CustomDNSEntries{
+				"custom.lan": {"A 192.168.178.55"},
+				"lan.home":   {"A 192.168.178.56"},
 			},
 		},
 		Conditional: config.ConditionalUpstreamConfig{
-			Mapping: map[string]config.Upstream{"fritz.box": upstreamFritzbox},
+			Mapping: map[string]config.ConditionalMapping{"fritz.box": {Upstreams: config.Upstreams{upstreamFritzbox}}},
 		},
 		Blocking: config.BlockingConfig{
 			BlackLists: map[string][]string{
@@ -218,7 +230,7 @@ func TestDnsRequest(t *testing.T) {
 			Upstream: upstreamClient,
 		},
 
-		Port: 55555,
+		Port: config.ListenConfig{"55555"},
 	})
 
 	assert.NoError(t, err)
@@ -256,6 +268,94 @@ func TestDnsRequest(t *testing.T) {
 	}
 }
 
+func TestDnsOverTLSRequest(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer(fmt.Sprintf("%s %d %s %s %s",
+			util.ExtractDomain(request.Question[0]), 123, "IN", "A", "123.124.122.122"))
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	server, err := NewServer(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port:     config.ListenConfig{"55556"},
+		TLSPort:  55853,
+		CertFile: "../testdata/cert.pem",
+		KeyFile:  "../testdata/key.pem",
+	})
+
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+	}
+
+	response, _, err := client.Exchange(util.NewMsgWithQuestion("google.de.", dns.TypeA), "127.0.0.1:55853")
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, response.Rcode)
+	assert.Equal(t, "google.de.\t250\tIN\tA\t123.124.122.122", response.Answer[0].String())
+}
+
+func TestNewServer_DoTOnlyWithTLSPort(t *testing.T) {
+	server, err := NewServer(&config.Config{
+		Port:      config.ListenConfig{"55556"},
+		HTTPSPort: 55444,
+		CertFile:  "../testdata/cert.pem",
+		KeyFile:   "../testdata/key.pem",
+	})
+	assert.NoError(t, err)
+
+	// DoH doesn't open a DoT listener on the default port
+	assert.NotNil(t, server.httpsServer)
+
+	for _, s := range server.dnsServers {
+		assert.NotEqual(t, "tcp-tls", s.Net)
+	}
+}
+
+func TestNewServer_InvalidCertificate(t *testing.T) {
+	_, err := NewServer(&config.Config{
+		Port:     config.ListenConfig{"55556"},
+		CertFile: "../testdata/doesnotexist.pem",
+		KeyFile:  "../testdata/key.pem",
+	})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "can't load certificate files")
+}
+
+func TestNewServer_InvalidConfiguration(t *testing.T) {
+	_, err := NewServer(&config.Config{
+		Port:             config.ListenConfig{"55556"},
+		UpstreamStrategy: "fastest",
+	})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "upstreamStrategy: unknown value 'fastest'")
+}
+
+func TestNewServer_ListLoadingFailed(t *testing.T) {
+	_, err := NewServer(&config.Config{
+		Port: config.ListenConfig{"55573"},
+		Blocking: config.BlockingConfig{
+			BlackLists:    map[string][]string{"ads": {"/does/not/exist.txt"}},
+			StartStrategy: "failOnError",
+		},
+	})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "can't load list '/does/not/exist.txt'")
+}
+
 func BenchmarkServerExternalResolver(b *testing.B) {
 	upstreamExternal := resolver.TestUDPUpstream(func(request *dns.Msg) (response *dns.Msg) {
 		msg, _ := util.NewMsgWithAnswer(fmt.Sprintf("example.com IN A 123.124.122.122"))
@@ -267,7 +367,7 @@ func BenchmarkServerExternalResolver(b *testing.B) {
 		Upstream: config.UpstreamConfig{
 			ExternalResolvers: []config.Upstream{upstreamExternal},
 		},
-		Port: 55555,
+		Port: config.ListenConfig{"55555"},
 	})
 
 	assert.NoError(b, err)
@@ -288,6 +388,104 @@ func BenchmarkServerExternalResolver(b *testing.B) {
 	})
 }
 
+// sends queries for different domains with 10000 queries per second over one UDP socket (like dnsperf) and reports
+// the share of answered queries and the max heap size during the load. Queries over the limit of concurrent requests
+// are dropped. Example: go test ./server -run none -bench ServerLoad -benchtime 50000x
+func BenchmarkServerLoad10kQPS(b *testing.B) {
+	const interval = time.Second / 10000
+
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		msg, _ := util.NewMsgWithAnswer(fmt.Sprintf("%s 300 IN A 123.124.122.122", request.Question[0].Name))
+		return msg
+	})
+
+	server, err := NewServer(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port:                  config.ListenConfig{"55572"},
+		MaxConcurrentRequests: 100,
+	})
+	assert.NoError(b, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("udp", "127.0.0.1:55572")
+	assert.NoError(b, err)
+
+	defer conn.Close()
+
+	var answered int
+
+	received := make(chan struct{})
+
+	go func() {
+		defer close(received)
+
+		buffer := make([]byte, dns.MaxMsgSize)
+
+		for {
+			if _, err := conn.Read(buffer); err != nil {
+				return
+			}
+			answered++
+		}
+	}()
+
+	var maxHeap uint64
+
+	stopSampling := make(chan struct{})
+
+	go func() {
+		var m runtime.MemStats
+
+		for {
+			select {
+			case <-stopSampling:
+				return
+			case <-time.After(10 * time.Millisecond):
+				runtime.ReadMemStats(&m)
+
+				if m.HeapInuse > atomic.LoadUint64(&maxHeap) {
+					atomic.StoreUint64(&maxHeap, m.HeapInuse)
+				}
+			}
+		}
+	}()
+
+	b.ResetTimer()
+
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		if wait := time.Until(start.Add(time.Duration(i) * interval)); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		msg := util.NewMsgWithQuestion(fmt.Sprintf("domain%d.example.com.", i), dns.TypeA)
+		msg.Id = uint16(i)
+
+		packed, _ := msg.Pack()
+		_, _ = conn.Write(packed)
+	}
+
+	qps := float64(b.N) / time.Since(start).Seconds()
+
+	// wait for the last answers
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	<-received
+
+	b.StopTimer()
+	close(stopSampling)
+
+	b.ReportMetric(float64(answered)/float64(b.N), "answered/op")
+	b.ReportMetric(qps, "qps")
+	b.ReportMetric(float64(atomic.LoadUint64(&maxHeap))/1024/1024, "max-heap-MB")
+}
+
 func requestServer(request *dns.Msg) *dns.Msg {
 	conn, err := net.Dial("udp", ":55555")
 	if err != nil {
@@ -322,3 +520,837 @@ func requestServer(request *dns.Msg) *dns.Msg {
 
 	return nil
 }
+
+func Test_parseBindAddress(t *testing.T) {
+	ip, err := parseBindAddress("")
+	assert.NoError(t, err)
+	assert.Nil(t, ip)
+
+	ip, err = parseBindAddress("127.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:53", listenAddress(ip, 53))
+
+	ip, err = parseBindAddress("0.0.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:53", listenAddress(ip, 53))
+
+	_, err = parseBindAddress("localhost")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid bind address")
+
+	// documentation address, not assigned to any interface
+	_, err = parseBindAddress("192.0.2.1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not assignable")
+}
+
+func Test_parseBindAddress_IPv6(t *testing.T) {
+	ip, err := parseBindAddress("[::]")
+	assert.NoError(t, err)
+	assert.Equal(t, "[::]:53", listenAddress(ip, 53))
+	assert.Equal(t, ":53", listenAddress(nil, 53))
+}
+
+func TestNewServer_InvalidBindAddress(t *testing.T) {
+	_, err := NewServer(&config.Config{
+		Port:        config.ListenConfig{"55556"},
+		BindAddress: "999.1.1.1",
+	})
+
+	assert.Error(t, err)
+}
+
+func Test_resolveListenAddresses(t *testing.T) {
+	addresses, err := resolveListenAddresses(config.ListenConfig{"53", "127.0.0.1:5353", "[::]:5354", ":5355"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":53", "127.0.0.1:5353", "[::]:5354", ":5355"}, addresses)
+
+	// bind address is used for entries without host
+	addresses, err = resolveListenAddresses(config.ListenConfig{"53", "[::]:5354"}, net.ParseIP("127.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:53", "[::]:5354"}, addresses)
+
+	// default port
+	addresses, err = resolveListenAddresses(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":53"}, addresses)
+
+	_, err = resolveListenAddresses(config.ListenConfig{"abc"}, nil)
+	assert.Error(t, err)
+
+	_, err = resolveListenAddresses(config.ListenConfig{"127.0.0.1:65536"}, nil)
+	assert.Error(t, err)
+
+	_, err = resolveListenAddresses(config.ListenConfig{"[::1:53"}, nil)
+	assert.Error(t, err)
+}
+
+func TestDnsRequest_MultipleListeners(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer(fmt.Sprintf("%s %d %s %s %s",
+			util.ExtractDomain(request.Question[0]), 123, "IN", "A", "123.124.122.122"))
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	server, err := NewServer(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port: config.ListenConfig{"127.0.0.1:55558", "55559"},
+	})
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, address := range []string{"127.0.0.1:55558", "127.0.0.1:55559"} {
+		for _, network := range []string{"udp", "tcp"} {
+			client := &dns.Client{Net: network}
+			response, _, err := client.Exchange(util.NewMsgWithQuestion("google.de.", dns.TypeA), address)
+			assert.NoError(t, err)
+			assert.Equal(t, "123.124.122.122", response.Answer[0].(*dns.A).A.String())
+		}
+	}
+}
+
+func TestStop_WaitsForInFlightQueries(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		time.Sleep(200 * time.Millisecond)
+
+		response, err := util.NewMsgWithAnswer(fmt.Sprintf("%s %d %s %s %s",
+			util.ExtractDomain(request.Question[0]), 123, "IN", "A", "123.124.122.122"))
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	server, err := NewServer(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port:            config.ListenConfig{"55560"},
+		ShutdownTimeout: 2,
+	})
+	assert.NoError(t, err)
+
+	server.Start()
+
+	time.Sleep(100 * time.Millisecond)
+
+	result := make(chan *dns.Msg)
+
+	go func() {
+		client := &dns.Client{Net: "tcp"}
+		response, _, err := client.Exchange(util.NewMsgWithQuestion("google.de.", dns.TypeA), "127.0.0.1:55560")
+		assert.NoError(t, err)
+		result <- response
+	}()
+
+	// stop server while the query is processed
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+
+	server.Stop()
+
+	// stop waits for the in-flight query
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	response := <-result
+	assert.Equal(t, "123.124.122.122", response.Answer[0].(*dns.A).A.String())
+}
+
+func TestReload(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer(fmt.Sprintf("%s %d %s %s %s",
+			util.ExtractDomain(request.Question[0]), 123, "IN", "A", "123.124.122.122"))
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	var conditionalCalls int32
+
+	conditional := config.ConditionalUpstreamConfig{
+		Mapping: map[string]config.ConditionalMapping{
+			"fritz.box": {Upstreams: config.Upstreams{resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+				atomic.AddInt32(&conditionalCalls, 1)
+
+				response, err := util.NewMsgWithAnswer(request.Question[0].Name + " 300 IN A 192.168.178.2")
+				assert.NoError(t, err)
+
+				return response
+			})}},
+		},
+		Caching: config.ConditionalCachingConfig{Enabled: true},
+	}
+
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		CustomDNS: config.CustomDNSConfig{
+			Mapping: map[string]config.CustomDNSEntries{"custom.lan": {"A 192.168.178.55"}},
+		},
+		Conditional: conditional,
+		Port:        config.ListenConfig{"55561"},
+	}
+
+	server, err := NewServer(cfg)
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := &dns.Client{Net: "tcp"}
+
+	response, _, err := client.Exchange(util.NewMsgWithQuestion("custom.lan.", dns.TypeA), "127.0.0.1:55561")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.178.55", response.Answer[0].(*dns.A).A.String())
+
+	// fill the cache
+	_, _, err = client.Exchange(util.NewMsgWithQuestion("google.de.", dns.TypeA), "127.0.0.1:55561")
+	assert.NoError(t, err)
+
+	_, _, err = client.Exchange(util.NewMsgWithQuestion("nas.fritz.box.", dns.TypeA), "127.0.0.1:55561")
+	assert.NoError(t, err)
+
+	oldCache := findCachingResolver(server.getResolver())
+
+	server.Reload(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		CustomDNS: config.CustomDNSConfig{
+			Mapping: map[string]config.CustomDNSEntries{"custom.lan": {"A 192.168.178.66"}},
+		},
+		Conditional: conditional,
+		Port:        config.ListenConfig{"55561"},
+	})
+
+	// new configuration is used
+	response, _, err = client.Exchange(util.NewMsgWithQuestion("custom.lan.", dns.TypeA), "127.0.0.1:55561")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.178.66", response.Answer[0].(*dns.A).A.String())
+
+	// cache is preserved
+	newCache := findCachingResolver(server.getResolver())
+	assert.True(t, oldCache != newCache)
+	assert.ElementsMatch(t, oldCache.Configuration(), newCache.Configuration())
+
+	// conditional cache is preserved
+	response, _, err = client.Exchange(util.NewMsgWithQuestion("nas.fritz.box.", dns.TypeA), "127.0.0.1:55561")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.178.2", response.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conditionalCalls))
+	assert.NotZero(t, newCache.CacheEntries())
+
+	// changed caching configuration: cache is reset
+	server.Reload(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Caching:     config.CachingConfig{MaxItemsCount: 100},
+		Conditional: conditional,
+		Port:        config.ListenConfig{"55561"},
+	})
+
+	assert.Zero(t, findCachingResolver(server.getResolver()).CacheEntries())
+}
+
+func TestReloadFromFile_KeepsConfigurationOnError(t *testing.T) {
+	server, err := NewServer(&config.Config{
+		Port: config.ListenConfig{"55562"},
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{{Net: "udp", Host: "127.0.0.1", Port: 53}},
+		},
+	})
+	assert.NoError(t, err)
+
+	oldResolver := server.getResolver()
+
+	// no config file in the current directory
+	server.reloadFromFile()
+
+	assert.Equal(t, oldResolver, server.getResolver())
+}
+
+func TestReload_KeepsConfigurationOnResolverError(t *testing.T) {
+	cfg := &config.Config{
+		Port: config.ListenConfig{"55563"},
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{{Net: "udp", Host: "127.0.0.1", Port: 53}},
+		},
+	}
+
+	server, err := NewServer(cfg)
+	assert.NoError(t, err)
+
+	oldResolver := server.getResolver()
+
+	// runtime condition, which is not checked by the validation
+	server.Reload(&config.Config{
+		Port:     config.ListenConfig{"55563"},
+		Upstream: cfg.Upstream,
+		QueryLog: config.QueryLogConfig{Dir: "/does/not/exist"},
+	})
+
+	assert.Equal(t, oldResolver, server.getResolver())
+	assert.Equal(t, cfg, server.cfg)
+}
+
+func TestBlockingAPI(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer("blocked.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	file := helpertest.TempFile("blocked.com")
+	defer os.Remove(file.Name())
+
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Blocking: config.BlockingConfig{
+			BlackLists:        map[string][]string{"ads": {file.Name()}},
+			ClientGroupsBlock: map[string][]string{"default": {"ads"}},
+		},
+		Port:     config.ListenConfig{"55563"},
+		HTTPPort: 55564,
+	}
+
+	server, err := NewServer(cfg)
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	resolve := func() string {
+		response, _, err := (&dns.Client{}).Exchange(util.NewMsgWithQuestion("blocked.com.", dns.TypeA), "127.0.0.1:55563")
+		assert.NoError(t, err)
+
+		return response.Answer[0].(*dns.A).A.String()
+	}
+
+	assert.Equal(t, "0.0.0.0", resolve())
+
+	resp, err := http.Post("http://127.0.0.1:55564"+api.PathBlockingDisable+"?duration=5m", "", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "123.124.122.122", resolve())
+
+	// state is preserved on reload
+	server.Reload(cfg)
+
+	resp, err = http.Get("http://127.0.0.1:55564" + api.PathBlockingStatus)
+	assert.NoError(t, err)
+
+	var status api.BlockingStatus
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+
+	assert.False(t, status.Enabled)
+	assert.True(t, status.AutoEnableInSec > 0 && status.AutoEnableInSec <= 300)
+
+	resp, err = http.Post("http://127.0.0.1:55564"+api.PathBlockingEnable, "", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "0.0.0.0", resolve())
+
+	// list refresh
+	assert.NoError(t, ioutil.WriteFile(file.Name(), []byte("other.com"), 0600))
+
+	resp, err = http.Post("http://127.0.0.1:55564"+api.PathListsRefresh, "", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, "123.124.122.122", resolve())
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port:        config.ListenConfig{"55565"},
+		MetricsPort: 55566,
+	}
+
+	server, err := NewServer(cfg)
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, _, err = (&dns.Client{}).Exchange(util.NewMsgWithQuestion("example.com.", dns.TypeA), "127.0.0.1:55565")
+	assert.NoError(t, err)
+
+	resp, err := http.Get("http://127.0.0.1:55566" + metrics.Path)
+	assert.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `blocky_query_total{rcode="NOERROR",type="A"}`)
+	assert.Contains(t, string(body), "blocky_cache_miss_total")
+}
+
+func TestCreateUpstreamResolver(t *testing.T) {
+	cfg := config.UpstreamConfig{
+		ExternalResolvers: []config.Upstream{
+			{Net: "udp", Host: "8.8.8.8", Port: 53},
+			{Net: "udp", Host: "1.1.1.1", Port: 53},
+		},
+	}
+
+	create := func(strategy string) resolver.Resolver {
+		r, err := createUpstreamResolver(cfg, strategy, nil)
+		assert.NoError(t, err)
+
+		return r
+	}
+
+	assert.IsType(t, &resolver.ParallelBestResolver{}, create(""))
+	assert.IsType(t, &resolver.ParallelBestResolver{}, create("parallel_best"))
+	assert.IsType(t, &resolver.RandomResolver{}, create("random"))
+	assert.IsType(t, &resolver.FailoverResolver{}, create("strict"))
+
+	_, err := createUpstreamResolver(cfg, "fastest", nil)
+	assert.Error(t, err)
+
+	// single upstream
+	cfg.ExternalResolvers = cfg.ExternalResolvers[:1]
+	assert.IsType(t, &resolver.UpstreamResolver{}, create("random"))
+
+	// upstream groups
+	cfg.Groups = map[string][]config.Upstream{"kids": {{Net: "udp", Host: "185.228.168.168", Port: 53}}}
+	assert.IsType(t, &resolver.GroupedUpstreamResolver{}, create(""))
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer("probe.example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port:              config.ListenConfig{"55567"},
+		HTTPPort:          55568,
+		HealthCheckDomain: "probe.example.com",
+	}
+
+	server, err := NewServer(cfg)
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:55568" + api.PathHealth)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// upstream is not reachable
+	server.Reload(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{{Net: "udp", Host: "127.0.0.1", Port: 1}},
+		},
+		Port:              cfg.Port,
+		HTTPPort:          cfg.HTTPPort,
+		HealthCheckDomain: "other.example.com",
+	})
+
+	resp, err = http.Get("http://127.0.0.1:55568" + api.PathHealth)
+	assert.NoError(t, err)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Contains(t, string(body), "can't resolve 'other.example.com'")
+}
+
+func TestCreateQueryResolver_Order(t *testing.T) {
+	names := func(cfg *config.Config) (result []string) {
+		r, err := createQueryResolver(cfg)
+		assert.NoError(t, err)
+
+		resolver.ForEach(r, func(res resolver.Resolver) {
+			result = append(result, fmt.Sprintf("%T", res))
+		})
+
+		return
+	}
+
+	defaultOrder := names(&config.Config{})
+	assert.Len(t, defaultOrder, len(config.DefaultResolverOrder)+1)
+	assert.Equal(t, "*resolver.RateLimitingResolver", defaultOrder[0])
+
+	// custom DNS before conditional
+	order := append([]string{}, config.DefaultResolverOrder...)
+	order[8], order[9] = order[9], order[8]
+
+	customOrder := names(&config.Config{ResolverOrder: order})
+	assert.Equal(t, defaultOrder[8], customOrder[9])
+	assert.Equal(t, defaultOrder[9], customOrder[8])
+	assert.Equal(t, "*resolver.CustomDNSResolver", customOrder[8])
+	assert.Equal(t, defaultOrder[len(defaultOrder)-1], customOrder[len(customOrder)-1])
+}
+
+func TestStatusAPI(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	file := helpertest.TempFile("blocked.com\nblocked2.com")
+	defer os.Remove(file.Name())
+
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream, upstream},
+		},
+		Blocking: config.BlockingConfig{
+			BlackLists:        map[string][]string{"ads": {file.Name()}},
+			ClientGroupsBlock: map[string][]string{"default": {"ads"}},
+		},
+		Port:     config.ListenConfig{"55569"},
+		HTTPPort: 55570,
+	}
+
+	server, err := NewServer(cfg)
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, _, err = (&dns.Client{}).Exchange(util.NewMsgWithQuestion("example.com.", dns.TypeA), "127.0.0.1:55569")
+	assert.NoError(t, err)
+
+	resp, err := http.Get("http://127.0.0.1:55570" + api.PathStatus)
+	assert.NoError(t, err)
+
+	var status api.Status
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+
+	assert.True(t, status.Blocking.Enabled)
+	assert.Equal(t, 1, status.CacheEntries)
+	assert.Contains(t, status.Lists, api.ListStatus{Type: "blacklist", Entries: map[string]int{"ads": 2},
+		LastRefresh: status.Lists[0].LastRefresh})
+	assert.Len(t, status.Upstreams, 2)
+	assert.Equal(t, "rate limiting resolver", status.Resolvers[0].Name)
+	assert.Contains(t, status.Resolvers[len(status.Resolvers)-1].Name, "parallel best resolver")
+
+	resp, err = http.Get("http://127.0.0.1:55570" + api.PathStats)
+	assert.NoError(t, err)
+
+	var stats api.Stats
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotNil(t, stats.TopQueries)
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		time.Sleep(500 * time.Millisecond)
+
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	server, err := NewServer(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port:                  config.ListenConfig{"55571"},
+		MaxConcurrentRequests: 1,
+	})
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// first request occupies the only slot
+	done := make(chan *dns.Msg)
+
+	go func() {
+		resp, _, err := (&dns.Client{Net: "tcp"}).Exchange(util.NewMsgWithQuestion("example.com.", dns.TypeA),
+			"127.0.0.1:55571")
+		assert.NoError(t, err)
+		done <- resp
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// TCP: SERVFAIL
+	resp, _, err := (&dns.Client{Net: "tcp"}).Exchange(util.NewMsgWithQuestion("other.com.", dns.TypeA),
+		"127.0.0.1:55571")
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	// UDP: dropped
+	_, _, err = (&dns.Client{Timeout: 250 * time.Millisecond}).Exchange(
+		util.NewMsgWithQuestion("other.com.", dns.TypeA), "127.0.0.1:55571")
+	assert.Error(t, err)
+
+	resp = <-done
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+}
+
+func TestUnsupportedRequests(t *testing.T) {
+	var upstreamCalls int32
+
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		atomic.AddInt32(&upstreamCalls, 1)
+
+		response, err := util.NewMsgWithAnswer("example.com 123 IN A 123.124.122.122")
+
+		assert.NoError(t, err)
+		return response
+	})
+
+	server, err := NewServer(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port: config.ListenConfig{"55574"},
+	})
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := &dns.Client{Net: "tcp"}
+
+	// NOTIFY
+	notify := util.NewMsgWithQuestion("example.com.", dns.TypeSOA)
+	notify.Opcode = dns.OpcodeNotify
+	resp, _, err := client.Exchange(notify, "127.0.0.1:55574")
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeNotImplemented, resp.Rcode)
+
+	// zone transfers
+	for _, qType := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		resp, _, err = client.Exchange(util.NewMsgWithQuestion("example.com.", qType), "127.0.0.1:55574")
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	}
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&upstreamCalls))
+
+	// regular query is resolved
+	resp, _, err = client.Exchange(util.NewMsgWithQuestion("example.com.", dns.TypeA), "127.0.0.1:55574")
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+}
+
+func Test_rejectUnsupported(t *testing.T) {
+	update := util.NewMsgWithQuestion("example.com.", dns.TypeSOA)
+	update.Opcode = dns.OpcodeUpdate
+	assert.Equal(t, dns.RcodeNotImplemented, rejectUnsupported(update).Rcode)
+
+	// no question
+	resp := rejectUnsupported(new(dns.Msg))
+	assert.Equal(t, dns.RcodeFormatError, resp.Rcode)
+	assert.Empty(t, resp.Question)
+
+	resp = rejectUnsupported(util.NewMsgWithQuestion("example.com.", dns.TypeAXFR))
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	assert.Equal(t, "example.com.", resp.Question[0].Name)
+
+	assert.Nil(t, rejectUnsupported(util.NewMsgWithQuestion("example.com.", dns.TypeA)))
+}
+
+func TestDnsRequest_Truncation(t *testing.T) {
+	var records config.CustomDNSEntries
+	for i := 0; i < 10; i++ {
+		records = append(records, fmt.Sprintf("TXT %d%s", i, strings.Repeat("x", 200)))
+	}
+
+	server, err := NewServer(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{{Net: "udp", Host: "127.0.0.1", Port: 53}},
+		},
+		CustomDNS: config.CustomDNSConfig{
+			Mapping: map[string]config.CustomDNSEntries{"large.lan": records},
+		},
+		Port: config.ListenConfig{"55576"},
+	})
+	assert.NoError(t, err)
+
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	query := func(net string, bufSize uint16) *dns.Msg {
+		msg := util.NewMsgWithQuestion("large.lan.", dns.TypeTXT)
+		if bufSize > 0 {
+			msg.SetEdns0(bufSize, false)
+		}
+
+		client := &dns.Client{Net: net, UDPSize: dns.MaxMsgSize}
+		response, _, err := client.Exchange(msg, "127.0.0.1:55576")
+		assert.NoError(t, err)
+
+		return response
+	}
+
+	// without EDNS: max 512 bytes
+	response := query("udp", 0)
+	assert.True(t, response.Truncated)
+	assert.True(t, len(response.Answer) < 10)
+	assert.True(t, response.Len() <= dns.MinMsgSize)
+
+	// EDNS buffer size of the client is used
+	response = query("udp", 1232)
+	assert.True(t, response.Truncated)
+	assert.True(t, response.Len() <= 1232)
+
+	response = query("udp", 4096)
+	assert.False(t, response.Truncated)
+	assert.Len(t, response.Answer, 10)
+
+	// full answer over TCP
+	response = query("tcp", 0)
+	assert.False(t, response.Truncated)
+	assert.Len(t, response.Answer, 10)
+
+	// cached answers are not modified by truncation
+	response = query("udp", 0)
+	assert.True(t, response.Truncated)
+
+	response = query("tcp", 0)
+	assert.Len(t, response.Answer, 10)
+}
+
+func TestTruncateForClient_MinBufferSize(t *testing.T) {
+	w := &discardResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}
+
+	request := util.NewMsgWithQuestion("large.lan.", dns.TypeTXT)
+	request.SetEdns0(100, false)
+
+	response := new(dns.Msg)
+	response.SetReply(request)
+
+	for i := 0; i < 2; i++ {
+		rr, err := dns.NewRR(fmt.Sprintf("large.lan. 300 IN TXT %d%s", i, strings.Repeat("x", 100)))
+		assert.NoError(t, err)
+
+		response.Answer = append(response.Answer, rr)
+	}
+
+	// EDNS buffer sizes below 512 bytes are treated as 512
+	assert.True(t, response.Len() > 100 && response.Len() <= dns.MinMsgSize)
+	assert.Equal(t, response, truncateForClient(w, request, response))
+
+	request.IsEdns0().SetUDPSize(0)
+	assert.Equal(t, response, truncateForClient(w, request, response))
+}
+
+// response writer, which discards written messages
+type discardResponseWriter struct {
+	dns.ResponseWriter
+	remoteAddr net.Addr
+	written    int
+}
+
+func (w *discardResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *discardResponseWriter) Write(data []byte) (int, error) {
+	w.written++
+	return len(data), nil
+}
+
+// measures the processing of a cached query with the default resolver chain, without network. Example:
+// go test ./server -run none -bench CacheHit -benchmem
+func BenchmarkCacheHit(b *testing.B) {
+	upstream := resolver.TestUDPUpstream(func(request *dns.Msg) *dns.Msg {
+		msg, _ := util.NewMsgWithAnswer(fmt.Sprintf("%s 300 IN A 123.124.122.122", request.Question[0].Name))
+		return msg
+	})
+
+	server, err := NewServer(&config.Config{
+		Upstream: config.UpstreamConfig{
+			ExternalResolvers: []config.Upstream{upstream},
+		},
+		Port: config.ListenConfig{"55577"},
+	})
+	assert.NoError(b, err)
+
+	// without console query log (info level)
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.WarnLevel)
+
+	request := util.NewMsgWithQuestion("example.com.", dns.TypeA)
+	w := &discardResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.178.10"), Port: 50000}}
+
+	// fill the cache
+	server.OnRequest(w, request)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		server.OnRequest(w, request)
+	}
+
+	b.StopTimer()
+
+	assert.Equal(b, b.N+1, w.written)
+}
@@ -10,6 +10,10 @@ import (
 const (
 	defaultMaxCount = 50
 	hours           = 24
+	// max number of distinct keys counted in the current hour, least frequent keys are dropped if exceeded
+	maxTrackedKeys = 10000
+	// format of hour keys: date with hour
+	hourLayout = "2006010215"
 )
 
 // nolint
@@ -42,8 +46,8 @@ func NewAggregatorWithMax(name string, maxCount uint) *Aggregator {
 func (s *Aggregator) AggregateResult() map[string]int {
 	result := make(map[string]int)
 
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	s.hourSwitch()
 
@@ -62,7 +66,14 @@ func (s *Aggregator) AggregateResult() map[string]int {
 
 // returns current date with hour
 func currentHour() string {
-	return now().Format("2006010215")
+	return now().Format(hourLayout)
+}
+
+// checks if the hour is the current hour, without allocation (called for each query)
+func isCurrentHour(hour string) bool {
+	var buf [len(hourLayout)]byte
+
+	return string(now().AppendFormat(buf[:0], hourLayout)) == hour
 }
 
 func (s *Aggregator) Put(key string) {
@@ -76,23 +87,26 @@ func (s *Aggregator) Put(key string) {
 		if val, ok := s.stageData[key]; ok {
 			s.stageData[key] = val + 1
 		} else {
+			if len(s.stageData) >= maxTrackedKeys {
+				s.stageData = getMaxValues(s.stageData, maxTrackedKeys/2)
+			}
+
 			s.stageData[key] = 1
 		}
 	}
 }
 
 func (s *Aggregator) hourSwitch() {
-	hour := currentHour()
-	if hour == s.currentHour {
+	if isCurrentHour(s.currentHour) {
 		return
 	}
 
+	hour := currentHour()
+
 	s.hourResults[s.currentHour] = getMaxValues(s.stageData, s.maxCount*2)
 
 	for k := range s.hourResults {
-		h, _ := time.Parse("2006010215", k)
-
-		if h.Before(now().Add(-1 * hours * time.Hour)) {
+		if isExpired(k) {
 			delete(s.hourResults, k)
 		}
 	}
@@ -101,6 +115,71 @@ func (s *Aggregator) hourSwitch() {
 	s.stageData = make(map[string]int)
 }
 
+// returns true if the hour is older than 24 hours
+func isExpired(hour string) bool {
+	h, _ := time.Parse(hourLayout, hour)
+
+	return h.Before(now().Add(-1 * hours * time.Hour))
+}
+
+// Counter counts events in hourly buckets, the sum contains the completed hours of the last 24 hours
+type Counter struct {
+	hourResults map[string]int
+	Name        string
+	currentHour string
+	lock        sync.Mutex
+	stageCount  int
+}
+
+func NewCounter(name string) *Counter {
+	return &Counter{
+		Name:        name,
+		hourResults: make(map[string]int),
+		currentHour: currentHour(),
+	}
+}
+
+func (c *Counter) Inc() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.hourSwitch()
+
+	c.stageCount++
+}
+
+func (c *Counter) Sum() (result int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.hourSwitch()
+
+	for _, v := range c.hourResults {
+		result += v
+	}
+
+	return
+}
+
+func (c *Counter) hourSwitch() {
+	if isCurrentHour(c.currentHour) {
+		return
+	}
+
+	hour := currentHour()
+
+	c.hourResults[c.currentHour] = c.stageCount
+
+	for k := range c.hourResults {
+		if isExpired(k) {
+			delete(c.hourResults, k)
+		}
+	}
+
+	c.currentHour = hour
+	c.stageCount = 0
+}
+
 func getMaxValues(in map[string]int, maxCount int) map[string]int {
 	if len(in) <= maxCount {
 		return in
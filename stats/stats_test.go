@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -167,3 +168,61 @@ func Test_Put_Empty(t *testing.T) {
 
 	assert.Len(t, res, 1)
 }
+
+func Test_Put_LimitsTrackedKeys(t *testing.T) {
+	mockTime := "20200106_0101"
+	now = func() time.Time {
+		t, _ := time.Parse("20060102_1505", mockTime)
+		return t
+	}
+	s := NewAggregatorWithMax("test", 3)
+
+	for i := 0; i < 5; i++ {
+		s.Put("frequent")
+	}
+
+	for i := 0; i < maxTrackedKeys*2; i++ {
+		s.Put(fmt.Sprintf("key%d", i))
+	}
+
+	assert.True(t, len(s.stageData) <= maxTrackedKeys)
+
+	// change hour
+	mockTime = "20200106_0201"
+
+	res := s.AggregateResult()
+
+	assert.Len(t, res, 3)
+	assert.Equal(t, 5, res["frequent"])
+}
+
+func Test_Counter(t *testing.T) {
+	mockTime := "20200107_0101"
+	now = func() time.Time {
+		t, _ := time.Parse("20060102_1505", mockTime)
+		return t
+	}
+	c := NewCounter("test")
+
+	c.Inc()
+	c.Inc()
+
+	// current hour is not included
+	assert.Equal(t, 0, c.Sum())
+
+	// change hour
+	mockTime = "20200107_0201"
+
+	c.Inc()
+	assert.Equal(t, 2, c.Sum())
+
+	// change hour
+	mockTime = "20200107_0301"
+
+	assert.Equal(t, 3, c.Sum())
+
+	// change day: first two hours are older than 24h
+	mockTime = "20200108_0251"
+
+	assert.Equal(t, 0, c.Sum())
+}
@@ -9,17 +9,18 @@ import (
 	"github.com/miekg/dns"
 )
 
-func QTypeToString() func(uint16) string {
-	innerMap := map[uint16]string{
-		dns.TypeA:     "A",
-		dns.TypeAAAA:  "AAAA",
-		dns.TypeCNAME: "CNAME",
-		dns.TypePTR:   "PTR",
-		dns.TypeMX:    "MX",
-	}
+// nolint:gochecknoglobals
+var qTypeNames = map[uint16]string{
+	dns.TypeA:     "A",
+	dns.TypeAAAA:  "AAAA",
+	dns.TypeCNAME: "CNAME",
+	dns.TypePTR:   "PTR",
+	dns.TypeMX:    "MX",
+}
 
+func QTypeToString() func(uint16) string {
 	return func(key uint16) string {
-		return innerMap[key]
+		return qTypeNames[key]
 	}
 }
 
@@ -45,14 +46,23 @@ func AnswerToString(answer []dns.RR) string {
 }
 
 func QuestionToString(questions []dns.Question) string {
+	// common case, called for each query
+	if len(questions) == 1 {
+		return questionToString(questions[0])
+	}
+
 	result := make([]string, len(questions))
 	for i, question := range questions {
-		result[i] = fmt.Sprintf("%s (%s)", QTypeToString()(question.Qtype), question.Name)
+		result[i] = questionToString(question)
 	}
 
 	return strings.Join(result, ", ")
 }
 
+func questionToString(question dns.Question) string {
+	return qTypeNames[question.Qtype] + " (" + question.Name + ")"
+}
+
 func CreateAnswerFromQuestion(question dns.Question, ip net.IP, remainingTTL uint32) (dns.RR, error) {
 	return dns.NewRR(fmt.Sprintf("%s %d %s %s %s", question.Name, remainingTTL, "IN", QTypeToString()(question.Qtype), ip))
 }
@@ -100,3 +110,43 @@ func IterateValueSorted(in map[string]int, fn func(string, int)) {
 		fn(kv.key, kv.value)
 	}
 }
+
+// ParseIPNets parses list of IP addresses and networks in CIDR notation, IP address is a network with single address
+func ParseIPNets(entries []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(entries))
+
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+
+		if ip := net.ParseIP(e); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or network '%s'", e)
+		}
+
+		result = append(result, network)
+	}
+
+	return result, nil
+}
+
+// ContainsIP returns true if the IP is in one of the networks
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,10 @@
+package util
+
+// set on build with ldflags, e.g. -X blocky/util.Version=v1.0
+// nolint:gochecknoglobals
+var (
+	// Version of blocky
+	Version = "undefined"
+	// BuildTime of the binary
+	BuildTime = "undefined"
+)
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"blocky/config"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const listCheckTimeout = 10 * time.Second
+
+// validate checks the configuration file and prints all problems. Returns the exit code: 0 if the configuration
+// is valid (warnings are allowed), 1 otherwise
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	path := flags.String("config", config.DefaultPath, "path of the configuration file or directory")
+	skipLists := flags.Bool("skip-lists", false, "don't check if black and white lists are reachable")
+
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	cfg, err := config.LoadConfig(*path)
+	if err != nil {
+		fmt.Printf("ERROR   %v\n", err)
+		return 1
+	}
+
+	errs := cfg.Validate()
+
+	if !*skipLists {
+		errs = append(errs, checkLists("blocking.blackLists", cfg.Blocking.BlackLists)...)
+		errs = append(errs, checkLists("blocking.whiteLists", cfg.Blocking.WhiteLists)...)
+	}
+
+	for _, e := range errs {
+		level := "ERROR  "
+		if e.Warning {
+			level = "WARNING"
+		}
+
+		fmt.Printf("%s %s\n", level, e)
+	}
+
+	if len(errs.Fatal()) > 0 {
+		return 1
+	}
+
+	fmt.Printf("configuration '%s' is valid\n", *path)
+
+	return 0
+}
+
+// checks that list files exist and list URLs are reachable, lists which can't be loaded are skipped by the server
+func checkLists(path string, lists map[string][]string) (result config.ValidationErrors) {
+	groups := make([]string, 0, len(lists))
+	for g := range lists {
+		groups = append(groups, g)
+	}
+
+	sort.Strings(groups)
+
+	client := &http.Client{Timeout: listCheckTimeout}
+
+	for _, group := range groups {
+		for i, link := range lists[group] {
+			if err := checkList(client, link); err != nil {
+				result = append(result, config.ValidationError{
+					Path:    fmt.Sprintf("%s.%s[%d]", path, group, i),
+					Message: err.Error(),
+					Warning: true,
+				})
+			}
+		}
+	}
+
+	return
+}
+
+func checkList(client *http.Client, link string) error {
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		_, err := os.Stat(link)
+		return err
+	}
+
+	resp, err := client.Get(link)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("list '%s' returned status code %d", link, resp.StatusCode)
+	}
+
+	return nil
+}